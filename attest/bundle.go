@@ -0,0 +1,221 @@
+package attest
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"time"
+)
+
+// BUNDLE_VERSION is the version of the bundle format written by the agent
+const BUNDLE_VERSION = 1
+
+// Bundle is everything needed to check offline that an SSH public key lives in a TPM, as exported by the agent
+type Bundle struct {
+	Version int    `json:"version"`
+	Name    string `json:"name,omitempty"`
+	// PublicKey is the SSH public key in authorized_keys format
+	PublicKey string `json:"publicKey"`
+	// Nonce is the qualifying data the verifier asked for, empty when none was given
+	Nonce []byte `json:"nonce,omitempty"`
+	// KeyAttestation is the PCP_KEY_ATTESTATION_BLOB of the key
+	KeyAttestation []byte `json:"keyAttestation"`
+	// AIKCertificates are the DER certificate of the attestation identity key followed by its intermediates
+	AIKCertificates [][]byte `json:"aikCertificates"`
+	// EKCertificate is the DER certificate of the TPM's endorsement key, empty when the TPM has none
+	EKCertificate []byte `json:"ekCertificate,omitempty"`
+}
+
+// ReadBundle reads a bundle written by WriteFile
+func ReadBundle(path string) (*Bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bundle{}
+	if err = json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("unable to parse attestation bundle %s: %w", path, err)
+	}
+	return b, nil
+}
+
+// WriteFile writes the bundle as JSON
+func (b *Bundle) WriteFile(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// ReadCertificates reads the PEM certificates of a file, for the roots of the verifier or an AIK certificate chain
+func ReadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse a certificate of %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", path)
+	}
+	return certs, nil
+}
+
+// VerifyOptions configure Verify
+type VerifyOptions struct {
+	// Roots are the trusted CAs of attestation identity keys and endorsement keys
+	Roots *x509.CertPool
+	// Nonce is the qualifying data the attestation must carry, nil to accept any
+	Nonce []byte
+	// CurrentTime checks the certificates at a given time, the zero time is now
+	CurrentTime time.Time
+	// RequireEK fails bundles without an endorsement key certificate. The certificate only has to chain to the roots,
+	// nothing in the bundle ties it to the AIK, see Result.EK.
+	RequireEK bool
+}
+
+// Result is what a verified bundle proves
+type Result struct {
+	PublicKey ssh.PublicKey
+	// AIK is the verified certificate of the key that signed the attestation
+	AIK *x509.Certificate
+	// EK is the bundle's endorsement key certificate, nil when the bundle has none. It chains to the roots, but an
+	// offline bundle can't show that it belongs to the TPM of the AIK: that takes credential activation with the TPM.
+	// It names the TPM the exporting agent reported, trust in the key rests on the AIK certificate.
+	EK *x509.Certificate
+	// Attributes are the TPM object attributes of the key
+	Attributes      uint32
+	FirmwareVersion uint64
+}
+
+// Verify checks that the key of the bundle is a non-exportable key of a TPM whose attestation identity key chains up
+// to the roots: the AIK certificate chain, the AIK's signature over the TPMS_ATTEST, the name of the key in it against
+// the key's public area and that public area against the SSH public key
+func Verify(b *Bundle, opts VerifyOptions) (*Result, error) {
+	if b.Version != BUNDLE_VERSION {
+		return nil, fmt.Errorf("unsupported attestation bundle version %d", b.Version)
+	}
+	if opts.Roots == nil {
+		return nil, fmt.Errorf("no attestation roots configured")
+	}
+
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(b.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the bundle's public key: %w", err)
+	}
+	res := &Result{PublicKey: sshKey}
+
+	// certificate chains, the EK certificate may have the same intermediates
+	if len(b.AIKCertificates) == 0 {
+		return nil, fmt.Errorf("the bundle has no AIK certificate")
+	}
+	intermediates := x509.NewCertPool()
+	var certs []*x509.Certificate
+	for _, der := range b.AIKCertificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse an AIK certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	verifyOpts := x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   opts.CurrentTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	res.AIK = certs[0]
+	if _, err = res.AIK.Verify(verifyOpts); err != nil {
+		return nil, fmt.Errorf("AIK certificate: %w", err)
+	}
+
+	if len(b.EKCertificate) > 0 {
+		if res.EK, err = x509.ParseCertificate(b.EKCertificate); err != nil {
+			return nil, fmt.Errorf("unable to parse the EK certificate: %w", err)
+		}
+		// the TPM manufacturer's subject alternative name is often marked critical
+		res.EK.UnhandledCriticalExtensions = nil
+		if _, err = res.EK.Verify(verifyOpts); err != nil {
+			return nil, fmt.Errorf("EK certificate: %w", err)
+		}
+	} else if opts.RequireEK {
+		return nil, fmt.Errorf("the bundle has no EK certificate")
+	}
+
+	// the TPM's statement, signed by the AIK
+	ka, err := ParseKeyAttestation(b.KeyAttestation)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := DecodeSignature(ka.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("attestation signature: %w", err)
+	}
+	if err = sig.Verify(res.AIK.PublicKey, ka.Attest); err != nil {
+		return nil, fmt.Errorf("attestation was not signed by the AIK: %w", err)
+	}
+	attest, err := DecodeAttest(ka.Attest)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Nonce != nil && !bytes.Equal(attest.ExtraData, opts.Nonce) {
+		return nil, fmt.Errorf("attestation nonce does not match")
+	}
+	res.FirmwareVersion = attest.FirmwareVersion
+
+	// the certified key
+	public, err := DecodePublic(ka.Public)
+	if err != nil {
+		return nil, fmt.Errorf("attested key: %w", err)
+	}
+	name, err := public.Name()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(name, attest.Name) {
+		return nil, fmt.Errorf("the attestation certifies another key")
+	}
+	res.Attributes = public.Attributes
+	if public.Attributes&TPMA_NON_EXPORTABLE != TPMA_NON_EXPORTABLE {
+		return nil, fmt.Errorf("the key was not generated in the TPM or can leave it, attributes 0x%08x", public.Attributes)
+	}
+	if public.Attributes&TPMA_SIGN_ENCRYPT == 0 {
+		return nil, fmt.Errorf("the key is not a signing key")
+	}
+
+	pub, err := public.Key()
+	if err != nil {
+		return nil, err
+	}
+	attested, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(attested.Marshal(), sshKey.Marshal()) {
+		return nil, fmt.Errorf("the attested key is not the bundle's public key")
+	}
+
+	return res, nil
+}
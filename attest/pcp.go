@@ -0,0 +1,213 @@
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// The claim blobs of the Microsoft Platform Crypto Provider, NCryptCreateClaim of a key returns a
+// PCP_KEY_ATTESTATION_BLOB: a header followed by the TPMS_ATTEST of TPM2_Certify, its TPMT_SIGNATURE by the attestation
+// identity key and the key's PCP_KEY_BLOB_WIN8, which holds its TPM2B_PUBLIC.
+const (
+	PCP_KEY_ATTESTATION_MAGIC = uint32(0x5344414B) // 'KADS'
+	PCP_KEY_BLOB_MAGIC        = uint32(0x4D504350) // 'PCPM'
+	PCP_TPM_VERSION_20        = uint32(2)
+	pcpTypeTPM20              = uint32(2)
+)
+
+type pcpKeyAttestationHeader struct {
+	Magic       uint32
+	Platform    uint32
+	HeaderSize  uint32
+	KeyAttest   uint32
+	Signature   uint32
+	KeyBlobSize uint32
+}
+
+type pcpKeyBlobHeader struct {
+	Magic            uint32
+	HeaderSize       uint32
+	PCPType          uint32
+	Flags            uint32
+	Public           uint32
+	Private          uint32
+	MigrationPublic  uint32
+	MigrationPrivate uint32
+	PolicyDigestList uint32
+	PCRBinding       uint32
+	PCRDigest        uint32
+	EncryptedSecret  uint32
+	TPM12HostageBlob uint32
+	PCRAlgID         uint16
+	Reserved         uint16
+}
+
+// KeyAttestation is a parsed PCP_KEY_ATTESTATION_BLOB
+type KeyAttestation struct {
+	// Attest is the TPMS_ATTEST the signature is over
+	Attest    []byte
+	Signature []byte
+	// Public is the TPMT_PUBLIC of the certified key from its key blob
+	Public []byte
+}
+
+// ParseKeyAttestation splits a PCP_KEY_ATTESTATION_BLOB
+func ParseKeyAttestation(blob []byte) (*KeyAttestation, error) {
+	var h pcpKeyAttestationHeader
+	if err := binary.Read(bytes.NewReader(blob), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("key attestation header: %w", errTruncated)
+	}
+	if h.Magic != PCP_KEY_ATTESTATION_MAGIC {
+		return nil, fmt.Errorf("not a PCP key attestation, magic 0x%08x", h.Magic)
+	}
+	if h.Platform != PCP_TPM_VERSION_20 {
+		return nil, fmt.Errorf("unsupported TPM version %d, only TPM 2.0 keys can be attested", h.Platform)
+	}
+	end := uint64(h.HeaderSize) + uint64(h.KeyAttest) + uint64(h.Signature) + uint64(h.KeyBlobSize)
+	if h.HeaderSize < uint32(binary.Size(h)) || end > uint64(len(blob)) {
+		return nil, fmt.Errorf("key attestation: %w", errTruncated)
+	}
+
+	ka := &KeyAttestation{}
+	off := h.HeaderSize
+	ka.Attest = blob[off : off+h.KeyAttest]
+	off += h.KeyAttest
+	ka.Signature = blob[off : off+h.Signature]
+	off += h.Signature
+
+	public, err := parsePCPKeyBlob(blob[off : off+h.KeyBlobSize])
+	if err != nil {
+		return nil, err
+	}
+	ka.Public = public
+	return ka, nil
+}
+
+// Marshal encodes the PCP_KEY_ATTESTATION_BLOB
+func (ka *KeyAttestation) Marshal() []byte {
+	keyBlob := marshalPCPKeyBlob(ka.Public)
+	h := pcpKeyAttestationHeader{
+		Magic:       PCP_KEY_ATTESTATION_MAGIC,
+		Platform:    PCP_TPM_VERSION_20,
+		KeyAttest:   uint32(len(ka.Attest)),
+		Signature:   uint32(len(ka.Signature)),
+		KeyBlobSize: uint32(len(keyBlob)),
+	}
+	h.HeaderSize = uint32(binary.Size(h))
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	buf.Write(ka.Attest)
+	buf.Write(ka.Signature)
+	buf.Write(keyBlob)
+	return buf.Bytes()
+}
+
+// parsePCPKeyBlob returns the TPMT_PUBLIC of a PCP_KEY_BLOB_WIN8, its public part is a TPM2B_PUBLIC
+func parsePCPKeyBlob(blob []byte) ([]byte, error) {
+	var h pcpKeyBlobHeader
+	if err := binary.Read(bytes.NewReader(blob), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("key blob header: %w", errTruncated)
+	}
+	if h.Magic != PCP_KEY_BLOB_MAGIC || h.PCPType != pcpTypeTPM20 {
+		return nil, fmt.Errorf("not a PCP TPM 2.0 key blob")
+	}
+	if uint64(h.HeaderSize)+uint64(h.Public) > uint64(len(blob)) || h.Public < 2 {
+		return nil, fmt.Errorf("key blob: %w", errTruncated)
+	}
+
+	public := blob[h.HeaderSize : h.HeaderSize+h.Public]
+	if size := binary.BigEndian.Uint16(public); int(size)+2 != len(public) {
+		return nil, fmt.Errorf("key blob public area of %d bytes has size %d", len(public), size)
+	}
+	return public[2:], nil
+}
+
+// marshalPCPKeyBlob returns a PCP_KEY_BLOB_WIN8 with only a public part
+func marshalPCPKeyBlob(public []byte) []byte {
+	h := pcpKeyBlobHeader{
+		Magic:   PCP_KEY_BLOB_MAGIC,
+		PCPType: pcpTypeTPM20,
+		Public:  uint32(len(public) + 2),
+	}
+	h.HeaderSize = uint32(binary.Size(h))
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, h)
+	binary.Write(&buf, binary.BigEndian, uint16(len(public)))
+	buf.Write(public)
+	return buf.Bytes()
+}
+
+// CertifyKey returns the PCP_KEY_ATTESTATION_BLOB a TPM with the attestation key aik makes for a key with the given
+// object attributes, as TPM2_Certify with nonce as the qualifying data. It stands in for a TPM in emulators.
+func CertifyKey(aik crypto.Signer, pub crypto.PublicKey, attributes uint32, nonce []byte) ([]byte, error) {
+	public, err := NewPublic(pub, attributes)
+	if err != nil {
+		return nil, err
+	}
+	name, err := public.Name()
+	if err != nil {
+		return nil, err
+	}
+	aikPublic, err := NewPublic(aik.Public(), TPMA_NON_EXPORTABLE|TPMA_RESTRICTED|TPMA_SIGN_ENCRYPT)
+	if err != nil {
+		return nil, err
+	}
+	aikName, err := aikPublic.Name()
+	if err != nil {
+		return nil, err
+	}
+
+	attest := &Attest{
+		Magic:           TPM_GENERATED_VALUE,
+		Type:            TPM_ST_ATTEST_CERTIFY,
+		QualifiedSigner: aikName,
+		ExtraData:       nonce,
+		Safe:            true,
+		Name:            name,
+		QualifiedName:   name,
+	}
+	attestBytes := attest.Encode()
+
+	sig, err := signTPM(aik, attestBytes)
+	if err != nil {
+		return nil, err
+	}
+	ka := &KeyAttestation{Attest: attestBytes, Signature: sig.Encode(), Public: public.Encode()}
+	return ka.Marshal(), nil
+}
+
+// signTPM signs data with SHA-256 the way a TPM signing key without a scheme does
+func signTPM(signer crypto.Signer, data []byte) (*Signature, error) {
+	digest := crypto.SHA256.New()
+	digest.Write(data)
+
+	raw, err := signer.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sig := &Signature{Hash: TPM_ALG_SHA256}
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		sig.Alg = TPM_ALG_RSASSA
+		sig.RSA = raw
+	case *ecdsa.PublicKey:
+		var rs struct{ R, S *big.Int }
+		if _, err = asn1.Unmarshal(raw, &rs); err != nil {
+			return nil, err
+		}
+		sig.Alg = TPM_ALG_ECDSA
+		sig.R, sig.S = rs.R, rs.S
+	default:
+		return nil, fmt.Errorf("unsupported attestation key %T", signer.Public())
+	}
+	return sig, nil
+}
@@ -0,0 +1,414 @@
+package attest
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// TPM 2.0 constants from part 2 of the library specification, only what certifying a signing key needs
+const (
+	TPM_GENERATED_VALUE   = uint32(0xff544347)
+	TPM_ST_ATTEST_CERTIFY = uint16(0x8017)
+	TPM_ALG_RSA           = uint16(0x0001)
+	TPM_ALG_SHA1          = uint16(0x0004)
+	TPM_ALG_SHA256        = uint16(0x000B)
+	TPM_ALG_SHA384        = uint16(0x000C)
+	TPM_ALG_SHA512        = uint16(0x000D)
+	TPM_ALG_NULL          = uint16(0x0010)
+	TPM_ALG_RSASSA        = uint16(0x0014)
+	TPM_ALG_RSAPSS        = uint16(0x0016)
+	TPM_ALG_ECDSA         = uint16(0x0018)
+	TPM_ALG_ECC           = uint16(0x0023)
+	TPM_ECC_NIST_P256     = uint16(0x0003)
+	TPM_ECC_NIST_P384     = uint16(0x0004)
+	TPM_ECC_NIST_P521     = uint16(0x0005)
+	TPMA_FIXED_TPM        = uint32(0x00000002)
+	TPMA_FIXED_PARENT     = uint32(0x00000010)
+	TPMA_SENSITIVE_ORIGIN = uint32(0x00000020)
+	TPMA_USER_WITH_AUTH   = uint32(0x00000040)
+	TPMA_NO_DA            = uint32(0x00000400)
+	TPMA_RESTRICTED       = uint32(0x00010000)
+	TPMA_SIGN_ENCRYPT     = uint32(0x00040000)
+	TPMA_NON_EXPORTABLE   = TPMA_FIXED_TPM | TPMA_FIXED_PARENT | TPMA_SENSITIVE_ORIGIN
+	tpmDefaultRSAExponent = 65537
+)
+
+var tpmHashes = map[uint16]crypto.Hash{
+	TPM_ALG_SHA1:   crypto.SHA1,
+	TPM_ALG_SHA256: crypto.SHA256,
+	TPM_ALG_SHA384: crypto.SHA384,
+	TPM_ALG_SHA512: crypto.SHA512,
+}
+
+var tpmCurves = map[uint16]elliptic.Curve{
+	TPM_ECC_NIST_P256: elliptic.P256(),
+	TPM_ECC_NIST_P384: elliptic.P384(),
+	TPM_ECC_NIST_P521: elliptic.P521(),
+}
+
+var errTruncated = errors.New("truncated TPM structure")
+
+// tpmReader reads the big endian TPM wire format, the first error sticks
+type tpmReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (t *tpmReader) u16() uint16 {
+	var v uint16
+	t.read(&v)
+	return v
+}
+
+func (t *tpmReader) u32() uint32 {
+	var v uint32
+	t.read(&v)
+	return v
+}
+
+func (t *tpmReader) u64() uint64 {
+	var v uint64
+	t.read(&v)
+	return v
+}
+
+func (t *tpmReader) read(v interface{}) {
+	if t.err == nil && binary.Read(t.r, binary.BigEndian, v) != nil {
+		t.err = errTruncated
+	}
+}
+
+// tpm2b reads a sized buffer
+func (t *tpmReader) tpm2b() []byte {
+	n := int(t.u16())
+	if t.err != nil {
+		return nil
+	}
+	if n > t.r.Len() {
+		t.err = errTruncated
+		return nil
+	}
+	b := make([]byte, n)
+	t.r.Read(b)
+	return b
+}
+
+type tpmWriter struct {
+	bytes.Buffer
+}
+
+func (t *tpmWriter) u16(v uint16) { binary.Write(t, binary.BigEndian, v) }
+func (t *tpmWriter) u32(v uint32) { binary.Write(t, binary.BigEndian, v) }
+func (t *tpmWriter) u64(v uint64) { binary.Write(t, binary.BigEndian, v) }
+
+func (t *tpmWriter) tpm2b(b []byte) {
+	t.u16(uint16(len(b)))
+	t.Write(b)
+}
+
+// Public is a TPMT_PUBLIC of an RSA or ECC signing key
+type Public struct {
+	Type       uint16
+	NameAlg    uint16
+	Attributes uint32
+	AuthPolicy []byte
+	// Scheme and SchemeHash are the key's signing scheme, TPM_ALG_NULL when it isn't restricted to one
+	Scheme     uint16
+	SchemeHash uint16
+	// RSA keys
+	KeyBits  uint16
+	Exponent uint32
+	Modulus  []byte
+	// ECC keys
+	Curve uint16
+	X, Y  []byte
+
+	// raw is the TPMT_PUBLIC it was decoded from, which the name is computed over
+	raw []byte
+}
+
+// NewPublic returns the public area the TPM has for a signing key with the given object attributes
+func NewPublic(pub crypto.PublicKey, attributes uint32) (*Public, error) {
+	p := &Public{NameAlg: TPM_ALG_SHA256, Attributes: attributes, Scheme: TPM_ALG_NULL}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		p.Type = TPM_ALG_RSA
+		p.KeyBits = uint16(k.N.BitLen())
+		if k.E != tpmDefaultRSAExponent {
+			p.Exponent = uint32(k.E)
+		}
+		p.Modulus = k.N.Bytes()
+	case *ecdsa.PublicKey:
+		p.Type = TPM_ALG_ECC
+		for id, c := range tpmCurves {
+			if c == k.Curve {
+				p.Curve = id
+			}
+		}
+		if p.Curve == 0 {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		p.X = k.X.FillBytes(make([]byte, size))
+		p.Y = k.Y.FillBytes(make([]byte, size))
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+	return p, nil
+}
+
+// DecodePublic parses a TPMT_PUBLIC
+func DecodePublic(b []byte) (*Public, error) {
+	t := &tpmReader{r: bytes.NewReader(b)}
+	p := &Public{Type: t.u16(), NameAlg: t.u16(), Attributes: t.u32(), AuthPolicy: t.tpm2b()}
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	// TPMT_SYM_DEF_OBJECT, a signing key has none
+	if sym := t.u16(); sym != TPM_ALG_NULL {
+		t.u16()
+		t.u16()
+	}
+	p.Scheme = t.u16()
+	if p.Scheme != TPM_ALG_NULL {
+		p.SchemeHash = t.u16()
+	}
+
+	switch p.Type {
+	case TPM_ALG_RSA:
+		p.KeyBits = t.u16()
+		p.Exponent = t.u32()
+		p.Modulus = t.tpm2b()
+	case TPM_ALG_ECC:
+		p.Curve = t.u16()
+		if kdf := t.u16(); kdf != TPM_ALG_NULL {
+			t.u16()
+		}
+		p.X = t.tpm2b()
+		p.Y = t.tpm2b()
+	default:
+		return nil, fmt.Errorf("unsupported TPM key type 0x%04x", p.Type)
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	if t.r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes after TPMT_PUBLIC", t.r.Len())
+	}
+	p.raw = append([]byte(nil), b...)
+	return p, nil
+}
+
+// Encode marshals the TPMT_PUBLIC, a decoded one as it was received
+func (p *Public) Encode() []byte {
+	if p.raw != nil {
+		return p.raw
+	}
+
+	var t tpmWriter
+	t.u16(p.Type)
+	t.u16(p.NameAlg)
+	t.u32(p.Attributes)
+	t.tpm2b(p.AuthPolicy)
+	t.u16(TPM_ALG_NULL)
+	t.u16(p.Scheme)
+	if p.Scheme != TPM_ALG_NULL {
+		t.u16(p.SchemeHash)
+	}
+	switch p.Type {
+	case TPM_ALG_RSA:
+		t.u16(p.KeyBits)
+		t.u32(p.Exponent)
+		t.tpm2b(p.Modulus)
+	case TPM_ALG_ECC:
+		t.u16(p.Curve)
+		t.u16(TPM_ALG_NULL)
+		t.tpm2b(p.X)
+		t.tpm2b(p.Y)
+	}
+	return t.Bytes()
+}
+
+// Name is the TPM name of the key, its name algorithm followed by the digest of the TPMT_PUBLIC
+func (p *Public) Name() ([]byte, error) {
+	h, ok := tpmHashes[p.NameAlg]
+	if !ok || !h.Available() {
+		return nil, fmt.Errorf("unsupported name algorithm 0x%04x", p.NameAlg)
+	}
+	d := h.New()
+	d.Write(p.Encode())
+
+	var t tpmWriter
+	t.u16(p.NameAlg)
+	t.Write(d.Sum(nil))
+	return t.Bytes(), nil
+}
+
+// Key returns the public key of the public area
+func (p *Public) Key() (crypto.PublicKey, error) {
+	switch p.Type {
+	case TPM_ALG_RSA:
+		e := int(p.Exponent)
+		if e == 0 {
+			e = tpmDefaultRSAExponent
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(p.Modulus), E: e}, nil
+	case TPM_ALG_ECC:
+		curve, ok := tpmCurves[p.Curve]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TPM curve 0x%04x", p.Curve)
+		}
+		x, y := new(big.Int).SetBytes(p.X), new(big.Int).SetBytes(p.Y)
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("TPM public point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported TPM key type 0x%04x", p.Type)
+}
+
+// Attest is a TPMS_ATTEST of TPM2_Certify, the TPM vouching with an attestation key that it holds the certified key
+type Attest struct {
+	Magic           uint32
+	Type            uint16
+	QualifiedSigner []byte
+	// ExtraData is the nonce given to TPM2_Certify
+	ExtraData       []byte
+	Clock           uint64
+	ResetCount      uint32
+	RestartCount    uint32
+	Safe            bool
+	FirmwareVersion uint64
+	// Name and QualifiedName are the names of the certified key
+	Name          []byte
+	QualifiedName []byte
+}
+
+// DecodeAttest parses a TPMS_ATTEST, only the TPMS_CERTIFY_INFO of TPM2_Certify is supported
+func DecodeAttest(b []byte) (*Attest, error) {
+	t := &tpmReader{r: bytes.NewReader(b)}
+	a := &Attest{Magic: t.u32(), Type: t.u16()}
+	if t.err == nil && a.Magic != TPM_GENERATED_VALUE {
+		return nil, fmt.Errorf("attestation was not generated by a TPM")
+	}
+	if t.err == nil && a.Type != TPM_ST_ATTEST_CERTIFY {
+		return nil, fmt.Errorf("attestation type 0x%04x is not a key certification", a.Type)
+	}
+	a.QualifiedSigner = t.tpm2b()
+	a.ExtraData = t.tpm2b()
+	a.Clock = t.u64()
+	a.ResetCount = t.u32()
+	a.RestartCount = t.u32()
+	var safe uint8
+	t.read(&safe)
+	a.Safe = safe != 0
+	a.FirmwareVersion = t.u64()
+	a.Name = t.tpm2b()
+	a.QualifiedName = t.tpm2b()
+	if t.err != nil {
+		return nil, t.err
+	}
+	return a, nil
+}
+
+// Encode marshals the TPMS_ATTEST
+func (a *Attest) Encode() []byte {
+	var t tpmWriter
+	t.u32(a.Magic)
+	t.u16(a.Type)
+	t.tpm2b(a.QualifiedSigner)
+	t.tpm2b(a.ExtraData)
+	t.u64(a.Clock)
+	t.u32(a.ResetCount)
+	t.u32(a.RestartCount)
+	if a.Safe {
+		t.WriteByte(1)
+	} else {
+		t.WriteByte(0)
+	}
+	t.u64(a.FirmwareVersion)
+	t.tpm2b(a.Name)
+	t.tpm2b(a.QualifiedName)
+	return t.Bytes()
+}
+
+// Signature is a TPMT_SIGNATURE with an RSASSA, RSAPSS or ECDSA signature
+type Signature struct {
+	Alg  uint16
+	Hash uint16
+	// RSA is the signature of RSASSA and RSAPSS, R and S that of ECDSA
+	RSA  []byte
+	R, S *big.Int
+}
+
+// DecodeSignature parses a TPMT_SIGNATURE
+func DecodeSignature(b []byte) (*Signature, error) {
+	t := &tpmReader{r: bytes.NewReader(b)}
+	s := &Signature{Alg: t.u16(), Hash: t.u16()}
+	switch s.Alg {
+	case TPM_ALG_RSASSA, TPM_ALG_RSAPSS:
+		s.RSA = t.tpm2b()
+	case TPM_ALG_ECDSA:
+		s.R = new(big.Int).SetBytes(t.tpm2b())
+		s.S = new(big.Int).SetBytes(t.tpm2b())
+	default:
+		if t.err == nil {
+			return nil, fmt.Errorf("unsupported TPM signature algorithm 0x%04x", s.Alg)
+		}
+	}
+	if t.err != nil {
+		return nil, t.err
+	}
+	return s, nil
+}
+
+// Encode marshals the TPMT_SIGNATURE
+func (s *Signature) Encode() []byte {
+	var t tpmWriter
+	t.u16(s.Alg)
+	t.u16(s.Hash)
+	if s.Alg == TPM_ALG_ECDSA {
+		t.tpm2b(s.R.Bytes())
+		t.tpm2b(s.S.Bytes())
+	} else {
+		t.tpm2b(s.RSA)
+	}
+	return t.Bytes()
+}
+
+// Verify checks the signature over data with the key that made it
+func (s *Signature) Verify(pub crypto.PublicKey, data []byte) error {
+	h, ok := tpmHashes[s.Hash]
+	if !ok || !h.Available() {
+		return fmt.Errorf("unsupported signature hash 0x%04x", s.Hash)
+	}
+	d := h.New()
+	d.Write(data)
+	digest := d.Sum(nil)
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch s.Alg {
+		case TPM_ALG_RSASSA:
+			return rsa.VerifyPKCS1v15(k, h, digest, s.RSA)
+		case TPM_ALG_RSAPSS:
+			return rsa.VerifyPSS(k, h, digest, s.RSA, nil)
+		}
+	case *ecdsa.PublicKey:
+		if s.Alg == TPM_ALG_ECDSA {
+			if !ecdsa.Verify(k, digest, s.R, s.S) {
+				return fmt.Errorf("ECDSA signature did not verify")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("signature algorithm 0x%04x does not match the %T key", s.Alg, pub)
+}
@@ -0,0 +1,130 @@
+// Package bridge relays SSH agent traffic between stdin/stdout and a running nCryptAgent endpoint. It is used by
+// tools that can only spawn a process, e.g. a ProxyCommand on a jump host or remote editor helpers.
+package bridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+const (
+	// MaxMessageLength matches OpenSSH's AGENT_MAX_LEN, anything larger is treated as a framing error
+	MaxMessageLength = 256 * 1024
+)
+
+var ErrMessageTooLarge = errors.New("agent message exceeds maximum length")
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+// Main runs the bridge using the given command line arguments and returns the process exit code
+func Main(args []string) int {
+	fs := flag.NewFlagSet("stdio-bridge", flag.ContinueOnError)
+	endpoint := fs.String("endpoint", DefaultEndpoint, "agent endpoint: pipe:<name>, unix:<path> or cygwin:<socket file>")
+	maxLen := fs.Int("max-length", MaxMessageLength, "maximum agent message length in bytes")
+	verbose := fs.Bool("v", false, "log relayed messages to stderr")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	log.SetOutput(os.Stderr)
+
+	conn, err := Dial(*endpoint)
+	if err != nil {
+		log.Printf("unable to connect to %s: %s", *endpoint, err)
+		return 1
+	}
+	defer conn.Close()
+
+	b := Bridge{MaxLength: uint32(*maxLen), Verbose: *verbose}
+	if err := b.Relay(stdio{os.Stdin, os.Stdout}, conn); err != nil {
+		log.Printf("bridge: %s", err)
+		return 1
+	}
+
+	return 0
+}
+
+type Bridge struct {
+	// MaxLength is the largest message accepted in either direction, defaults to MaxMessageLength
+	MaxLength uint32
+	Verbose   bool
+}
+
+// Relay copies length prefixed agent messages from client to agent and back until the client closes its side.
+// Each message is validated before it is forwarded, so a malformed frame from either side ends the session
+// instead of being passed on.
+func (b *Bridge) Relay(client io.ReadWriter, agent io.ReadWriter) error {
+	maxLen := b.MaxLength
+	if maxLen == 0 {
+		maxLen = MaxMessageLength
+	}
+
+	for {
+		req, err := ReadMessage(client, maxLen)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading request: %w", err)
+		}
+		if b.Verbose {
+			log.Printf("-> request type %d, %d bytes", req[4], len(req)-4)
+		}
+		if _, err = agent.Write(req); err != nil {
+			return fmt.Errorf("writing request: %w", err)
+		}
+
+		resp, err := ReadMessage(agent, maxLen)
+		if err == io.EOF {
+			return fmt.Errorf("agent closed connection: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return fmt.Errorf("reading response: %w", err)
+		}
+		if b.Verbose {
+			log.Printf("<- response type %d, %d bytes", resp[4], len(resp)-4)
+		}
+		if _, err = client.Write(resp); err != nil {
+			return fmt.Errorf("writing response: %w", err)
+		}
+	}
+}
+
+// ReadMessage reads a single agent message, returning it including its 4 byte length prefix. io.EOF is only
+// returned if the reader ends cleanly between messages.
+func ReadMessage(r io.Reader, maxLen uint32) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated length prefix: %w", err)
+		}
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(header[:])
+	if l == 0 {
+		return nil, fmt.Errorf("empty agent message")
+	}
+	if l > maxLen {
+		return nil, fmt.Errorf("%w (%d > %d)", ErrMessageTooLarge, l, maxLen)
+	}
+
+	msg := make([]byte, 4+l)
+	copy(msg, header[:])
+	if _, err := io.ReadFull(r, msg[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("truncated message body: %w", err)
+	}
+
+	return msg, nil
+}
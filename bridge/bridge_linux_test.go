@@ -0,0 +1,113 @@
+//go:build linux
+
+package bridge
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// pipeStdio is the bridge's side of a pair of os.Pipes, like the stdin and stdout of the bridge process
+type pipeStdio struct {
+	*os.File
+	out *os.File
+}
+
+func (p pipeStdio) Write(b []byte) (int, error) { return p.out.Write(b) }
+
+// TestRelayRoundTrip lists keys and signs through the bridge, with the client talking to it over pipes and the bridge
+// dialling a keyring served on a unix socket
+func TestRelayRoundTrip(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "bridged"}); err != nil {
+		t.Fatal(err)
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	conn, err := Dial("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// stdinR/stdinW carry requests to the bridge, stdoutR/stdoutW the responses back to the client
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdoutR.Close()
+
+	relayed := make(chan error, 1)
+	go func() {
+		b := Bridge{}
+		relayed <- b.Relay(pipeStdio{File: stdinR, out: stdoutW}, conn)
+		stdinR.Close()
+		stdoutW.Close()
+	}()
+
+	client := agent.NewClient(struct {
+		io.Reader
+		io.Writer
+	}{stdoutR, stdinW})
+
+	keys, err := client.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "bridged" {
+		t.Fatalf("listed %v, expected the bridged key", keys)
+	}
+
+	data := []byte("bridge round trip")
+	sig, err := client.Sign(keys[0], data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.ParsePublicKey(keys[0].Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pub.Verify(data, sig); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the client's side of stdin ends the session cleanly
+	stdinW.Close()
+	if err = <-relayed; err != nil {
+		t.Fatalf("relay ended with %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"ncryptagent/keyman/listeners"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// frame returns an agent message of the given type and body length, including its length prefix
+func frame(msgType byte, bodyLen int) []byte {
+	msg := make([]byte, 5+bodyLen)
+	binary.BigEndian.PutUint32(msg, uint32(1+bodyLen))
+	msg[4] = msgType
+	for i := 5; i < len(msg); i++ {
+		msg[i] = byte(i)
+	}
+	return msg
+}
+
+// lengthPrefix returns just the 4 byte length prefix of a message of length l
+func lengthPrefix(l uint32) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], l)
+	return header[:]
+}
+
+func TestReadMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		input  []byte
+		maxLen uint32
+		err    string
+		target error
+	}{
+		{name: "single byte message", input: frame(11, 0), maxLen: MaxMessageLength},
+		{name: "maximum length", input: frame(11, MaxMessageLength-1), maxLen: MaxMessageLength},
+		{name: "custom maximum", input: frame(11, 15), maxLen: 16},
+		{name: "clean EOF", input: nil, maxLen: MaxMessageLength, target: io.EOF},
+		{name: "zero length", input: lengthPrefix(0), maxLen: MaxMessageLength, err: "empty agent message"},
+		{name: "oversized", input: lengthPrefix(MaxMessageLength + 1), maxLen: MaxMessageLength, target: ErrMessageTooLarge},
+		{name: "oversized custom maximum", input: frame(11, 16), maxLen: 16, target: ErrMessageTooLarge},
+		{name: "huge length", input: lengthPrefix(0xffffffff), maxLen: MaxMessageLength, target: ErrMessageTooLarge},
+		{name: "truncated length prefix", input: []byte{0, 0}, maxLen: MaxMessageLength, err: "truncated length prefix", target: io.ErrUnexpectedEOF},
+		{name: "EOF after length prefix", input: lengthPrefix(10), maxLen: MaxMessageLength, err: "truncated message body", target: io.ErrUnexpectedEOF},
+		{name: "truncated body", input: frame(11, 20)[:12], maxLen: MaxMessageLength, err: "truncated message body", target: io.ErrUnexpectedEOF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := ReadMessage(bytes.NewReader(tc.input), tc.maxLen)
+			if tc.err == "" && tc.target == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(msg, tc.input) {
+					t.Fatalf("read %d bytes, expected %d", len(msg), len(tc.input))
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("read a %d byte message, expected an error", len(msg))
+			}
+			if tc.target != nil && !errors.Is(err, tc.target) {
+				t.Errorf("error %q is not %q", err, tc.target)
+			}
+			if tc.err != "" && !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("error %q, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestReadMessageSequence(t *testing.T) {
+	first, second := frame(11, 3), frame(13, 40)
+	r := bytes.NewReader(append(append([]byte(nil), first...), second...))
+	for _, expected := range [][]byte{first, second} {
+		msg, err := ReadMessage(r, MaxMessageLength)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, expected) {
+			t.Fatalf("read % x, expected % x", msg, expected)
+		}
+	}
+	if _, err := ReadMessage(r, MaxMessageLength); err != io.EOF {
+		t.Fatalf("expected io.EOF after the last message, got %v", err)
+	}
+}
+
+// scriptedAgent answers each request with the next of its responses, recording the requests
+type scriptedAgent struct {
+	requests  bytes.Buffer
+	responses *bytes.Reader
+}
+
+func (a *scriptedAgent) Read(p []byte) (int, error)  { return a.responses.Read(p) }
+func (a *scriptedAgent) Write(p []byte) (int, error) { return a.requests.Write(p) }
+
+// testClient sends its requests and collects the responses
+type testClient struct {
+	requests  io.Reader
+	responses bytes.Buffer
+}
+
+func (c *testClient) Read(p []byte) (int, error)  { return c.requests.Read(p) }
+func (c *testClient) Write(p []byte) (int, error) { return c.responses.Write(p) }
+
+func TestRelay(t *testing.T) {
+	request, response := frame(11, 0), frame(12, 100)
+
+	for _, tc := range []struct {
+		name      string
+		requests  []byte
+		responses []byte
+		maxLen    uint32
+		err       string
+		target    error
+		// forwarded is the number of requests that reach the agent, relayed the number of responses returned
+		forwarded, relayed int
+	}{
+		{name: "no requests", forwarded: 0, relayed: 0},
+		{name: "round trips", requests: bytes.Repeat(request, 3), responses: bytes.Repeat(response, 3), forwarded: 3, relayed: 3},
+		{name: "zero length request", requests: lengthPrefix(0), err: "reading request: empty agent message"},
+		{name: "oversized request", requests: lengthPrefix(MaxMessageLength + 1), target: ErrMessageTooLarge},
+		{name: "request over custom maximum", requests: frame(11, 64), maxLen: 32, target: ErrMessageTooLarge},
+		{name: "client EOF in request", requests: append(request, frame(11, 10)[:8]...), responses: response, err: "reading request", target: io.ErrUnexpectedEOF, forwarded: 1, relayed: 1},
+		{name: "agent closed", requests: request, err: "agent closed connection", target: io.ErrUnexpectedEOF, forwarded: 1},
+		{name: "agent EOF in response", requests: request, responses: response[:50], err: "reading response", target: io.ErrUnexpectedEOF, forwarded: 1},
+		{name: "zero length response", requests: request, responses: lengthPrefix(0), err: "reading response: empty agent message", forwarded: 1},
+		{name: "oversized response", requests: request, responses: lengthPrefix(MaxMessageLength + 1), target: ErrMessageTooLarge, forwarded: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &testClient{requests: bytes.NewReader(tc.requests)}
+			agent := &scriptedAgent{responses: bytes.NewReader(tc.responses)}
+
+			b := Bridge{MaxLength: tc.maxLen}
+			err := b.Relay(client, agent)
+			if tc.err == "" && tc.target == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if err == nil {
+					t.Fatal("relay succeeded, expected an error")
+				}
+				if tc.target != nil && !errors.Is(err, tc.target) {
+					t.Errorf("error %q is not %q", err, tc.target)
+				}
+				if tc.err != "" && !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("error %q, expected %q", err, tc.err)
+				}
+			}
+
+			if expected := bytes.Repeat(request, tc.forwarded); !bytes.Equal(agent.requests.Bytes(), expected) {
+				t.Errorf("agent received %d bytes, expected %d", agent.requests.Len(), len(expected))
+			}
+			if expected := bytes.Repeat(response, tc.relayed); !bytes.Equal(client.responses.Bytes(), expected) {
+				t.Errorf("client received %d bytes, expected %d", client.responses.Len(), len(expected))
+			}
+		})
+	}
+}
+
+// TestCygwinClientHandshake runs the bridge's side of the Cygwin handshake against the listener's, so the two can't
+// disagree on the credentials a native client sends
+func TestCygwinClientHandshake(t *testing.T) {
+	secret := [16]byte{0x10, 0x32, 0x54, 0x76, 0x98, 0xba, 0xdc, 0xfe, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	for _, tc := range []struct {
+		name   string
+		secret [16]byte
+		err    bool
+	}{
+		{name: "matching secret", secret: secret},
+		{name: "wrong secret", secret: [16]byte{1}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+
+			clientErr := make(chan error, 1)
+			go func() {
+				defer client.Close()
+				clientErr <- cygwinClientHandshake(client, tc.secret[:])
+			}()
+
+			h := listeners.NewCygwinHandshake(secret)
+			err := h.Run(server)
+			server.Close()
+			cerr := <-clientErr
+			if tc.err {
+				if err == nil || cerr == nil {
+					t.Fatalf("handshake succeeded, server %v, client %v", err, cerr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("server: %s", err)
+			}
+			if cerr != nil {
+				t.Fatalf("client: %s", cerr)
+			}
+
+			uid, gid, _ := cygwinIDs()
+			if h.Peer != (listeners.CygwinCredentials{PID: uint32(os.Getpid()), UID: uid, GID: gid}) {
+				t.Errorf("server got credentials %+v", h.Peer)
+			}
+		})
+	}
+}
+
+func TestCygwinIDFromSID(t *testing.T) {
+	const machine = "S-1-5-21-1004336348-1177238915-682003330"
+	for _, tc := range []struct {
+		sid string
+		id  uint32
+		err bool
+	}{
+		{sid: machine + "-1001", id: 197609},
+		{sid: machine + "-513", id: 197121},
+		{sid: "S-1-5-21-3623811015-3361044348-30300820-1013", id: 0x100000 + 1013},
+		{sid: "S-1-5-32-544", id: 544},
+		{sid: "S-1-5-18", id: 18},
+		{sid: "S-1-5-80-956008885-3418522649-1831038044-1853292631-2271478464", id: 2271478464},
+		{sid: "S-1-5", err: true},
+		{sid: "not a sid", err: true},
+		{sid: "S-1-5-21-1-2-3-x", err: true},
+	} {
+		id, err := cygwinIDFromSID(tc.sid, machine)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: mapped to %d, expected an error", tc.sid, id)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.sid, err)
+		} else if id != tc.id {
+			t.Errorf("%s: mapped to %d, expected %d", tc.sid, id, tc.id)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dialTimeout = 5 * time.Second
+
+// Dial connects to an agent endpoint. Endpoints are given as pipe:<name>, unix:<path> or cygwin:<socket file>.
+// Without a scheme, names starting with \\.\pipe\ are treated as named pipes, and files are inspected to tell
+// Cygwin socket emulation files from unix sockets.
+func Dial(endpoint string) (io.ReadWriteCloser, error) {
+	scheme, addr := splitEndpoint(endpoint)
+
+	switch scheme {
+	case "pipe":
+		return dialPipe(addr)
+	case "unix":
+		return net.DialTimeout("unix", addr, dialTimeout)
+	case "cygwin":
+		return dialCygwin(addr)
+	default:
+		return nil, fmt.Errorf("unknown endpoint type %q", scheme)
+	}
+}
+
+func splitEndpoint(endpoint string) (string, string) {
+	for _, scheme := range []string{"pipe", "unix", "cygwin"} {
+		if strings.HasPrefix(endpoint, scheme+":") {
+			return scheme, endpoint[len(scheme)+1:]
+		}
+	}
+
+	if strings.HasPrefix(endpoint, `\\.\pipe\`) {
+		return "pipe", endpoint
+	}
+
+	if _, _, err := readCygwinSocketFile(endpoint); err == nil {
+		return "cygwin", endpoint
+	}
+
+	return "unix", endpoint
+}
+
+// readCygwinSocketFile parses a Cygwin AF_UNIX emulation file of the form "!<socket >PORT s UUID"
+func readCygwinSocketFile(path string) (int, []byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	content = bytes.TrimRight(content, "\x00")
+	if !bytes.HasPrefix(content, []byte("!<socket >")) {
+		return 0, nil, fmt.Errorf("%s is not a cygwin socket file", path)
+	}
+
+	fields := strings.Fields(string(content[len("!<socket >"):]))
+	if len(fields) != 3 || fields[1] != "s" {
+		return 0, nil, fmt.Errorf("malformed cygwin socket file %s", path)
+	}
+
+	port, err := strconv.Atoi(fields[0])
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, fmt.Errorf("invalid port in cygwin socket file %s", path)
+	}
+
+	uuid, err := parseCygwinUUID(fields[2])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid uuid in cygwin socket file %s: %w", path, err)
+	}
+
+	return port, uuid, nil
+}
+
+// parseCygwinUUID is the inverse of the listener's UUIDToString, each group holds 4 bytes in reverse order
+func parseCygwinUUID(s string) ([]byte, error) {
+	groups := strings.Split(s, "-")
+	if len(groups) != 4 {
+		return nil, fmt.Errorf("expected 4 groups, got %d", len(groups))
+	}
+
+	uuid := make([]byte, 0, 16)
+	for _, g := range groups {
+		b, err := hex.DecodeString(g)
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != 4 {
+			return nil, fmt.Errorf("invalid group %q", g)
+		}
+		uuid = append(uuid, b[3], b[2], b[1], b[0])
+	}
+
+	return uuid, nil
+}
+
+func dialCygwin(path string) (io.ReadWriteCloser, error) {
+	port, uuid, err := readCygwinSocketFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cygwinClientHandshake(conn, uuid); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cygwin handshake failed: %w", err)
+	}
+
+	return conn, nil
+}
+
+// cygwinClientHandshake performs the client side of the Cygwin socket emulation handshake: send the secret from the
+// socket file, expect it echoed back, then exchange pid/uid/gid credentials
+func cygwinClientHandshake(conn net.Conn, uuid []byte) error {
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(uuid); err != nil {
+		return err
+	}
+
+	var echoed [16]byte
+	if _, err := io.ReadFull(conn, echoed[:]); err != nil {
+		return err
+	}
+	if !bytes.Equal(echoed[:], uuid) {
+		return fmt.Errorf("server returned an invalid uuid")
+	}
+
+	uid, gid, err := cygwinIDs()
+	if err != nil {
+		return fmt.Errorf("unable to determine uid and gid: %w", err)
+	}
+	creds := make([]byte, 12)
+	binary.LittleEndian.PutUint32(creds, uint32(os.Getpid()))
+	binary.LittleEndian.PutUint32(creds[4:], uid)
+	binary.LittleEndian.PutUint32(creds[8:], gid)
+	if _, err := conn.Write(creds); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, creds); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// cygwinIDFromSID maps a Windows SID to the uid or gid Cygwin gives it: well known SIDs such as S-1-5-18 and the
+// BUILTIN aliases keep their last sub-authority, accounts of this machine (machineSID) get 0x30000 + RID and domain
+// accounts 0x100000 + RID. Windows itself has no uid, os.Getuid returns -1 which the listener rejects.
+func cygwinIDFromSID(sid, machineSID string) (uint32, error) {
+	parts := strings.Split(sid, "-")
+	if len(parts) < 4 || parts[0] != "S" {
+		return 0, fmt.Errorf("invalid SID %q", sid)
+	}
+	rid, err := strconv.ParseUint(parts[len(parts)-1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid SID %q: %w", sid, err)
+	}
+
+	switch {
+	case parts[1] != "1" || parts[2] != "5" || len(parts) == 4 || parts[3] == "32":
+		return uint32(rid), nil
+	case machineSID != "" && strings.HasPrefix(sid, machineSID+"-"):
+		return 0x30000 + uint32(rid), nil
+	case parts[3] == "21":
+		return 0x100000 + uint32(rid), nil
+	default:
+		return uint32(rid), nil
+	}
+}
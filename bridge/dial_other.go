@@ -0,0 +1,21 @@
+//go:build !windows
+
+package bridge
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// DefaultEndpoint is the unix socket given in SSH_AUTH_SOCK
+var DefaultEndpoint = "unix:" + os.Getenv("SSH_AUTH_SOCK")
+
+func dialPipe(name string) (io.ReadWriteCloser, error) {
+	return nil, fmt.Errorf("named pipe %s: named pipes are only available on Windows", name)
+}
+
+// cygwinIDs returns the uid and gid sent in the Cygwin handshake, outside Windows the process has real ones
+func cygwinIDs() (uint32, uint32, error) {
+	return uint32(os.Getuid()), uint32(os.Getgid()), nil
+}
@@ -0,0 +1,47 @@
+package bridge
+
+import (
+	"golang.org/x/sys/windows"
+	"io"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// DefaultEndpoint is the named pipe used by OpenSSH for Windows, served by the NamedPipe listener
+const DefaultEndpoint = `\\.\pipe\openssh-ssh-agent`
+
+func dialPipe(name string) (io.ReadWriteCloser, error) {
+	timeout := dialTimeout
+	return winio.DialPipe(name, &timeout)
+}
+
+// cygwinIDs returns the uid and gid Cygwin would give the process, from the user and primary group of its token
+func cygwinIDs() (uint32, uint32, error) {
+	token := windows.GetCurrentProcessToken()
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return 0, 0, err
+	}
+	group, err := token.GetTokenPrimaryGroup()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// the SID of the machine's account domain, without it local accounts are mapped like domain accounts
+	var machineSID string
+	if name, err := windows.ComputerName(); err == nil {
+		if sid, _, _, err := windows.LookupSID("", name); err == nil {
+			machineSID = sid.String()
+		}
+	}
+
+	uid, err := cygwinIDFromSID(user.User.Sid.String(), machineSID)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := cygwinIDFromSID(group.PrimaryGroup.String(), machineSID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
@@ -1,3 +1,10 @@
 windres.exe -i resources.rc -o rsrc.syso -O coff
 go mod tidy
-go build -ldflags "-H=windowsgui" -o build\nCryptAgent.exe
\ No newline at end of file
+go build -ldflags "-H=windowsgui" -o build\nCryptAgent.exe
+set GOOS=linux
+set GOARCH=amd64
+go build -o build\ncrypt-wsl-relay-amd64 .\cmd\ncrypt-wsl-relay
+set GOARCH=arm64
+go build -o build\ncrypt-wsl-relay-arm64 .\cmd\ncrypt-wsl-relay
+set GOOS=
+set GOARCH=
\ No newline at end of file
@@ -0,0 +1,343 @@
+//go:build linux
+
+// ncrypt-wsl-relay runs inside a WSL2 (or other Hyper-V) Linux guest. It listens on a unix socket and relays each
+// connection over AF_VSOCK to the nCryptAgent Hyper-V socket listener running on the Windows host, replacing the
+// socat based script from the config tab.
+//
+// Typical usage from .bashrc/.profile:
+//
+//	eval $(ncrypt-wsl-relay -daemon -print-env)
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// VSockServicePort must match listeners.VSockServicePort on the Windows side
+	VSockServicePort = 0x23232323
+	// VMADDR_CID_HOST is the well known CID of the hypervisor host
+	VMADDR_CID_HOST = 2
+
+	defaultSocketName = "ncryptagent-hv.sock"
+	daemonEnv         = "NCRYPT_WSL_RELAY_DAEMON"
+)
+
+type relayConfig struct {
+	socketPath  string
+	useAuthSock bool
+	cid         uint
+	port        uint
+	tcpAddr     string
+	retries     int
+	retryDelay  time.Duration
+	daemon      bool
+	printEnv    bool
+	verbose     bool
+}
+
+func main() {
+	cfg := relayConfig{}
+
+	flag.StringVar(&cfg.socketPath, "socket", "", "unix socket path to listen on (default $XDG_RUNTIME_DIR/"+defaultSocketName+", or in a directory of the user in $TMPDIR)")
+	flag.BoolVar(&cfg.useAuthSock, "use-ssh-auth-sock", false, "listen on the path already in SSH_AUTH_SOCK instead of the default socket")
+	flag.UintVar(&cfg.cid, "cid", VMADDR_CID_HOST, "vsock CID to connect to (1 for loopback testing)")
+	flag.UintVar(&cfg.port, "port", VSockServicePort, "vsock port of the nCryptAgent service")
+	flag.StringVar(&cfg.tcpAddr, "tcp", "", "relay to a TCP host:port instead of vsock (for testing)")
+	flag.IntVar(&cfg.retries, "retries", 5, "number of connection attempts per client before giving up")
+	flag.DurationVar(&cfg.retryDelay, "retry-delay", 200*time.Millisecond, "initial delay between connection attempts, doubled on each retry")
+	flag.BoolVar(&cfg.daemon, "daemon", false, "detach from the terminal and run in the background")
+	flag.BoolVar(&cfg.printEnv, "print-env", false, "print shell commands to set SSH_AUTH_SOCK")
+	flag.BoolVar(&cfg.verbose, "v", false, "log every relayed connection")
+	flag.Parse()
+
+	if cfg.socketPath == "" {
+		path, err := defaultSocketPath(cfg.useAuthSock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.socketPath = path
+	}
+	// before SSH_AUTH_SOCK is pointed at an existing socket, it has to be ours
+	if err := checkSocketPath(cfg.socketPath); err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.printEnv {
+		fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", shellQuote(cfg.socketPath))
+	}
+
+	if socketInUse(cfg.socketPath) {
+		if cfg.verbose || !cfg.printEnv {
+			log.Printf("relay already listening on %s", cfg.socketPath)
+		}
+		return
+	}
+
+	if cfg.daemon && os.Getenv(daemonEnv) == "" {
+		if err := daemonize(); err != nil {
+			log.Fatalf("unable to start daemon: %s", err)
+		}
+		return
+	}
+
+	if err := run(&cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// defaultSocketPath returns the socket in the user's runtime directory, or in a directory of the user in the shared
+// temp directory. SSH_AUTH_SOCK is only used when asked for, it usually points at another agent's socket that the
+// relay would otherwise remove and take over.
+func defaultSocketPath(useAuthSock bool) (string, error) {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); useAuthSock && sock != "" {
+		return sock, nil
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return filepath.Join(runtimeDir, defaultSocketName), nil
+	}
+	dir, err := userTempDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, defaultSocketName), nil
+}
+
+// userTempDir returns ncrypt-wsl-relay-<uid> in the temp directory, creating it with mode 0700. Any local user can
+// create it first, so an existing one has to be a directory of the current user that no one else can access.
+func userTempDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("ncrypt-wsl-relay-%d", os.Getuid()))
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return "", fmt.Errorf("%s is owned by another user", dir)
+	}
+	if fi.Mode().Perm() != 0700 {
+		return "", fmt.Errorf("%s has mode %o, expected 700", dir, fi.Mode().Perm())
+	}
+	return dir, nil
+}
+
+// checkSocketPath makes sure that whatever is at path is a socket of the current user, so the relay neither points
+// SSH_AUTH_SOCK at another user's socket nor removes a file it doesn't own. A path that doesn't exist is fine.
+func checkSocketPath(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("socket %s is owned by another user", path)
+	}
+	return nil
+}
+
+func shellQuote(s string) string {
+	quoted := []byte{'\''}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\'' {
+			quoted = append(quoted, []byte(`'\''`)...)
+		} else {
+			quoted = append(quoted, s[i])
+		}
+	}
+	return string(append(quoted, '\''))
+}
+
+// socketInUse reports whether something is already accepting connections on the socket path
+func socketInUse(path string) bool {
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// daemonize re-executes the relay in a new session with stdio detached
+func daemonize() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer devNull.Close()
+
+	var args []string
+	for _, a := range os.Args[1:] {
+		if a == "-print-env" || a == "--print-env" {
+			continue
+		}
+		args = append(args, a)
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	return cmd.Process.Release()
+}
+
+func run(cfg *relayConfig) error {
+	// a stale socket of an earlier relay is replaced, anything else is left alone
+	if err := checkSocketPath(cfg.socketPath); err != nil {
+		return err
+	}
+	os.Remove(cfg.socketPath)
+	if err := os.MkdirAll(filepath.Dir(cfg.socketPath), 0700); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("unix", cfg.socketPath)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %w", cfg.socketPath, err)
+	}
+	if err := os.Chmod(cfg.socketPath, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	if cfg.verbose {
+		log.Printf("relaying %s to %s", cfg.socketPath, cfg.target())
+	}
+
+	return cfg.serve(l)
+}
+
+// serve relays every connection accepted on l until l is closed
+func (cfg *relayConfig) serve(l net.Listener) error {
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg.handle(conn)
+		}()
+	}
+}
+
+func (cfg *relayConfig) target() string {
+	if cfg.tcpAddr != "" {
+		return "tcp:" + cfg.tcpAddr
+	}
+	return fmt.Sprintf("vsock:%d:0x%x", cfg.cid, cfg.port)
+}
+
+// halfCloser is implemented by connections that support shutting down the write side only
+type halfCloser interface {
+	CloseWrite() error
+}
+
+func (cfg *relayConfig) dial() (io.ReadWriteCloser, error) {
+	if cfg.tcpAddr != "" {
+		return net.Dial("tcp", cfg.tcpAddr)
+	}
+	return dialVSock(uint32(cfg.cid), uint32(cfg.port))
+}
+
+// dialWithRetry connects to the host, backing off between attempts so a relay started before the agent (or
+// surviving an agent restart) keeps working
+func (cfg *relayConfig) dialWithRetry() (io.ReadWriteCloser, error) {
+	delay := cfg.retryDelay
+	var err error
+	for attempt := 0; attempt <= cfg.retries; attempt++ {
+		var upstream io.ReadWriteCloser
+		upstream, err = cfg.dial()
+		if err == nil {
+			return upstream, nil
+		}
+		if attempt < cfg.retries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	return nil, fmt.Errorf("unable to connect to %s: %w", cfg.target(), err)
+}
+
+func (cfg *relayConfig) handle(client net.Conn) {
+	defer client.Close()
+
+	upstream, err := cfg.dialWithRetry()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer upstream.Close()
+
+	if cfg.verbose {
+		log.Printf("relaying connection to %s", cfg.target())
+	}
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst io.Writer, src io.Reader) {
+		io.Copy(dst, src)
+		if hc, ok := dst.(halfCloser); ok {
+			hc.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+
+	// once either side has finished and the other has drained, tear down both
+	<-done
+	<-done
+}
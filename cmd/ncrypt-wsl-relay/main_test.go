@@ -0,0 +1,278 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoServer accepts TCP connections on l and echoes everything back until the client closes its write side
+func echoServer(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// startRelay serves a relay to cfg.tcpAddr on a unix socket in a temporary directory and returns the socket path
+func startRelay(t *testing.T, cfg *relayConfig) string {
+	t.Helper()
+	cfg.socketPath = filepath.Join(t.TempDir(), defaultSocketName)
+	l, err := net.Listen("unix", cfg.socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cfg.serve(l) }()
+	t.Cleanup(func() {
+		l.Close()
+		if err := <-done; err != nil {
+			t.Errorf("serve: %s", err)
+		}
+	})
+	return cfg.socketPath
+}
+
+// roundTrip sends msg through the relay and returns what came back once the upstream closed the connection
+func roundTrip(t *testing.T, socketPath string, msg []byte) []byte {
+	t.Helper()
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.UnixConn).CloseWrite()
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestRelayTCP(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go echoServer(upstream)
+
+	socketPath := startRelay(t, &relayConfig{tcpAddr: upstream.Addr().String(), retryDelay: 10 * time.Millisecond})
+
+	msg := bytes.Repeat([]byte("ssh-agent request "), 4096)
+	if reply := roundTrip(t, socketPath, msg); !bytes.Equal(reply, msg) {
+		t.Fatalf("relayed %d bytes, received %d", len(msg), len(reply))
+	}
+}
+
+func TestRelayTCPRetry(t *testing.T) {
+	// reserve a port and start listening on it only after the relay's first attempts have failed
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := upstream.Addr().String()
+	upstream.Close()
+
+	socketPath := startRelay(t, &relayConfig{tcpAddr: addr, retries: 5, retryDelay: 50 * time.Millisecond})
+
+	late := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			late <- nil
+			return
+		}
+		late <- l
+		echoServer(l)
+	}()
+	defer func() {
+		if l := <-late; l != nil {
+			l.Close()
+		}
+	}()
+
+	msg := []byte("late agent")
+	if reply := roundTrip(t, socketPath, msg); !bytes.Equal(reply, msg) {
+		t.Fatalf("received %q, expected %q", reply, msg)
+	}
+}
+
+func TestRelayTCPUnreachable(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := upstream.Addr().String()
+	upstream.Close()
+
+	socketPath := startRelay(t, &relayConfig{tcpAddr: addr, retries: 1, retryDelay: 10 * time.Millisecond})
+
+	// nothing is sent so the relay's close isn't turned into a reset by unread data
+	if reply := roundTrip(t, socketPath, nil); len(reply) != 0 {
+		t.Fatalf("received %q from an unreachable agent", reply)
+	}
+}
+
+func TestDefaultSocketPath(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/other-agent.sock")
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+
+	if p, err := defaultSocketPath(false); err != nil || p != "/run/user/1000/"+defaultSocketName {
+		t.Errorf("default socket %s: %v", p, err)
+	}
+	if p, err := defaultSocketPath(true); err != nil || p != "/tmp/other-agent.sock" {
+		t.Errorf("socket %s with -use-ssh-auth-sock: %v", p, err)
+	}
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	userDir := filepath.Join(tmp, fmt.Sprintf("ncrypt-wsl-relay-%d", os.Getuid()))
+	for i := 0; i < 2; i++ {
+		// the second time the directory already exists
+		p, err := defaultSocketPath(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p != filepath.Join(userDir, defaultSocketName) {
+			t.Errorf("default socket %s without XDG_RUNTIME_DIR", p)
+		}
+		if fi, err := os.Stat(userDir); err != nil || fi.Mode().Perm() != 0700 {
+			t.Errorf("socket directory %v: %v", fi.Mode(), err)
+		}
+	}
+}
+
+// chownOtherUser gives path to nobody, which needs root
+func chownOtherUser(t *testing.T, path string) error {
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner needs root")
+	}
+	return os.Lchown(path, 65534, 65534)
+}
+
+func TestUserTempDir(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(dir string) error
+		err   string
+	}{
+		{name: "created", setup: func(dir string) error { return nil }},
+		{name: "existing", setup: func(dir string) error { return os.Mkdir(dir, 0700) }},
+		{name: "accessible to others", setup: func(dir string) error {
+			if err := os.Mkdir(dir, 0700); err != nil {
+				return err
+			}
+			return os.Chmod(dir, 0777)
+		}, err: "has mode 777"},
+		{name: "other user", setup: func(dir string) error {
+			if err := os.Mkdir(dir, 0700); err != nil {
+				return err
+			}
+			return chownOtherUser(t, dir)
+		}, err: "owned by another user"},
+		{name: "file", setup: func(dir string) error { return os.WriteFile(dir, nil, 0600) }, err: "not a directory"},
+		{name: "symlink", setup: func(dir string) error { return os.Symlink(filepath.Dir(dir), dir) }, err: "not a directory"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+			dir := filepath.Join(tmp, fmt.Sprintf("ncrypt-wsl-relay-%d", os.Getuid()))
+			if err := tc.setup(dir); err != nil {
+				t.Fatal(err)
+			}
+			got, err := userTempDir()
+			if tc.err == "" {
+				if err != nil || got != dir {
+					t.Fatalf("got %s, %v", got, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got error %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCheckSocketPath(t *testing.T) {
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	file := filepath.Join(dir, "file")
+	if err = os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "other.sock")
+	lo, err := net.Listen("unix", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lo.Close()
+	link := filepath.Join(dir, "link.sock")
+	if err = os.Symlink(sock, link); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		path string
+		err  string
+	}{
+		{name: "missing", path: filepath.Join(dir, "missing.sock")},
+		{name: "own socket", path: sock},
+		{name: "regular file", path: file, err: "not a socket"},
+		{name: "symlink to a socket", path: link, err: "not a socket"},
+		{name: "socket of another user", path: other, err: "owned by another user"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.path == other {
+				if err := chownOtherUser(t, other); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := checkSocketPath(tc.path)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got error %v, expected %q", err, tc.err)
+			}
+		})
+	}
+
+	// run refuses to replace what isn't a socket of ours
+	if err := run(&relayConfig{socketPath: file}); err == nil {
+		t.Fatal("relay replaced a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("file removed: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// vsockConn wraps a connected AF_VSOCK socket. The net package can't wrap AF_VSOCK file descriptors, so the socket is
+// driven through os.File which still uses the runtime poller for non-blocking descriptors.
+type vsockConn struct {
+	*os.File
+}
+
+func dialVSock(cid uint32, port uint32) (*vsockConn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create vsock socket: %w", err)
+	}
+
+	if err = unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("vsock connect to %d:0x%x failed: %w", cid, port, err)
+	}
+
+	if err = unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return &vsockConn{File: os.NewFile(uintptr(fd), fmt.Sprintf("vsock:%d:%d", cid, port))}, nil
+}
+
+func (c *vsockConn) CloseWrite() error {
+	rc, err := c.File.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var shutdownErr error
+	err = rc.Control(func(fd uintptr) {
+		shutdownErr = unix.Shutdown(int(fd), unix.SHUT_WR)
+	})
+	if err != nil {
+		return err
+	}
+	return shutdownErr
+}
@@ -0,0 +1,92 @@
+package headless
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"ncryptagent/keyman"
+	"ncryptagent/keyman/listeners"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// Main runs the agent without a user interface until it is interrupted or, when started by the service control
+// manager, until the service is stopped, and returns the process exit code
+func Main(args []string) int {
+	fs := flag.NewFlagSet("headless", flag.ContinueOnError)
+	configPath := fs.String("config", defaultConfigPath(), "path of the config file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	setupLog(*configPath)
+
+	if isService() {
+		return runService(*configPath)
+	}
+
+	km, err := start(*configPath)
+	if err != nil {
+		log.Printf("%s", err)
+		return 1
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	s := <-sig
+	log.Printf("Received %s, shutting down", s)
+
+	km.Close()
+	return 0
+}
+
+// start loads the config and starts the KeyManager, PINs are asked for with pinentry and notifications are logged.
+// The Pageant and WSL2 listeners need the user interface and are not started.
+func start(configPath string) (*keyman.KeyManager, error) {
+	km, err := keyman.NewKeyManager(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load KeyManager: %w", err)
+	}
+
+	km.SetHeadless()
+	notifyChan := make(chan keyman.NotifyMsg)
+	km.SetNotifyChan(notifyChan)
+	km.SetPINHandler(pinentryPrompt)
+	go func() {
+		for n := range notifyChan {
+			log.Printf("%s: %s", n.Title, n.Message)
+		}
+	}()
+
+	if err = km.Start(); err != nil {
+		km.Close()
+		return nil, fmt.Errorf("unable to start KeyManager: %w", err)
+	}
+
+	for _, k := range km.KeysList() {
+		if k.Missing {
+			log.Printf("Key %s is not available: %v", k.Name, k.LoadError)
+		}
+	}
+	if km.GetListenerEnabled(listeners.TYPE_UNIX) && runtime.GOOS != "windows" {
+		log.Printf("Agent listening, use SSH_AUTH_SOCK=%s", km.UnixSocketPath())
+	}
+	if km.GetListenerEnabled(listeners.TYPE_NAMED_PIPE) && runtime.GOOS == "windows" {
+		log.Printf("Agent listening on %s", listeners.NAMED_PIPE)
+	}
+	if pipe := km.MachineNamedPipe(); pipe != "" {
+		log.Printf("Machine scope keys served on %s", pipe)
+	}
+	return km, nil
+}
+
+func defaultConfigPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "config.json"
+	}
+	return filepath.Join(configDir, "nCryptAgent", "config.json")
+}
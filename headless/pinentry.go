@@ -0,0 +1,114 @@
+package headless
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// pinentryPrompt asks for a PIN with pinentry, the program gpg-agent uses, PINENTRY_PROGRAM selects another one. The
+// terminal in GPG_TTY is passed on for the curses and tty variants.
+func pinentryPrompt(title, message string) ([]byte, bool) {
+	program := os.Getenv("PINENTRY_PROGRAM")
+	if program == "" {
+		program = "pinentry"
+	}
+	cmd := exec.Command(program)
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		cmd.Args = append(cmd.Args, "--ttyname", tty)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		log.Printf("unable to ask for a PIN: %s", err)
+		return nil, false
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Printf("unable to ask for a PIN: %s", err)
+		return nil, false
+	}
+	if err = cmd.Start(); err != nil {
+		log.Printf("unable to start %s to ask for a PIN: %s", program, err)
+		return nil, false
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	r := bufio.NewReader(stdout)
+	if _, err = assuanResponse(r); err != nil {
+		log.Printf("%s did not start: %s", program, err)
+		return nil, false
+	}
+	for _, command := range []string{"SETTITLE " + assuanEscape(title), "SETDESC " + assuanEscape(message), "SETPROMPT PIN:"} {
+		fmt.Fprintf(stdin, "%s\n", command)
+		if _, err = assuanResponse(r); err != nil {
+			log.Printf("%s failed: %s", program, err)
+			return nil, false
+		}
+	}
+
+	// an error response means the prompt was cancelled
+	fmt.Fprintf(stdin, "GETPIN\n")
+	pin, err := assuanResponse(r)
+	if err != nil {
+		return nil, false
+	}
+	fmt.Fprintf(stdin, "BYE\n")
+	return pin, true
+}
+
+// assuanResponse reads the lines of a response up to its OK or ERR, returning the data sent with it. The lines are
+// overwritten once they are decoded as the data may be a PIN.
+func assuanResponse(r *bufio.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			wipe(data)
+			return nil, err
+		}
+		text := bytes.TrimRight(line, "\r\n")
+		switch {
+		case bytes.Equal(text, []byte("OK")) || bytes.HasPrefix(text, []byte("OK ")):
+			return data, nil
+		case bytes.HasPrefix(text, []byte("ERR ")):
+			err = fmt.Errorf("%s", text[4:])
+			wipe(data)
+			return nil, err
+		case bytes.HasPrefix(text, []byte("D ")):
+			data = assuanUnescape(data, text[2:])
+		}
+		wipe(line)
+	}
+}
+
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// assuanUnescape appends the decoded s to out
+func assuanUnescape(out []byte, s []byte) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if b, err := strconv.ParseUint(string(s[i+1:i+3]), 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return out
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package headless
+
+import (
+	"log"
+	"os"
+)
+
+// setupLog logs to stderr
+func setupLog(configPath string) {
+	log.SetOutput(os.Stderr)
+}
+
+// isService is false, services are run by the service control manager of Windows
+func isService() bool {
+	return false
+}
+
+// runService is not reached outside Windows
+func runService(configPath string) int {
+	return 1
+}
@@ -0,0 +1,74 @@
+package headless
+
+import (
+	"golang.org/x/sys/windows/svc"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// SERVICE_NAME is the name the agent registers with the service control manager, e.g. with
+// sc create nCryptAgent binPath= "C:\path\to\nCryptAgent.exe -headless -config C:\ProgramData\nCryptAgent\config.json"
+const SERVICE_NAME = "nCryptAgent"
+
+// isService reports whether the service control manager started the process
+func isService() bool {
+	service, err := svc.IsWindowsService()
+	if err != nil {
+		log.Printf("unable to determine whether running as a service: %s", err)
+		return false
+	}
+	return service
+}
+
+// setupLog logs to nCryptAgent.log next to the config file, like the user interface does. The agent is built for the
+// GUI subsystem and a service has no console either.
+func setupLog(configPath string) {
+	logPath := filepath.Join(filepath.Dir(configPath), "nCryptAgent.log")
+	os.MkdirAll(filepath.Dir(logPath), os.ModePerm)
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("Could not open log file, logging to STDERR")
+		log.SetOutput(os.Stderr)
+		return
+	}
+	log.SetOutput(f)
+}
+
+// runService runs the agent as a Windows service until the service is stopped
+func runService(configPath string) int {
+	if err := svc.Run(SERVICE_NAME, &agentService{configPath: configPath}); err != nil {
+		log.Printf("unable to run the %s service: %s", SERVICE_NAME, err)
+		return 1
+	}
+	return 0
+}
+
+type agentService struct {
+	configPath string
+}
+
+func (s *agentService) Execute(args []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	km, err := start(s.configPath)
+	if err != nil {
+		log.Printf("%s", err)
+		return true, 1
+	}
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			status <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Printf("Service stopping, shutting down")
+			status <- svc.Status{State: svc.StopPending}
+			km.Close()
+			return false, 0
+		}
+	}
+	km.Close()
+	return false, 0
+}
@@ -0,0 +1,117 @@
+package keyman
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"ncryptagent/attest"
+	"ncryptagent/ncrypt"
+	"strings"
+)
+
+// AttestationConfig is the attestation identity key that certifies TPM keys for ExportAttestation. The AIK is created
+// and certified by an attestation CA outside of the agent, like one enrolled for a device management service.
+type AttestationConfig struct {
+	// AIKContainer is the container of the AIK in the Microsoft Platform Crypto Provider
+	AIKContainer string `json:"aikContainer"`
+	// AIKCertificate is a PEM file with the certificate of the AIK followed by its intermediates
+	AIKCertificate string `json:"aikCertificate"`
+}
+
+// Attestable reports whether the key is a loaded TPM key whose attestation can be exported
+func (k *Key) Attestable() bool {
+	nk, ok := k.key.(*ncryptKey)
+	return ok && nk.provider == ncrypt.ProviderMSPlatform
+}
+
+// ExportAttestation returns the attestation bundle of a key of the Microsoft Platform Crypto Provider: the TPM's
+// certification of the key by the configured AIK, the AIK certificate chain and the TPM's EK certificate. The nonce of
+// the verifier, if any, is signed along. A configured key that isn't loaded yet is loaded for it.
+func (km *KeyManager) ExportAttestation(name string, nonce []byte) (*attest.Bundle, error) {
+	cfg := km.config.Attestation
+	if cfg == nil || cfg.AIKContainer == "" || cfg.AIKCertificate == "" {
+		return nil, fmt.Errorf("no attestation identity key configured, set aikContainer and aikCertificate under attestation in the config")
+	}
+
+	k, ok := km.Keys[name]
+	if !ok || k.key == nil {
+		var err error
+		if k, err = km.loadConfiguredKey(name); err != nil {
+			return nil, err
+		}
+	}
+	nk, ok := k.key.(*ncryptKey)
+	if !ok || nk.provider != ncrypt.ProviderMSPlatform {
+		return nil, fmt.Errorf("key %s is not a key of the %s, only TPM keys can be attested", name, ncrypt.ProviderMSPlatform)
+	}
+	b, ok := k.backend.(*ncryptBackend)
+	if !ok {
+		return nil, fmt.Errorf("key %s has no NCRYPT backend", name)
+	}
+
+	certs, err := attest.ReadCertificates(cfg.AIKCertificate)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the AIK certificate: %w", err)
+	}
+	claim, ek, err := b.keyAttestation(nk, cfg.AIKContainer, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("unable to attest key %s: %w", name, err)
+	}
+
+	bundle := &attest.Bundle{
+		Version:        attest.BUNDLE_VERSION,
+		Name:           name,
+		PublicKey:      strings.TrimSpace(string(ssh.MarshalAuthorizedKey(*k.SSHPublicKey))),
+		Nonce:          nonce,
+		KeyAttestation: claim,
+		EKCertificate:  ek,
+	}
+	for _, cert := range certs {
+		bundle.AIKCertificates = append(bundle.AIKCertificates, cert.Raw)
+	}
+
+	log.Printf("Exported the attestation of key %s by AIK %s", name, cfg.AIKContainer)
+	return bundle, nil
+}
+
+// loadConfiguredKey loads a key of the config that isn't loaded, for commands run without starting the agent
+func (km *KeyManager) loadConfiguredKey(name string) (*Key, error) {
+	for _, kc := range km.config.Keys {
+		if kc.Name == name {
+			return km.loadKey(kc)
+		}
+	}
+	return nil, fmt.Errorf("no key named %s", name)
+}
+
+// keyAttestation certifies a key with the AIK of the platform provider and reads the TPM's EK certificate, which is
+// left out when the TPM has none in its NV storage
+func (b *ncryptBackend) keyAttestation(nk *ncryptKey, aikContainer string, nonce []byte) ([]byte, []byte, error) {
+	ph, err := b.getProviderHandle(ncrypt.ProviderMSPlatform)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aik, err := b.api.OpenKey(ph, aikContainer, 0, ncrypt.NCRYPT_SILENT_FLAG)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open AIK %s: %w", aikContainer, err)
+	}
+	defer b.api.FreeObject(aik)
+
+	claim, err := b.api.CreateClaim(nk.handle, aik, ncrypt.NCRYPT_CLAIM_AUTHORITY_AND_SUBJECT, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ek []byte
+	for _, property := range []string{ncrypt.NCRYPT_PCP_RSA_EKNVCERT_PROPERTY, ncrypt.NCRYPT_PCP_ECC_EKNVCERT_PROPERTY, ncrypt.NCRYPT_PCP_EKNVCERT_PROPERTY} {
+		if ek, err = b.api.GetPropertyBytes(ph, property); err == nil && len(ek) > 0 {
+			break
+		}
+	}
+	if len(ek) == 0 {
+		log.Printf("The TPM has no EK certificate, exporting the attestation without it")
+		ek = nil
+	}
+	return claim, ek, nil
+}
@@ -0,0 +1,236 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"ncryptagent/attest"
+	"ncryptagent/ncrypt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestAttestation exports the attestation of TPM keys of an ncrypt.Emulator certified by the AIK of a
+// tpmFixture and runs the verifier on it, unchanged and tampered with. With ATTESTATION_FIXTURE_DIR set the bundle
+// of the P-256 key, its nonce and the fixture's root are left there as bundle.json, nonce.hex and roots.pem for
+// -verify-attestation.
+func TestAttestation(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	tmp := t.TempDir()
+	dir := os.Getenv("ATTESTATION_FIXTURE_DIR")
+	if dir == "" {
+		dir = tmp
+	}
+
+	const aikContainer = "Emulated AIK"
+	fixture, err := newTPMFixture()
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu.EKCertificate = fixture.EKCertificate
+	if err = emu.AddKey(ncrypt.ProviderMSPlatform, aikContainer, fixture.AIK, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "roots.pem"), fixture.RootPEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(tmp, "aik.pem"), fixture.AIKChainPEM(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	km := newDetachedKeyManager(filepath.Join(tmp, "config.json"))
+	km.RegisterBackend(newNCryptBackend(emu))
+	defer func() {
+		// the AIK is freed after each export, the keys and providers when the key manager closes
+		km.Close()
+		if n := emu.OpenHandles(); n != 0 {
+			t.Errorf("%d handles were not freed", n)
+		}
+	}()
+
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	opts := attest.VerifyOptions{Roots: fixture.Roots(), Nonce: nonce, RequireEK: true}
+
+	check(t, "unconfigured", func() error {
+		if _, err := km.ExportAttestation("none", nonce); err == nil {
+			return fmt.Errorf("exported without an AIK")
+		}
+		return nil
+	})
+	km.config.Attestation = &AttestationConfig{AIKContainer: aikContainer, AIKCertificate: filepath.Join(tmp, "aik.pem")}
+
+	for _, alg := range []string{ncrypt.ALG_ECDSA_P256, ncrypt.ALG_RSA} {
+		keyName := "attested-" + alg
+		t.Run(keyName, func(t *testing.T) {
+			var bundle *attest.Bundle
+			if !check(t, "export", func() error {
+				_, err := km.CreateNewNCryptKey(keyName, "", ncrypt.ProviderMSPlatform, alg, 2048, "", "")
+				if err != nil {
+					return err
+				}
+				bundle, err = km.ExportAttestation(keyName, nonce)
+				return err
+			}) {
+				return
+			}
+
+			check(t, "verify", func() error {
+				res, err := attest.Verify(bundle, opts)
+				if err != nil {
+					return err
+				}
+				if res.EK == nil || res.Attributes&attest.TPMA_FIXED_TPM == 0 {
+					return fmt.Errorf("verified without an EK or fixedTPM")
+				}
+				if !bytes.Equal(res.PublicKey.Marshal(), (*km.Keys[keyName].SSHPublicKey).Marshal()) {
+					return fmt.Errorf("verified another key")
+				}
+				return nil
+			})
+			check(t, "bundle file", func() error {
+				path := filepath.Join(tmp, "bundle.json")
+				if alg == ncrypt.ALG_ECDSA_P256 {
+					path = filepath.Join(dir, "bundle.json")
+					if err := os.WriteFile(filepath.Join(dir, "nonce.hex"), []byte(fmt.Sprintf("%x\n", nonce)), 0644); err != nil {
+						return err
+					}
+				}
+				if err := bundle.WriteFile(path); err != nil {
+					return err
+				}
+				read, err := attest.ReadBundle(path)
+				if err != nil {
+					return err
+				}
+				_, err = attest.Verify(read, opts)
+				return err
+			})
+			testAttestationTampering(t, bundle, fixture, opts)
+		})
+	}
+
+	check(t, "imported key not generated in the TPM", func() error {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if _, err = km.ImportKey(&KeyConfig{Name: "imported", Type: "NCRYPT", ProviderName: ncrypt.ProviderMSPlatform}, priv, CreateOptions{}); err != nil {
+			return err
+		}
+		bundle, err := km.ExportAttestation("imported", nonce)
+		if err != nil {
+			return err
+		}
+		if _, err = attest.Verify(bundle, opts); err == nil || !strings.Contains(err.Error(), "not generated in the TPM") {
+			return fmt.Errorf("the attestation of an imported key verified: %v", err)
+		}
+		return nil
+	})
+
+	check(t, "software key refused", func() error {
+		if _, err := km.CreateNewNCryptKey("software", "", ncrypt.ProviderMSSoftware, ncrypt.ALG_ECDSA_P256, 0, "", ""); err != nil {
+			return err
+		}
+		if _, err := km.ExportAttestation("software", nonce); err == nil {
+			return fmt.Errorf("exported the attestation of a software key")
+		}
+		return nil
+	})
+
+	check(t, "before Windows 10", func() error {
+		emu.Missing = []string{"NCryptCreateClaim"}
+		defer func() { emu.Missing = nil }()
+		if _, err := km.ExportAttestation("attested-"+ncrypt.ALG_ECDSA_P256, nonce); !errors.Is(err, ncrypt.ErrNotSupported) {
+			return fmt.Errorf("export without NCryptCreateClaim returned %v, expected ErrNotSupported", err)
+		}
+		return nil
+	})
+}
+
+// testAttestationTampering runs the verifier on bundles that must not verify
+func testAttestationTampering(t *testing.T, bundle *attest.Bundle, fixture *tpmFixture, opts attest.VerifyOptions) {
+	tampered := func(name string, f func(b *attest.Bundle, o *attest.VerifyOptions) error, expect string) {
+		check(t, name, func() error {
+			b := *bundle
+			b.KeyAttestation = append([]byte(nil), bundle.KeyAttestation...)
+			o := opts
+			if err := f(&b, &o); err != nil {
+				return err
+			}
+			_, err := attest.Verify(&b, o)
+			if err == nil {
+				return fmt.Errorf("tampered bundle verified")
+			}
+			if !strings.Contains(err.Error(), expect) {
+				return fmt.Errorf("expected an error about %q, got %w", expect, err)
+			}
+			return nil
+		})
+	}
+
+	tampered("wrong nonce", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		o.Nonce = []byte("another nonce")
+		return nil
+	}, "nonce")
+	tampered("other public key", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		pub, err := ssh.NewPublicKey(&other.PublicKey)
+		if err != nil {
+			return err
+		}
+		b.PublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+		return nil
+	}, "not the bundle's public key")
+	tampered("modified attestation", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		// a byte of the TPMS_ATTEST after the 24 byte header
+		b.KeyAttestation[24+10] ^= 0xff
+		return nil
+	}, "not signed by the AIK")
+	tampered("untrusted roots", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		other, err := newTPMFixture()
+		if err != nil {
+			return err
+		}
+		o.Roots = other.Roots()
+		return nil
+	}, "AIK certificate")
+	tampered("other AIK", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		// a genuine statement of another TPM about the same key
+		other, err := newTPMFixture()
+		if err != nil {
+			return err
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(b.PublicKey))
+		if err != nil {
+			return err
+		}
+		b.KeyAttestation, err = attest.CertifyKey(other.AIK, pub.(ssh.CryptoPublicKey).CryptoPublicKey(), attest.TPMA_NON_EXPORTABLE|attest.TPMA_SIGN_ENCRYPT, o.Nonce)
+		return err
+	}, "not signed by the AIK")
+	tampered("exportable key", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(b.PublicKey))
+		if err != nil {
+			return err
+		}
+		b.KeyAttestation, err = attest.CertifyKey(fixture.AIK, pub.(ssh.CryptoPublicKey).CryptoPublicKey(), attest.TPMA_SENSITIVE_ORIGIN|attest.TPMA_SIGN_ENCRYPT, o.Nonce)
+		return err
+	}, "not generated in the TPM")
+	tampered("missing EK", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		b.EKCertificate = nil
+		return nil
+	}, "no EK certificate")
+	tampered("truncated", func(b *attest.Bundle, o *attest.VerifyOptions) error {
+		b.KeyAttestation = b.KeyAttestation[:len(b.KeyAttestation)-8]
+		return nil
+	}, "truncated")
+}
@@ -0,0 +1,132 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"time"
+)
+
+// oidEKCertificate is the extended key usage of TPM endorsement key certificates, tcg-kp-EKCertificate
+var oidEKCertificate = asn1.ObjectIdentifier{2, 23, 133, 8, 1}
+
+// tpmFixture is an emulated TPM with its PKI: a root CA standing in for the TPM vendor and the attestation CA, which
+// issued the certificates of an endorsement key and an attestation identity key. It gives the verifier data to check
+// without a TPM. The emulator signs with its AIK.
+type tpmFixture struct {
+	Root    *x509.Certificate
+	rootKey crypto.Signer
+
+	EK            crypto.Signer
+	EKCertificate []byte
+	AIK           crypto.Signer
+	// AIKCertificate is issued by an intermediate, AIKIntermediate
+	AIKCertificate  []byte
+	AIKIntermediate []byte
+}
+
+// newTPMFixture generates the keys and certificates of a fixture
+func newTPMFixture() (*tpmFixture, error) {
+	f := &tpmFixture{}
+	var err error
+
+	if f.rootKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, err
+	}
+	root := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Emulated TPM Root CA"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rootDER, err := f.issue(root, nil, nil, f.rootKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	if f.Root, err = x509.ParseCertificate(rootDER); err != nil {
+		return nil, err
+	}
+
+	if f.EK, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		return nil, err
+	}
+	f.EKCertificate, err = f.issue(&x509.Certificate{
+		KeyUsage:           x509.KeyUsageKeyEncipherment,
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{oidEKCertificate},
+	}, f.Root, f.rootKey, f.EK.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	// the attestation CA is an intermediate of the root
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	f.AIKIntermediate, err = f.issue(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Emulated Attestation CA"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, f.Root, f.rootKey, intermediateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	intermediate, err := x509.ParseCertificate(f.AIKIntermediate)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.AIK, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		return nil, err
+	}
+	f.AIKCertificate, err = f.issue(&x509.Certificate{
+		Subject:  pkix.Name{CommonName: "Emulated AIK"},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+	}, intermediate, intermediateKey, f.AIK.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// issue signs a certificate valid for a day with the issuer, self-signed when issuer is nil
+func (f *tpmFixture) issue(template, issuer *x509.Certificate, issuerKey crypto.Signer, pub crypto.PublicKey) ([]byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+	if issuer == nil {
+		issuer, issuerKey = template, f.rootKey
+	}
+	return x509.CreateCertificate(rand.Reader, template, issuer, pub, issuerKey)
+}
+
+// Roots returns a pool with the fixture's root CA
+func (f *tpmFixture) Roots() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(f.Root)
+	return pool
+}
+
+// RootPEM returns the root CA in PEM, as the verifier reads its roots
+func (f *tpmFixture) RootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Root.Raw})
+}
+
+// AIKChainPEM returns the AIK certificate followed by its intermediate in PEM, as the agent reads it
+func (f *tpmFixture) AIKChainPEM() []byte {
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.AIKCertificate})
+	return append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.AIKIntermediate})...)
+}
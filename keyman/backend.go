@@ -0,0 +1,308 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"sort"
+)
+
+// KeyCapabilities describe what using or creating a key involves
+type KeyCapabilities struct {
+	// PIN is set when signing may prompt for a PIN or password
+	PIN bool
+	// Touch is set when signing needs the user to touch the device
+	Touch bool
+	// Attestation is set when the backend can prove where the key was generated
+	Attestation bool
+	// Create is set when the backend can generate new keys
+	Create bool
+	// Delete is set when the backend can remove keys from their storage
+	Delete bool
+	// Software is set when the private key is decrypted into the agent's memory instead of staying in hardware
+	Software bool
+}
+
+// CreateOptions carries the parameters of a new key that are not stored in its KeyConfig
+type CreateOptions struct {
+	// Password protects a new key, backends without passwords ignore it
+	Password string
+	// Application, COSEAlgorithm, COSEHash and Resident describe a new WebAuthN credential
+	Application   string
+	COSEAlgorithm int64
+	COSEHash      string
+	Resident      bool
+	// HWND is the window prompts for the new key are shown over
+	HWND uintptr
+	// PINPolicy and TouchPolicy of a new PIV key by name, like "once" or "always", empty for the card's defaults.
+	// ManagementKey is the card's management key in hex, empty for the default one, and Certificate has a self-signed
+	// certificate written to the slot.
+	PINPolicy     string
+	TouchPolicy   string
+	ManagementKey string
+	Certificate   bool
+}
+
+// KeyBackend is a source of keys, selected by KeyConfig.Type
+type KeyBackend interface {
+	// Type is the KeyConfig.Type of the backend's keys
+	Type() string
+	Capabilities() KeyCapabilities
+	// Load opens the key kc describes
+	Load(kc *KeyConfig) (BackendKey, error)
+	// Create generates a new key. Name, Algorithm and Length of kc are set by the caller, the backend fills in what
+	// it needs to load the key again, e.g. the container name.
+	Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error)
+	// Delete removes a key from the backend's storage, key is nil when the key could not be loaded
+	Delete(kc *KeyConfig, key BackendKey) error
+	Close() error
+}
+
+// BackendKey is a key loaded by a KeyBackend
+type BackendKey interface {
+	Public() ssh.PublicKey
+	// Sign signs data, algorithm is an ssh signature algorithm or empty for the key's default one
+	Sign(data []byte, algorithm string) (*ssh.Signature, error)
+	Capabilities() KeyCapabilities
+	Close() error
+}
+
+// backendPreparer is implemented by backends that need to open something before any of their keys can be loaded,
+// a failure stops the KeyManager from starting
+type backendPreparer interface {
+	Prepare(keys []*KeyConfig) error
+}
+
+// keyImporter is implemented by backends that can store an existing private key instead of generating one. Like
+// Create the backend fills in what it needs to load the key again, and the key's algorithm and length.
+type keyImporter interface {
+	Import(kc *KeyConfig, key crypto.Signer, opts CreateOptions) (BackendKey, error)
+}
+
+// algorithmReporter is implemented by keys that know their algorithm and length, which a config made from a
+// container name lacks
+type algorithmReporter interface {
+	Algorithm() (string, int)
+}
+
+// windowOwner is implemented by keys that show prompts over a window of ours
+type windowOwner interface {
+	SetHWND(hwnd uintptr)
+}
+
+// RegisterBackend makes a backend's keys loadable, replacing any backend of the same type
+func (km *KeyManager) RegisterBackend(b KeyBackend) {
+	if km.backends == nil {
+		km.backends = make(map[string]KeyBackend)
+	}
+	km.backends[b.Type()] = b
+}
+
+// Backend returns the backend of a key type, or nil
+func (km *KeyManager) Backend(keyType string) KeyBackend {
+	return km.backends[keyType]
+}
+
+// BackendTypes returns the registered key types, sorted
+func (km *KeyManager) BackendTypes() []string {
+	var types []string
+	for t := range km.backends {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (km *KeyManager) prepareBackends() error {
+	for _, b := range km.backends {
+		p, ok := b.(backendPreparer)
+		if !ok {
+			continue
+		}
+		var keys []*KeyConfig
+		for _, kc := range km.config.Keys {
+			if kc.Type == b.Type() {
+				keys = append(keys, kc)
+			}
+		}
+		if err := p.Prepare(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (km *KeyManager) closeBackends() {
+	for _, b := range km.backends {
+		if err := b.Close(); err != nil {
+			log.Printf("Closing %s backend failed: %s", b.Type(), err)
+		}
+	}
+}
+
+// loadKey loads a configured key through the backend of its type and registers it
+func (km *KeyManager) loadKey(kc *KeyConfig) (*Key, error) {
+	if err := checkScope(kc); err != nil {
+		return nil, err
+	}
+	b := km.backends[kc.Type]
+	if b == nil {
+		return nil, fmt.Errorf("%s keys are not supported on this platform", kc.Type)
+	}
+
+	bk, err := b.Load(kc)
+	if err != nil {
+		return nil, err
+	}
+
+	return km.addKey(kc, b, bk), nil
+}
+
+// CreateKey generates a new key with the backend of kc.Type, registers it and saves the config
+func (km *KeyManager) CreateKey(kc *KeyConfig, opts CreateOptions) (*Key, error) {
+	if _, keyNameExists := km.Keys[kc.Name]; keyNameExists {
+		return nil, fmt.Errorf("key named %s already exists", kc.Name)
+	}
+	if err := checkScope(kc); err != nil {
+		return nil, err
+	}
+
+	b := km.backends[kc.Type]
+	if b == nil {
+		return nil, fmt.Errorf("%s keys are not supported on this platform", kc.Type)
+	}
+	if !b.Capabilities().Create {
+		return nil, fmt.Errorf("%s keys can't be created", kc.Type)
+	}
+
+	bk, err := b.Create(kc, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	k := km.addKey(kc, b, bk)
+	return k, km.SaveConfig()
+}
+
+// ImportKey stores an existing private key with the backend of kc.Type, registers it and saves the config. The caller
+// still owns key and wipes it afterwards.
+func (km *KeyManager) ImportKey(kc *KeyConfig, key crypto.Signer, opts CreateOptions) (*Key, error) {
+	if _, keyNameExists := km.Keys[kc.Name]; keyNameExists {
+		return nil, fmt.Errorf("key named %s already exists", kc.Name)
+	}
+	if err := checkScope(kc); err != nil {
+		return nil, err
+	}
+
+	b := km.backends[kc.Type]
+	if b == nil {
+		return nil, fmt.Errorf("%s keys are not supported on this platform", kc.Type)
+	}
+	importer, ok := b.(keyImporter)
+	if !ok {
+		return nil, fmt.Errorf("keys can't be imported into the %s backend", kc.Type)
+	}
+
+	bk, err := importer.Import(kc, key, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	k := km.addKey(kc, b, bk)
+	return k, km.SaveConfig()
+}
+
+// addKey registers a loaded key under its configured name
+func (km *KeyManager) addKey(kc *KeyConfig, b KeyBackend, bk BackendKey) *Key {
+	pub := bk.Public()
+	k := &Key{
+		Name:         kc.Name,
+		Type:         kc.Type,
+		algorithm:    kc.Algorithm,
+		length:       kc.Length,
+		SSHPublicKey: &pub,
+		config:       kc,
+		backend:      b,
+		key:          bk,
+	}
+	if ar, ok := bk.(algorithmReporter); ok {
+		algorithm, length := ar.Algorithm()
+		if algorithm != "" {
+			k.algorithm = algorithm
+		}
+		if length != 0 {
+			k.length = length
+		}
+	}
+
+	km.Keys[kc.Name] = k
+
+	k.SetTimeout(km.pinTimeoutFor(kc))
+	if km.hwnd != 0 {
+		k.SetHWND(km.hwnd)
+	}
+	if km.publicKeysDir != "" {
+		k.SaveSSHPublicKey(km.publicKeysDir)
+		k.LoadCertificate("")
+	}
+
+	return k
+}
+
+// signerKey is a BackendKey for keys that are available as a crypto.Signer
+type signerKey struct {
+	signer crypto.Signer
+	pub    ssh.PublicKey
+	caps   KeyCapabilities
+}
+
+func newSignerKey(signer crypto.Signer, caps KeyCapabilities) (*signerKey, error) {
+	pub, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &signerKey{signer: signer, pub: pub, caps: caps}, nil
+}
+
+func (s *signerKey) Public() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *signerKey) Sign(data []byte, algorithm string) (*ssh.Signature, error) {
+	sshSigner, err := ssh.NewSignerFromSigner(s.signer)
+	if err != nil {
+		return nil, err
+	}
+
+	if algorithm == "" {
+		return sshSigner.Sign(rand.Reader, data)
+	}
+
+	algorithmSigner, ok := sshSigner.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("invalid signer type %T", sshSigner)
+	}
+	return algorithmSigner.SignWithAlgorithm(rand.Reader, data, algorithm)
+}
+
+func (s *signerKey) Capabilities() KeyCapabilities {
+	return s.caps
+}
+
+// pinCache returns the signer's PIN cache, if it keeps one
+func (s *signerKey) pinCache() (pinCache, bool) {
+	pc, ok := s.signer.(pinCache)
+	return pc, ok
+}
+
+// pinManager returns the signer's PIN management, if it has one
+func (s *signerKey) pinManager() (pinManager, bool) {
+	pm, ok := s.signer.(pinManager)
+	return pm, ok
+}
+
+func (s *signerKey) Close() error {
+	return nil
+}
@@ -0,0 +1,368 @@
+package keyman
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"ncryptagent/ncrypt"
+	"ncryptagent/piv"
+	"os"
+	"testing"
+)
+
+// check runs f as the subtest name, failing it with the error f returns. It reports whether f succeeded, so that
+// checks depending on it can be skipped.
+func check(t *testing.T, name string, f func() error) bool {
+	t.Helper()
+	return t.Run(name, func(t *testing.T) {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// TestBackendConformance runs the conformance checks on every backend that can run without hardware: software keys,
+// key files, the NCrypt, PIV and OpenPGP backends on their emulators and a PKCS#11 module named in
+// PKCS11_CONFORMANCE_MODULE, with the user PIN in PKCS11_CONFORMANCE_PIN
+func TestBackendConformance(t *testing.T) {
+	t.Run(TYPE_SOFTWARE, func(t *testing.T) {
+		b := NewSoftwareBackend()
+		defer b.Close()
+		CheckBackendConformance(t, b, ConformanceTemplates(TYPE_SOFTWARE), nil)
+	})
+
+	t.Run(TYPE_FILE, func(t *testing.T) {
+		const passphrase = "conformance"
+		b := NewFileBackend(func(title, message string) ([]byte, bool) { return []byte(passphrase), true })
+		defer b.Close()
+
+		plain, _ := writeKeyFile(t, "")
+		encrypted, _ := writeKeyFile(t, passphrase)
+		CheckBackendConformance(t, b, nil, []*KeyConfig{
+			{Name: "plain", Type: TYPE_FILE, ContainerName: plain},
+			{Name: "encrypted", Type: TYPE_FILE, ContainerName: encrypted},
+		})
+	})
+
+	t.Run("NCRYPT", func(t *testing.T) {
+		emu := ncrypt.NewEmulator()
+		defer checkNCryptHandles(t, emu)
+		b := newNCryptBackend(emu)
+		defer b.Close()
+		CheckBackendConformance(t, b, ConformanceTemplates("NCRYPT"), nil)
+	})
+
+	t.Run(TYPE_PIV, func(t *testing.T) {
+		// the keys of an emulated card and keys generated in retired slots
+		_, readers := newPIVTestCard(t, pivTestPIN)
+		b := NewPIVBackend(func(title, message string) ([]byte, bool) { return []byte(pivTestPIN), true }, readers)
+		defer b.Close()
+
+		keys, err := b.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var templates []KeyConfig
+		for i, tc := range []struct {
+			alg    string
+			length int
+		}{
+			{ncrypt.ALG_ECDSA_P256, 0},
+			{ncrypt.ALG_ECDSA_P384, 0},
+			{ncrypt.ALG_RSA, 2048},
+			{ALG_ED25519, 0},
+		} {
+			templates = append(templates, KeyConfig{Algorithm: tc.alg, Length: tc.length, Token: "12345678", KeyID: piv.Slot(0x83 + i).String()})
+		}
+		CheckBackendConformance(t, b, templates, keys)
+	})
+
+	t.Run(TYPE_OPENPGP, func(t *testing.T) {
+		// the keys of three emulated cards
+		_, _, readers := newOpenPGPTestCards(t, openPGPTestPIN)
+		b := NewOpenPGPBackend(func(title, message string) ([]byte, bool) { return []byte(openPGPTestPIN), true }, readers)
+		defer b.Close()
+
+		keys, err := b.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 4 {
+			t.Fatalf("listed %d keys, expected 4", len(keys))
+		}
+		CheckBackendConformance(t, b, nil, keys)
+	})
+
+	t.Run(TYPE_PKCS11, func(t *testing.T) {
+		module := os.Getenv("PKCS11_CONFORMANCE_MODULE")
+		if module == "" {
+			t.Skip("set PKCS11_CONFORMANCE_MODULE to a module with keys on its tokens")
+		}
+		pin := os.Getenv("PKCS11_CONFORMANCE_PIN")
+		b := NewPKCS11Backend(func(title, message string) ([]byte, bool) { return []byte(pin), true })
+		defer b.Close()
+
+		keys, err := b.Keys(module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		CheckBackendConformance(t, b, nil, keys)
+	})
+}
+
+// ConformanceTemplates returns the keys CheckBackendConformance creates by default, one per algorithm the agent
+// offers for new keys
+func ConformanceTemplates(keyType string) []KeyConfig {
+	var templates []KeyConfig
+	for _, alg := range ncrypt.AVAILABLE_ALGORITHMS {
+		kc := KeyConfig{Type: keyType, Algorithm: alg}
+		if alg == ncrypt.ALG_RSA {
+			kc.Length = 2048
+		}
+		if keyType == "NCRYPT" {
+			kc.ProviderName = ncrypt.ProviderMSSoftware
+		}
+		templates = append(templates, kc)
+	}
+	if keyType == TYPE_SOFTWARE {
+		templates = append(templates, KeyConfig{Type: keyType, Algorithm: ALG_ED25519})
+	}
+	return templates
+}
+
+// CheckBackendConformance runs the checks every KeyBackend has to pass, each key in a subtest of t. A key is created
+// from each template, loaded again by its config, used for signing through the backend and through a
+// KeyManagerAgent, and deleted. Backends that can't create keys are checked with the keys in existing, which are not
+// deleted.
+func CheckBackendConformance(t *testing.T, b KeyBackend, templates []KeyConfig, existing []*KeyConfig) {
+	t.Helper()
+	c := &conformanceChecker{backend: b}
+
+	check(t, "type", func() error {
+		if b.Type() == "" {
+			return fmt.Errorf("empty key type")
+		}
+		return nil
+	})
+
+	check(t, "load missing", func() error {
+		containerUUID, _ := uuid.NewRandom()
+		kc := &KeyConfig{Name: "missing", Type: b.Type(), ContainerName: containerUUID.String()}
+		if key, err := b.Load(kc); err == nil {
+			key.Close()
+			return fmt.Errorf("loading a key that doesn't exist succeeded")
+		}
+		return nil
+	})
+
+	keys := 0
+	if b.Capabilities().Create {
+		for i, template := range templates {
+			kc := template
+			kc.Name = fmt.Sprintf("conformance-%s-%d", kc.Algorithm, i)
+			kc.Type = b.Type()
+			t.Run(kc.Name, func(t *testing.T) { c.checkCreated(t, &kc) })
+			keys++
+		}
+	}
+
+	for _, kc := range existing {
+		t.Run(kc.Name, func(t *testing.T) { c.checkExisting(t, kc) })
+		keys++
+	}
+
+	if keys == 0 {
+		t.Errorf("%s: no keys checked", b.Type())
+	}
+}
+
+// newDetachedKeyManager returns a KeyManager without backends, listeners or public key files. The config is only
+// written when configPath is set.
+func newDetachedKeyManager(configPath string) *KeyManager {
+	km := &KeyManager{
+		Keys:       make(map[string]*Key),
+		backends:   make(map[string]KeyBackend),
+		configPath: configPath,
+		config:     &KeyManagerConfig{DisableNotifications: true},
+	}
+	km.sshAgent = KeyManagerAgent{km: km}
+	km.machineAgent = &KeyManagerAgent{km: km, machine: true}
+	return km
+}
+
+func TestAgentSkipsKeysWithoutPublicKey(t *testing.T) {
+	km := newDetachedKeyManager("")
+	kc := &KeyConfig{Name: "missing", Type: TYPE_PKCS11}
+	km.Keys[kc.Name] = &Key{Name: kc.Name, Type: kc.Type, Missing: true, config: kc, LoadError: fmt.Errorf("token not present")}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := km.sshAgent.List(); err != nil || len(ids) != 0 {
+		t.Fatalf("agent lists %d keys (%v), expected none", len(ids), err)
+	}
+	if _, err = km.sshAgent.Sign(pub, []byte("data")); err == nil {
+		t.Fatal("signed with a key the agent doesn't have")
+	}
+}
+
+type conformanceChecker struct {
+	backend KeyBackend
+}
+
+func (c *conformanceChecker) checkCreated(t *testing.T, kc *KeyConfig) {
+	var key BackendKey
+	if !check(t, "create", func() error {
+		var err error
+		key, err = c.backend.Create(kc, CreateOptions{})
+		if err != nil {
+			return err
+		}
+		if kc.Type != c.backend.Type() {
+			return fmt.Errorf("config type changed to %s", kc.Type)
+		}
+		return nil
+	}) {
+		return
+	}
+
+	c.checkKey(t, kc, key)
+
+	reloaded := c.checkReload(t, kc, key)
+	key.Close()
+	if reloaded != nil {
+		t.Run("reloaded", func(t *testing.T) { c.checkKey(t, kc, reloaded) })
+	}
+
+	if c.backend.Capabilities().Delete {
+		check(t, "delete", func() error {
+			if err := c.backend.Delete(kc, reloaded); err != nil {
+				return err
+			}
+			if key, err := c.backend.Load(kc); err == nil {
+				key.Close()
+				return fmt.Errorf("key can still be loaded after it was deleted")
+			}
+			return nil
+		})
+	}
+	if reloaded != nil {
+		reloaded.Close()
+	}
+}
+
+func (c *conformanceChecker) checkExisting(t *testing.T, kc *KeyConfig) {
+	var key BackendKey
+	if !check(t, "load", func() error {
+		var err error
+		key, err = c.backend.Load(kc)
+		return err
+	}) {
+		return
+	}
+	defer key.Close()
+
+	c.checkKey(t, kc, key)
+}
+
+// checkReload loads a created key by its config, it has to have the same public key
+func (c *conformanceChecker) checkReload(t *testing.T, kc *KeyConfig, created BackendKey) BackendKey {
+	var key BackendKey
+	check(t, "reload", func() error {
+		var err error
+		key, err = c.backend.Load(kc)
+		if err != nil {
+			return err
+		}
+		if string(key.Public().Marshal()) != string(created.Public().Marshal()) {
+			return fmt.Errorf("loaded public key %s differs from the created one", ssh.FingerprintSHA256(key.Public()))
+		}
+		return nil
+	})
+	return key
+}
+
+func (c *conformanceChecker) checkKey(t *testing.T, kc *KeyConfig, key BackendKey) {
+	pub := key.Public()
+	if !check(t, "public key", func() error {
+		if pub == nil {
+			return fmt.Errorf("no public key")
+		}
+		_, err := ssh.ParsePublicKey(pub.Marshal())
+		return err
+	}) {
+		return
+	}
+
+	check(t, "capabilities", func() error {
+		kcaps, bcaps := key.Capabilities(), c.backend.Capabilities()
+		if kcaps.PIN && !bcaps.PIN || kcaps.Touch && !bcaps.Touch || kcaps.Attestation && !bcaps.Attestation ||
+			kcaps.Software != bcaps.Software {
+			return fmt.Errorf("key capabilities %+v exceed backend capabilities %+v", kcaps, bcaps)
+		}
+		return nil
+	})
+
+	algorithms := []string{""}
+	if pub.Type() == ssh.KeyAlgoRSA {
+		algorithms = append(algorithms, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512)
+	}
+	for _, algorithm := range algorithms {
+		name := "sign"
+		if algorithm != "" {
+			name = "sign " + algorithm
+		}
+		check(t, name, func() error {
+			data := make([]byte, 64)
+			rand.Read(data)
+			sig, err := key.Sign(data, algorithm)
+			if err != nil {
+				return err
+			}
+			if algorithm != "" && sig.Format != algorithm {
+				return fmt.Errorf("signature format is %s", sig.Format)
+			}
+			return pub.Verify(data, sig)
+		})
+	}
+
+	check(t, "sign unknown algorithm", func() error {
+		if _, err := key.Sign([]byte("data"), "unknown-algorithm@example.com"); err == nil {
+			return fmt.Errorf("signing with an unknown algorithm succeeded")
+		}
+		return nil
+	})
+
+	check(t, "agent", func() error {
+		return c.checkAgent(kc, key)
+	})
+}
+
+// checkAgent serves the key from a KeyManagerAgent, the way the listeners use it
+func (c *conformanceChecker) checkAgent(kc *KeyConfig, key BackendKey) error {
+	km := newDetachedKeyManager("")
+	km.addKey(kc, c.backend, key)
+
+	ids, err := km.sshAgent.List()
+	if err != nil {
+		return err
+	}
+	if len(ids) != 1 || string(ids[0].Marshal()) != string(key.Public().Marshal()) {
+		return fmt.Errorf("agent lists %d keys, expected the key", len(ids))
+	}
+
+	data := []byte("conformance")
+	sig, err := km.sshAgent.Sign(key.Public(), data)
+	if err != nil {
+		return err
+	}
+	return key.Public().Verify(data, sig)
+}
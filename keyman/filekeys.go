@@ -0,0 +1,316 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// TYPE_FILE is the KeyConfig.Type of OpenSSH and PEM private key files, ContainerName is the path of the file
+const TYPE_FILE = "FILE"
+
+// LoadFileKey adds the private key file at kc.ContainerName as a key
+func (km *KeyManager) LoadFileKey(kc *KeyConfig) (*Key, error) {
+	if _, keyNameExists := km.Keys[kc.Name]; keyNameExists {
+		return nil, fmt.Errorf("key named %s already exists", kc.Name)
+	}
+	kc.Type = TYPE_FILE
+	return km.loadKey(kc)
+}
+
+// FileBackend uses private key files for keys that can't live in hardware. The file is read when the key is used, an
+// encrypted one is decrypted with a passphrase asked for through the PIN prompt. The decrypted key is kept for the
+// PIN timeout and overwritten when it is dropped.
+type FileBackend struct {
+	prompt PINPrompt
+}
+
+// NewFileBackend returns a FILE backend asking for passphrases with prompt
+func NewFileBackend(prompt PINPrompt) *FileBackend {
+	return &FileBackend{prompt: prompt}
+}
+
+func (b *FileBackend) Type() string {
+	return TYPE_FILE
+}
+
+func (b *FileBackend) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: true, Software: true}
+}
+
+// Load reads the public key of a key file. OpenSSH files carry it unencrypted, for encrypted PEM files it is taken
+// from the .pub file next to it or from the config.
+func (b *FileBackend) Load(kc *KeyConfig) (BackendKey, error) {
+	if kc.ContainerName == "" {
+		return nil, fmt.Errorf("no key file configured for key %s", kc.Name)
+	}
+	data, err := os.ReadFile(kc.ContainerName)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &fileKey{name: kc.Name, path: kc.ContainerName, prompt: b.prompt}
+
+	raw, err := ssh.ParseRawPrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case err == nil:
+		signer, ok := raw.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T in %s", raw, kc.ContainerName)
+		}
+		k.pub, err = ssh.NewPublicKey(signer.Public())
+		zeroPrivateKey(raw)
+		if err != nil {
+			return nil, err
+		}
+	case errors.As(err, &missing):
+		k.encrypted = true
+		k.pub = missing.PublicKey
+		if k.pub == nil {
+			if k.pub, err = storedPublicKey(kc); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unable to parse key file %s: %w", kc.ContainerName, err)
+	}
+
+	return k, nil
+}
+
+// storedPublicKey returns the public key of an encrypted key file that doesn't include it
+func storedPublicKey(kc *KeyConfig) (ssh.PublicKey, error) {
+	authorizedKey := []byte(kc.SSHPublicKey)
+	if pubData, err := os.ReadFile(kc.ContainerName + ".pub"); err == nil {
+		authorizedKey = pubData
+	}
+	if len(authorizedKey) == 0 {
+		return nil, fmt.Errorf("the public key of %s is unknown, put it in %s.pub", kc.ContainerName, kc.ContainerName)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(authorizedKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key of %s: %w", kc.ContainerName, err)
+	}
+	return pub, nil
+}
+
+func (b *FileBackend) Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error) {
+	return nil, fmt.Errorf("creating key files is not supported")
+}
+
+func (b *FileBackend) Delete(kc *KeyConfig, key BackendKey) error {
+	return fmt.Errorf("deleting key files is not supported")
+}
+
+func (b *FileBackend) Close() error {
+	return nil
+}
+
+// fileKey is a key file, decrypted while its PIN cache lasts. unlockMu serializes decrypting the file, so that
+// concurrent signatures ask for the passphrase once, while mu guards the decrypted key and is not held during the
+// prompt.
+type fileKey struct {
+	name      string
+	path      string
+	prompt    PINPrompt
+	pub       ssh.PublicKey
+	encrypted bool
+
+	unlockMu    sync.Mutex
+	mu          sync.Mutex
+	key         interface{}
+	timeout     int
+	timer       *time.Timer
+	timeractive bool
+}
+
+func (k *fileKey) Public() ssh.PublicKey {
+	return k.pub
+}
+
+func (k *fileKey) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: k.encrypted, Software: true}
+}
+
+func (k *fileKey) Sign(data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := k.unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer k.mu.Unlock()
+
+	sk := signerKey{signer: signer, pub: k.pub}
+	sig, err := sk.Sign(data, algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	k.handlePinTimerLocked()
+	return sig, nil
+}
+
+// unlock returns the decrypted key with mu held, reading the file and asking for its passphrase when it isn't cached
+func (k *fileKey) unlock() (crypto.Signer, error) {
+	k.unlockMu.Lock()
+	defer k.unlockMu.Unlock()
+
+	k.mu.Lock()
+	if k.key != nil {
+		return k.key.(crypto.Signer), nil
+	}
+	k.mu.Unlock()
+
+	raw, err := k.decrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	// only unlock sets the key, it can't have been set in the meantime
+	k.mu.Lock()
+	k.key = raw
+	return raw, nil
+}
+
+// decrypt reads the key file, asking for the passphrase of an encrypted one
+func (k *fileKey) decrypt() (crypto.Signer, error) {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	if k.encrypted {
+		if k.prompt == nil {
+			return nil, fmt.Errorf("unable to ask for the passphrase of %s", k.path)
+		}
+		passphrase, ok := k.prompt("Passphrase required", fmt.Sprintf("Enter the passphrase of key %s (%s)", k.name, k.path))
+		if !ok {
+			return nil, fmt.Errorf("passphrase entry for %s was cancelled", k.path)
+		}
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(data, passphrase)
+		for i := range passphrase {
+			passphrase[i] = 0
+		}
+	} else {
+		raw, err = ssh.ParseRawPrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt %s: %w", k.path, err)
+	}
+
+	signer, ok := raw.(crypto.Signer)
+	if !ok {
+		zeroPrivateKey(raw)
+		return nil, fmt.Errorf("unsupported key type %T in %s", raw, k.path)
+	}
+	pub, err := ssh.NewPublicKey(signer.Public())
+	if err != nil || string(pub.Marshal()) != string(k.pub.Marshal()) {
+		zeroPrivateKey(raw)
+		return nil, fmt.Errorf("%s no longer holds the key that was loaded", k.path)
+	}
+	return signer, nil
+}
+
+// handlePinTimerLocked keeps the decrypted key for the timeout after the first signature, like
+// Signer.handlePinTimer does with the PIN of NCrypt keys, a timeout of 0 drops it after every signature
+func (k *fileKey) handlePinTimerLocked() {
+	if !k.timeractive && k.timeout > 0 {
+		log.Printf("Starting key cache purge timer: %ds\n", k.timeout)
+		k.timer = time.AfterFunc(time.Second*time.Duration(k.timeout), func() {
+			k.mu.Lock()
+			defer k.mu.Unlock()
+			k.timeractive = false
+			k.dropLocked()
+			log.Printf("Key cache purged\n")
+		})
+		k.timeractive = true
+	} else if k.timeout == 0 {
+		k.dropLocked()
+	}
+}
+
+func (k *fileKey) dropLocked() {
+	if k.key != nil {
+		zeroPrivateKey(k.key)
+		k.key = nil
+	}
+}
+
+// PINCached reports whether the decrypted key is still held
+func (k *fileKey) PINCached() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.key != nil && k.encrypted
+}
+
+func (k *fileKey) PurgePIN() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.timer != nil {
+		k.timer.Stop()
+	}
+	k.timeractive = false
+	k.dropLocked()
+}
+
+func (k *fileKey) SetPINTimeout(timeout int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.timeout = timeout
+}
+
+func (k *fileKey) Close() error {
+	k.PurgePIN()
+	return nil
+}
+
+// zeroPrivateKey overwrites the secret parts of a parsed private key. Copies that the crypto packages keep internally,
+// like the precomputed values of newer Go versions, are out of reach.
+func zeroPrivateKey(key interface{}) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		zeroInt(k.D)
+		for _, p := range k.Primes {
+			zeroInt(p)
+		}
+		zeroInt(k.Precomputed.Dp)
+		zeroInt(k.Precomputed.Dq)
+		zeroInt(k.Precomputed.Qinv)
+		for _, v := range k.Precomputed.CRTValues {
+			zeroInt(v.Exp)
+			zeroInt(v.Coeff)
+			zeroInt(v.R)
+		}
+	case *ecdsa.PrivateKey:
+		zeroInt(k.D)
+	case ed25519.PrivateKey:
+		for i := range k {
+			k[i] = 0
+		}
+	case *ed25519.PrivateKey:
+		for i := range *k {
+			(*k)[i] = 0
+		}
+	}
+}
+
+func zeroInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+	words := x.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	x.SetInt64(0)
+}
@@ -0,0 +1,226 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPassphrase = "correct horse"
+
+// writeKeyFile writes a new P-256 key to a PEM file, encrypted with passphrase unless it is empty. The public key of
+// an encrypted file goes in the .pub file next to it.
+func writeKeyFile(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if passphrase != "" {
+		if block, err = x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte(passphrase), x509.PEMCipherAES256); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id_ecdsa")
+	if err = os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if passphrase != "" {
+		if err = os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(pub), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path, pub
+}
+
+// testPrompt answers passphrase prompts with the next of its answers, an empty answer cancels the prompt
+type testPrompt struct {
+	answers []string
+	given   [][]byte
+}
+
+func (p *testPrompt) prompt(title, message string) ([]byte, bool) {
+	if len(p.given) == len(p.answers) {
+		return nil, false
+	}
+	answer := p.answers[len(p.given)]
+	pin := []byte(answer)
+	p.given = append(p.given, pin)
+	return pin, answer != ""
+}
+
+func loadFileKey(t *testing.T, path string, prompt PINPrompt) *fileKey {
+	t.Helper()
+	key, err := NewFileBackend(prompt).Load(&KeyConfig{Name: "test", ContainerName: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key.(*fileKey)
+}
+
+func signFileKey(t *testing.T, k *fileKey, pub ssh.PublicKey) error {
+	t.Helper()
+	data := []byte("signed data")
+	sig, err := k.Sign(data, "")
+	if err != nil {
+		return err
+	}
+	if err = pub.Verify(data, sig); err != nil {
+		t.Fatalf("signature doesn't verify: %s", err)
+	}
+	return nil
+}
+
+func TestFileKey(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		passphrase string
+		answers    []string
+		prompts    int
+		err        string
+	}{
+		{name: "unencrypted"},
+		{name: "encrypted", passphrase: testPassphrase, answers: []string{testPassphrase}, prompts: 1},
+		{name: "wrong passphrase", passphrase: testPassphrase, answers: []string{"wrong"}, prompts: 1, err: "unable to decrypt"},
+		{name: "cancelled", passphrase: testPassphrase, answers: []string{""}, prompts: 1, err: "was cancelled"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, pub := writeKeyFile(t, tc.passphrase)
+			p := &testPrompt{answers: tc.answers}
+			k := loadFileKey(t, path, p.prompt)
+			k.SetPINTimeout(60)
+			defer k.Close()
+
+			if !bytes.Equal(k.Public().Marshal(), pub.Marshal()) {
+				t.Fatal("loaded public key doesn't match")
+			}
+			if k.Capabilities().PIN != (tc.passphrase != "") {
+				t.Errorf("PIN capability %t for passphrase %q", k.Capabilities().PIN, tc.passphrase)
+			}
+
+			err := signFileKey(t, k, pub)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("Sign returned %v, expected %q", err, tc.err)
+			}
+			if len(p.given) != tc.prompts {
+				t.Fatalf("prompted %d times, expected %d", len(p.given), tc.prompts)
+			}
+			for _, pin := range p.given {
+				if !bytes.Equal(pin, make([]byte, len(pin))) {
+					t.Errorf("passphrase %q not overwritten", pin)
+				}
+			}
+			if cached := k.PINCached(); cached != (tc.passphrase != "" && tc.err == "") {
+				t.Errorf("PINCached %t", cached)
+			}
+		})
+	}
+}
+
+func TestFileKeyRetry(t *testing.T) {
+	// a failed unlock isn't cached, the next signature asks again
+	path, pub := writeKeyFile(t, testPassphrase)
+	p := &testPrompt{answers: []string{"wrong", testPassphrase}}
+	k := loadFileKey(t, path, p.prompt)
+	k.SetPINTimeout(60)
+	defer k.Close()
+
+	if err := signFileKey(t, k, pub); err == nil {
+		t.Fatal("signed with the wrong passphrase")
+	}
+	if err := signFileKey(t, k, pub); err != nil {
+		t.Fatal(err)
+	}
+	if err := signFileKey(t, k, pub); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.given) != 2 {
+		t.Fatalf("prompted %d times, expected 2", len(p.given))
+	}
+}
+
+func TestFileKeyCacheTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout int
+		// purge drops the cached key after the first signature
+		purge   func(k *fileKey)
+		prompts int
+	}{
+		{"no timeout", 0, func(k *fileKey) {}, 2},
+		{"timeout", 60, func(k *fileKey) {}, 1},
+		{"purged", 60, func(k *fileKey) { k.PurgePIN() }, 2},
+		{"expired", 1, func(k *fileKey) { time.Sleep(1500 * time.Millisecond) }, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, pub := writeKeyFile(t, testPassphrase)
+			p := &testPrompt{answers: []string{testPassphrase, testPassphrase}}
+			k := loadFileKey(t, path, p.prompt)
+			k.SetPINTimeout(tc.timeout)
+			defer k.Close()
+
+			if err := signFileKey(t, k, pub); err != nil {
+				t.Fatal(err)
+			}
+			if k.PINCached() != (tc.timeout > 0) {
+				t.Errorf("PINCached %t after the first signature with timeout %d", k.PINCached(), tc.timeout)
+			}
+			tc.purge(k)
+			if err := signFileKey(t, k, pub); err != nil {
+				t.Fatal(err)
+			}
+			if len(p.given) != tc.prompts {
+				t.Fatalf("prompted %d times, expected %d", len(p.given), tc.prompts)
+			}
+		})
+	}
+}
+
+func TestFileKeyPromptUnlocked(t *testing.T) {
+	// the key stays usable for the UI and purges while its passphrase prompt is open
+	path, pub := writeKeyFile(t, testPassphrase)
+	var k *fileKey
+	prompt := func(title, message string) ([]byte, bool) {
+		done := make(chan struct{})
+		go func() {
+			k.PINCached()
+			k.PurgePIN()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("key locked during the prompt")
+		}
+		return []byte(testPassphrase), true
+	}
+	k = loadFileKey(t, path, prompt)
+	k.SetPINTimeout(60)
+	defer k.Close()
+
+	if err := signFileKey(t, k, pub); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,47 @@
+package keyman
+
+import (
+	"github.com/lxn/win"
+)
+
+// focusState remembers the window that had the focus before a PIN prompt brought ours to the front
+type focusState struct {
+	victimHWND win.HWND
+	victimID   uint32
+	myID       uint32
+}
+
+func (k *Key) TakeFocus() bool {
+	if !k.config.NoPin && k.hwnd != 0 {
+		if pc, ok := k.pinCache(); ok && pc.PINCached() {
+			return false
+		}
+		hwnd := win.HWND(k.hwnd)
+
+		k.focus.victimHWND = win.GetForegroundWindow()
+		k.focus.myID = win.GetCurrentThreadId()
+		k.focus.victimID = win.GetWindowThreadProcessId(k.focus.victimHWND, nil)
+		win.AttachThreadInput(int32(k.focus.victimID), int32(k.focus.myID), true)
+		win.ShowWindow(hwnd, win.SW_NORMAL)
+		win.SetForegroundWindow(hwnd)
+		win.SetFocus(hwnd)
+		win.SetActiveWindow(hwnd)
+		win.AttachThreadInput(int32(k.focus.victimID), int32(k.focus.myID), false)
+
+		return true
+	}
+
+	return false
+}
+
+func (k *Key) ReturnFocus() {
+	if !k.config.NoPin {
+		win.ShowWindow(win.HWND(k.hwnd), win.SW_HIDE)
+		win.AttachThreadInput(int32(k.focus.myID), int32(k.focus.victimID), true)
+		win.ShowWindow(k.focus.victimHWND, win.SW_SHOW)
+		win.SetForegroundWindow(k.focus.victimHWND)
+		win.SetFocus(k.focus.victimHWND)
+		win.SetActiveWindow(k.focus.victimHWND)
+		win.AttachThreadInput(int32(k.focus.myID), int32(k.focus.victimID), false)
+	}
+}
@@ -0,0 +1,150 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"ncryptagent/ncrypt"
+	"os"
+	"strings"
+)
+
+// ImportNCryptKeyFile imports the private key of an OpenSSH, PKCS#8, PKCS#1 or SEC1 key file into a key storage
+// provider as a non-exportable key, so a key like ~/.ssh/id_rsa moves into the TPM or onto a smart card and keeps its
+// public key. The passphrase decrypts an encrypted file, the password protects a TPM key like a created one. The
+// decrypted key is wiped from memory once it is imported, the file is left alone. Scope SCOPE_MACHINE imports it into
+// the machine's key store.
+func (km *KeyManager) ImportNCryptKeyFile(keyName string, containerName string, providerName string, path string, passphrase string, password string, scope string) (*Key, error) {
+	key, err := ReadPrivateKeyFile(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroPrivateKey(key)
+
+	k, err := km.ImportKey(&KeyConfig{
+		Name:          keyName,
+		Type:          "NCRYPT",
+		ContainerName: containerName,
+		ProviderName:  providerName,
+		Scope:         scope,
+	}, key, CreateOptions{Password: password})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Imported %s into %s as key %s", path, providerName, keyName)
+	return k, nil
+}
+
+// ReadPrivateKeyFile parses a private key file for import, an empty passphrase reads an unencrypted file
+func ReadPrivateKeyFile(path string, passphrase string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	if passphrase == "" {
+		raw, err = ssh.ParseRawPrivateKey(data)
+	} else {
+		p := []byte(passphrase)
+		raw, err = ssh.ParseRawPrivateKeyWithPassphrase(data, p)
+		for i := range p {
+			p[i] = 0
+		}
+	}
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, fmt.Errorf("%s is encrypted, its passphrase is required", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse key file %s: %w", path, err)
+	}
+
+	signer, ok := raw.(crypto.Signer)
+	if !ok {
+		zeroPrivateKey(raw)
+		return nil, fmt.Errorf("unsupported key type %T in %s", raw, path)
+	}
+	return signer, nil
+}
+
+// privateKeyBlob returns the CNG private blob of a key with its NCrypt algorithm and length
+func privateKeyBlob(key crypto.Signer) (string, []byte, string, int, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		blob, err := ncrypt.MarshalRSAFullPrivateBlob(k)
+		return ncrypt.BCRYPT_RSAFULLPRIVATE_BLOB, blob, ncrypt.ALG_RSA, k.N.BitLen(), err
+	case *ecdsa.PrivateKey:
+		for name, curve := range ncrypt.CurveNames {
+			if curve == k.Curve && strings.HasPrefix(name, "ECDSA_") {
+				blob, err := ncrypt.MarshalECCPrivateBlob(k)
+				return ncrypt.BCRYPT_ECCPRIVATE_BLOB, blob, name, k.Curve.Params().BitSize, err
+			}
+		}
+		return "", nil, "", 0, fmt.Errorf("keys of curve %s can't be imported", k.Curve.Params().Name)
+	}
+	return "", nil, "", 0, fmt.Errorf("%T keys can't be imported, only RSA and NIST P-256, P-384 and P-521 keys", key)
+}
+
+// Import stores an existing RSA or ECDSA key in the provider of kc. The key is imported without finalizing it, so its
+// export policy is cleared and its TPM password set before the provider persists it. Smart card keys go on the card
+// in kc.Reader when it is set.
+func (b *ncryptBackend) Import(kc *KeyConfig, key crypto.Signer, opts CreateOptions) (BackendKey, error) {
+	blobType, blob, algorithm, length, err := privateKeyBlob(key)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range blob {
+			blob[i] = 0
+		}
+	}()
+	kc.Algorithm, kc.Length = algorithm, length
+
+	if kc.ContainerName == "" {
+		containerUUID, _ := uuid.NewRandom()
+		kc.ContainerName = containerUUID.String()
+	}
+
+	providerHandle, err := b.getProviderHandle(kc.ProviderName)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := b.algSupported(providerHandle, kc.Algorithm); err != nil || !ok {
+		return nil, fmt.Errorf("provider %s does not support algorithm %v", kc.ProviderName, kc.Algorithm)
+	}
+
+	name := kc.ContainerName
+	if kc.ProviderName == ncrypt.ProviderMSSC && kc.Reader != "" {
+		name = fmt.Sprintf("\\\\.\\%s\\%s", kc.Reader, kc.ContainerName)
+	}
+	kh, err := b.api.ImportKey(providerHandle, name, blobType, blob, kc.ncryptFlags()|ncrypt.NCRYPT_DO_NOT_FINALIZE_FLAG)
+	if err != nil {
+		return nil, fmt.Errorf("unable to import key: %w", err)
+	}
+
+	// keys on a smart card never leave it, the smart card provider has no export policy
+	if kc.ProviderName != ncrypt.ProviderMSSC {
+		if err = b.api.SetProperty(kh, ncrypt.NCRYPT_EXPORT_POLICY_PROPERTY, uint32(0), 0); err != nil {
+			b.api.FreeObject(kh)
+			return nil, fmt.Errorf("unable to make the key non-exportable: %w", err)
+		}
+	}
+
+	bk, err := b.finalizeKey(kc, kh, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := ssh.NewPublicKey(key.Public())
+	if err != nil || string(bk.Public().Marshal()) != string(expected.Marshal()) {
+		b.Delete(kc, bk)
+		return nil, fmt.Errorf("the imported key %s doesn't have the public key of the key that was imported", kc.ContainerName)
+	}
+	return bk, nil
+}
@@ -0,0 +1,366 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"math/big"
+	"ncryptagent/ncrypt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestNCryptImport round-trips the CNG private blobs of RSA and NIST curve keys, then imports key files into the
+// TPM and onto a smart card of the emulator through a KeyManager: an OpenSSH, a PKCS#8 and an encrypted PEM file
+func TestNCryptImport(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	dir := t.TempDir()
+
+	var keys []crypto.Signer
+	// an odd length gives primes of different sizes
+	for _, bits := range []int{2048, 2047} {
+		k, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		k, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+
+	for _, key := range keys {
+		testPrivateBlob(t, emu, key)
+	}
+
+	km := newDetachedKeyManager(filepath.Join(dir, "config.json"))
+	km.RegisterBackend(newNCryptBackend(emu))
+	defer km.Close()
+
+	// signs checks that an imported key signs for the public key of the file
+	signs := func(name string, key crypto.Signer) error {
+		k, ok := km.Keys[name]
+		if !ok {
+			return fmt.Errorf("key %s was not registered", name)
+		}
+		pub, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal((*k.SSHPublicKey).Marshal(), pub.Marshal()) {
+			return fmt.Errorf("key %s has another public key than its file", name)
+		}
+		sig, err := k.SignSSH([]byte(name))
+		if err != nil {
+			return err
+		}
+		return pub.Verify([]byte(name), sig)
+	}
+	writeFile := func(name string, block *pem.Block) (string, error) {
+		path := filepath.Join(dir, name)
+		return path, os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	}
+
+	check(t, "openssh into the TPM", func() error {
+		block, err := marshalOpenSSHECDSA(keys[2].(*ecdsa.PrivateKey), "openssh@import")
+		if err != nil {
+			return err
+		}
+		path, err := writeFile("id_ecdsa", block)
+		if err != nil {
+			return err
+		}
+		if _, err = km.ImportNCryptKeyFile("openssh", "", ncrypt.ProviderMSPlatform, path, "", "", ""); err != nil {
+			return err
+		}
+		if kc := km.Keys["openssh"].config; kc.Algorithm != ncrypt.ALG_ECDSA_P256 || kc.ContainerName == "" {
+			return fmt.Errorf("imported key configured as %s in %q", kc.Algorithm, kc.ContainerName)
+		}
+		return signs("openssh", keys[2])
+	})
+
+	check(t, "pkcs8 into the TPM", func() error {
+		der, err := x509.MarshalPKCS8PrivateKey(keys[0])
+		if err != nil {
+			return err
+		}
+		path, err := writeFile("id_rsa", &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err != nil {
+			return err
+		}
+		if _, err = km.ImportNCryptKeyFile("pkcs8", "", ncrypt.ProviderMSPlatform, path, "", "", ""); err != nil {
+			return err
+		}
+		if length := km.Keys["pkcs8"].config.Length; length != 2048 {
+			return fmt.Errorf("imported key configured with length %d", length)
+		}
+		return signs("pkcs8", keys[0])
+	})
+	check(t, "pkcs8 non-exportable", func() error {
+		nk := km.Keys["pkcs8"].key.(*ncryptKey)
+		if _, err := emu.ExportKey(nk.handle, ncrypt.BCRYPT_RSAFULLPRIVATE_BLOB); err == nil {
+			return fmt.Errorf("the private key of an imported key was exported")
+		}
+		return nil
+	})
+	check(t, "software non-exportable", func() error {
+		der, err := x509.MarshalPKCS8PrivateKey(keys[3])
+		if err != nil {
+			return err
+		}
+		path, err := writeFile("software.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err != nil {
+			return err
+		}
+		if _, err = km.ImportNCryptKeyFile("software", "", ncrypt.ProviderMSSoftware, path, "", "", ""); err != nil {
+			return err
+		}
+		// the software provider exports keys whose policy allows it, the import cleared it
+		nk := km.Keys["software"].key.(*ncryptKey)
+		if _, err := emu.ExportKey(nk.handle, ncrypt.BCRYPT_ECCPRIVATE_BLOB); err == nil {
+			return fmt.Errorf("the private key of an imported key was exported")
+		}
+		return signs("software", keys[3])
+	})
+
+	const reader = "Emulated Reader 3"
+	card := []byte{0x49, 0x4d, 0x50, 0x4f, 0x52, 0x54, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03}
+	var encrypted string
+	check(t, "encrypted onto a smart card", func() error {
+		// a card with a key already provisioned on it, the imported key shares its (empty) PIN
+		other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err = emu.AddCardKey(reader, card, "provisioned", other, ""); err != nil {
+			return err
+		}
+
+		der, err := x509.MarshalECPrivateKey(keys[3].(*ecdsa.PrivateKey))
+		if err != nil {
+			return err
+		}
+		// legacy encrypted PEM files are still around and have to be imported
+		block, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte("passphrase"), x509.PEMCipherAES256)
+		if err != nil {
+			return err
+		}
+		if encrypted, err = writeFile("id_ecdsa_encrypted", block); err != nil {
+			return err
+		}
+		if _, err = km.ImportNCryptKeyFile("encrypted", "", ncrypt.ProviderMSSC, encrypted, "", "", ""); err == nil ||
+			!strings.Contains(err.Error(), "passphrase") {
+			return fmt.Errorf("imported an encrypted file without its passphrase: %v", err)
+		}
+		if _, err = km.ImportNCryptKeyFile("encrypted", "", ncrypt.ProviderMSSC, encrypted, "wrong", "", ""); err == nil {
+			return fmt.Errorf("imported an encrypted file with a wrong passphrase")
+		}
+
+		key, err := ReadPrivateKeyFile(encrypted, "passphrase")
+		if err != nil {
+			return err
+		}
+		defer zeroPrivateKey(key)
+		kc := &KeyConfig{Name: "encrypted", Type: "NCRYPT", ProviderName: ncrypt.ProviderMSSC, ContainerName: "imported", Reader: reader}
+		if _, err = km.ImportKey(kc, key, CreateOptions{}); err != nil {
+			return err
+		}
+		if kc.Token != hex.EncodeToString(card) || kc.Reader != reader {
+			return fmt.Errorf("imported key bound to card %s in %s", kc.Token, kc.Reader)
+		}
+		return signs("encrypted", keys[3])
+	})
+	emu.MoveCard(card, "")
+
+	check(t, "refused", func() error {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			return err
+		}
+		path, err := writeFile("id_ed25519", &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err != nil {
+			return err
+		}
+		if _, err = km.ImportNCryptKeyFile("ed25519", "", ncrypt.ProviderMSPlatform, path, "", "", ""); err == nil {
+			return fmt.Errorf("imported an ed25519 key")
+		}
+
+		// the platform provider has no P-521
+		der, err = x509.MarshalPKCS8PrivateKey(keys[4])
+		if err != nil {
+			return err
+		}
+		if path, err = writeFile("id_p521", &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+			return err
+		}
+		if _, err = km.ImportNCryptKeyFile("p521", "", ncrypt.ProviderMSPlatform, path, "", "", ""); err == nil {
+			return fmt.Errorf("imported a P-521 key into the TPM")
+		}
+		if _, err = km.ImportNCryptKeyFile("pkcs8", "", ncrypt.ProviderMSSoftware, path, "", "", ""); err == nil {
+			return fmt.Errorf("imported a key under the name of another key")
+		}
+		if len(km.Keys) != 4 || len(km.config.Keys) != 4 {
+			return fmt.Errorf("%d keys registered and %d configured after the refused imports", len(km.Keys), len(km.config.Keys))
+		}
+		return nil
+	})
+}
+
+// testPrivateBlob checks that the private blob of a key decodes to the same key and that the provider stores it as
+// is, and that the public blob of the key decodes to its public key with unmarshalRSA or unmarshalECC
+func testPrivateBlob(t *testing.T, emu *ncrypt.Emulator, key crypto.Signer) {
+	t.Helper()
+	blobType, blob, algorithm, length, err := privateKeyBlob(key)
+	name := fmt.Sprintf("blob %s-%d", algorithm, length)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+
+	check(t, name+" round trip", func() error {
+		var err error
+		var decoded crypto.Signer
+		var public crypto.PublicKey
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			if decoded, err = ncrypt.UnmarshalRSAFullPrivateBlob(blob); err != nil {
+				return err
+			}
+			public, err = unmarshalRSA(ncrypt.MarshalRSAPublicBlob(&k.PublicKey))
+		case *ecdsa.PrivateKey:
+			if decoded, err = ncrypt.UnmarshalECCPrivateBlob(blob); err != nil {
+				return err
+			}
+			var pubBlob []byte
+			if pubBlob, err = ncrypt.MarshalECCPublicBlob(&k.PublicKey); err != nil {
+				return err
+			}
+			public, err = unmarshalECC(pubBlob, k.Curve)
+		}
+		if err != nil {
+			return err
+		}
+		if !decoded.(interface{ Equal(crypto.PrivateKey) bool }).Equal(key) {
+			return fmt.Errorf("the private blob decodes to another key")
+		}
+		if !public.(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+			return fmt.Errorf("the public blob decodes to another key")
+		}
+		return nil
+	})
+
+	check(t, name+" provider round trip", func() error {
+		ph, err := emu.OpenStorageProvider(ncrypt.ProviderMSSoftware)
+		if err != nil {
+			return err
+		}
+		defer emu.FreeObject(ph)
+		// the emulator leaves imported keys exportable until their export policy is set
+		kh, err := emu.ImportKey(ph, name, blobType, blob, 0)
+		if err != nil {
+			return err
+		}
+		exported, err := emu.ExportKey(kh, blobType)
+		if err == nil && !bytes.Equal(exported, blob) {
+			err = fmt.Errorf("the provider exported another blob than the one imported")
+		}
+		emu.DeleteKey(kh, 0)
+		return err
+	})
+}
+
+// marshalOpenSSHECDSA encodes an unencrypted openssh-key-v1 file of an ECDSA key the way ssh-keygen writes it
+func marshalOpenSSHECDSA(key *ecdsa.PrivateKey, comment string) (*pem.Block, error) {
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	curve := "nistp" + strings.TrimPrefix(key.Curve.Params().Name, "P-")
+
+	checkInt := make([]byte, 4)
+	rand.Read(checkInt)
+	private := ssh.Marshal(struct {
+		Check1, Check2 uint32
+		KeyType        string
+		Curve          string
+		Point          []byte
+		D              *big.Int
+		Comment        string
+	}{
+		Check1:  uint32(checkInt[0])<<24 | uint32(checkInt[1])<<16 | uint32(checkInt[2])<<8 | uint32(checkInt[3]),
+		Check2:  uint32(checkInt[0])<<24 | uint32(checkInt[1])<<16 | uint32(checkInt[2])<<8 | uint32(checkInt[3]),
+		KeyType: pub.Type(),
+		Curve:   curve,
+		Point:   elliptic.Marshal(key.Curve, key.X, key.Y),
+		D:       key.D,
+		Comment: comment,
+	})
+	for i := byte(1); len(private)%8 != 0; i++ {
+		private = append(private, i)
+	}
+
+	data := append([]byte("openssh-key-v1\x00"), ssh.Marshal(struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName:   "none",
+		KdfName:      "none",
+		NumKeys:      1,
+		PubKey:       pub.Marshal(),
+		PrivKeyBlock: private,
+	})...)
+	return &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data}, nil
+}
+
+// TestNCryptImportMissingFunctions imports on a Windows whose ncrypt.dll lacks NCryptImportKey or
+// NCryptIsAlgSupported
+func TestNCryptImportMissingFunctions(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	b := newNCryptBackend(emu)
+	defer b.Close()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check(t, "without NCryptImportKey", func() error {
+		emu.Missing = []string{"NCryptImportKey"}
+		_, err := b.Import(&KeyConfig{Name: "import", Type: "NCRYPT", ProviderName: ncrypt.ProviderMSSoftware}, priv, CreateOptions{})
+		if !errors.Is(err, ncrypt.ErrNotSupported) {
+			return fmt.Errorf("importing returned %v, expected ErrNotSupported", err)
+		}
+		return nil
+	})
+	check(t, "without NCryptIsAlgSupported", func() error {
+		emu.Missing = []string{"NCryptIsAlgSupported"}
+		key, err := b.Import(&KeyConfig{Name: "import", Type: "NCRYPT", ProviderName: ncrypt.ProviderMSSoftware}, priv, CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("importing without NCryptIsAlgSupported failed: %w", err)
+		}
+		return key.Close()
+	})
+}
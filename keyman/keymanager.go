@@ -3,34 +3,20 @@ package keyman
 import (
 	"bytes"
 	"context"
-	"crypto"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/sha1"
-	"encoding/asn1"
-	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/fxamacker/cbor/v2"
-	"github.com/google/uuid"
-	"github.com/lxn/win"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"log"
-	"math/big"
 	"ncryptagent/keyman/listeners"
-	"ncryptagent/ncrypt"
-	"ncryptagent/webauthn"
+	"ncryptagent/scard"
 	"os"
-	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
-	"unsafe"
+	"time"
 )
 
 const (
@@ -50,25 +36,6 @@ type NotifyMsg struct {
 	}
 }
 
-type sshPrivateKeySKECDSA struct {
-	Type        string
-	ID          string
-	Key         []byte
-	Application string
-	Flags       byte
-	KeyHandle   []byte
-	Reserved    string
-}
-
-type sshPrivateKeySKED25519 struct {
-	Type        string
-	Key         []byte
-	Application string
-	Flags       byte
-	KeyHandle   []byte
-	Reserved    string
-}
-
 type KeyConfig struct {
 	Name           string `json:"name"`
 	Type           string `json:"type"`
@@ -80,6 +47,16 @@ type KeyConfig struct {
 	Length         int    `json:"length,omitempty"`
 	VerifyRequired bool   `json:"verifyRequired,omitempty"`
 	NoPin          bool   `json:"noPin,omitempty"`
+	// Profile is the name of the profile serving the key, empty for the default profile
+	Profile string `json:"profile,omitempty"`
+	// Token is the serial number of the token holding a PKCS11 key and KeyID the key's hex CKA_ID. For NCRYPT keys on
+	// a smart card Token is the card's GUID in hex and Reader the reader it was found in.
+	Token  string `json:"token,omitempty"`
+	KeyID  string `json:"keyId,omitempty"`
+	Reader string `json:"reader,omitempty"`
+	// Scope is SCOPE_MACHINE for NCrypt keys of the machine's key store, which every account of the machine can open,
+	// empty or SCOPE_USER for keys of the user running the agent
+	Scope string `json:"scope,omitempty"`
 }
 
 type KeyManagerConfig struct {
@@ -89,8 +66,35 @@ type KeyManagerConfig struct {
 	VSockEnabled         bool         `json:"vsock"`
 	NamedPipeEnabled     bool         `json:"namedpipe"`
 	CygwinEnabled        bool         `json:"cygwin"`
+	CygwinSockets        []string     `json:"cygwinSockets,omitempty"`
 	DisableNotifications bool         `json:"disableNotifications,omitempty"`
 	USBEvents            bool         `json:"usbEvents,omitempty"`
+	VSockServicePort     uint32       `json:"vsockServicePort,omitempty"`
+	VSockVMIDs           []string     `json:"vsockVMIDs,omitempty"`
+	VSockAnyPartition    *bool        `json:"vsockAnyPartition,omitempty"`
+	AFVSockEnabled       bool         `json:"afvsock,omitempty"`
+	AFVSockPort          uint32       `json:"afvsockPort,omitempty"`
+	AFVSockAllowedCIDs   []uint32     `json:"afvsockAllowedCIDs,omitempty"`
+	AFVSockAllowAnyGuest bool         `json:"afvsockAllowAnyGuest,omitempty"`
+	UnixSocketEnabled    bool         `json:"unixSocket,omitempty"`
+	UnixSocketPath       string       `json:"unixSocketPath,omitempty"`
+	PolicyFile           string       `json:"policyFile,omitempty"`
+	// PCSCBackends enables the PIV and OpenPGP keys used directly over PC/SC. They are on by default except on
+	// Windows, where cards are used through the smart card KSP.
+	PCSCBackends *bool `json:"pcscBackends,omitempty"`
+	// ListenerLimits holds connection limits keyed by listener type, listeners not present use the defaults
+	ListenerLimits map[string]listeners.ConnLimits `json:"listenerLimits,omitempty"`
+	// TraceFile enables recording of the agent protocol traffic of all listeners, see listeners.Tracer
+	TraceFile string `json:"traceFile,omitempty"`
+	// Profiles are additional agents on their own endpoints, see ProfileConfig
+	Profiles []*ProfileConfig `json:"profiles,omitempty"`
+	// Attestation is the AIK certifying TPM keys for ExportAttestation, see AttestationConfig
+	Attestation *AttestationConfig `json:"attestation,omitempty"`
+	// MachineListener serves the machine scope keys to other accounts, see MachineListenerConfig
+	MachineListener *MachineListenerConfig `json:"machineListener,omitempty"`
+	// VerifySignatures checks every signature against the key's public key before it is returned to a client, so a
+	// faulty card, TPM or driver fails with an error and a notification instead of a failed login
+	VerifySignatures bool `json:"verifySignatures,omitempty"`
 }
 
 type Key struct {
@@ -106,65 +110,30 @@ type Key struct {
 	algorithm string
 	length    int
 
-	config *KeyConfig
-	handle uintptr
-	signer *crypto.Signer
-	hwnd   uintptr
-
-	focusData struct {
-		victimHWND win.HWND
-		victimID   uint32
-		myID       uint32
-	}
-}
-
-func (k *Key) TakeFocus() bool {
-	if !k.config.NoPin && k.hwnd != 0 {
-		if k.Type == "NCRYPT" && k.signer != nil {
-			if ncryptSigner, ok := (*k.signer).(*Signer); ok {
-				if ncryptSigner.timeractive {
-					return false
-				}
-			}
-		}
-		hwnd := win.HWND(k.hwnd)
-
-		k.focusData.victimHWND = win.GetForegroundWindow()
-		k.focusData.myID = win.GetCurrentThreadId()
-		k.focusData.victimID = win.GetWindowThreadProcessId(k.focusData.victimHWND, nil)
-		win.AttachThreadInput(int32(k.focusData.victimID), int32(k.focusData.myID), true)
-		win.ShowWindow(hwnd, win.SW_NORMAL)
-		win.SetForegroundWindow(hwnd)
-		win.SetFocus(hwnd)
-		win.SetActiveWindow(hwnd)
-		win.AttachThreadInput(int32(k.focusData.victimID), int32(k.focusData.myID), false)
-
-		return true
-	}
+	config  *KeyConfig
+	backend KeyBackend
+	key     BackendKey
+	hwnd    uintptr
 
-	return false
-}
-
-func (k *Key) ReturnFocus() {
-	if !k.config.NoPin {
-		win.ShowWindow(win.HWND(k.hwnd), win.SW_HIDE)
-		win.AttachThreadInput(int32(k.focusData.myID), int32(k.focusData.victimID), true)
-		win.ShowWindow(k.focusData.victimHWND, win.SW_SHOW)
-		win.SetForegroundWindow(k.focusData.victimHWND)
-		win.SetFocus(k.focusData.victimHWND)
-		win.SetActiveWindow(k.focusData.victimHWND)
-		win.AttachThreadInput(int32(k.focusData.myID), int32(k.focusData.victimID), false)
-	}
+	focus focusState
 }
 
 func (k *Key) AlgorithmReadable() string {
-	if k.algorithm == ncrypt.ALG_RSA {
+	if k.algorithm == "RSA" {
 		return fmt.Sprintf("%s-%d", k.algorithm, k.length)
 	} else {
 		return k.algorithm
 	}
 }
 
+// TypeReadable is the key type as shown to the user, marking keys whose private key is held in memory
+func (k *Key) TypeReadable() string {
+	if k.Capabilities().Software {
+		return fmt.Sprintf("%s (software key)", k.Type)
+	}
+	return k.Type
+}
+
 func (k *Key) SSHPublicKeyString() string {
 	if k.SSHPublicKey != nil {
 		pkBytes := ssh.MarshalAuthorizedKey(*k.SSHPublicKey)
@@ -268,198 +237,139 @@ func (k *Key) ContainerName() string {
 	return ""
 }
 
-func (k *Key) Close() {
-	if k.handle != 0 {
-		ncrypt.NCryptFreeObject(k.handle)
+// SmartCard describes the card or token holding the key and the reader it was found in, empty for keys that aren't
+// bound to one
+func (k *Key) SmartCard() string {
+	if k.config == nil || k.config.Token == "" {
+		return ""
 	}
-	k.handle = 0
-}
-
-func (k *Key) SignSSH(b []byte) (*ssh.Signature, error) {
-	if k.TakeFocus() {
-		defer k.ReturnFocus()
+	reader := k.config.Reader
+	if k.Type == TYPE_PIV || k.Type == TYPE_OPENPGP {
+		reader = k.config.ProviderName
 	}
-
-	if k.Type == "NCRYPT" && k.signer != nil {
-		sshSigner, err := ssh.NewSignerFromSigner(*k.signer)
-
-		if err != nil {
-			return nil, err
-		}
-
-		signature, err := sshSigner.Sign(rand.Reader, b)
-		if err == nil {
-			k.Missing = false
-		}
-
-		return signature, err
-	} else if k.Type == "WEBAUTHN" {
-		return k.signWebAuthN(b)
+	if reader == "" {
+		return k.config.Token
 	}
-
-	return nil, fmt.Errorf("invalid signer")
+	return fmt.Sprintf("%s in %s", k.config.Token, reader)
 }
 
-func (k *Key) SignWithAlgorithmSSH(b []byte, algorithm string) (*ssh.Signature, error) {
-	if k.TakeFocus() {
-		defer k.ReturnFocus()
+// PurgePIN clears a cached PIN so the next signature prompts for it again
+func (k *Key) PurgePIN() {
+	if pc, ok := k.pinCache(); ok {
+		pc.PurgePIN()
 	}
+}
 
-	if k.Type == "NCRYPT" && k.signer != nil {
-		sshSigner, err := ssh.NewSignerFromSigner(*k.signer)
-
-		if err != nil {
-			return nil, err
-		}
-
-		if algorithmSigner, ok := sshSigner.(ssh.AlgorithmSigner); ok {
+// pinCache is implemented by signers that keep the PIN for a while after it was entered
+type pinCache interface {
+	PINCached() bool
+	PurgePIN()
+	SetPINTimeout(timeout int)
+}
 
-			signature, err := algorithmSigner.SignWithAlgorithm(rand.Reader, b, algorithm)
-			if err == nil {
-				k.Missing = false
-			}
+// pinCacheProvider is implemented by backend keys whose signer keeps a PIN cache
+type pinCacheProvider interface {
+	pinCache() (pinCache, bool)
+}
 
-			return signature, err
-		} else {
-			return nil, fmt.Errorf("invalid signer type %T", algorithmSigner)
-		}
-	} else if k.Type == "WEBAUTHN" {
-		return k.signWebAuthN(b)
+func (k *Key) pinCache() (pinCache, bool) {
+	if k.key == nil {
+		return nil, false
 	}
-
-	return nil, fmt.Errorf("invalid signer")
+	if p, ok := k.key.(pinCacheProvider); ok {
+		return p.pinCache()
+	}
+	pc, ok := k.key.(pinCache)
+	return pc, ok
 }
 
-func (k *Key) signWebAuthN(signData []byte) (*ssh.Signature, error) {
-
-	privBytes, err := base64.StdEncoding.DecodeString(k.config.SKPrivateHalf)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding base64 private half: %w", err)
+// Capabilities returns what using the key involves, a key that could not be loaded has none
+func (k *Key) Capabilities() KeyCapabilities {
+	if k.key == nil {
+		return KeyCapabilities{}
 	}
+	return k.key.Capabilities()
+}
 
-	var application string
-	var keyHandle []byte
-
-	if (*k.SSHPublicKey).Type() == OPENSSH_SK_ECDSA || (*k.SSHPublicKey).Type() == OPENSSH_SK_ECDSA_CERT {
-		priv := sshPrivateKeySKECDSA{}
-		err = ssh.Unmarshal(privBytes, &priv)
-
-		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling private half: %w", err)
-		}
-
-		application = priv.Application
-		keyHandle = priv.KeyHandle
-	} else if (*k.SSHPublicKey).Type() == OPENSSH_SK_ED25519 || (*k.SSHPublicKey).Type() == OPENSSH_SK_ED25519_CERT {
-		priv := sshPrivateKeySKED25519{}
-		err = ssh.Unmarshal(privBytes, &priv)
+func (k *Key) SetHWND(hwnd uintptr) {
+	if wo, ok := k.key.(windowOwner); ok {
+		wo.SetHWND(hwnd)
+	}
+	k.hwnd = hwnd
+}
 
-		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling private half: %w", err)
+func (k *Key) Close() {
+	if k.key != nil {
+		if err := k.key.Close(); err != nil {
+			log.Printf("Closing key %s failed: %s", k.Name, err)
 		}
-
-		application = priv.Application
-		keyHandle = priv.KeyHandle
 	}
+}
 
-	clientData := webauthn.CLIENT_DATA{
-		Version:              webauthn.CLIENT_DATA_CURRENT_VERSION,
-		ClientDataJSONLength: uint32(len(signData)),
-		ClientDataJSON:       uintptr(unsafe.Pointer(&signData[0])),
-		HashAlgId:            webauthn.LPCWSTR(webauthn.HASH_ALGORITHM_SHA_256),
+func (k *Key) deleteFromKeystore() error {
+	if k.backend == nil || !k.backend.Capabilities().Delete {
+		return nil
 	}
+	return k.backend.Delete(k.config, k.key)
+}
 
-	credentials := []webauthn.CREDENTIAL{
-		{
-			Version:        webauthn.CREDENTIAL_CURRENT_VERSION,
-			IdLen:          uint32(len(keyHandle)),
-			Id:             uintptr(unsafe.Pointer(&keyHandle[0])),
-			CredentialType: webauthn.LPCWSTR(webauthn.CREDENTIAL_TYPE_PUBLIC_KEY),
-		},
-	}
+func (k *Key) SignSSH(b []byte) (*ssh.Signature, error) {
+	return k.SignWithAlgorithmSSH(b, "")
+}
 
-	userVerification := webauthn.USER_VERIFICATION_REQUIREMENT_DISCOURAGED
-	if k.config.VerifyRequired {
-		userVerification = webauthn.USER_VERIFICATION_REQUIREMENT_REQUIRED
+// SignWithAlgorithmSSH signs with the given ssh signature algorithm, an empty algorithm uses the key's default one
+func (k *Key) SignWithAlgorithmSSH(b []byte, algorithm string) (*ssh.Signature, error) {
+	if k.key == nil {
+		return nil, fmt.Errorf("invalid signer")
 	}
 
-	assertionOptions := webauthn.AUTHENTICATOR_GET_ASSERTION_OPTIONS{
-		Version: webauthn.AUTHENTICATOR_MAKE_CREDENTIAL_OPTIONS_CURRENT_VERSION,
-		CredentialList: webauthn.CREDENTIALS{
-			Count:       1,
-			Credentials: uintptr(unsafe.Pointer(&credentials[0])),
-		},
-		UserVerificationRequirement: uint32(userVerification),
+	if k.TakeFocus() {
+		defer k.ReturnFocus()
 	}
 
-	assertion, err := webauthn.AuthenticatorGetAssertion(k.hwnd, application, clientData, assertionOptions)
-
-	if err != nil {
-		return nil, fmt.Errorf("AuthenticatorGetAssertion failed: %w", err)
+	signature, err := k.key.Sign(b, algorithm)
+	if err == nil {
+		k.Missing = false
 	}
 
-	defer webauthn.FreeAssertion(assertion)
-
-	authDataBytes := webauthn.UintptrToBytes(assertion.AuthenticatorData, assertion.AuthenticatorDataLen)
-	assertionSignatureBytes := webauthn.UintptrToBytes(assertion.Signature, assertion.SignatureLen)
+	return signature, err
+}
 
-	authData := webauthn.AuthenticatorData{}
-	reader := bytes.NewReader(authDataBytes)
-	err = binary.Read(reader, binary.BigEndian, &authData.RPIDHash)
-	err = binary.Read(reader, binary.BigEndian, &authData.Flags)
-	err = binary.Read(reader, binary.BigEndian, &authData.Counter)
+// ErrSignatureInvalid is returned for a signature that doesn't verify against the public key of the key that made it
+var ErrSignatureInvalid = errors.New("signature does not verify against the public key")
 
-	additionalData := struct {
-		Flags   byte
-		Counter uint32
-	}{
-		Flags:   authData.Flags,
-		Counter: authData.Counter,
+// VerifySignature checks a signature of the key over data against the key's public key, RSA, ECDSA and the sk
+// signatures of security keys alike
+func (k *Key) VerifySignature(data []byte, sig *ssh.Signature) error {
+	if k.SSHPublicKey == nil {
+		return fmt.Errorf("key %s has no public key to verify its signature", k.Name)
 	}
-
-	var signatureBytes []byte
-
-	if (*k.SSHPublicKey).Type() == "sk-ecdsa-sha2-nistp256@openssh.com" || (*k.SSHPublicKey).Type() == "sk-ecdsa-sha2-nistp256-cert-v01@openssh.com" {
-		signatureParsed := struct {
-			R *big.Int
-			S *big.Int
-		}{}
-
-		_, err = asn1.Unmarshal(assertionSignatureBytes, &signatureParsed)
-		if err != nil {
-			return nil, fmt.Errorf("asn1.Unmarshal of ECDSA signature failed: %w", err)
-		}
-
-		signatureBytes = ssh.Marshal(signatureParsed)
-	} else {
-		signatureBytes = assertionSignatureBytes
+	if err := (*k.SSHPublicKey).Verify(data, sig); err != nil {
+		return fmt.Errorf("key %s: %w, its card, TPM or driver may be faulty: %v", k.Name, ErrSignatureInvalid, err)
 	}
+	return nil
+}
 
-	sig := ssh.Signature{
-		Format: (*k.SSHPublicKey).Type(),
-		Blob:   signatureBytes,
-		Rest:   ssh.Marshal(additionalData),
+func (k *Key) SetTimeout(timeout int) {
+	if pc, ok := k.pinCache(); ok {
+		pc.SetPINTimeout(timeout)
 	}
-
-	return &sig, nil
 }
 
-func (k *Key) SetHWND(hwnd uintptr) {
-	if k.Type == "NCRYPT" && k.handle != 0 {
-		err := ncrypt.NCryptSetProperty(k.handle, ncrypt.NCRYPT_WINDOW_HANDLE_PROPERTY, hwnd, 0)
-		if err != nil {
-			log.Printf("Setting NCryptWindow handle failed: %v", err)
-		}
+// Profile returns the name of the profile the key is assigned to, empty for the default profile
+func (k *Key) Profile() string {
+	if k.config == nil {
+		return ""
 	}
-	k.hwnd = hwnd
+	return k.config.Profile
 }
 
-func (k *Key) SetTimeout(timeout int) {
-	if k.Type == "NCRYPT" && k.signer != nil {
-		if ncryptSigner, ok := (*k.signer).(*Signer); ok {
-			ncryptSigner.SetPINTimeout(timeout)
-		}
+// Scope returns SCOPE_MACHINE for keys of the machine's key store and SCOPE_USER for all others
+func (k *Key) Scope() string {
+	if k.config == nil || !k.config.machineScope() {
+		return SCOPE_USER
 	}
+	return SCOPE_MACHINE
 }
 
 func (k *Key) SSHCertificateSerial() string {
@@ -470,23 +380,38 @@ func (k *Key) SSHCertificateSerial() string {
 }
 
 type KeyManager struct {
-	Keys            map[string]*Key
-	providerHandles map[string]uintptr
-	configPath      string
-	publicKeysDir   string
-	config          *KeyManagerConfig
+	Keys          map[string]*Key
+	backends      map[string]KeyBackend
+	configPath    string
+	publicKeysDir string
+	config        *KeyManagerConfig
 
 	lwg    *sync.WaitGroup
 	lctx   context.Context
 	cancel context.CancelFunc
-	hwnd   win.HWND
+	hwnd   uintptr
 
-	namedPipeListener *listeners.NamedPipe
-	cygwinListener    *listeners.Cygwin
-	vSockListener     *listeners.VSock
-	pageantListener   *listeners.Pageant
-	sshAgent          KeyManagerAgent
-	notifyChan        chan NotifyMsg
+	// activeListeners holds the last listener started for each listener type
+	activeListeners map[string]listeners.Listener
+	sshAgent        KeyManagerAgent
+	notifyChan      chan NotifyMsg
+	confirmHandler  func(title, message string) bool
+	pinHandler      PINPrompt
+	// headless is set for the agent without a user interface, see SetHeadless
+	headless bool
+
+	policyMu sync.RWMutex
+	policy   *Policy
+	// policyState is the policy file as it was loaded, see watchPolicy
+	policyState policyFileState
+	tracer      *listeners.Tracer
+
+	profilesMu sync.Mutex
+	profiles   []*Profile
+
+	// machineAgent serves the machine scope keys on the machine listener
+	machineAgent    *KeyManagerAgent
+	machineListener listeners.Listener
 }
 
 func NewKeyManager(configPath string) (*KeyManager, error) {
@@ -510,6 +435,7 @@ func NewKeyManager(configPath string) (*KeyManager, error) {
 			NamedPipeEnabled:     true,
 			DisableNotifications: true,
 			USBEvents:            false,
+			UnixSocketEnabled:    true,
 		}
 	} else {
 		//log.Printf("Loading %s\n", configPath)
@@ -525,18 +451,14 @@ func NewKeyManager(configPath string) (*KeyManager, error) {
 	}
 
 	km := KeyManager{
-		Keys:              make(map[string]*Key),
-		providerHandles:   make(map[string]uintptr),
-		configPath:        configPath,
-		config:            &kmc,
-		hwnd:              0,
-		publicKeysDir:     publicKeysDir,
-		cygwinListener:    nil,
-		pageantListener:   nil,
-		namedPipeListener: nil,
-		vSockListener:     nil,
-	}
-	km.providerHandles = make(map[string]uintptr)
+		Keys:            make(map[string]*Key),
+		backends:        make(map[string]KeyBackend),
+		configPath:      configPath,
+		config:          &kmc,
+		hwnd:            0,
+		publicKeysDir:   publicKeysDir,
+		activeListeners: make(map[string]listeners.Listener),
+	}
 	km.configPath = configPath
 
 	km.sshAgent = KeyManagerAgent{
@@ -544,89 +466,76 @@ func NewKeyManager(configPath string) (*KeyManager, error) {
 		locked: false,
 		mu:     sync.Mutex{},
 	}
+	km.machineAgent = &KeyManagerAgent{km: &km, machine: true}
+
+	km.registerPlatformBackends()
+	km.RegisterBackend(NewPKCS11Backend(km.AskPIN))
+	km.RegisterBackend(NewFileBackend(km.AskPIN))
+	if km.pcscBackendsEnabled() {
+		km.RegisterBackend(NewPIVBackend(km.AskPIN, scard.System()))
+		km.RegisterBackend(NewOpenPGPBackend(km.AskPIN, scard.System()))
+	}
+	km.loadProfiles()
+
+	if err := km.ReloadPolicy(); err != nil {
+		log.Printf("%s", err)
+	}
 
 	return &km, nil
 }
 
+// pcscBackendsEnabled reports whether the PIV and OpenPGP backends are registered, see KeyManagerConfig.PCSCBackends
+func (km *KeyManager) pcscBackendsEnabled() bool {
+	if km.config.PCSCBackends != nil {
+		return *km.config.PCSCBackends
+	}
+	return PCSC_BACKENDS_DEFAULT
+}
+
 func (km *KeyManager) Start() error {
 	saveConfig := false
 	km.lctx, km.cancel = context.WithCancel(context.Background())
 
 	km.lwg = new(sync.WaitGroup)
 
-	if km.config.CygwinEnabled {
-		_, disableListenerInConfig, _ := km.StartListener(listeners.TYPE_CYGWIN)
-		if disableListenerInConfig {
-			km.config.CygwinEnabled = false
-			saveConfig = true
-		}
-	}
-
-	if km.config.VSockEnabled {
-		_, disableListenerInConfig, _ := km.StartListener(listeners.TYPE_VSOCK)
-		if disableListenerInConfig {
-			km.config.VSockEnabled = false
-			saveConfig = true
+	if km.config.TraceFile != "" {
+		tracer, err := listeners.NewTracer(km.config.TraceFile)
+		if err != nil {
+			log.Printf("agent protocol tracing disabled: %s", err)
+		} else {
+			log.Printf("Recording agent protocol trace to %s", km.config.TraceFile)
+			km.tracer = tracer
+			listeners.SetTracer(tracer)
 		}
 	}
 
-	if km.config.NamedPipeEnabled {
-		_, disableListenerInConfig, _ := km.StartListener(listeners.TYPE_NAMED_PIPE)
-		if disableListenerInConfig {
-			km.config.NamedPipeEnabled = false
-			saveConfig = true
+	for _, listenerType := range platformListenerTypes {
+		if enabled := km.listenerEnabled(listenerType); *enabled {
+			if km.headless && isGUIListener(listenerType) {
+				log.Printf("%s listener needs the user interface, not started by the headless agent", listenerType)
+				continue
+			}
+			_, disableListenerInConfig, _ := km.StartListener(listenerType)
+			if disableListenerInConfig {
+				*enabled = false
+				saveConfig = true
+			}
 		}
 	}
 
-	if km.config.PageantEnabled {
-		_, disableListenerInConfig, _ := km.StartListener(listeners.TYPE_PAGEANT)
-		if disableListenerInConfig {
-			km.config.PageantEnabled = false
-			saveConfig = true
-		}
+	for _, p := range km.Profiles() {
+		km.startProfile(p)
 	}
+	km.startMachineListener()
 
-	for _, k := range km.config.Keys {
-		log.Printf("Loading key %s\n", k.Name)
-		var err error
-
-		if k.Type == "NCRYPT" {
-			if k.ProviderName == "" {
-				k.ProviderName = ncrypt.ProviderMSSC
-			}
-
-			_, err = km.getProviderHandle(k.ProviderName)
-			if err != nil {
-				return fmt.Errorf("unable to open provider %s for %s: %w", k.ProviderName, k.Name, err)
-			}
-
-			_, err = km.LoadNCryptKey(k)
-		} else {
-			_, err = km.LoadWebAuthNKey(k)
-		}
-
-		if err != nil {
-			km.Keys[k.Name] = &Key{
-				Name:                 k.Name,
-				Type:                 k.Type,
-				algorithm:            "unknown",
-				length:               0,
-				SSHPublicKey:         nil,
-				SSHPublicKeyLocation: "",
-				config:               k,
-				handle:               0,
-				LoadError:            err,
-				Missing:              true,
-			}
+	km.lwg.Add(1)
+	go func() {
+		defer km.lwg.Done()
+		km.watchPolicy(km.lctx)
+	}()
 
-			if k.SSHPublicKey != "" {
-				if sshPublicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.SSHPublicKey)); err == nil {
-					km.Keys[k.Name].SSHPublicKey = &sshPublicKey
-				} else {
-					log.Printf("Unable to load stored public key: %v", err)
-				}
-			}
-		}
+	if err := km.loadKeys(); err != nil {
+		return err
 	}
 
 	if saveConfig {
@@ -636,55 +545,36 @@ func (km *KeyManager) Start() error {
 	return nil
 }
 
-// StartListener attempts top start a listenerType, returning (success, disableListenerInConfig, error)
-// If disableListenerInConfig is true, the caller should disable the listener in the config and save
-func (km *KeyManager) StartListener(listenerType string) (bool, bool, error) {
-	var err error
-	var listener listeners.Listener
-
-	switch listenerType {
-	case listeners.TYPE_VSOCK:
-		if km.vSockListener != nil {
-			km.vSockListener.Stop()
-		}
+// newListener creates a listener of the given type, returning (listener, disableListenerInConfig, error). A nil
+// listener without error means the listener was not started.
+func (km *KeyManager) newListener(listenerType string) (listeners.Listener, bool, error) {
+	limits := km.config.ListenerLimits[listenerType]
 
-		km.vSockListener, err = listeners.NewVSockListener()
+	if listenerType == listeners.TYPE_AF_VSOCK {
+		l := listeners.NewAFVSockListener(listeners.AFVSockOptions{
+			Port:          km.config.AFVSockPort,
+			AllowedCIDs:   km.config.AFVSockAllowedCIDs,
+			AllowAnyGuest: km.config.AFVSockAllowAnyGuest,
+		})
+		l.Limits = limits
+		return l, false, nil
+	}
 
-		if err != nil {
-			var listenerErr *listeners.ListenerError
-			if errors.As(err, &listenerErr) {
-				switch listenerErr.Code() {
-				case listeners.ERR_DISABLE:
-					log.Printf("disabled vSock listener: %s", err)
-					return false, true, nil
-				case listeners.ERR_ABORTED:
-					log.Printf("disabled vSock listener, but config wont be saved: %s", err)
-					return false, false, nil
-				}
-			} else {
-				log.Printf("could not create vsock listener: %s", err)
-				return false, false, err
-			}
-		}
+	return km.newPlatformListener(listenerType, limits)
+}
 
-		if km.vSockListener == nil {
-			return false, false, nil
-		}
+// StartListener attempts top start a listenerType, returning (success, disableListenerInConfig, error)
+// If disableListenerInConfig is true, the caller should disable the listener in the config and save
+func (km *KeyManager) StartListener(listenerType string) (bool, bool, error) {
+	if l := km.activeListeners[listenerType]; l != nil {
+		l.Stop()
+	}
 
-		listener = km.vSockListener
-	case listeners.TYPE_CYGWIN:
-		km.cygwinListener = new(listeners.Cygwin)
-		km.cygwinListener.Sockfile = filepath.Join(filepath.Dir(km.configPath), "cygwin-agent.sock")
-		listener = km.cygwinListener
-	case listeners.TYPE_NAMED_PIPE:
-		km.namedPipeListener = new(listeners.NamedPipe)
-		listener = km.namedPipeListener
-	case listeners.TYPE_PAGEANT:
-		km.pageantListener = new(listeners.Pageant)
-		listener = km.pageantListener
-	default:
-		return false, false, fmt.Errorf("invalid listener type %s", listenerType)
+	listener, disableListenerInConfig, err := km.newListener(listenerType)
+	if listener == nil {
+		return false, disableListenerInConfig, err
 	}
+	km.activeListeners[listenerType] = listener
 
 	km.lwg.Add(1)
 	go func(l listeners.Listener) {
@@ -700,502 +590,54 @@ func (km *KeyManager) StartListener(listenerType string) (bool, bool, error) {
 	return true, false, nil
 }
 
-func (km *KeyManager) RescanNCryptKeys() error {
-
-	log.Printf("Rescanning for all NCrypt keys")
-	for _, k := range km.KeysList() {
-		if k.Type == "NCRYPT" {
-			_, err := km.LoadNCryptKey(k.config)
-
-			if err != nil {
-				k.Missing = true
-			}
-		}
-	}
-
-	return nil
-}
-
-func (km *KeyManager) LoadNCryptKey(kc *KeyConfig) (*Key, error) {
-	providerHandle, err := km.getProviderHandle(kc.ProviderName)
-	if err != nil {
-		return nil, err
-	}
-
-	// silently determine if the key is available
-	keyHandle, err := ncrypt.NCryptOpenKey(providerHandle, kc.ContainerName, 0, ncrypt.NCRYPT_SILENT_FLAG)
-	if err != nil {
-		return nil, err
-	}
-
-	// close and reopen the handle allowing user interaction now
-	ncrypt.NCryptFreeObject(keyHandle)
-	keyHandle, err = ncrypt.NCryptOpenKey(providerHandle, kc.ContainerName, 0, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	algorithmName, err := ncrypt.NCryptGetPropertyStr(keyHandle, ncrypt.NCRYPT_ALGORITHM_PROPERTY)
-	if err != nil {
-		ncrypt.NCryptFreeObject(keyHandle)
-		return nil, err
-	}
-
-	var keyLength = 0
-	if algorithmName == ncrypt.ALG_RSA {
-		keyLength, err = ncrypt.NCryptGetPropertyInt(keyHandle, ncrypt.NCRYPT_LENGTH_PROPERTY)
-		if err == nil {
-			log.Printf("Got length %d\n", keyLength)
-		} else {
-			log.Printf("%v", err)
-			keyLength = 0
-		}
-	}
-
-	signer, err := newNCryptSigner(keyHandle, km.config.PinTimeout)
-	if err != nil {
-		ncrypt.NCryptFreeObject(keyHandle)
-		return nil, err
-	}
-
-	sshPub, err := ssh.NewPublicKey(signer.Public())
-	if err != nil {
-		ncrypt.NCryptFreeObject(keyHandle)
-		return nil, err
-	}
-
-	sshPub.Type()
-
-	km.Keys[kc.Name] = &Key{
-		Name:                 kc.Name,
-		Type:                 "NCRYPT",
-		algorithm:            algorithmName,
-		length:               0,
-		SSHPublicKey:         &sshPub,
-		SSHPublicKeyLocation: "",
-		config:               kc,
-		handle:               keyHandle,
-		LoadError:            nil,
-		signer:               &signer,
-		Missing:              false,
-	}
-
-	if km.hwnd != 0 {
-		km.Keys[kc.Name].SetHWND(uintptr(km.hwnd))
-	}
-
-	km.Keys[kc.Name].SaveSSHPublicKey(km.publicKeysDir)
-	km.Keys[kc.Name].LoadCertificate("")
-
-	return km.Keys[kc.Name], nil
-}
-
-func (km *KeyManager) getProviderHandle(providerName string) (uintptr, error) {
-	var pHandle uintptr
-	var handleOpen bool
-	var err error
-
-	if pHandle, handleOpen = km.providerHandles[providerName]; !handleOpen {
-		pHandle, err = ncrypt.NCryptOpenStorageProvider(providerName)
-		if err != nil {
-			return 0, fmt.Errorf("unable to open provider %s: %w", providerName, err)
-		}
-
-		km.providerHandles[providerName] = pHandle
-	}
-
-	return pHandle, nil
-}
-
-func (km *KeyManager) CreateNewNCryptKey(keyName string, containerName string, providerName string, algorithm string, bits int, password string) (*Key, error) {
-
-	if _, keyNameExists := km.Keys[keyName]; keyNameExists {
-		return nil, fmt.Errorf("key named %s already exists", keyName)
-	}
-
-	if containerName == "" {
-		containerUUID, _ := uuid.NewRandom()
-		containerName = containerUUID.String()
-	}
-
-	if providerName == ncrypt.ProviderMSSC {
-		return nil, fmt.Errorf("creating keys on smartcards is not supported")
-	}
-
-	//TODO: investigate replacing this with NCryptIsAlgSupported()
-	//https://learn.microsoft.com/en-us/windows/win32/api/ncrypt/nf-ncrypt-ncryptisalgsupported
-	algorithmOK := false
-	for _, i := range ncrypt.AVAILABLE_ALGORITHMS {
-		if i == algorithm {
-			algorithmOK = true
-			break
-		}
-	}
-	if !algorithmOK {
-		return nil, fmt.Errorf("unsupported algorithm %v", algorithm)
-	}
-
-	providerHandle, err := km.getProviderHandle(providerName)
-	if err != nil {
-		return nil, err
-	}
-
-	kh, err := ncrypt.NCryptCreatePersistedKey(providerHandle, containerName, algorithm, 0, 0)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create persisted key: %w", err)
-	}
-
-	if algorithm == ncrypt.ALG_RSA {
-		err = ncrypt.NCryptSetProperty(kh, ncrypt.NCRYPT_LENGTH_PROPERTY, uint32(bits), 0)
-
-		if err != nil {
-			ncrypt.NCryptFreeObject(kh)
-			return nil, fmt.Errorf("unable to set key NCRYPT_LENGTH_PROPERTY: %w", err)
-		}
-	}
-
-	if password != "" {
-		// If the provider is platform, set the property to a UI compatible one
-		utf16Str, err := syscall.UTF16FromString(password)
-		if err != nil {
-			return nil, err
-		}
-		bytesStr := make([]byte, len(utf16Str)*2)
-		for i, utf16 := range utf16Str {
-			// LPCSTR (Windows' representation of utf16) is always little endian.
-			binary.LittleEndian.PutUint16(bytesStr[i*2:i*2+2], utf16)
-		}
-
-		digest := sha1.Sum(bytesStr[:len(bytesStr)-2])
-
-		err = ncrypt.NCryptSetProperty(kh, ncrypt.NCRYPT_PCP_USAGE_AUTH_PROPERTY, digest[:], 0)
-		if err != nil {
-			log.Printf("error setting password: %v\n", err)
-		}
-	}
-
-	err = ncrypt.NCryptFinalizeKey(kh, 0)
-	if err != nil {
-		ncrypt.NCryptFreeObject(kh)
-		return nil, fmt.Errorf("unable to finalize key: %w", err)
-	}
-
-	uc, err := ncrypt.NCryptGetPropertyStr(kh, ncrypt.NCRYPT_UNIQUE_NAME_PROPERTY)
-	if err != nil {
-		ncrypt.NCryptFreeObject(kh)
-		return nil, fmt.Errorf("unable to retrieve NCRYPT_UNIQUE_NAME_PROPERTY: %w", err)
-	}
-
-	signer, err := newNCryptSigner(kh, km.config.PinTimeout)
-	if err != nil {
-		ncrypt.NCryptFreeObject(kh)
-		return nil, err
-	}
-
-	sshPub, err := ssh.NewPublicKey(signer.Public())
-	if err != nil {
-		ncrypt.NCryptFreeObject(kh)
-		return nil, err
-	}
-
-	kc := KeyConfig{
-		Name:          keyName,
-		Type:          "NCRYPT",
-		ContainerName: uc,
-		ProviderName:  providerName,
-		Length:        bits,
-		Algorithm:     algorithm,
-		NoPin:         password == "",
-	}
-
-	k := Key{
-		Name:                 keyName,
-		Type:                 "NCRYPT",
-		algorithm:            algorithm,
-		length:               bits,
-		SSHPublicKey:         &sshPub,
-		SSHPublicKeyLocation: "",
-		config:               &kc,
-		handle:               kh,
-		signer:               &signer,
-		Missing:              false,
+func (km *KeyManager) KeysList() []*Key {
+	if km.Keys == nil {
+		return nil
 	}
 
-	km.Keys[keyName] = &k
-
-	k.SetHWND(uintptr(km.hwnd))
-	k.SaveSSHPublicKey(km.publicKeysDir)
-	k.LoadCertificate("")
-
-	err = km.SaveConfig()
+	keys := make([]*Key, 0, len(km.Keys))
 
-	// empty the password so we are prompted on first use
-	if password != "" {
-		ncrypt.NCryptSetProperty(kh, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
+	for _, k := range km.Keys {
+		keys = append(keys, k)
 	}
 
-	return &k, err
+	return keys
 }
 
-func (km *KeyManager) CreateNewWebAuthNKey(keyName string, application string, coseAlgorithm int64, coseHash string, resident bool, verifyRequired bool, hwnd uintptr) (*Key, error) {
-
-	if _, keyNameExists := km.Keys[keyName]; keyNameExists {
-		return nil, fmt.Errorf("key named %s already exists", keyName)
-	}
-
-	if application == "" {
-		application = fmt.Sprintf("ssh:%s", keyName)
-	} else {
-		application = fmt.Sprintf("ssh:%s", application)
-	}
-
-	var userName string
-	currentUser, err := user.Current()
-	if err != nil {
-		userName = ""
-	} else {
-		userName = currentUser.Name
-	}
-
-	userId := []byte("(null)")
-
-	entityInfo := webauthn.RP_ENTITY_INFORMATION{
-		Version: webauthn.RP_ENTITY_INFORMATION_CURRENT_VERSION,
-		Id:      webauthn.LPCWSTR(application),
-		Name:    webauthn.LPCWSTR("nCrypt Agent"),
-		Icon:    nil,
-	}
-
-	userEntityInfo := webauthn.USER_ENTITY_INFORMATION{
-		Version:     webauthn.USER_ENTITY_INFORMATION_CURRENT_VERSION,
-		IdLen:       uint32(len(userId)),
-		Id:          uintptr(unsafe.Pointer(&userId[0])),
-		Name:        webauthn.LPCWSTR(userName),
-		Icon:        nil,
-		DisplayName: webauthn.LPCWSTR(userName),
-	}
-
-	coseParameter := []webauthn.COSE_CREDENTIAL_PARAMETER{
-		{
-			Version:        webauthn.COSE_CREDENTIAL_PARAMETER_CURRENT_VERSION,
-			CredentialType: webauthn.LPCWSTR(webauthn.CREDENTIAL_TYPE_PUBLIC_KEY),
-			Alg:            coseAlgorithm,
-		},
-	}
-
-	coseParameters := webauthn.COSE_CREDENTIAL_PARAMETERS{
-		Count:                uint32(len(coseParameter)),
-		CredentialParameters: uintptr(unsafe.Pointer(&coseParameter[0])),
-	}
-
-	sshChallengeData := []byte("{}") // should we make a random data?
-
-	clientData := webauthn.CLIENT_DATA{
-		Version:              webauthn.CLIENT_DATA_CURRENT_VERSION,
-		ClientDataJSONLength: uint32(len(sshChallengeData)),
-		ClientDataJSON:       uintptr(unsafe.Pointer(&sshChallengeData[0])),
-		HashAlgId:            webauthn.LPCWSTR(coseHash),
-	}
-
-	userVerificationRequirement := webauthn.USER_VERIFICATION_REQUIREMENT_DISCOURAGED
-
-	if verifyRequired {
-		userVerificationRequirement = webauthn.USER_VERIFICATION_REQUIREMENT_REQUIRED
-	}
-
-	credentialOptions := webauthn.AUTHENTICATOR_MAKE_CREDENTIAL_OPTIONS{
-		Version:                     webauthn.AUTHENTICATOR_MAKE_CREDENTIAL_OPTIONS_CURRENT_VERSION,
-		UserVerificationRequirement: uint32(userVerificationRequirement),
-		RequireResidentKey:          resident,
-	}
-
-	var useWnd uintptr
-	if hwnd != 0 {
-		useWnd = hwnd
-	} else if km.hwnd != 0 {
-		useWnd = uintptr(km.hwnd)
-	} else {
-		useWnd = uintptr(win.GetForegroundWindow())
-	}
-
-	credentialAttestation, err := webauthn.AuthenticatorMakeCredential(useWnd, entityInfo, userEntityInfo, coseParameters, clientData, credentialOptions)
-
-	if err != nil {
-		return nil, fmt.Errorf("AuthenticatorMakeCredential failed: %w", err)
-	}
-
-	defer webauthn.FreeCredentialAttestation(credentialAttestation)
-
-	attestationObjectBytes := webauthn.UintptrToBytes(credentialAttestation.AttestationObject, credentialAttestation.AttestationObjectLen)
-	attestationObject := webauthn.AttestationObject{}
-	err = cbor.Unmarshal(attestationObjectBytes, &attestationObject)
-
-	if err != nil {
-		return nil, fmt.Errorf("cbor.Unmarshal failed to parse attestationObject: %w", err)
+// loadKeys loads the configured keys, keys that fail to load are kept as missing with their stored public key
+func (km *KeyManager) loadKeys() error {
+	if err := km.prepareBackends(); err != nil {
+		return err
 	}
 
-	reader := bytes.NewReader(attestationObject.AuthData)
-	authData := webauthn.AuthenticatorData{}
-
-	// Format of attestation object from https://www.w3.org/TR/webauthn/#attestation-object
-	// Read Authenticator Data Header
-	err = binary.Read(reader, binary.BigEndian, &authData.RPIDHash)
-	err = binary.Read(reader, binary.BigEndian, &authData.Flags)
-	err = binary.Read(reader, binary.BigEndian, &authData.Counter)
-
-	//TODO: Look at authData.Flags to see if there is credential data or extensions
-
-	// Read the attested credential data
-	authData.AttestedCredentialData = &webauthn.AttestedCredentialData{}
-	err = binary.Read(reader, binary.BigEndian, &authData.AttestedCredentialData.AAGUID)
-	err = binary.Read(reader, binary.BigEndian, &authData.AttestedCredentialData.CredentialIDLen)
-	authData.AttestedCredentialData.CredentialID = make([]byte, authData.AttestedCredentialData.CredentialIDLen)
-	err = binary.Read(reader, binary.BigEndian, &authData.AttestedCredentialData.CredentialID)
-
-	credentialPublicKey := make([]byte, reader.Len()) // Read the rest of the AttestedCredentialData in as the public key
-	//TODO: check for CBOR extensions?!
-	_, err = reader.Read(credentialPublicKey)
-
-	coseKey := webauthn.COSEKey{}
-	err = cbor.Unmarshal(credentialPublicKey, &coseKey)
-	if err != nil {
-		return nil, fmt.Errorf("cbor.Unmarshal failed to parse credentialPublicKey: %w", err)
-	}
-
-	var sshPrivBytes []byte
-	var sshPubBytes []byte
-
-	if coseKey.Kty == webauthn.COSE_KEY_TYPE_EC2 {
-		if coseKey.Alg == webauthn.COSE_ALGORITHM_ECDSA_P256_WITH_SHA256 {
-			x := new(big.Int)
-			x.SetBytes(coseKey.X[:])
-			y := new(big.Int)
-			y.SetBytes(coseKey.Y[:])
-
-			publicKeyBytes := elliptic.Marshal(elliptic.P256(), x, y)
-
-			keyType := OPENSSH_SK_ECDSA
-			curveName := "nistp256"
-
-			sshPub := struct {
-				Type        string
-				ID          string
-				Key         []byte
-				Application string
-			}{
-				Type:        keyType,
-				ID:          curveName,
-				Key:         publicKeyBytes,
-				Application: application,
-			}
-
-			sshPriv := sshPrivateKeySKECDSA{
-				Type:        keyType,
-				ID:          curveName,
-				Key:         publicKeyBytes,
-				Application: application,
-				Flags:       authData.Flags,
-				KeyHandle:   authData.AttestedCredentialData.CredentialID,
-				Reserved:    "",
-			}
+	for _, k := range km.config.Keys {
+		log.Printf("Loading key %s\n", k.Name)
 
-			sshPubBytes = ssh.Marshal(&sshPub)
-			sshPrivBytes = ssh.Marshal(&sshPriv)
-		} else {
-			return nil, fmt.Errorf("invalid algorithm cose identifier: %d", coseKey.Alg)
-		}
-	} else if coseKey.Kty == webauthn.COSE_KEY_TYPE_OKP {
-		if coseKey.Alg == webauthn.COSE_ALGORITHM_EDDSA_ED25519 {
-			keyType := OPENSSH_SK_ED25519
-
-			sshPub := struct {
-				Type        string
-				Key         []byte
-				Application string
-			}{
-				Type:        keyType,
-				Key:         coseKey.X[:],
-				Application: application,
+		if _, err := km.loadKey(k); err != nil {
+			km.Keys[k.Name] = &Key{
+				Name:                 k.Name,
+				Type:                 k.Type,
+				algorithm:            "unknown",
+				length:               0,
+				SSHPublicKey:         nil,
+				SSHPublicKeyLocation: "",
+				config:               k,
+				backend:              km.backends[k.Type],
+				LoadError:            err,
+				Missing:              true,
 			}
 
-			sshPriv := struct {
-				Type        string
-				Key         []byte
-				Application string
-				Flags       byte
-				KeyHandle   []byte
-				Reserved    string
-			}{
-				Type:        keyType,
-				Key:         coseKey.X[:],
-				Application: application,
-				Flags:       authData.Flags,
-				KeyHandle:   authData.AttestedCredentialData.CredentialID,
-				Reserved:    "",
+			if k.SSHPublicKey != "" {
+				if sshPublicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.SSHPublicKey)); err == nil {
+					km.Keys[k.Name].SSHPublicKey = &sshPublicKey
+				} else {
+					log.Printf("Unable to load stored public key: %v", err)
+				}
 			}
-
-			sshPubBytes = ssh.Marshal(&sshPub)
-			sshPrivBytes = ssh.Marshal(&sshPriv)
-
-		} else {
-			return nil, fmt.Errorf("invalid algorithm cose identifier: %d", coseKey.Alg)
 		}
-	} else {
-		return nil, fmt.Errorf("openSSH SK keys only available for ECDSA or ED25519 key types (got %d)", coseKey.Kty)
-	}
-
-	sshPublicKeyObj, err := ssh.ParsePublicKey(sshPubBytes)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse previously generated public key: %w", err)
 	}
 
-	k := Key{
-		Name:           keyName,
-		Type:           "WEBAUTHN",
-		SSHPublicKey:   &sshPublicKeyObj,
-		SSHCertificate: nil,
-		Missing:        false,
-		LoadError:      nil,
-		algorithm:      "",
-		config: &KeyConfig{
-			Name:           keyName,
-			Type:           "WEBAUTHN",
-			ContainerName:  "",
-			ProviderName:   "",
-			SSHPublicKey:   "",
-			SKPrivateHalf:  base64.StdEncoding.EncodeToString(sshPrivBytes),
-			Algorithm:      "",
-			Length:         0,
-			VerifyRequired: verifyRequired,
-			NoPin:          false,
-		},
-		handle: 0,
-		signer: nil,
-	}
-
-	km.Keys[keyName] = &k
-
-	k.SetHWND(uintptr(km.hwnd))
-	k.SaveSSHPublicKey(km.publicKeysDir)
-	k.LoadCertificate("")
-
-	err = km.SaveConfig()
-
-	return &k, err
-}
-
-func (km *KeyManager) KeysList() []*Key {
-	if km.Keys == nil {
-		return nil
-	}
-
-	keys := make([]*Key, 0, len(km.Keys))
-
-	for _, k := range km.Keys {
-		keys = append(keys, k)
-	}
-
-	return keys
+	return nil
 }
 
 func (km *KeyManager) Close() {
@@ -1203,20 +645,15 @@ func (km *KeyManager) Close() {
 		k.Close()
 	}
 
-	for _, p := range km.providerHandles {
-		if p != 0 {
-			ncrypt.NCryptFreeObject(p)
-		}
-	}
-
-	km.cancel()
-}
+	km.closeBackends()
 
-func (km *KeyManager) SetHwnd(hwnd win.HWND) {
-	km.hwnd = hwnd
+	if km.cancel != nil {
+		km.cancel()
+	}
 
-	for _, k := range km.Keys {
-		k.SetHWND(uintptr(hwnd))
+	if km.tracer != nil {
+		listeners.SetTracer(nil)
+		km.tracer.Close()
 	}
 }
 
@@ -1245,8 +682,8 @@ func (km *KeyManager) SaveConfig() error {
 func (km *KeyManager) DeleteKey(keyToDelete *Key, deleteFromKeystore bool) error {
 	log.Printf("Deleting %s - from keystore %v\n", keyToDelete.Name, deleteFromKeystore)
 
-	if deleteFromKeystore && keyToDelete.Type == "NCRYPT" {
-		err := ncrypt.NCryptDeleteKey(keyToDelete.handle, 0)
+	if deleteFromKeystore {
+		err := keyToDelete.deleteFromKeystore()
 
 		if err != nil {
 			log.Printf("err: %s", err)
@@ -1262,7 +699,9 @@ func (km *KeyManager) DeleteKey(keyToDelete *Key, deleteFromKeystore bool) error
 func (km *KeyManager) SetPinTimeout(timeout int) {
 	km.config.PinTimeout = timeout
 	for _, k := range km.Keys {
-		k.SetTimeout(timeout)
+		if k.config != nil {
+			k.SetTimeout(km.pinTimeoutFor(k.config))
+		}
 	}
 }
 
@@ -1276,56 +715,28 @@ func (km *KeyManager) GetNotificationsEnabled() bool {
 	return !km.config.DisableNotifications
 }
 
-func (km *KeyManager) EnableListener(listenerType string, enabled bool) {
+// GetVerifySignatures reports whether signatures are verified before they are returned to clients
+func (km *KeyManager) GetVerifySignatures() bool {
+	return km.config.VerifySignatures
+}
 
-	running := false
+func (km *KeyManager) SetVerifySignatures(enabled bool) {
+	km.config.VerifySignatures = enabled
+}
 
-	switch listenerType {
-	case listeners.TYPE_PAGEANT:
-		if km.pageantListener != nil {
-			running = km.pageantListener.Running()
-		}
-	case listeners.TYPE_CYGWIN:
-		if km.cygwinListener != nil {
-			running = km.cygwinListener.Running()
-		}
-	case listeners.TYPE_VSOCK:
-		if km.vSockListener != nil {
-			running = km.vSockListener.Running()
-		}
-	case listeners.TYPE_NAMED_PIPE:
-		if km.namedPipeListener != nil {
-			running = km.namedPipeListener.Running()
-		}
-	default:
+func (km *KeyManager) EnableListener(listenerType string, enabled bool) {
+	enabledInConfig := km.listenerEnabled(listenerType)
+	if enabledInConfig == nil {
 		return
 	}
 
+	running := km.listenerRunning(listenerType)
 	if running == enabled {
 		return
 	}
 
 	if running == true && enabled == false {
-		switch listenerType {
-		case listeners.TYPE_PAGEANT:
-			if km.pageantListener != nil {
-				km.pageantListener.Stop()
-			}
-		case listeners.TYPE_CYGWIN:
-			if km.cygwinListener != nil {
-				km.cygwinListener.Stop()
-			}
-		case listeners.TYPE_VSOCK:
-			if km.vSockListener != nil {
-				km.vSockListener.Stop()
-			}
-		case listeners.TYPE_NAMED_PIPE:
-			if km.namedPipeListener != nil {
-				km.namedPipeListener.Stop()
-			}
-		default:
-			return
-		}
+		km.activeListeners[listenerType].Stop()
 	}
 
 	if running == false && enabled == true {
@@ -1338,33 +749,56 @@ func (km *KeyManager) EnableListener(listenerType string, enabled bool) {
 		enabled = listenerStarted
 	}
 
+	*enabledInConfig = enabled
+}
+
+// listenerEnabled returns the config switch of a listener type, or nil for an unknown type
+func (km *KeyManager) listenerEnabled(listenerType string) *bool {
 	switch listenerType {
 	case listeners.TYPE_PAGEANT:
-		km.config.PageantEnabled = enabled
+		return &km.config.PageantEnabled
 	case listeners.TYPE_CYGWIN:
-		km.config.CygwinEnabled = enabled
+		return &km.config.CygwinEnabled
 	case listeners.TYPE_VSOCK:
-		km.config.VSockEnabled = enabled
+		return &km.config.VSockEnabled
 	case listeners.TYPE_NAMED_PIPE:
-		km.config.NamedPipeEnabled = enabled
+		return &km.config.NamedPipeEnabled
+	case listeners.TYPE_AF_VSOCK:
+		return &km.config.AFVSockEnabled
+	case listeners.TYPE_UNIX:
+		return &km.config.UnixSocketEnabled
+	}
+
+	return nil
+}
+
+func (km *KeyManager) listenerRunning(listenerType string) bool {
+	if l := km.activeListeners[listenerType]; l != nil {
+		return l.Running()
 	}
+	return false
 }
 
 func (km *KeyManager) GetListenerEnabled(listenerType string) bool {
-	switch listenerType {
-	case listeners.TYPE_PAGEANT:
-		return km.config.PageantEnabled
-	case listeners.TYPE_CYGWIN:
-		return km.config.CygwinEnabled
-	case listeners.TYPE_VSOCK:
-		return km.config.VSockEnabled
-	case listeners.TYPE_NAMED_PIPE:
-		return km.config.NamedPipeEnabled
+	if enabled := km.listenerEnabled(listenerType); enabled != nil {
+		return *enabled
 	}
 
 	return false
 }
 
+// SetHeadless marks the KeyManager as running without a user interface, e.g. as a service in session 0 where no
+// dialog can be shown. Start leaves out the listeners that need the user interface.
+func (km *KeyManager) SetHeadless() {
+	km.headless = true
+}
+
+// isGUIListener reports whether a listener needs the user interface: the Pageant window has to be on the user's
+// desktop, and a missing Hyper-V socket registration is offered in a dialog
+func isGUIListener(listenerType string) bool {
+	return listenerType == listeners.TYPE_PAGEANT || listenerType == listeners.TYPE_VSOCK
+}
+
 func (km *KeyManager) SetNotifyChan(c chan NotifyMsg) {
 	km.notifyChan = c
 }
@@ -1377,42 +811,225 @@ func (km *KeyManager) Notify(n NotifyMsg) {
 	}
 }
 
-func (km *KeyManager) CygwinSocketLocation() string {
-	if km.cygwinListener != nil {
-		return km.cygwinListener.Sockfile
+// SetConfirmHandler sets the function used to ask the user to confirm a signature required by policy. Without a
+// handler confirmation can't be given and those requests are denied.
+func (km *KeyManager) SetConfirmHandler(handler func(title, message string) bool) {
+	km.confirmHandler = handler
+}
+
+func (km *KeyManager) Confirm(title, message string) bool {
+	if km.confirmHandler == nil {
+		return false
 	}
+	return km.confirmHandler(title, message)
+}
 
-	return ""
+// SetPINHandler sets the function used to ask for the PIN of keys the agent logs in to itself, like keys on PKCS#11
+// tokens. Without a handler those keys can only be used when the token has its own PIN entry.
+func (km *KeyManager) SetPINHandler(handler PINPrompt) {
+	km.pinHandler = handler
+}
+
+func (km *KeyManager) AskPIN(title, message string) ([]byte, bool) {
+	if km.pinHandler == nil {
+		return nil, false
+	}
+	return km.pinHandler(title, message)
+}
+
+// PolicyPath returns the configured policy file, or policy.json next to the config file
+func (km *KeyManager) PolicyPath() string {
+	if km.config.PolicyFile != "" {
+		return km.config.PolicyFile
+	}
+	return filepath.Join(filepath.Dir(km.configPath), POLICY_FILE)
+}
+
+// ReloadPolicy loads the signing policy. A missing default policy file allows everything, a policy file that
+// can't be loaded denies everything until it is fixed.
+func (km *KeyManager) ReloadPolicy() error {
+	var policy *Policy
+	var err error
+
+	policyPath := km.PolicyPath()
+	state := statPolicyFile(policyPath)
+	if _, statErr := os.Stat(policyPath); errors.Is(statErr, os.ErrNotExist) && km.config.PolicyFile == "" {
+		policy = nil
+	} else if policy, err = LoadPolicy(policyPath); err != nil {
+		policy = &Policy{DefaultAction: POLICY_DENY}
+	} else {
+		log.Printf("Loaded signing policy %s with %d rules", policyPath, len(policy.Rules))
+	}
+
+	km.policyMu.Lock()
+	km.policy = policy
+	km.policyState = state
+	km.policyMu.Unlock()
+
+	return err
 }
 
-func (km *KeyManager) LoadWebAuthNKey(kc *KeyConfig) (*Key, error) {
-	out, _, _, _, err := ssh.ParseAuthorizedKey([]byte(kc.SSHPublicKey))
+// policyWatchInterval is how often the policy file is checked for changes
+var policyWatchInterval = 2 * time.Second
+
+// policyFileState is what watchPolicy compares to notice a changed, created or removed policy file
+type policyFileState struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
 
+func statPolicyFile(policyPath string) policyFileState {
+	fi, err := os.Stat(policyPath)
 	if err != nil {
-		log.Printf("Error parsing authorized: %w\n", err)
-		return nil, err
+		return policyFileState{}
 	}
+	return policyFileState{exists: true, size: fi.Size(), modTime: fi.ModTime()}
+}
+
+// watchPolicy reloads the policy whenever its file changes, until ctx is done. A policy that fails to load denies
+// everything, the user is notified so it gets fixed.
+func (km *KeyManager) watchPolicy(ctx context.Context) {
+	ticker := time.NewTicker(policyWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-	k := Key{
-		Name:           kc.Name,
-		Type:           "WEBAUTHN",
-		SSHPublicKey:   &out,
-		SSHCertificate: nil,
-		Missing:        false,
-		LoadError:      nil,
-		algorithm:      "",
-		config:         kc,
-		handle:         0,
-		signer:         nil,
+		km.policyMu.RLock()
+		loaded := km.policyState
+		km.policyMu.RUnlock()
+		if statPolicyFile(km.PolicyPath()) == loaded {
+			continue
+		}
+
+		log.Printf("Signing policy %s changed, reloading", km.PolicyPath())
+		if err := km.ReloadPolicy(); err != nil {
+			log.Printf("%s", err)
+			msg := NotifyMsg{
+				Title:   "Signing Policy Invalid",
+				Message: fmt.Sprintf("%s\nEvery request is denied until the policy is fixed", err),
+			}
+			msg.Icon.DLL = "imageres"
+			msg.Icon.Index = 100
+			msg.Icon.Size = 32
+			km.Notify(msg)
+		}
+	}
+}
+
+// ExplainPolicy evaluates a request against the current policy without signing anything
+func (km *KeyManager) ExplainPolicy(req *PolicyRequest) *PolicyDecision {
+	km.policyMu.RLock()
+	defer km.policyMu.RUnlock()
+
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+	return km.policy.Explain(req)
+}
+
+func (km *KeyManager) GetVSockOptions() listeners.VSockOptions {
+	port := km.config.VSockServicePort
+	if port == 0 {
+		port = listeners.VSockServicePort
 	}
 
-	km.Keys[kc.Name] = &k
+	return listeners.VSockOptions{
+		ServicePort:  port,
+		VMIDs:        km.config.VSockVMIDs,
+		AnyPartition: km.config.VSockAnyPartition == nil || *km.config.VSockAnyPartition,
+		Headless:     km.headless,
+	}
+}
+
+// SetVSockOptions validates and stores the Hyper-V socket options, restarting the listener if it is running
+func (km *KeyManager) SetVSockOptions(options listeners.VSockOptions) error {
+	vmids, err := listeners.NormalizeVMIDs(options.VMIDs)
+	if err != nil {
+		return err
+	}
+
+	if options.ServicePort == listeners.VSockServicePort {
+		options.ServicePort = 0
+	}
 
-	k.SetHWND(uintptr(km.hwnd))
-	k.SaveSSHPublicKey(km.publicKeysDir)
-	k.LoadCertificate("")
+	changed := options.ServicePort != km.config.VSockServicePort ||
+		options.AnyPartition != km.GetVSockOptions().AnyPartition ||
+		strings.Join(vmids, ",") != strings.Join(km.config.VSockVMIDs, ",")
 
-	return &k, nil
+	km.config.VSockServicePort = options.ServicePort
+	km.config.VSockVMIDs = vmids
+	// the wildcard listener is the default, only an opt-out is stored
+	km.config.VSockAnyPartition = nil
+	if !options.AnyPartition {
+		km.config.VSockAnyPartition = &options.AnyPartition
+	}
+
+	if changed && km.listenerRunning(listeners.TYPE_VSOCK) {
+		if _, disableListenerInConfig, err := km.StartListener(listeners.TYPE_VSOCK); err != nil || disableListenerInConfig {
+			km.config.VSockEnabled = false
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UnixSocketPath returns the configured unix socket of the headless agent, or agent.sock in $XDG_RUNTIME_DIR or the
+// config directory
+func (km *KeyManager) UnixSocketPath() string {
+	if km.config.UnixSocketPath != "" {
+		return km.config.UnixSocketPath
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ncryptagent", "agent.sock")
+	}
+	return filepath.Join(filepath.Dir(km.configPath), "agent.sock")
+}
+
+// GetCygwinSocketPaths returns the configured Cygwin socket files, or the default one in the config directory
+func (km *KeyManager) GetCygwinSocketPaths() []string {
+	if len(km.config.CygwinSockets) > 0 {
+		return km.config.CygwinSockets
+	}
+
+	return []string{filepath.Join(filepath.Dir(km.configPath), listeners.CYGWIN_SOCK)}
+}
+
+// SetCygwinSocketPaths stores the Cygwin socket files, restarting the listener if it is running. An empty list
+// restores the default location.
+func (km *KeyManager) SetCygwinSocketPaths(paths []string) error {
+	var cleaned []string
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("cygwin socket path %s must be absolute", p)
+		}
+		cleaned = append(cleaned, filepath.Clean(p))
+	}
+
+	defaultPath := filepath.Join(filepath.Dir(km.configPath), listeners.CYGWIN_SOCK)
+	if len(cleaned) == 1 && strings.EqualFold(cleaned[0], defaultPath) {
+		cleaned = nil
+	}
+
+	changed := strings.Join(cleaned, ";") != strings.Join(km.config.CygwinSockets, ";")
+	km.config.CygwinSockets = cleaned
+
+	if changed && km.listenerRunning(listeners.TYPE_CYGWIN) {
+		if _, _, err := km.StartListener(listeners.TYPE_CYGWIN); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (km *KeyManager) SetNotificationsEnabled(enabled bool) {
@@ -0,0 +1,61 @@
+//go:build !windows
+
+package keyman
+
+import (
+	"fmt"
+	"ncryptagent/keyman/listeners"
+	"runtime"
+)
+
+// platformListenerTypes are the listeners started by Start, in order
+var platformListenerTypes = []string{
+	listeners.TYPE_UNIX,
+	listeners.TYPE_AF_VSOCK,
+}
+
+func (km *KeyManager) newPlatformListener(listenerType string, limits listeners.ConnLimits) (listeners.Listener, bool, error) {
+	switch listenerType {
+	case listeners.TYPE_UNIX:
+		return &listeners.UnixSocket{Path: km.UnixSocketPath(), Limits: limits}, false, nil
+	}
+
+	return nil, false, fmt.Errorf("listener type %s is not available on %s", listenerType, runtime.GOOS)
+}
+
+// profileListeners creates the listeners of a profile's endpoints, named pipes and Cygwin sockets only exist on
+// Windows
+func (km *KeyManager) profileListeners(pc *ProfileConfig) []listeners.Listener {
+	var ls []listeners.Listener
+	if pc.UnixSocket != "" {
+		ls = append(ls, &listeners.UnixSocket{
+			Path:   pc.UnixSocket,
+			Limits: km.config.ListenerLimits[listeners.TYPE_UNIX],
+		})
+	}
+	return ls
+}
+
+// newMachineListener fails, the machine listener is a named pipe and machine scope keys are NCrypt keys
+func (km *KeyManager) newMachineListener(path string, allow []string) (listeners.Listener, error) {
+	return nil, fmt.Errorf("the machine listener needs Windows")
+}
+
+// PCSC_BACKENDS_DEFAULT enables the PIV and OpenPGP backends, PC/SC is the only way to cards without the smart card KSP
+const PCSC_BACKENDS_DEFAULT = true
+
+// registerPlatformBackends registers nothing, NCrypt and WebAuthN keys need Windows. Their keys are kept in the config
+// and shown as missing. PKCS#11 and key files work everywhere and are registered by NewKeyManager, the in memory
+// software backend is only for the trace replay and the tests as its keys would not survive a restart.
+func (km *KeyManager) registerPlatformBackends() {
+}
+
+// focusState is empty, PIN prompts on other platforms don't come from a window of ours
+type focusState struct{}
+
+func (k *Key) TakeFocus() bool {
+	return false
+}
+
+func (k *Key) ReturnFocus() {
+}
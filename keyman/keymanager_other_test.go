@@ -0,0 +1,55 @@
+//go:build !windows
+
+package keyman
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeadlessBackends(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		pcsc   bool
+	}{
+		{"default config", "", true},
+		{"pcsc backends", `{"pcscBackends": true}`, true},
+		{"pcsc backends off", `{"pcscBackends": false}`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			configPath := filepath.Join(t.TempDir(), "config.json")
+			if tc.config != "" {
+				if err := os.WriteFile(configPath, []byte(tc.config), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			km, err := NewKeyManager(configPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer km.Close()
+
+			for _, keyType := range []string{TYPE_PKCS11, TYPE_FILE} {
+				if km.Backend(keyType) == nil {
+					t.Errorf("no %s backend", keyType)
+				}
+			}
+			for _, keyType := range []string{TYPE_PIV, TYPE_OPENPGP} {
+				if registered := km.Backend(keyType) != nil; registered != tc.pcsc {
+					t.Errorf("%s backend registered %t, expected %t", keyType, registered, tc.pcsc)
+				}
+			}
+			for _, keyType := range []string{"NCRYPT", "WEBAUTHN"} {
+				if km.Backend(keyType) != nil {
+					t.Errorf("%s backend registered without Windows", keyType)
+				}
+			}
+			// keys of the in memory backend would be gone after a restart
+			if km.Backend(TYPE_SOFTWARE) != nil {
+				t.Errorf("%s backend registered", TYPE_SOFTWARE)
+			}
+		})
+	}
+}
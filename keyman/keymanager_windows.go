@@ -0,0 +1,131 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lxn/win"
+	"golang.org/x/sys/windows"
+	"log"
+	"ncryptagent/keyman/listeners"
+	"ncryptagent/ncrypt"
+	"strings"
+)
+
+// platformListenerTypes are the listeners started by Start, in order. AF_VSOCK only exists on Linux hosts, Windows
+// guests are served by the Hyper-V socket listener.
+var platformListenerTypes = []string{
+	listeners.TYPE_CYGWIN,
+	listeners.TYPE_VSOCK,
+	listeners.TYPE_NAMED_PIPE,
+	listeners.TYPE_PAGEANT,
+}
+
+func (km *KeyManager) newPlatformListener(listenerType string, limits listeners.ConnLimits) (listeners.Listener, bool, error) {
+	switch listenerType {
+	case listeners.TYPE_VSOCK:
+		vSockListener, err := listeners.NewVSockListener(km.GetVSockOptions())
+
+		if err != nil {
+			var listenerErr *listeners.ListenerError
+			if errors.As(err, &listenerErr) {
+				switch listenerErr.Code() {
+				case listeners.ERR_DISABLE:
+					log.Printf("disabled vSock listener: %s", err)
+					return nil, true, nil
+				case listeners.ERR_ABORTED:
+					log.Printf("disabled vSock listener, but config wont be saved: %s", err)
+					return nil, false, nil
+				}
+			} else {
+				log.Printf("could not create vsock listener: %s", err)
+				return nil, false, err
+			}
+		}
+
+		if vSockListener == nil {
+			return nil, false, nil
+		}
+
+		vSockListener.Limits = limits
+		return vSockListener, false, nil
+	case listeners.TYPE_CYGWIN:
+		return &listeners.Cygwin{Sockfiles: km.GetCygwinSocketPaths(), Limits: limits}, false, nil
+	case listeners.TYPE_NAMED_PIPE:
+		return &listeners.NamedPipe{Limits: limits}, false, nil
+	case listeners.TYPE_PAGEANT:
+		return &listeners.Pageant{Limits: limits}, false, nil
+	}
+
+	return nil, false, fmt.Errorf("invalid listener type %s", listenerType)
+}
+
+// profileListeners creates the listeners of a profile's endpoints
+func (km *KeyManager) profileListeners(pc *ProfileConfig) []listeners.Listener {
+	var ls []listeners.Listener
+	if pc.NamedPipe != "" {
+		ls = append(ls, &listeners.NamedPipe{
+			Path:   pc.NamedPipe,
+			Limits: km.config.ListenerLimits[listeners.TYPE_NAMED_PIPE],
+		})
+	}
+	if len(pc.CygwinSockets) > 0 {
+		ls = append(ls, &listeners.Cygwin{
+			Sockfiles: pc.CygwinSockets,
+			Limits:    km.config.ListenerLimits[listeners.TYPE_CYGWIN],
+		})
+	}
+	return ls
+}
+
+// newMachineListener creates the named pipe of the machine listener, the accounts and groups of allow are looked up
+// by name unless they are given as SIDs
+func (km *KeyManager) newMachineListener(path string, allow []string) (listeners.Listener, error) {
+	var sids []string
+	for _, account := range allow {
+		if strings.HasPrefix(strings.ToUpper(account), "S-1-") {
+			sids = append(sids, account)
+			continue
+		}
+		sid, _, _, err := windows.LookupSID("", account)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up account %s: %w", account, err)
+		}
+		sids = append(sids, sid.String())
+	}
+
+	sd, err := listeners.PipeSecurityDescriptor(sids)
+	if err != nil {
+		return nil, err
+	}
+	return &listeners.NamedPipe{
+		Path:               path,
+		SecurityDescriptor: sd,
+		Limits:             km.config.ListenerLimits[listeners.TYPE_NAMED_PIPE],
+	}, nil
+}
+
+// PCSC_BACKENDS_DEFAULT leaves the PIV and OpenPGP backends off, cards are used through the smart card KSP unless
+// pcscBackends is set in the config
+const PCSC_BACKENDS_DEFAULT = false
+
+// registerPlatformBackends registers the NCrypt and WebAuthN backends
+func (km *KeyManager) registerPlatformBackends() {
+	km.RegisterBackend(newNCryptBackend(ncrypt.Native))
+	km.RegisterBackend(&webAuthNBackend{})
+}
+
+func (km *KeyManager) SetHwnd(hwnd win.HWND) {
+	km.hwnd = uintptr(hwnd)
+
+	for _, k := range km.Keys {
+		k.SetHWND(uintptr(hwnd))
+	}
+}
+
+func (km *KeyManager) CygwinSocketLocation() string {
+	if l, ok := km.activeListeners[listeners.TYPE_CYGWIN].(*listeners.Cygwin); ok && len(l.Sockfiles) > 0 {
+		return l.Sockfiles[0]
+	}
+
+	return ""
+}
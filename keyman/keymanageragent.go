@@ -2,10 +2,15 @@ package keyman
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"log"
+	"ncryptagent/keyman/listeners"
+	"strings"
 	"sync"
 )
 
@@ -13,25 +18,74 @@ type KeyManagerAgent struct {
 	km     *KeyManager
 	locked bool
 	mu     sync.Mutex
+
+	// profile is the name of the profile whose keys the agent serves, empty for the default profile
+	profile    string
+	passphrase []byte
+	// machine agents serve the machine scope keys of all profiles on the machine listener
+	machine bool
+}
+
+// keys returns the keys of the agent's profile, or the machine scope keys for the machine agent
+func (kma *KeyManagerAgent) keys() []*Key {
+	var keys []*Key
+	for _, k := range kma.km.KeysList() {
+		if kma.machine {
+			if k.Scope() == SCOPE_MACHINE {
+				keys = append(keys, k)
+			}
+		} else if strings.EqualFold(kma.km.keyProfile(k), kma.profile) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Locked reports whether a client has locked the agent
+func (kma *KeyManagerAgent) Locked() bool {
+	kma.mu.Lock()
+	defer kma.mu.Unlock()
+	return kma.locked
 }
 
 // List returns the identities known to the agent.
 func (kma *KeyManagerAgent) List() ([]*agent.Key, error) {
+	return kma.list(nil)
+}
+
+// list returns the identities visible to the client of conn, keys the policy denies to the client are left out.
+// conn is nil for requests that don't come from a listener.
+func (kma *KeyManagerAgent) list(conn *connectionAgent) ([]*agent.Key, error) {
 	kma.mu.Lock()
 	defer kma.mu.Unlock()
 
-	if kma.km.Keys == nil {
+	if kma.km.Keys == nil || kma.locked {
 		return nil, nil
 	}
 
 	var ids []*agent.Key
-	for _, k := range kma.km.KeysList() {
+	for _, k := range kma.keys() {
+		decision := kma.km.ExplainPolicy(&PolicyRequest{
+			Operation: OPERATION_LIST,
+			KeyName:   k.Name,
+			Peer:      conn.peer(),
+		})
+		if decision.Action == POLICY_DENY {
+			log.Printf("Key %s hidden from %s by policy: %s", k.Name, conn.peer(), decision)
+			continue
+		}
+
+		comment := k.Name
+		if k.Capabilities().Software {
+			comment += " [software]"
+		}
+
 		if k.SSHPublicKey != nil {
 			pub := *k.SSHPublicKey
 			ids = append(ids, &agent.Key{
 				Format:  pub.Type(),
 				Blob:    pub.Marshal(),
-				Comment: k.Name})
+				Comment: comment})
 		}
 
 		// Check for a cert
@@ -42,7 +96,7 @@ func (kma *KeyManagerAgent) List() ([]*agent.Key, error) {
 			ids = append(ids, &agent.Key{
 				Format:  pub.Type(),
 				Blob:    pub.Marshal(),
-				Comment: k.Name})
+				Comment: comment})
 		}
 	}
 	return ids, nil
@@ -55,7 +109,21 @@ func (kma *KeyManagerAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature
 }
 
 func (kma *KeyManagerAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
-	for _, k := range kma.km.KeysList() {
+	return kma.signWithFlags(nil, key, data, flags)
+}
+
+func (kma *KeyManagerAgent) signWithFlags(conn *connectionAgent, key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	peer := conn.peer()
+	if kma.Locked() {
+		return nil, fmt.Errorf("agent is locked")
+	}
+
+	for _, k := range kma.keys() {
+		// missing keys without a stored public key can't be the requested one, list leaves them out too
+		if k.SSHPublicKey == nil {
+			continue
+		}
+
 		// Some clients might send the certificate blob as a key instead, so check equality for that
 		var certMatches = false
 		if k.SSHCertificate != nil {
@@ -64,45 +132,15 @@ func (kma *KeyManagerAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags
 
 		pub := *k.SSHPublicKey
 		if bytes.Equal(pub.Marshal(), key.Marshal()) || certMatches {
-			if flags == 0 {
-				sig, err := k.SignSSH(data)
-
-				if err != nil {
-					log.Printf("SSH Sign with %s FAILED: %v", k.Name, err)
-					kma.km.Notify(NotifyMsg{
-						Title:   "SSH Sign Failed",
-						Message: fmt.Sprintf("Failed to sign message with key \"%s\"", k.Name),
-						Icon: struct {
-							DLL   string
-							Index int32
-							Size  int
-						}{
-							DLL:   "imageres",
-							Index: 100,
-							Size:  32,
-						},
-					})
-
-					return nil, err
-				}
-
-				log.Printf("SSH Sign with %s SUCCEEDED", k.Name)
-				kma.km.Notify(NotifyMsg{
-					Title:   "SSH Sign Successful",
-					Message: fmt.Sprintf("Signed message with key \"%s\"", k.Name),
-					Icon: struct {
-						DLL   string
-						Index int32
-						Size  int
-					}{
-						DLL:   "imageres",
-						Index: 101,
-						Size:  32,
-					},
-				})
-
-				return sig, err
+			if err := kma.enforcePolicy(conn, k, data); err != nil {
+				kma.notifySign(k, peer, err)
+				return nil, err
+			}
 
+			var sig *ssh.Signature
+			var err error
+			if flags == 0 {
+				sig, err = k.SignSSH(data)
 			} else {
 				var algorithm string
 
@@ -114,50 +152,232 @@ func (kma *KeyManagerAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags
 				default:
 					return nil, fmt.Errorf("agent: unsupported signature flags: %d", flags)
 				}
-				sig, err := k.SignWithAlgorithmSSH(data, algorithm)
-
-				if err != nil {
-					log.Printf("SSH Sign with %s FAILED: %v", k.Name, err)
-					kma.km.Notify(NotifyMsg{
-						Title:   "SSH Sign Failed",
-						Message: fmt.Sprintf("Failed to sign message with key \"%s\"", k.Name),
-						Icon: struct {
-							DLL   string
-							Index int32
-							Size  int
-						}{
-							DLL:   "imageres",
-							Index: 100,
-							Size:  32,
-						},
-					})
-
-					return nil, err
-				}
+				sig, err = k.SignWithAlgorithmSSH(data, algorithm)
+			}
+			if err == nil && kma.km.GetVerifySignatures() {
+				err = k.VerifySignature(data, sig)
+			}
 
-				log.Printf("SSH Sign with %s SUCCEEDED", k.Name)
-				kma.km.Notify(NotifyMsg{
-					Title:   "SSH Sign Successful",
-					Message: fmt.Sprintf("Signed message with key \"%s\"", k.Name),
-					Icon: struct {
-						DLL   string
-						Index int32
-						Size  int
-					}{
-						DLL:   "imageres",
-						Index: 101,
-						Size:  32,
-					},
-				})
-
-				return sig, err
+			kma.notifySign(k, peer, err)
+			if err != nil {
+				return nil, err
 			}
+			return sig, nil
 		}
 	}
 
 	return nil, fmt.Errorf("not found")
 }
 
+// enforcePolicy evaluates the signing policy for a request, asking the user for confirmation or purging the cached
+// PIN when a rule requires it
+func (kma *KeyManagerAgent) enforcePolicy(conn *connectionAgent, k *Key, data []byte) error {
+	payload, namespace, sessionID := ParseSignPayload(data)
+	req := &PolicyRequest{
+		Operation: OPERATION_SIGN,
+		KeyName:   k.Name,
+		Peer:      conn.peer(),
+		Payload:   payload,
+		Namespace: namespace,
+	}
+	if bind := conn.sessionBind(sessionID); bind != nil {
+		req.HostKey = bind.hostKey
+		req.HostNames = knownHostNames(bind.hostKey)
+	}
+	if conn != nil {
+		req.Forwarded = conn.forwarded
+	}
+
+	decision := kma.km.ExplainPolicy(req)
+	log.Printf("Policy for %s %s by %s: %s", k.Name, payload, req.Peer, decision)
+
+	switch decision.Action {
+	case POLICY_DENY:
+		return fmt.Errorf("signing with key %s denied by policy", k.Name)
+	case POLICY_CONFIRM:
+		purpose := "authentication"
+		if payload == PAYLOAD_SSHSIG {
+			purpose = fmt.Sprintf("a %q signature", namespace)
+		} else if payload == PAYLOAD_OTHER {
+			purpose = "an unknown payload"
+		}
+		destination := ""
+		if len(req.HostNames) > 0 {
+			destination = fmt.Sprintf(" to %s", strings.Join(req.HostNames, ", "))
+		} else if req.HostKey != nil {
+			destination = fmt.Sprintf(" to host %s", ssh.FingerprintSHA256(req.HostKey))
+		}
+		if req.Forwarded {
+			destination += " (forwarded)"
+		}
+		message := fmt.Sprintf("%s wants to use key \"%s\" for %s%s.\n\nAllow?", req.Peer, k.Name, purpose, destination)
+		if !kma.km.Confirm("Confirm SSH Key Use", message) {
+			return fmt.Errorf("signing with key %s was not confirmed", k.Name)
+		}
+	case POLICY_PIN:
+		k.PurgePIN()
+	}
+	return nil
+}
+
+// notifySign writes the audit log line for a signing request and shows the tray notification
+func (kma *KeyManagerAgent) notifySign(k *Key, peer *listeners.PeerInfo, err error) {
+	client := ""
+	if peer != nil {
+		log.Printf("SSH Sign with %s requested by %s via %s", k.Name, peer, peer.Listener)
+		client = fmt.Sprintf("\nRequested by %s", peer)
+	}
+
+	msg := NotifyMsg{
+		Title:   "SSH Sign Successful",
+		Message: fmt.Sprintf("Signed message with key \"%s\"%s", k.Name, client),
+	}
+	msg.Icon.DLL = "imageres"
+	msg.Icon.Index = 101
+	msg.Icon.Size = 32
+
+	if errors.Is(err, ErrSignatureInvalid) {
+		log.Printf("SSH Sign with %s FAILED, invalid signature: %v", k.Name, err)
+		msg.Title = "SSH Signature Invalid"
+		msg.Message = fmt.Sprintf("Key \"%s\" made a signature that does not verify, it was not sent%s", k.Name, client)
+		msg.Icon.Index = 100
+	} else if err != nil {
+		log.Printf("SSH Sign with %s FAILED: %v", k.Name, err)
+		msg.Title = "SSH Sign Failed"
+		msg.Message = fmt.Sprintf("Failed to sign message with key \"%s\"%s", k.Name, client)
+		msg.Icon.Index = 100
+	} else {
+		log.Printf("SSH Sign with %s SUCCEEDED", k.Name)
+	}
+
+	kma.km.Notify(msg)
+
+	// a wrong PIN counts against the tries of the PIN, an invalid signature was made with the right one
+	if err != nil && !errors.Is(err, ErrSignatureInvalid) {
+		kma.km.checkPINRetries(k)
+	}
+}
+
+// WithContext returns an agent bound to a single client connection, the peer identity attached to ctx by the
+// listener is used for logging and notifications
+func (kma *KeyManagerAgent) WithContext(ctx context.Context) agent.Agent {
+	return &connectionAgent{kma: kma, ctx: ctx}
+}
+
+// connectionAgent is a KeyManagerAgent serving a single client connection
+type connectionAgent struct {
+	kma *KeyManagerAgent
+	ctx context.Context
+
+	// session-bind@openssh.com state, requests on a connection are served one at a time
+	binds     []sessionBind
+	forwarded bool
+}
+
+type sessionBind struct {
+	hostKey   ssh.PublicKey
+	sessionID []byte
+}
+
+// peer returns the client identity, c may be nil
+func (c *connectionAgent) peer() *listeners.PeerInfo {
+	if c == nil {
+		return nil
+	}
+	return listeners.PeerFromContext(c.ctx)
+}
+
+// sessionBind returns the bind for an authentication request's session, or the most recent bind for other payloads
+func (c *connectionAgent) sessionBind(sessionID []byte) *sessionBind {
+	if c == nil || len(c.binds) == 0 {
+		return nil
+	}
+	if sessionID == nil {
+		return &c.binds[len(c.binds)-1]
+	}
+	for i := range c.binds {
+		if bytes.Equal(c.binds[i].sessionID, sessionID) {
+			return &c.binds[i]
+		}
+	}
+	return nil
+}
+
+func (c *connectionAgent) List() ([]*agent.Key, error) {
+	return c.kma.list(c)
+}
+
+func (c *connectionAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return c.kma.signWithFlags(c, key, data, 0)
+}
+
+func (c *connectionAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	return c.kma.signWithFlags(c, key, data, flags)
+}
+
+func (c *connectionAgent) Add(key agent.AddedKey) error {
+	return c.kma.Add(key)
+}
+
+func (c *connectionAgent) Remove(key ssh.PublicKey) error {
+	return c.kma.Remove(key)
+}
+
+func (c *connectionAgent) RemoveAll() error {
+	return c.kma.RemoveAll()
+}
+
+func (c *connectionAgent) Lock(passphrase []byte) error {
+	return c.kma.Lock(passphrase)
+}
+
+func (c *connectionAgent) Unlock(passphrase []byte) error {
+	return c.kma.Unlock(passphrase)
+}
+
+func (c *connectionAgent) Signers() ([]ssh.Signer, error) {
+	return c.kma.Signers()
+}
+
+func (c *connectionAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType == "session-bind@openssh.com" {
+		return nil, c.bindSession(contents)
+	}
+	return c.kma.Extension(extensionType, contents)
+}
+
+// bindSession records the destination host of the connection. OpenSSH sends it before authenticating, signed by
+// the host key over the session identifier.
+func (c *connectionAgent) bindSession(contents []byte) error {
+	var msg struct {
+		HostKey    []byte
+		SessionID  []byte
+		Signature  []byte
+		Forwarding bool
+	}
+	if err := ssh.Unmarshal(contents, &msg); err != nil {
+		return err
+	}
+
+	hostKey, err := ssh.ParsePublicKey(msg.HostKey)
+	if err != nil {
+		return err
+	}
+	sig := new(ssh.Signature)
+	if err = ssh.Unmarshal(msg.Signature, sig); err != nil {
+		return err
+	}
+	if err = hostKey.Verify(msg.SessionID, sig); err != nil {
+		return fmt.Errorf("session-bind signature invalid: %w", err)
+	}
+
+	c.binds = append(c.binds, sessionBind{hostKey: hostKey, sessionID: msg.SessionID})
+	if msg.Forwarding {
+		c.forwarded = true
+	}
+	return nil
+}
+
 // Add adds a private key to the agent.
 func (kma *KeyManagerAgent) Add(key agent.AddedKey) error {
 	return fmt.Errorf("not implemented")
@@ -175,13 +395,28 @@ func (kma *KeyManagerAgent) RemoveAll() error {
 
 // Lock locks the agent. Sign and Remove will fail, and List will empty an empty list.
 func (kma *KeyManagerAgent) Lock(passphrase []byte) error {
+	kma.mu.Lock()
+	defer kma.mu.Unlock()
+	if kma.locked {
+		return fmt.Errorf("agent: already locked")
+	}
 	kma.locked = true
+	kma.passphrase = append([]byte(nil), passphrase...)
 	return nil
 }
 
 // Unlock undoes the effect of Lock
 func (kma *KeyManagerAgent) Unlock(passphrase []byte) error {
+	kma.mu.Lock()
+	defer kma.mu.Unlock()
+	if !kma.locked {
+		return fmt.Errorf("agent: not locked")
+	}
+	if subtle.ConstantTimeCompare(passphrase, kma.passphrase) != 1 {
+		return fmt.Errorf("agent: incorrect passphrase")
+	}
 	kma.locked = false
+	kma.passphrase = nil
 	return nil
 }
 
@@ -0,0 +1,111 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const TYPE_AF_VSOCK = "AF_VSOCK"
+
+const (
+	VMADDR_CID_ANY   = 0xFFFFFFFF
+	VMADDR_CID_LOCAL = 1
+	VMADDR_CID_HOST  = 2
+)
+
+// AFVSockOptions configures the AF_VSOCK listener used on Linux hosts to serve QEMU/Firecracker guests
+type AFVSockOptions struct {
+	// Port is the vsock port to listen on, defaults to VSockServicePort so guests can use the same relay as WSL2
+	Port uint32
+	// AllowedCIDs are the guest context IDs that may connect
+	AllowedCIDs []uint32
+	// AllowAnyGuest accepts every guest on the host instead of only AllowedCIDs. Without either no guest is accepted
+	// and the listener doesn't start.
+	AllowAnyGuest bool
+}
+
+// ErrNoGuestsAllowed is returned by the AF_VSOCK listener when neither AllowedCIDs nor AllowAnyGuest are set
+var ErrNoGuestsAllowed = errors.New("no vsock guests allowed, list their CIDs or allow any guest")
+
+// AFVSock serves the agent over AF_VSOCK on Linux hosts, the virtio-vsock equivalent of the Hyper-V socket
+// listener
+type AFVSock struct {
+	options AFVSockOptions
+	// Limits bounds client connections, the zero value uses the defaults
+	Limits ConnLimits
+
+	mu        sync.Mutex
+	running   bool
+	stopping  bool
+	lastError error
+	closer    func() error
+}
+
+func NewAFVSockListener(options AFVSockOptions) *AFVSock {
+	if options.Port == 0 {
+		options.Port = VSockServicePort
+	}
+
+	return &AFVSock{options: options}
+}
+
+func (s *AFVSock) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+func (s *AFVSock) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError
+}
+
+func (s *AFVSock) Name() string {
+	return fmt.Sprintf("AF_VSOCK port 0x%x", s.options.Port)
+}
+
+func (s *AFVSock) Stop() error {
+	s.mu.Lock()
+	closer := s.closer
+	s.stopping = true
+	s.mu.Unlock()
+
+	if closer != nil {
+		return closer()
+	}
+	return nil
+}
+
+// cidAllowed reports whether a guest with the given context ID may connect
+func (s *AFVSock) cidAllowed(cid uint32) bool {
+	if s.options.AllowAnyGuest {
+		return true
+	}
+	for _, c := range s.options.AllowedCIDs {
+		if c == cid {
+			return true
+		}
+	}
+	return false
+}
+
+// shuttingDown reports whether the listener was stopped or its context cancelled, closing the socket makes the accept
+// loop fail with the poller's "use of closed file" error rather than os.ErrClosed
+func (s *AFVSock) shuttingDown(ctx context.Context) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping || ctx.Err() != nil
+}
+
+func (s *AFVSock) setState(running bool, closer func() error, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+	s.closer = closer
+	if err != nil {
+		s.lastError = err
+	}
+}
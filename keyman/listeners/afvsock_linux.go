@@ -0,0 +1,123 @@
+//go:build linux
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
+)
+
+// vsockFile wraps a connected AF_VSOCK socket, the net package is unable to wrap AF_VSOCK descriptors itself
+type vsockFile struct {
+	*os.File
+}
+
+func (s *AFVSock) Run(ctx context.Context, sshagent agent.Agent) error {
+	// every VM on the host could use the keys, so guests have to be allowed explicitly
+	if len(s.options.AllowedCIDs) == 0 && !s.options.AllowAnyGuest {
+		s.setState(false, nil, ErrNoGuestsAllowed)
+		return ErrNoGuestsAllowed
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		s.setState(false, nil, err)
+		return fmt.Errorf("unable to create vsock socket: %w", err)
+	}
+
+	if err = unix.Bind(fd, &unix.SockaddrVM{CID: VMADDR_CID_ANY, Port: s.options.Port}); err != nil {
+		unix.Close(fd)
+		s.setState(false, nil, err)
+		return fmt.Errorf("unable to bind vsock port 0x%x: %w", s.options.Port, err)
+	}
+
+	if err = unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		s.setState(false, nil, err)
+		return fmt.Errorf("unable to listen on vsock port 0x%x: %w", s.options.Port, err)
+	}
+
+	l := os.NewFile(uintptr(fd), fmt.Sprintf("vsock:*:%d", s.options.Port))
+	s.mu.Lock()
+	s.stopping = false
+	s.mu.Unlock()
+	s.setState(true, l.Close, nil)
+	defer s.setState(false, nil, nil)
+	defer l.Close()
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	guard := newConnGuard(s.Name(), s.Limits)
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+	// clients waiting for their next request are cut off when the listener shuts down, before waiting for them
+	conns := new(connSet)
+	defer conns.closeAll()
+
+	for {
+		var nfd int
+		var sa unix.Sockaddr
+		var acceptErr error
+		err = rc.Read(func(fd uintptr) bool {
+			nfd, sa, acceptErr = unix.Accept4(int(fd), unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK)
+			return acceptErr != unix.EAGAIN
+		})
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) || s.shuttingDown(ctx) {
+				return nil
+			}
+			s.setState(true, l.Close, err)
+			return err
+		}
+		if acceptErr != nil {
+			if acceptErr == unix.ECONNABORTED || acceptErr == unix.EINTR {
+				continue
+			}
+			s.setState(true, l.Close, acceptErr)
+			return acceptErr
+		}
+
+		peer, ok := sa.(*unix.SockaddrVM)
+		if !ok || !s.cidAllowed(peer.CID) {
+			if ok {
+				log.Printf("Rejected vsock connection from CID %d", peer.CID)
+			}
+			unix.Close(nfd)
+			continue
+		}
+
+		conn := &vsockFile{File: os.NewFile(uintptr(nfd), fmt.Sprintf("vsock:%d:%d", peer.CID, peer.Port))}
+		if !conns.add(conn) {
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			defer conns.remove(conn)
+			// the client process lives inside the guest, only its CID is known
+			err := guard.Serve(ctx, sshagent, conn, &PeerInfo{Listener: TYPE_AF_VSOCK, Detail: fmt.Sprintf("vsock CID %d", peer.CID)})
+			if err != nil && err != io.EOF && !errors.Is(err, os.ErrClosed) {
+				log.Println(err.Error())
+			}
+		}()
+	}
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package listeners
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
+)
+
+// testAFVSockPort is a port unlikely to be used by anything else on the test machine
+const testAFVSockPort = 0x23232399
+
+// startAFVSock runs an AF_VSOCK listener until it is serving, skipping the test when the kernel has no vsock support.
+// The returned channel receives the result of Run.
+func startAFVSock(t *testing.T, ctx context.Context, l *AFVSock, sshagent agent.Agent) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- l.Run(ctx, sshagent) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.Running() {
+		select {
+		case err := <-done:
+			if errors.Is(err, unix.EAFNOSUPPORT) || errors.Is(err, unix.EADDRNOTAVAIL) || errors.Is(err, unix.ENODEV) {
+				t.Skipf("no AF_VSOCK support: %s", err)
+			}
+			t.Fatalf("listener stopped before serving: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("listener not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return done
+}
+
+// waitRun waits for Run to return and checks that it returned without an error
+func waitRun(t *testing.T, l *AFVSock, done <-chan error) {
+	t.Helper()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v on shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+	if err := l.LastError(); err != nil {
+		t.Fatalf("shutdown recorded as error %v", err)
+	}
+	if l.Running() {
+		t.Fatal("listener still running after shutdown")
+	}
+}
+
+func TestAFVSockStop(t *testing.T) {
+	l := NewAFVSockListener(AFVSockOptions{Port: testAFVSockPort, AllowAnyGuest: true})
+	done := startAFVSock(t, context.Background(), l, agent.NewKeyring())
+
+	if err := l.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	waitRun(t, l, done)
+}
+
+func TestAFVSockContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := NewAFVSockListener(AFVSockOptions{Port: testAFVSockPort, AllowAnyGuest: true})
+	done := startAFVSock(t, ctx, l, agent.NewKeyring())
+
+	cancel()
+	waitRun(t, l, done)
+}
+
+// TestAFVSockLoopback lists the keys of the agent through a VMADDR_CID_LOCAL connection, which needs the
+// vsock_loopback transport
+func TestAFVSockLoopback(t *testing.T) {
+	keyring := agent.NewKeyring()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "loopback"}); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewAFVSockListener(AFVSockOptions{Port: testAFVSockPort, AllowedCIDs: []uint32{VMADDR_CID_LOCAL}})
+	done := startAFVSock(t, context.Background(), l, keyring)
+	defer waitRun(t, l, done)
+	defer l.Stop()
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Connect(fd, &unix.SockaddrVM{CID: VMADDR_CID_LOCAL, Port: testAFVSockPort}); err != nil {
+		unix.Close(fd)
+		t.Skipf("no vsock loopback transport: %s", err)
+	}
+	conn := os.NewFile(uintptr(fd), "vsock-client")
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Comment != "loopback" {
+		t.Fatalf("listed %v, expected the loopback key", keys)
+	}
+}
+
+func TestAFVSockNoGuests(t *testing.T) {
+	l := NewAFVSockListener(AFVSockOptions{Port: testAFVSockPort})
+	if err := l.Run(context.Background(), agent.NewKeyring()); !errors.Is(err, ErrNoGuestsAllowed) {
+		t.Fatalf("Run returned %v, expected ErrNoGuestsAllowed", err)
+	}
+	if !errors.Is(l.LastError(), ErrNoGuestsAllowed) || l.Running() {
+		t.Fatalf("listener running %t with error %v", l.Running(), l.LastError())
+	}
+}
+
+func TestAFVSockCIDAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options AFVSockOptions
+		allowed map[uint32]bool
+	}{
+		{name: "nothing allowed", options: AFVSockOptions{}, allowed: map[uint32]bool{3: false, VMADDR_CID_LOCAL: false}},
+		{name: "listed", options: AFVSockOptions{AllowedCIDs: []uint32{3, 5}}, allowed: map[uint32]bool{3: true, 4: false, 5: true}},
+		{name: "any guest", options: AFVSockOptions{AllowAnyGuest: true}, allowed: map[uint32]bool{3: true, 4: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := NewAFVSockListener(tc.options)
+			for cid, allowed := range tc.allowed {
+				if l.cidAllowed(cid) != allowed {
+					t.Errorf("CID %d allowed %t, expected %t", cid, !allowed, allowed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package listeners
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func (s *AFVSock) Run(ctx context.Context, sshagent agent.Agent) error {
+	err := fmt.Errorf("the AF_VSOCK listener is only available on Linux, use the Hyper-V socket listener instead")
+	s.setState(false, nil, err)
+	return err
+}
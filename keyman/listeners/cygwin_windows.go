@@ -0,0 +1,212 @@
+package listeners
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+type Cygwin struct {
+	// Sockfiles are the socket emulation files written for clients, all of them point at the same TCP listener
+	Sockfiles []string
+	// Limits bounds client connections, the zero value uses the defaults
+	Limits ConnLimits
+
+	mu          sync.Mutex
+	running     bool
+	lastError   error
+	netListener net.Listener
+}
+
+func (s *Cygwin) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+func (s *Cygwin) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError
+}
+
+func (s *Cygwin) Name() string {
+	return "cygwin/msys/GIT for windows"
+}
+
+func (s *Cygwin) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	if s.netListener == nil {
+		return nil
+	}
+	return s.netListener.Close()
+}
+
+func (s *Cygwin) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = err
+}
+
+func SetFileAttributes(path string, attr uint32) error {
+	cpath, cpathErr := syscall.UTF16PtrFromString(path)
+	if cpathErr != nil {
+		return cpathErr
+	}
+	return syscall.SetFileAttributes(cpath, attr)
+}
+
+func UUIDToString(uuid [16]byte) string {
+	var buf [35]byte
+	dst := buf[:]
+	for i := 0; i < 4; i++ {
+		b := uuid[i*4 : i*4+4]
+		hex.Encode(dst[i*9:i*9+8], []byte{b[3], b[2], b[1], b[0]})
+		if i != 3 {
+			dst[9*i+8] = '-'
+		}
+	}
+	return string(buf[:])
+}
+
+func removeCygwinSocket(filename string) {
+	// the socket file is created read only, which would prevent its removal
+	SetFileAttributes(filename, syscall.FILE_ATTRIBUTE_NORMAL)
+	os.Remove(filename)
+}
+
+func createCygwinSocket(filename string, port int, uuid [16]byte) error {
+	removeCygwinSocket(filename)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(fmt.Sprintf("!<socket >%d s %s", port, UUIDToString(uuid)))
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if err := SetFileAttributes(filename, syscall.FILE_ATTRIBUTE_SYSTEM|syscall.FILE_ATTRIBUTE_READONLY); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Cygwin) Run(ctx context.Context, sshagent agent.Agent) error {
+	if len(s.Sockfiles) == 0 {
+		return fmt.Errorf("no cygwin socket files configured")
+	}
+
+	// listen tcp socket
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		s.setError(err)
+		return err
+	}
+
+	s.mu.Lock()
+	s.netListener = l
+	s.mu.Unlock()
+
+	// cygwin socket uuid
+	var uuid [16]byte
+	if _, err = rand.Read(uuid[:]); err != nil {
+		l.Close()
+		return err
+	}
+
+	defer func() {
+		l.Close()
+		for _, f := range s.Sockfiles {
+			// a restarted listener may already have replaced the file, only remove our own
+			if content, err := os.ReadFile(f); err == nil && bytes.HasSuffix(content, []byte(UUIDToString(uuid))) {
+				removeCygwinSocket(f)
+			}
+		}
+	}()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	for _, f := range s.Sockfiles {
+		if err = createCygwinSocket(f, port, uuid); err != nil {
+			s.setError(err)
+			return fmt.Errorf("unable to create cygwin socket %s: %w", f, err)
+		}
+	}
+
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	// closing the listener unblocks Accept when the context is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-stop:
+		}
+	}()
+
+	guard := newConnGuard(s.Name(), s.Limits)
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			s.setError(err)
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			// the slot is taken before the handshake, slow handshakes count against MaxConnections
+			if !guard.Reserve(&PeerInfo{Listener: TYPE_CYGWIN, Detail: conn.RemoteAddr().String()}) {
+				return
+			}
+			defer guard.Release()
+
+			h := NewCygwinHandshake(uuid)
+			if err := h.Run(conn); err != nil {
+				log.Printf("Cygwin handshake from %s failed: %s", conn.RemoteAddr(), err)
+				return
+			}
+
+			// the handshake pid is the cygwin pid, the windows process is found from the TCP connection owner
+			peer := NewProcessPeer(TYPE_CYGWIN, tcpClientPID(conn))
+			peer.Detail = fmt.Sprintf("cygwin pid %d uid %d", h.Peer.PID, h.Peer.UID)
+			err := guard.ServeReserved(ctx, sshagent, conn, peer)
+			if err != nil && err != io.EOF {
+				log.Println(err.Error())
+			}
+		}()
+	}
+}
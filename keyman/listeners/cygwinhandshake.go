@@ -0,0 +1,137 @@
+package listeners
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+// CygwinHandshakeTimeout bounds how long a client has to complete the socket emulation handshake
+const CygwinHandshakeTimeout = 5 * time.Second
+
+// CygwinCredentials is the pid/uid/gid block exchanged during the handshake
+type CygwinCredentials struct {
+	PID uint32
+	UID uint32
+	GID uint32
+}
+
+// cygwinNoID is (uid_t)-1 and (gid_t)-1, which cygwin never hands out to a process. Native Windows clients such as
+// the stdio bridge have to send the IDs Cygwin would give them, os.Getuid returns -1 on Windows.
+const cygwinNoID = 0xffffffff
+
+// validate checks the credentials a client sent, a pid_t is a positive signed 32 bit number and the uid and gid must
+// name an account and a group
+func (c CygwinCredentials) validate() error {
+	if c.PID == 0 || c.PID > math.MaxInt32 {
+		return fmt.Errorf("invalid pid %d", c.PID)
+	}
+	if c.UID == cygwinNoID {
+		return fmt.Errorf("invalid uid %d", c.UID)
+	}
+	if c.GID == cygwinNoID {
+		return fmt.Errorf("invalid gid %d", c.GID)
+	}
+	return nil
+}
+
+type cygwinHandshakeState int
+
+const (
+	cygwinReadSecret cygwinHandshakeState = iota
+	cygwinWriteSecret
+	cygwinReadCredentials
+	cygwinWriteCredentials
+	cygwinHandshakeDone
+)
+
+// CygwinHandshake implements the server side of Cygwin's AF_UNIX emulation handshake:
+//
+//  1. the client sends the 16 byte secret from the socket file, which must match ours
+//  2. the secret is echoed back
+//  3. the client sends its pid, uid and gid as little endian uint32s
+//  4. we reply with our pid, the client's uid and our pid as gid (as cygwin does for AF_UNIX -> AF_INET)
+type CygwinHandshake struct {
+	secret  [16]byte
+	timeout time.Duration
+	state   cygwinHandshakeState
+	Peer    CygwinCredentials
+}
+
+// NewCygwinHandshake returns the server side of the handshake for the secret written to the socket files
+func NewCygwinHandshake(secret [16]byte) *CygwinHandshake {
+	return &CygwinHandshake{
+		secret:  secret,
+		timeout: CygwinHandshakeTimeout,
+		state:   cygwinReadSecret,
+	}
+}
+
+func (h *CygwinHandshake) Run(conn net.Conn) error {
+	if h.timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(h.timeout)); err != nil {
+			return err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	for h.state != cygwinHandshakeDone {
+		if err := h.step(conn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *CygwinHandshake) step(conn io.ReadWriter) error {
+	switch h.state {
+	case cygwinReadSecret:
+		var secret [16]byte
+		if _, err := io.ReadFull(conn, secret[:]); err != nil {
+			return fmt.Errorf("reading secret: %w", err)
+		}
+		if !bytes.Equal(secret[:], h.secret[:]) {
+			return fmt.Errorf("invalid uuid")
+		}
+		h.state = cygwinWriteSecret
+	case cygwinWriteSecret:
+		if _, err := conn.Write(h.secret[:]); err != nil {
+			return fmt.Errorf("writing secret: %w", err)
+		}
+		h.state = cygwinReadCredentials
+	case cygwinReadCredentials:
+		var creds [12]byte
+		if _, err := io.ReadFull(conn, creds[:]); err != nil {
+			return fmt.Errorf("reading credentials: %w", err)
+		}
+		h.Peer = CygwinCredentials{
+			PID: binary.LittleEndian.Uint32(creds[0:]),
+			UID: binary.LittleEndian.Uint32(creds[4:]),
+			GID: binary.LittleEndian.Uint32(creds[8:]),
+		}
+		if err := h.Peer.validate(); err != nil {
+			return fmt.Errorf("invalid credentials block: %w", err)
+		}
+		h.state = cygwinWriteCredentials
+	case cygwinWriteCredentials:
+		pid := uint32(os.Getpid())
+		var creds [12]byte
+		binary.LittleEndian.PutUint32(creds[0:], pid)
+		binary.LittleEndian.PutUint32(creds[4:], h.Peer.UID)
+		binary.LittleEndian.PutUint32(creds[8:], pid) // for cygwin's AF_UNIX -> AF_INET, pid = gid
+		if _, err := conn.Write(creds[:]); err != nil {
+			return fmt.Errorf("writing credentials: %w", err)
+		}
+		h.state = cygwinHandshakeDone
+	default:
+		return fmt.Errorf("invalid handshake state %d", h.state)
+	}
+
+	return nil
+}
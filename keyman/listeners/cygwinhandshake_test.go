@@ -0,0 +1,186 @@
+package listeners
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testCygwinSecret = [16]byte{0x10, 0x32, 0x54, 0x76, 0x98, 0xba, 0xdc, 0xfe, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+
+func cygwinCredentialsBlock(pid, uid, gid uint32) []byte {
+	creds := make([]byte, 12)
+	binary.LittleEndian.PutUint32(creds, pid)
+	binary.LittleEndian.PutUint32(creds[4:], uid)
+	binary.LittleEndian.PutUint32(creds[8:], gid)
+	return creds
+}
+
+// runCygwinHandshake runs the server side of the handshake on one end of a net.Pipe and the client function on the
+// other, returning the handshake and the server's result
+func runCygwinHandshake(t *testing.T, timeout time.Duration, client func(conn net.Conn)) (*CygwinHandshake, error) {
+	t.Helper()
+	server, clientConn := net.Pipe()
+	defer server.Close()
+
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		defer clientConn.Close()
+		client(clientConn)
+	}()
+
+	h := NewCygwinHandshake(testCygwinSecret)
+	h.timeout = timeout
+	err := h.Run(server)
+	server.Close()
+	<-clientDone
+	return h, err
+}
+
+func TestCygwinHandshake(t *testing.T) {
+	var echoed [16]byte
+	var reply [12]byte
+	var clientErr error
+	h, err := runCygwinHandshake(t, time.Second, func(conn net.Conn) {
+		if _, clientErr = conn.Write(testCygwinSecret[:]); clientErr != nil {
+			return
+		}
+		if _, clientErr = io.ReadFull(conn, echoed[:]); clientErr != nil {
+			return
+		}
+		if _, clientErr = conn.Write(cygwinCredentialsBlock(1234, 197609, 197121)); clientErr != nil {
+			return
+		}
+		_, clientErr = io.ReadFull(conn, reply[:])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	if echoed != testCygwinSecret {
+		t.Errorf("echoed secret % x", echoed)
+	}
+	if h.Peer != (CygwinCredentials{PID: 1234, UID: 197609, GID: 197121}) {
+		t.Errorf("peer credentials %+v", h.Peer)
+	}
+	pid := uint32(os.Getpid())
+	if !bytes.Equal(reply[:], cygwinCredentialsBlock(pid, 197609, pid)) {
+		t.Errorf("reply credentials % x", reply)
+	}
+}
+
+func TestCygwinHandshakeErrors(t *testing.T) {
+	// credentials sends the secret, reads the echo and sends a credentials block
+	credentials := func(block []byte) func(conn net.Conn) {
+		return func(conn net.Conn) {
+			conn.Write(testCygwinSecret[:])
+			io.ReadFull(conn, make([]byte, 16))
+			conn.Write(block)
+		}
+	}
+
+	badSecret := testCygwinSecret
+	badSecret[15] ^= 0xff
+
+	for _, tc := range []struct {
+		name   string
+		client func(conn net.Conn)
+		err    string
+	}{
+		{
+			name:   "bad secret",
+			client: func(conn net.Conn) { conn.Write(badSecret[:]) },
+			err:    "invalid uuid",
+		},
+		{
+			name:   "no secret",
+			client: func(conn net.Conn) {},
+			err:    "reading secret: EOF",
+		},
+		{
+			name:   "short secret",
+			client: func(conn net.Conn) { conn.Write(testCygwinSecret[:10]) },
+			err:    "reading secret: unexpected EOF",
+		},
+		{
+			name:   "secret not read back",
+			client: func(conn net.Conn) { conn.Write(testCygwinSecret[:]) },
+			err:    "writing secret",
+		},
+		{
+			name:   "short credentials",
+			client: credentials(cygwinCredentialsBlock(1234, 1000, 1000)[:8]),
+			err:    "reading credentials: unexpected EOF",
+		},
+		{
+			name:   "zero pid",
+			client: credentials(cygwinCredentialsBlock(0, 1000, 1000)),
+			err:    "invalid credentials block: invalid pid 0",
+		},
+		{
+			name:   "negative pid",
+			client: credentials(cygwinCredentialsBlock(0xfffffffe, 1000, 1000)),
+			err:    "invalid credentials block: invalid pid",
+		},
+		{
+			name:   "no uid",
+			client: credentials(cygwinCredentialsBlock(1234, 0xffffffff, 1000)),
+			err:    "invalid credentials block: invalid uid",
+		},
+		{
+			name:   "no gid",
+			client: credentials(cygwinCredentialsBlock(1234, 1000, 0xffffffff)),
+			err:    "invalid credentials block: invalid gid",
+		},
+		{
+			name:   "empty credentials block",
+			client: credentials(make([]byte, 12)),
+			err:    "invalid credentials block",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := runCygwinHandshake(t, time.Second, tc.client)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("handshake returned %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCygwinHandshakeTimeout(t *testing.T) {
+	// the clients wait for the server to give up and close its end
+	for _, tc := range []struct {
+		name   string
+		client func(conn net.Conn)
+	}{
+		{"silent client", func(conn net.Conn) {
+			conn.Read(make([]byte, 1))
+		}},
+		{"stalled after the secret", func(conn net.Conn) {
+			conn.Write(testCygwinSecret[:])
+			io.ReadFull(conn, make([]byte, 16))
+			conn.Read(make([]byte, 1))
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			_, err := runCygwinHandshake(t, 50*time.Millisecond, tc.client)
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				t.Fatalf("handshake returned %v, expected a timeout", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("handshake timed out after %s", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package listeners
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxConnections = 32
+	DefaultIdleTimeout    = 300
+	// DefaultRequestTimeout is much shorter than the idle timeout, a client that connects has to send its first request
+	// and one that starts a request has to finish it without holding a connection slot for minutes
+	DefaultRequestTimeout = 10
+	// DefaultMaxMessageSize is well above the largest request a client sends, an SSHSIG request carries a hash
+	// rather than the signed file
+	DefaultMaxMessageSize = 256 * 1024
+)
+
+// evictionWait is how long a new connection waits for the slot of an evicted idle connection
+const evictionWait = time.Second
+
+var (
+	ErrTooManyConnections = errors.New("too many concurrent connections")
+	ErrMessageTooLarge    = errors.New("agent message too large")
+	errEvicted            = errors.New("idle connection evicted")
+)
+
+// ConnLimits bounds the resources a listener's clients can use. Zero values use the defaults, negative values
+// disable the limit.
+type ConnLimits struct {
+	// MaxConnections is the number of connections served at the same time, further connections are closed
+	MaxConnections int `json:"maxConnections,omitempty"`
+	// IdleTimeout is the number of seconds a client may wait between requests
+	IdleTimeout int `json:"idleTimeout,omitempty"`
+	// RequestTimeout is the number of seconds a new client may take to send its first request, and any client to send
+	// the rest of a request once it has started
+	RequestTimeout int `json:"requestTimeout,omitempty"`
+	// MaxMessageSize is the largest request in bytes, excluding the length prefix
+	MaxMessageSize int `json:"maxMessageSize,omitempty"`
+}
+
+func (l ConnLimits) withDefaults() ConnLimits {
+	if l.MaxConnections == 0 {
+		l.MaxConnections = DefaultMaxConnections
+	}
+	if l.IdleTimeout == 0 {
+		l.IdleTimeout = DefaultIdleTimeout
+	}
+	if l.RequestTimeout == 0 {
+		l.RequestTimeout = DefaultRequestTimeout
+	}
+	if l.MaxMessageSize == 0 {
+		l.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return l
+}
+
+// connGuard enforces a listener's ConnLimits. When all slots are taken, the connection that has been idle the longest
+// is evicted to make room, so idle clients can't lock out the ones with requests.
+type connGuard struct {
+	name   string
+	limits ConnLimits
+	slots  chan struct{}
+
+	mu    sync.Mutex
+	conns map[*limitedConn]struct{}
+}
+
+func newConnGuard(name string, limits ConnLimits) *connGuard {
+	g := &connGuard{
+		name:   name,
+		limits: limits.withDefaults(),
+		conns:  make(map[*limitedConn]struct{}),
+	}
+	if g.limits.MaxConnections > 0 {
+		g.slots = make(chan struct{}, g.limits.MaxConnections)
+	}
+	return g
+}
+
+func (g *connGuard) acquire() bool {
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (g *connGuard) release() {
+	if g.slots != nil {
+		<-g.slots
+	}
+}
+
+// acquireEvicting takes a slot, evicting the longest idle connection and waiting for its slot when there is none free
+func (g *connGuard) acquireEvicting() bool {
+	if g.acquire() {
+		return true
+	}
+	if !g.evictIdle() {
+		return false
+	}
+	select {
+	case g.slots <- struct{}{}:
+		return true
+	case <-time.After(evictionWait):
+		return false
+	}
+}
+
+// evictIdle ends the connection that has been waiting for its next request the longest. Its pending read is
+// interrupted by moving the read deadline to now, connections without deadline support can't be evicted.
+func (g *connGuard) evictIdle() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var oldest *limitedConn
+	for c := range g.conns {
+		if c.idleSince.IsZero() || c.evicted || c.deadline == nil {
+			continue
+		}
+		if oldest == nil || c.idleSince.Before(oldest.idleSince) {
+			oldest = c
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	oldest.evicted = true
+	oldest.deadline.SetReadDeadline(time.Now())
+	return true
+}
+
+func (g *connGuard) track(c *limitedConn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.conns[c] = struct{}{}
+}
+
+func (g *connGuard) untrack(c *limitedConn) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.conns, c)
+}
+
+// Serve serves a single connection within the limits. It returns ErrTooManyConnections without reading anything if
+// the listener is at capacity, the caller still owns and closes conn.
+func (g *connGuard) Serve(ctx context.Context, sshagent agent.Agent, conn io.ReadWriter, peer *PeerInfo) error {
+	if !g.Reserve(peer) {
+		return ErrTooManyConnections
+	}
+	defer g.release()
+	return g.ServeReserved(ctx, sshagent, conn, peer)
+}
+
+// Reserve takes a connection slot for a listener that has to talk to the client before serving it, e.g. the Cygwin
+// handshake, so those connections count against MaxConnections too. It returns false when the listener is at
+// capacity. A reserved slot is used with ServeReserved, or given back with Release if the client is never served.
+func (g *connGuard) Reserve(peer *PeerInfo) bool {
+	if !g.acquireEvicting() {
+		log.Printf("%s: rejected connection from %s, %d connections already active", g.name, peer, g.limits.MaxConnections)
+		return false
+	}
+	return true
+}
+
+// Release gives back a slot taken with Reserve
+func (g *connGuard) Release() {
+	g.release()
+}
+
+// ServeReserved serves a connection in a slot taken with Reserve, the caller releases the slot afterwards
+func (g *connGuard) ServeReserved(ctx context.Context, sshagent agent.Agent, conn io.ReadWriter, peer *PeerInfo) error {
+	// connections without deadline support (the Pageant shared memory) hold a single message and can't stall, the
+	// deadline is taken before the tracing wrapper so they don't look evictable when tracing is on
+	deadline, _ := conn.(interface{ SetReadDeadline(time.Time) error })
+
+	var tc *tracingConn
+	if t := activeTracer(); t != nil {
+		// the listener type is recorded when known so a replay sees the same value as the signing policy
+		listener := g.name
+		if peer != nil && peer.Listener != "" {
+			listener = peer.Listener
+		}
+		tc = t.wrap(conn, listener, peer)
+		conn = tc
+	}
+
+	lc := newLimitedConn(conn, deadline, g)
+	g.track(lc)
+	err := ServeAgentConn(ctx, sshagent, lc, peer)
+	g.untrack(lc)
+	if tc != nil {
+		tc.close(err)
+	}
+
+	switch {
+	case errors.Is(err, ErrMessageTooLarge):
+		log.Printf("%s: closed connection from %s after %d requests: %s", g.name, peer, lc.requests, err)
+	case errors.Is(err, errEvicted):
+		log.Printf("%s: evicted idle connection from %s after %d requests to serve a new client", g.name, peer, lc.requests)
+		err = nil
+	case isTimeout(err):
+		switch {
+		case lc.inMessage:
+			log.Printf("%s: closed connection from %s after %d requests: request not completed within %ds", g.name, peer, lc.requests, g.limits.RequestTimeout)
+		case lc.requests == 0:
+			log.Printf("%s: closed connection from %s: no request within %ds", g.name, peer, g.limits.RequestTimeout)
+		default:
+			log.Printf("%s: closed idle connection from %s after %d requests", g.name, peer, lc.requests)
+		}
+		err = nil
+	default:
+		log.Printf("%s: connection from %s served %d requests", g.name, peer, lc.requests)
+	}
+	return err
+}
+
+func isTimeout(err error) bool {
+	var te interface{ Timeout() bool }
+	return errors.As(err, &te) && te.Timeout()
+}
+
+// limitedConn follows the agent framing of the stream it wraps, so it can count requests and reject oversized ones
+// before the agent allocates a buffer for them
+type limitedConn struct {
+	conn      io.ReadWriter
+	deadline  interface{ SetReadDeadline(time.Time) error }
+	guard     *connGuard
+	limits    ConnLimits
+	requests  int
+	header    [4]byte
+	pending   []byte // header bytes not yet returned to the reader
+	remaining uint32 // body bytes of the current message not yet read
+	inMessage bool
+	// idleSince is when the connection started waiting for its next request, zero while a request is read or served.
+	// It is guarded by the guard's mutex, like evicted.
+	idleSince time.Time
+	evicted   bool
+}
+
+// newLimitedConn wraps conn, deadline sets the read deadline of the underlying connection and is nil for
+// connections without deadline support
+func newLimitedConn(conn io.ReadWriter, deadline interface{ SetReadDeadline(time.Time) error }, guard *connGuard) *limitedConn {
+	return &limitedConn{conn: conn, deadline: deadline, guard: guard, limits: guard.limits}
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 && c.remaining == 0 {
+		if err := c.readHeader(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	if uint32(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.conn.Read(p)
+	c.remaining -= uint32(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader waits for the next request, up to IdleTimeout between requests or RequestTimeout for the first one.
+// Once its first byte has arrived the rest of the request has to follow within RequestTimeout. A connection that ends
+// cleanly between requests returns io.EOF, one that ends within the header io.ErrUnexpectedEOF.
+func (c *limitedConn) readHeader() error {
+	c.inMessage = false
+	timeout := c.limits.IdleTimeout
+	if c.requests == 0 {
+		timeout = c.limits.RequestTimeout
+	}
+	if !c.setIdle(true, timeout) {
+		return errEvicted
+	}
+
+	_, err := io.ReadFull(c.conn, c.header[:1])
+	// the rest of the header and the whole body have to arrive within one timeout, not one timeout per read
+	if !c.setIdle(false, c.limits.RequestTimeout) {
+		return errEvicted
+	}
+	if err != nil {
+		return err
+	}
+
+	c.inMessage = true
+	if _, err = io.ReadFull(c.conn, c.header[1:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("truncated request header: %w", err)
+	}
+
+	length := binary.BigEndian.Uint32(c.header[:])
+	if c.limits.MaxMessageSize > 0 && uint64(length) > uint64(c.limits.MaxMessageSize) {
+		return fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooLarge, length, c.limits.MaxMessageSize)
+	}
+
+	c.requests++
+	c.pending = c.header[:]
+	c.remaining = length
+	return nil
+}
+
+// setIdle marks the connection as waiting for a request or not and sets the read deadline. Both happen under the
+// guard's mutex so an eviction's deadline isn't overwritten, it returns false once the connection was evicted.
+func (c *limitedConn) setIdle(idle bool, timeout int) bool {
+	c.guard.mu.Lock()
+	defer c.guard.mu.Unlock()
+	if c.evicted {
+		return false
+	}
+	c.idleSince = time.Time{}
+	if idle {
+		c.idleSince = time.Now()
+	}
+	c.setDeadline(timeout)
+	return true
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	return c.conn.Write(p)
+}
+
+// setDeadline gives the client timeout seconds for the next read, a timeout of 0 or less disables it
+func (c *limitedConn) setDeadline(timeout int) {
+	if c.deadline == nil {
+		return
+	}
+	if timeout <= 0 {
+		c.deadline.SetReadDeadline(time.Time{})
+		return
+	}
+	c.deadline.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+}
@@ -0,0 +1,317 @@
+package listeners
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveGuarded serves the server end of a net.Pipe with the guard and returns the client end and the result of Serve
+func serveGuarded(g *connGuard) (net.Conn, <-chan error) {
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		done <- g.Serve(context.Background(), agent.NewKeyring(), server, &PeerInfo{Listener: "TEST"})
+	}()
+	return client, done
+}
+
+// waitServe returns the result of Serve, failing the test if it takes longer than within
+func waitServe(t *testing.T, done <-chan error, within time.Duration) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(within):
+		t.Fatalf("connection still served after %s", within)
+		return nil
+	}
+}
+
+// listKeys sends a request identities request and reads the response
+func listKeys(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	_, err := agent.NewClient(conn).List()
+	return err
+}
+
+func TestLimitsOversizedFrame(t *testing.T) {
+	g := newConnGuard("test", ConnLimits{MaxMessageSize: 1024})
+	client, done := serveGuarded(g)
+	defer client.Close()
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], 1025)
+	if _, err := client.Write(header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitServe(t, done, 5*time.Second); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("Serve returned %v, expected ErrMessageTooLarge", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("oversized request answered: %v", err)
+	}
+}
+
+func TestLimitsMaxMessageSize(t *testing.T) {
+	// a request of exactly the maximum size is read, the agent answers it with a failure
+	g := newConnGuard("test", ConnLimits{MaxMessageSize: 1024})
+	client, done := serveGuarded(g)
+
+	msg := make([]byte, 4+1024)
+	binary.BigEndian.PutUint32(msg, 1024)
+	msg[4] = 0xf0
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	var reply [5]byte
+	if _, err := io.ReadFull(client, reply[:]); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	if err := waitServe(t, done, 5*time.Second); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestLimitsTruncated(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sent []byte
+	}{
+		{"header", []byte{0, 0}},
+		{"body", []byte{0, 0, 0, 10, 11, 0}},
+		{"empty body", []byte{0, 0, 0, 10}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newConnGuard("test", ConnLimits{})
+			client, done := serveGuarded(g)
+			if _, err := client.Write(tc.sent); err != nil {
+				t.Fatal(err)
+			}
+			client.Close()
+			if err := waitServe(t, done, 5*time.Second); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("Serve returned %v, expected io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+
+	t.Run("between requests", func(t *testing.T) {
+		g := newConnGuard("test", ConnLimits{})
+		client, done := serveGuarded(g)
+		if err := listKeys(client); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		if err := waitServe(t, done, 5*time.Second); err != nil && err != io.EOF {
+			t.Fatalf("clean close returned %v", err)
+		}
+	})
+}
+
+func TestLimitsSlowLoris(t *testing.T) {
+	limits := ConnLimits{IdleTimeout: 300, RequestTimeout: 1}
+
+	for _, tc := range []struct {
+		name string
+		// send writes to the connection until it fails
+		send func(conn net.Conn)
+	}{
+		{"silent client", func(conn net.Conn) {}},
+		{"partial header", func(conn net.Conn) {
+			conn.Write([]byte{0, 0})
+		}},
+		{"dripped header", func(conn net.Conn) {
+			for _, b := range []byte{0, 0, 0, 1} {
+				if _, err := conn.Write([]byte{b}); err != nil {
+					return
+				}
+				time.Sleep(400 * time.Millisecond)
+			}
+		}},
+		{"dripped body", func(conn net.Conn) {
+			if _, err := conn.Write([]byte{0, 0, 0, 100}); err != nil {
+				return
+			}
+			for i := 0; i < 100; i++ {
+				if _, err := conn.Write([]byte{11}); err != nil {
+					return
+				}
+				time.Sleep(200 * time.Millisecond)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := newConnGuard("test", limits)
+			client, done := serveGuarded(g)
+			defer client.Close()
+			go tc.send(client)
+
+			start := time.Now()
+			if err := waitServe(t, done, 5*time.Second); err != nil {
+				t.Fatalf("Serve returned %v for a timed out client", err)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Fatalf("slow client held the connection for %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestLimitsIdleBetweenRequests(t *testing.T) {
+	// the short request timeout doesn't apply while a client is idle between requests
+	g := newConnGuard("test", ConnLimits{IdleTimeout: 300, RequestTimeout: 1})
+	client, done := serveGuarded(g)
+	defer client.Close()
+
+	if err := listKeys(client); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if err := listKeys(client); err != nil {
+		t.Fatalf("request after idling: %s", err)
+	}
+	client.Close()
+	waitServe(t, done, 5*time.Second)
+}
+
+func TestLimitsEvictIdle(t *testing.T) {
+	g := newConnGuard("test", ConnLimits{MaxConnections: 2})
+
+	// two clients take the slots, each sends a request and stays connected
+	var clients []net.Conn
+	var dones []<-chan error
+	for i := 0; i < 2; i++ {
+		client, done := serveGuarded(g)
+		defer client.Close()
+		if err := listKeys(client); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		dones = append(dones, done)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a third client evicts the client that has been idle the longest
+	third, thirdDone := serveGuarded(g)
+	defer third.Close()
+	if err := listKeys(third); err != nil {
+		t.Fatalf("new client not served at capacity: %s", err)
+	}
+	if err := waitServe(t, dones[0], 5*time.Second); err != nil {
+		t.Fatalf("evicted connection returned %v", err)
+	}
+	if err := listKeys(clients[1]); err != nil {
+		t.Fatalf("second client evicted: %s", err)
+	}
+	if err := listKeys(clients[0]); err == nil {
+		t.Fatal("evicted client still served")
+	}
+
+	third.Close()
+	waitServe(t, thirdDone, 5*time.Second)
+}
+
+func TestLimitsRejectBusy(t *testing.T) {
+	// clients in the middle of a request are not evicted, a new client is rejected instead
+	g := newConnGuard("test", ConnLimits{MaxConnections: 2})
+	for i := 0; i < 2; i++ {
+		client, _ := serveGuarded(g)
+		defer client.Close()
+		if _, err := client.Write([]byte{0, 0, 0, 10, 11}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, done := serveGuarded(g)
+	defer client.Close()
+	if err := waitServe(t, done, 5*time.Second); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("Serve returned %v, expected ErrTooManyConnections", err)
+	}
+}
+
+func TestLimitsReserve(t *testing.T) {
+	// a slot reserved for a handshake counts against MaxConnections and can't be evicted
+	g := newConnGuard("test", ConnLimits{MaxConnections: 1})
+	if !g.Reserve(&PeerInfo{Listener: "TEST"}) {
+		t.Fatal("no slot reserved")
+	}
+
+	client, done := serveGuarded(g)
+	defer client.Close()
+	if err := waitServe(t, done, 5*time.Second); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("Serve returned %v with the slot reserved, expected ErrTooManyConnections", err)
+	}
+
+	// once released the slot serves the next client
+	g.Release()
+	client, done = serveGuarded(g)
+	defer client.Close()
+	if err := listKeys(client); err != nil {
+		t.Fatalf("client not served after Release: %s", err)
+	}
+	client.Close()
+	waitServe(t, done, 5*time.Second)
+}
+
+func TestLimitsTracingKeepsDeadlines(t *testing.T) {
+	tracer, err := NewTracer(filepath.Join(t.TempDir(), "trace.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetTracer(tracer)
+	defer func() {
+		SetTracer(nil)
+		tracer.Close()
+	}()
+
+	g := newConnGuard("test", ConnLimits{MaxConnections: 1})
+
+	// a connection without deadline support, like the Pageant shared memory, stays unevictable when traced
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		done <- g.Serve(context.Background(), agent.NewKeyring(), struct{ io.ReadWriter }{server}, &PeerInfo{Listener: "TEST"})
+	}()
+	if err := listKeys(client); err != nil {
+		t.Fatal(err)
+	}
+
+	other, otherDone := serveGuarded(g)
+	defer other.Close()
+	if err := waitServe(t, otherDone, 5*time.Second); !errors.Is(err, ErrTooManyConnections) {
+		t.Fatalf("Serve returned %v, expected ErrTooManyConnections instead of evicting", err)
+	}
+
+	// a traced connection with deadline support is still evicted
+	client.Close()
+	waitServe(t, done, 5*time.Second)
+	idle, idleDone := serveGuarded(g)
+	defer idle.Close()
+	if err := listKeys(idle); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	next, nextDone := serveGuarded(g)
+	defer next.Close()
+	if err := listKeys(next); err != nil {
+		t.Fatalf("traced idle connection not evicted: %s", err)
+	}
+	if err := waitServe(t, idleDone, 5*time.Second); err != nil {
+		t.Fatalf("evicted connection returned %v", err)
+	}
+	next.Close()
+	waitServe(t, nextDone, 5*time.Second)
+}
@@ -3,6 +3,23 @@ package listeners
 import (
 	"context"
 	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"sync"
+)
+
+// Listener types, the Windows listeners are only available on Windows and the Unix socket listener everywhere else
+const (
+	TYPE_CYGWIN     = "CYGWIN"
+	TYPE_NAMED_PIPE = "NAMED_PIPE"
+	TYPE_PAGEANT    = "PAGEANT"
+	TYPE_UNIX       = "UNIX"
+)
+
+const (
+	CYGWIN_SOCK = "cygwin-agent.sock"
+	NAMED_PIPE  = "\\\\.\\pipe\\openssh-ssh-agent"
+	// MACHINE_NAMED_PIPE is the default pipe of the listener serving machine scope keys to other accounts
+	MACHINE_NAMED_PIPE = "\\\\.\\pipe\\ncryptagent-machine"
 )
 
 const (
@@ -28,3 +45,42 @@ type ListenerError struct {
 
 func (e *ListenerError) Error() string { return e.msg }
 func (e *ListenerError) Code() int     { return e.code }
+
+// connSet holds the open connections of a listener so they can be closed when it shuts down. An idle client would
+// otherwise keep its connection, and the listener's Run, until the idle timeout, or forever without one.
+type connSet struct {
+	mu     sync.Mutex
+	conns  map[io.Closer]struct{}
+	closed bool
+}
+
+// add tracks a connection, it returns false once the set was closed and the caller has to close conn itself
+func (s *connSet) add(conn io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[io.Closer]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *connSet) remove(conn io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeAll closes the tracked connections and every connection added later
+func (s *connSet) closeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
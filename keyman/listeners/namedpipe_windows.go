@@ -0,0 +1,125 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+type NamedPipe struct {
+	// Path is the pipe to listen on, empty for NAMED_PIPE
+	Path string
+	// Limits bounds client connections, the zero value uses the defaults
+	Limits ConnLimits
+	// SecurityDescriptor is the SDDL of the pipe, see PipeSecurityDescriptor. Empty leaves the default of go-winio.
+	SecurityDescriptor string
+
+	mu        sync.Mutex
+	running   bool
+	pipe      net.Listener
+	lastError error
+}
+
+func (s *NamedPipe) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+func (s *NamedPipe) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError
+}
+
+func (s *NamedPipe) Name() string {
+	if s.Path != "" && s.Path != NAMED_PIPE {
+		return "Named Pipe " + s.Path
+	}
+	return "Named Pipe"
+}
+
+func (s *NamedPipe) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pipe == nil {
+		return nil
+	}
+	return s.pipe.Close()
+}
+
+func (s *NamedPipe) setState(running bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+	s.lastError = err
+}
+
+func (s *NamedPipe) Run(ctx context.Context, sshagent agent.Agent) error {
+	var cfg = &winio.PipeConfig{SecurityDescriptor: s.SecurityDescriptor}
+	path := s.Path
+	if path == "" {
+		path = NAMED_PIPE
+	}
+	pipe, err := winio.ListenPipe(path, cfg)
+	if err != nil {
+		s.setState(false, err)
+		return err
+	}
+
+	s.mu.Lock()
+	s.pipe = pipe
+	s.mu.Unlock()
+
+	s.setState(true, nil)
+	defer pipe.Close()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	guard := newConnGuard(s.Name(), s.Limits)
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+	// clients waiting for their next request are cut off when the listener shuts down, before waiting for them
+	conns := new(connSet)
+	defer conns.closeAll()
+	// context cancelled
+	go func() {
+		<-ctx.Done()
+		pipe.Close()
+	}()
+	// loop
+	for {
+		conn, err := pipe.Accept()
+		if err != nil {
+			if err != winio.ErrPipeListenerClosed && ctx.Err() == nil {
+				s.setState(false, err)
+				return err
+			}
+			return nil
+		}
+		if !conns.add(conn) {
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			defer conns.remove(conn)
+			// errors of a single client connection are logged, they don't make the listener fail
+			peer := NewProcessPeer(TYPE_NAMED_PIPE, namedPipeClientPID(conn))
+			err := guard.Serve(ctx, sshagent, conn, peer)
+			if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) && err != winio.ErrFileClosed {
+				log.Println(err.Error())
+			}
+		}()
+	}
+}
@@ -1,3 +1,5 @@
+//go:build windows
+
 package pageant
 
 import (
@@ -23,6 +25,11 @@ type memoryMapConn struct {
 	sync.Mutex
 }
 
+// ClientPID returns the process id of the client that sent the request, or zero if it is unknown
+func (m *memoryMapConn) ClientPID() uint32 {
+	return m.req.pid
+}
+
 func (m *memoryMapConn) Read(p []byte) (n int, err error) {
 	m.Lock()
 	defer m.Unlock()
@@ -1,8 +1,11 @@
+//go:build windows
+
 package pageant
 
 import (
 	"context"
 	"encoding/binary"
+	"fmt"
 	"golang.org/x/sys/windows"
 	"io"
 	"log"
@@ -22,6 +25,8 @@ var (
 	pDispatchMessage  = u32.NewProc("DispatchMessageW")
 	pTranslateMessage = u32.NewProc("TranslateMessage")
 	pGetMessage       = u32.NewProc("GetMessageW")
+
+	pGetProcessIdOfThread = k32.NewProc("GetProcessIdOfThread")
 )
 
 const (
@@ -34,6 +39,7 @@ const (
 
 type request struct {
 	data     []byte
+	pid      uint32
 	response chan response
 }
 
@@ -171,12 +177,12 @@ func (s *PageantWindow) wndProc(hWnd windows.Handle, message uint32, wParam, lPa
 		}
 		return 0
 	}
+	h := [3]uintptr{copyData.lpData, uintptr(copyData.cbData), uintptr(copyData.cbData)}
+	mapName := *(*[]byte)(unsafe.Pointer(&h))
+	if len(mapName) > 0 && mapName[len(mapName)-1] == 0 {
+		mapName = mapName[:len(mapName)-1]
+	}
 	if s.debug {
-		h := [3]uintptr{copyData.lpData, uintptr(copyData.cbData), uintptr(copyData.cbData)}
-		mapName := *(*[]byte)(unsafe.Pointer(&h))
-		if mapName[len(mapName)-1] == 0 {
-			mapName = mapName[:len(mapName)-1]
-		}
 		log.Println("Pageant: OpenFileMapping", copyData.lpData, copyData.cbData, string(mapName))
 	}
 	fileMap, err := OpenFileMapping(fileMapAllAccess, 0, copyData.lpData)
@@ -230,7 +236,7 @@ func (s *PageantWindow) wndProc(hWnd windows.Handle, message uint32, wParam, lPa
 	data := make([]byte, size)
 	copy(data, sharedMemoryArray[:size])
 	ch := make(chan response)
-	s.requestCh <- request{data, ch}
+	s.requestCh <- request{data, clientPIDFromMapName(string(mapName)), ch}
 	// wait for response
 	resp := <-ch
 	if resp.err == nil {
@@ -239,3 +245,23 @@ func (s *PageantWindow) wndProc(hWnd windows.Handle, message uint32, wParam, lPa
 	}
 	return
 }
+
+// clientPIDFromMapName works out the sending process from the file mapping name. PuTTY and most clients derived from
+// it name the mapping PageantRequest%08x after the calling thread id, which is resolved to its owning process. Zero
+// is returned for clients using any other naming scheme. The client picks the name, so the process is only a claim
+// of the client, see listeners.PeerInfo.Unverified.
+func clientPIDFromMapName(mapName string) uint32 {
+	var threadId uint32
+	if _, err := fmt.Sscanf(mapName, "PageantRequest%08x", &threadId); err != nil || threadId == 0 {
+		return 0
+	}
+
+	thread, err := windows.OpenThread(windows.THREAD_QUERY_LIMITED_INFORMATION, false, threadId)
+	if err != nil {
+		return 0
+	}
+	defer windows.CloseHandle(thread)
+
+	pid, _, _ := pGetProcessIdOfThread.Call(uintptr(thread))
+	return uint32(pid)
+}
@@ -10,9 +10,10 @@ import (
 	"sync"
 )
 
-const TYPE_PAGEANT = "PAGEANT"
-
 type Pageant struct {
+	// Limits bounds client connections, the zero value uses the defaults
+	Limits ConnLimits
+
 	running   bool
 	win       *pageant.PageantWindow
 	lastError error
@@ -49,6 +50,7 @@ func (p *Pageant) Run(ctx context.Context, sshagent agent.Agent) error {
 	defer func() { p.running = false }()
 	defer p.win.Close()
 
+	guard := newConnGuard(p.Name(), p.Limits)
 	wg := new(sync.WaitGroup)
 	for {
 		conn, err := p.win.AcceptCtx(ctx)
@@ -63,7 +65,14 @@ func (p *Pageant) Run(ctx context.Context, sshagent agent.Agent) error {
 		go func() {
 			log.Println("Handling agent connection")
 			defer conn.Close()
-			err := agent.ServeAgent(sshagent, conn)
+			var pid uint32
+			if c, ok := conn.(interface{ ClientPID() uint32 }); ok {
+				pid = c.ClientPID()
+			}
+			// the pid is taken from the mapping name the client chose, it can't be relied on
+			peer := NewProcessPeer(TYPE_PAGEANT, pid)
+			peer.Unverified = true
+			err := guard.Serve(ctx, sshagent, conn, peer)
 			if err != nil && err != io.EOF {
 				log.Println(err.Error())
 			}
@@ -0,0 +1,125 @@
+package listeners
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"strings"
+)
+
+// maxParentDepth limits how far up the process tree the parent chain is resolved
+const maxParentDepth = 8
+
+// ProcessInfo describes a single process in a peer's process chain
+type ProcessInfo struct {
+	PID       uint32
+	ImagePath string
+}
+
+// ImageName returns the executable name without its directory, e.g. ssh.exe
+func (p ProcessInfo) ImageName() string {
+	if p.ImagePath == "" {
+		return fmt.Sprintf("pid %d", p.PID)
+	}
+	return p.ImagePath[strings.LastIndexAny(p.ImagePath, `\/`)+1:]
+}
+
+// PeerInfo identifies the client on the other end of an agent connection, as far as the listener can tell
+type PeerInfo struct {
+	// Listener is the listener type the connection arrived on, e.g. TYPE_NAMED_PIPE
+	Listener string
+	// Process is the client process, nil if it could not be determined
+	Process *ProcessInfo
+	// Parents is the parent process chain of Process, immediate parent first
+	Parents []ProcessInfo
+	// Detail holds whatever else is known when there is no local process, e.g. a VM ID or Cygwin pid
+	Detail string
+	// Unverified is set when the client named its process itself rather than the system vouching for it, like the
+	// file mapping name of a Pageant request. Any local process can claim to be another, so Process and Parents are
+	// only for display and logs, policy rules on processes never match them.
+	Unverified bool
+}
+
+// Chain returns the process chain as "ssh.exe <- git.exe <- explorer.exe"
+func (p *PeerInfo) Chain() string {
+	if p == nil || p.Process == nil {
+		return ""
+	}
+
+	names := []string{p.Process.ImageName()}
+	for _, parent := range p.Parents {
+		names = append(names, parent.ImageName())
+	}
+	return strings.Join(names, " <- ")
+}
+
+func (p *PeerInfo) String() string {
+	if p == nil {
+		return "unknown client"
+	}
+
+	var parts []string
+	if p.Process != nil {
+		if p.Unverified {
+			parts = append(parts, fmt.Sprintf("%s (pid %d, unverified)", p.Chain(), p.Process.PID))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s (pid %d)", p.Chain(), p.Process.PID))
+		}
+	}
+	if p.Detail != "" {
+		parts = append(parts, p.Detail)
+	}
+	if len(parts) == 0 {
+		return "unknown client"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// NewProcessPeer builds a PeerInfo for a local client process, resolving its image path and parent chain
+func NewProcessPeer(listener string, pid uint32) *PeerInfo {
+	peer := &PeerInfo{Listener: listener}
+	if pid == 0 {
+		return peer
+	}
+
+	chain := resolveProcessChain(pid, maxParentDepth)
+	if len(chain) == 0 {
+		peer.Process = &ProcessInfo{PID: pid}
+		return peer
+	}
+
+	peer.Process = &chain[0]
+	peer.Parents = chain[1:]
+	return peer
+}
+
+type peerContextKey struct{}
+
+// WithPeer returns a copy of ctx carrying the peer identity
+func WithPeer(ctx context.Context, peer *PeerInfo) context.Context {
+	return context.WithValue(ctx, peerContextKey{}, peer)
+}
+
+// PeerFromContext returns the peer identity attached to ctx, or nil
+func PeerFromContext(ctx context.Context) *PeerInfo {
+	if ctx == nil {
+		return nil
+	}
+	peer, _ := ctx.Value(peerContextKey{}).(*PeerInfo)
+	return peer
+}
+
+// ContextAgent is implemented by agents that want to know which client they are serving. WithContext returns an
+// agent bound to a single connection.
+type ContextAgent interface {
+	WithContext(ctx context.Context) agent.Agent
+}
+
+// ServeAgentConn serves agent requests on conn, binding the agent to the peer identity first if it supports it
+func ServeAgentConn(ctx context.Context, sshagent agent.Agent, conn io.ReadWriter, peer *PeerInfo) error {
+	if ca, ok := sshagent.(ContextAgent); ok {
+		sshagent = ca.WithContext(WithPeer(ctx, peer))
+	}
+	return agent.ServeAgent(sshagent, conn)
+}
@@ -0,0 +1,84 @@
+package listeners
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// procRoot is where the process information is read from, a directory laid out like /proc in the tests
+var procRoot = "/proc"
+
+// procPath returns the path of a file in the /proc directory of pid
+func procPath(pid uint32, name string) string {
+	return filepath.Join(procRoot, strconv.FormatUint(uint64(pid), 10), name)
+}
+
+// resolveProcessChain returns pid followed by its parents from /proc, stopping at maxDepth or init
+func resolveProcessChain(pid uint32, maxDepth int) []ProcessInfo {
+	chain := make([]ProcessInfo, 0, maxDepth+1)
+	seen := make(map[uint32]bool)
+	for len(chain) <= maxDepth && pid != 0 && !seen[pid] {
+		seen[pid] = true
+		ppid, ok := procParent(pid)
+		if !ok && len(chain) > 0 {
+			break
+		}
+		path, _ := os.Readlink(procPath(pid, "exe"))
+		chain = append(chain, ProcessInfo{PID: pid, ImagePath: path})
+		pid = ppid
+	}
+	return chain
+}
+
+// procParent reads the parent pid from /proc/<pid>/stat. The command name may contain spaces or parentheses, so
+// the fields are taken from after the last closing parenthesis.
+func procParent(pid uint32) (uint32, bool) {
+	stat, err := os.ReadFile(procPath(pid, "stat"))
+	if err != nil {
+		return 0, false
+	}
+	return parseStatParent(string(stat))
+}
+
+// parseStatParent returns the parent pid, the fourth field, of the contents of a /proc/<pid>/stat file
+func parseStatParent(s string) (uint32, bool) {
+	end := strings.LastIndexByte(s, ')')
+	if end < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 2 {
+		return 0, false
+	}
+	ppid, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(ppid), true
+}
+
+// unixPeerPID returns the pid of the process on the other end of a unix socket using SO_PEERCRED
+func unixPeerPID(conn net.Conn) uint32 {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0
+	}
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return 0
+	}
+
+	var cred *unix.Ucred
+	rc.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return 0
+	}
+	return uint32(cred.Pid)
+}
@@ -0,0 +1,183 @@
+package listeners
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseStatParent(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stat string
+		ppid uint32
+		ok   bool
+	}{
+		{name: "plain", stat: "1234 (ssh) S 42 1234 1234 0 -1 4194560", ppid: 42, ok: true},
+		{name: "comm with spaces", stat: "1234 (tmux: server) S 7 1234 1234 0 -1", ppid: 7, ok: true},
+		{name: "comm with parentheses", stat: "1234 (a) S 99 (b)) R 13 1234 1234 0 -1", ppid: 13, ok: true},
+		{name: "comm of a closing parenthesis", stat: "1234 ()) S 5 1234", ppid: 5, ok: true},
+		{name: "newline", stat: "1234 (ssh) S 42 1234\n", ppid: 42, ok: true},
+		{name: "no comm", stat: "1234 ssh S 42 1234"},
+		{name: "truncated", stat: "1234 (ssh) S"},
+		{name: "empty", stat: ""},
+		{name: "non numeric parent", stat: "1234 (ssh) S x 1234"},
+		{name: "parent out of range", stat: "1234 (ssh) S 4294967296 1234"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ppid, ok := parseStatParent(tc.stat)
+			if ppid != tc.ppid || ok != tc.ok {
+				t.Errorf("got %d, %t, expected %d, %t", ppid, ok, tc.ppid, tc.ok)
+			}
+		})
+	}
+}
+
+// fakeProc lays out a /proc directory with a stat file and exe link for each process, parents maps a pid to its
+// parent
+func fakeProc(t *testing.T, parents map[uint32]uint32, comm map[uint32]string) {
+	t.Helper()
+	root := t.TempDir()
+	for pid, ppid := range parents {
+		dir := filepath.Join(root, fmt.Sprint(pid))
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		name := comm[pid]
+		if name == "" {
+			name = fmt.Sprintf("proc%d", pid)
+		}
+		stat := fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560\n", pid, name, ppid, pid, pid)
+		if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(fmt.Sprintf("/usr/bin/proc%d", pid), filepath.Join(dir, "exe")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := procRoot
+	procRoot = root
+	t.Cleanup(func() { procRoot = old })
+}
+
+func TestResolveProcessChain(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		parents  map[uint32]uint32
+		comm     map[uint32]string
+		pid      uint32
+		maxDepth int
+		chain    []uint32
+	}{
+		{
+			name:     "up to init",
+			parents:  map[uint32]uint32{100: 50, 50: 1, 1: 0},
+			pid:      100,
+			maxDepth: 8,
+			chain:    []uint32{100, 50, 1},
+		},
+		{
+			name:     "comm with spaces and parentheses",
+			parents:  map[uint32]uint32{100: 50, 50: 1, 1: 0},
+			comm:     map[uint32]string{100: "ssh (1) S 7", 50: "tmux: server)"},
+			pid:      100,
+			maxDepth: 8,
+			chain:    []uint32{100, 50, 1},
+		},
+		{
+			name:     "depth limit",
+			parents:  map[uint32]uint32{100: 50, 50: 40, 40: 30, 30: 1, 1: 0},
+			pid:      100,
+			maxDepth: 2,
+			chain:    []uint32{100, 50, 40},
+		},
+		{
+			// a parent that exited is left out, its pid may already belong to another process
+			name:     "vanished parent",
+			parents:  map[uint32]uint32{100: 50},
+			pid:      100,
+			maxDepth: 8,
+			chain:    []uint32{100},
+		},
+		{
+			name:     "parent loop",
+			parents:  map[uint32]uint32{100: 50, 50: 100},
+			pid:      100,
+			maxDepth: 8,
+			chain:    []uint32{100, 50},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeProc(t, tc.parents, tc.comm)
+			var pids []uint32
+			for _, p := range resolveProcessChain(tc.pid, tc.maxDepth) {
+				pids = append(pids, p.PID)
+				if _, known := tc.parents[p.PID]; known && p.ImagePath != fmt.Sprintf("/usr/bin/proc%d", p.PID) {
+					t.Errorf("pid %d has image %q", p.PID, p.ImagePath)
+				}
+			}
+			if !reflect.DeepEqual(pids, tc.chain) {
+				t.Errorf("chain %v, expected %v", pids, tc.chain)
+			}
+		})
+	}
+}
+
+func TestNewProcessPeerVanished(t *testing.T) {
+	fakeProc(t, map[uint32]uint32{}, nil)
+
+	peer := NewProcessPeer(TYPE_UNIX, 4242)
+	if peer.Process == nil || peer.Process.PID != 4242 || peer.Process.ImagePath != "" || len(peer.Parents) != 0 {
+		t.Fatalf("peer of a vanished process %+v", peer)
+	}
+	if s := peer.String(); s != "pid 4242 (pid 4242)" {
+		t.Errorf("peer of a vanished process shown as %q", s)
+	}
+
+	if peer = NewProcessPeer(TYPE_UNIX, 0); peer.Process != nil || peer.String() != "unknown client" {
+		t.Errorf("peer without pid %+v", peer)
+	}
+}
+
+func TestUnixPeerPID(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("socketpair-%d", i))
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	if pid := unixPeerPID(conns[0]); pid != uint32(os.Getpid()) {
+		t.Errorf("peer pid %d, expected %d", pid, os.Getpid())
+	}
+
+	peer := NewProcessPeer(TYPE_UNIX, unixPeerPID(conns[1]))
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peer.Process == nil || peer.Process.ImagePath != exe || len(peer.Parents) == 0 {
+		t.Errorf("peer %+v, expected the test binary %s with its parents", peer, exe)
+	}
+
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+	if pid := unixPeerPID(pipe); pid != 0 {
+		t.Errorf("pid %d for a connection that isn't a unix socket", pid)
+	}
+}
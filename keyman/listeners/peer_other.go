@@ -0,0 +1,13 @@
+//go:build !windows && !linux
+
+package listeners
+
+import "net"
+
+func resolveProcessChain(pid uint32, maxDepth int) []ProcessInfo {
+	return nil
+}
+
+func unixPeerPID(conn net.Conn) uint32 {
+	return 0
+}
@@ -0,0 +1,91 @@
+package listeners
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestPeerInfoString(t *testing.T) {
+	process := &ProcessInfo{PID: 300, ImagePath: `C:\Windows\System32\OpenSSH\ssh.exe`}
+	parents := []ProcessInfo{{PID: 200, ImagePath: "/usr/bin/git"}, {PID: 100}}
+	for _, tc := range []struct {
+		name  string
+		peer  *PeerInfo
+		chain string
+		str   string
+	}{
+		{name: "nil", peer: nil, chain: "", str: "unknown client"},
+		{name: "empty", peer: &PeerInfo{Listener: TYPE_UNIX}, chain: "", str: "unknown client"},
+		{name: "detail only", peer: &PeerInfo{Detail: "VM 1234"}, chain: "", str: "VM 1234"},
+		{name: "process", peer: &PeerInfo{Process: process}, chain: "ssh.exe", str: "ssh.exe (pid 300)"},
+		{
+			name:  "parents",
+			peer:  &PeerInfo{Process: process, Parents: parents},
+			chain: "ssh.exe <- git <- pid 100",
+			str:   "ssh.exe <- git <- pid 100 (pid 300)",
+		},
+		{
+			name:  "unverified with detail",
+			peer:  &PeerInfo{Process: process, Detail: "cygwin pid 7", Unverified: true},
+			chain: "ssh.exe",
+			str:   "ssh.exe (pid 300, unverified), cygwin pid 7",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if chain := tc.peer.Chain(); chain != tc.chain {
+				t.Errorf("chain %q, expected %q", chain, tc.chain)
+			}
+			if str := tc.peer.String(); str != tc.str {
+				t.Errorf("string %q, expected %q", str, tc.str)
+			}
+		})
+	}
+}
+
+// peerRecordingAgent is a keyring that records the peer of the context it is bound to
+type peerRecordingAgent struct {
+	agent.Agent
+	bound chan *PeerInfo
+}
+
+func (a *peerRecordingAgent) WithContext(ctx context.Context) agent.Agent {
+	a.bound <- PeerFromContext(ctx)
+	return a.Agent
+}
+
+func TestServeAgentConnPeer(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		peer *PeerInfo
+	}{
+		{name: "nil peer", peer: nil},
+		{name: "process peer", peer: &PeerInfo{Listener: TYPE_UNIX, Process: &ProcessInfo{PID: 42}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &peerRecordingAgent{Agent: agent.NewKeyring(), bound: make(chan *PeerInfo, 1)}
+			server, client := net.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				done <- ServeAgentConn(context.Background(), a, server, tc.peer)
+				server.Close()
+			}()
+
+			keys, err := agent.NewClient(client).List()
+			client.Close()
+			if err != nil || len(keys) != 0 {
+				t.Fatalf("listed %d keys: %v", len(keys), err)
+			}
+			<-done
+			if bound := <-a.bound; bound != tc.peer {
+				t.Errorf("agent bound to peer %v, expected %v", bound, tc.peer)
+			}
+		})
+	}
+
+	if PeerFromContext(nil) != nil || PeerFromContext(context.Background()) != nil {
+		t.Error("peer found in a context without one")
+	}
+}
@@ -0,0 +1,140 @@
+package listeners
+
+import (
+	"encoding/binary"
+	"golang.org/x/sys/windows"
+	"net"
+	"unsafe"
+)
+
+var (
+	k32                             = windows.NewLazySystemDLL("kernel32.dll")
+	iphlpapi                        = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetNamedPipeClientProcessId = k32.NewProc("GetNamedPipeClientProcessId")
+	procGetExtendedTcpTable         = iphlpapi.NewProc("GetExtendedTcpTable")
+)
+
+const (
+	tcpTableOwnerPidAll = 5 // TCP_TABLE_OWNER_PID_ALL
+	afInet              = 2 // AF_INET
+)
+
+// mibTcpRowOwnerPid is MIB_TCPROW_OWNER_PID, ports are in network byte order in the low 16 bits
+type mibTcpRowOwnerPid struct {
+	State      uint32
+	LocalAddr  uint32
+	LocalPort  uint32
+	RemoteAddr uint32
+	RemotePort uint32
+	OwningPid  uint32
+}
+
+// resolveProcessChain returns pid followed by its parents, stopping at maxDepth, a missing parent or a reused pid
+func resolveProcessChain(pid uint32, maxDepth int) []ProcessInfo {
+	parents := make(map[uint32]uint32)
+	created := make(map[uint32]windows.Filetime)
+
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err == nil {
+		defer windows.CloseHandle(snapshot)
+		var entry windows.ProcessEntry32
+		entry.Size = uint32(unsafe.Sizeof(entry))
+		for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+			parents[entry.ProcessID] = entry.ParentProcessID
+		}
+	}
+
+	chain := make([]ProcessInfo, 0, maxDepth+1)
+	seen := make(map[uint32]bool)
+	for len(chain) <= maxDepth && pid != 0 && !seen[pid] {
+		seen[pid] = true
+		path, ctime, ok := queryProcess(pid)
+		if !ok && len(chain) > 0 {
+			break
+		}
+		// a parent created after its child means the parent pid has been reused by an unrelated process
+		if len(chain) > 0 {
+			child := created[chain[len(chain)-1].PID]
+			if child.Nanoseconds() != 0 && ctime.Nanoseconds() > child.Nanoseconds() {
+				break
+			}
+		}
+		created[pid] = ctime
+		chain = append(chain, ProcessInfo{PID: pid, ImagePath: path})
+		pid = parents[pid]
+	}
+	return chain
+}
+
+func queryProcess(pid uint32) (string, windows.Filetime, bool) {
+	var ctime, exit, kernel, user windows.Filetime
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return "", ctime, false
+	}
+	defer windows.CloseHandle(h)
+
+	windows.GetProcessTimes(h, &ctime, &exit, &kernel, &user)
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err = windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return "", ctime, true
+	}
+	return windows.UTF16ToString(buf[:size]), ctime, true
+}
+
+// namedPipeClientPID returns the process id of the client connected to a server side pipe connection
+func namedPipeClientPID(conn net.Conn) uint32 {
+	f, ok := conn.(interface{ Fd() uintptr })
+	if !ok {
+		return 0
+	}
+
+	var pid uint32
+	r, _, _ := procGetNamedPipeClientProcessId.Call(f.Fd(), uintptr(unsafe.Pointer(&pid)))
+	if r == 0 {
+		return 0
+	}
+	return pid
+}
+
+// tcpClientPID looks up the process owning the client end of a loopback TCP connection
+func tcpClientPID(conn net.Conn) uint32 {
+	local, ok1 := conn.LocalAddr().(*net.TCPAddr)
+	remote, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 || remote.IP.To4() == nil {
+		return 0
+	}
+
+	var size uint32
+	procGetExtendedTcpTable.Call(0, uintptr(unsafe.Pointer(&size)), 0, afInet, tcpTableOwnerPidAll, 0)
+	if size == 0 {
+		return 0
+	}
+	// leave room for connections opened between the two calls
+	size += 16 * uint32(unsafe.Sizeof(mibTcpRowOwnerPid{}))
+	buf := make([]byte, size)
+	r, _, _ := procGetExtendedTcpTable.Call(uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0, afInet, tcpTableOwnerPidAll, 0)
+	if r != 0 {
+		return 0
+	}
+
+	port := func(p int) uint32 {
+		return uint32(p>>8&0xff | p&0xff<<8)
+	}
+	addr := func(ip net.IP) uint32 {
+		return binary.LittleEndian.Uint32(ip.To4())
+	}
+
+	count := binary.LittleEndian.Uint32(buf)
+	rows := unsafe.Slice((*mibTcpRowOwnerPid)(unsafe.Pointer(&buf[4])), count)
+	for _, row := range rows {
+		// the client's local end is our remote end
+		if row.LocalAddr == addr(remote.IP) && row.LocalPort&0xffff == port(remote.Port) &&
+			row.RemoteAddr == addr(local.IP) && row.RemotePort&0xffff == port(local.Port) {
+			return row.OwningPid
+		}
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+package listeners
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PipeSecurityDescriptor returns the SDDL of a named pipe that SYSTEM, the account running the agent and the accounts
+// and groups of sids can connect to. Connections over the network are denied to everyone, the DACL is protected so
+// nothing is inherited.
+func PipeSecurityDescriptor(sids []string) (string, error) {
+	var sd strings.Builder
+	sd.WriteString("D:P(D;;GA;;;NU)(A;;GA;;;SY)(A;;GA;;;OW)")
+	for _, sid := range sids {
+		if !validSID(sid) {
+			return "", fmt.Errorf("%q is not a SID", sid)
+		}
+		fmt.Fprintf(&sd, "(A;;GRGW;;;%s)", strings.ToUpper(sid))
+	}
+	return sd.String(), nil
+}
+
+// validSID checks the string form of a SID, S-1- followed by the authority and at least one sub authority
+func validSID(sid string) bool {
+	parts := strings.Split(strings.ToUpper(sid), "-")
+	if len(parts) < 4 || parts[0] != "S" || parts[1] != "1" {
+		return false
+	}
+	if _, err := strconv.ParseUint(parts[2], 10, 48); err != nil {
+		return false
+	}
+	for _, p := range parts[3:] {
+		if _, err := strconv.ParseUint(p, 10, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
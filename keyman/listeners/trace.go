@@ -0,0 +1,317 @@
+package listeners
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Agent protocol message numbers, see draft-miller-ssh-agent
+const (
+	AGENT_FAILURE                    = 5
+	AGENT_SUCCESS                    = 6
+	AGENTC_REQUEST_IDENTITIES        = 11
+	AGENT_IDENTITIES_ANSWER          = 12
+	AGENTC_SIGN_REQUEST              = 13
+	AGENT_SIGN_RESPONSE              = 14
+	AGENTC_ADD_IDENTITY              = 17
+	AGENTC_REMOVE_IDENTITY           = 18
+	AGENTC_REMOVE_ALL_IDENTITIES     = 19
+	AGENTC_ADD_SMARTCARD_KEY         = 20
+	AGENTC_REMOVE_SMARTCARD_KEY      = 21
+	AGENTC_LOCK                      = 22
+	AGENTC_UNLOCK                    = 23
+	AGENTC_ADD_ID_CONSTRAINED        = 25
+	AGENTC_ADD_SMARTCARD_CONSTRAINED = 26
+	AGENTC_EXTENSION                 = 27
+	AGENT_EXTENSION_FAILURE          = 28
+)
+
+var agentMessageNames = map[byte]string{
+	AGENT_FAILURE:                    "FAILURE",
+	AGENT_SUCCESS:                    "SUCCESS",
+	AGENTC_REQUEST_IDENTITIES:        "REQUEST_IDENTITIES",
+	AGENT_IDENTITIES_ANSWER:          "IDENTITIES_ANSWER",
+	AGENTC_SIGN_REQUEST:              "SIGN_REQUEST",
+	AGENT_SIGN_RESPONSE:              "SIGN_RESPONSE",
+	AGENTC_ADD_IDENTITY:              "ADD_IDENTITY",
+	AGENTC_REMOVE_IDENTITY:           "REMOVE_IDENTITY",
+	AGENTC_REMOVE_ALL_IDENTITIES:     "REMOVE_ALL_IDENTITIES",
+	AGENTC_ADD_SMARTCARD_KEY:         "ADD_SMARTCARD_KEY",
+	AGENTC_REMOVE_SMARTCARD_KEY:      "REMOVE_SMARTCARD_KEY",
+	AGENTC_LOCK:                      "LOCK",
+	AGENTC_UNLOCK:                    "UNLOCK",
+	AGENTC_ADD_ID_CONSTRAINED:        "ADD_ID_CONSTRAINED",
+	AGENTC_ADD_SMARTCARD_CONSTRAINED: "ADD_SMARTCARD_KEY_CONSTRAINED",
+	AGENTC_EXTENSION:                 "EXTENSION",
+	AGENT_EXTENSION_FAILURE:          "EXTENSION_FAILURE",
+}
+
+// AgentMessageName returns the protocol name of an agent message number
+func AgentMessageName(t byte) string {
+	if name, ok := agentMessageNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_%d", t)
+}
+
+const (
+	TRACE_OPEN     = "open"
+	TRACE_REQUEST  = "request"
+	TRACE_RESPONSE = "response"
+	TRACE_CLOSE    = "close"
+)
+
+// TraceRecord is a single line of a trace file
+type TraceRecord struct {
+	Conn     uint64 `json:"conn"`
+	Dir      string `json:"dir"`
+	Listener string `json:"listener,omitempty"`
+	Peer     string `json:"peer,omitempty"`
+	// Start is the wall clock time of an open record
+	Start *time.Time `json:"start,omitempty"`
+	// Elapsed is the time since the connection was opened in seconds
+	Elapsed float64 `json:"t"`
+	Type    string  `json:"type,omitempty"`
+	// Message is the frame without its length prefix, after redaction
+	Message []byte `json:"msg,omitempty"`
+	// Redacted is set when anything of the message was zeroed or left out
+	Redacted bool `json:"redacted,omitempty"`
+	// Dropped is set when everything but the message type, or the extension name, was left out. Such messages can't
+	// be replayed.
+	Dropped bool   `json:"dropped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Tracer records the agent traffic of every connection to a file as JSON lines. Private keys, passphrases,
+// signatures and session identifiers are redacted before they are written.
+type Tracer struct {
+	mu     sync.Mutex
+	f      *os.File
+	w      *bufio.Writer
+	enc    *json.Encoder
+	nextID uint64
+}
+
+func NewTracer(path string) (*Tracer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open trace file %s: %w", path, err)
+	}
+	w := bufio.NewWriter(f)
+	return &Tracer{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.w.Flush()
+	return t.f.Close()
+}
+
+func (t *Tracer) write(r *TraceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(r)
+	// flush every record so a trace survives the agent being killed
+	t.w.Flush()
+}
+
+// wrap returns conn with its traffic traced
+func (t *Tracer) wrap(conn io.ReadWriter, listener string, peer *PeerInfo) *tracingConn {
+	tc := &tracingConn{
+		conn:   conn,
+		tracer: t,
+		id:     atomic.AddUint64(&t.nextID, 1),
+		start:  time.Now(),
+	}
+	t.write(&TraceRecord{Conn: tc.id, Dir: TRACE_OPEN, Listener: listener, Peer: peer.String(), Start: &tc.start})
+	return tc
+}
+
+var tracer struct {
+	sync.Mutex
+	t *Tracer
+}
+
+// SetTracer enables tracing of new connections on all listeners, nil disables it
+func SetTracer(t *Tracer) {
+	tracer.Lock()
+	defer tracer.Unlock()
+	tracer.t = t
+}
+
+func activeTracer() *Tracer {
+	tracer.Lock()
+	defer tracer.Unlock()
+	return tracer.t
+}
+
+// tracingConn splits the bytes read and written into agent frames and records them
+type tracingConn struct {
+	conn   io.ReadWriter
+	tracer *Tracer
+	id     uint64
+	start  time.Time
+	rbuf   []byte
+	wbuf   []byte
+}
+
+func (c *tracingConn) Read(p []byte) (int, error) {
+	n, err := c.conn.Read(p)
+	c.rbuf = c.record(TRACE_REQUEST, append(c.rbuf, p[:n]...))
+	return n, err
+}
+
+func (c *tracingConn) Write(p []byte) (int, error) {
+	n, err := c.conn.Write(p)
+	c.wbuf = c.record(TRACE_RESPONSE, append(c.wbuf, p[:n]...))
+	return n, err
+}
+
+// record writes out every complete frame in buf and returns what is left over
+func (c *tracingConn) record(dir string, buf []byte) []byte {
+	for len(buf) >= 4 {
+		length := binary.BigEndian.Uint32(buf)
+		if uint32(len(buf)-4) < length {
+			break
+		}
+		msg := buf[4 : 4+length]
+		buf = buf[4+length:]
+
+		r := &TraceRecord{Conn: c.id, Dir: dir, Elapsed: time.Since(c.start).Seconds()}
+		if len(msg) > 0 {
+			r.Type = AgentMessageName(msg[0])
+			r.Message, r.Redacted, r.Dropped = RedactAgentMessage(dir, msg)
+		}
+		c.tracer.write(r)
+	}
+	// don't hold on to a large backing array
+	return append([]byte(nil), buf...)
+}
+
+func (c *tracingConn) close(err error) {
+	r := &TraceRecord{Conn: c.id, Dir: TRACE_CLOSE, Elapsed: time.Since(c.start).Seconds()}
+	if err != nil && err != io.EOF {
+		r.Error = err.Error()
+	}
+	c.tracer.write(r)
+}
+
+// RedactAgentMessage returns a copy of msg that is safe to share. Public keys, comments and the structure of signed
+// data are kept so a trace can be replayed, everything secret is replaced by zeros of the same length. redacted
+// reports whether anything was zeroed or left out, dropped whether the message was cut down to its type, or the name
+// of an extension, so it can't be replayed.
+func RedactAgentMessage(dir string, msg []byte) (out []byte, redacted bool, dropped bool) {
+	out = append([]byte(nil), msg...)
+	if len(out) == 0 {
+		return out, false, false
+	}
+
+	switch {
+	case dir == TRACE_REQUEST && out[0] == AGENTC_SIGN_REQUEST:
+		// string key blob, string data, uint32 flags
+		_, rest, ok := splitString(out[1:])
+		if !ok {
+			return out[:1], true, true
+		}
+		data, _, ok := splitString(rest)
+		if !ok {
+			return out[:1], true, true
+		}
+		redactSignData(data)
+		return out, true, false
+	case dir == TRACE_RESPONSE && out[0] == AGENT_SIGN_RESPONSE:
+		// string signature containing string format, string blob
+		sig, _, ok := splitString(out[1:])
+		if !ok {
+			return out[:1], true, true
+		}
+		_, blobAndRest, ok := splitString(sig)
+		if !ok {
+			return out[:1], true, true
+		}
+		blob, _, ok := splitString(blobAndRest)
+		if !ok {
+			return out[:1], true, true
+		}
+		zero(blob)
+		return out, true, false
+	case dir == TRACE_REQUEST && out[0] == AGENTC_EXTENSION:
+		// keep only the extension name, session-bind carries the session identifier
+		name, _, ok := splitString(out[1:])
+		if !ok {
+			return out[:1], true, true
+		}
+		return out[:1+4+len(name)], true, true
+	case dir == TRACE_REQUEST:
+		switch out[0] {
+		case AGENTC_ADD_IDENTITY, AGENTC_ADD_ID_CONSTRAINED, AGENTC_ADD_SMARTCARD_KEY,
+			AGENTC_ADD_SMARTCARD_CONSTRAINED, AGENTC_LOCK, AGENTC_UNLOCK:
+			return out[:1], true, true
+		}
+	}
+	return out, false, false
+}
+
+// redactSignData zeros the secret parts of data in place. The SSHSIG preamble and namespace and the user
+// authentication request after the session identifier are kept, they tell what the signature was for.
+func redactSignData(data []byte) {
+	if len(data) >= 6 && string(data[:6]) == "SSHSIG" {
+		if _, rest, ok := splitString(data[6:]); ok {
+			zero(rest)
+			return
+		}
+	}
+
+	const msgUserAuthRequest = 50
+	if sid, rest, ok := splitString(data); ok && len(rest) > 0 && rest[0] == msgUserAuthRequest {
+		zero(sid)
+		return
+	}
+
+	zero(data)
+}
+
+// splitString returns the contents of the SSH string at the start of b and the bytes after it. The contents
+// share b's backing array.
+func splitString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	l := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < l {
+		return nil, nil, false
+	}
+	return b[4 : 4+l], b[4+l:], true
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// ReadTrace parses a trace file written by a Tracer
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	var records []TraceRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 4*DefaultMaxMessageSize)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("trace line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,58 @@
+package listeners
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRedactAgentMessage(t *testing.T) {
+	signRequest := append([]byte{AGENTC_SIGN_REQUEST}, ssh.Marshal(struct {
+		KeyBlob []byte
+		Data    []byte
+		Flags   uint32
+	}{[]byte("key"), []byte("secret data"), 0})...)
+	signResponse := append([]byte{AGENT_SIGN_RESPONSE}, ssh.Marshal(struct {
+		Signature []byte
+	}{ssh.Marshal(struct {
+		Format string
+		Blob   []byte
+	}{"ssh-ed25519", []byte("signature")})})...)
+	extension := append([]byte{AGENTC_EXTENSION}, ssh.Marshal(struct {
+		Name     string
+		Contents []byte `ssh:"rest"`
+	}{"session-bind@openssh.com", []byte("session id")})...)
+
+	for _, tc := range []struct {
+		name     string
+		dir      string
+		msg      []byte
+		redacted bool
+		dropped  bool
+		secret   string
+	}{
+		{"request identities", TRACE_REQUEST, []byte{AGENTC_REQUEST_IDENTITIES}, false, false, ""},
+		{"sign request", TRACE_REQUEST, signRequest, true, false, "secret data"},
+		{"sign response", TRACE_RESPONSE, signResponse, true, false, "signature"},
+		{"extension", TRACE_REQUEST, extension, true, true, "session id"},
+		{"lock", TRACE_REQUEST, append([]byte{AGENTC_LOCK}, ssh.Marshal(struct{ Passphrase string }{"passphrase"})...), true, true, "passphrase"},
+		{"truncated sign request", TRACE_REQUEST, signRequest[:10], true, true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out, redacted, dropped := RedactAgentMessage(tc.dir, tc.msg)
+			if redacted != tc.redacted || dropped != tc.dropped {
+				t.Fatalf("redacted %t dropped %t, expected %t and %t", redacted, dropped, tc.redacted, tc.dropped)
+			}
+			if tc.secret != "" && bytes.Contains(out, []byte(tc.secret)) {
+				t.Fatalf("%q left in the redacted message", tc.secret)
+			}
+			if !dropped && len(out) != len(tc.msg) {
+				t.Fatalf("redacted message of %d bytes, expected %d", len(out), len(tc.msg))
+			}
+			if out[0] != tc.msg[0] {
+				t.Fatalf("message type %d, expected %d", out[0], tc.msg[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+//go:build !windows
+
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// UnixSocket serves the agent on a unix domain socket, the listener used by the headless agent. Point SSH_AUTH_SOCK
+// at Path to use it.
+type UnixSocket struct {
+	Path string
+	// Limits bounds client connections, the zero value uses the defaults
+	Limits ConnLimits
+
+	mu        sync.Mutex
+	running   bool
+	listener  net.Listener
+	lastError error
+}
+
+func (s *UnixSocket) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+func (s *UnixSocket) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastError
+}
+
+func (s *UnixSocket) Name() string {
+	return "Unix Socket " + s.Path
+}
+
+func (s *UnixSocket) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+func (s *UnixSocket) setState(running bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = running
+	s.lastError = err
+}
+
+func (s *UnixSocket) Run(ctx context.Context, sshagent agent.Agent) error {
+	if s.Path == "" {
+		err := fmt.Errorf("no unix socket path configured")
+		s.setState(false, err)
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		s.setState(false, err)
+		return err
+	}
+	// a socket left behind by an agent that was killed is replaced, anything else at the path is left alone
+	if fi, err := os.Lstat(s.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			err = fmt.Errorf("%s exists and is not a socket", s.Path)
+			s.setState(false, err)
+			return err
+		}
+		os.Remove(s.Path)
+	}
+
+	l, err := listenPrivateUnix(s.Path)
+	if err != nil {
+		s.setState(false, err)
+		return err
+	}
+
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	s.setState(true, nil)
+	// a restarted listener may already have replaced the socket, only remove our own
+	if bound, err := os.Lstat(s.Path); err == nil {
+		defer func() {
+			if current, err := os.Lstat(s.Path); err == nil && os.SameFile(bound, current) {
+				os.Remove(s.Path)
+			}
+		}()
+	}
+	defer l.Close()
+	defer func() {
+		s.mu.Lock()
+		s.running = false
+		s.mu.Unlock()
+	}()
+
+	guard := newConnGuard(s.Name(), s.Limits)
+	wg := new(sync.WaitGroup)
+	conns := new(connSet)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// the listener was stopped or its context cancelled, clients waiting for their next request are cut off
+			conns.closeAll()
+			wg.Wait()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			s.setState(false, err)
+			return err
+		}
+		if !conns.add(conn) {
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			defer conns.remove(conn)
+			peer := NewProcessPeer(TYPE_UNIX, unixPeerPID(conn))
+			err := guard.Serve(ctx, sshagent, conn, peer)
+			if err != nil && err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Println(err.Error())
+			}
+		}()
+	}
+}
+
+// listenPrivateUnix listens on a unix socket that only the owner may connect to, matching ssh-agent. The socket is
+// bound and restricted to 0600 inside a new 0700 directory and then moved to path, so it is never reachable with the
+// permissions of the umask. The caller removes path after closing the listener.
+func listenPrivateUnix(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ncryptagent-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "agent.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is unlinked by its new name when the listener is done
+	l.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(tmp, 0600); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
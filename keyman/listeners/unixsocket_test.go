@@ -0,0 +1,195 @@
+//go:build !windows
+
+package listeners
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startUnixSocket runs the listener until it is serving and returns a channel receiving the result of Run
+func startUnixSocket(t *testing.T, s *UnixSocket) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(context.Background(), agent.NewKeyring()) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.Running() {
+		select {
+		case err := <-done:
+			t.Fatalf("listener stopped before serving: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("listener not running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return done
+}
+
+func stopUnixSocket(t *testing.T, s *UnixSocket, done <-chan error) {
+	t.Helper()
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Stop")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	// the socket is restricted regardless of the umask
+	old := syscall.Umask(0)
+	defer syscall.Umask(old)
+
+	dir := t.TempDir()
+	s := &UnixSocket{Path: filepath.Join(dir, "agent", "agent.sock")}
+	done := startUnixSocket(t, s)
+
+	fi, err := os.Lstat(s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %s, expected a socket with 0600", fi.Mode())
+	}
+	if di, err := os.Stat(filepath.Dir(s.Path)); err != nil || di.Mode().Perm() != 0700 {
+		t.Errorf("socket directory mode %v: %v", di.Mode(), err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(s.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".ncryptagent-") {
+			t.Errorf("temporary directory %s left behind", e.Name())
+		}
+	}
+
+	conn, err := net.Dial("unix", s.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = agent.NewClient(conn).List(); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	stopUnixSocket(t, s, done)
+	if _, err = os.Lstat(s.Path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed after Stop: %v", err)
+	}
+}
+
+func TestUnixSocketStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+
+	// a socket left behind by a killed agent is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := &UnixSocket{Path: path}
+	done := startUnixSocket(t, s)
+
+	// a restarted listener's socket is not removed by the listener it replaced
+	restarted := &UnixSocket{Path: path}
+	restartedDone := startUnixSocket(t, restarted)
+	stopUnixSocket(t, s, done)
+	if _, err = os.Lstat(path); err != nil {
+		t.Fatalf("restarted listener's socket removed: %v", err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	stopUnixSocket(t, restarted, restartedDone)
+}
+
+func TestUnixSocketNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	if err := os.WriteFile(path, []byte("keep me"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &UnixSocket{Path: path}
+	if err := s.Run(context.Background(), agent.NewKeyring()); err == nil {
+		t.Fatal("listener replaced a regular file")
+	}
+	if content, err := os.ReadFile(path); err != nil || string(content) != "keep me" {
+		t.Fatalf("file changed: %q, %v", content, err)
+	}
+}
+
+func TestUnixSocketIdleClient(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(s *UnixSocket, cancel context.CancelFunc)
+	}{
+		{name: "stop", stop: func(s *UnixSocket, cancel context.CancelFunc) { s.Stop() }},
+		{name: "cancel", stop: func(s *UnixSocket, cancel context.CancelFunc) { cancel() }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// without timeouts an idle client would keep its connection forever
+			s := &UnixSocket{
+				Path:   filepath.Join(t.TempDir(), "agent.sock"),
+				Limits: ConnLimits{IdleTimeout: -1, RequestTimeout: -1},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() { done <- s.Run(ctx, agent.NewKeyring()) }()
+
+			var conn net.Conn
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				var err error
+				if conn, err = net.Dial("unix", s.Path); err == nil {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			defer conn.Close()
+			// the connection is served before the listener shuts down
+			if _, err := agent.NewClient(conn).List(); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.stop(s, cancel)
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Run returned %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run waited for the idle client")
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Fatal("connection still open after the listener shut down")
+			}
+		})
+	}
+}
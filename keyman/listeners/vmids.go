@@ -0,0 +1,151 @@
+package listeners
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The helpers in this file are used by the Hyper-V socket listener to work out which VM partitions it should
+// be listening on. They are deliberately free of any Windows specific calls.
+
+const (
+	VSockServicePort = 0x23232323
+	TYPE_VSOCK       = "VSOCK"
+)
+
+// VSockOptions controls which VM partitions the Hyper-V socket listener accepts connections from
+type VSockOptions struct {
+	// ServicePort is the AF_VSOCK port guests connect to, the Hyper-V service GUID is derived from it
+	ServicePort uint32
+	// VMIDs are explicit VM GUIDs to listen on in addition to any discovered WSL2 utility VMs
+	VMIDs []string
+	// AnyPartition additionally listens on the wildcard VM ID, accepting connections from any partition. It is the
+	// default, turning it off limits the listener to WSL2 and the listed VM IDs.
+	AnyPartition bool
+	// Headless logs and skips a missing Hyper-V socket registration instead of offering to add it in a dialog
+	Headless bool
+}
+
+// NormalizeVMID validates a VM GUID, accepting it with or without surrounding braces, and returns it in
+// lowercase without braces.
+func NormalizeVMID(vmid string) (string, error) {
+	id := strings.TrimSpace(vmid)
+	id = strings.TrimPrefix(id, "{")
+	id = strings.TrimSuffix(id, "}")
+	id = strings.ToLower(id)
+
+	if len(id) != 36 {
+		return "", fmt.Errorf("invalid VM ID %q", vmid)
+	}
+
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return "", fmt.Errorf("invalid VM ID %q", vmid)
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdef", c) {
+				return "", fmt.Errorf("invalid VM ID %q", vmid)
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// NormalizeVMIDs normalizes a list of VM IDs, dropping duplicates. The first invalid ID is returned as an error.
+func NormalizeVMIDs(vmids []string) ([]string, error) {
+	seen := make(map[string]interface{})
+	results := make([]string, 0, len(vmids))
+	for _, v := range vmids {
+		id, err := NormalizeVMID(v)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = nil
+		results = append(results, id)
+	}
+	return results, nil
+}
+
+// ParseWSLHostVMID extracts the utility VM ID from a wslhost.exe command line. wslhost is started with the
+// VM ID as a braced GUID argument, e.g.
+//
+//	"C:\...\wslhost.exe" {1c3c0a1e-...} 2916 2912 C:\...\wsl.exe --vm-id {b7a9c2f0-...} --handle 2164
+//
+// The last braced argument is the VM ID.
+func ParseWSLHostVMID(commandLine string) (string, bool) {
+	args := strings.Fields(commandLine)
+	for i := len(args) - 1; i >= 0; i-- {
+		arg := strings.Trim(args[i], "\"")
+		if !strings.HasPrefix(arg, "{") || !strings.HasSuffix(arg, "}") {
+			continue
+		}
+		if id, err := NormalizeVMID(arg); err == nil {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// ParseWSLHostVMIDs extracts the unique VM IDs from a set of wslhost.exe command lines.
+func ParseWSLHostVMIDs(commandLines []string) []string {
+	seen := make(map[string]interface{})
+	results := make([]string, 0)
+	for _, cl := range commandLines {
+		id, ok := ParseWSLHostVMID(cl)
+		if !ok {
+			continue
+		}
+		if _, dup := seen[id]; dup {
+			continue
+		}
+		seen[id] = nil
+		results = append(results, id)
+	}
+	return results
+}
+
+// MergeVMIDs returns the union of the given VM ID lists, keeping the order of first appearance.
+func MergeVMIDs(lists ...[]string) []string {
+	seen := make(map[string]interface{})
+	results := make([]string, 0)
+	for _, l := range lists {
+		for _, v := range l {
+			if _, ok := seen[v]; ok {
+				continue
+			}
+			seen[v] = nil
+			results = append(results, v)
+		}
+	}
+	return results
+}
+
+func vmidDiff(old, new []string) (add, del []string) {
+	add = make([]string, 0)
+	del = make([]string, 0)
+	oldIDS := make(map[string]interface{})
+	newIDS := make(map[string]interface{})
+	for _, v := range old {
+		oldIDS[v] = 0
+	}
+	for _, v := range new {
+		newIDS[v] = 0
+	}
+	for _, v := range new {
+		if _, ok := oldIDS[v]; !ok {
+			add = append(add, v)
+		}
+	}
+	for _, v := range old {
+		if _, ok := newIDS[v]; !ok {
+			del = append(del, v)
+		}
+	}
+	return
+}
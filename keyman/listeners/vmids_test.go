@@ -0,0 +1,139 @@
+package listeners
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	testVMID1 = "b7a9c2f0-1d2e-4f3a-8b9c-0d1e2f3a4b5c"
+	testVMID2 = "1c3c0a1e-aaaa-bbbb-cccc-ddddeeeeffff"
+)
+
+func TestNormalizeVMID(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    string
+		invalid bool
+	}{
+		{in: testVMID1, want: testVMID1},
+		{in: "{" + testVMID1 + "}", want: testVMID1},
+		{in: "  {B7A9C2F0-1D2E-4F3A-8B9C-0D1E2F3A4B5C} ", want: testVMID1},
+		{in: "00000000-0000-0000-0000-000000000000", want: "00000000-0000-0000-0000-000000000000"},
+		{in: "", invalid: true},
+		{in: "b7a9c2f0-1d2e-4f3a-8b9c-0d1e2f3a4b5", invalid: true},
+		{in: "b7a9c2f0-1d2e-4f3a-8b9c-0d1e2f3a4b5cd", invalid: true},
+		{in: "b7a9c2f0x1d2e-4f3a-8b9c-0d1e2f3a4b5c", invalid: true},
+		{in: "g7a9c2f0-1d2e-4f3a-8b9c-0d1e2f3a4b5c", invalid: true},
+		{in: "{{" + testVMID1 + "}}", invalid: true},
+	} {
+		got, err := NormalizeVMID(tc.in)
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("NormalizeVMID(%q) = %q, expected an error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("NormalizeVMID(%q) = %q, %v, expected %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestNormalizeVMIDs(t *testing.T) {
+	got, err := NormalizeVMIDs([]string{testVMID1, "{" + testVMID2 + "}", "{B7A9C2F0-1D2E-4F3A-8B9C-0D1E2F3A4B5C}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{testVMID1, testVMID2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("NormalizeVMIDs = %v, expected %v", got, want)
+	}
+
+	if got, err = NormalizeVMIDs([]string{testVMID1, "not-a-vm"}); err == nil {
+		t.Errorf("NormalizeVMIDs accepted an invalid ID: %v", got)
+	}
+}
+
+func TestParseWSLHostVMID(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		commandLine string
+		want        string
+	}{
+		{
+			name:        "vm-id argument",
+			commandLine: `"C:\Program Files\WSL\wslhost.exe" {1c3c0a1e-aaaa-bbbb-cccc-ddddeeeeffff} 2916 2912 C:\Windows\System32\wsl.exe --vm-id {b7a9c2f0-1d2e-4f3a-8b9c-0d1e2f3a4b5c} --handle 2164`,
+			want:        testVMID1,
+		},
+		{
+			name:        "quoted",
+			commandLine: `wslhost.exe "{B7A9C2F0-1D2E-4F3A-8B9C-0D1E2F3A4B5C}"`,
+			want:        testVMID1,
+		},
+		{
+			name:        "invalid last braced argument",
+			commandLine: `wslhost.exe {1c3c0a1e-aaaa-bbbb-cccc-ddddeeeeffff} {not-a-guid}`,
+			want:        testVMID2,
+		},
+		{
+			name:        "unbraced",
+			commandLine: `wslhost.exe ` + testVMID1,
+		},
+		{
+			name: "empty",
+		},
+	} {
+		got, ok := ParseWSLHostVMID(tc.commandLine)
+		if ok != (tc.want != "") || got != tc.want {
+			t.Errorf("%s: ParseWSLHostVMID = %q, %v, expected %q", tc.name, got, ok, tc.want)
+		}
+	}
+}
+
+func TestParseWSLHostVMIDs(t *testing.T) {
+	got := ParseWSLHostVMIDs([]string{
+		`wslhost.exe --vm-id {` + testVMID1 + `}`,
+		`wslhost.exe`,
+		`wslhost.exe --vm-id {` + testVMID2 + `}`,
+		`wslhost.exe --vm-id {B7A9C2F0-1D2E-4F3A-8B9C-0D1E2F3A4B5C}`,
+	})
+	if want := []string{testVMID1, testVMID2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseWSLHostVMIDs = %v, expected %v", got, want)
+	}
+	if got = ParseWSLHostVMIDs(nil); got == nil || len(got) != 0 {
+		t.Errorf("ParseWSLHostVMIDs(nil) = %#v, expected an empty list", got)
+	}
+}
+
+func TestMergeVMIDs(t *testing.T) {
+	for _, tc := range []struct {
+		lists [][]string
+		want  []string
+	}{
+		{nil, []string{}},
+		{[][]string{{"a", "b"}, nil, {"b", "c"}, {"a"}}, []string{"a", "b", "c"}},
+		{[][]string{{"c", "c"}, {"b", "a"}}, []string{"c", "b", "a"}},
+	} {
+		if got := MergeVMIDs(tc.lists...); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("MergeVMIDs(%v) = %v, expected %v", tc.lists, got, tc.want)
+		}
+	}
+}
+
+func TestVMIDDiff(t *testing.T) {
+	for _, tc := range []struct {
+		old, new []string
+		add, del []string
+	}{
+		{nil, nil, []string{}, []string{}},
+		{nil, []string{"a", "b"}, []string{"a", "b"}, []string{}},
+		{[]string{"a", "b"}, nil, []string{}, []string{"a", "b"}},
+		{[]string{"a", "b"}, []string{"b", "c"}, []string{"c"}, []string{"a"}},
+		{[]string{"a", "b"}, []string{"b", "a"}, []string{}, []string{}},
+	} {
+		add, del := vmidDiff(tc.old, tc.new)
+		if !reflect.DeepEqual(add, tc.add) || !reflect.DeepEqual(del, tc.del) {
+			t.Errorf("vmidDiff(%v, %v) = %v, %v, expected %v, %v", tc.old, tc.new, add, del, tc.add, tc.del)
+		}
+	}
+}
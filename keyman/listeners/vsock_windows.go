@@ -10,7 +10,6 @@ import (
 	"io"
 	"log"
 	"net"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -26,9 +25,7 @@ var (
 )
 
 const (
-	VSockServicePort     = 0x23232323
 	HyperVServiceRegPath = `SOFTWARE\Microsoft\Windows NT\CurrentVersion\Virtualization\GuestCommunicationServices`
-	TYPE_VSOCK           = "VSOCK"
 )
 
 // https://docs.microsoft.com/en-us/virtualization/hyper-v-on-windows/user-guide/make-integration-service
@@ -37,16 +34,40 @@ const (
 //$service.SetValue("ElementName", $friendlyName)
 
 type VSock struct {
-	running bool
-	pipe    *winio.HvsockListener
+	// Limits bounds client connections, the zero value uses the defaults
+	Limits ConnLimits
+
+	running     bool
+	pipe        *winio.HvsockListener
+	serviceGUID guid.GUID
+	options     VSockOptions
+	cancel      context.CancelFunc
 }
 
-func NewVSockListener() (*VSock, error) {
+func NewVSockListener(options VSockOptions) (*VSock, error) {
+	if options.ServicePort == 0 {
+		options.ServicePort = VSockServicePort
+	}
+
+	vmids, err := NormalizeVMIDs(options.VMIDs)
+	if err != nil {
+		return nil, err
+	}
+	options.VMIDs = vmids
+
+	serviceGUID := winio.VsockServiceID(options.ServicePort)
+
 	if !CheckHvSocket() {
 		return nil, fmt.Errorf("could not open a hyper-v socket")
 	}
 
-	if !CheckHVService() {
+	if !CheckHVService(serviceGUID) {
+		if options.Headless {
+			// without a desktop the dialog would never be answered
+			log.Printf("Hyper-V socket %s is not registered under HKLM\\%s, WSL2 listener not started", serviceGUID, HyperVServiceRegPath)
+			return nil, nil
+		}
+
 		dlg, err := NewGenericDialog(nil,
 			"Set-up Guest Communication Socket?",
 			"The Hyper-V Guest Communication socket for nCryptAgent was not found. \n\nWould you like to install the registry entry now, or disable WSL2 agent connectivity?",
@@ -63,7 +84,7 @@ func NewVSockListener() (*VSock, error) {
 		switch dlg.Run() {
 		case walk.DlgCmdOK:
 			program16, _ := windows.UTF16PtrFromString("reg.exe")
-			arguments16, _ := windows.UTF16PtrFromString(fmt.Sprintf("ADD \"HKLM\\%s\\%s\" /v ElementName /t REG_SZ /d \"nCryptAgent\"", HyperVServiceRegPath, HyperVServiceGUID.String()))
+			arguments16, _ := windows.UTF16PtrFromString(fmt.Sprintf("ADD \"HKLM\\%s\\%s\" /v ElementName /t REG_SZ /d \"nCryptAgent\"", HyperVServiceRegPath, serviceGUID.String()))
 			directory16, _ := windows.UTF16PtrFromString("")
 
 			err = windows.ShellExecute(0, windows.StringToUTF16Ptr("runas"), program16, arguments16, directory16, 0)
@@ -81,7 +102,10 @@ func NewVSockListener() (*VSock, error) {
 		}
 	}
 
-	vsock := new(VSock)
+	vsock := &VSock{
+		serviceGUID: serviceGUID,
+		options:     options,
+	}
 
 	return vsock, nil
 }
@@ -100,6 +124,9 @@ func (s *VSock) Name() string {
 
 func (s *VSock) Stop() error {
 	s.running = false
+	if s.cancel != nil {
+		s.cancel()
+	}
 	if s.pipe != nil {
 		return s.pipe.Close()
 	}
@@ -110,16 +137,17 @@ func (s *VSock) Stop() error {
 type vSockWorker struct {
 	l        net.Listener
 	sshagent agent.Agent
+	guard    *connGuard
 }
 
-func newVSockWorker(vmid string, sshagent agent.Agent) (*vSockWorker, error) {
+func newVSockWorker(vmid string, serviceGUID guid.GUID, sshagent agent.Agent, guard *connGuard) (*vSockWorker, error) {
 	vmidGUID, err := guid.FromString(vmid)
 	if err != nil {
 		return nil, err
 	}
 	pipe, err := winio.ListenHvsock(&winio.HvsockAddr{
 		VMID:      vmidGUID,
-		ServiceID: HyperVServiceGUID,
+		ServiceID: serviceGUID,
 	})
 	if err != nil {
 		return nil, err
@@ -127,17 +155,19 @@ func newVSockWorker(vmid string, sshagent agent.Agent) (*vSockWorker, error) {
 	return &vSockWorker{
 		l:        pipe,
 		sshagent: sshagent,
+		guard:    guard,
 	}, nil
 }
 
-func (s *vSockWorker) Run() {
+func (s *vSockWorker) Run(ctx context.Context) {
 	for {
 		conn, err := s.l.Accept()
 		if err != nil {
 			return
 		}
 		go func() {
-			agent.ServeAgent(s.sshagent, conn)
+			defer conn.Close()
+			s.guard.Serve(ctx, s.sshagent, conn, hvsockPeer(conn))
 		}()
 	}
 }
@@ -146,54 +176,34 @@ func (s *vSockWorker) Close() {
 	s.l.Close()
 }
 
-func vmidDiff(old, new []string) (add, del []string) {
-	add = make([]string, 0)
-	del = make([]string, 0)
-	oldIDS := make(map[string]interface{})
-	newIDS := make(map[string]interface{})
-	for _, v := range old {
-		oldIDS[v] = 0
-	}
-	for _, v := range new {
-		newIDS[v] = 0
-	}
-	for _, v := range new {
-		if _, ok := oldIDS[v]; !ok {
-			add = append(add, v)
-		}
-	}
-	for _, v := range old {
-		if _, ok := newIDS[v]; !ok {
-			del = append(del, v)
-		}
-	}
-	return
-}
-
-func (s *VSock) wsl2Watcher(ctx context.Context, sshagent agent.Agent) {
+func (s *VSock) wsl2Watcher(ctx context.Context, sshagent agent.Agent, guard *connGuard) {
 	timeout := time.Second * 60
 	ch := make(chan *ProcessEvent, 1)
 	pn, err := NewProcessNotify("wslhost.exe", ch)
 	if err != nil {
 		// fallback to polling mode
 		timeout = time.Second * 15
-		println("ProcessNotify error:", err.Error())
+		log.Printf("ProcessNotify error, polling for WSL2 VMs: %s", err)
 	} else {
 		pn.Start()
 		defer pn.Stop()
 	}
-	lastVMIDs := make([]string, 0)
 	workers := make(map[string]*vSockWorker)
 	for {
-		vmids := GetVMIDs()
+		// explicitly configured VMs may not be running yet, they are retried until a listener can be created
+		vmids := MergeVMIDs(GetVMIDs(), s.options.VMIDs)
+		lastVMIDs := make([]string, 0, len(workers))
+		for v := range workers {
+			lastVMIDs = append(lastVMIDs, v)
+		}
 		add, del := vmidDiff(lastVMIDs, vmids)
 		for _, v := range add {
-			w, err := newVSockWorker(v, sshagent)
+			w, err := newVSockWorker(v, s.serviceGUID, sshagent, guard)
 			if err != nil {
 				continue
 			}
 			workers[v] = w
-			go w.Run()
+			go w.Run(ctx)
 		}
 		for _, v := range del {
 			w := workers[v]
@@ -202,9 +212,11 @@ func (s *VSock) wsl2Watcher(ctx context.Context, sshagent agent.Agent) {
 				delete(workers, v)
 			}
 		}
-		lastVMIDs = vmids
 		select {
 		case <-ctx.Done():
+			for _, w := range workers {
+				w.Close()
+			}
 			return
 		case <-ch:
 		case <-time.After(timeout):
@@ -218,14 +230,28 @@ func (s *VSock) Run(ctx context.Context, sshagent agent.Agent) error {
 		return nil
 	}
 
-	if !CheckHVService() {
+	if !CheckHVService(s.serviceGUID) {
+		return nil
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	defer s.cancel()
+
+	// the per VM listeners share the connection limits
+	guard := newConnGuard(s.Name(), s.Limits)
+
+	if !s.options.AnyPartition {
+		// only the per VM listeners created by the watcher are used
+		s.running = true
+		defer func() { s.running = false }()
+		s.wsl2Watcher(ctx, sshagent, guard)
 		return nil
 	}
 
 	var err error
 	s.pipe, err = winio.ListenHvsock(&winio.HvsockAddr{
 		VMID:      vmWildCard,
-		ServiceID: HyperVServiceGUID,
+		ServiceID: s.serviceGUID,
 	})
 	if err != nil {
 		return err
@@ -234,7 +260,7 @@ func (s *VSock) Run(ctx context.Context, sshagent agent.Agent) error {
 	s.running = true
 	defer s.pipe.Close()
 
-	go s.wsl2Watcher(ctx, sshagent)
+	go s.wsl2Watcher(ctx, sshagent, guard)
 
 	wg := new(sync.WaitGroup)
 	// context cancelled
@@ -250,7 +276,8 @@ func (s *VSock) Run(ctx context.Context, sshagent agent.Agent) error {
 		}
 		wg.Add(1)
 		go func() {
-			err := agent.ServeAgent(sshagent, conn)
+			defer conn.Close()
+			err := guard.Serve(ctx, sshagent, conn, hvsockPeer(conn))
 			if err != nil && err != io.EOF {
 				log.Println(err.Error())
 			}
@@ -259,17 +286,26 @@ func (s *VSock) Run(ctx context.Context, sshagent agent.Agent) error {
 	}
 }
 
+// hvsockPeer identifies a Hyper-V socket client. The client process runs inside the VM, so only the VM ID is known.
+func hvsockPeer(conn net.Conn) *PeerInfo {
+	peer := &PeerInfo{Listener: TYPE_VSOCK}
+	if addr, ok := conn.RemoteAddr().(*winio.HvsockAddr); ok {
+		peer.Detail = "VM " + addr.VMID.String()
+	}
+	return peer
+}
+
 const afHvSock = 34      // AF_HYPERV
 const sHvProtocolRaw = 1 // HV_PROTOCOL_RAW
 
-func CheckHVService() bool {
+func CheckHVService(serviceGUID guid.GUID) bool {
 	gcs, err := registry.OpenKey(registry.LOCAL_MACHINE, HyperVServiceRegPath, registry.READ)
 	if err != nil {
 		return false
 	}
 	defer gcs.Close()
 
-	agentSrv, err := registry.OpenKey(gcs, HyperVServiceGUID.String(), registry.READ)
+	agentSrv, err := registry.OpenKey(gcs, serviceGUID.String(), registry.READ)
 	if err != nil {
 		return false
 	}
@@ -288,29 +324,18 @@ func GetVMIDs() []string {
 		return nil
 	}
 
-	guids := make(map[string]interface{})
-
+	commandLines := make([]string, 0, len(processes))
 	for _, v := range processes {
-		args := strings.Split(v.CommandLine, " ")
-		for i := len(args) - 1; i >= 0; i-- {
-			if strings.Contains(args[i], "{") {
-				guids[args[i]] = nil
-				break
-			}
-		}
+		commandLines = append(commandLines, v.CommandLine)
 	}
 
-	results := make([]string, 0)
-	for k := range guids {
-		results = append(results, k[1:len(k)-1])
-	}
-	return results
+	return ParseWSLHostVMIDs(commandLines)
 }
 
 func CheckHvSocket() bool {
 	fd, err := syscall.Socket(afHvSock, syscall.SOCK_STREAM, sHvProtocolRaw)
 	if err != nil {
-		println(err.Error())
+		log.Printf("Hyper-V socket not available: %s", err)
 		return false
 	}
 	syscall.Close(fd)
@@ -0,0 +1,464 @@
+package keyman
+
+import (
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"ncryptagent/ncrypt"
+	"strings"
+	"sync"
+)
+
+func (km *KeyManager) RescanNCryptKeys() error {
+
+	log.Printf("Rescanning for all NCrypt keys")
+	for _, k := range km.KeysList() {
+		if k.Type == "NCRYPT" {
+			_, err := km.LoadNCryptKey(k.config)
+
+			if err != nil {
+				k.Missing = true
+			} else {
+				k.Close()
+			}
+		}
+	}
+
+	return nil
+}
+
+func (km *KeyManager) LoadNCryptKey(kc *KeyConfig) (*Key, error) {
+	if kc.Type == "" {
+		kc.Type = "NCRYPT"
+	}
+	return km.loadKey(kc)
+}
+
+// CreateNewNCryptKey creates a key in a key storage provider, scope SCOPE_MACHINE creates it in the machine's key
+// store, which needs an administrator
+func (km *KeyManager) CreateNewNCryptKey(keyName string, containerName string, providerName string, algorithm string, bits int, password string, scope string) (*Key, error) {
+	return km.CreateKey(&KeyConfig{
+		Name:          keyName,
+		Type:          "NCRYPT",
+		ContainerName: containerName,
+		ProviderName:  providerName,
+		Length:        bits,
+		Algorithm:     algorithm,
+		Scope:         scope,
+	}, CreateOptions{Password: password})
+}
+
+// ncryptBackend loads keys from CNG key storage providers, the provider handles stay open until Close
+type ncryptBackend struct {
+	api             ncrypt.API
+	mu              sync.Mutex
+	providerHandles map[string]uintptr
+	// providers are the probed key storage providers, nil until Providers is first called
+	providers []*ProviderInfo
+}
+
+// NewNCryptBackend returns the NCRYPT backend on top of api, ncrypt.Native on Windows or an ncrypt.Emulator
+func NewNCryptBackend(api ncrypt.API) KeyBackend {
+	return newNCryptBackend(api)
+}
+
+func newNCryptBackend(api ncrypt.API) *ncryptBackend {
+	return &ncryptBackend{api: api, providerHandles: make(map[string]uintptr)}
+}
+
+func (b *ncryptBackend) Type() string {
+	return "NCRYPT"
+}
+
+func (b *ncryptBackend) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: true, Create: true, Delete: true}
+}
+
+// Prepare opens the key storage provider of every configured NCrypt key
+func (b *ncryptBackend) Prepare(keys []*KeyConfig) error {
+	for _, k := range keys {
+		if k.ProviderName == "" {
+			k.ProviderName = ncrypt.ProviderMSSC
+		}
+
+		if _, err := b.getProviderHandle(k.ProviderName); err != nil {
+			return fmt.Errorf("unable to open provider %s for %s: %w", k.ProviderName, k.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *ncryptBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, p := range b.providerHandles {
+		if p != 0 {
+			b.api.FreeObject(p)
+		}
+		delete(b.providerHandles, name)
+	}
+	return nil
+}
+
+func (b *ncryptBackend) getProviderHandle(providerName string) (uintptr, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var pHandle uintptr
+	var handleOpen bool
+	var err error
+
+	if pHandle, handleOpen = b.providerHandles[providerName]; !handleOpen {
+		pHandle, err = b.api.OpenStorageProvider(providerName)
+		if err != nil {
+			return 0, fmt.Errorf("unable to open provider %s: %w", providerName, err)
+		}
+
+		b.providerHandles[providerName] = pHandle
+	}
+
+	return pHandle, nil
+}
+
+// openKey opens a key container, failing without a prompt when the key isn't available. Smart card keys are opened
+// on the card in their reader first, as cards provisioned from the same template have the same containers, then on
+// whichever card the provider picks when their card isn't there.
+func (b *ncryptBackend) openKey(kc *KeyConfig) (uintptr, error) {
+	if kc.ProviderName == "" {
+		kc.ProviderName = ncrypt.ProviderMSSC
+	}
+
+	providerHandle, err := b.getProviderHandle(kc.ProviderName)
+	if err != nil {
+		return 0, err
+	}
+
+	names := []string{kc.ContainerName}
+	if kc.ProviderName == ncrypt.ProviderMSSC && kc.Reader != "" {
+		names = append([]string{fmt.Sprintf("\\\\.\\%s\\%s", kc.Reader, kc.ContainerName)}, names...)
+	}
+	for _, name := range names {
+		// silently determine if the key is available
+		var keyHandle uintptr
+		keyHandle, err = b.api.OpenKey(providerHandle, name, 0, kc.ncryptFlags()|ncrypt.NCRYPT_SILENT_FLAG)
+		if err != nil {
+			continue
+		}
+		err = b.checkSmartCard(kc, keyHandle)
+		b.api.FreeObject(keyHandle)
+		if err != nil {
+			continue
+		}
+
+		// reopen the handle allowing user interaction now
+		return b.api.OpenKey(providerHandle, name, 0, kc.ncryptFlags())
+	}
+	return 0, err
+}
+
+// checkSmartCard binds a smart card key to the card it is on: the reader and the GUID of the card are recorded when
+// the key is first loaded, afterwards a key on another card is refused, so the key is missing rather than swapped
+// for a key of the same container on another card
+func (b *ncryptBackend) checkSmartCard(kc *KeyConfig, kh uintptr) error {
+	if kc.ProviderName != ncrypt.ProviderMSSC {
+		return nil
+	}
+
+	reader, err := b.api.GetPropertyStr(kh, ncrypt.NCRYPT_READER_PROPERTY)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve NCRYPT_READER_PROPERTY: %w", err)
+	}
+	guid, err := b.api.GetPropertyBytes(kh, ncrypt.NCRYPT_SMARTCARD_GUID_PROPERTY)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve NCRYPT_SMARTCARD_GUID_PROPERTY: %w", err)
+	}
+	card := hex.EncodeToString(guid)
+
+	if kc.Token == "" {
+		log.Printf("Key %s is on card %s in reader %s", kc.Name, card, reader)
+	} else if !strings.EqualFold(kc.Token, card) {
+		return fmt.Errorf("key %s is on card %s, not on card %s in reader %s", kc.Name, kc.Token, card, reader)
+	} else if kc.Reader != reader {
+		log.Printf("Card %s of key %s moved to reader %s", card, kc.Name, reader)
+	}
+	kc.Token, kc.Reader = card, reader
+	return nil
+}
+
+func (b *ncryptBackend) Load(kc *KeyConfig) (BackendKey, error) {
+	keyHandle, err := b.openKey(kc)
+	if err != nil {
+		return nil, err
+	}
+
+	algorithmName, err := b.api.GetPropertyStr(keyHandle, ncrypt.NCRYPT_ALGORITHM_PROPERTY)
+	if err != nil {
+		b.api.FreeObject(keyHandle)
+		return nil, err
+	}
+
+	var keyLength = 0
+	if algorithmName == ncrypt.ALG_RSA {
+		keyLength, err = b.api.GetPropertyInt(keyHandle, ncrypt.NCRYPT_LENGTH_PROPERTY)
+		if err == nil {
+			log.Printf("Got length %d\n", keyLength)
+		} else {
+			log.Printf("%v", err)
+			keyLength = 0
+		}
+	}
+
+	return b.newNCryptKey(kc, keyHandle, algorithmName, keyLength)
+}
+
+func (b *ncryptBackend) Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error) {
+	if kc.ContainerName == "" {
+		containerUUID, _ := uuid.NewRandom()
+		kc.ContainerName = containerUUID.String()
+	}
+
+	if kc.ProviderName == ncrypt.ProviderMSSC {
+		return nil, fmt.Errorf("creating keys on smartcards through the minidriver is not supported, create a PIV key instead")
+	}
+
+	algorithmOK := false
+	for _, i := range ncrypt.AVAILABLE_ALGORITHMS {
+		if i == kc.Algorithm {
+			algorithmOK = true
+			break
+		}
+	}
+	if !algorithmOK {
+		return nil, fmt.Errorf("unsupported algorithm %v", kc.Algorithm)
+	}
+
+	providerHandle, err := b.getProviderHandle(kc.ProviderName)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, err := b.algSupported(providerHandle, kc.Algorithm); err != nil || !ok {
+		return nil, fmt.Errorf("provider %s does not support algorithm %v", kc.ProviderName, kc.Algorithm)
+	}
+
+	kh, err := b.api.CreatePersistedKey(providerHandle, kc.ContainerName, kc.Algorithm, 0, kc.ncryptFlags())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create persisted key: %w", err)
+	}
+
+	if kc.Algorithm == ncrypt.ALG_RSA {
+		err = b.api.SetProperty(kh, ncrypt.NCRYPT_LENGTH_PROPERTY, uint32(kc.Length), 0)
+
+		if err != nil {
+			b.api.FreeObject(kh)
+			return nil, fmt.Errorf("unable to set key NCRYPT_LENGTH_PROPERTY: %w", err)
+		}
+	}
+
+	return b.finalizeKey(kc, kh, opts)
+}
+
+// finalizeKey sets the password of a key that was created or imported without finalizing it, finalizes it and opens
+// it as the key of kc, a smart card key bound to its card
+func (b *ncryptBackend) finalizeKey(kc *KeyConfig, kh uintptr, opts CreateOptions) (BackendKey, error) {
+	if opts.Password != "" {
+		// If the provider is platform, set the property to a UI compatible one
+		err := b.api.SetProperty(kh, ncrypt.NCRYPT_PCP_USAGE_AUTH_PROPERTY, ncrypt.UsageAuthDigest(opts.Password), 0)
+		if err != nil {
+			log.Printf("error setting password: %v\n", err)
+		}
+	}
+
+	err := b.api.FinalizeKey(kh, 0)
+	if err != nil {
+		b.api.FreeObject(kh)
+		return nil, fmt.Errorf("unable to finalize key: %w", err)
+	}
+
+	uc, err := b.api.GetPropertyStr(kh, ncrypt.NCRYPT_UNIQUE_NAME_PROPERTY)
+	if err != nil {
+		b.api.FreeObject(kh)
+		return nil, fmt.Errorf("unable to retrieve NCRYPT_UNIQUE_NAME_PROPERTY: %w", err)
+	}
+
+	kc.ContainerName = uc
+	// smart card keys have the card's PIN
+	kc.NoPin = opts.Password == "" && kc.ProviderName != ncrypt.ProviderMSSC
+	if err = b.checkSmartCard(kc, kh); err != nil {
+		b.api.FreeObject(kh)
+		return nil, err
+	}
+
+	key, err := b.newNCryptKey(kc, kh, kc.Algorithm, kc.Length)
+	if err != nil {
+		return nil, err
+	}
+
+	// empty the password so we are prompted on first use
+	if opts.Password != "" {
+		b.api.SetProperty(kh, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
+	}
+
+	return key, nil
+}
+
+// Delete removes the key container, a key that could not be loaded is opened for it first
+func (b *ncryptBackend) Delete(kc *KeyConfig, key BackendKey) error {
+	nk, ok := key.(*ncryptKey)
+	if !ok || nk.handle == 0 {
+		kh, err := b.openKey(kc)
+		if err != nil {
+			return err
+		}
+		nk = &ncryptKey{api: b.api, handle: kh}
+	}
+
+	// NCryptDeleteKey frees the handle when it succeeds
+	if err := b.api.DeleteKey(nk.handle, 0); err != nil {
+		return err
+	}
+	nk.handle = 0
+	return nil
+}
+
+// ncryptKey is an open NCrypt key handle
+type ncryptKey struct {
+	*signerKey
+	api       ncrypt.API
+	handle    uintptr
+	algorithm string
+	length    int
+	// provider and noPin tell whether the key has a password the agent can change
+	provider string
+	noPin    bool
+}
+
+func (b *ncryptBackend) newNCryptKey(kc *KeyConfig, kh uintptr, algorithm string, length int) (*ncryptKey, error) {
+	signer, err := newNCryptSigner(b.api, kh, 0)
+	if err != nil {
+		b.api.FreeObject(kh)
+		return nil, err
+	}
+
+	sk, err := newSignerKey(signer, KeyCapabilities{PIN: !kc.NoPin})
+	if err != nil {
+		b.api.FreeObject(kh)
+		return nil, err
+	}
+
+	return &ncryptKey{
+		signerKey: sk,
+		api:       b.api,
+		handle:    kh,
+		algorithm: algorithm,
+		length:    length,
+		provider:  kc.ProviderName,
+		noPin:     kc.NoPin,
+	}, nil
+}
+
+func (n *ncryptKey) Algorithm() (string, int) {
+	return n.algorithm, n.length
+}
+
+func (n *ncryptKey) SetHWND(hwnd uintptr) {
+	if n.handle == 0 {
+		return
+	}
+	err := n.api.SetProperty(n.handle, ncrypt.NCRYPT_WINDOW_HANDLE_PROPERTY, hwnd, 0)
+	if err != nil {
+		log.Printf("Setting NCryptWindow handle failed: %v", err)
+	}
+}
+
+// managesPIN reports whether the key is a Platform Crypto Provider key with a password, smart card PINs are changed
+// through their PIV or OpenPGP keys
+func (n *ncryptKey) managesPIN() bool {
+	return n.provider == ncrypt.ProviderMSPlatform && !n.noPin
+}
+
+// PINStatus of a PCP key tells nothing, the TPM's dictionary attack lockout is shared by all of its keys
+func (n *ncryptKey) PINStatus() (*PINStatus, error) {
+	return &PINStatus{Retries: -1, MaxRetries: -1, UnblockRetries: -1}, nil
+}
+
+// ChangePIN changes the password of a PCP key, the old one is set on the handle for the provider to check
+func (n *ncryptKey) ChangePIN(oldPIN, newPIN string) error {
+	if n.handle == 0 {
+		return fmt.Errorf("key is closed")
+	}
+	if newPIN == "" {
+		return fmt.Errorf("the password of a TPM key can't be removed")
+	}
+	// forget the password on the handle, it is the old one or was rejected
+	defer n.api.SetProperty(n.handle, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
+
+	if err := n.api.SetProperty(n.handle, ncrypt.NCRYPT_PIN_PROPERTY, oldPIN, 0); err != nil {
+		return err
+	}
+	return n.api.SetProperty(n.handle, ncrypt.NCRYPT_PCP_CHANGEPASSWORD_PROPERTY, ncrypt.UsageAuthDigest(newPIN), 0)
+}
+
+// UnblockPIN is not supported, the TPM's lockout is reset by its owner
+func (n *ncryptKey) UnblockPIN(string, string) error {
+	return ErrUnblockNotSupported
+}
+
+func (n *ncryptKey) Close() error {
+	if n.handle != 0 {
+		n.api.FreeObject(n.handle)
+		n.handle = 0
+	}
+	return nil
+}
+
+func getPublicKey(api ncrypt.API, kh uintptr) (crypto.PublicKey, error) {
+	algGroup, err := api.GetPropertyStr(kh, ncrypt.NCRYPT_ALGORITHM_GROUP_PROPERTY)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get NCRYPT_ALGORITHM_GROUP_PROPERTY: %w", err)
+	}
+
+	var pub crypto.PublicKey
+	switch algGroup {
+	case "ECDSA":
+		buf, err := api.ExportKey(kh, ncrypt.BCRYPT_ECCPUBLIC_BLOB)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export ECC public key: %w", err)
+		}
+		curveName, err := api.GetPropertyStr(kh, ncrypt.NCRYPT_ECC_CURVE_NAME_PROPERTY)
+		if err != nil {
+			// The smart card provider doesn't have the curve name property set, attempt to get it from
+			// algorithm property
+			curveName, err = api.GetPropertyStr(kh, ncrypt.NCRYPT_ALGORITHM_PROPERTY)
+			if err != nil {
+				return nil, fmt.Errorf("failed to retrieve ECC curve name: %w", err)
+			}
+		}
+
+		if _, ok := ncrypt.CurveNames[curveName]; !ok {
+			return nil, fmt.Errorf("curveName %s not found in curvenames map", curveName)
+		}
+
+		pub, err = unmarshalECC(buf, ncrypt.CurveNames[curveName])
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal ECC public key: %w", err)
+		}
+	case "RSA":
+		buf, err := api.ExportKey(kh, ncrypt.BCRYPT_RSAPUBLIC_BLOB)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export %v public key: %w", algGroup, err)
+		}
+		pub, err = unmarshalRSA(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %v public key: %w", algGroup, err)
+		}
+	default:
+		return nil, fmt.Errorf("unhandled algorithm group %v retrieved from key", algGroup)
+	}
+
+	return pub, nil
+}
@@ -0,0 +1,459 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"ncryptagent/ncrypt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkNCryptHandles fails t if handles of the emulator were not freed
+func checkNCryptHandles(t *testing.T, emu *ncrypt.Emulator) {
+	t.Helper()
+	if n := emu.OpenHandles(); n != 0 {
+		t.Errorf("%d handles were not freed", n)
+	}
+}
+
+// TestNCryptLifecycle runs a PIN protected key through a KeyManager: the PIN cache and timeout, changing and
+// unblocking the password, a removed and reinserted card and deleting the key
+func TestNCryptLifecycle(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	backend := newNCryptBackend(emu)
+	defer checkNCryptHandles(t, emu)
+	const keyName = "lifecycle"
+	const pin = "123456"
+
+	dir := t.TempDir()
+	var err error
+
+	pinOK := true
+	promptPIN := pin
+	emu.PINPrompt = func(provider string, container string) (string, bool) {
+		if !pinOK {
+			return "", false
+		}
+		return promptPIN, true
+	}
+
+	km := newDetachedKeyManager(filepath.Join(dir, "config.json"))
+	km.RegisterBackend(backend)
+	defer km.Close()
+
+	var k *Key
+	if !check(t, "create", func() error {
+		k, err = km.CreateNewNCryptKey(keyName, "", ncrypt.ProviderMSPlatform, ncrypt.ALG_ECDSA_P256, 0, pin, "")
+		if err != nil {
+			return err
+		}
+		if k.config.NoPin || !k.Capabilities().PIN {
+			return fmt.Errorf("key created with a password has no PIN")
+		}
+		return nil
+	}) {
+		return
+	}
+	provider, container := k.config.ProviderName, k.config.ContainerName
+
+	// sign signs with the key currently registered under keyName, expecting the given number of PIN prompts
+	sign := func(prompts int) error {
+		before := emu.Prompts(provider, container)
+		sig, err := km.Keys[keyName].SignSSH([]byte("lifecycle"))
+		if err != nil {
+			return err
+		}
+		if err = (*km.Keys[keyName].SSHPublicKey).Verify([]byte("lifecycle"), sig); err != nil {
+			return err
+		}
+		if shown := emu.Prompts(provider, container) - before; shown != prompts {
+			return fmt.Errorf("PIN prompt shown %d times, expected %d", shown, prompts)
+		}
+		return nil
+	}
+
+	check(t, "first use prompts", func() error {
+		return sign(1)
+	})
+	check(t, "no PIN timeout", func() error {
+		k.SetTimeout(0)
+		if err := sign(1); err != nil {
+			return err
+		}
+		return sign(1)
+	})
+	check(t, "PIN cache", func() error {
+		k.SetTimeout(60)
+		if err := sign(1); err != nil {
+			return err
+		}
+		if err := sign(0); err != nil {
+			return err
+		}
+		if pc, ok := k.pinCache(); !ok || !pc.PINCached() {
+			return fmt.Errorf("PIN is not reported as cached")
+		}
+		return nil
+	})
+	check(t, "purge PIN", func() error {
+		k.PurgePIN()
+		return sign(1)
+	})
+	check(t, "PIN timeout", func() error {
+		k.PurgePIN()
+		k.SetTimeout(1)
+		if err := sign(1); err != nil {
+			return err
+		}
+		time.Sleep(1500 * time.Millisecond)
+		return sign(1)
+	})
+	check(t, "purge stops the PIN timer", func() error {
+		k.PurgePIN()
+		k.SetTimeout(1)
+		if err := sign(1); err != nil {
+			return err
+		}
+		// the timer of the purged PIN would fire during the second sleep and wipe the PIN cached since
+		time.Sleep(600 * time.Millisecond)
+		k.PurgePIN()
+		if err := sign(1); err != nil {
+			return err
+		}
+		time.Sleep(600 * time.Millisecond)
+		return sign(0)
+	})
+	check(t, "cancelled PIN", func() error {
+		k.PurgePIN()
+		pinOK = false
+		defer func() { pinOK = true }()
+		if _, err := k.SignSSH([]byte("lifecycle")); err == nil {
+			return fmt.Errorf("signing succeeded without a PIN")
+		}
+		return nil
+	})
+
+	check(t, "change password", func() error {
+		const newPIN = "654321"
+		if !k.PINManageable() {
+			return fmt.Errorf("the password of a PCP key can't be changed")
+		}
+		if err := km.ChangeKeyPIN(keyName, "wrong", newPIN); err == nil {
+			return fmt.Errorf("password changed with a wrong old password")
+		}
+		if err := km.ChangeKeyPIN(keyName, pin, newPIN); err != nil {
+			return err
+		}
+		if _, err := k.SignSSH([]byte("lifecycle")); err == nil {
+			return fmt.Errorf("signing with the old password succeeded")
+		}
+		promptPIN = newPIN
+		defer func() { promptPIN = pin }()
+		if err := sign(1); err != nil {
+			return err
+		}
+		return km.ChangeKeyPIN(keyName, newPIN, pin)
+	})
+	check(t, "unblock password", func() error {
+		if err := km.UnblockKeyPIN(keyName, "12345678", pin); !errors.Is(err, ErrUnblockNotSupported) {
+			return fmt.Errorf("unblocking a PCP key returned %v", err)
+		}
+		return nil
+	})
+
+	check(t, "removed card", func() error {
+		if err := emu.SetRemoved(provider, container, true); err != nil {
+			return err
+		}
+		if _, err := k.SignSSH([]byte("lifecycle")); err == nil {
+			return fmt.Errorf("signing succeeded with the card removed")
+		}
+
+		// a restart loads the key as missing with the stored public key
+		restarted := newDetachedKeyManager(km.configPath)
+		restarted.RegisterBackend(newNCryptBackend(emu))
+		restarted.config.Keys = km.config.Keys
+		defer restarted.Close()
+		if err := restarted.loadKeys(); err != nil {
+			return err
+		}
+		missing := restarted.Keys[keyName]
+		if missing == nil || !missing.Missing || missing.LoadError == nil || missing.SSHPublicKey == nil {
+			return fmt.Errorf("key is not loaded as missing with its public key")
+		}
+
+		if err := km.RescanNCryptKeys(); err != nil {
+			return err
+		}
+		if !km.Keys[keyName].Missing {
+			return fmt.Errorf("key is not marked missing after a rescan")
+		}
+		return nil
+	})
+	check(t, "inserted card", func() error {
+		if err := emu.SetRemoved(provider, container, false); err != nil {
+			return err
+		}
+		if err := km.RescanNCryptKeys(); err != nil {
+			return err
+		}
+		if km.Keys[keyName].Missing {
+			return fmt.Errorf("key is still missing after a rescan")
+		}
+		return sign(1)
+	})
+
+	check(t, "delete", func() error {
+		if err := km.DeleteKey(km.Keys[keyName], true); err != nil {
+			return err
+		}
+		if _, ok := km.Keys[keyName]; ok {
+			return fmt.Errorf("key is still registered")
+		}
+		if _, err := backend.Load(k.config); err == nil {
+			return fmt.Errorf("key can still be loaded after it was deleted")
+		}
+		return nil
+	})
+}
+
+// TestNCryptSmartCards loads a key from one of two cards with the same container and swaps the cards around
+func TestNCryptSmartCards(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	backend := newNCryptBackend(emu)
+	defer checkNCryptHandles(t, emu)
+	const keyName = "template"
+	const container = "template-container"
+	readers := []string{"Emulated Reader 1", "Emulated Reader 2"}
+	cards := [][]byte{
+		{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10},
+		{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x20},
+	}
+
+	var publics []ssh.PublicKey
+	if !check(t, "setup", func() error {
+		for i, card := range cards {
+			signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return err
+			}
+			if err = emu.AddCardKey(readers[i], card, container, signer, ""); err != nil {
+				return err
+			}
+			pub, err := ssh.NewPublicKey(signer.Public())
+			if err != nil {
+				return err
+			}
+			publics = append(publics, pub)
+		}
+		return nil
+	}) {
+		return
+	}
+	defer func() {
+		for _, card := range cards {
+			emu.MoveCard(card, "")
+		}
+	}()
+
+	km := newDetachedKeyManager(filepath.Join(t.TempDir(), "config.json"))
+	km.RegisterBackend(backend)
+	defer km.Close()
+
+	// the key imported from the second reader
+	kc := &KeyConfig{Name: keyName, Type: "NCRYPT", ProviderName: ncrypt.ProviderMSSC, ContainerName: container, Reader: readers[1]}
+	var k *Key
+	check(t, "reader scoped", func() error {
+		var err error
+		if k, err = km.LoadNCryptKey(kc); err != nil {
+			return err
+		}
+		if !bytes.Equal((*k.SSHPublicKey).Marshal(), publics[1].Marshal()) {
+			return fmt.Errorf("key was loaded from the card in the other reader")
+		}
+		if kc.Token != hex.EncodeToString(cards[1]) || kc.Reader != readers[1] {
+			return fmt.Errorf("key bound to card %s in %s", kc.Token, kc.Reader)
+		}
+		if card := k.SmartCard(); !strings.Contains(card, kc.Token) {
+			return fmt.Errorf("key details show card %q", card)
+		}
+		return nil
+	})
+	check(t, "other card", func() error {
+		// the first card takes the place of the key's card
+		emu.MoveCard(cards[1], "")
+		emu.MoveCard(cards[0], readers[1])
+		if err := km.RescanNCryptKeys(); err != nil {
+			return err
+		}
+		if !km.Keys[keyName].Missing {
+			return fmt.Errorf("key from another card is not marked missing")
+		}
+		if _, err := backend.Load(kc); err == nil {
+			return fmt.Errorf("key was loaded from another card")
+		}
+		return nil
+	})
+	check(t, "moved card", func() error {
+		emu.MoveCard(cards[1], readers[0])
+		if err := km.RescanNCryptKeys(); err != nil {
+			return err
+		}
+		if km.Keys[keyName].Missing {
+			return fmt.Errorf("key is missing after its card moved to another reader")
+		}
+		if kc.Reader != readers[0] {
+			return fmt.Errorf("key is bound to reader %s after its card moved", kc.Reader)
+		}
+		sig, err := km.Keys[keyName].SignSSH([]byte(keyName))
+		if err != nil {
+			return err
+		}
+		return publics[1].Verify([]byte(keyName), sig)
+	})
+	check(t, "removed card", func() error {
+		emu.MoveCard(cards[1], "")
+		if _, err := km.Keys[keyName].SignSSH([]byte(keyName)); err == nil {
+			return fmt.Errorf("signing succeeded with the card taken out")
+		}
+		return nil
+	})
+}
+
+// TestNCryptProviders probes the providers of the emulator, with a vendor provider that only loads P-256 keys
+func TestNCryptProviders(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	defer checkNCryptHandles(t, emu)
+	const keyName = "providers"
+	const vendor = "Emulated Vendor Key Storage Provider"
+
+	emu.InstallProvider(vendor, []string{ncrypt.ALG_ECDSA_P256}, false)
+	b := newNCryptBackend(emu)
+	defer b.Close()
+
+	providers := make(map[string]*ProviderInfo)
+	if !check(t, "enumerate", func() error {
+		infos, err := b.Providers()
+		if err != nil {
+			return err
+		}
+		for _, p := range infos {
+			providers[p.Name] = p
+		}
+		for _, name := range []string{ncrypt.ProviderMSSoftware, ncrypt.ProviderMSPlatform, ncrypt.ProviderMSSC, ncrypt.ProviderMSPassport, vendor} {
+			if providers[name] == nil {
+				return fmt.Errorf("provider %s was not enumerated", name)
+			}
+		}
+		return nil
+	}) {
+		return
+	}
+
+	rsaLengths := func(p *ProviderInfo) []int {
+		for _, a := range p.Algorithms {
+			if a.Algorithm == ncrypt.ALG_RSA {
+				return a.Lengths
+			}
+		}
+		return nil
+	}
+	check(t, "platform", func() error {
+		p := providers[ncrypt.ProviderMSPlatform]
+		if !p.Create || !p.Supports(ncrypt.ALG_ECDSA_P256) || p.Supports(ncrypt.ALG_ECDSA_P521) {
+			return fmt.Errorf("probed %v, create %v", p.Algorithms, p.Create)
+		}
+		if l := rsaLengths(p); len(l) != 1 || l[0] != 2048 {
+			return fmt.Errorf("RSA lengths %v, expected 2048", l)
+		}
+		return nil
+	})
+	check(t, "software", func() error {
+		p := providers[ncrypt.ProviderMSSoftware]
+		if !p.Create || len(p.Algorithms) != len(ncrypt.AVAILABLE_ALGORITHMS) || len(rsaLengths(p)) != len(rsaKeyLengths) {
+			return fmt.Errorf("probed %v, create %v", p.Algorithms, p.Create)
+		}
+		return nil
+	})
+	check(t, "passport", func() error {
+		p := providers[ncrypt.ProviderMSPassport]
+		if !p.Create || p.Supports(ncrypt.ALG_ECDSA_P256) {
+			return fmt.Errorf("probed %v, create %v", p.Algorithms, p.Create)
+		}
+		if l := rsaLengths(p); len(l) != 1 || l[0] != 2048 {
+			return fmt.Errorf("RSA lengths %v, expected 2048", l)
+		}
+		return nil
+	})
+	check(t, "smart card", func() error {
+		if p := providers[ncrypt.ProviderMSSC]; p.Create {
+			return fmt.Errorf("keys can be created on the smart card provider")
+		}
+		return nil
+	})
+	check(t, "vendor", func() error {
+		p := providers[vendor]
+		if p.Create || !p.Supports(ncrypt.ALG_ECDSA_P256) || p.Supports(ncrypt.ALG_RSA) {
+			return fmt.Errorf("probed %v, create %v", p.Algorithms, p.Create)
+		}
+		if _, err := b.Create(&KeyConfig{Name: keyName, Type: "NCRYPT", ProviderName: vendor, Algorithm: ncrypt.ALG_ECDSA_P384}, CreateOptions{}); err == nil {
+			return fmt.Errorf("created a key with an algorithm the provider doesn't support")
+		}
+		if _, err := b.Create(&KeyConfig{Name: keyName, Type: "NCRYPT", ProviderName: vendor, Algorithm: ncrypt.ALG_ECDSA_P256}, CreateOptions{}); err == nil {
+			return fmt.Errorf("created a key on a provider that only loads keys")
+		}
+
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		if err = emu.AddKey(vendor, keyName, priv, ""); err != nil {
+			return err
+		}
+		key, err := b.Load(&KeyConfig{Name: keyName, Type: "NCRYPT", ProviderName: vendor, ContainerName: keyName})
+		if err != nil {
+			return err
+		}
+		defer key.Close()
+		pub, err := ssh.NewPublicKey(&priv.PublicKey)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(key.Public().Marshal(), pub.Marshal()) {
+			return fmt.Errorf("loaded another key")
+		}
+		return nil
+	})
+}
+
+// TestNCryptMissingFunctions runs the backend on a Windows whose ncrypt.dll lacks the newer functions, they fail
+// with ErrNotSupported instead of keeping the agent from starting
+func TestNCryptMissingFunctions(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	emu.Missing = []string{"NCryptEnumStorageProviders", "NCryptIsAlgSupported"}
+	defer checkNCryptHandles(t, emu)
+	b := newNCryptBackend(emu)
+	defer b.Close()
+
+	check(t, "providers", func() error {
+		if _, err := b.Providers(); !errors.Is(err, ncrypt.ErrNotSupported) {
+			return fmt.Errorf("enumerating providers returned %v, expected ErrNotSupported", err)
+		}
+		return nil
+	})
+	check(t, "create", func() error {
+		key, err := b.Create(&KeyConfig{Name: "create", Type: "NCRYPT", ProviderName: ncrypt.ProviderMSSoftware, Algorithm: ncrypt.ALG_ECDSA_P256}, CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating a key without NCryptIsAlgSupported failed: %w", err)
+		}
+		return key.Close()
+	})
+}
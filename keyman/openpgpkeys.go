@@ -0,0 +1,313 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"ncryptagent/openpgp"
+	"ncryptagent/scard"
+)
+
+const TYPE_OPENPGP = "OPENPGP"
+
+// OpenPGPBackend uses the authentication and signature keys in the OpenPGP applet of smart cards, YubiKeys and
+// Nitrokeys. KeyConfig.Token is the card's manufacturer and serial number in hex like GnuPG shows it, KeyID the key,
+// "aut" or "sig", and ProviderName the reader the card was last seen in.
+type OpenPGPBackend struct {
+	cards *smartCards
+}
+
+// NewOpenPGPBackend returns an OpenPGP card backend finding cards with connector, scard.System() for the PC/SC
+// readers, and asking for PW1 with prompt
+func NewOpenPGPBackend(prompt PINPrompt, connector scard.Connector) *OpenPGPBackend {
+	return &OpenPGPBackend{cards: newSmartCards(openPGPApplet{}, connector, prompt)}
+}
+
+func (b *OpenPGPBackend) Type() string {
+	return TYPE_OPENPGP
+}
+
+func (b *OpenPGPBackend) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: true, Touch: true}
+}
+
+func (b *OpenPGPBackend) Load(kc *KeyConfig) (BackendKey, error) {
+	if kc.KeyID == "" {
+		return nil, fmt.Errorf("no OpenPGP card key configured for key %s", kc.Name)
+	}
+	key, err := openpgp.ParseKey(kc.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	cards, err := b.cards.present(kc.ProviderName)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cards {
+		if kc.Token != "" && c.id != kc.Token {
+			continue
+		}
+
+		info, err := openPGPKeyInfoOf(c, key)
+		if err != nil {
+			if kc.Token != "" {
+				return nil, err
+			}
+			continue
+		}
+
+		kc.Token = c.id
+		kc.ProviderName = c.currentReader()
+		return newOpenPGPKey(c, kc, key, info)
+	}
+
+	if kc.Token != "" {
+		return nil, fmt.Errorf("card %s is not present", kc.Token)
+	}
+	return nil, fmt.Errorf("no OpenPGP card with an %s found", key.Name())
+}
+
+func (b *OpenPGPBackend) Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error) {
+	return nil, fmt.Errorf("creating OpenPGP card keys is not supported, use gpg --card-edit")
+}
+
+func (b *OpenPGPBackend) Delete(kc *KeyConfig, key BackendKey) error {
+	return fmt.Errorf("deleting OpenPGP card keys is not supported")
+}
+
+// Close forgets the PINs and disconnects from the cards
+func (b *OpenPGPBackend) Close() error {
+	b.cards.close()
+	return nil
+}
+
+// Keys lists the signing keys on the OpenPGP cards in the readers, as configs that load them
+func (b *OpenPGPBackend) Keys() ([]*KeyConfig, error) {
+	cards, err := b.cards.present("")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*KeyConfig
+	for _, c := range cards {
+		for _, key := range openpgp.SigningKeys {
+			info, err := openPGPKeyInfoOf(c, key)
+			if err != nil {
+				if !errors.Is(err, openpgp.ErrNotFound) {
+					log.Printf("Reading the OpenPGP %s of card %s failed: %s", key.Name(), c.id, err)
+				}
+				continue
+			}
+			sshPub, err := ssh.NewPublicKey(info.public)
+			if err != nil {
+				continue
+			}
+
+			kc := &KeyConfig{
+				Name:          fmt.Sprintf("OpenPGP %s %s", c.id, key),
+				Type:          TYPE_OPENPGP,
+				ContainerName: key.Name(),
+				ProviderName:  c.currentReader(),
+				Token:         c.id,
+				KeyID:         key.String(),
+				SSHPublicKey:  string(ssh.MarshalAuthorizedKey(sshPub)),
+			}
+			kc.Algorithm, kc.Length = publicKeyAlgorithm(info.public)
+			keys = append(keys, kc)
+		}
+	}
+	return keys, nil
+}
+
+// openPGPApplet is the OpenPGP applet for the smart card handling shared with other applets
+type openPGPApplet struct{}
+
+func (openPGPApplet) Name() string {
+	return "OpenPGP"
+}
+
+func (openPGPApplet) Select(t scard.Transmitter) error {
+	return openpgp.New(t).Select()
+}
+
+func (openPGPApplet) ID(t scard.Transmitter) (string, error) {
+	return openpgp.New(t).ID()
+}
+
+func (openPGPApplet) ClearPIN(t scard.Transmitter) error {
+	return openpgp.New(t).ClearPIN()
+}
+
+func (openPGPApplet) PINRejected(err error) bool {
+	var pinErr *openpgp.PINError
+	return errors.As(err, &pinErr) || errors.Is(err, openpgp.ErrPINBlocked)
+}
+
+// openPGPKeyInfo is what the agent needs to know of a key on the card
+type openPGPKeyInfo struct {
+	public crypto.PublicKey
+	attrs  openpgp.Attributes
+	touch  bool
+}
+
+func openPGPKeyInfoOf(c *smartCard, key openpgp.Key) (*openPGPKeyInfo, error) {
+	info := &openPGPKeyInfo{}
+	err := c.withApplet(func(t scard.Transmitter) error {
+		card := openpgp.New(t)
+		data, err := card.ApplicationData()
+		if err != nil {
+			return err
+		}
+		if _, ok := data.Fingerprints[key]; !ok {
+			return openpgp.ErrNotFound
+		}
+		info.attrs = data.Attributes[key]
+		if info.public, err = card.PublicKey(key, info.attrs); err != nil {
+			return err
+		}
+		if info.touch, err = card.Touch(key); err != nil {
+			log.Printf("Reading the touch policy of the OpenPGP %s of card %s failed: %s", key.Name(), c.id, err)
+		}
+		return nil
+	})
+	return info, err
+}
+
+func newOpenPGPKey(c *smartCard, kc *KeyConfig, key openpgp.Key, info *openPGPKeyInfo) (*openPGPKey, error) {
+	signer := &openPGPSigner{card: c, name: kc.Name, key: key, info: info}
+	sk, err := newSignerKey(signer, KeyCapabilities{PIN: true, Touch: info.touch})
+	if err != nil {
+		return nil, err
+	}
+	algorithm, length := publicKeyAlgorithm(info.public)
+	return &openPGPKey{signerKey: sk, algorithm: algorithm, length: length}, nil
+}
+
+// openPGPKey is a key on an OpenPGP card
+type openPGPKey struct {
+	*signerKey
+	algorithm string
+	length    int
+}
+
+func (k *openPGPKey) Algorithm() (string, int) {
+	return k.algorithm, k.length
+}
+
+// openPGPSigner signs with INTERNAL AUTHENTICATE with the authentication key and PSO: COMPUTE DIGITAL SIGNATURE with
+// the signature key
+type openPGPSigner struct {
+	card    *smartCard
+	name    string
+	key     openpgp.Key
+	info    *openPGPKeyInfo
+	timeout int
+}
+
+func (s *openPGPSigner) Public() crypto.PublicKey {
+	return s.info.public
+}
+
+func (s *openPGPSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, isRSAPSS := opts.(*rsa.PSSOptions); isRSAPSS {
+		return nil, fmt.Errorf("RSA-PSS signing is not supported")
+	}
+
+	switch s.info.public.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := pkcs1DigestInfo[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported RSA hash algorithm %v", opts.HashFunc())
+		}
+		return s.sign(append(append([]byte{}, prefix...), digest...))
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return s.sign(digest)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", s.info.public)
+	}
+}
+
+func (s *openPGPSigner) sign(data []byte) ([]byte, error) {
+	c := s.card
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var signature []byte
+	err := c.withAppletLocked(func(t scard.Transmitter) error {
+		card := openpgp.New(t)
+		retries := func() (int, bool, error) { return card.PINRetries(s.key) }
+		verify := func(pin string) error { return card.VerifyPIN(s.key, pin) }
+		if err := c.verifyLocked(s.name, retries, verify); err != nil {
+			return err
+		}
+		if s.info.touch {
+			log.Printf("Touch card %s to sign with key %s", c.id, s.name)
+		}
+		var err error
+		signature, err = card.Sign(s.key, s.info.public, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.handlePinTimerLocked(s.timeout)
+	return signature, nil
+}
+
+// PINCached reports whether the card's PW1 is cached
+func (s *openPGPSigner) PINCached() bool {
+	return s.card.pinCached()
+}
+
+// PurgePIN forgets the card's PW1, for all keys on it
+func (s *openPGPSigner) PurgePIN() {
+	s.card.purgePIN()
+}
+
+func (s *openPGPSigner) SetPINTimeout(timeout int) {
+	s.timeout = timeout
+}
+
+func (s *openPGPSigner) managesPIN() bool {
+	return true
+}
+
+// PINStatus reads the tries left for the card's PW1 and reset code, the reset code has no tries when it was never set
+func (s *openPGPSigner) PINStatus() (*PINStatus, error) {
+	var status *openpgp.PINStatus
+	err := s.card.withApplet(func(t scard.Transmitter) error {
+		var err error
+		status, err = openpgp.New(t).PINStatus()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PINStatus{
+		Retries:        status.Retries,
+		MaxRetries:     -1,
+		Unblock:        "reset code",
+		UnblockRetries: status.ResetCodeRetries,
+	}, nil
+}
+
+// ChangePIN changes the card's PW1, for both keys on it
+func (s *openPGPSigner) ChangePIN(oldPIN, newPIN string) error {
+	return s.card.managePIN(func(t scard.Transmitter) error {
+		return openpgp.New(t).ChangePIN(oldPIN, newPIN)
+	})
+}
+
+// UnblockPIN sets a new PW1 for the card with its reset code
+func (s *openPGPSigner) UnblockPIN(resetCode, newPIN string) error {
+	return s.card.managePIN(func(t scard.Transmitter) error {
+		return openpgp.New(t).UnblockPIN(resetCode, newPIN)
+	})
+}
@@ -0,0 +1,437 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"ncryptagent/openpgp"
+	"ncryptagent/scard"
+	"strings"
+	"testing"
+)
+
+// openPGPScript is a recorded session with an OpenPGP card that isn't a YubiKey: it keeps its data objects in 6E
+// without the 73 template, returns them in two parts, has an imported P-256 authentication key and tells the tries
+// left with a wrong PIN. The public key is the base point of P-256.
+const openPGPScript = `
+# SELECT OpenPGP
+> 00 A4 04 00 06 D2 76 00 01 24 01
+< 90 00
+# GET DATA AID
+> 00 CA 00 4F 00
+< D2 76 00 01 24 01 03 03 00 0F 00 00 12 34 00 00 90 00
+# GET DATA application related data, the rest with GET RESPONSE
+> 00 CA 00 6E 00
+< 6E 81 8C 4F 10 D2 76 00 01 24 01 03 03 00 0F 00 00 12 34 00 00 5F 52 08 00 73 00 00 80 05 90 00 C0 0A 7C 00 08 00 08 00 08 00 00 00 C1 06 01 08 00 00 20 00 C2 06 01 08 00 00 20 00 C3 0A 13 2A 86 48 CE 3D 03 01 07 FF C4 07 01 40 40 40 03 00 03 C5 3C 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 61 2B
+> 00 C0 00 00 2B
+< 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 A1 90 00
+# GENERATE ASYMMETRIC KEY PAIR, read the authentication key
+> 00 47 81 00 02 A4 00 00
+< 7F 49 43 86 41 04 6B 17 D1 F2 E1 2C 42 47 F8 BC E6 E5 63 A4 40 F2 77 03 7D 81 2D EB 33 A0 F4 A1 39 45 D8 98 C2 96 4F E3 42 E2 FE 1A 7F 9B 8E E7 EB 4A 7C 0F 9E 16 2B CE 33 57 6B 31 5E CE CB B6 40 68 37 BF 51 F5 90 00
+# GET DATA UIF of the authentication key, not a YubiKey
+> 00 CA 00 D8 00
+< 6A 88
+# VERIFY PW1 without a PIN returns the tries left
+> 00 20 00 82
+< 63 C3
+# VERIFY PW1 123456
+> 00 20 00 82 06 31 32 33 34 35 36
+< 63 C2
+# INTERNAL AUTHENTICATE, r and s concatenated
+> 00 88 00 00 20 *
+< 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 11 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 22 90 00
+`
+
+const openPGPTestPIN = "123456"
+
+// newOpenPGPTestCards returns an emulated card with serial number 12345678 with an Ed25519 authentication and an RSA
+// signature key in Emulated Reader 0, and two other cards with ECDSA authentication keys in Emulated Reader 1 and 2
+func newOpenPGPTestCards(t *testing.T, pin string) (*openpgp.Emulator, []*openpgp.Emulator, *scard.Virtual) {
+	t.Helper()
+	emu := openpgp.NewEmulator(12345678, pin)
+	if _, err := emu.GenerateKey(openpgp.KeyAuthentication, openpgp.Attributes{Algorithm: openpgp.AlgEdDSA, Curve: openpgp.CurveEd25519}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := emu.GenerateKey(openpgp.KeySignature, openpgp.Attributes{Algorithm: openpgp.AlgRSA, RSABits: 2048}); err != nil {
+		t.Fatal(err)
+	}
+	others := []*openpgp.Emulator{openpgp.NewEmulator(1, pin), openpgp.NewEmulator(2, pin)}
+	if _, err := others[0].GenerateKey(openpgp.KeyAuthentication, openpgp.Attributes{Algorithm: openpgp.AlgECDSA, Curve: openpgp.CurveP256}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := others[1].GenerateKey(openpgp.KeyAuthentication, openpgp.Attributes{Algorithm: openpgp.AlgECDSA, Curve: openpgp.CurveP384}); err != nil {
+		t.Fatal(err)
+	}
+
+	readers := scard.NewVirtual()
+	readers.Insert("Emulated Reader 0", emu)
+	readers.Insert("Emulated Reader 1", others[0])
+	readers.Insert("Emulated Reader 2", others[1])
+	return emu, others, readers
+}
+
+// TestOpenPGPEmulation runs the OpenPGP card backend on openpgp.Emulator cards in a virtual reader: the PIN cache, a
+// card that was reset or moved to another reader, another card in the reader and changing PW1 and unblocking it with
+// the reset code
+func TestOpenPGPEmulation(t *testing.T) {
+	const pin = openPGPTestPIN
+	const reader = "Emulated Reader 0"
+	const id = "FFFF00BC614E"
+
+	emu, others, readers := newOpenPGPTestCards(t, pin)
+	readers.Remove("Emulated Reader 1")
+	readers.Remove("Emulated Reader 2")
+
+	prompts := 0
+	promptPIN := pin
+	prompt := func(title, message string) ([]byte, bool) {
+		prompts++
+		return []byte(promptPIN), true
+	}
+
+	b := NewOpenPGPBackend(prompt, readers)
+	defer b.Close()
+
+	load := func(key openpgp.Key) (BackendKey, pinCache, error) {
+		k, err := b.Load(&KeyConfig{Name: "openpgp-" + key.String(), Type: TYPE_OPENPGP, Token: id, KeyID: key.String()})
+		if err != nil {
+			return nil, nil, err
+		}
+		provider, ok := k.(pinCacheProvider)
+		if !ok {
+			return nil, nil, fmt.Errorf("key has no PIN cache")
+		}
+		pc, ok := provider.pinCache()
+		if !ok {
+			return nil, nil, fmt.Errorf("key has no PIN cache")
+		}
+		pc.SetPINTimeout(60)
+		return k, pc, nil
+	}
+	sign := func(key BackendKey) error {
+		data := []byte("openpgpemulation")
+		sig, err := key.Sign(data, "")
+		if err != nil {
+			return err
+		}
+		return key.Public().Verify(data, sig)
+	}
+
+	check(t, "aut pin cache", func() error {
+		key, pc, err := load(openpgp.KeyAuthentication)
+		if err != nil {
+			return err
+		}
+		prompts = 0
+		if err = sign(key); err != nil {
+			return err
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		if prompts != 1 || !pc.PINCached() {
+			return fmt.Errorf("%d PIN prompts for two signatures, cached %v", prompts, pc.PINCached())
+		}
+		pc.PurgePIN()
+		if pc.PINCached() {
+			return fmt.Errorf("PIN still cached after purge")
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		if prompts != 2 {
+			return fmt.Errorf("no PIN prompt after purge")
+		}
+		return nil
+	})
+
+	check(t, "sig pin once", func() error {
+		key, _, err := load(openpgp.KeySignature)
+		if err != nil {
+			return err
+		}
+		prompts = 0
+		for i := 0; i < 2; i++ {
+			if err = sign(key); err != nil {
+				return err
+			}
+		}
+		if prompts > 1 {
+			return fmt.Errorf("%d PIN prompts for two signatures with the cached PIN", prompts)
+		}
+		return nil
+	})
+
+	check(t, "aut wrong pin", func() error {
+		key, pc, err := load(openpgp.KeyAuthentication)
+		if err != nil {
+			return err
+		}
+		pc.PurgePIN()
+		promptPIN = "654321"
+		err = sign(key)
+		promptPIN = pin
+		var pinErr *openpgp.PINError
+		if !errors.As(err, &pinErr) || pinErr.Retries != 2 || emu.PINRetries() != 2 {
+			return fmt.Errorf("signing with a wrong PIN returned %v, %d tries left", err, emu.PINRetries())
+		}
+		if pc.PINCached() {
+			return fmt.Errorf("wrong PIN was cached")
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		if emu.PINRetries() != 3 {
+			return fmt.Errorf("tries were not reset by the right PIN")
+		}
+		return nil
+	})
+
+	check(t, "aut reset card", func() error {
+		key, _, err := load(openpgp.KeyAuthentication)
+		if err != nil {
+			return err
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		emu.Reset()
+		prompts = 0
+		if err = sign(key); err != nil {
+			return err
+		}
+		if prompts != 0 {
+			return fmt.Errorf("PIN prompt after a reset although the PIN is cached")
+		}
+		return nil
+	})
+
+	check(t, "aut moved card", func() error {
+		key, _, err := load(openpgp.KeyAuthentication)
+		if err != nil {
+			return err
+		}
+		readers.Remove(reader)
+		if err = sign(key); err == nil {
+			return fmt.Errorf("signing with a removed card succeeded")
+		}
+		readers.Insert("Emulated Reader 1", emu)
+		defer func() {
+			readers.Remove("Emulated Reader 1")
+			readers.Insert(reader, emu)
+		}()
+		if err = sign(key); err != nil {
+			return fmt.Errorf("card in another reader: %w", err)
+		}
+		return nil
+	})
+
+	check(t, "aut other card", func() error {
+		readers.Insert(reader, others[0])
+		defer readers.Insert(reader, emu)
+
+		if key, err := b.Load(&KeyConfig{Name: "openpgp-aut", Type: TYPE_OPENPGP, Token: id, KeyID: "aut"}); err == nil {
+			key.Close()
+			return fmt.Errorf("key was loaded from another card")
+		}
+		return nil
+	})
+
+	check(t, "aut change pin", func() error {
+		const newPIN = "13572468"
+		key, pc, err := load(openpgp.KeyAuthentication)
+		if err != nil {
+			return err
+		}
+		pm, ok := key.(pinManagerProvider).pinManager()
+		if !ok {
+			return fmt.Errorf("key has no PIN management")
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		var pinErr *openpgp.PINError
+		if err = pm.ChangePIN("654321", newPIN); !errors.As(err, &pinErr) || pinErr.Retries != 2 {
+			return fmt.Errorf("changing the PIN with a wrong one returned %v", err)
+		}
+		if err = pm.ChangePIN(pin, newPIN); err != nil {
+			return err
+		}
+		if pc.PINCached() {
+			return fmt.Errorf("old PIN still cached after the change")
+		}
+		promptPIN = newPIN
+		defer func() { promptPIN = pin }()
+		// the signature key shares PW1
+		sigKey, _, err := load(openpgp.KeySignature)
+		if err != nil {
+			return err
+		}
+		if err = sign(sigKey); err != nil {
+			return err
+		}
+		return pm.ChangePIN(newPIN, pin)
+	})
+
+	check(t, "aut reset code", func() error {
+		const resetCode = "87654321"
+		key, pc, err := load(openpgp.KeyAuthentication)
+		if err != nil {
+			return err
+		}
+		pm, _ := key.(pinManagerProvider).pinManager()
+		if status, err := pm.PINStatus(); err != nil || status.UnblockRetries != 0 {
+			return fmt.Errorf("PIN status %v without a reset code: %v", status, err)
+		}
+		if err = pm.UnblockPIN(resetCode, pin); !errors.Is(err, openpgp.ErrResetCodeBlocked) {
+			return fmt.Errorf("unblocking without a reset code returned %v", err)
+		}
+
+		emu.SetResetCode(resetCode)
+		for i := 0; i < 3; i++ {
+			pm.ChangePIN("654321", pin)
+		}
+		status, err := pm.PINStatus()
+		if err != nil || status.Retries != 0 || !status.Low() {
+			return fmt.Errorf("PIN status %v after three wrong PINs: %v", status, err)
+		}
+		pc.PurgePIN()
+		if err = sign(key); err == nil {
+			return fmt.Errorf("signing with a blocked PIN succeeded")
+		}
+		var pinErr *openpgp.PINError
+		if err = pm.UnblockPIN("12345678", pin); !errors.As(err, &pinErr) || !pinErr.ResetCode {
+			return fmt.Errorf("unblocking with a wrong reset code returned %v", err)
+		}
+		if err = pm.UnblockPIN(resetCode, pin); err != nil {
+			return err
+		}
+		if status, err = pm.PINStatus(); err != nil || status.Retries != 3 || status.UnblockRetries != 3 {
+			return fmt.Errorf("PIN status %v after unblocking: %v", status, err)
+		}
+		return sign(key)
+	})
+}
+
+// TestOpenPGPScript replays openPGPScript and a session recorded with the emulator
+func TestOpenPGPScript(t *testing.T) {
+	check(t, "script", func() error {
+		script, err := scard.ParseScript(strings.NewReader(openPGPScript))
+		if err != nil {
+			return err
+		}
+		card := openpgp.New(script)
+		if err = card.Select(); err != nil {
+			return err
+		}
+		id, err := card.ID()
+		if err != nil {
+			return err
+		}
+		if id != "000F00001234" {
+			return fmt.Errorf("card id %s", id)
+		}
+
+		data, err := card.ApplicationData()
+		if err != nil {
+			return err
+		}
+		if data.Version() != "3.3" || data.Manufacturer() != 0x000F || data.PW1Once || data.PW1Retries != 3 {
+			return fmt.Errorf("version %s, manufacturer %04X, PW1 once %v, %d tries", data.Version(), data.Manufacturer(), data.PW1Once, data.PW1Retries)
+		}
+		attrs := data.Attributes[openpgp.KeyAuthentication]
+		if attrs.Algorithm != openpgp.AlgECDSA || attrs.Curve != openpgp.CurveP256 {
+			return fmt.Errorf("authentication key attributes %s", attrs)
+		}
+		if _, ok := data.Fingerprints[openpgp.KeySignature]; ok || len(data.Fingerprints) != 1 {
+			return fmt.Errorf("%d keys with fingerprints, expected the authentication key", len(data.Fingerprints))
+		}
+
+		pub, err := card.PublicKey(openpgp.KeyAuthentication, attrs)
+		if err != nil {
+			return err
+		}
+		ecPub, ok := pub.(*ecdsa.PublicKey)
+		if !ok || ecPub.X.Cmp(elliptic.P256().Params().Gx) != 0 || ecPub.Y.Cmp(elliptic.P256().Params().Gy) != 0 {
+			return fmt.Errorf("public key %v", pub)
+		}
+		touch, err := card.Touch(openpgp.KeyAuthentication)
+		if err != nil || touch {
+			return fmt.Errorf("touch %v, %v", touch, err)
+		}
+
+		retries, verified, err := card.PINRetries(openpgp.KeyAuthentication)
+		if err != nil {
+			return err
+		}
+		if retries != 3 || verified {
+			return fmt.Errorf("%d tries left, verified %v", retries, verified)
+		}
+		var pinErr *openpgp.PINError
+		if err = card.VerifyPIN(openpgp.KeyAuthentication, "123456"); !errors.As(err, &pinErr) || pinErr.Retries != 2 {
+			return fmt.Errorf("wrong PIN returned %v", err)
+		}
+
+		signature, err := card.Sign(openpgp.KeyAuthentication, pub, bytes.Repeat([]byte{0x42}, 32))
+		if err != nil {
+			return err
+		}
+		var rs struct{ R, S *big.Int }
+		if _, err = asn1.Unmarshal(signature, &rs); err != nil {
+			return err
+		}
+		if !bytes.Equal(rs.R.Bytes(), bytes.Repeat([]byte{0x11}, 32)) || !bytes.Equal(rs.S.Bytes(), bytes.Repeat([]byte{0x22}, 32)) {
+			return fmt.Errorf("signature %X", signature)
+		}
+		return script.Done()
+	})
+
+	check(t, "recorded script", func() error {
+		emu := openpgp.NewEmulator(1, "123456")
+		if _, err := emu.GenerateKey(openpgp.KeySignature, openpgp.Attributes{Algorithm: openpgp.AlgRSA, RSABits: 4096}); err != nil {
+			return err
+		}
+
+		session := func(card *openpgp.Card) ([]byte, error) {
+			if err := card.Select(); err != nil {
+				return nil, err
+			}
+			data, err := card.ApplicationData()
+			if err != nil {
+				return nil, err
+			}
+			pub, err := card.PublicKey(openpgp.KeySignature, data.Attributes[openpgp.KeySignature])
+			if err != nil {
+				return nil, err
+			}
+			if err := card.VerifyPIN(openpgp.KeySignature, "123456"); err != nil {
+				return nil, err
+			}
+			digestInfo := append(append([]byte{}, pkcs1DigestInfo[crypto.SHA256]...), bytes.Repeat([]byte{0x42}, 32)...)
+			return card.Sign(openpgp.KeySignature, pub, digestInfo)
+		}
+
+		var recording bytes.Buffer
+		recorded, err := session(openpgp.New(&scard.Recorder{Transmitter: emu, W: &recording}))
+		if err != nil {
+			return err
+		}
+		script, err := scard.ParseScript(&recording)
+		if err != nil {
+			return err
+		}
+		replayed, err := session(openpgp.New(script))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(recorded, replayed) {
+			return fmt.Errorf("replayed signature differs")
+		}
+		return script.Done()
+	})
+}
@@ -0,0 +1,163 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// lowPINRetries is the number of tries left from which the agent warns that a PIN is about to be blocked, the
+// smart card PIN prompt says the same
+const lowPINRetries = 2
+
+// ErrPINManagementNotSupported is returned for keys whose PIN or password can't be changed by the agent
+var ErrPINManagementNotSupported = errors.New("the PIN of this key can't be changed here")
+
+// ErrUnblockNotSupported is returned for keys whose PIN has no PUK or reset code the agent can use
+var ErrUnblockNotSupported = errors.New("the PIN of this key can't be unblocked here")
+
+// PINStatus is what a key's provider tells about its PIN or password
+type PINStatus struct {
+	// Retries and MaxRetries are the tries of the PIN, -1 when the provider doesn't tell
+	Retries    int
+	MaxRetries int
+	// Unblock names what unblocks the PIN, like "PUK", empty when the PIN can't be unblocked here. UnblockRetries
+	// are its tries left, -1 when the provider doesn't tell.
+	Unblock        string
+	UnblockRetries int
+}
+
+// Low reports whether the PIN is blocked or about to be
+func (s *PINStatus) Low() bool {
+	return s.Retries >= 0 && s.Retries <= lowPINRetries && s.Retries != s.MaxRetries
+}
+
+func (s *PINStatus) String() string {
+	var text string
+	switch {
+	case s.Retries == 0:
+		text = "blocked"
+	case s.Retries < 0:
+		text = "tries left unknown"
+	case s.MaxRetries > 0:
+		text = fmt.Sprintf("%d of %d tries left", s.Retries, s.MaxRetries)
+	default:
+		text = fmt.Sprintf("%d tries left", s.Retries)
+	}
+	if s.Unblock != "" && s.UnblockRetries >= 0 {
+		text += fmt.Sprintf(", %s %d tries left", s.Unblock, s.UnblockRetries)
+	}
+	return text
+}
+
+// pinManager is implemented by keys or their signers whose PIN or password the agent can change. The providers are
+// reached through interfaces that have emulators: scard.Transmitter for PIV and OpenPGP cards and ncrypt.API for the
+// Platform Crypto Provider.
+type pinManager interface {
+	// managesPIN reports whether the key's provider supports changing its PIN
+	managesPIN() bool
+	PINStatus() (*PINStatus, error)
+	ChangePIN(oldPIN, newPIN string) error
+	// UnblockPIN sets a new PIN with the PUK or reset code, ErrUnblockNotSupported when there is none
+	UnblockPIN(puk, newPIN string) error
+}
+
+// pinManagerProvider is implemented by backend keys whose signer manages the PIN
+type pinManagerProvider interface {
+	pinManager() (pinManager, bool)
+}
+
+func (k *Key) pinManager() (pinManager, bool) {
+	if k.key == nil {
+		return nil, false
+	}
+	if pm, ok := k.key.(pinManager); ok && pm.managesPIN() {
+		return pm, true
+	}
+	if p, ok := k.key.(pinManagerProvider); ok {
+		if pm, ok := p.pinManager(); ok && pm.managesPIN() {
+			return pm, true
+		}
+	}
+	return nil, false
+}
+
+// PINManageable reports whether the agent can change the key's PIN or password
+func (k *Key) PINManageable() bool {
+	_, ok := k.pinManager()
+	return ok
+}
+
+// PINStatus reads the tries left for the key's PIN without using it
+func (k *Key) PINStatus() (*PINStatus, error) {
+	pm, ok := k.pinManager()
+	if !ok {
+		return nil, ErrPINManagementNotSupported
+	}
+	return pm.PINStatus()
+}
+
+// ChangeKeyPIN changes the PIN or password of a key. The PINs of smart cards are shared by all keys on the card.
+func (km *KeyManager) ChangeKeyPIN(name string, oldPIN, newPIN string) error {
+	k, pm, err := km.pinManagedKey(name)
+	if err != nil {
+		return err
+	}
+	if err = pm.ChangePIN(oldPIN, newPIN); err != nil {
+		km.checkPINRetries(k)
+		return fmt.Errorf("changing the PIN of key %s failed: %w", name, err)
+	}
+	log.Printf("Changed the PIN of key %s", name)
+	return nil
+}
+
+// UnblockKeyPIN sets a new PIN for a key with its PUK or reset code
+func (km *KeyManager) UnblockKeyPIN(name string, puk, newPIN string) error {
+	k, pm, err := km.pinManagedKey(name)
+	if err != nil {
+		return err
+	}
+	if err = pm.UnblockPIN(puk, newPIN); err != nil {
+		km.checkPINRetries(k)
+		return fmt.Errorf("unblocking the PIN of key %s failed: %w", name, err)
+	}
+	log.Printf("Unblocked the PIN of key %s", name)
+	return nil
+}
+
+func (km *KeyManager) pinManagedKey(name string) (*Key, pinManager, error) {
+	k, ok := km.Keys[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("no key named %s", name)
+	}
+	pm, ok := k.pinManager()
+	if !ok {
+		return nil, nil, ErrPINManagementNotSupported
+	}
+	return k, pm, nil
+}
+
+// checkPINRetries warns with a notification when the PIN of a key is blocked or about to be
+func (km *KeyManager) checkPINRetries(k *Key) {
+	status, err := k.PINStatus()
+	if err != nil || !status.Low() {
+		return
+	}
+
+	msg := NotifyMsg{Title: "PIN about to be blocked"}
+	if status.Retries == 0 {
+		msg.Title = "PIN blocked"
+		msg.Message = fmt.Sprintf("The PIN of key \"%s\" is blocked", k.Name)
+		if status.Unblock != "" {
+			msg.Message += fmt.Sprintf(", unblock it with the %s", status.Unblock)
+		}
+	} else {
+		msg.Message = fmt.Sprintf("The PIN of key \"%s\" has %s", k.Name, status)
+	}
+	msg.Icon.DLL = "imageres"
+	msg.Icon.Index = 100
+	msg.Icon.Size = 32
+
+	log.Printf("%s: %s", msg.Title, msg.Message)
+	km.Notify(msg)
+}
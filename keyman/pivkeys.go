@@ -0,0 +1,563 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"math/big"
+	"ncryptagent/ncrypt"
+	"ncryptagent/piv"
+	"ncryptagent/scard"
+	"time"
+)
+
+const TYPE_PIV = "PIV"
+
+// CreateNewPIVKey generates a key on a PIV card, token and reader choose the card and may be empty when only one is
+// present, see PIVBackend.Create
+func (km *KeyManager) CreateNewPIVKey(keyName string, token string, reader string, slot string, algorithm string, bits int, opts CreateOptions) (*Key, error) {
+	return km.CreateKey(&KeyConfig{
+		Name:         keyName,
+		Type:         TYPE_PIV,
+		Token:        token,
+		ProviderName: reader,
+		KeyID:        slot,
+		Algorithm:    algorithm,
+		Length:       bits,
+	}, opts)
+}
+
+// PIVCards lists the PIV cards in the readers for choosing where to generate a key
+func (km *KeyManager) PIVCards() ([]PIVCard, error) {
+	b, ok := km.backends[TYPE_PIV].(*PIVBackend)
+	if !ok {
+		return nil, fmt.Errorf("the PIV backend is not available")
+	}
+	return b.Cards()
+}
+
+// PIVBackend uses keys in the PIV applet of smart cards and YubiKeys, talking to the applet with APDUs instead of
+// going through the smart card minidriver. KeyConfig.Token is the card's serial number (or the GUID of cards without
+// one), KeyID the slot in hex like "9a" and ProviderName the reader the card was last seen in.
+type PIVBackend struct {
+	cards *smartCards
+}
+
+// NewPIVBackend returns a PIV backend finding cards with connector, scard.System() for the PC/SC readers, and asking
+// for PINs with prompt
+func NewPIVBackend(prompt PINPrompt, connector scard.Connector) *PIVBackend {
+	return &PIVBackend{cards: newSmartCards(pivApplet{}, connector, prompt)}
+}
+
+func (b *PIVBackend) Type() string {
+	return TYPE_PIV
+}
+
+func (b *PIVBackend) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: true, Touch: true, Create: true}
+}
+
+func (b *PIVBackend) Load(kc *KeyConfig) (BackendKey, error) {
+	if kc.KeyID == "" {
+		return nil, fmt.Errorf("no PIV slot configured for key %s", kc.Name)
+	}
+	slot, err := piv.ParseSlot(kc.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	cards, err := b.cards.present(kc.ProviderName)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cards {
+		if kc.Token != "" && c.id != kc.Token {
+			continue
+		}
+
+		info, err := pivSlotInfoOf(c, slot)
+		if err != nil {
+			if kc.Token != "" {
+				return nil, err
+			}
+			continue
+		}
+
+		kc.Token = c.id
+		kc.ProviderName = c.currentReader()
+		return newPIVKey(c, kc, slot, info)
+	}
+
+	if kc.Token != "" {
+		return nil, fmt.Errorf("card %s is not present", kc.Token)
+	}
+	return nil, fmt.Errorf("no card with a key in PIV slot %s found", slot)
+}
+
+// Create generates a key with GENERATE ASYMMETRIC in the slot kc.KeyID, 9a when it is empty, of the card kc.Token or
+// the card in reader kc.ProviderName, or else the only card present. A slot holding a key is refused rather than
+// overwritten. With opts.Certificate a self-signed certificate is written to the slot, which the smart card minidriver
+// needs to see the key; signing it takes the PIN.
+func (b *PIVBackend) Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error) {
+	if kc.KeyID == "" {
+		kc.KeyID = piv.SlotAuthentication.String()
+	}
+	slot, err := piv.ParseSlot(kc.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	alg, err := pivAlgorithm(kc.Algorithm, kc.Length)
+	if err != nil {
+		return nil, err
+	}
+	pinPolicy, err := piv.ParsePINPolicy(opts.PINPolicy)
+	if err != nil {
+		return nil, err
+	}
+	touchPolicy, err := piv.ParseTouchPolicy(opts.TouchPolicy)
+	if err != nil {
+		return nil, err
+	}
+	c, err := b.cardFor(kc)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &pivSlotInfo{pinPolicy: pinPolicy, touchPolicy: touchPolicy}
+	err = c.withApplet(func(t scard.Transmitter) error {
+		card := piv.New(t)
+		if _, err := card.PublicKey(slot); !errors.Is(err, piv.ErrNotFound) {
+			if err == nil {
+				return fmt.Errorf("%s of card %s already holds a key", slot.Name(), c.id)
+			}
+			return err
+		}
+		if err := pivAuthenticate(card, opts.ManagementKey); err != nil {
+			return err
+		}
+		log.Printf("Generating a %s key in %s of card %s", alg, slot.Name(), c.id)
+		if touchPolicy == piv.TouchPolicyAlways || touchPolicy == piv.TouchPolicyCached {
+			log.Printf("Touch card %s if it blinks", c.id)
+		}
+		var err error
+		info.public, err = card.GenerateKey(slot, alg, pinPolicy, touchPolicy)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("generating a key on card %s failed: %w", c.id, err)
+	}
+
+	// the card tells the policies it applied, cards without the YubiKey extensions have their own defaults
+	if got, err := pivSlotInfoOf(c, slot); err == nil {
+		info.pinPolicy, info.touchPolicy = got.pinPolicy, got.touchPolicy
+	} else if info.pinPolicy == piv.PINPolicyDefault {
+		info.pinPolicy = piv.PINPolicyOnce
+	}
+
+	kc.Type = TYPE_PIV
+	kc.Token = c.id
+	kc.ProviderName = c.currentReader()
+	kc.KeyID = slot.String()
+	kc.ContainerName = slot.Name()
+	kc.NoPin = info.pinPolicy == piv.PINPolicyNever
+	kc.Algorithm, kc.Length = publicKeyAlgorithm(info.public)
+
+	key, err := newPIVKey(c, kc, slot, info)
+	if err != nil {
+		return nil, err
+	}
+	kc.SSHPublicKey = string(ssh.MarshalAuthorizedKey(key.Public()))
+	if opts.Certificate {
+		if err = writePIVCertificate(c, kc.Name, slot, key, opts.ManagementKey); err != nil {
+			return nil, fmt.Errorf("the key was generated in %s of card %s but writing its certificate failed: %w", slot.Name(), c.id, err)
+		}
+	}
+	return key, nil
+}
+
+// cardFor returns the card a new key goes on
+func (b *PIVBackend) cardFor(kc *KeyConfig) (*smartCard, error) {
+	cards, err := b.cards.present(kc.ProviderName)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cards {
+		if kc.Token != "" && c.id == kc.Token {
+			return c, nil
+		}
+		if kc.Token == "" && kc.ProviderName != "" && c.currentReader() == kc.ProviderName {
+			return c, nil
+		}
+	}
+	switch {
+	case kc.Token != "":
+		return nil, fmt.Errorf("card %s is not present", kc.Token)
+	case kc.ProviderName != "":
+		return nil, fmt.Errorf("no PIV card in reader %s", kc.ProviderName)
+	case len(cards) == 0:
+		return nil, fmt.Errorf("no PIV card present")
+	case len(cards) > 1:
+		return nil, fmt.Errorf("%d PIV cards are present, choose one", len(cards))
+	}
+	return cards[0], nil
+}
+
+// pivAlgorithm returns the PIV algorithm of a KeyConfig algorithm, ECDSA P-256 when it is empty
+func pivAlgorithm(algorithm string, length int) (piv.Algorithm, error) {
+	switch algorithm {
+	case "", ncrypt.ALG_ECDSA_P256:
+		return piv.AlgECCP256, nil
+	case ncrypt.ALG_ECDSA_P384:
+		return piv.AlgECCP384, nil
+	case ALG_ED25519:
+		return piv.AlgEd25519, nil
+	case ncrypt.ALG_RSA:
+		switch length {
+		case 0, 2048:
+			return piv.AlgRSA2048, nil
+		case 1024:
+			return piv.AlgRSA1024, nil
+		case 3072:
+			return piv.AlgRSA3072, nil
+		case 4096:
+			return piv.AlgRSA4096, nil
+		}
+		return 0, fmt.Errorf("unsupported RSA key length %d", length)
+	}
+	return 0, fmt.Errorf("unsupported algorithm %s", algorithm)
+}
+
+// pivAuthenticate authenticates with a management key in hex, the default one when it is empty
+func pivAuthenticate(card *piv.Card, managementKey string) error {
+	alg, err := card.ManagementKeyAlgorithm()
+	if err != nil {
+		return err
+	}
+	mk := piv.DefaultManagementKey
+	if managementKey == "" {
+		// YubiKeys from firmware 5.7 have the default key as an AES-192 key
+		if alg != piv.AlgTDES && alg != piv.AlgAES192 {
+			return fmt.Errorf("the card has an %s management key, which is not the default one: %w", alg, piv.ErrManagementKey)
+		}
+		mk.Algorithm = alg
+	} else if mk, err = piv.ParseManagementKey(managementKey, alg); err != nil {
+		return err
+	}
+	return card.Authenticate(mk)
+}
+
+// writePIVCertificate writes a self-signed certificate for the new key in a slot
+func writePIVCertificate(c *smartCard, name string, slot piv.Slot, key *pivKey, managementKey string) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, OrganizationalUnit: []string{"nCryptAgent"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(20, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.signer.Public(), key.signer)
+	if err != nil {
+		return err
+	}
+	return c.withApplet(func(t scard.Transmitter) error {
+		card := piv.New(t)
+		if err := pivAuthenticate(card, managementKey); err != nil {
+			return err
+		}
+		return card.PutCertificate(slot, der)
+	})
+}
+
+func (b *PIVBackend) Delete(kc *KeyConfig, key BackendKey) error {
+	return fmt.Errorf("deleting PIV keys is not supported")
+}
+
+// Close forgets the PINs and disconnects from the cards
+func (b *PIVBackend) Close() error {
+	b.cards.close()
+	return nil
+}
+
+// Keys lists the keys on the PIV cards in the readers, as configs that load them
+func (b *PIVBackend) Keys() ([]*KeyConfig, error) {
+	cards, err := b.cards.present("")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*KeyConfig
+	for _, c := range cards {
+		for _, slot := range piv.Slots {
+			info, err := pivSlotInfoOf(c, slot)
+			if err != nil {
+				if !errors.Is(err, piv.ErrNotFound) {
+					log.Printf("Reading PIV slot %s of card %s failed: %s", slot, c.id, err)
+				}
+				continue
+			}
+			sshPub, err := ssh.NewPublicKey(info.public)
+			if err != nil {
+				continue
+			}
+
+			kc := &KeyConfig{
+				Name:          fmt.Sprintf("PIV %s %s", c.id, slot),
+				Type:          TYPE_PIV,
+				ContainerName: slot.Name(),
+				ProviderName:  c.currentReader(),
+				Token:         c.id,
+				KeyID:         slot.String(),
+				SSHPublicKey:  string(ssh.MarshalAuthorizedKey(sshPub)),
+				NoPin:         info.pinPolicy == piv.PINPolicyNever,
+			}
+			kc.Algorithm, kc.Length = publicKeyAlgorithm(info.public)
+			keys = append(keys, kc)
+		}
+	}
+	return keys, nil
+}
+
+// PIVCard is a PIV card in a reader, with the slots that hold no key
+type PIVCard struct {
+	ID     string
+	Reader string
+	Free   []piv.Slot
+}
+
+// Cards lists the PIV cards in the readers
+func (b *PIVBackend) Cards() ([]PIVCard, error) {
+	cards, err := b.cards.present("")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []PIVCard
+	for _, c := range cards {
+		pc := PIVCard{ID: c.id, Reader: c.currentReader()}
+		err := c.withApplet(func(t scard.Transmitter) error {
+			card := piv.New(t)
+			for _, slot := range piv.Slots {
+				_, err := card.PublicKey(slot)
+				if errors.Is(err, piv.ErrNotFound) {
+					pc.Free = append(pc.Free, slot)
+				} else if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Reading the slots of card %s failed: %s", c.id, err)
+			continue
+		}
+		list = append(list, pc)
+	}
+	return list, nil
+}
+
+// pivApplet is the PIV applet for the smart card handling shared with other applets
+type pivApplet struct{}
+
+func (pivApplet) Name() string {
+	return "PIV"
+}
+
+func (pivApplet) Select(t scard.Transmitter) error {
+	return piv.New(t).Select()
+}
+
+func (pivApplet) ID(t scard.Transmitter) (string, error) {
+	return piv.New(t).ID()
+}
+
+func (pivApplet) ClearPIN(t scard.Transmitter) error {
+	return piv.New(t).ClearPIN()
+}
+
+func (pivApplet) PINRejected(err error) bool {
+	var pinErr *piv.PINError
+	return errors.As(err, &pinErr) || errors.Is(err, piv.ErrPINBlocked)
+}
+
+// pivSlotInfo is what the agent needs to know of a slot
+type pivSlotInfo struct {
+	public      crypto.PublicKey
+	pinPolicy   byte
+	touchPolicy byte
+}
+
+func pivSlotInfoOf(c *smartCard, slot piv.Slot) (*pivSlotInfo, error) {
+	info := &pivSlotInfo{pinPolicy: piv.PINPolicyOnce}
+	if slot == piv.SlotCardAuthentication {
+		info.pinPolicy = piv.PINPolicyNever
+	}
+	err := c.withApplet(func(t scard.Transmitter) error {
+		card := piv.New(t)
+		var err error
+		if info.public, err = card.PublicKey(slot); err != nil {
+			return err
+		}
+		// only YubiKeys tell the policies of a slot
+		if m, err := card.Metadata(slot); err == nil {
+			if m.PINPolicy != piv.PINPolicyDefault {
+				info.pinPolicy = m.PINPolicy
+			}
+			info.touchPolicy = m.TouchPolicy
+		}
+		return nil
+	})
+	return info, err
+}
+
+func newPIVKey(c *smartCard, kc *KeyConfig, slot piv.Slot, info *pivSlotInfo) (*pivKey, error) {
+	if _, err := piv.AlgorithmOf(info.public); err != nil {
+		return nil, err
+	}
+	signer := &pivSigner{card: c, name: kc.Name, slot: slot, info: info}
+	caps := KeyCapabilities{
+		PIN:   info.pinPolicy != piv.PINPolicyNever,
+		Touch: info.touchPolicy == piv.TouchPolicyAlways || info.touchPolicy == piv.TouchPolicyCached,
+	}
+	sk, err := newSignerKey(signer, caps)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, length := publicKeyAlgorithm(info.public)
+	return &pivKey{signerKey: sk, algorithm: algorithm, length: length}, nil
+}
+
+// pivKey is a key in a slot of a PIV card
+type pivKey struct {
+	*signerKey
+	algorithm string
+	length    int
+}
+
+func (k *pivKey) Algorithm() (string, int) {
+	return k.algorithm, k.length
+}
+
+// pivSigner signs with GENERAL AUTHENTICATE
+type pivSigner struct {
+	card    *smartCard
+	name    string
+	slot    piv.Slot
+	info    *pivSlotInfo
+	timeout int
+}
+
+func (s *pivSigner) Public() crypto.PublicKey {
+	return s.info.public
+}
+
+func (s *pivSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, isRSAPSS := opts.(*rsa.PSSOptions); isRSAPSS {
+		return nil, fmt.Errorf("RSA-PSS signing is not supported")
+	}
+
+	switch s.info.public.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := pkcs1DigestInfo[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported RSA hash algorithm %v", opts.HashFunc())
+		}
+		return s.sign(append(append([]byte{}, prefix...), digest...))
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return s.sign(digest)
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", s.info.public)
+	}
+}
+
+func (s *pivSigner) sign(data []byte) ([]byte, error) {
+	c := s.card
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var signature []byte
+	err := c.withAppletLocked(func(t scard.Transmitter) error {
+		card := piv.New(t)
+		if s.info.pinPolicy != piv.PINPolicyNever {
+			err := c.verifyLocked(s.name, card.PINRetries, card.VerifyPIN)
+			if err != nil {
+				return err
+			}
+		}
+		if s.info.touchPolicy == piv.TouchPolicyAlways || s.info.touchPolicy == piv.TouchPolicyCached {
+			log.Printf("Touch card %s to sign with key %s", c.id, s.name)
+		}
+		var err error
+		signature, err = card.Sign(s.slot, s.info.public, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.handlePinTimerLocked(s.timeout)
+	return signature, nil
+}
+
+// PINCached reports whether the card's PIN is cached
+func (s *pivSigner) PINCached() bool {
+	return s.card.pinCached()
+}
+
+// PurgePIN forgets the card's PIN, for all keys on it
+func (s *pivSigner) PurgePIN() {
+	s.card.purgePIN()
+}
+
+func (s *pivSigner) SetPINTimeout(timeout int) {
+	s.timeout = timeout
+}
+
+func (s *pivSigner) managesPIN() bool {
+	return true
+}
+
+// PINStatus reads the tries left for the card's PIN and PUK
+func (s *pivSigner) PINStatus() (*PINStatus, error) {
+	var status *piv.PINStatus
+	err := s.card.withApplet(func(t scard.Transmitter) error {
+		var err error
+		status, err = piv.New(t).PINStatus()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PINStatus{
+		Retries:        status.Retries,
+		MaxRetries:     status.MaxRetries,
+		Unblock:        "PUK",
+		UnblockRetries: status.PUKRetries,
+	}, nil
+}
+
+// ChangePIN changes the card's PIN, for all keys on it
+func (s *pivSigner) ChangePIN(oldPIN, newPIN string) error {
+	return s.card.managePIN(func(t scard.Transmitter) error {
+		return piv.New(t).ChangePIN(oldPIN, newPIN)
+	})
+}
+
+// UnblockPIN sets a new PIN for the card with its PUK
+func (s *pivSigner) UnblockPIN(puk, newPIN string) error {
+	return s.card.managePIN(func(t scard.Transmitter) error {
+		return piv.New(t).UnblockPIN(puk, newPIN)
+	})
+}
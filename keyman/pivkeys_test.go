@@ -0,0 +1,527 @@
+package keyman
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"ncryptagent/ncrypt"
+	"ncryptagent/piv"
+	"ncryptagent/scard"
+	"strings"
+	"testing"
+)
+
+// pivScript is a recorded session with a PIV card that is not a YubiKey: it has no serial number, so it is told apart
+// by the GUID of its CHUID, which it returns in two parts. It asks for the version again with the right length and
+// rejects a wrong PIN.
+const pivScript = `
+# SELECT PIV
+> 00 A4 04 00 05 A0 00 00 03 08 00
+< 61 11 4F 06 00 00 10 00 01 00 79 07 4F 05 A0 00 00 03 08 90 00
+# GET SERIAL, not a YubiKey
+> 00 F8 00 00 00
+< 6D 00
+# GET DATA CHUID, the second part with GET RESPONSE
+> 00 CB 3F FF 05 5C 03 5F C1 02 00
+< 53 12 34 10 00 11 22 33 44 55 61 0A
+> 00 C0 00 00 0A
+< 66 77 88 99 AA BB CC DD EE FF 90 00
+# GET VERSION, the card wants Le 03
+> 00 FD 00 00 00
+< 6C 03
+> 00 FD 00 00 03
+< 05 04 03 90 00
+# VERIFY without a PIN returns the tries left
+> 00 20 00 80
+< 63 C2
+# VERIFY 123456
+> 00 20 00 80 08 31 32 33 34 35 36 FF FF
+< 63 C1
+`
+
+const pivTestPIN = "123456"
+
+// newPIVTestCard returns an emulated card with serial number 12345678 and keys in five slots, in a virtual reader
+func newPIVTestCard(t *testing.T, pin string) (*piv.Emulator, *scard.Virtual) {
+	t.Helper()
+	emu := piv.NewEmulator(12345678, pin)
+	for _, k := range []struct {
+		slot piv.Slot
+		alg  piv.Algorithm
+		cert bool
+	}{
+		{piv.SlotAuthentication, piv.AlgECCP256, true},
+		{piv.SlotSignature, piv.AlgRSA2048, true},
+		{piv.SlotKeyManagement, piv.AlgECCP384, false},
+		{piv.SlotCardAuthentication, piv.AlgECCP256, true},
+		{0x82, piv.AlgEd25519, false},
+	} {
+		if _, err := emu.GenerateKey(k.slot, k.alg, piv.PINPolicyDefault, k.cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readers := scard.NewVirtual()
+	readers.Insert("Emulated Reader 0", emu)
+	return emu, readers
+}
+
+// TestPIVEmulation runs the PIV backend on a piv.Emulator in a virtual reader: the PIN cache, a card that was reset or
+// moved to another reader, another card in the reader and changing and unblocking the PIN
+func TestPIVEmulation(t *testing.T) {
+	const pin = pivTestPIN
+	const reader = "Emulated Reader 0"
+
+	emu, readers := newPIVTestCard(t, pin)
+
+	prompts := 0
+	promptPIN := pin
+	prompt := func(title, message string) ([]byte, bool) {
+		prompts++
+		return []byte(promptPIN), true
+	}
+
+	b := NewPIVBackend(prompt, readers)
+	defer b.Close()
+	check(t, "keys", func() error {
+		keys, err := b.Keys()
+		if err != nil {
+			return err
+		}
+		if len(keys) != 5 {
+			return fmt.Errorf("listed %d keys, expected 5", len(keys))
+		}
+		return nil
+	})
+
+	load := func(slot piv.Slot) (BackendKey, pinCache, error) {
+		key, err := b.Load(&KeyConfig{Name: "piv-" + slot.String(), Type: TYPE_PIV, Token: "12345678", KeyID: slot.String()})
+		if err != nil {
+			return nil, nil, err
+		}
+		provider, ok := key.(pinCacheProvider)
+		if !ok {
+			return nil, nil, fmt.Errorf("key has no PIN cache")
+		}
+		pc, ok := provider.pinCache()
+		if !ok {
+			return nil, nil, fmt.Errorf("key has no PIN cache")
+		}
+		pc.SetPINTimeout(60)
+		return key, pc, nil
+	}
+	sign := func(key BackendKey) error {
+		data := []byte("pivemulation")
+		sig, err := key.Sign(data, "")
+		if err != nil {
+			return err
+		}
+		return key.Public().Verify(data, sig)
+	}
+
+	check(t, "9a pin cache", func() error {
+		key, pc, err := load(piv.SlotAuthentication)
+		if err != nil {
+			return err
+		}
+		prompts = 0
+		if err = sign(key); err != nil {
+			return err
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		if prompts != 1 || !pc.PINCached() {
+			return fmt.Errorf("%d PIN prompts for two signatures, cached %v", prompts, pc.PINCached())
+		}
+		pc.PurgePIN()
+		if pc.PINCached() {
+			return fmt.Errorf("PIN still cached after purge")
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		if prompts != 2 {
+			return fmt.Errorf("no PIN prompt after purge")
+		}
+		return nil
+	})
+
+	check(t, "9c pin always", func() error {
+		key, _, err := load(piv.SlotSignature)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2; i++ {
+			if err = sign(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	check(t, "9e no pin", func() error {
+		key, _, err := load(piv.SlotCardAuthentication)
+		if err != nil {
+			return err
+		}
+		if key.Capabilities().PIN {
+			return fmt.Errorf("card authentication key wants a PIN")
+		}
+		if c, ok := b.cards.get("12345678"); ok {
+			c.purgePIN()
+		}
+		prompts = 0
+		if err = sign(key); err != nil {
+			return err
+		}
+		if prompts != 0 {
+			return fmt.Errorf("PIN prompt for a key without PIN policy")
+		}
+		return nil
+	})
+
+	check(t, "9a wrong pin", func() error {
+		key, pc, err := load(piv.SlotAuthentication)
+		if err != nil {
+			return err
+		}
+		pc.PurgePIN()
+		promptPIN = "654321"
+		err = sign(key)
+		promptPIN = pin
+		var pinErr *piv.PINError
+		if !errors.As(err, &pinErr) || pinErr.Retries != 2 || emu.PINRetries() != 2 {
+			return fmt.Errorf("signing with a wrong PIN returned %v, %d tries left", err, emu.PINRetries())
+		}
+		if pc.PINCached() {
+			return fmt.Errorf("wrong PIN was cached")
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		if emu.PINRetries() != 3 {
+			return fmt.Errorf("tries were not reset by the right PIN")
+		}
+		return nil
+	})
+
+	check(t, "9a reset card", func() error {
+		key, _, err := load(piv.SlotAuthentication)
+		if err != nil {
+			return err
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		emu.Reset()
+		prompts = 0
+		if err = sign(key); err != nil {
+			return err
+		}
+		if prompts != 0 {
+			return fmt.Errorf("PIN prompt after a reset although the PIN is cached")
+		}
+		return nil
+	})
+
+	check(t, "9a moved card", func() error {
+		key, _, err := load(piv.SlotAuthentication)
+		if err != nil {
+			return err
+		}
+		readers.Remove(reader)
+		if err = sign(key); err == nil {
+			return fmt.Errorf("signing with a removed card succeeded")
+		}
+		readers.Insert("Emulated Reader 1", emu)
+		defer func() {
+			readers.Remove("Emulated Reader 1")
+			readers.Insert(reader, emu)
+		}()
+		if err = sign(key); err != nil {
+			return fmt.Errorf("card in another reader: %w", err)
+		}
+		return nil
+	})
+
+	check(t, "9a other card", func() error {
+		other := piv.NewEmulator(87654321, pin)
+		if _, err := other.GenerateKey(piv.SlotAuthentication, piv.AlgECCP256, piv.PINPolicyDefault, true); err != nil {
+			return err
+		}
+		readers.Insert(reader, other)
+		defer readers.Insert(reader, emu)
+
+		if key, err := b.Load(&KeyConfig{Name: "piv-9a", Type: TYPE_PIV, Token: "12345678", KeyID: "9a"}); err == nil {
+			key.Close()
+			return fmt.Errorf("key was loaded from another card")
+		}
+		return nil
+	})
+
+	check(t, "9a change pin", func() error {
+		const newPIN = "13572468"
+		key, pc, err := load(piv.SlotAuthentication)
+		if err != nil {
+			return err
+		}
+		pm, ok := key.(pinManagerProvider).pinManager()
+		if !ok {
+			return fmt.Errorf("key has no PIN management")
+		}
+		if err = sign(key); err != nil {
+			return err
+		}
+		var pinErr *piv.PINError
+		if err = pm.ChangePIN("654321", newPIN); !errors.As(err, &pinErr) || pinErr.Retries != 2 {
+			return fmt.Errorf("changing the PIN with a wrong one returned %v", err)
+		}
+		if status, err := pm.PINStatus(); err != nil || status.Retries != 2 || status.MaxRetries != 3 {
+			return fmt.Errorf("PIN status %v after a wrong PIN: %v", status, err)
+		}
+		if err = pm.ChangePIN(pin, newPIN); err != nil {
+			return err
+		}
+		if pc.PINCached() {
+			return fmt.Errorf("old PIN still cached after the change")
+		}
+		promptPIN = newPIN
+		defer func() { promptPIN = pin }()
+		if err = sign(key); err != nil {
+			return err
+		}
+		return pm.ChangePIN(newPIN, pin)
+	})
+
+	check(t, "9a unblock pin", func() error {
+		key, pc, err := load(piv.SlotAuthentication)
+		if err != nil {
+			return err
+		}
+		pm, _ := key.(pinManagerProvider).pinManager()
+		for i := 0; i < 3; i++ {
+			pm.ChangePIN("654321", pin)
+		}
+		status, err := pm.PINStatus()
+		if err != nil || status.Retries != 0 || !status.Low() {
+			return fmt.Errorf("PIN status %v after three wrong PINs: %v", status, err)
+		}
+		pc.PurgePIN()
+		if err = sign(key); err == nil {
+			return fmt.Errorf("signing with a blocked PIN succeeded")
+		}
+		var pinErr *piv.PINError
+		if err = pm.UnblockPIN("87654321", pin); !errors.As(err, &pinErr) || !pinErr.PUK || emu.PUKRetries() != 2 {
+			return fmt.Errorf("unblocking with a wrong PUK returned %v", err)
+		}
+		if err = pm.UnblockPIN("12345678", pin); err != nil {
+			return err
+		}
+		if status, err = pm.PINStatus(); err != nil || status.Retries != 3 || status.UnblockRetries != 3 {
+			return fmt.Errorf("PIN status %v after unblocking: %v", status, err)
+		}
+		return sign(key)
+	})
+}
+
+// TestPIVGenerate generates keys on an emulated card with another management key
+func TestPIVGenerate(t *testing.T) {
+	const managementKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	emu, readers := newPIVTestCard(t, pivTestPIN)
+	b := NewPIVBackend(func(title, message string) ([]byte, bool) { return []byte(pivTestPIN), true }, readers)
+	defer b.Close()
+
+	mk, err := piv.ParseManagementKey(managementKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emu.SetManagementKey(mk)
+
+	check(t, "87 generate", func() error {
+		kc := &KeyConfig{Name: "piv-87", Type: TYPE_PIV, Token: "12345678", KeyID: "87", Algorithm: ncrypt.ALG_ECDSA_P256}
+		key, err := b.Create(kc, CreateOptions{PINPolicy: "never", TouchPolicy: "cached", ManagementKey: managementKey, Certificate: true})
+		if err != nil {
+			return err
+		}
+		defer key.Close()
+		if caps := key.Capabilities(); caps.PIN || !caps.Touch || !kc.NoPin {
+			return fmt.Errorf("capabilities %+v of a key with PIN policy never and touch policy cached", caps)
+		}
+		if kc.ContainerName != piv.Slot(0x87).Name() || kc.ProviderName == "" {
+			return fmt.Errorf("config %+v", kc)
+		}
+		return checkPIVCertificate(b, kc, key)
+	})
+
+	check(t, "88 generate with pin", func() error {
+		kc := &KeyConfig{Name: "piv-88", Type: TYPE_PIV, Token: "12345678", KeyID: "88", Algorithm: ncrypt.ALG_RSA, Length: 2048}
+		key, err := b.Create(kc, CreateOptions{ManagementKey: managementKey, Certificate: true})
+		if err != nil {
+			return err
+		}
+		defer key.Close()
+		if !key.Capabilities().PIN || kc.NoPin {
+			return fmt.Errorf("key generated with the default PIN policy wants no PIN")
+		}
+		return checkPIVCertificate(b, kc, key)
+	})
+
+	check(t, "89 wrong management key", func() error {
+		kc := &KeyConfig{Name: "piv-89", Type: TYPE_PIV, Token: "12345678", KeyID: "89", Algorithm: ncrypt.ALG_ECDSA_P256}
+		key, err := b.Create(kc, CreateOptions{})
+		if err == nil {
+			key.Close()
+			return fmt.Errorf("generating with the default management key succeeded")
+		}
+		if !errors.Is(err, piv.ErrManagementKey) {
+			return fmt.Errorf("generating with the default management key returned %w", err)
+		}
+		return nil
+	})
+
+	check(t, "9a occupied slot", func() error {
+		kc := &KeyConfig{Name: "piv-9a-new", Type: TYPE_PIV, Token: "12345678", KeyID: "9a", Algorithm: ncrypt.ALG_ECDSA_P256}
+		key, err := b.Create(kc, CreateOptions{ManagementKey: managementKey})
+		if err == nil {
+			key.Close()
+			return fmt.Errorf("generating a key in a slot holding one succeeded")
+		}
+		return nil
+	})
+
+	check(t, "cards", func() error {
+		cards, err := b.Cards()
+		if err != nil {
+			return err
+		}
+		if len(cards) != 1 || cards[0].ID != "12345678" {
+			return fmt.Errorf("listed cards %+v", cards)
+		}
+		for _, slot := range cards[0].Free {
+			if slot == 0x87 || slot == 0x88 || slot == piv.SlotAuthentication {
+				return fmt.Errorf("slot %s with a key is listed as free", slot)
+			}
+		}
+		// the 5 keys of the test card and the 2 generated ones
+		if len(cards[0].Free) != len(piv.Slots)-7 {
+			return fmt.Errorf("%d free slots, expected %d", len(cards[0].Free), len(piv.Slots)-7)
+		}
+		return nil
+	})
+}
+
+// checkPIVCertificate checks that the certificate written to the slot of a new key has its public key and that the
+// key signs
+func checkPIVCertificate(b *PIVBackend, kc *KeyConfig, key BackendKey) error {
+	slot, err := piv.ParseSlot(kc.KeyID)
+	if err != nil {
+		return err
+	}
+	c, ok := b.cards.get(kc.Token)
+	if !ok {
+		return fmt.Errorf("card %s not found", kc.Token)
+	}
+	err = c.withApplet(func(t scard.Transmitter) error {
+		cert, err := piv.New(t).Certificate(slot)
+		if err != nil {
+			return err
+		}
+		pub, err := ssh.NewPublicKey(cert.PublicKey)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(pub.Marshal(), key.Public().Marshal()) {
+			return fmt.Errorf("the certificate has another public key")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data := []byte("pivgenerate")
+	sig, err := key.Sign(data, "")
+	if err != nil {
+		return err
+	}
+	return key.Public().Verify(data, sig)
+}
+
+// TestPIVScript replays pivScript and a session recorded with the emulator
+func TestPIVScript(t *testing.T) {
+	check(t, "script", func() error {
+		script, err := scard.ParseScript(strings.NewReader(pivScript))
+		if err != nil {
+			return err
+		}
+		card := piv.New(script)
+		if err = card.Select(); err != nil {
+			return err
+		}
+		id, err := card.ID()
+		if err != nil {
+			return err
+		}
+		if id != "00112233445566778899aabbccddeeff" {
+			return fmt.Errorf("card id %s", id)
+		}
+		version, err := card.Version()
+		if err != nil {
+			return err
+		}
+		if version != "5.4.3" {
+			return fmt.Errorf("version %s", version)
+		}
+		retries, verified, err := card.PINRetries()
+		if err != nil {
+			return err
+		}
+		if retries != 2 || verified {
+			return fmt.Errorf("%d tries left, verified %v", retries, verified)
+		}
+		var pinErr *piv.PINError
+		if err = card.VerifyPIN("123456"); !errors.As(err, &pinErr) || pinErr.Retries != 1 {
+			return fmt.Errorf("wrong PIN returned %v", err)
+		}
+		return script.Done()
+	})
+
+	check(t, "recorded script", func() error {
+		emu := piv.NewEmulator(1, "123456")
+		pub, err := emu.GenerateKey(piv.SlotAuthentication, piv.AlgRSA2048, piv.PINPolicyDefault, true)
+		if err != nil {
+			return err
+		}
+
+		session := func(card *piv.Card) ([]byte, error) {
+			if err := card.Select(); err != nil {
+				return nil, err
+			}
+			if _, err := card.Certificate(piv.SlotAuthentication); err != nil {
+				return nil, err
+			}
+			if err := card.VerifyPIN("123456"); err != nil {
+				return nil, err
+			}
+			return card.Sign(piv.SlotAuthentication, pub, bytes.Repeat([]byte{0x42}, 51))
+		}
+
+		var recording bytes.Buffer
+		recorded, err := session(piv.New(&scard.Recorder{Transmitter: emu, W: &recording}))
+		if err != nil {
+			return err
+		}
+		script, err := scard.ParseScript(&recording)
+		if err != nil {
+			return err
+		}
+		replayed, err := session(piv.New(script))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(recorded, replayed) {
+			return fmt.Errorf("replayed signature differs")
+		}
+		return script.Done()
+	})
+}
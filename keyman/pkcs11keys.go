@@ -0,0 +1,774 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"math/big"
+	"ncryptagent/ncrypt"
+	"ncryptagent/pkcs11"
+	"sync"
+	"time"
+)
+
+const TYPE_PKCS11 = "PKCS11"
+
+// PINPrompt asks the user for a PIN, ok is false when the prompt was cancelled. The PIN belongs to the caller, which
+// overwrites it when it is done with it.
+type PINPrompt func(title, message string) (pin []byte, ok bool)
+
+// pkcs1DigestInfo is the DigestInfo prefix CKM_RSA_PKCS signatures need in front of the digest
+var pkcs1DigestInfo = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// curveOIDs maps the named curves of CKA_EC_PARAMS to the algorithm names the agent uses
+var curveOIDs = map[string]string{
+	"1.2.840.10045.3.1.7": ncrypt.ALG_ECDSA_P256,
+	"1.3.132.0.34":        ncrypt.ALG_ECDSA_P384,
+	"1.3.132.0.35":        ncrypt.ALG_ECDSA_P521,
+}
+
+// PKCS11Backend uses keys on the tokens of PKCS#11 modules. KeyConfig.ProviderName is the path of the module,
+// Token the serial number of the token, KeyID the hex CKA_ID and ContainerName the CKA_LABEL of the key. A key is
+// found by its id when it has one, by its label otherwise.
+type PKCS11Backend struct {
+	prompt PINPrompt
+
+	mu      sync.Mutex
+	modules map[string]pkcs11.Module
+	tokens  map[string]*pkcs11Token
+}
+
+// NewPKCS11Backend returns a PKCS11 backend asking for token PINs with prompt
+func NewPKCS11Backend(prompt PINPrompt) *PKCS11Backend {
+	return &PKCS11Backend{
+		prompt:  prompt,
+		modules: make(map[string]pkcs11.Module),
+		tokens:  make(map[string]*pkcs11Token),
+	}
+}
+
+func (b *PKCS11Backend) Type() string {
+	return TYPE_PKCS11
+}
+
+func (b *PKCS11Backend) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: true}
+}
+
+func (b *PKCS11Backend) Load(kc *KeyConfig) (BackendKey, error) {
+	if kc.ProviderName == "" {
+		return nil, fmt.Errorf("no PKCS#11 module configured for key %s", kc.Name)
+	}
+	if kc.KeyID == "" && kc.ContainerName == "" {
+		return nil, fmt.Errorf("no key id or label configured for key %s", kc.Name)
+	}
+	id, err := hex.DecodeString(kc.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key id %s: %w", kc.KeyID, err)
+	}
+
+	tokens, err := b.presentTokens(kc.ProviderName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tokens {
+		if kc.Token != "" && t.serial != kc.Token {
+			continue
+		}
+
+		pub, err := t.publicKey(id, kc.ContainerName)
+		if err != nil {
+			if kc.Token != "" {
+				return nil, err
+			}
+			continue
+		}
+
+		if kc.Token == "" {
+			kc.Token = t.serial
+		}
+		return t.newPKCS11Key(kc, id, pub)
+	}
+
+	if kc.Token != "" {
+		return nil, fmt.Errorf("token %s is not present", kc.Token)
+	}
+	return nil, fmt.Errorf("key %s not found on any token of %s", kc.Name, kc.ProviderName)
+}
+
+func (b *PKCS11Backend) Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error) {
+	return nil, fmt.Errorf("creating keys on PKCS#11 tokens is not supported")
+}
+
+func (b *PKCS11Backend) Delete(kc *KeyConfig, key BackendKey) error {
+	return fmt.Errorf("deleting keys from PKCS#11 tokens is not supported")
+}
+
+// Close logs out of every token and unloads the modules
+func (b *PKCS11Backend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, t := range b.tokens {
+		t.close()
+		delete(b.tokens, name)
+	}
+	for path, m := range b.modules {
+		if err := m.Finalize(); err != nil {
+			log.Printf("Finalizing PKCS#11 module %s failed: %s", path, err)
+		}
+		delete(b.modules, path)
+	}
+	return nil
+}
+
+// Keys lists the keys on the tokens of a module, as configs that load them
+func (b *PKCS11Backend) Keys(modulePath string) ([]*KeyConfig, error) {
+	tokens, err := b.presentTokens(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*KeyConfig
+	for _, t := range tokens {
+		tokenKeys, err := t.keys()
+		if err != nil {
+			log.Printf("Listing keys on token %s failed: %s", t.label, err)
+			continue
+		}
+		keys = append(keys, tokenKeys...)
+	}
+	return keys, nil
+}
+
+func (b *PKCS11Backend) module(path string) (pkcs11.Module, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if m, ok := b.modules[path]; ok {
+		return m, nil
+	}
+	m, err := pkcs11.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	b.modules[path] = m
+	return m, nil
+}
+
+// presentTokens returns the tokens currently in the slots of a module
+func (b *PKCS11Backend) presentTokens(modulePath string) ([]*pkcs11Token, error) {
+	m, err := b.module(modulePath)
+	if err != nil {
+		return nil, err
+	}
+
+	slots, err := m.SlotList(true)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list slots of %s: %w", modulePath, err)
+	}
+
+	var tokens []*pkcs11Token
+	for _, slot := range slots {
+		info, err := m.TokenInfo(slot)
+		if err != nil {
+			log.Printf("Reading token info of slot %d failed: %s", slot, err)
+			continue
+		}
+		tokens = append(tokens, b.token(m, modulePath, info))
+	}
+	return tokens, nil
+}
+
+// token returns the token with the serial number in info, tokens are kept across removal so their keys can find the
+// token again when it is inserted in another slot
+func (b *PKCS11Backend) token(m pkcs11.Module, modulePath string, info pkcs11.TokenInfo) *pkcs11Token {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	name := modulePath + "\x00" + info.SerialNumber
+	t, ok := b.tokens[name]
+	if !ok {
+		t = &pkcs11Token{
+			module:     m,
+			modulePath: modulePath,
+			serial:     info.SerialNumber,
+			prompt:     b.prompt,
+		}
+		b.tokens[name] = t
+	}
+	t.mu.Lock()
+	t.label = info.Label
+	t.flags = info.Flags
+	t.mu.Unlock()
+	return t
+}
+
+// pkcs11Token holds the session with a token, shared by all of its keys. Login state belongs to the token, so the
+// keys on it share the PIN cache.
+type pkcs11Token struct {
+	module     pkcs11.Module
+	modulePath string
+	serial     string
+	prompt     PINPrompt
+
+	mu          sync.Mutex
+	label       string
+	flags       uint
+	slot        uint
+	session     uint
+	open        bool
+	generation  int
+	mechanisms  []uint
+	loggedIn    bool
+	timer       *time.Timer
+	timeractive bool
+}
+
+// sessionLocked returns the open session, opening one in the token's current slot when there is none
+func (t *pkcs11Token) sessionLocked() (uint, error) {
+	if t.open {
+		return t.session, nil
+	}
+
+	slots, err := t.module.SlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	found := false
+	for _, slot := range slots {
+		info, err := t.module.TokenInfo(slot)
+		if err == nil && info.SerialNumber == t.serial {
+			t.slot, t.label, t.flags = slot, info.Label, info.Flags
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("token %s is not present", t.serial)
+	}
+
+	session, err := t.module.OpenSession(t.slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open a session with token %s: %w", t.label, err)
+	}
+	if t.mechanisms, err = t.module.MechanismList(t.slot); err != nil {
+		log.Printf("Listing mechanisms of token %s failed: %s", t.label, err)
+	}
+
+	t.session = session
+	t.open = true
+	t.loggedIn = false
+	t.generation++
+	return session, nil
+}
+
+// resetLocked drops the session after the token was removed, the next use opens a new one
+func (t *pkcs11Token) resetLocked() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timeractive = false
+	if t.open {
+		t.module.CloseSession(t.session)
+	}
+	t.open = false
+	t.loggedIn = false
+}
+
+func (t *pkcs11Token) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.logoutLocked()
+	t.resetLocked()
+}
+
+func (t *pkcs11Token) loginRequired() bool {
+	return t.flags&pkcs11.CKF_LOGIN_REQUIRED != 0
+}
+
+// loginLocked logs in as userType, asking for the PIN unless the token has its own PIN entry
+func (t *pkcs11Token) loginLocked(session uint, userType uint, keyName string) error {
+	if userType == pkcs11.CKU_USER && (t.loggedIn || !t.loginRequired()) {
+		return nil
+	}
+
+	var pin []byte
+	if t.flags&pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH == 0 {
+		if t.prompt == nil {
+			return fmt.Errorf("unable to ask for the PIN of token %s", t.label)
+		}
+		message := fmt.Sprintf("Enter the PIN of token %s to use key %s", t.label, keyName)
+		if t.flags&pkcs11.CKF_USER_PIN_FINAL_TRY != 0 {
+			message += ". This is the last try before the PIN is locked."
+		}
+		var ok bool
+		if pin, ok = t.prompt("PIN required", message); !ok {
+			return fmt.Errorf("PIN entry for token %s was cancelled", t.label)
+		}
+		defer func() {
+			for i := range pin {
+				pin[i] = 0
+			}
+		}()
+	}
+
+	err := t.module.Login(session, userType, pin)
+	if errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("login to token %s failed: %w", t.label, err)
+	}
+	if userType == pkcs11.CKU_USER {
+		t.loggedIn = true
+	}
+	return nil
+}
+
+func (t *pkcs11Token) logoutLocked() {
+	if !t.open || !t.loggedIn {
+		return
+	}
+	if err := t.module.Logout(t.session); err != nil {
+		log.Printf("Logout from token %s failed: %s", t.label, err)
+	}
+	t.loggedIn = false
+}
+
+// handlePinTimerLocked keeps the token logged in for timeout seconds after the first signature, like
+// Signer.handlePinTimer does for NCrypt keys, a timeout of 0 logs out after every signature
+func (t *pkcs11Token) handlePinTimerLocked(timeout int) {
+	if !t.loginRequired() {
+		return
+	}
+	if !t.timeractive && timeout > 0 {
+		log.Printf("Starting pin cache purge timer: %ds\n", timeout)
+		t.timer = time.AfterFunc(time.Second*time.Duration(timeout), func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.timeractive = false
+			t.logoutLocked()
+			log.Printf("PIN Cache purged\n")
+		})
+		t.timeractive = true
+	} else if timeout == 0 {
+		t.logoutLocked()
+	}
+}
+
+func (t *pkcs11Token) purgePIN() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timeractive = false
+	t.logoutLocked()
+}
+
+func (t *pkcs11Token) pinCached() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.loggedIn && t.loginRequired()
+}
+
+func (t *pkcs11Token) supports(mechanism uint) bool {
+	for _, m := range t.mechanisms {
+		if m == mechanism {
+			return true
+		}
+	}
+	return false
+}
+
+// findObjectsLocked finds objects of a class by id, or by label when there is no id
+func (t *pkcs11Token) findObjectsLocked(session uint, class uint, id []byte, label string) ([]uint, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if len(id) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	} else {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, label))
+	}
+	return t.module.FindObjects(session, template)
+}
+
+// publicKey finds the public key of a key without logging in, from its public key object or its certificate
+func (t *pkcs11Token) publicKey(id []byte, label string) (crypto.PublicKey, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, err := t.sessionLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, class := range []uint{pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_CERTIFICATE, pkcs11.CKO_PRIVATE_KEY} {
+		objects, err := t.findObjectsLocked(session, class, id, label)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) > 1 {
+			return nil, fmt.Errorf("%d keys match on token %s, configure the key id", len(objects), t.label)
+		}
+		if len(objects) == 1 {
+			return t.objectPublicKeyLocked(session, class, objects[0])
+		}
+	}
+	return nil, fmt.Errorf("key not found on token %s", t.label)
+}
+
+func (t *pkcs11Token) objectPublicKeyLocked(session uint, class uint, object uint) (crypto.PublicKey, error) {
+	if class == pkcs11.CKO_CERTIFICATE {
+		attrs, err := t.module.GetAttributeValue(session, object, []uint{pkcs11.CKA_VALUE})
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(attrs[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse certificate: %w", err)
+		}
+		return cert.PublicKey, nil
+	}
+
+	attrs, err := t.module.GetAttributeValue(session, object, []uint{
+		pkcs11.CKA_KEY_TYPE, pkcs11.CKA_MODULUS, pkcs11.CKA_PUBLIC_EXPONENT, pkcs11.CKA_EC_PARAMS, pkcs11.CKA_EC_POINT,
+	})
+	if err != nil {
+		return nil, err
+	}
+	keyType, err := attrs[0].ULong()
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		if len(attrs[1].Value) == 0 || len(attrs[2].Value) == 0 {
+			return nil, fmt.Errorf("RSA key has no public modulus or exponent")
+		}
+		e := new(big.Int).SetBytes(attrs[2].Value)
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA public exponent is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(attrs[1].Value), E: int(e.Int64())}, nil
+	case pkcs11.CKK_EC:
+		return unmarshalECPoint(attrs[3].Value, attrs[4].Value)
+	default:
+		return nil, fmt.Errorf("unsupported key type 0x%X", keyType)
+	}
+}
+
+// unmarshalECPoint decodes CKA_EC_PARAMS and CKA_EC_POINT, the point is a DER OCTET STRING but some modules return
+// the bare point
+func unmarshalECPoint(params []byte, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("EC key without a named curve: %w", err)
+	}
+	alg, ok := curveOIDs[oid.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %s", oid)
+	}
+	curve := ncrypt.CurveNames[alg]
+	size := (curve.Params().BitSize + 7) / 8
+
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) > 0 || len(raw) != 1+2*size {
+		raw = point
+	}
+	if len(raw) != 1+2*size || raw[0] != 4 {
+		return nil, fmt.Errorf("EC point is not an uncompressed %s point", alg)
+	}
+
+	pub := &ecdsa.PublicKey{
+		Curve: curve,
+		X:     new(big.Int).SetBytes(raw[1 : 1+size]),
+		Y:     new(big.Int).SetBytes(raw[1+size:]),
+	}
+	if !curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("EC point is not on curve %s", alg)
+	}
+	return pub, nil
+}
+
+// keys lists the keys of the token. Keys are told apart by their id, objects without one by their label.
+func (t *pkcs11Token) keys() ([]*KeyConfig, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	session, err := t.sessionLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*KeyConfig
+	seen := make(map[string]bool)
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY, pkcs11.CKO_CERTIFICATE} {
+		objects, err := t.module.FindObjects(session, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)})
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			attrs, err := t.module.GetAttributeValue(session, object, []uint{pkcs11.CKA_ID, pkcs11.CKA_LABEL})
+			if err != nil {
+				return nil, err
+			}
+			id, label := attrs[0].Value, string(attrs[1].Value)
+			name := "id:" + hex.EncodeToString(id)
+			if len(id) == 0 {
+				name = "label:" + label
+			}
+			if seen[name] {
+				continue
+			}
+
+			pub, err := t.objectPublicKeyLocked(session, class, object)
+			if err != nil {
+				// a private key doesn't always reveal its public key, its public key object or certificate may
+				continue
+			}
+			sshPub, err := ssh.NewPublicKey(pub)
+			if err != nil {
+				continue
+			}
+			seen[name] = true
+
+			kc := &KeyConfig{
+				Name:          label,
+				Type:          TYPE_PKCS11,
+				ContainerName: label,
+				ProviderName:  t.modulePath,
+				Token:         t.serial,
+				KeyID:         hex.EncodeToString(id),
+				SSHPublicKey:  string(ssh.MarshalAuthorizedKey(sshPub)),
+				NoPin:         !t.loginRequired(),
+			}
+			if kc.Name == "" {
+				kc.Name = fmt.Sprintf("%s %s", t.label, kc.KeyID)
+			}
+			kc.Algorithm, kc.Length = publicKeyAlgorithm(pub)
+			keys = append(keys, kc)
+		}
+	}
+	return keys, nil
+}
+
+func publicKeyAlgorithm(pub crypto.PublicKey) (string, int) {
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		return ncrypt.ALG_RSA, p.N.BitLen()
+	case *ecdsa.PublicKey:
+		for _, alg := range []string{ncrypt.ALG_ECDSA_P256, ncrypt.ALG_ECDSA_P384, ncrypt.ALG_ECDSA_P521} {
+			if ncrypt.CurveNames[alg] == p.Curve {
+				return alg, 0
+			}
+		}
+	case ed25519.PublicKey:
+		return ALG_ED25519, 0
+	}
+	return "", 0
+}
+
+func (t *pkcs11Token) newPKCS11Key(kc *KeyConfig, id []byte, pub crypto.PublicKey) (*pkcs11Key, error) {
+	signer := &pkcs11Signer{token: t, name: kc.Name, id: id, label: kc.ContainerName, publicKey: pub}
+
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		signer.mechanism = pkcs11.CKM_RSA_PKCS
+	case *ecdsa.PublicKey:
+		signer.mechanism = pkcs11.CKM_ECDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	t.mu.Lock()
+	supported := t.supports(signer.mechanism)
+	loginRequired := t.loginRequired()
+	t.mu.Unlock()
+	if !supported {
+		return nil, fmt.Errorf("token %s doesn't support signing mechanism 0x%X", t.label, signer.mechanism)
+	}
+
+	sk, err := newSignerKey(signer, KeyCapabilities{PIN: loginRequired})
+	if err != nil {
+		return nil, err
+	}
+	algorithm, length := publicKeyAlgorithm(pub)
+	return &pkcs11Key{signerKey: sk, algorithm: algorithm, length: length}, nil
+}
+
+// pkcs11Key is a key on a PKCS#11 token
+type pkcs11Key struct {
+	*signerKey
+	algorithm string
+	length    int
+}
+
+func (k *pkcs11Key) Algorithm() (string, int) {
+	return k.algorithm, k.length
+}
+
+// pkcs11Signer signs with CKM_ECDSA or CKM_RSA_PKCS, the private key object is looked up again whenever the token
+// got a new session
+type pkcs11Signer struct {
+	token     *pkcs11Token
+	name      string
+	id        []byte
+	label     string
+	publicKey crypto.PublicKey
+	mechanism uint
+	// timeout is the PIN timeout of the key, guarded by the token's mutex like the token's PIN timer
+	timeout int
+
+	handle             uint
+	generation         int
+	alwaysAuthenticate bool
+}
+
+func (s *pkcs11Signer) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+func (s *pkcs11Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, isRSAPSS := opts.(*rsa.PSSOptions); isRSAPSS {
+		return nil, fmt.Errorf("RSA-PSS signing is not supported")
+	}
+
+	switch pub := s.publicKey.(type) {
+	case *rsa.PublicKey:
+		prefix, ok := pkcs1DigestInfo[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported RSA hash algorithm %v", opts.HashFunc())
+		}
+		return s.token.sign(s, append(append([]byte{}, prefix...), digest...))
+	case *ecdsa.PublicKey:
+		signatureBytes, err := s.token.sign(s, digest)
+		if err != nil {
+			return nil, err
+		}
+
+		// CKM_ECDSA returns r and s padded to the size of the curve
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signatureBytes) != 2*size {
+			return nil, fmt.Errorf("ECDSA signature has %d bytes, expected %d", len(signatureBytes), 2*size)
+		}
+
+		var b cryptobyte.Builder
+		b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+			b.AddASN1BigInt(new(big.Int).SetBytes(signatureBytes[:size]))
+			b.AddASN1BigInt(new(big.Int).SetBytes(signatureBytes[size:]))
+		})
+		return b.Bytes()
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", s.publicKey)
+	}
+}
+
+// PINCached reports whether the token is still logged in
+func (s *pkcs11Signer) PINCached() bool {
+	return s.token.pinCached()
+}
+
+// PurgePIN logs out of the token, for all keys on it
+func (s *pkcs11Signer) PurgePIN() {
+	s.token.purgePIN()
+}
+
+func (s *pkcs11Signer) SetPINTimeout(timeout int) {
+	s.token.mu.Lock()
+	defer s.token.mu.Unlock()
+	s.timeout = timeout
+}
+
+// sign signs data with a key of the token, a token that was removed and inserted again gets a new session
+func (t *pkcs11Token) sign(s *pkcs11Signer, data []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var signatureBytes []byte
+		signatureBytes, err = t.signLocked(s, data)
+		if err == nil {
+			t.handlePinTimerLocked(s.timeout)
+			return signatureBytes, nil
+		}
+
+		var ckr pkcs11.Error
+		if !errors.As(err, &ckr) {
+			return nil, err
+		}
+		switch ckr {
+		case pkcs11.CKR_USER_NOT_LOGGED_IN:
+			// logged out by another application using the token
+			t.loggedIn = false
+		case pkcs11.CKR_DEVICE_REMOVED, pkcs11.CKR_DEVICE_ERROR, pkcs11.CKR_TOKEN_NOT_PRESENT,
+			pkcs11.CKR_SESSION_HANDLE_INVALID, pkcs11.CKR_SESSION_CLOSED, pkcs11.CKR_KEY_HANDLE_INVALID,
+			pkcs11.CKR_OBJECT_HANDLE_INVALID:
+			t.resetLocked()
+		default:
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func (t *pkcs11Token) signLocked(s *pkcs11Signer, data []byte) ([]byte, error) {
+	session, err := t.sessionLocked()
+	if err != nil {
+		return nil, err
+	}
+	if err = t.loginLocked(session, pkcs11.CKU_USER, s.name); err != nil {
+		return nil, err
+	}
+
+	if s.generation != t.generation || s.handle == 0 {
+		objects, err := t.findObjectsLocked(session, pkcs11.CKO_PRIVATE_KEY, s.id, s.label)
+		if err != nil {
+			return nil, err
+		}
+		if len(objects) != 1 {
+			return nil, fmt.Errorf("found %d private keys for key %s on token %s", len(objects), s.name, t.label)
+		}
+		attrs, err := t.module.GetAttributeValue(session, objects[0], []uint{pkcs11.CKA_ALWAYS_AUTHENTICATE})
+		if err != nil {
+			return nil, err
+		}
+		s.handle = objects[0]
+		s.generation = t.generation
+		s.alwaysAuthenticate = len(attrs[0].Value) == 1 && attrs[0].Value[0] != 0
+	}
+
+	if err = t.module.SignInit(session, &pkcs11.Mechanism{Mechanism: s.mechanism}, s.handle); err != nil {
+		return nil, err
+	}
+
+	// keys like the PIV signature key want the PIN again for every signature
+	if s.alwaysAuthenticate {
+		if err = t.loginLocked(session, pkcs11.CKU_CONTEXT_SPECIFIC, s.name); err != nil {
+			// closing the session ends the signing operation that was started
+			t.resetLocked()
+			return nil, err
+		}
+	}
+
+	return t.module.Sign(session, data)
+}
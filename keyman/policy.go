@@ -0,0 +1,418 @@
+package keyman
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"ncryptagent/keyman/listeners"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type PolicyAction string
+
+const (
+	POLICY_ALLOW   PolicyAction = "allow"
+	POLICY_DENY    PolicyAction = "deny"
+	POLICY_CONFIRM PolicyAction = "confirm"
+	// POLICY_PIN purges any cached PIN before signing so the user has to enter it again
+	POLICY_PIN PolicyAction = "pin"
+)
+
+const (
+	PAYLOAD_AUTH   = "auth"
+	PAYLOAD_SSHSIG = "sshsig"
+	PAYLOAD_OTHER  = "other"
+)
+
+const (
+	OPERATION_LIST = "list"
+	OPERATION_SIGN = "sign"
+)
+
+const POLICY_FILE = "policy.json"
+
+// PolicyRule is a single rule of a signing policy. Every condition that is set must match for the rule to apply, an
+// empty condition matches anything. Name patterns use path.Match syntax and are case-insensitive.
+type PolicyRule struct {
+	Name string `json:"name,omitempty"`
+	// Keys are key name patterns
+	Keys []string `json:"keys,omitempty"`
+	// Listeners are listener types, e.g. NAMED_PIPE, PAGEANT, CYGWIN, VSOCK, AF_VSOCK
+	Listeners []string `json:"listeners,omitempty"`
+	// Processes are image name patterns matched against the client process, e.g. ssh.exe. Clients whose process
+	// can't be verified, like those of the Pageant listener, never match.
+	Processes []string `json:"processes,omitempty"`
+	// Ancestors are image name patterns, any process in the client's verified parent chain may match
+	Ancestors []string `json:"ancestors,omitempty"`
+	// Hosts are destination host name patterns or SHA256: host key fingerprints. They can only match clients that
+	// send the session-bind@openssh.com extension (OpenSSH 8.9 and newer).
+	Hosts []string `json:"hosts,omitempty"`
+	// Forwarded matches requests arriving through a forwarded agent connection
+	Forwarded *bool `json:"forwarded,omitempty"`
+	// Payloads are auth, sshsig or other
+	Payloads []string `json:"payloads,omitempty"`
+	// Namespaces are SSHSIG namespace patterns, e.g. git or file
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Days are weekday abbreviations, e.g. mon, tue
+	Days []string `json:"days,omitempty"`
+	// Hours is a local time range like 09:00-17:30, ranges may wrap past midnight
+	Hours string `json:"hours,omitempty"`
+
+	Action PolicyAction `json:"action"`
+}
+
+// Policy is an ordered list of rules, the first matching rule decides the outcome
+type Policy struct {
+	Rules         []PolicyRule `json:"rules"`
+	DefaultAction PolicyAction `json:"defaultAction,omitempty"`
+}
+
+// PolicyRequest describes an agent operation for policy evaluation
+type PolicyRequest struct {
+	Operation string
+	KeyName   string
+	Peer      *listeners.PeerInfo
+	Payload   string
+	Namespace string
+	HostKey   ssh.PublicKey
+	HostNames []string
+	Forwarded bool
+	Time      time.Time
+}
+
+// PolicyDecision is the outcome of evaluating a request, Reasons explains how it was reached
+type PolicyDecision struct {
+	Action   PolicyAction
+	Rule     int
+	RuleName string
+	Reasons  []string
+}
+
+func (d *PolicyDecision) String() string {
+	if d.Rule < 0 {
+		return fmt.Sprintf("%s (default)", d.Action)
+	}
+	return fmt.Sprintf("%s (rule %d %q)", d.Action, d.Rule+1, d.RuleName)
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func validAction(a PolicyAction) bool {
+	switch a {
+	case POLICY_ALLOW, POLICY_DENY, POLICY_CONFIRM, POLICY_PIN:
+		return true
+	}
+	return false
+}
+
+// LoadPolicy reads and validates a policy file
+func LoadPolicy(policyPath string) (*Policy, error) {
+	content, err := ioutil.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read policy file at %s: %w", policyPath, err)
+	}
+
+	var p Policy
+	if err = json.Unmarshal(content, &p); err != nil {
+		return nil, fmt.Errorf("unable to parse policy file at %s: %w", policyPath, err)
+	}
+
+	if err = p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file at %s: %w", policyPath, err)
+	}
+
+	return &p, nil
+}
+
+// Validate checks actions, patterns and time conditions of every rule
+func (p *Policy) Validate() error {
+	if p.DefaultAction != "" && !validAction(p.DefaultAction) {
+		return fmt.Errorf("unknown default action %q", p.DefaultAction)
+	}
+
+	for i, r := range p.Rules {
+		if !validAction(r.Action) {
+			return fmt.Errorf("rule %d: unknown action %q", i+1, r.Action)
+		}
+		for _, patterns := range [][]string{r.Keys, r.Processes, r.Ancestors, r.Hosts, r.Namespaces} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+					return fmt.Errorf("rule %d: invalid pattern %q", i+1, pattern)
+				}
+			}
+		}
+		for _, payload := range r.Payloads {
+			switch strings.ToLower(payload) {
+			case PAYLOAD_AUTH, PAYLOAD_SSHSIG, PAYLOAD_OTHER:
+			default:
+				return fmt.Errorf("rule %d: unknown payload type %q", i+1, payload)
+			}
+		}
+		for _, day := range r.Days {
+			if _, ok := weekdays[strings.ToLower(day)]; !ok {
+				return fmt.Errorf("rule %d: unknown day %q", i+1, day)
+			}
+		}
+		if r.Hours != "" {
+			if _, _, err := parseHours(r.Hours); err != nil {
+				return fmt.Errorf("rule %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Explain evaluates req against the policy and returns the decision along with the reasons each rule matched or
+// not. It has no side effects and is used for both enforcement and dry runs.
+func (p *Policy) Explain(req *PolicyRequest) *PolicyDecision {
+	d := &PolicyDecision{Action: POLICY_ALLOW, Rule: -1}
+	if p == nil {
+		d.Reasons = append(d.Reasons, "no policy loaded")
+		return d
+	}
+	if p.DefaultAction != "" {
+		d.Action = p.DefaultAction
+	}
+
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		ok, reason := r.matches(req)
+		if !ok {
+			d.Reasons = append(d.Reasons, fmt.Sprintf("rule %d %q skipped: %s", i+1, r.Name, reason))
+			continue
+		}
+		d.Reasons = append(d.Reasons, fmt.Sprintf("rule %d %q matched: %s", i+1, r.Name, r.Action))
+		d.Action = r.Action
+		d.Rule = i
+		d.RuleName = r.Name
+		return d
+	}
+
+	d.Reasons = append(d.Reasons, fmt.Sprintf("no rule matched, default action %s", d.Action))
+	return d
+}
+
+func (r *PolicyRule) matches(req *PolicyRequest) (bool, string) {
+	// When listing keys nothing is known about the payload or destination yet. Rules depending on them can't be
+	// decided and are left to the sign request.
+	if req.Operation == OPERATION_LIST && (len(r.Payloads) > 0 || len(r.Namespaces) > 0 || len(r.Hosts) > 0 || r.Forwarded != nil) {
+		return false, "depends on the sign request"
+	}
+
+	if len(r.Keys) > 0 && !matchAny(r.Keys, req.KeyName) {
+		return false, fmt.Sprintf("key %q", req.KeyName)
+	}
+
+	if len(r.Listeners) > 0 {
+		listener := ""
+		if req.Peer != nil {
+			listener = req.Peer.Listener
+		}
+		if !matchAny(r.Listeners, listener) {
+			return false, fmt.Sprintf("listener %q", listener)
+		}
+	}
+
+	if len(r.Processes) > 0 {
+		if req.Peer == nil || req.Peer.Process == nil {
+			return false, "client process unknown"
+		}
+		if req.Peer.Unverified {
+			return false, fmt.Sprintf("client process %q unverified", req.Peer.Process.ImageName())
+		}
+		if !matchAny(r.Processes, req.Peer.Process.ImageName()) {
+			return false, fmt.Sprintf("process %q", req.Peer.Process.ImageName())
+		}
+	}
+
+	if len(r.Ancestors) > 0 {
+		if req.Peer != nil && req.Peer.Unverified {
+			return false, fmt.Sprintf("ancestors %q unverified", req.Peer.Chain())
+		}
+		found := false
+		if req.Peer != nil {
+			for _, parent := range req.Peer.Parents {
+				if matchAny(r.Ancestors, parent.ImageName()) {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return false, fmt.Sprintf("ancestors %q", req.Peer.Chain())
+		}
+	}
+
+	if len(r.Hosts) > 0 {
+		if req.HostKey == nil {
+			return false, "destination host unknown"
+		}
+		fingerprint := ssh.FingerprintSHA256(req.HostKey)
+		found := false
+		for _, h := range r.Hosts {
+			if strings.HasPrefix(h, "SHA256:") {
+				found = h == fingerprint
+			} else {
+				found = matchAny([]string{h}, req.HostNames...)
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			return false, fmt.Sprintf("host %s %q", fingerprint, req.HostNames)
+		}
+	}
+
+	if r.Forwarded != nil && *r.Forwarded != req.Forwarded {
+		return false, fmt.Sprintf("forwarded %t", req.Forwarded)
+	}
+
+	if len(r.Payloads) > 0 && !matchAny(r.Payloads, req.Payload) {
+		return false, fmt.Sprintf("payload %q", req.Payload)
+	}
+
+	if len(r.Namespaces) > 0 && (req.Payload != PAYLOAD_SSHSIG || !matchAny(r.Namespaces, req.Namespace)) {
+		return false, fmt.Sprintf("namespace %q", req.Namespace)
+	}
+
+	if len(r.Days) > 0 {
+		day := req.Time.Weekday()
+		found := false
+		for _, d := range r.Days {
+			if weekdays[strings.ToLower(d)] == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, fmt.Sprintf("day %s", day)
+		}
+	}
+
+	if r.Hours != "" {
+		start, end, _ := parseHours(r.Hours)
+		now := time.Duration(req.Time.Hour())*time.Hour + time.Duration(req.Time.Minute())*time.Minute
+		inRange := now >= start && now < end
+		if end <= start {
+			inRange = now >= start || now < end
+		}
+		if !inRange {
+			return false, fmt.Sprintf("time %s", req.Time.Format("15:04"))
+		}
+	}
+
+	return true, ""
+}
+
+// matchAny reports whether any of values matches any of the patterns
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, v := range values {
+			if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(v)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseHours(hours string) (time.Duration, time.Duration, error) {
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid hours %q, expected HH:MM-HH:MM", hours)
+	}
+
+	var bounds [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid hours %q, expected HH:MM-HH:MM", hours)
+		}
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// ParseSignPayload works out what kind of data a client asked to be signed. User authentication requests start with
+// the session identifier followed by SSH_MSG_USERAUTH_REQUEST, SSHSIG signatures (ssh-keygen -Y sign, git) start
+// with the SSHSIG preamble and namespace.
+func ParseSignPayload(data []byte) (payload string, namespace string, sessionID []byte) {
+	if bytes.HasPrefix(data, []byte("SSHSIG")) {
+		if ns, _, ok := parseSSHString(data[6:]); ok {
+			return PAYLOAD_SSHSIG, string(ns), nil
+		}
+		return PAYLOAD_OTHER, "", nil
+	}
+
+	const msgUserAuthRequest = 50
+	if sid, rest, ok := parseSSHString(data); ok && len(rest) > 0 && rest[0] == msgUserAuthRequest {
+		return PAYLOAD_AUTH, "", sid
+	}
+
+	return PAYLOAD_OTHER, "", nil
+}
+
+func parseSSHString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	l := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < l {
+		return nil, nil, false
+	}
+	return b[4 : 4+l], b[4+l:], true
+}
+
+// knownHostNames returns the names recorded for hostKey in the user's known_hosts file. Hashed entries can't be
+// reversed and are skipped.
+func knownHostNames(hostKey ssh.PublicKey) []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var names []string
+	want := hostKey.Marshal()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		_, hosts, key, _, _, err := ssh.ParseKnownHosts(scanner.Bytes())
+		if err != nil || key == nil || !bytes.Equal(key.Marshal(), want) {
+			continue
+		}
+		for _, h := range hosts {
+			if strings.HasPrefix(h, "|") {
+				continue
+			}
+			// [host]:port entries
+			h = strings.TrimPrefix(h, "[")
+			if i := strings.Index(h, "]"); i >= 0 {
+				h = h[:i]
+			}
+			names = append(names, h)
+		}
+	}
+	return names
+}
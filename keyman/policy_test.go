@@ -0,0 +1,532 @@
+package keyman
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"ncryptagent/keyman/listeners"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func policyBool(b bool) *bool {
+	return &b
+}
+
+func TestPolicyExplain(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewPublicKey(priv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHostKey, err := ssh.NewPublicKey(otherPriv.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-01-01 is a Monday
+	monday := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	pipePeer := &listeners.PeerInfo{
+		Listener: listeners.TYPE_NAMED_PIPE,
+		Process:  &listeners.ProcessInfo{PID: 10, ImagePath: `C:\Windows\System32\OpenSSH\ssh.exe`},
+		Parents: []listeners.ProcessInfo{
+			{PID: 9, ImagePath: `C:\Program Files\Git\cmd\git.exe`},
+			{PID: 8, ImagePath: `C:\Windows\explorer.exe`},
+		},
+	}
+	pageantPeer := *pipePeer
+	pageantPeer.Listener = listeners.TYPE_PAGEANT
+	pageantPeer.Unverified = true
+	sign := func() *PolicyRequest {
+		return &PolicyRequest{
+			Operation: OPERATION_SIGN,
+			KeyName:   "work-yubikey",
+			Peer:      pipePeer,
+			Payload:   PAYLOAD_AUTH,
+			Time:      monday(10, 0),
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy *Policy
+		req    func(r *PolicyRequest)
+		action PolicyAction
+		rule   int
+	}{
+		{
+			name:   "no policy",
+			action: POLICY_ALLOW,
+			rule:   -1,
+		},
+		{
+			name:   "empty policy",
+			policy: &Policy{},
+			action: POLICY_ALLOW,
+			rule:   -1,
+		},
+		{
+			name:   "default action",
+			policy: &Policy{DefaultAction: POLICY_CONFIRM, Rules: []PolicyRule{{Keys: []string{"home-*"}, Action: POLICY_ALLOW}}},
+			action: POLICY_CONFIRM,
+			rule:   -1,
+		},
+		{
+			name: "first matching rule",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{
+				{Keys: []string{"home-*"}, Action: POLICY_PIN},
+				{Keys: []string{"WORK-*"}, Action: POLICY_CONFIRM},
+				{Action: POLICY_ALLOW},
+			}},
+			action: POLICY_CONFIRM,
+			rule:   1,
+		},
+		{
+			name:   "listener",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Listeners: []string{listeners.TYPE_NAMED_PIPE}, Action: POLICY_ALLOW}}},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "other listener",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Listeners: []string{listeners.TYPE_PAGEANT}, Action: POLICY_ALLOW}}},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "listener of an unknown peer",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Listeners: []string{listeners.TYPE_NAMED_PIPE}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Peer = nil },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "process",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Processes: []string{"SSH.exe"}, Action: POLICY_ALLOW}}},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "other process",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Processes: []string{"putty*.exe"}, Action: POLICY_ALLOW}}},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "process unknown",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Processes: []string{"*"}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Peer = &listeners.PeerInfo{Listener: listeners.TYPE_VSOCK, Detail: "VM"} },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "ancestor",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Ancestors: []string{"git.exe"}, Action: POLICY_ALLOW}}},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "unverified process",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Processes: []string{"ssh.exe"}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Peer = &pageantPeer },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "unverified ancestor",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Ancestors: []string{"git.exe"}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Peer = &pageantPeer },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "listener of an unverified process",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Listeners: []string{listeners.TYPE_PAGEANT}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Peer = &pageantPeer },
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "ancestor is not the process",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Ancestors: []string{"ssh.exe"}, Action: POLICY_ALLOW}}},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "ancestors of an unknown peer",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Ancestors: []string{"*"}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Peer = nil },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "host name",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hosts: []string{"*.example.com"}, Action: POLICY_ALLOW}}},
+			req: func(r *PolicyRequest) {
+				r.HostKey = hostKey
+				r.HostNames = []string{"10.0.0.1", "git.example.com"}
+			},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "host fingerprint",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hosts: []string{ssh.FingerprintSHA256(hostKey)}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.HostKey = hostKey },
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "other host key",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hosts: []string{ssh.FingerprintSHA256(hostKey), "*.example.com"}, Action: POLICY_ALLOW}}},
+			req: func(r *PolicyRequest) {
+				r.HostKey = otherHostKey
+				r.HostNames = []string{"example.org"}
+			},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "destination host unknown",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hosts: []string{"*"}, Action: POLICY_ALLOW}}},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "forwarded",
+			policy: &Policy{DefaultAction: POLICY_ALLOW, Rules: []PolicyRule{{Forwarded: policyBool(true), Action: POLICY_CONFIRM}}},
+			req:    func(r *PolicyRequest) { r.Forwarded = true },
+			action: POLICY_CONFIRM,
+			rule:   0,
+		},
+		{
+			name:   "not forwarded",
+			policy: &Policy{DefaultAction: POLICY_ALLOW, Rules: []PolicyRule{{Forwarded: policyBool(true), Action: POLICY_CONFIRM}}},
+			action: POLICY_ALLOW,
+			rule:   -1,
+		},
+		{
+			name:   "local only",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Forwarded: policyBool(false), Action: POLICY_ALLOW}}},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "payload",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Payloads: []string{"AUTH"}, Action: POLICY_ALLOW}}},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "other payload",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Payloads: []string{PAYLOAD_SSHSIG}, Action: POLICY_ALLOW}}},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "namespace",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Namespaces: []string{"git"}, Action: POLICY_PIN}}},
+			req: func(r *PolicyRequest) {
+				r.Payload = PAYLOAD_SSHSIG
+				r.Namespace = "git"
+			},
+			action: POLICY_PIN,
+			rule:   0,
+		},
+		{
+			name:   "other namespace",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Namespaces: []string{"git"}, Action: POLICY_PIN}}},
+			req: func(r *PolicyRequest) {
+				r.Payload = PAYLOAD_SSHSIG
+				r.Namespace = "file"
+			},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "namespace of an auth request",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Namespaces: []string{"*"}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Namespace = "git" },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "day",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Days: []string{"Mon", "tue"}, Action: POLICY_ALLOW}}},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "other day",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Days: []string{"sat", "sun"}, Action: POLICY_ALLOW}}},
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "within hours",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hours: "09:00-17:30", Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Time = monday(17, 29) },
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "start of hours",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hours: "09:00-17:30", Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Time = monday(9, 0) },
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "end of hours",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hours: "09:00-17:30", Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Time = monday(17, 30) },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "before hours",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Hours: "09:00-17:30", Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Time = monday(8, 59) },
+			action: POLICY_DENY,
+			rule:   -1,
+		},
+		{
+			name:   "hours past midnight, late",
+			policy: &Policy{DefaultAction: POLICY_ALLOW, Rules: []PolicyRule{{Hours: "22:00-06:00", Action: POLICY_DENY}}},
+			req:    func(r *PolicyRequest) { r.Time = monday(23, 15) },
+			action: POLICY_DENY,
+			rule:   0,
+		},
+		{
+			name:   "hours past midnight, early",
+			policy: &Policy{DefaultAction: POLICY_ALLOW, Rules: []PolicyRule{{Hours: "22:00-06:00", Action: POLICY_DENY}}},
+			req:    func(r *PolicyRequest) { r.Time = monday(5, 59) },
+			action: POLICY_DENY,
+			rule:   0,
+		},
+		{
+			name:   "hours past midnight, daytime",
+			policy: &Policy{DefaultAction: POLICY_ALLOW, Rules: []PolicyRule{{Hours: "22:00-06:00", Action: POLICY_DENY}}},
+			req:    func(r *PolicyRequest) { r.Time = monday(6, 0) },
+			action: POLICY_ALLOW,
+			rule:   -1,
+		},
+		{
+			name: "all conditions",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{
+				Keys:      []string{"work-*"},
+				Listeners: []string{listeners.TYPE_NAMED_PIPE},
+				Processes: []string{"ssh.exe"},
+				Ancestors: []string{"git.exe"},
+				Hosts:     []string{"github.com"},
+				Forwarded: policyBool(false),
+				Payloads:  []string{PAYLOAD_AUTH},
+				Days:      []string{"mon"},
+				Hours:     "08:00-18:00",
+				Action:    POLICY_ALLOW,
+			}}},
+			req: func(r *PolicyRequest) {
+				r.HostKey = hostKey
+				r.HostNames = []string{"github.com"}
+			},
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name:   "list",
+			policy: &Policy{DefaultAction: POLICY_DENY, Rules: []PolicyRule{{Keys: []string{"work-*"}, Processes: []string{"ssh.exe"}, Action: POLICY_ALLOW}}},
+			req:    func(r *PolicyRequest) { r.Operation = OPERATION_LIST },
+			action: POLICY_ALLOW,
+			rule:   0,
+		},
+		{
+			name: "list skips rules decided by the sign request",
+			policy: &Policy{DefaultAction: POLICY_CONFIRM, Rules: []PolicyRule{
+				{Payloads: []string{PAYLOAD_AUTH}, Action: POLICY_DENY},
+				{Namespaces: []string{"git"}, Action: POLICY_DENY},
+				{Hosts: []string{"*"}, Action: POLICY_DENY},
+				{Forwarded: policyBool(false), Action: POLICY_DENY},
+			}},
+			req: func(r *PolicyRequest) {
+				r.Operation = OPERATION_LIST
+				r.Payload = ""
+			},
+			action: POLICY_CONFIRM,
+			rule:   -1,
+		},
+		{
+			name: "sign applies rules skipped when listing",
+			policy: &Policy{DefaultAction: POLICY_CONFIRM, Rules: []PolicyRule{
+				{Payloads: []string{PAYLOAD_AUTH}, Action: POLICY_DENY},
+			}},
+			action: POLICY_DENY,
+			rule:   0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := sign()
+			if tc.req != nil {
+				tc.req(req)
+			}
+			if tc.policy != nil {
+				if err := tc.policy.Validate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := tc.policy.Explain(req)
+			if d.Action != tc.action || d.Rule != tc.rule {
+				t.Fatalf("decision %s, expected %s from rule %d\n%s", d, tc.action, tc.rule+1, strings.Join(d.Reasons, "\n"))
+			}
+			if len(d.Reasons) == 0 {
+				t.Fatal("decision without reasons")
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy Policy
+		err    string
+	}{
+		{"unknown default action", Policy{DefaultAction: "maybe"}, "unknown default action"},
+		{"unknown action", Policy{Rules: []PolicyRule{{Action: "maybe"}}}, "rule 1: unknown action"},
+		{"missing action", Policy{Rules: []PolicyRule{{Action: POLICY_ALLOW}, {Keys: []string{"*"}}}}, "rule 2: unknown action"},
+		{"invalid pattern", Policy{Rules: []PolicyRule{{Processes: []string{"ssh[.exe"}, Action: POLICY_ALLOW}}}, "invalid pattern"},
+		{"unknown payload", Policy{Rules: []PolicyRule{{Payloads: []string{"x11"}, Action: POLICY_ALLOW}}}, "unknown payload"},
+		{"unknown day", Policy{Rules: []PolicyRule{{Days: []string{"monday"}, Action: POLICY_ALLOW}}}, "unknown day"},
+		{"invalid hours", Policy{Rules: []PolicyRule{{Hours: "9-17", Action: POLICY_ALLOW}}}, "invalid hours"},
+		{"hours out of range", Policy{Rules: []PolicyRule{{Hours: "09:00-24:30", Action: POLICY_ALLOW}}}, "invalid hours"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.policy.Validate(); err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("Validate returned %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestReloadPolicy(t *testing.T) {
+	dir := t.TempDir()
+	km := newDetachedKeyManager(filepath.Join(dir, "config.json"))
+	req := &PolicyRequest{Operation: OPERATION_SIGN, KeyName: "key", Payload: PAYLOAD_AUTH}
+
+	// a missing default policy file allows everything
+	if err := km.ReloadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	if d := km.ExplainPolicy(req); d.Action != POLICY_ALLOW {
+		t.Fatalf("decision %s without a policy file", d)
+	}
+
+	valid := `{"defaultAction": "confirm", "rules": [{"keys": ["key"], "payloads": ["auth"], "action": "pin"}]}`
+	if err := os.WriteFile(km.PolicyPath(), []byte(valid), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := km.ReloadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	if d := km.ExplainPolicy(req); d.Action != POLICY_PIN || d.Rule != 0 {
+		t.Fatalf("decision %s with a valid policy file", d)
+	}
+
+	for _, invalid := range []string{
+		`{"rules": [`,
+		`{"rules": [{"keys": ["key"], "action": "sometimes"}]}`,
+		`{"defaultAction": "allow", "rules": [{"hours": "late", "action": "allow"}]}`,
+	} {
+		if err := os.WriteFile(km.PolicyPath(), []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := km.ReloadPolicy(); err == nil {
+			t.Fatalf("invalid policy %s loaded", invalid)
+		}
+		for _, op := range []string{OPERATION_LIST, OPERATION_SIGN} {
+			req.Operation = op
+			if d := km.ExplainPolicy(req); d.Action != POLICY_DENY || d.Rule != -1 {
+				t.Fatalf("%s decision %s with the invalid policy %s", op, d, invalid)
+			}
+		}
+	}
+
+	// an explicitly configured policy file that is missing denies everything too
+	km.config.PolicyFile = filepath.Join(dir, "missing.json")
+	if err := km.ReloadPolicy(); err == nil {
+		t.Fatal("missing policy file loaded")
+	}
+	if d := km.ExplainPolicy(req); d.Action != POLICY_DENY {
+		t.Fatalf("decision %s with a missing policy file", d)
+	}
+}
+
+func TestWatchPolicy(t *testing.T) {
+	interval := policyWatchInterval
+	policyWatchInterval = 10 * time.Millisecond
+	defer func() { policyWatchInterval = interval }()
+
+	km := newDetachedKeyManager(filepath.Join(t.TempDir(), "config.json"))
+	if err := km.ReloadPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	req := &PolicyRequest{Operation: OPERATION_SIGN, KeyName: "key", Payload: PAYLOAD_AUTH}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		km.watchPolicy(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(action PolicyAction) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			d := km.ExplainPolicy(req)
+			if d.Action == action {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("decision %s, expected %s", d, action)
+			}
+			time.Sleep(policyWatchInterval)
+		}
+	}
+
+	// created, changed, broken and removed again
+	for _, step := range []struct {
+		policy string
+		action PolicyAction
+	}{
+		{`{"rules": [{"keys": ["key"], "action": "confirm"}]}`, POLICY_CONFIRM},
+		{`{"rules": [{"keys": ["key"], "action": "pin"}, {"action": "allow"}]}`, POLICY_PIN},
+		{`{"rules": [`, POLICY_DENY},
+		{"", POLICY_ALLOW},
+	} {
+		if step.policy == "" {
+			if err := os.Remove(km.PolicyPath()); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := os.WriteFile(km.PolicyPath(), []byte(step.policy), 0600); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(step.action)
+	}
+}
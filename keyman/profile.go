@@ -0,0 +1,312 @@
+package keyman
+
+import (
+	"fmt"
+	"log"
+	"ncryptagent/keyman/listeners"
+	"strings"
+	"sync"
+)
+
+// DEFAULT_PROFILE is the display name of the profile formed by the top level listeners and the keys that aren't
+// assigned to a profile
+const DEFAULT_PROFILE = "default"
+
+// ProfileConfig describes a virtual agent with its own keys, lock state, PIN timeout and listener endpoints. Keys are
+// assigned to a profile through KeyConfig.Profile.
+type ProfileConfig struct {
+	Name string `json:"name"`
+	// PinTimeout overrides the top level PIN timeout for the profile's keys, 0 uses the top level value
+	PinTimeout int `json:"pinTimeout,omitempty"`
+	// NamedPipe is the full pipe path, e.g. \\.\pipe\ncryptagent-work
+	NamedPipe string `json:"namedPipe,omitempty"`
+	// CygwinSockets are the socket files of the profile's Cygwin listener
+	CygwinSockets []string `json:"cygwinSockets,omitempty"`
+	// UnixSocket is the socket path of the profile on Linux and other unix systems
+	UnixSocket string `json:"unixSocket,omitempty"`
+}
+
+// Profile is a running profile
+type Profile struct {
+	config *ProfileConfig
+	agent  *KeyManagerAgent
+
+	mu        sync.Mutex
+	listeners []listeners.Listener
+}
+
+func (p *Profile) Name() string {
+	return p.config.Name
+}
+
+func (p *Profile) Config() ProfileConfig {
+	return *p.config
+}
+
+// Locked reports whether a client has locked the profile's agent
+func (p *Profile) Locked() bool {
+	return p.agent.Locked()
+}
+
+// Listeners returns the profile's listeners that have been started
+func (p *Profile) Listeners() []listeners.Listener {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]listeners.Listener(nil), p.listeners...)
+}
+
+func (p *Profile) stop() {
+	for _, l := range p.Listeners() {
+		l.Stop()
+	}
+}
+
+// startProfile starts the listeners of a profile, the listeners stop when the KeyManager is closed
+func (km *KeyManager) startProfile(p *Profile) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.listeners = km.profileListeners(p.config)
+	for _, l := range p.listeners {
+		km.lwg.Add(1)
+		go func(l listeners.Listener) {
+			defer km.lwg.Done()
+			log.Printf("Starting listener %T for profile %s\n", l, p.Name())
+			if err := l.Run(km.lctx, p.agent); err != nil {
+				log.Printf("Error result from listener Run() for profile %s: %s\n", p.Name(), err)
+			}
+		}(l)
+	}
+}
+
+// validateProfile checks that a profile's name and endpoints don't clash with the top level listeners or one of others
+func (km *KeyManager) validateProfile(pc *ProfileConfig, others []*ProfileConfig) error {
+	if pc.Name == "" {
+		return fmt.Errorf("profile name is empty")
+	}
+	if strings.EqualFold(pc.Name, DEFAULT_PROFILE) {
+		return fmt.Errorf("profile name %s is reserved", pc.Name)
+	}
+	if pc.NamedPipe == "" && len(pc.CygwinSockets) == 0 && pc.UnixSocket == "" {
+		return fmt.Errorf("profile %s has no named pipe, Cygwin socket or unix socket", pc.Name)
+	}
+	if pc.PinTimeout < 0 {
+		return fmt.Errorf("profile %s has a negative PIN timeout", pc.Name)
+	}
+
+	pipes := map[string]string{strings.ToLower(listeners.NAMED_PIPE): DEFAULT_PROFILE}
+	sockets := make(map[string]string)
+	for _, s := range km.GetCygwinSocketPaths() {
+		sockets[strings.ToLower(s)] = DEFAULT_PROFILE
+	}
+	sockets[strings.ToLower(km.UnixSocketPath())] = DEFAULT_PROFILE
+	for _, other := range others {
+		if other == pc {
+			continue
+		}
+		if strings.EqualFold(other.Name, pc.Name) {
+			return fmt.Errorf("profile %s already exists", pc.Name)
+		}
+		if other.NamedPipe != "" {
+			pipes[strings.ToLower(other.NamedPipe)] = other.Name
+		}
+		for _, s := range other.CygwinSockets {
+			sockets[strings.ToLower(s)] = other.Name
+		}
+		if other.UnixSocket != "" {
+			sockets[strings.ToLower(other.UnixSocket)] = other.Name
+		}
+	}
+
+	if pc.NamedPipe != "" {
+		if !strings.HasPrefix(pc.NamedPipe, `\\.\pipe\`) {
+			return fmt.Errorf("profile %s: named pipe %s must start with \\\\.\\pipe\\", pc.Name, pc.NamedPipe)
+		}
+		if owner, ok := pipes[strings.ToLower(pc.NamedPipe)]; ok {
+			return fmt.Errorf("profile %s: named pipe %s is used by profile %s", pc.Name, pc.NamedPipe, owner)
+		}
+	}
+	for _, s := range pc.CygwinSockets {
+		if owner, ok := sockets[strings.ToLower(s)]; ok {
+			return fmt.Errorf("profile %s: Cygwin socket %s is used by profile %s", pc.Name, s, owner)
+		}
+	}
+	if owner, ok := sockets[strings.ToLower(pc.UnixSocket)]; ok && pc.UnixSocket != "" {
+		return fmt.Errorf("profile %s: unix socket %s is used by profile %s", pc.Name, pc.UnixSocket, owner)
+	}
+	return nil
+}
+
+// loadProfiles creates the runtime state of the configured profiles, invalid profiles are logged and skipped. A
+// profile that clashes with an earlier one is skipped, the earlier one is loaded.
+func (km *KeyManager) loadProfiles() {
+	km.profiles = nil
+	var loaded []*ProfileConfig
+	for _, pc := range km.config.Profiles {
+		if err := km.validateProfile(pc, loaded); err != nil {
+			log.Printf("Ignoring profile: %s", err)
+			continue
+		}
+		km.profiles = append(km.profiles, km.newProfile(pc))
+		loaded = append(loaded, pc)
+	}
+
+	for _, kc := range km.config.Keys {
+		if kc.Profile != "" && km.GetProfile(kc.Profile) == nil {
+			log.Printf("Key %s is assigned to unknown profile %s, it is served by the default profile", kc.Name, kc.Profile)
+		}
+	}
+}
+
+// keyProfile returns the name of the profile serving a key, empty for the default profile. Keys assigned to a profile
+// that was skipped as invalid or has been removed are served by the default profile rather than by no agent.
+func (km *KeyManager) keyProfile(k *Key) string {
+	name := k.Profile()
+	if name == "" {
+		return ""
+	}
+	p := km.GetProfile(name)
+	if p == nil {
+		return ""
+	}
+	return p.Name()
+}
+
+func (km *KeyManager) newProfile(pc *ProfileConfig) *Profile {
+	return &Profile{
+		config: pc,
+		agent:  &KeyManagerAgent{km: km, profile: pc.Name},
+	}
+}
+
+// Profiles returns the configured profiles, not including the default profile
+func (km *KeyManager) Profiles() []*Profile {
+	km.profilesMu.Lock()
+	defer km.profilesMu.Unlock()
+	return append([]*Profile(nil), km.profiles...)
+}
+
+// ProfileNames returns the names keys can be assigned to, starting with the default profile
+func (km *KeyManager) ProfileNames() []string {
+	names := []string{DEFAULT_PROFILE}
+	for _, p := range km.Profiles() {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// GetProfile returns the profile with the given name, or nil
+func (km *KeyManager) GetProfile(name string) *Profile {
+	for _, p := range km.Profiles() {
+		if strings.EqualFold(p.Name(), name) {
+			return p
+		}
+	}
+	return nil
+}
+
+// AddProfile adds a profile to the config and starts its listeners if the KeyManager is running
+func (km *KeyManager) AddProfile(pc ProfileConfig) (*Profile, error) {
+	km.profilesMu.Lock()
+	c := &pc
+	if err := km.validateProfile(c, km.config.Profiles); err != nil {
+		km.profilesMu.Unlock()
+		return nil, err
+	}
+	km.config.Profiles = append(km.config.Profiles, c)
+	p := km.newProfile(c)
+	km.profiles = append(km.profiles, p)
+	km.profilesMu.Unlock()
+
+	if km.lctx != nil {
+		km.startProfile(p)
+	}
+
+	return p, km.SaveConfig()
+}
+
+// RemoveProfile stops a profile's listeners and removes it from the config. Its keys move to the default profile.
+func (km *KeyManager) RemoveProfile(name string) error {
+	p := km.GetProfile(name)
+	if p == nil {
+		return fmt.Errorf("profile %s not found", name)
+	}
+	p.stop()
+
+	km.profilesMu.Lock()
+	for i := range km.profiles {
+		if km.profiles[i] == p {
+			km.profiles = append(km.profiles[:i], km.profiles[i+1:]...)
+			break
+		}
+	}
+	for i := range km.config.Profiles {
+		if km.config.Profiles[i] == p.config {
+			km.config.Profiles = append(km.config.Profiles[:i], km.config.Profiles[i+1:]...)
+			break
+		}
+	}
+	km.profilesMu.Unlock()
+
+	for _, k := range km.KeysList() {
+		if strings.EqualFold(k.Profile(), p.Name()) {
+			km.assignProfile(k, "")
+		}
+	}
+
+	return km.SaveConfig()
+}
+
+// SetKeyProfile assigns a key to a profile, DEFAULT_PROFILE or an empty name assigns it to the default profile
+func (km *KeyManager) SetKeyProfile(k *Key, name string) error {
+	if strings.EqualFold(name, DEFAULT_PROFILE) {
+		name = ""
+	}
+	if name != "" {
+		p := km.GetProfile(name)
+		if p == nil {
+			return fmt.Errorf("profile %s not found", name)
+		}
+		name = p.Name()
+	}
+
+	km.assignProfile(k, name)
+	return km.SaveConfig()
+}
+
+func (km *KeyManager) assignProfile(k *Key, name string) {
+	if k.config == nil {
+		return
+	}
+	k.config.Profile = name
+	k.SetTimeout(km.pinTimeoutFor(k.config))
+}
+
+// pinTimeoutFor returns the PIN timeout of the key's profile
+func (km *KeyManager) pinTimeoutFor(kc *KeyConfig) int {
+	if kc.Profile != "" {
+		if p := km.GetProfile(kc.Profile); p != nil && p.config.PinTimeout > 0 {
+			return p.config.PinTimeout
+		}
+	}
+	return km.config.PinTimeout
+}
+
+// SetProfilePinTimeout changes the PIN timeout of a profile's keys, 0 reverts to the top level timeout
+func (km *KeyManager) SetProfilePinTimeout(name string, timeout int) error {
+	p := km.GetProfile(name)
+	if p == nil {
+		return fmt.Errorf("profile %s not found", name)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("PIN timeout must not be negative")
+	}
+	p.config.PinTimeout = timeout
+
+	for _, k := range km.KeysList() {
+		if strings.EqualFold(k.Profile(), p.Name()) {
+			k.SetTimeout(km.pinTimeoutFor(k.config))
+		}
+	}
+	return km.SaveConfig()
+}
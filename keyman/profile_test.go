@@ -0,0 +1,347 @@
+package keyman
+
+import (
+	"fmt"
+	"ncryptagent/keyman/listeners"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newProfileKeyManager returns a KeyManager with the software backend and the given profiles loaded, with fixed
+// default endpoints so clashes with them don't depend on the environment
+func newProfileKeyManager(t *testing.T, profiles ...*ProfileConfig) *KeyManager {
+	t.Helper()
+	dir := t.TempDir()
+	km := newDetachedKeyManager(filepath.Join(dir, "config.json"))
+	km.config.PinTimeout = 5
+	km.config.UnixSocketPath = filepath.Join(dir, "agent.sock")
+	km.config.CygwinSockets = []string{filepath.Join(dir, "cygwin-agent.sock")}
+	km.config.Profiles = profiles
+	km.RegisterBackend(NewSoftwareBackend())
+	km.loadProfiles()
+	t.Cleanup(km.Close)
+	return km
+}
+
+// addProfileKey creates a software key assigned to profile
+func addProfileKey(t *testing.T, km *KeyManager, name, profile string) *Key {
+	t.Helper()
+	k, err := km.CreateKey(&KeyConfig{Name: name, Type: TYPE_SOFTWARE, Algorithm: ALG_ED25519, Profile: profile}, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// listedKeys returns the sorted comments of the keys an agent lists
+func listedKeys(kma *KeyManagerAgent) (string, error) {
+	ids, err := kma.List()
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for _, id := range ids {
+		names = append(names, strings.TrimSuffix(id.Comment, " [software]"))
+	}
+	sort.Strings(names)
+	return strings.Join(names, ","), nil
+}
+
+func TestValidateProfile(t *testing.T) {
+	work := &ProfileConfig{
+		Name:          "work",
+		NamedPipe:     `\\.\pipe\ncryptagent-work`,
+		CygwinSockets: []string{`C:\work\agent.sock`},
+		UnixSocket:    "/run/work/agent.sock",
+	}
+	km := newProfileKeyManager(t, work)
+	defaultCygwin := km.GetCygwinSocketPaths()[0]
+
+	for _, tc := range []struct {
+		name    string
+		profile ProfileConfig
+		err     string
+	}{
+		{name: "valid", profile: ProfileConfig{Name: "home", NamedPipe: `\\.\pipe\ncryptagent-home`}},
+		{name: "unix socket only", profile: ProfileConfig{Name: "home", UnixSocket: "/run/home/agent.sock"}},
+		{name: "empty name", profile: ProfileConfig{NamedPipe: `\\.\pipe\x`}, err: "name is empty"},
+		{name: "reserved name", profile: ProfileConfig{Name: "Default", NamedPipe: `\\.\pipe\x`}, err: "reserved"},
+		{name: "no endpoint", profile: ProfileConfig{Name: "home"}, err: "has no named pipe"},
+		{name: "negative PIN timeout", profile: ProfileConfig{Name: "home", NamedPipe: `\\.\pipe\x`, PinTimeout: -1}, err: "negative PIN timeout"},
+		{name: "duplicate name", profile: ProfileConfig{Name: "WORK", NamedPipe: `\\.\pipe\x`}, err: "already exists"},
+		{name: "pipe outside the pipe namespace", profile: ProfileConfig{Name: "home", NamedPipe: `C:\pipe`}, err: "must start with"},
+		{name: "default named pipe", profile: ProfileConfig{Name: "home", NamedPipe: strings.Replace(listeners.NAMED_PIPE, "openssh", "OpenSSH", 1)}, err: "used by profile default"},
+		{name: "named pipe of another profile", profile: ProfileConfig{Name: "home", NamedPipe: `\\.\pipe\ncryptagent-WORK`}, err: "used by profile work"},
+		{name: "default Cygwin socket", profile: ProfileConfig{Name: "home", CygwinSockets: []string{defaultCygwin}}, err: "used by profile default"},
+		{name: "Cygwin socket of another profile", profile: ProfileConfig{Name: "home", CygwinSockets: []string{`c:\WORK\agent.sock`}}, err: "used by profile work"},
+		{name: "default unix socket", profile: ProfileConfig{Name: "home", UnixSocket: km.UnixSocketPath()}, err: "used by profile default"},
+		{name: "unix socket of another profile", profile: ProfileConfig{Name: "home", UnixSocket: "/run/work/agent.sock"}, err: "used by profile work"},
+		{name: "Cygwin socket used as unix socket", profile: ProfileConfig{Name: "home", UnixSocket: `C:\work\agent.sock`}, err: "used by profile work"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := km.validateProfile(&tc.profile, km.config.Profiles)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("got error %v, expected %q", err, tc.err)
+			}
+		})
+	}
+
+	// a profile doesn't clash with itself when it is validated again
+	if err := km.validateProfile(work, km.config.Profiles); err != nil {
+		t.Errorf("loaded profile is invalid: %s", err)
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		profiles []*ProfileConfig
+		loaded   string
+	}{
+		{name: "none", loaded: DEFAULT_PROFILE},
+		{name: "valid", profiles: []*ProfileConfig{
+			{Name: "work", UnixSocket: "/run/work.sock"},
+			{Name: "home", UnixSocket: "/run/home.sock"},
+		}, loaded: "default,work,home"},
+		{name: "invalid skipped", profiles: []*ProfileConfig{
+			{Name: "work", UnixSocket: "/run/work.sock"},
+			{Name: "nowhere"},
+			{Name: "default", UnixSocket: "/run/default.sock"},
+			{Name: "home", UnixSocket: "/run/home.sock"},
+		}, loaded: "default,work,home"},
+		{name: "later clash skipped", profiles: []*ProfileConfig{
+			{Name: "work", UnixSocket: "/run/work.sock"},
+			{Name: "other", UnixSocket: "/run/work.sock"},
+		}, loaded: "default,work"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			km := newProfileKeyManager(t, tc.profiles...)
+			if loaded := strings.Join(km.ProfileNames(), ","); loaded != tc.loaded {
+				t.Errorf("loaded profiles %s, expected %s", loaded, tc.loaded)
+			}
+			// skipped profiles stay in the config so a fixed config file keeps them
+			if len(km.config.Profiles) != len(tc.profiles) {
+				t.Errorf("config has %d profiles, expected %d", len(km.config.Profiles), len(tc.profiles))
+			}
+		})
+	}
+}
+
+func TestProfileLocks(t *testing.T) {
+	km := newProfileKeyManager(t,
+		&ProfileConfig{Name: "work", UnixSocket: "/run/work.sock"},
+		&ProfileConfig{Name: "home", UnixSocket: "/run/home.sock"},
+	)
+	addProfileKey(t, km, "default-key", "")
+	addProfileKey(t, km, "work-key", "work")
+	addProfileKey(t, km, "home-key", "home")
+	work, home := km.GetProfile("work"), km.GetProfile("HOME")
+
+	for _, tc := range []struct {
+		name   string
+		action func() error
+		locked map[string]bool
+		lists  map[string]string
+	}{
+		{
+			name:   "unlocked",
+			action: func() error { return nil },
+			lists:  map[string]string{"default": "default-key", "work": "work-key", "home": "home-key"},
+		},
+		{
+			name:   "lock work",
+			action: func() error { return work.agent.Lock([]byte("work")) },
+			locked: map[string]bool{"work": true},
+			lists:  map[string]string{"default": "default-key", "work": "", "home": "home-key"},
+		},
+		{
+			name: "lock the default profile",
+			action: func() error {
+				if err := home.agent.Unlock([]byte("work")); err == nil {
+					return fmt.Errorf("unlocked an unlocked agent")
+				}
+				return km.sshAgent.Lock([]byte("default"))
+			},
+			locked: map[string]bool{"work": true, "default": true},
+			lists:  map[string]string{"default": "", "work": "", "home": "home-key"},
+		},
+		{
+			name: "unlock work",
+			action: func() error {
+				if err := work.agent.Unlock([]byte("default")); err == nil {
+					return fmt.Errorf("unlocked with the passphrase of another profile")
+				}
+				return work.agent.Unlock([]byte("work"))
+			},
+			locked: map[string]bool{"default": true},
+			lists:  map[string]string{"default": "", "work": "work-key", "home": "home-key"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.action(); err != nil {
+				t.Fatal(err)
+			}
+			agents := map[string]*KeyManagerAgent{"default": &km.sshAgent, "work": work.agent, "home": home.agent}
+			for name, kma := range agents {
+				if kma.Locked() != tc.locked[name] {
+					t.Errorf("%s locked %t, expected %t", name, kma.Locked(), tc.locked[name])
+				}
+				listed, err := listedKeys(kma)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if listed != tc.lists[name] {
+					t.Errorf("%s lists %q, expected %q", name, listed, tc.lists[name])
+				}
+			}
+			if work.Locked() != tc.locked["work"] {
+				t.Errorf("work profile locked %t", work.Locked())
+			}
+		})
+	}
+}
+
+func TestProfilePinTimeout(t *testing.T) {
+	km := newProfileKeyManager(t,
+		&ProfileConfig{Name: "work", UnixSocket: "/run/work.sock", PinTimeout: 30},
+		&ProfileConfig{Name: "home", UnixSocket: "/run/home.sock"},
+	)
+
+	for _, tc := range []struct {
+		name    string
+		action  func() error
+		err     string
+		profile string
+		timeout int
+	}{
+		{name: "default profile", profile: "", timeout: 5},
+		{name: "profile override", profile: "work", timeout: 30},
+		{name: "profile without override", profile: "home", timeout: 5},
+		{name: "unknown profile", profile: "gone", timeout: 5},
+		{name: "change override", action: func() error { return km.SetProfilePinTimeout("WORK", 60) }, profile: "work", timeout: 60},
+		{name: "set override", action: func() error { return km.SetProfilePinTimeout("home", 10) }, profile: "home", timeout: 10},
+		{name: "revert override", action: func() error { return km.SetProfilePinTimeout("home", 0) }, profile: "home", timeout: 5},
+		{name: "top level timeout", action: func() error { km.SetPinTimeout(15); return nil }, profile: "home", timeout: 15},
+		{name: "top level timeout with override", profile: "work", timeout: 60},
+		{name: "negative", action: func() error { return km.SetProfilePinTimeout("work", -1) }, err: "must not be negative", profile: "work", timeout: 60},
+		{name: "unknown", action: func() error { return km.SetProfilePinTimeout("gone", 1) }, err: "not found", profile: "work", timeout: 60},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.action != nil {
+				err := tc.action()
+				if tc.err == "" && err != nil {
+					t.Fatal(err)
+				}
+				if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+					t.Fatalf("got error %v, expected %q", err, tc.err)
+				}
+			}
+			if timeout := km.pinTimeoutFor(&KeyConfig{Profile: tc.profile}); timeout != tc.timeout {
+				t.Errorf("PIN timeout %d, expected %d", timeout, tc.timeout)
+			}
+		})
+	}
+}
+
+func TestSetKeyProfile(t *testing.T) {
+	km := newProfileKeyManager(t, &ProfileConfig{Name: "work", UnixSocket: "/run/work.sock"})
+	k := addProfileKey(t, km, "key", "")
+
+	for _, tc := range []struct {
+		name    string
+		profile string
+		err     string
+		config  string
+		served  string
+	}{
+		{name: "to a profile", profile: "Work", config: "work", served: "work"},
+		{name: "unknown profile", profile: "home", err: "not found", config: "work", served: "work"},
+		{name: "by default name", profile: "DEFAULT", config: "", served: ""},
+		{name: "back to the profile", profile: "work", config: "work", served: "work"},
+		{name: "by empty name", profile: "", config: "", served: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := km.SetKeyProfile(k, tc.profile)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("got error %v, expected %q", err, tc.err)
+			}
+			if k.Profile() != tc.config {
+				t.Errorf("key assigned to %q, expected %q", k.Profile(), tc.config)
+			}
+			for _, name := range km.ProfileNames() {
+				kma := &km.sshAgent
+				if p := km.GetProfile(name); p != nil {
+					kma = p.agent
+				}
+				listed, err := listedKeys(kma)
+				if err != nil {
+					t.Fatal(err)
+				}
+				served := name == DEFAULT_PROFILE && tc.served == "" || name == tc.served
+				if (listed == "key") != served {
+					t.Errorf("profile %s lists %q", name, listed)
+				}
+			}
+		})
+	}
+}
+
+// TestOrphanedProfileKeys checks that keys of a profile that was skipped as invalid or removed are served by the
+// default profile
+func TestOrphanedProfileKeys(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		setup   func(km *KeyManager) error
+		profile string
+	}{
+		{
+			name:    "invalid profile",
+			setup:   func(km *KeyManager) error { return nil },
+			profile: "invalid",
+		},
+		{
+			name:    "unknown profile",
+			setup:   func(km *KeyManager) error { return nil },
+			profile: "unknown",
+		},
+		{
+			name:    "removed profile",
+			setup:   func(km *KeyManager) error { return km.RemoveProfile("work") },
+			profile: "work",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			km := newProfileKeyManager(t,
+				&ProfileConfig{Name: "work", UnixSocket: "/run/work.sock"},
+				&ProfileConfig{Name: "invalid", UnixSocket: "/run/work.sock"},
+			)
+			k := addProfileKey(t, km, "key", tc.profile)
+			if err := tc.setup(km); err != nil {
+				t.Fatal(err)
+			}
+
+			if listed, err := listedKeys(&km.sshAgent); err != nil || listed != "key" {
+				t.Fatalf("default profile lists %q (%v), expected the key", listed, err)
+			}
+			if _, err := km.sshAgent.Sign(*k.SSHPublicKey, []byte("data")); err != nil {
+				t.Fatalf("default profile can't sign with the key: %s", err)
+			}
+			if p := km.GetProfile("work"); p != nil {
+				if listed, err := listedKeys(p.agent); err != nil || listed != "" {
+					t.Errorf("profile work lists %q (%v)", listed, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package keyman
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"ncryptagent/ncrypt"
+	"sort"
+)
+
+// rsaKeyLengths are the RSA key lengths offered when creating keys, when the provider supports them
+var rsaKeyLengths = []int{2048, 3072, 4096}
+
+// AlgorithmInfo is an algorithm a key storage provider supports
+type AlgorithmInfo struct {
+	Algorithm string
+	// Lengths are the RSA key lengths the provider can create, empty for curves
+	Lengths []int
+}
+
+// ProviderInfo is what a key storage provider told when it was probed
+type ProviderInfo struct {
+	Name       string
+	Algorithms []AlgorithmInfo
+	// Create is whether keys can be created on the provider, existing keys can be loaded from every provider
+	Create bool
+}
+
+// Supports reports whether the provider has an algorithm
+func (p *ProviderInfo) Supports(algorithm string) bool {
+	for _, a := range p.Algorithms {
+		if a.Algorithm == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// NCryptProviders returns the installed key storage providers, probed once per run
+func (km *KeyManager) NCryptProviders() ([]*ProviderInfo, error) {
+	b, ok := km.backends["NCRYPT"].(*ncryptBackend)
+	if !ok {
+		return nil, fmt.Errorf("no NCRYPT backend")
+	}
+	return b.Providers()
+}
+
+// Providers enumerates the key storage providers and probes which of AVAILABLE_ALGORITHMS each one supports, its RSA
+// key lengths and whether it creates keys. Creation is probed with a key that is never finalized, so nothing is
+// stored and no prompt is shown.
+func (b *ncryptBackend) Providers() ([]*ProviderInfo, error) {
+	b.mu.Lock()
+	providers := b.providers
+	b.mu.Unlock()
+	if providers != nil {
+		return providers, nil
+	}
+
+	names, err := b.api.EnumStorageProviders()
+	if err != nil {
+		return nil, fmt.Errorf("unable to enumerate key storage providers: %w", err)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p, err := b.probeProvider(name)
+		if err != nil {
+			log.Printf("Skipping key storage provider %s: %v", name, err)
+			continue
+		}
+		providers = append(providers, p)
+	}
+
+	b.mu.Lock()
+	b.providers = providers
+	b.mu.Unlock()
+	return providers, nil
+}
+
+// algSupported asks a provider whether it supports alg. Versions of Windows without NCryptIsAlgSupported can't be
+// asked, the algorithm is taken as supported and creating or importing the key fails if it isn't.
+func (b *ncryptBackend) algSupported(ph uintptr, alg string) (bool, error) {
+	ok, err := b.api.IsAlgSupported(ph, alg)
+	if errors.Is(err, ncrypt.ErrNotSupported) {
+		return true, nil
+	}
+	return ok, err
+}
+
+func (b *ncryptBackend) probeProvider(name string) (*ProviderInfo, error) {
+	ph, err := b.getProviderHandle(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ProviderInfo{Name: name}
+	for _, alg := range ncrypt.AVAILABLE_ALGORITHMS {
+		ok, err := b.algSupported(ph, alg)
+		if err != nil {
+			log.Printf("Unable to probe %s on provider %s: %v", alg, name, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		info := AlgorithmInfo{Algorithm: alg}
+		created := false
+		// smart card keys are created on the card with its own tools
+		if name != ncrypt.ProviderMSSC {
+			info.Lengths, created = b.probeCreate(ph, alg)
+		}
+		if created {
+			p.Create = true
+		}
+		p.Algorithms = append(p.Algorithms, info)
+	}
+
+	log.Printf("Key storage provider %s: %v, create %v", name, p.Algorithms, p.Create)
+	return p, nil
+}
+
+// probeCreate starts creating a key of the algorithm and reports whether the provider allows it, with the offered
+// RSA key lengths the provider supports
+func (b *ncryptBackend) probeCreate(ph uintptr, alg string) ([]int, bool) {
+	probeUUID, _ := uuid.NewRandom()
+	kh, err := b.api.CreatePersistedKey(ph, "ncryptagent-probe-"+probeUUID.String(), alg, 0, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer b.api.FreeObject(kh)
+
+	if alg != ncrypt.ALG_RSA {
+		return nil, true
+	}
+
+	// NCRYPT_SUPPORTED_LENGTHS: minimum, maximum, increment and default length
+	buf, err := b.api.GetPropertyBytes(kh, ncrypt.NCRYPT_LENGTHS_PROPERTY)
+	if err != nil || len(buf) < 16 {
+		return rsaKeyLengths, true
+	}
+	min := int(binary.LittleEndian.Uint32(buf[0:]))
+	max := int(binary.LittleEndian.Uint32(buf[4:]))
+	inc := int(binary.LittleEndian.Uint32(buf[8:]))
+
+	var lengths []int
+	for _, l := range rsaKeyLengths {
+		if l < min || l > max {
+			continue
+		}
+		if (inc == 0 && l != min) || (inc != 0 && (l-min)%inc != 0) {
+			continue
+		}
+		lengths = append(lengths, l)
+	}
+	return lengths, len(lengths) > 0
+}
@@ -0,0 +1,117 @@
+package keyman
+
+import (
+	"fmt"
+	"log"
+	"ncryptagent/keyman/listeners"
+	"ncryptagent/ncrypt"
+	"strings"
+)
+
+// Key scopes of KeyConfig.Scope
+const (
+	SCOPE_USER    = "user"
+	SCOPE_MACHINE = "machine"
+)
+
+// MachineListenerConfig is the named pipe serving the machine scope keys, e.g. to the build jobs of a build server
+// running the agent as a service. Only SYSTEM, the account running the agent and the accounts and groups in Allow can
+// connect to it.
+type MachineListenerConfig struct {
+	// NamedPipe is the full pipe path, listeners.MACHINE_NAMED_PIPE when empty
+	NamedPipe string `json:"namedPipe,omitempty"`
+	// Allow are the accounts and groups allowed to connect, as names like BUILTIN\Users or DOMAIN\build-agents or as
+	// SIDs like S-1-5-32-545
+	Allow []string `json:"allow,omitempty"`
+}
+
+func (kc *KeyConfig) machineScope() bool {
+	return strings.EqualFold(kc.Scope, SCOPE_MACHINE)
+}
+
+// checkScope refuses unknown scopes, and machine scope for keys other than NCrypt keys of a key storage provider with
+// a machine key store
+func checkScope(kc *KeyConfig) error {
+	switch strings.ToLower(kc.Scope) {
+	case "", SCOPE_USER:
+		return nil
+	case SCOPE_MACHINE:
+		if kc.Type != "NCRYPT" {
+			return fmt.Errorf("key %s: only NCRYPT keys can have machine scope", kc.Name)
+		}
+		if kc.ProviderName == ncrypt.ProviderMSSC {
+			return fmt.Errorf("key %s: smart card keys can't have machine scope", kc.Name)
+		}
+		return nil
+	}
+	return fmt.Errorf("key %s has unknown scope %s", kc.Name, kc.Scope)
+}
+
+// ncryptFlags returns NCRYPT_MACHINE_KEY_FLAG for machine scope keys, for opening, creating and importing them
+func (kc *KeyConfig) ncryptFlags() uint32 {
+	if kc.machineScope() {
+		return ncrypt.NCRYPT_MACHINE_KEY_FLAG
+	}
+	return 0
+}
+
+// MachineNamedPipe returns the pipe of the machine listener, empty when it isn't configured
+func (km *KeyManager) MachineNamedPipe() string {
+	if km.config.MachineListener == nil {
+		return ""
+	}
+	if km.config.MachineListener.NamedPipe == "" {
+		return listeners.MACHINE_NAMED_PIPE
+	}
+	return km.config.MachineListener.NamedPipe
+}
+
+// MachineListener returns the machine listener once it has been started, or nil
+func (km *KeyManager) MachineListener() listeners.Listener {
+	return km.machineListener
+}
+
+// validateMachinePipe checks that the machine listener's pipe is a pipe path and not the pipe of the default profile
+// or of another profile
+func (km *KeyManager) validateMachinePipe(path string) error {
+	if !strings.HasPrefix(path, `\\.\pipe\`) {
+		return fmt.Errorf("named pipe %s must start with \\\\.\\pipe\\", path)
+	}
+	if strings.EqualFold(path, listeners.NAMED_PIPE) {
+		return fmt.Errorf("named pipe %s is used by profile %s", path, DEFAULT_PROFILE)
+	}
+	for _, p := range km.config.Profiles {
+		if strings.EqualFold(path, p.NamedPipe) {
+			return fmt.Errorf("named pipe %s is used by profile %s", path, p.Name)
+		}
+	}
+	return nil
+}
+
+// startMachineListener starts the machine listener when it is configured, it stops when the KeyManager is closed
+func (km *KeyManager) startMachineListener() {
+	if km.config.MachineListener == nil {
+		return
+	}
+	path := km.MachineNamedPipe()
+	if err := km.validateMachinePipe(path); err != nil {
+		log.Printf("Machine listener not started: %s", err)
+		return
+	}
+
+	l, err := km.newMachineListener(path, km.config.MachineListener.Allow)
+	if err != nil {
+		log.Printf("Machine listener not started: %s", err)
+		return
+	}
+	km.machineListener = l
+
+	km.lwg.Add(1)
+	go func() {
+		defer km.lwg.Done()
+		log.Printf("Starting machine listener on %s for %s\n", path, strings.Join(km.config.MachineListener.Allow, ", "))
+		if err := l.Run(km.lctx, km.machineAgent); err != nil {
+			log.Printf("Error result from machine listener Run(): %s\n", err)
+		}
+	}()
+}
@@ -0,0 +1,258 @@
+package keyman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"ncryptagent/keyman/listeners"
+	"ncryptagent/ncrypt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestNCryptMachineScope creates and imports machine scope keys on the emulator through a KeyManager and checks that
+// they are apart from the user's keys, that an account without administrator rights can use but not create them, that
+// the machine agent serves only them and the security descriptor of the machine listener's pipe
+func TestNCryptMachineScope(t *testing.T) {
+	const keyName = "machine"
+
+	emu := ncrypt.NewEmulator()
+	defer func() {
+		if n := emu.OpenHandles(); n != 0 {
+			t.Errorf("%d handles were not freed", n)
+		}
+	}()
+	b := newNCryptBackend(emu)
+	dir := t.TempDir()
+	km := newDetachedKeyManager(filepath.Join(dir, "config.json"))
+	km.RegisterBackend(b)
+	defer km.Close()
+
+	// containers lists the containers of the platform provider in the user's or the machine's key store
+	containers := func(flags uint32) (map[string]bool, error) {
+		ph, err := emu.OpenStorageProvider(ncrypt.ProviderMSPlatform)
+		if err != nil {
+			return nil, err
+		}
+		defer emu.FreeObject(ph)
+		keys, err := emu.EnumKeys(ph, "", flags)
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]bool)
+		for _, k := range keys {
+			found[strings.ToLower(k.Container)] = true
+		}
+		return found, nil
+	}
+
+	var machine *Key
+	var err error
+	if !check(t, "create", func() error {
+		machine, err = km.CreateNewNCryptKey(keyName, "build-agent", ncrypt.ProviderMSPlatform, ncrypt.ALG_ECDSA_P256, 0, "", SCOPE_MACHINE)
+		if err != nil {
+			return err
+		}
+		if machine.Scope() != SCOPE_MACHINE || machine.config.Scope != SCOPE_MACHINE {
+			return fmt.Errorf("key has scope %s", machine.Scope())
+		}
+		return nil
+	}) {
+		return
+	}
+	container := strings.ToLower(machine.config.ContainerName)
+
+	check(t, "machine key store", func() error {
+		user, err := containers(0)
+		if err != nil {
+			return err
+		}
+		machineKeys, err := containers(ncrypt.NCRYPT_MACHINE_KEY_FLAG)
+		if err != nil {
+			return err
+		}
+		if user[container] || !machineKeys[container] {
+			return fmt.Errorf("container %s is in the user's key store or missing from the machine's", container)
+		}
+		return nil
+	})
+	check(t, "load", func() error {
+		kc := *machine.config
+		bk, err := b.Load(&kc)
+		if err != nil {
+			return err
+		}
+		defer bk.Close()
+		if string(bk.Public().Marshal()) != string((*machine.SSHPublicKey).Marshal()) {
+			return fmt.Errorf("loaded another public key")
+		}
+		kc.Scope = ""
+		if bk, err = b.Load(&kc); err == nil {
+			bk.Close()
+			return fmt.Errorf("machine key loaded from the user's key store")
+		}
+		return nil
+	})
+
+	check(t, "user key of the same container", func() error {
+		user, err := km.CreateKey(&KeyConfig{
+			Name:          "user",
+			Type:          "NCRYPT",
+			ContainerName: "build-agent",
+			ProviderName:  ncrypt.ProviderMSPlatform,
+			Algorithm:     ncrypt.ALG_ECDSA_P256,
+		}, CreateOptions{})
+		if err != nil {
+			return err
+		}
+		if user.Scope() != SCOPE_USER {
+			return fmt.Errorf("key has scope %s", user.Scope())
+		}
+		if string((*user.SSHPublicKey).Marshal()) == string((*machine.SSHPublicKey).Marshal()) {
+			return fmt.Errorf("the user's key is the machine key")
+		}
+		return nil
+	})
+
+	check(t, "import", func() error {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, "machine.pem")
+		if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return err
+		}
+		k, err := km.ImportNCryptKeyFile("machine-import", "", ncrypt.ProviderMSPlatform, path, "", "", SCOPE_MACHINE)
+		if err != nil {
+			return err
+		}
+		machineKeys, err := containers(ncrypt.NCRYPT_MACHINE_KEY_FLAG)
+		if err != nil {
+			return err
+		}
+		if k.Scope() != SCOPE_MACHINE || !machineKeys[strings.ToLower(k.config.ContainerName)] {
+			return fmt.Errorf("imported key is not in the machine's key store")
+		}
+		return nil
+	})
+
+	check(t, "refused scopes", func() error {
+		if _, err := km.CreateKey(&KeyConfig{
+			Name:         "card",
+			Type:         "NCRYPT",
+			ProviderName: ncrypt.ProviderMSSC,
+			Algorithm:    ncrypt.ALG_ECDSA_P256,
+			Scope:        SCOPE_MACHINE,
+		}, CreateOptions{}); err == nil || !strings.Contains(err.Error(), "machine scope") {
+			return fmt.Errorf("machine scope smart card key not refused: %v", err)
+		}
+		if _, err := km.LoadNCryptKey(&KeyConfig{
+			Name:          "global",
+			ContainerName: "build-agent",
+			ProviderName:  ncrypt.ProviderMSPlatform,
+			Scope:         "global",
+		}); err == nil || !strings.Contains(err.Error(), "unknown scope") {
+			return fmt.Errorf("unknown scope not refused: %v", err)
+		}
+		return nil
+	})
+
+	check(t, "unprivileged account", func() error {
+		emu.Unprivileged = true
+		defer func() { emu.Unprivileged = false }()
+
+		if _, err := km.CreateNewNCryptKey("unprivileged", "", ncrypt.ProviderMSPlatform, ncrypt.ALG_ECDSA_P256, 0, "", SCOPE_MACHINE); err == nil || !strings.Contains(err.Error(), "NTE_PERM") {
+			return fmt.Errorf("machine key created without administrator rights: %v", err)
+		}
+		kc := *machine.config
+		bk, err := b.Load(&kc)
+		if err != nil {
+			return fmt.Errorf("machine key can't be used without administrator rights: %w", err)
+		}
+		return bk.Close()
+	})
+
+	check(t, "machine agent", func() error {
+		ids, err := km.machineAgent.List()
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, id := range ids {
+			names = append(names, id.Comment)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != "machine,machine-import" {
+			return fmt.Errorf("machine agent lists %v, expected the machine scope keys", names)
+		}
+
+		if _, err = km.machineAgent.Sign(*machine.SSHPublicKey, []byte(keyName)); err != nil {
+			return err
+		}
+		if _, err = km.machineAgent.Sign(*km.Keys["user"].SSHPublicKey, []byte(keyName)); err == nil {
+			return fmt.Errorf("machine agent signed with a user key")
+		}
+		if ids, err = km.sshAgent.List(); err != nil || len(ids) != 3 {
+			return fmt.Errorf("default agent lists %d keys, expected 3: %v", len(ids), err)
+		}
+		return nil
+	})
+
+	check(t, "pipe security", func() error {
+		sd, err := listeners.PipeSecurityDescriptor([]string{"S-1-5-32-545", "s-1-5-21-1004336348-1177238915-682003330-1001"})
+		if err != nil {
+			return err
+		}
+		expected := "D:P(D;;GA;;;NU)(A;;GA;;;SY)(A;;GA;;;OW)(A;;GRGW;;;S-1-5-32-545)(A;;GRGW;;;S-1-5-21-1004336348-1177238915-682003330-1001)"
+		if sd != expected {
+			return fmt.Errorf("security descriptor %s, expected %s", sd, expected)
+		}
+		for _, invalid := range []string{`BUILTIN\Users`, "S-1-5", "S-1-5-32-545)(A;;GA;;;WD"} {
+			if _, err = listeners.PipeSecurityDescriptor([]string{invalid}); err == nil {
+				return fmt.Errorf("%s accepted as a SID", invalid)
+			}
+		}
+		return nil
+	})
+
+	check(t, "pipe path", func() error {
+		if err := km.validateMachinePipe(listeners.MACHINE_NAMED_PIPE); err != nil {
+			return err
+		}
+		for _, invalid := range []string{listeners.NAMED_PIPE, "ncryptagent-machine"} {
+			if err := km.validateMachinePipe(invalid); err == nil {
+				return fmt.Errorf("machine listener pipe %s accepted", invalid)
+			}
+		}
+		return nil
+	})
+
+	check(t, "delete", func() error {
+		for _, name := range []string{"machine", "machine-import", "user"} {
+			if k, ok := km.Keys[name]; ok {
+				if err := km.DeleteKey(k, true); err != nil {
+					return err
+				}
+			}
+		}
+		machineKeys, err := containers(ncrypt.NCRYPT_MACHINE_KEY_FLAG)
+		if err != nil {
+			return err
+		}
+		if len(machineKeys) != 0 {
+			return fmt.Errorf("machine keys %v left after deleting", machineKeys)
+		}
+		return nil
+	})
+}
@@ -2,6 +2,7 @@ package keyman
 
 import (
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"fmt"
 	"golang.org/x/crypto/cryptobyte"
@@ -10,36 +11,43 @@ import (
 	"log"
 	"math/big"
 	"ncryptagent/ncrypt"
+	"sync"
 	"time"
 )
 
 type Signer struct {
+	api            ncrypt.API
 	algorithmGroup string
 	keyHandle      uintptr
 	publicKey      crypto.PublicKey
-	timeout        int
-	timeractive    bool
+
+	// mu guards the PIN timer state, the timer fires on its own goroutine
+	mu          sync.Mutex
+	timeout     int
+	timer       *time.Timer
+	timeractive bool
 }
 
-func newNCryptSigner(kh uintptr, timeout int) (crypto.Signer, error) {
-	pub, err := getPublicKey(kh)
+func newNCryptSigner(api ncrypt.API, kh uintptr, timeout int) (crypto.Signer, error) {
+	pub, err := getPublicKey(api, kh)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get public key: %w", err)
 	}
 
-	algGroup, err := ncrypt.NCryptGetPropertyStr(kh, ncrypt.NCRYPT_ALGORITHM_GROUP_PROPERTY)
+	algGroup, err := api.GetPropertyStr(kh, ncrypt.NCRYPT_ALGORITHM_GROUP_PROPERTY)
 	if err != nil {
 		return nil, fmt.Errorf("unable to get NCRYPT_ALGORITHM_GROUP_PROPERTY: %w", err)
 	}
 
-	signer := Signer{
+	signer := &Signer{
+		api:            api,
 		algorithmGroup: algGroup,
 		keyHandle:      kh,
 		publicKey:      pub,
 		timeout:        timeout,
 	}
 
-	return &signer, nil
+	return signer, nil
 }
 
 func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
@@ -49,7 +57,7 @@ func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byt
 
 	switch s.algorithmGroup {
 	case "ECDSA":
-		signatureBytes, err := ncrypt.NCryptSignHash(s.keyHandle, digest, "")
+		signatureBytes, err := s.api.SignHash(s.keyHandle, digest, "")
 
 		if err != nil {
 			return nil, err
@@ -57,26 +65,24 @@ func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byt
 
 		s.handlePinTimer()
 
-		if len(signatureBytes) >= len(digest)*2 {
-			sigR := signatureBytes[:len(digest)]
-			sigS := signatureBytes[len(digest):]
-
-			var b cryptobyte.Builder
-			b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
-				b.AddASN1BigInt(new(big.Int).SetBytes(sigR))
-				b.AddASN1BigInt(new(big.Int).SetBytes(sigS))
-			})
-			return b.Bytes()
+		sigR, sigS, err := splitECDSASignature(s.publicKey, signatureBytes)
+		if err != nil {
+			return nil, err
 		}
 
-		return nil, fmt.Errorf("signatureBytes not long enough to encode ASN signature")
+		var b cryptobyte.Builder
+		b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+			b.AddASN1BigInt(new(big.Int).SetBytes(sigR))
+			b.AddASN1BigInt(new(big.Int).SetBytes(sigS))
+		})
+		return b.Bytes()
 	case "RSA":
 		hf := opts.HashFunc()
 		hashAlg, ok := ncrypt.HashAlgorithms[hf]
 		if !ok {
 			return nil, fmt.Errorf("unsupported RSA hash algorithm %v", hf)
 		}
-		signatureBytes, err := ncrypt.NCryptSignHash(s.keyHandle, digest, hashAlg)
+		signatureBytes, err := s.api.SignHash(s.keyHandle, digest, hashAlg)
 
 		if err != nil {
 			return nil, fmt.Errorf("NCryptSignHash failed: %w", err)
@@ -90,24 +96,73 @@ func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byt
 	}
 }
 
+// splitECDSASignature splits the r|s signature of NCryptSignHash into r and s. Both are as long as the coordinates
+// of the key's curve, which is not the length of the digest for every curve and hash, e.g. 66 bytes for P-521 signing
+// a SHA-512 digest of 64 bytes.
+func splitECDSASignature(pub crypto.PublicKey, sig []byte) ([]byte, []byte, error) {
+	ecKey, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("ECDSA signature for a %T public key", pub)
+	}
+	size := (ecKey.Curve.Params().BitSize + 7) / 8
+	if len(sig) != 2*size {
+		return nil, nil, fmt.Errorf("ECDSA signature of %d bytes for curve %s, expected %d", len(sig), ecKey.Curve.Params().Name, 2*size)
+	}
+	return sig[:size], sig[size:], nil
+}
+
 func (s *Signer) handlePinTimer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if !s.timeractive && s.timeout > 0 {
 		log.Printf("Starting pin cache purge timer: %ds\n", s.timeout)
-		time.AfterFunc(time.Second*time.Duration(s.timeout), func() {
+		var timer *time.Timer
+		timer = time.AfterFunc(time.Second*time.Duration(s.timeout), func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			// a timer that was stopped after it fired must not purge a PIN cached since
+			if s.timer != timer {
+				return
+			}
+			s.timer = nil
 			s.timeractive = false
-			ncrypt.NCryptSetProperty(s.keyHandle, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
+			s.api.SetProperty(s.keyHandle, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
 			log.Printf("PIN Cache purged\n")
 		})
+		s.timer = timer
 		s.timeractive = true
 	} else if s.timeout == 0 {
-		ncrypt.NCryptSetProperty(s.keyHandle, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
+		s.api.SetProperty(s.keyHandle, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
+	}
+}
+
+// PurgePIN clears the cached PIN immediately and stops the purge timer, the next signature starts a new one
+func (s *Signer) PurgePIN() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
 	}
+	s.timeractive = false
+	s.api.SetProperty(s.keyHandle, ncrypt.NCRYPT_PIN_PROPERTY, "", 0)
 }
 
 func (s *Signer) Public() crypto.PublicKey {
 	return s.publicKey
 }
 
+// PINCached reports whether the PIN entered for the last signature is still cached
+func (s *Signer) PINCached() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.timeractive
+}
+
 func (s *Signer) SetPINTimeout(timeout int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.timeout = timeout
 }
@@ -0,0 +1,296 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"math/big"
+	"ncryptagent/ncrypt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// signatureHashes are the digests CNG signs, every key is checked with each of them
+var signatureHashes = []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+func TestSplitECDSASignature(t *testing.T) {
+	for _, tc := range []struct {
+		curve elliptic.Curve
+		size  int
+	}{
+		{elliptic.P256(), 32},
+		{elliptic.P384(), 48},
+		{elliptic.P521(), 66},
+	} {
+		t.Run(tc.curve.Params().Name, func(t *testing.T) {
+			key, err := ecdsa.GenerateKey(tc.curve, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig := make([]byte, 2*tc.size)
+			sig[0], sig[tc.size] = 1, 2
+			r, s, err := splitECDSASignature(key.Public(), sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r) != tc.size || len(s) != tc.size || r[0] != 1 || s[0] != 2 {
+				t.Fatalf("r and s of %d and %d bytes, expected %d", len(r), len(s), tc.size)
+			}
+			for _, length := range []int{0, 2*tc.size - 2, 2*tc.size + 2, 64} {
+				if length == 2*tc.size {
+					continue
+				}
+				if _, _, err = splitECDSASignature(key.Public(), make([]byte, length)); err == nil {
+					t.Errorf("a raw signature of %d bytes was split", length)
+				}
+			}
+		})
+	}
+
+	t.Run("RSA", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = splitECDSASignature(key.Public(), make([]byte, 64)); err == nil {
+			t.Fatal("split an ECDSA signature for an RSA key")
+		}
+	})
+}
+
+// TestNCryptSignatures signs digests of every hash with a key of every algorithm of the emulator and verifies the
+// encoded signatures, including the ECDSA signatures of curves whose coordinates aren't as long as the digest
+func TestNCryptSignatures(t *testing.T) {
+	emu := ncrypt.NewEmulator()
+	for _, algorithm := range ncrypt.AVAILABLE_ALGORITHMS {
+		t.Run(algorithm, func(t *testing.T) {
+			keyName := "signature-" + algorithm
+
+			ph, err := emu.OpenStorageProvider(ncrypt.ProviderMSSoftware)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer emu.FreeObject(ph)
+
+			kh, err := emu.CreatePersistedKey(ph, keyName, algorithm, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if algorithm == ncrypt.ALG_RSA {
+				err = emu.SetProperty(kh, ncrypt.NCRYPT_LENGTH_PROPERTY, uint32(2048), 0)
+			}
+			if err == nil {
+				err = emu.FinalizeKey(kh, 0)
+			}
+			if err != nil {
+				emu.FreeObject(kh)
+				t.Fatal(err)
+			}
+			defer emu.DeleteKey(kh, 0)
+
+			signer, err := newNCryptSigner(emu, kh, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, hash := range signatureHashes {
+				t.Run(hash.String(), func(t *testing.T) {
+					h := hash.New()
+					h.Write([]byte(keyName))
+					digest := h.Sum(nil)
+
+					sig, err := signer.Sign(rand.Reader, digest, hash)
+					if err != nil {
+						t.Fatal(err)
+					}
+					switch pub := signer.Public().(type) {
+					case *ecdsa.PublicKey:
+						if !ecdsa.VerifyASN1(pub, digest, sig) {
+							t.Fatal("ECDSA signature did not verify")
+						}
+					case *rsa.PublicKey:
+						if err = rsa.VerifyPKCS1v15(pub, hash, digest, sig); err != nil {
+							t.Fatal(err)
+						}
+					default:
+						t.Fatalf("unexpected public key %T", pub)
+					}
+				})
+			}
+		})
+	}
+
+	if n := emu.OpenHandles(); n != 0 {
+		t.Errorf("%d handles were not freed", n)
+	}
+}
+
+// faultyKey corrupts the signatures of a key, like a card or driver returning a wrong signature
+type faultyKey struct {
+	BackendKey
+}
+
+func (f faultyKey) Sign(data []byte, algorithm string) (*ssh.Signature, error) {
+	sig, err := f.BackendKey.Sign(data, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	blob := append([]byte(nil), sig.Blob...)
+	blob[len(blob)-1] ^= 1
+	return &ssh.Signature{Format: sig.Format, Blob: blob, Rest: sig.Rest}, nil
+}
+
+// TestSignatureVerification signs through the agent with a key made faulty, its signatures are sent as they are
+// unless signatures are verified, then the agent fails with ErrSignatureInvalid and a notification
+func TestSignatureVerification(t *testing.T) {
+	const keyName = "verify"
+
+	km := newDetachedKeyManager(filepath.Join(t.TempDir(), "config.json"))
+	km.RegisterBackend(newNCryptBackend(ncrypt.NewEmulator()))
+	defer km.Close()
+	notifications := make(chan NotifyMsg, 10)
+	km.SetNotifyChan(notifications)
+	km.SetNotificationsEnabled(true)
+
+	k, err := km.CreateNewNCryptKey(keyName, "", ncrypt.ProviderMSSoftware, ncrypt.ALG_ECDSA_P521, 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer km.DeleteKey(k, true)
+
+	// sign signs through the agent and returns the title of the notification
+	sign := func() (string, error) {
+		_, err := km.sshAgent.Sign(*k.SSHPublicKey, []byte(keyName))
+		select {
+		case n := <-notifications:
+			return n.Title, err
+		default:
+			return "", fmt.Errorf("no notification: %v", err)
+		}
+	}
+
+	check(t, "valid signature", func() error {
+		km.SetVerifySignatures(true)
+		_, err := sign()
+		return err
+	})
+
+	working := k.key
+	k.key = faultyKey{working}
+	defer func() { k.key = working }()
+
+	check(t, "faulty key unverified", func() error {
+		km.SetVerifySignatures(false)
+		_, err := sign()
+		return err
+	})
+	check(t, "faulty key", func() error {
+		km.SetVerifySignatures(true)
+		title, err := sign()
+		if !errors.Is(err, ErrSignatureInvalid) {
+			return fmt.Errorf("faulty signature not refused: %v", err)
+		}
+		if !strings.Contains(title, "Invalid") {
+			return fmt.Errorf("notification %q for an invalid signature", title)
+		}
+		return nil
+	})
+}
+
+// TestSKSignatureVerification verifies signatures of software sk-ecdsa and sk-ed25519 security keys in the format
+// of the WebAuthN backend, and refuses them with another counter than the one signed
+func TestSKSignatureVerification(t *testing.T) {
+	const application = "ssh:"
+	data := []byte("sk signature")
+
+	// skSigned is what a security key signs: the application and data digests around the flags and the counter
+	skSigned := func(flags byte, counter uint32) []byte {
+		app := sha256.Sum256([]byte(application))
+		msg := sha256.Sum256(data)
+		return ssh.Marshal(struct {
+			ApplicationDigest []byte `ssh:"rest"`
+			Flags             byte
+			Counter           uint32
+			MessageDigest     []byte `ssh:"rest"`
+		}{app[:], flags, counter, msg[:]})
+	}
+	skFields := func(flags byte, counter uint32) []byte {
+		return ssh.Marshal(struct {
+			Flags   byte
+			Counter uint32
+		}{flags, counter})
+	}
+
+	for _, tc := range []struct {
+		name string
+		key  func() (ssh.PublicKey, *ssh.Signature, error)
+	}{
+		{ssh.KeyAlgoSKECDSA256, func() (ssh.PublicKey, *ssh.Signature, error) {
+			priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			pub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+				Name        string
+				Curve       string
+				Point       []byte
+				Application string
+			}{ssh.KeyAlgoSKECDSA256, "nistp256", elliptic.Marshal(elliptic.P256(), priv.X, priv.Y), application}))
+			if err != nil {
+				return nil, nil, err
+			}
+			digest := sha256.Sum256(skSigned(1, 7))
+			r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+			if err != nil {
+				return nil, nil, err
+			}
+			return pub, &ssh.Signature{
+				Format: ssh.KeyAlgoSKECDSA256,
+				Blob:   ssh.Marshal(struct{ R, S *big.Int }{r, s}),
+				Rest:   skFields(1, 7),
+			}, nil
+		}},
+		{ssh.KeyAlgoSKED25519, func() (ssh.PublicKey, *ssh.Signature, error) {
+			edPub, priv, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			pub, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+				Name        string
+				KeyBytes    []byte
+				Application string
+			}{ssh.KeyAlgoSKED25519, edPub, application}))
+			if err != nil {
+				return nil, nil, err
+			}
+			return pub, &ssh.Signature{
+				Format: ssh.KeyAlgoSKED25519,
+				Blob:   ed25519.Sign(priv, skSigned(1, 7)),
+				Rest:   skFields(1, 7),
+			}, nil
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pub, sig, err := tc.key()
+			if err != nil {
+				t.Fatal(err)
+			}
+			k := &Key{Name: tc.name, Type: "WEBAUTHN", SSHPublicKey: &pub}
+			if err = k.VerifySignature(data, sig); err != nil {
+				t.Fatal(err)
+			}
+			sig.Rest = skFields(1, 8)
+			if err = k.VerifySignature(data, sig); !errors.Is(err, ErrSignatureInvalid) {
+				t.Fatalf("signature of another counter not refused: %v", err)
+			}
+		})
+	}
+}
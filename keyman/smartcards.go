@@ -0,0 +1,332 @@
+package keyman
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"ncryptagent/scard"
+	"sync"
+	"time"
+)
+
+// cardApplet is the applet of a smart card backend, as far as finding its cards and caching their PIN goes
+type cardApplet interface {
+	// Name names the applet in messages and PIN prompts
+	Name() string
+	// Select selects the applet, before any other command
+	Select(t scard.Transmitter) error
+	// ID identifies the card, the selected applet's keys are looked for on the card with their configured ID
+	ID(t scard.Transmitter) (string, error)
+	// ClearPIN has the card forget that the PIN was verified
+	ClearPIN(t scard.Transmitter) error
+	// PINRejected reports whether an error verifying the PIN means it is wrong or blocked, so it is forgotten
+	PINRejected(err error) bool
+}
+
+// smartCards are the cards a backend has seen in the readers of its connector. Cards are kept across removal, so
+// their keys find them again in another reader and keep their PIN cache.
+type smartCards struct {
+	applet    cardApplet
+	connector scard.Connector
+	prompt    PINPrompt
+
+	mu    sync.Mutex
+	cards map[string]*smartCard
+}
+
+func newSmartCards(applet cardApplet, connector scard.Connector, prompt PINPrompt) *smartCards {
+	return &smartCards{
+		applet:    applet,
+		connector: connector,
+		prompt:    prompt,
+		cards:     make(map[string]*smartCard),
+	}
+}
+
+// get returns a card seen before
+func (s *smartCards) get(id string) (*smartCard, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.cards[id]
+	return c, ok
+}
+
+// present returns the cards with the applet in the readers, the preferred reader's first
+func (s *smartCards) present(preferredReader string) ([]*smartCard, error) {
+	readers, err := s.connector.ListReaders()
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range readers {
+		if r == preferredReader && i > 0 {
+			readers = append([]string{r}, append(readers[:i:i], readers[i+1:]...)...)
+			break
+		}
+	}
+
+	var cards []*smartCard
+	for _, reader := range readers {
+		c, err := s.cardIn(reader)
+		if err != nil {
+			if !errors.Is(err, scard.Error(scard.SCARD_E_NO_SMARTCARD)) {
+				log.Printf("No %s card in reader %s: %s", s.applet.Name(), reader, err)
+			}
+			continue
+		}
+		cards = append(cards, c)
+	}
+	return cards, nil
+}
+
+// cardIn returns the card in a reader
+func (s *smartCards) cardIn(reader string) (*smartCard, error) {
+	conn, err := s.connector.Open(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var id string
+	err = transaction(conn, s.applet, func(t scard.Transmitter) error {
+		var err error
+		id, err = s.applet.ID(t)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.cards[id]
+	if !ok {
+		c = &smartCard{applet: s.applet, connector: s.connector, id: id, prompt: s.prompt}
+		s.cards[id] = c
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		c.conn, c.reader = conn, reader
+	} else {
+		conn.Close()
+	}
+	return c, nil
+}
+
+// close forgets the PINs and disconnects from the cards
+func (s *smartCards) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, c := range s.cards {
+		c.close()
+		delete(s.cards, id)
+	}
+}
+
+// transaction selects the applet in a transaction and runs f with it
+func transaction(conn scard.Conn, applet cardApplet, f func(t scard.Transmitter) error) error {
+	if err := conn.BeginTransaction(); err != nil {
+		return err
+	}
+	defer conn.EndTransaction()
+
+	if err := applet.Select(conn); err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+// smartCard holds the connection to a card, shared by all of its keys. The PIN is cached for the card, so its keys
+// share the PIN cache.
+type smartCard struct {
+	applet    cardApplet
+	connector scard.Connector
+	id        string
+	prompt    PINPrompt
+
+	mu          sync.Mutex
+	reader      string
+	conn        scard.Conn
+	pin         []byte
+	timer       *time.Timer
+	timeractive bool
+}
+
+func (c *smartCard) currentReader() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reader
+}
+
+// connectLocked finds the card in the readers when it isn't connected, it may have moved to another reader
+func (c *smartCard) connectLocked() error {
+	if c.conn != nil {
+		return nil
+	}
+
+	readers, err := c.connector.ListReaders()
+	if err != nil {
+		return err
+	}
+	for _, reader := range readers {
+		conn, err := c.connector.Open(reader)
+		if err != nil {
+			continue
+		}
+		var id string
+		err = transaction(conn, c.applet, func(t scard.Transmitter) error {
+			var err error
+			id, err = c.applet.ID(t)
+			return err
+		})
+		if err != nil || id != c.id {
+			conn.Close()
+			continue
+		}
+		c.conn, c.reader = conn, reader
+		return nil
+	}
+	return fmt.Errorf("card %s is not present", c.id)
+}
+
+// dropLocked closes the connection after the card was removed or reset, the next use connects again
+func (c *smartCard) dropLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// withAppletLocked runs f on the selected applet, connecting again once when the card was removed or reset since the
+// last use
+func (c *smartCard) withAppletLocked(f func(t scard.Transmitter) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = c.connectLocked(); err != nil {
+			return err
+		}
+		err = transaction(c.conn, c.applet, f)
+		if !scard.CardGone(err) {
+			return err
+		}
+		c.dropLocked()
+	}
+	return err
+}
+
+// withApplet is withAppletLocked for reading from the card
+func (c *smartCard) withApplet(f func(t scard.Transmitter) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.withAppletLocked(f)
+}
+
+func (c *smartCard) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purgePINLocked()
+	c.dropLocked()
+}
+
+// verifyLocked verifies the cached PIN with verify, asking for it when there is none. retries tells the tries left
+// for the prompt. The PIN is verified before every signature as another application may have reset the card in the
+// meantime.
+func (c *smartCard) verifyLocked(keyName string, retries func() (int, bool, error), verify func(pin string) error) error {
+	if c.pin == nil {
+		if c.prompt == nil {
+			return fmt.Errorf("unable to ask for the PIN of card %s", c.id)
+		}
+		message := fmt.Sprintf("Enter the %s PIN of card %s to use key %s", c.applet.Name(), c.id, keyName)
+		if retries, verified, err := retries(); err == nil && !verified {
+			if retries == 0 {
+				return fmt.Errorf("the %s PIN of card %s is blocked", c.applet.Name(), c.id)
+			}
+			if retries == 1 {
+				message += ". This is the last try before the PIN is blocked."
+			} else if retries < 3 {
+				message += fmt.Sprintf(". %d tries left.", retries)
+			}
+		}
+		pin, ok := c.prompt("PIN required", message)
+		if !ok {
+			return fmt.Errorf("PIN entry for card %s was cancelled", c.id)
+		}
+		c.pin = pin
+	}
+
+	if err := verify(string(c.pin)); err != nil {
+		if c.applet.PINRejected(err) {
+			c.forgetPINLocked()
+		}
+		return fmt.Errorf("PIN verification with card %s failed: %w", c.id, err)
+	}
+	return nil
+}
+
+func (c *smartCard) forgetPINLocked() {
+	for i := range c.pin {
+		c.pin[i] = 0
+	}
+	c.pin = nil
+}
+
+// handlePinTimerLocked keeps the PIN for timeout seconds after the first signature, like Signer.handlePinTimer does
+// for NCrypt keys, a timeout of 0 forgets it after every signature
+func (c *smartCard) handlePinTimerLocked(timeout int) {
+	if c.pin == nil {
+		return
+	}
+	if !c.timeractive && timeout > 0 {
+		log.Printf("Starting pin cache purge timer: %ds\n", timeout)
+		c.timer = time.AfterFunc(time.Second*time.Duration(timeout), func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.timeractive = false
+			c.purgePINLocked()
+			log.Printf("PIN Cache purged\n")
+		})
+		c.timeractive = true
+	} else if timeout == 0 {
+		c.purgePINLocked()
+	}
+}
+
+// purgePINLocked forgets the PIN and has the card drop its verification
+func (c *smartCard) purgePINLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timeractive = false
+	if c.pin == nil {
+		return
+	}
+	c.forgetPINLocked()
+	if c.conn != nil {
+		if err := transaction(c.conn, c.applet, c.applet.ClearPIN); err != nil {
+			log.Printf("Resetting the PIN verification of card %s failed: %s", c.id, err)
+		}
+	}
+}
+
+func (c *smartCard) purgePIN() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purgePINLocked()
+}
+
+func (c *smartCard) pinCached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pin != nil
+}
+
+// managePIN runs f to change or unblock the PIN and forgets the cached PIN, which is the old one or was rejected
+func (c *smartCard) managePIN(f func(t scard.Transmitter) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.withAppletLocked(f)
+	c.purgePINLocked()
+	return err
+}
@@ -0,0 +1,112 @@
+package keyman
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/google/uuid"
+	"ncryptagent/ncrypt"
+	"sync"
+)
+
+// TYPE_SOFTWARE is the KeyConfig.Type of keys held by a SoftwareBackend
+const TYPE_SOFTWARE = "SOFTWARE"
+
+// ALG_ED25519 is the algorithm name of ED25519 software keys, the other algorithms use the ncrypt names
+const ALG_ED25519 = "ED25519"
+
+// SoftwareBackend keeps keys in memory, they are lost when the process exits. It backs the trace replay and the
+// backend conformance checks and is not registered by the agent.
+type SoftwareBackend struct {
+	mu   sync.Mutex
+	keys map[string]crypto.Signer
+}
+
+func NewSoftwareBackend() *SoftwareBackend {
+	return &SoftwareBackend{keys: make(map[string]crypto.Signer)}
+}
+
+func (b *SoftwareBackend) Type() string {
+	return TYPE_SOFTWARE
+}
+
+func (b *SoftwareBackend) Capabilities() KeyCapabilities {
+	return KeyCapabilities{Create: true, Delete: true, Software: true}
+}
+
+func (b *SoftwareBackend) Load(kc *KeyConfig) (BackendKey, error) {
+	b.mu.Lock()
+	signer, ok := b.keys[kc.ContainerName]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("key container %s not found", kc.ContainerName)
+	}
+	return newSignerKey(signer, b.Capabilities())
+}
+
+// Create generates an RSA, ECDSA or ED25519 key. RSA keys default to 2048 bits.
+func (b *SoftwareBackend) Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch kc.Algorithm {
+	case ncrypt.ALG_RSA:
+		if kc.Length == 0 {
+			kc.Length = 2048
+		}
+		signer, err = rsa.GenerateKey(rand.Reader, kc.Length)
+	case ncrypt.ALG_ECDSA_P256, ncrypt.ALG_ECDSA_P384, ncrypt.ALG_ECDSA_P521:
+		signer, err = ecdsa.GenerateKey(ncrypt.CurveNames[kc.Algorithm], rand.Reader)
+	case ALG_ED25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %v", kc.Algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate %s key: %w", kc.Algorithm, err)
+	}
+
+	if err = b.Import(kc, signer); err != nil {
+		return nil, err
+	}
+	return newSignerKey(signer, b.Capabilities())
+}
+
+// Import stores an existing key under kc.ContainerName, a random container name is chosen when it is empty
+func (b *SoftwareBackend) Import(kc *KeyConfig, signer crypto.Signer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if kc.ContainerName == "" {
+		containerUUID, _ := uuid.NewRandom()
+		kc.ContainerName = containerUUID.String()
+	}
+	if _, exists := b.keys[kc.ContainerName]; exists {
+		return fmt.Errorf("key container %s already exists", kc.ContainerName)
+	}
+
+	kc.Type = TYPE_SOFTWARE
+	kc.NoPin = true
+	b.keys[kc.ContainerName] = signer
+	return nil
+}
+
+func (b *SoftwareBackend) Delete(kc *KeyConfig, key BackendKey) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.keys[kc.ContainerName]; !ok {
+		return fmt.Errorf("key container %s not found", kc.ContainerName)
+	}
+	delete(b.keys, kc.ContainerName)
+	return nil
+}
+
+func (b *SoftwareBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.keys = make(map[string]crypto.Signer)
+	return nil
+}
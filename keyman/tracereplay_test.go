@@ -0,0 +1,455 @@
+package keyman
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"ncryptagent/keyman/listeners"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// replayMismatch is a response that differs from the recorded one
+type replayMismatch struct {
+	Conn     uint64
+	Request  string
+	Expected string
+	Got      string
+}
+
+func (m replayMismatch) String() string {
+	return fmt.Sprintf("conn %d %s: expected %s, got %s", m.Conn, m.Request, m.Expected, m.Got)
+}
+
+type replayReport struct {
+	Connections int
+	Requests    int
+	// Skipped counts dropped requests that can't be sent again
+	Skipped    int
+	Mismatches []replayMismatch
+}
+
+// TestReplayTrace replays the traces in testdata and the trace named by AGENT_TRACE, failing on every response that
+// differs from the recorded one
+func TestReplayTrace(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := os.Getenv("AGENT_TRACE"); path != "" {
+		paths = append(paths, path)
+	}
+
+	for _, path := range paths {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			records, err := listeners.ReadTrace(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := replayTrace(records)
+			if report != nil {
+				for _, m := range report.Mismatches {
+					t.Error(m)
+				}
+				t.Logf("%d connections, %d requests replayed, %d dropped requests skipped",
+					report.Connections, report.Requests, report.Skipped)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// replayTrace drives the requests of a recorded trace against a KeyManagerAgent and compares the responses with the
+// recorded ones. The agent is backed by software keys generated to stand in for every public key in the trace, key
+// blobs in requests and recorded responses are translated to the stand-ins before they are used.
+func replayTrace(records []listeners.TraceRecord) (*replayReport, error) {
+	r, err := newTraceReplayer(records)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &replayReport{}
+	conns := make(map[uint64][]listeners.TraceRecord)
+	var order []uint64
+	for _, record := range records {
+		if _, ok := conns[record.Conn]; !ok {
+			order = append(order, record.Conn)
+		}
+		conns[record.Conn] = append(conns[record.Conn], record)
+	}
+
+	for _, id := range order {
+		report.Connections++
+		if err := r.replayConn(conns[id], report); err != nil {
+			return report, fmt.Errorf("conn %d: %w", id, err)
+		}
+	}
+	return report, nil
+}
+
+type traceReplayer struct {
+	km       *KeyManager
+	software *SoftwareBackend
+	blobs    map[string][]byte // recorded key blob to stand-in key blob
+}
+
+func newTraceReplayer(records []listeners.TraceRecord) (*traceReplayer, error) {
+	r := &traceReplayer{
+		km: &KeyManager{
+			Keys:   make(map[string]*Key),
+			config: &KeyManagerConfig{DisableNotifications: true},
+		},
+		software: NewSoftwareBackend(),
+		blobs:    make(map[string][]byte),
+	}
+	r.km.sshAgent = KeyManagerAgent{km: r.km}
+	r.km.RegisterBackend(r.software)
+
+	// identities answers name the keys, sign requests may use keys that were never listed
+	for _, record := range records {
+		if len(record.Message) == 0 {
+			continue
+		}
+		switch {
+		case record.Dir == listeners.TRACE_RESPONSE && record.Message[0] == listeners.AGENT_IDENTITIES_ANSWER:
+			ids, err := parseIdentities(record.Message)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				if err := r.addKey(id.blob, id.comment); err != nil {
+					return nil, err
+				}
+			}
+		case record.Dir == listeners.TRACE_REQUEST && record.Message[0] == listeners.AGENTC_SIGN_REQUEST:
+			var req signRequest
+			if err := ssh.Unmarshal(record.Message, &req); err != nil {
+				return nil, err
+			}
+			if err := r.addKey(req.KeyBlob, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// addKey creates a stand-in for a recorded public key or certificate. A certificate gets a stand-in key of its own
+// plus a copy of the certificate for it, signed by a throwaway CA.
+func (r *traceReplayer) addKey(blob []byte, comment string) error {
+	if _, ok := r.blobs[string(blob)]; ok {
+		return nil
+	}
+
+	pub, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return fmt.Errorf("unable to parse recorded key: %w", err)
+	}
+
+	cert, isCert := pub.(*ssh.Certificate)
+	if isCert {
+		if err = r.addKey(cert.Key.Marshal(), comment); err != nil {
+			return err
+		}
+		standIn, err := ssh.ParsePublicKey(r.blobs[string(cert.Key.Marshal())])
+		if err != nil {
+			return err
+		}
+		k := r.keyFor(standIn)
+		if k == nil {
+			return fmt.Errorf("no stand-in key for certificate %s", cert.KeyId)
+		}
+
+		_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+		ca, _ := ssh.NewSignerFromSigner(caKey)
+		copied := *cert
+		copied.Key = standIn
+		if err = copied.SignCert(rand.Reader, ca); err != nil {
+			return err
+		}
+		k.SSHCertificate = &copied
+		r.blobs[string(blob)] = copied.Marshal()
+		return nil
+	}
+
+	signer, err := standInSigner(pub)
+	if err != nil {
+		return err
+	}
+
+	base := comment
+	if base == "" {
+		base = ssh.FingerprintSHA256(pub)
+	}
+	name := base
+	for i := 2; r.km.Keys[name] != nil; i++ {
+		name = fmt.Sprintf("%s (%d)", base, i)
+	}
+
+	kc := &KeyConfig{Name: name}
+	if err = r.software.Import(kc, signer); err != nil {
+		return err
+	}
+	k, err := r.km.loadKey(kc)
+	if err != nil {
+		return err
+	}
+	r.blobs[string(blob)] = (*k.SSHPublicKey).Marshal()
+	return nil
+}
+
+func (r *traceReplayer) keyFor(pub ssh.PublicKey) *Key {
+	for _, k := range r.km.Keys {
+		if k.SSHPublicKey != nil && string((*k.SSHPublicKey).Marshal()) == string(pub.Marshal()) {
+			return k
+		}
+	}
+	return nil
+}
+
+// standInSigner generates a software key of the same type and size as pub. Security keys are stood in for by a
+// plain key on the same curve, their signatures are reported as a format mismatch.
+func standInSigner(pub ssh.PublicKey) (crypto.Signer, error) {
+	switch pub.Type() {
+	case OPENSSH_SK_ECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case OPENSSH_SK_ED25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported recorded key type %s", pub.Type())
+	}
+
+	switch p := cryptoPub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return rsa.GenerateKey(rand.Reader, p.N.BitLen())
+	case *ecdsa.PublicKey:
+		return ecdsa.GenerateKey(p.Curve, rand.Reader)
+	case ed25519.PublicKey:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unsupported recorded key type %s", pub.Type())
+}
+
+// signRequest is SSH_AGENTC_SIGN_REQUEST
+type signRequest struct {
+	KeyBlob []byte `sshtype:"13"`
+	Data    []byte
+	Flags   uint32
+}
+
+type identity struct {
+	blob    []byte
+	comment string
+}
+
+func parseIdentities(msg []byte) ([]identity, error) {
+	if len(msg) < 5 {
+		return nil, fmt.Errorf("identities answer too short")
+	}
+	count := binary.BigEndian.Uint32(msg[1:])
+	rest := msg[5:]
+	var ids []identity
+	for i := uint32(0); i < count; i++ {
+		var id struct {
+			Blob    []byte
+			Comment string
+			Rest    []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(rest, &id); err != nil {
+			return nil, fmt.Errorf("malformed identities answer: %w", err)
+		}
+		ids = append(ids, identity{id.Blob, id.Comment})
+		rest = id.Rest
+	}
+	return ids, nil
+}
+
+// replayConn serves one recorded connection through a pipe, so requests take the same path through ServeAgent as
+// they do from a listener
+func (r *traceReplayer) replayConn(records []listeners.TraceRecord, report *replayReport) error {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	peer := &listeners.PeerInfo{}
+	for _, record := range records {
+		if record.Dir == listeners.TRACE_OPEN {
+			peer.Listener = record.Listener
+			peer.Detail = "replay of " + record.Peer
+		}
+	}
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		listeners.ServeAgentConn(context.Background(), &r.km.sshAgent, server, peer)
+		server.Close()
+	}()
+
+	for i := 0; i < len(records); i++ {
+		req := records[i]
+		if req.Dir != listeners.TRACE_REQUEST {
+			continue
+		}
+
+		// the recorded response follows its request
+		var expected *listeners.TraceRecord
+		for j := i + 1; j < len(records); j++ {
+			if records[j].Dir == listeners.TRACE_RESPONSE {
+				expected = &records[j]
+				break
+			}
+			if records[j].Dir == listeners.TRACE_REQUEST {
+				break
+			}
+		}
+
+		if req.Dropped || len(req.Message) == 0 {
+			report.Skipped++
+			continue
+		}
+		report.Requests++
+
+		msg, err := r.translateRequest(req.Message)
+		if err != nil {
+			return err
+		}
+		if err = writeFrame(client, msg); err != nil {
+			return err
+		}
+		got, err := readFrame(client)
+		if err != nil {
+			return err
+		}
+
+		if expected == nil {
+			continue
+		}
+		if want, have, ok := r.compare(expected.Message, got); !ok {
+			report.Mismatches = append(report.Mismatches, replayMismatch{
+				Conn:     req.Conn,
+				Request:  req.Type,
+				Expected: want,
+				Got:      have,
+			})
+		}
+	}
+
+	client.Close()
+	<-served
+	return nil
+}
+
+func (r *traceReplayer) translateRequest(msg []byte) ([]byte, error) {
+	if msg[0] != listeners.AGENTC_SIGN_REQUEST {
+		return msg, nil
+	}
+
+	var req signRequest
+	if err := ssh.Unmarshal(msg, &req); err != nil {
+		return nil, err
+	}
+	if blob, ok := r.blobs[string(req.KeyBlob)]; ok {
+		req.KeyBlob = blob
+	}
+	return ssh.Marshal(&req), nil
+}
+
+// compare checks a response against the recorded one. Signatures differ on every run so only their format is
+// compared, identities are compared as a set since the agent lists keys in no particular order.
+func (r *traceReplayer) compare(expected, got []byte) (string, string, bool) {
+	if len(expected) == 0 || len(got) == 0 {
+		return fmt.Sprintf("%d bytes", len(expected)), fmt.Sprintf("%d bytes", len(got)), len(expected) == len(got)
+	}
+
+	want, have := listeners.AgentMessageName(expected[0]), listeners.AgentMessageName(got[0])
+	if expected[0] != got[0] {
+		return want, have, false
+	}
+
+	switch expected[0] {
+	case listeners.AGENT_IDENTITIES_ANSWER:
+		wantIDs, err := parseIdentities(expected)
+		if err != nil {
+			return want, err.Error(), false
+		}
+		haveIDs, err := parseIdentities(got)
+		if err != nil {
+			return want, err.Error(), false
+		}
+		describe := func(ids []identity, translate bool) string {
+			var s []string
+			for _, id := range ids {
+				blob := id.blob
+				if translate {
+					blob = r.blobs[string(blob)]
+				}
+				// the stand-in keys are software keys whatever the recorded keys were, their marker is left out
+				s = append(s, fmt.Sprintf("%s %x", strings.TrimSuffix(id.comment, " [software]"), blob))
+			}
+			sort.Strings(s)
+			return strings.Join(s, ", ")
+		}
+		want, have = describe(wantIDs, true), describe(haveIDs, false)
+		return fmt.Sprintf("%s [%d keys]", want, len(wantIDs)), fmt.Sprintf("%s [%d keys]", have, len(haveIDs)), want == have
+	case listeners.AGENT_SIGN_RESPONSE:
+		format := func(msg []byte) string {
+			var resp struct {
+				SigBlob []byte `sshtype:"14"`
+			}
+			if err := ssh.Unmarshal(msg, &resp); err != nil {
+				return err.Error()
+			}
+			sig := new(ssh.Signature)
+			if err := ssh.Unmarshal(resp.SigBlob, sig); err != nil {
+				return err.Error()
+			}
+			return sig.Format
+		}
+		want, have = want+" "+format(expected), have+" "+format(got)
+		return want, have, want == have
+	}
+	return want, have, true
+}
+
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(length[:]))
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
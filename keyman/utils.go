@@ -2,7 +2,6 @@ package keyman
 
 import (
 	"bytes"
-	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
@@ -111,50 +110,3 @@ func unmarshalECC(buf []byte, curve elliptic.Curve) (*ecdsa.PublicKey, error) {
 	}
 	return pub, nil
 }
-
-func getPublicKey(kh uintptr) (crypto.PublicKey, error) {
-	algGroup, err := ncrypt.NCryptGetPropertyStr(kh, ncrypt.NCRYPT_ALGORITHM_GROUP_PROPERTY)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get NCRYPT_ALGORITHM_GROUP_PROPERTY: %w", err)
-	}
-
-	var pub crypto.PublicKey
-	switch algGroup {
-	case "ECDSA":
-		buf, err := ncrypt.NCryptExportKey(kh, ncrypt.BCRYPT_ECCPUBLIC_BLOB)
-		if err != nil {
-			return nil, fmt.Errorf("failed to export ECC public key: %w", err)
-		}
-		curveName, err := ncrypt.NCryptGetPropertyStr(kh, ncrypt.NCRYPT_ECC_CURVE_NAME_PROPERTY)
-		if err != nil {
-			// The smart card provider doesn't have the curve name property set, attempt to get it from
-			// algorithm property
-			curveName, err = ncrypt.NCryptGetPropertyStr(kh, ncrypt.NCRYPT_ALGORITHM_PROPERTY)
-			if err != nil {
-				return nil, fmt.Errorf("failed to retrieve ECC curve name: %w", err)
-			}
-		}
-
-		if _, ok := ncrypt.CurveNames[curveName]; !ok {
-			return nil, fmt.Errorf("curveName %s not found in curvenames map", curveName)
-		}
-
-		pub, err = unmarshalECC(buf, ncrypt.CurveNames[curveName])
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal ECC public key: %w", err)
-		}
-	case "RSA":
-		buf, err := ncrypt.NCryptExportKey(kh, ncrypt.BCRYPT_RSAPUBLIC_BLOB)
-		if err != nil {
-			return nil, fmt.Errorf("failed to export %v public key: %w", algGroup, err)
-		}
-		pub, err = unmarshalRSA(buf)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal %v public key: %w", algGroup, err)
-		}
-	default:
-		return nil, fmt.Errorf("unhandled algorithm group %v retrieved from key", algGroup)
-	}
-
-	return pub, nil
-}
@@ -0,0 +1,444 @@
+package keyman
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/lxn/win"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"math/big"
+	"ncryptagent/webauthn"
+	"os/user"
+	"unsafe"
+)
+
+type sshPrivateKeySKECDSA struct {
+	Type        string
+	ID          string
+	Key         []byte
+	Application string
+	Flags       byte
+	KeyHandle   []byte
+	Reserved    string
+}
+
+type sshPrivateKeySKED25519 struct {
+	Type        string
+	Key         []byte
+	Application string
+	Flags       byte
+	KeyHandle   []byte
+	Reserved    string
+}
+
+// webAuthNBackend creates and loads OpenSSH security keys through the Windows WebAuthN API. The key handle is kept in
+// the config, there is nothing to delete from the authenticator.
+type webAuthNBackend struct{}
+
+func (b *webAuthNBackend) Type() string {
+	return "WEBAUTHN"
+}
+
+func (b *webAuthNBackend) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: true, Touch: true, Create: true}
+}
+
+func (b *webAuthNBackend) Load(kc *KeyConfig) (BackendKey, error) {
+	out, _, _, _, err := ssh.ParseAuthorizedKey([]byte(kc.SSHPublicKey))
+
+	if err != nil {
+		log.Printf("Error parsing authorized: %s\n", err)
+		return nil, err
+	}
+
+	return &webAuthNKey{config: kc, pub: out}, nil
+}
+
+func (b *webAuthNBackend) Delete(kc *KeyConfig, key BackendKey) error {
+	return nil
+}
+
+func (b *webAuthNBackend) Close() error {
+	return nil
+}
+
+type webAuthNKey struct {
+	config *KeyConfig
+	pub    ssh.PublicKey
+	hwnd   uintptr
+}
+
+func (w *webAuthNKey) Public() ssh.PublicKey {
+	return w.pub
+}
+
+func (w *webAuthNKey) Capabilities() KeyCapabilities {
+	return KeyCapabilities{PIN: w.config.VerifyRequired, Touch: true}
+}
+
+func (w *webAuthNKey) SetHWND(hwnd uintptr) {
+	w.hwnd = hwnd
+}
+
+func (w *webAuthNKey) Close() error {
+	return nil
+}
+
+// Sign asks the authenticator for an assertion over signData, security keys have a single signature algorithm
+func (w *webAuthNKey) Sign(signData []byte, algorithm string) (*ssh.Signature, error) {
+
+	privBytes, err := base64.StdEncoding.DecodeString(w.config.SKPrivateHalf)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding base64 private half: %w", err)
+	}
+
+	var application string
+	var keyHandle []byte
+
+	if w.pub.Type() == OPENSSH_SK_ECDSA || w.pub.Type() == OPENSSH_SK_ECDSA_CERT {
+		priv := sshPrivateKeySKECDSA{}
+		err = ssh.Unmarshal(privBytes, &priv)
+
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling private half: %w", err)
+		}
+
+		application = priv.Application
+		keyHandle = priv.KeyHandle
+	} else if w.pub.Type() == OPENSSH_SK_ED25519 || w.pub.Type() == OPENSSH_SK_ED25519_CERT {
+		priv := sshPrivateKeySKED25519{}
+		err = ssh.Unmarshal(privBytes, &priv)
+
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling private half: %w", err)
+		}
+
+		application = priv.Application
+		keyHandle = priv.KeyHandle
+	}
+
+	clientData := webauthn.CLIENT_DATA{
+		Version:              webauthn.CLIENT_DATA_CURRENT_VERSION,
+		ClientDataJSONLength: uint32(len(signData)),
+		ClientDataJSON:       uintptr(unsafe.Pointer(&signData[0])),
+		HashAlgId:            webauthn.LPCWSTR(webauthn.HASH_ALGORITHM_SHA_256),
+	}
+
+	credentials := []webauthn.CREDENTIAL{
+		{
+			Version:        webauthn.CREDENTIAL_CURRENT_VERSION,
+			IdLen:          uint32(len(keyHandle)),
+			Id:             uintptr(unsafe.Pointer(&keyHandle[0])),
+			CredentialType: webauthn.LPCWSTR(webauthn.CREDENTIAL_TYPE_PUBLIC_KEY),
+		},
+	}
+
+	userVerification := webauthn.USER_VERIFICATION_REQUIREMENT_DISCOURAGED
+	if w.config.VerifyRequired {
+		userVerification = webauthn.USER_VERIFICATION_REQUIREMENT_REQUIRED
+	}
+
+	assertionOptions := webauthn.AUTHENTICATOR_GET_ASSERTION_OPTIONS{
+		Version: webauthn.AUTHENTICATOR_MAKE_CREDENTIAL_OPTIONS_CURRENT_VERSION,
+		CredentialList: webauthn.CREDENTIALS{
+			Count:       1,
+			Credentials: uintptr(unsafe.Pointer(&credentials[0])),
+		},
+		UserVerificationRequirement: uint32(userVerification),
+	}
+
+	assertion, err := webauthn.AuthenticatorGetAssertion(w.hwnd, application, clientData, assertionOptions)
+
+	if err != nil {
+		return nil, fmt.Errorf("AuthenticatorGetAssertion failed: %w", err)
+	}
+
+	defer webauthn.FreeAssertion(assertion)
+
+	authDataBytes := webauthn.UintptrToBytes(assertion.AuthenticatorData, assertion.AuthenticatorDataLen)
+	assertionSignatureBytes := webauthn.UintptrToBytes(assertion.Signature, assertion.SignatureLen)
+
+	authData := webauthn.AuthenticatorData{}
+	reader := bytes.NewReader(authDataBytes)
+	err = binary.Read(reader, binary.BigEndian, &authData.RPIDHash)
+	err = binary.Read(reader, binary.BigEndian, &authData.Flags)
+	err = binary.Read(reader, binary.BigEndian, &authData.Counter)
+
+	additionalData := struct {
+		Flags   byte
+		Counter uint32
+	}{
+		Flags:   authData.Flags,
+		Counter: authData.Counter,
+	}
+
+	var signatureBytes []byte
+
+	if w.pub.Type() == "sk-ecdsa-sha2-nistp256@openssh.com" || w.pub.Type() == "sk-ecdsa-sha2-nistp256-cert-v01@openssh.com" {
+		signatureParsed := struct {
+			R *big.Int
+			S *big.Int
+		}{}
+
+		_, err = asn1.Unmarshal(assertionSignatureBytes, &signatureParsed)
+		if err != nil {
+			return nil, fmt.Errorf("asn1.Unmarshal of ECDSA signature failed: %w", err)
+		}
+
+		signatureBytes = ssh.Marshal(signatureParsed)
+	} else {
+		signatureBytes = assertionSignatureBytes
+	}
+
+	sig := ssh.Signature{
+		Format: w.pub.Type(),
+		Blob:   signatureBytes,
+		Rest:   ssh.Marshal(additionalData),
+	}
+
+	return &sig, nil
+}
+
+func (km *KeyManager) CreateNewWebAuthNKey(keyName string, application string, coseAlgorithm int64, coseHash string, resident bool, verifyRequired bool, hwnd uintptr) (*Key, error) {
+	if hwnd == 0 {
+		hwnd = km.hwnd
+	}
+
+	return km.CreateKey(&KeyConfig{
+		Name:           keyName,
+		Type:           "WEBAUTHN",
+		VerifyRequired: verifyRequired,
+	}, CreateOptions{
+		Application:   application,
+		COSEAlgorithm: coseAlgorithm,
+		COSEHash:      coseHash,
+		Resident:      resident,
+		HWND:          hwnd,
+	})
+}
+
+// Create makes a new credential on an authenticator, kc.SKPrivateHalf receives the OpenSSH key handle
+func (b *webAuthNBackend) Create(kc *KeyConfig, opts CreateOptions) (BackendKey, error) {
+	application := opts.Application
+	coseAlgorithm := opts.COSEAlgorithm
+	coseHash := opts.COSEHash
+	resident := opts.Resident
+	verifyRequired := kc.VerifyRequired
+
+	if application == "" {
+		application = fmt.Sprintf("ssh:%s", kc.Name)
+	} else {
+		application = fmt.Sprintf("ssh:%s", application)
+	}
+
+	var userName string
+	currentUser, err := user.Current()
+	if err != nil {
+		userName = ""
+	} else {
+		userName = currentUser.Name
+	}
+
+	userId := []byte("(null)")
+
+	entityInfo := webauthn.RP_ENTITY_INFORMATION{
+		Version: webauthn.RP_ENTITY_INFORMATION_CURRENT_VERSION,
+		Id:      webauthn.LPCWSTR(application),
+		Name:    webauthn.LPCWSTR("nCrypt Agent"),
+		Icon:    nil,
+	}
+
+	userEntityInfo := webauthn.USER_ENTITY_INFORMATION{
+		Version:     webauthn.USER_ENTITY_INFORMATION_CURRENT_VERSION,
+		IdLen:       uint32(len(userId)),
+		Id:          uintptr(unsafe.Pointer(&userId[0])),
+		Name:        webauthn.LPCWSTR(userName),
+		Icon:        nil,
+		DisplayName: webauthn.LPCWSTR(userName),
+	}
+
+	coseParameter := []webauthn.COSE_CREDENTIAL_PARAMETER{
+		{
+			Version:        webauthn.COSE_CREDENTIAL_PARAMETER_CURRENT_VERSION,
+			CredentialType: webauthn.LPCWSTR(webauthn.CREDENTIAL_TYPE_PUBLIC_KEY),
+			Alg:            coseAlgorithm,
+		},
+	}
+
+	coseParameters := webauthn.COSE_CREDENTIAL_PARAMETERS{
+		Count:                uint32(len(coseParameter)),
+		CredentialParameters: uintptr(unsafe.Pointer(&coseParameter[0])),
+	}
+
+	sshChallengeData := []byte("{}") // should we make a random data?
+
+	clientData := webauthn.CLIENT_DATA{
+		Version:              webauthn.CLIENT_DATA_CURRENT_VERSION,
+		ClientDataJSONLength: uint32(len(sshChallengeData)),
+		ClientDataJSON:       uintptr(unsafe.Pointer(&sshChallengeData[0])),
+		HashAlgId:            webauthn.LPCWSTR(coseHash),
+	}
+
+	userVerificationRequirement := webauthn.USER_VERIFICATION_REQUIREMENT_DISCOURAGED
+
+	if verifyRequired {
+		userVerificationRequirement = webauthn.USER_VERIFICATION_REQUIREMENT_REQUIRED
+	}
+
+	credentialOptions := webauthn.AUTHENTICATOR_MAKE_CREDENTIAL_OPTIONS{
+		Version:                     webauthn.AUTHENTICATOR_MAKE_CREDENTIAL_OPTIONS_CURRENT_VERSION,
+		UserVerificationRequirement: uint32(userVerificationRequirement),
+		RequireResidentKey:          resident,
+	}
+
+	var useWnd uintptr
+	if opts.HWND != 0 {
+		useWnd = opts.HWND
+	} else {
+		useWnd = uintptr(win.GetForegroundWindow())
+	}
+
+	credentialAttestation, err := webauthn.AuthenticatorMakeCredential(useWnd, entityInfo, userEntityInfo, coseParameters, clientData, credentialOptions)
+
+	if err != nil {
+		return nil, fmt.Errorf("AuthenticatorMakeCredential failed: %w", err)
+	}
+
+	defer webauthn.FreeCredentialAttestation(credentialAttestation)
+
+	attestationObjectBytes := webauthn.UintptrToBytes(credentialAttestation.AttestationObject, credentialAttestation.AttestationObjectLen)
+	attestationObject := webauthn.AttestationObject{}
+	err = cbor.Unmarshal(attestationObjectBytes, &attestationObject)
+
+	if err != nil {
+		return nil, fmt.Errorf("cbor.Unmarshal failed to parse attestationObject: %w", err)
+	}
+
+	reader := bytes.NewReader(attestationObject.AuthData)
+	authData := webauthn.AuthenticatorData{}
+
+	// Format of attestation object from https://www.w3.org/TR/webauthn/#attestation-object
+	// Read Authenticator Data Header
+	err = binary.Read(reader, binary.BigEndian, &authData.RPIDHash)
+	err = binary.Read(reader, binary.BigEndian, &authData.Flags)
+	err = binary.Read(reader, binary.BigEndian, &authData.Counter)
+
+	//TODO: Look at authData.Flags to see if there is credential data or extensions
+
+	// Read the attested credential data
+	authData.AttestedCredentialData = &webauthn.AttestedCredentialData{}
+	err = binary.Read(reader, binary.BigEndian, &authData.AttestedCredentialData.AAGUID)
+	err = binary.Read(reader, binary.BigEndian, &authData.AttestedCredentialData.CredentialIDLen)
+	authData.AttestedCredentialData.CredentialID = make([]byte, authData.AttestedCredentialData.CredentialIDLen)
+	err = binary.Read(reader, binary.BigEndian, &authData.AttestedCredentialData.CredentialID)
+
+	credentialPublicKey := make([]byte, reader.Len()) // Read the rest of the AttestedCredentialData in as the public key
+	//TODO: check for CBOR extensions?!
+	_, err = reader.Read(credentialPublicKey)
+
+	coseKey := webauthn.COSEKey{}
+	err = cbor.Unmarshal(credentialPublicKey, &coseKey)
+	if err != nil {
+		return nil, fmt.Errorf("cbor.Unmarshal failed to parse credentialPublicKey: %w", err)
+	}
+
+	var sshPrivBytes []byte
+	var sshPubBytes []byte
+
+	if coseKey.Kty == webauthn.COSE_KEY_TYPE_EC2 {
+		if coseKey.Alg == webauthn.COSE_ALGORITHM_ECDSA_P256_WITH_SHA256 {
+			x := new(big.Int)
+			x.SetBytes(coseKey.X[:])
+			y := new(big.Int)
+			y.SetBytes(coseKey.Y[:])
+
+			publicKeyBytes := elliptic.Marshal(elliptic.P256(), x, y)
+
+			keyType := OPENSSH_SK_ECDSA
+			curveName := "nistp256"
+
+			sshPub := struct {
+				Type        string
+				ID          string
+				Key         []byte
+				Application string
+			}{
+				Type:        keyType,
+				ID:          curveName,
+				Key:         publicKeyBytes,
+				Application: application,
+			}
+
+			sshPriv := sshPrivateKeySKECDSA{
+				Type:        keyType,
+				ID:          curveName,
+				Key:         publicKeyBytes,
+				Application: application,
+				Flags:       authData.Flags,
+				KeyHandle:   authData.AttestedCredentialData.CredentialID,
+				Reserved:    "",
+			}
+
+			sshPubBytes = ssh.Marshal(&sshPub)
+			sshPrivBytes = ssh.Marshal(&sshPriv)
+		} else {
+			return nil, fmt.Errorf("invalid algorithm cose identifier: %d", coseKey.Alg)
+		}
+	} else if coseKey.Kty == webauthn.COSE_KEY_TYPE_OKP {
+		if coseKey.Alg == webauthn.COSE_ALGORITHM_EDDSA_ED25519 {
+			keyType := OPENSSH_SK_ED25519
+
+			sshPub := struct {
+				Type        string
+				Key         []byte
+				Application string
+			}{
+				Type:        keyType,
+				Key:         coseKey.X[:],
+				Application: application,
+			}
+
+			sshPriv := struct {
+				Type        string
+				Key         []byte
+				Application string
+				Flags       byte
+				KeyHandle   []byte
+				Reserved    string
+			}{
+				Type:        keyType,
+				Key:         coseKey.X[:],
+				Application: application,
+				Flags:       authData.Flags,
+				KeyHandle:   authData.AttestedCredentialData.CredentialID,
+				Reserved:    "",
+			}
+
+			sshPubBytes = ssh.Marshal(&sshPub)
+			sshPrivBytes = ssh.Marshal(&sshPriv)
+
+		} else {
+			return nil, fmt.Errorf("invalid algorithm cose identifier: %d", coseKey.Alg)
+		}
+	} else {
+		return nil, fmt.Errorf("openSSH SK keys only available for ECDSA or ED25519 key types (got %d)", coseKey.Kty)
+	}
+
+	sshPublicKeyObj, err := ssh.ParsePublicKey(sshPubBytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse previously generated public key: %w", err)
+	}
+
+	kc.SKPrivateHalf = base64.StdEncoding.EncodeToString(sshPrivBytes)
+
+	return &webAuthNKey{config: kc, pub: sshPublicKeyObj}, nil
+}
+
+func (km *KeyManager) LoadWebAuthNKey(kc *KeyConfig) (*Key, error) {
+	return km.loadKey(kc)
+}
@@ -1,9 +1,316 @@
 package main
 
 import (
-	"ncryptagent/ui"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"ncryptagent/attest"
+	"ncryptagent/bridge"
+	"ncryptagent/headless"
+	"ncryptagent/keyman"
+	"ncryptagent/keyman/listeners"
+	"ncryptagent/scard"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// command is a mode of the executable selected by its first argument, e.g. -stdio-bridge, with - or --
+type command struct {
+	name string
+	// args describes the arguments for the usage
+	args  string
+	usage string
+	// minArgs and maxArgs bound the number of arguments, maxArgs -1 leaves them to the flags of the command
+	minArgs int
+	maxArgs int
+	run     func(args []string) int
+}
+
+var commands = []command{
+	{"stdio-bridge", "[-endpoint <endpoint>] [-max-length <bytes>] [-v]",
+		"relay stdin/stdout to a running agent, e.g. for use as a ProxyCommand", 0, -1, bridge.Main},
+	{"headless", "[-config <config file>]",
+		"run the agent without a user interface, e.g. as a service", 0, -1, headless.Main},
+	{"list-pkcs11", "<module>",
+		"list the keys on the tokens of a PKCS#11 module as config entries", 1, 1,
+		func(args []string) int { return listPKCS11(args[0]) }},
+	{"list-openpgp", "",
+		"list the keys on the OpenPGP cards present as config entries", 0, 0,
+		func([]string) int { return listOpenPGP() }},
+	{"list-piv", "",
+		"list the keys on the PIV cards present as config entries", 0, 0,
+		func([]string) int { return listPIV() }},
+	{"explain-policy", "[-config <config file>] [request flags, see -explain-policy -h] <key>",
+		"dry run a request against the signing policy and explain the decision", 1, -1, explainPolicy},
+	{"export-attestation", "<key> <bundle file> [<nonce hex>]",
+		"export the TPM attestation of a configured key of the Platform Crypto Provider as a bundle", 2, 3,
+		func(args []string) int { return exportAttestation(args[0], args[1], args[2:]) }},
+	{"verify-attestation", "<bundle file> <roots PEM file> [<nonce hex>]",
+		"verify an attestation bundle against the root certificates of a PEM file", 2, 3,
+		func(args []string) int { return verifyAttestation(args[0], args[1], args[2:]) }},
+}
+
+// findCommand returns the command named by arg, which starts with - or --
+func findCommand(arg string) (command, bool) {
+	if !strings.HasPrefix(arg, "-") {
+		return command{}, false
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s [-<command> [arguments]]\n\ncommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s\n    \t%s\n", strings.TrimSpace("-"+c.name+" "+c.args), c.usage)
+	}
+	fmt.Fprintf(w, "\nwithout a command %s\n", agentUsage)
+}
+
 func main() {
-	ui.RunUI()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-h", "-help", "--help":
+			printUsage(os.Stdout)
+			os.Exit(0)
+		}
+
+		if c, ok := findCommand(os.Args[1]); ok {
+			args := os.Args[2:]
+			if len(args) < c.minArgs || (c.maxArgs >= 0 && len(args) > c.maxArgs) {
+				fmt.Fprintf(os.Stderr, "usage: %s %s\n", filepath.Base(os.Args[0]), strings.TrimSpace("-"+c.name+" "+c.args))
+				os.Exit(2)
+			}
+			os.Exit(c.run(args))
+		}
+	}
+
+	runAgent(os.Args[1:])
+}
+
+func explainPolicy(args []string) int {
+	configDir, _ := os.UserConfigDir()
+	fs := flag.NewFlagSet("explain-policy", flag.ContinueOnError)
+	configPath := fs.String("config", filepath.Join(configDir, "nCryptAgent", "config.json"), "path of the config file")
+	list := fs.Bool("list", false, "explain listing the key instead of signing with it")
+	listener := fs.String("listener", "NAMED_PIPE", "listener type the request arrives on")
+	process := fs.String("process", "", "image path or name of the client process, e.g. ssh.exe")
+	ancestors := fs.String("ancestors", "", "comma separated parent processes of the client, immediate parent first")
+	hosts := fs.String("host", "", "comma separated names of the destination host")
+	hostKeyPath := fs.String("host-key", "", "file with the public key of the destination host")
+	forwarded := fs.Bool("forwarded", false, "the request arrives through agent forwarding")
+	payload := fs.String("payload", keyman.PAYLOAD_AUTH, "auth, sshsig or other")
+	namespace := fs.String("namespace", "", "namespace of an sshsig payload, e.g. git")
+	at := fs.String("time", "", "local time of the request, now when empty")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "explain-policy needs exactly one key name")
+		return 2
+	}
+
+	req := &keyman.PolicyRequest{
+		Operation: keyman.OPERATION_SIGN,
+		KeyName:   fs.Arg(0),
+		Peer:      &listeners.PeerInfo{Listener: strings.ToUpper(*listener)},
+		Payload:   *payload,
+		Namespace: *namespace,
+		Forwarded: *forwarded,
+	}
+	if *list {
+		req.Operation = keyman.OPERATION_LIST
+	}
+	if *process != "" {
+		req.Peer.Process = &listeners.ProcessInfo{ImagePath: *process}
+		for _, parent := range strings.Split(*ancestors, ",") {
+			if parent = strings.TrimSpace(parent); parent != "" {
+				req.Peer.Parents = append(req.Peer.Parents, listeners.ProcessInfo{ImagePath: parent})
+			}
+		}
+	}
+	if *hosts != "" {
+		req.HostNames = strings.Split(*hosts, ",")
+	}
+	if *hostKeyPath != "" {
+		content, err := os.ReadFile(*hostKeyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if req.HostKey, _, _, _, err = ssh.ParseAuthorizedKey(content); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid host key in %s: %s\n", *hostKeyPath, err)
+			return 2
+		}
+	}
+	if *at != "" {
+		t, err := time.ParseInLocation("2006-01-02 15:04", *at, time.Local)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid time %q, expected YYYY-MM-DD HH:MM\n", *at)
+			return 2
+		}
+		req.Time = t
+	}
+
+	km, err := keyman.NewKeyManager(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer km.Close()
+
+	fmt.Printf("policy %s\n", km.PolicyPath())
+	decision := km.ExplainPolicy(req)
+	for _, reason := range decision.Reasons {
+		fmt.Printf("  %s\n", reason)
+	}
+	fmt.Printf("%s %s: %s\n", req.Operation, req.KeyName, decision)
+	return 0
+}
+
+func exportAttestation(keyName string, bundlePath string, args []string) int {
+	var nonce []byte
+	if len(args) > 0 {
+		var err error
+		if nonce, err = hex.DecodeString(args[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid nonce: %s\n", err)
+			return 2
+		}
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	km, err := keyman.NewKeyManager(filepath.Join(configDir, "nCryptAgent", "config.json"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer km.Close()
+
+	bundle, err := km.ExportAttestation(keyName, nonce)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err = bundle.WriteFile(bundlePath); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("attestation of key %s written to %s\n", keyName, bundlePath)
+	return 0
+}
+
+func verifyAttestation(bundlePath string, rootsPath string, args []string) int {
+	opts := attest.VerifyOptions{}
+	if len(args) > 0 {
+		var err error
+		if opts.Nonce, err = hex.DecodeString(strings.TrimSpace(args[0])); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid nonce: %s\n", err)
+			return 2
+		}
+	}
+
+	roots, err := attest.ReadCertificates(rootsPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	opts.Roots = x509.NewCertPool()
+	for _, cert := range roots {
+		opts.Roots.AddCert(cert)
+	}
+
+	bundle, err := attest.ReadBundle(bundlePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	res, err := attest.Verify(bundle, opts)
+	if err != nil {
+		fmt.Printf("%s: attestation failed: %s\n", bundlePath, err)
+		return 1
+	}
+
+	fmt.Printf("%s: %s is a TPM key, attributes 0x%08x\n", bundlePath, ssh.FingerprintSHA256(res.PublicKey), res.Attributes)
+	fmt.Printf("  AIK: %s, issued by %s\n", res.AIK.Subject, res.AIK.Issuer)
+	if res.EK != nil {
+		fmt.Printf("  EK: issued by %s, not bound to the AIK\n", res.EK.Issuer)
+	} else {
+		fmt.Printf("  EK: no certificate in the bundle\n")
+	}
+	if opts.Nonce == nil {
+		fmt.Printf("  no nonce given, the attestation may be replayed\n")
+	}
+	return 0
+}
+
+func listPKCS11(modulePath string) int {
+	b := keyman.NewPKCS11Backend(nil)
+	defer b.Close()
+
+	keys, err := b.Keys(modulePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(keys) == 0 {
+		fmt.Fprintf(os.Stderr, "no keys found on the tokens of %s\n", modulePath)
+		return 1
+	}
+
+	out, _ := json.MarshalIndent(keys, "", "  ")
+	fmt.Println(string(out))
+	return 0
+}
+
+func listPIV() int {
+	b := keyman.NewPIVBackend(nil, scard.System())
+	defer b.Close()
+
+	keys, err := b.Keys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(os.Stderr, "no keys found on the PIV cards present")
+		return 1
+	}
+
+	out, _ := json.MarshalIndent(keys, "", "  ")
+	fmt.Println(string(out))
+	return 0
+}
+
+func listOpenPGP() int {
+	b := keyman.NewOpenPGPBackend(nil, scard.System())
+	defer b.Close()
+
+	keys, err := b.Keys()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(os.Stderr, "no keys found on the OpenPGP cards present")
+		return 1
+	}
+
+	out, _ := json.MarshalIndent(keys, "", "  ")
+	fmt.Println(string(out))
+	return 0
 }
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"ncryptagent/headless"
+	"os"
+)
+
+// agentUsage completes the usage, the arguments are the flags of the headless agent
+const agentUsage = "the agent runs without a user interface, with the flags of -headless"
+
+// runAgent runs the headless agent, there is no user interface outside Windows. Unknown flags are rejected by the
+// flags of the headless agent.
+func runAgent(args []string) {
+	os.Exit(headless.Main(args))
+}
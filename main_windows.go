@@ -0,0 +1,18 @@
+package main
+
+import (
+	"ncryptagent/ui"
+	"os"
+)
+
+// agentUsage completes the usage, the user interface takes no arguments
+const agentUsage = "the user interface is started, it takes no arguments"
+
+// runAgent runs the user interface, arguments that aren't a command are rejected
+func runAgent(args []string) {
+	if len(args) > 0 {
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	ui.RunUI()
+}
@@ -0,0 +1,98 @@
+package ncrypt
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// ErrNotSupported is returned by the functions of ncrypt.dll this version of Windows doesn't have, like
+// NCryptCreateClaim before Windows 10
+var ErrNotSupported = errors.New("not supported by this version of Windows")
+
+// API is the part of CNG the agent uses. Native calls ncrypt.dll on Windows, Emulator is a pure Go stand-in that
+// lets the key lifecycle run anywhere.
+type API interface {
+	// EnumStorageProviders lists the names of the installed key storage providers
+	EnumStorageProviders() ([]string, error)
+	OpenStorageProvider(provider string) (uintptr, error)
+	// IsAlgSupported reports whether a provider supports an algorithm, like ALG_ECDSA_P256
+	IsAlgSupported(provider uintptr, algorithm string) (bool, error)
+	FreeObject(h uintptr) error
+	CreatePersistedKey(provider uintptr, containerName string, algorithmName string, legacyKeySpec uint32, flags uint32) (uintptr, error)
+	FinalizeKey(keyHandle uintptr, flags uint32) error
+	OpenKey(provider uintptr, containerName string, legacyKeySpec uint32, flags uint32) (uintptr, error)
+	// DeleteKey removes the key from its provider and frees the handle when it succeeds
+	DeleteKey(keyHandle uintptr, flags uint32) error
+	GetPropertyStr(h uintptr, property string) (string, error)
+	GetPropertyInt(h uintptr, property string) (int, error)
+	GetPropertyBytes(h uintptr, property string) ([]byte, error)
+	// SetProperty takes a uint32, uintptr, []byte or string value
+	SetProperty(h uintptr, property string, value interface{}, flags uint32) error
+	// ImportKey imports a private key blob as a persisted key named containerName, with NCRYPT_DO_NOT_FINALIZE_FLAG
+	// its properties can be set before FinalizeKey
+	ImportKey(provider uintptr, containerName string, blobType string, blob []byte, flags uint32) (uintptr, error)
+	ExportKey(keyHandle uintptr, blobType string) ([]byte, error)
+	// SignHash signs with PKCS#1 v1.5 padding for the hash algorithm hashID, an empty hashID signs without padding
+	SignHash(keyHandle uintptr, digest []byte, hashID string) ([]byte, error)
+	// CreateClaim returns a claim of the authority key about the subject key, with NCRYPT_CLAIM_AUTHORITY_AND_SUBJECT
+	// the PCP_KEY_ATTESTATION_BLOB of a TPM key certified by an attestation identity key
+	CreateClaim(subjectKey uintptr, authorityKey uintptr, claimType uint32, nonce []byte) ([]byte, error)
+	// EnumKeys lists the keys of a provider, scope selects a smart card reader as \\.\<reader>\ and
+	// NCRYPT_MACHINE_KEY_FLAG lists the machine keys instead of the user's
+	EnumKeys(provider uintptr, scope string, flags uint32) ([]NCryptKeyDescriptor, error)
+}
+
+type NCryptKeyDescriptor struct {
+	Container string
+	Algorithm string
+}
+
+func errNoToStr(e uint32) string {
+	switch e {
+	case NTE_INVALID_PARAMETER:
+		return "NTE_INVALID_PARAMETER"
+	case NTE_INVALID_HANDLE:
+		return "NTE_INVALID_HANDLE"
+	case NTE_BAD_FLAGS:
+		return "NTE_BAD_FLAGS"
+	case NTE_BAD_KEYSET:
+		return "NTE_BAD_KEYSET"
+	case NTE_BAD_KEY_STATE:
+		return "NTE_BAD_KEY_STATE"
+	case NTE_EXISTS:
+		return "NTE_EXISTS"
+	case NTE_NO_MORE_ITEMS:
+		return "NTE_NO_MORE_ITEMS"
+	case NTE_NOT_SUPPORTED:
+		return "NTE_NOT_SUPPORTED"
+	case NTE_SILENT_CONTEXT:
+		return "NTE_SILENT_CONTEXT"
+	case NTE_PERM:
+		return "NTE_PERM"
+	case SCARD_W_CANCELLED_BY_USER:
+		return "User cancelled smartcard action"
+	case SCARD_W_WRONG_CHV:
+		return "Wrong PIN"
+	case SCARD_W_REMOVED_CARD:
+		return "Smartcard removed"
+	default:
+		return fmt.Sprintf("0x%X", e)
+	}
+}
+
+// UsageAuthDigest returns the NCRYPT_PCP_USAGE_AUTH_PROPERTY value for a password, the SHA1 digest of its UTF-16LE
+// encoding without the terminating zero
+func UsageAuthDigest(password string) []byte {
+	utf16Str := utf16.Encode([]rune(password))
+	bytesStr := make([]byte, len(utf16Str)*2)
+	for i, c := range utf16Str {
+		// LPCSTR (Windows' representation of utf16) is always little endian.
+		binary.LittleEndian.PutUint16(bytesStr[i*2:i*2+2], c)
+	}
+
+	digest := sha1.Sum(bytesStr)
+	return digest[:]
+}
@@ -0,0 +1,229 @@
+package ncrypt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+)
+
+// MarshalRSAPublicBlob encodes a BCRYPT_RSAPUBLIC_BLOB the way NCryptExportKey returns it, a BCRYPT_RSAKEY_BLOB header
+// followed by the big endian public exponent and modulus
+func MarshalRSAPublicBlob(pub *rsa.PublicKey) []byte {
+	exp := big.NewInt(int64(pub.E)).Bytes()
+	mod := pub.N.Bytes()
+
+	header := rsaKeyBlobHeader{
+		Magic:         RSA1Magic,
+		BitLength:     uint32(pub.N.BitLen()),
+		PublicExpSize: uint32(len(exp)),
+		ModulusSize:   uint32(len(mod)),
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(exp)
+	buf.Write(mod)
+	return buf.Bytes()
+}
+
+// MarshalECCPublicBlob encodes a BCRYPT_ECCPUBLIC_BLOB, a BCRYPT_ECCKEY_BLOB header followed by X and Y padded to the
+// size of the curve
+func MarshalECCPublicBlob(pub *ecdsa.PublicKey) ([]byte, error) {
+	magic, ok := CurveMagicMap[pub.Curve.Params().Name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+	}
+	size := (pub.Curve.Params().BitSize + 7) / 8
+
+	header := struct {
+		Magic uint32
+		Key   uint32
+	}{
+		Magic: magic,
+		Key:   uint32(size),
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(pub.X.FillBytes(make([]byte, size)))
+	buf.Write(pub.Y.FillBytes(make([]byte, size)))
+	return buf.Bytes(), nil
+}
+
+// rsaKeyBlobHeader is the BCRYPT_RSAKEY_BLOB header of RSA blobs
+type rsaKeyBlobHeader struct {
+	Magic         uint32
+	BitLength     uint32
+	PublicExpSize uint32
+	ModulusSize   uint32
+	Prime1Size    uint32
+	Prime2Size    uint32
+}
+
+// MarshalRSAFullPrivateBlob encodes a BCRYPT_RSAFULLPRIVATE_BLOB for NCryptImportKey, the header followed by the big
+// endian public exponent, modulus, primes, CRT exponents and coefficient, and the private exponent. Only keys of two
+// primes can be encoded.
+func MarshalRSAFullPrivateBlob(key *rsa.PrivateKey) ([]byte, error) {
+	if len(key.Primes) != 2 {
+		return nil, fmt.Errorf("RSA keys of %d primes can't be imported", len(key.Primes))
+	}
+	key.Precompute()
+
+	exp := big.NewInt(int64(key.E)).Bytes()
+	modSize := (key.N.BitLen() + 7) / 8
+	p1Size := (key.Primes[0].BitLen() + 7) / 8
+	p2Size := (key.Primes[1].BitLen() + 7) / 8
+	header := rsaKeyBlobHeader{
+		Magic:         RSA3Magic,
+		BitLength:     uint32(key.N.BitLen()),
+		PublicExpSize: uint32(len(exp)),
+		ModulusSize:   uint32(modSize),
+		Prime1Size:    uint32(p1Size),
+		Prime2Size:    uint32(p2Size),
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(exp)
+	for _, v := range []struct {
+		n    *big.Int
+		size int
+	}{
+		{key.N, modSize},
+		{key.Primes[0], p1Size},
+		{key.Primes[1], p2Size},
+		{key.Precomputed.Dp, p1Size},
+		{key.Precomputed.Dq, p2Size},
+		{key.Precomputed.Qinv, p1Size},
+		{key.D, modSize},
+	} {
+		if (v.n.BitLen()+7)/8 > v.size {
+			return nil, fmt.Errorf("RSA key component of %d bits exceeds %d bytes", v.n.BitLen(), v.size)
+		}
+		buf.Write(v.n.FillBytes(make([]byte, v.size)))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalRSAFullPrivateBlob decodes a BCRYPT_RSAFULLPRIVATE_BLOB and checks the key it holds
+func UnmarshalRSAFullPrivateBlob(blob []byte) (*rsa.PrivateKey, error) {
+	var header rsaKeyBlobHeader
+	r := bytes.NewReader(blob)
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("RSA private blob header: %w", err)
+	}
+	if header.Magic != RSA3Magic {
+		return nil, fmt.Errorf("invalid RSA private blob magic %x", header.Magic)
+	}
+	if header.PublicExpSize == 0 || header.PublicExpSize > 8 {
+		return nil, fmt.Errorf("unsupported public exponent size (%d bits)", header.PublicExpSize*8)
+	}
+
+	read := func(size uint32) (*big.Int, error) {
+		if uint64(size) > uint64(r.Len()) {
+			return nil, fmt.Errorf("RSA private blob is truncated")
+		}
+		b := make([]byte, size)
+		r.Read(b)
+		return new(big.Int).SetBytes(b), nil
+	}
+	var values [8]*big.Int
+	for i, size := range []uint32{header.PublicExpSize, header.ModulusSize, header.Prime1Size, header.Prime2Size,
+		header.Prime1Size, header.Prime2Size, header.Prime1Size, header.ModulusSize} {
+		v, err := read(size)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("RSA private blob has %d trailing bytes", r.Len())
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: values[1], E: int(values[0].Int64())},
+		D:         values[7],
+		Primes:    []*big.Int{values[2], values[3]},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	key.Precompute()
+	if key.Precomputed.Dp.Cmp(values[4]) != 0 || key.Precomputed.Dq.Cmp(values[5]) != 0 || key.Precomputed.Qinv.Cmp(values[6]) != 0 {
+		return nil, fmt.Errorf("RSA private blob has inconsistent CRT values")
+	}
+	return key, nil
+}
+
+// MarshalECCPrivateBlob encodes a BCRYPT_ECCPRIVATE_BLOB for NCryptImportKey, a BCRYPT_ECCKEY_BLOB header followed by
+// X, Y and the private scalar D padded to the size of the curve
+func MarshalECCPrivateBlob(key *ecdsa.PrivateKey) ([]byte, error) {
+	magic, ok := CurvePrivateMagicMap[key.Curve.Params().Name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+
+	header := struct {
+		Magic uint32
+		Key   uint32
+	}{
+		Magic: magic,
+		Key:   uint32(size),
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, header)
+	buf.Write(key.X.FillBytes(make([]byte, size)))
+	buf.Write(key.Y.FillBytes(make([]byte, size)))
+	buf.Write(key.D.FillBytes(make([]byte, size)))
+	return buf.Bytes(), nil
+}
+
+// UnmarshalECCPrivateBlob decodes a BCRYPT_ECCPRIVATE_BLOB of a NIST curve and checks that D derives X and Y
+func UnmarshalECCPrivateBlob(blob []byte) (*ecdsa.PrivateKey, error) {
+	header := struct {
+		Magic uint32
+		Key   uint32
+	}{}
+	r := bytes.NewReader(blob)
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("ECC private blob header: %w", err)
+	}
+
+	var curve elliptic.Curve
+	for _, c := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		if CurvePrivateMagicMap[c.Params().Name] == header.Magic {
+			curve = c
+		}
+	}
+	if curve == nil {
+		return nil, fmt.Errorf("invalid ECC private blob magic %x", header.Magic)
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if int(header.Key) != size || r.Len() != 3*size {
+		return nil, fmt.Errorf("ECC private blob of %d bytes doesn't fit %s", len(blob), curve.Params().Name)
+	}
+
+	values := make([]byte, 3*size)
+	r.Read(values)
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(values[:size]),
+			Y:     new(big.Int).SetBytes(values[size : 2*size]),
+		},
+		D: new(big.Int).SetBytes(values[2*size:]),
+	}
+	if key.D.Sign() == 0 || key.D.Cmp(curve.Params().N) >= 0 {
+		return nil, fmt.Errorf("ECC private blob has an invalid private scalar")
+	}
+	if x, y := curve.ScalarBaseMult(key.D.Bytes()); x.Cmp(key.X) != 0 || y.Cmp(key.Y) != 0 {
+		return nil, fmt.Errorf("ECC private blob's public point doesn't match its private scalar")
+	}
+	return key, nil
+}
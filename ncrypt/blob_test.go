@@ -0,0 +1,207 @@
+package ncrypt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestRSAFullPrivateBlob(t *testing.T) {
+	for _, bits := range []int{1024, 2048, 3072} {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := MarshalRSAFullPrivateBlob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if magic := binary.LittleEndian.Uint32(blob); magic != RSA3Magic {
+			t.Errorf("%d bits: magic %x", bits, magic)
+		}
+		modSize, primeSize := bits/8, bits/16
+		if expected := 24 + 3 + 2*modSize + 5*primeSize; len(blob) != expected {
+			t.Errorf("%d bits: blob of %d bytes, expected %d", bits, len(blob), expected)
+		}
+
+		decoded, err := UnmarshalRSAFullPrivateBlob(blob)
+		if err != nil {
+			t.Fatalf("%d bits: %s", bits, err)
+		}
+		if !decoded.Equal(key) {
+			t.Errorf("%d bits: decoded key differs", bits)
+		}
+	}
+}
+
+func TestRSAFullPrivateBlobMultiPrime(t *testing.T) {
+	key, err := rsa.GenerateMultiPrimeKey(rand.Reader, 3, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = MarshalRSAFullPrivateBlob(key); err == nil {
+		t.Fatal("encoded a key of 3 primes")
+	}
+}
+
+func TestRSAFullPrivateBlobMalformed(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := MarshalRSAFullPrivateBlob(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blob is the header, the 3 byte exponent, the modulus, 5 prime sized values and the private exponent
+	modOffset := 24 + 3
+	qinvOffset := modOffset + 128 + 4*64
+	dOffset := qinvOffset + 64
+
+	modified := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, blob...))
+	}
+
+	for _, tc := range []struct {
+		name string
+		blob []byte
+		err  string
+	}{
+		{"empty", nil, "header"},
+		{"short header", blob[:20], "header"},
+		{"header only", blob[:24], "truncated"},
+		{"truncated", blob[:len(blob)-1], "truncated"},
+		{"trailing bytes", append(append([]byte{}, blob...), 0), "trailing"},
+		{"public blob", MarshalRSAPublicBlob(&key.PublicKey), "magic"},
+		{"no exponent", modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[8:], 0)
+			return b
+		}), "exponent size"},
+		{"oversized exponent", modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[8:], 9)
+			return b
+		}), "exponent size"},
+		{"oversized modulus", modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[12:], 0xffffffff)
+			return b
+		}), "truncated"},
+		{"wrong private exponent", modified(func(b []byte) []byte {
+			b[dOffset+10] ^= 0xff
+			return b
+		}), ""},
+		{"wrong modulus", modified(func(b []byte) []byte {
+			b[modOffset+10] ^= 0xff
+			return b
+		}), ""},
+		{"inconsistent CRT values", modified(func(b []byte) []byte {
+			b[qinvOffset+10] ^= 0xff
+			return b
+		}), "CRT"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := UnmarshalRSAFullPrivateBlob(tc.blob)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("decoding returned %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestECCPrivateBlob(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		name := curve.Params().Name
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := MarshalECCPrivateBlob(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(blob) != 8+3*size {
+			t.Errorf("%s: blob of %d bytes", name, len(blob))
+		}
+		if magic := binary.LittleEndian.Uint32(blob); magic != CurvePrivateMagicMap[name] {
+			t.Errorf("%s: magic %x", name, magic)
+		}
+
+		decoded, err := UnmarshalECCPrivateBlob(blob)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !decoded.Equal(key) {
+			t.Errorf("%s: decoded key differs", name)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = MarshalECCPrivateBlob(key); err == nil {
+		t.Fatal("encoded a P-224 key")
+	}
+}
+
+func TestECCPrivateBlobMalformed(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := MarshalECCPrivateBlob(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := MarshalECCPublicBlob(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modified := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, blob...))
+	}
+	setD := func(d []byte) []byte {
+		return modified(func(b []byte) []byte {
+			copy(b[8+64:], d)
+			return b
+		})
+	}
+	order := elliptic.P256().Params().N.Bytes()
+
+	for _, tc := range []struct {
+		name string
+		blob []byte
+		err  string
+	}{
+		{"empty", nil, "header"},
+		{"short header", blob[:6], "header"},
+		{"header only", blob[:8], "doesn't fit"},
+		{"truncated", blob[:len(blob)-1], "doesn't fit"},
+		{"trailing bytes", append(append([]byte{}, blob...), 0), "doesn't fit"},
+		{"public blob", public, "magic"},
+		{"wrong key size", modified(func(b []byte) []byte {
+			binary.LittleEndian.PutUint32(b[4:], 48)
+			return b
+		}), "doesn't fit"},
+		{"zero scalar", setD(make([]byte, 32)), "private scalar"},
+		{"scalar of the order", setD(order), "private scalar"},
+		{"scalar above the order", setD(bytes.Repeat([]byte{0xff}, 32)), "private scalar"},
+		{"wrong public point", modified(func(b []byte) []byte {
+			b[8+10] ^= 0xff
+			return b
+		}), "doesn't match"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := UnmarshalECCPrivateBlob(tc.blob)
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("decoding returned %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package ncrypt
+
+import (
+	"crypto"
+	"crypto/elliptic"
+)
+
+const (
+
+	// Key storage properties
+	NCRYPT_ALGORITHM_GROUP_PROPERTY = "Algorithm Group"
+	NCRYPT_LENGTH_PROPERTY          = "Length"
+	NCRYPT_KEY_TYPE_PROPERTY        = "Key Type"
+	NCRYPT_UNIQUE_NAME_PROPERTY     = "Unique Name"
+	NCRYPT_ECC_CURVE_NAME_PROPERTY  = "ECCCurveName"
+	NCRYPT_IMPL_TYPE_PROPERTY       = "Impl Type"
+	NCRYPT_PROV_HANDLE              = "Provider Handle"
+	NCRYPT_PIN_PROPERTY             = "SmartCardPin"
+	NCRYPT_SECURE_PIN_PROPERTY      = "SmartCardSecurePin"
+	NCRYPT_READER_PROPERTY          = "SmartCardReader"
+	NCRYPT_ALGORITHM_PROPERTY       = "Algorithm Name"
+	NCRYPT_WINDOW_HANDLE_PROPERTY   = "HWND Handle"
+	NCRYPT_PCP_USAGE_AUTH_PROPERTY  = "PCP_USAGEAUTH"
+	// NCRYPT_LENGTHS_PROPERTY are the key lengths a provider supports for the algorithm of a key, as
+	// NCRYPT_SUPPORTED_LENGTHS
+	NCRYPT_LENGTHS_PROPERTY = "Lengths"
+	// NCRYPT_SMARTCARD_GUID_PROPERTY is the GUID of the card holding a key, from its Cardid file
+	NCRYPT_SMARTCARD_GUID_PROPERTY = "SmartCardGuid"
+	// NCRYPT_PCP_CHANGEPASSWORD_PROPERTY sets a new usage auth digest on a PCP key whose handle holds the old one
+	NCRYPT_PCP_CHANGEPASSWORD_PROPERTY = "PCP_CHANGEPASSWORD"
+	// The endorsement key certificates in the TPM's NV storage, properties of the platform provider
+	NCRYPT_PCP_RSA_EKNVCERT_PROPERTY = "PCP_RSA_EKNVCERT"
+	NCRYPT_PCP_ECC_EKNVCERT_PROPERTY = "PCP_ECC_EKNVCERT"
+	NCRYPT_PCP_EKNVCERT_PROPERTY     = "PCP_EKNVCERT"
+	// NCryptCreateClaim of a key certified by an attestation identity key, with an optional nonce
+	NCRYPT_CLAIM_AUTHORITY_AND_SUBJECT      = 0x00000003
+	NCRYPTBUFFER_CLAIM_KEYATTESTATION_NONCE = 49
+	// NCryptImportKey of a persisted key named by NCRYPTBUFFER_PKCS_KEY_NAME, finalized after its properties are set
+	NCRYPTBUFFER_PKCS_KEY_NAME  = 45
+	NCRYPT_DO_NOT_FINALIZE_FLAG = 0x00000400
+	// NCRYPT_EXPORT_POLICY_PROPERTY of 0 keeps a key from being exported
+	NCRYPT_EXPORT_POLICY_PROPERTY      = "Export Policy"
+	NCRYPT_ALLOW_EXPORT_FLAG           = 0x00000001
+	NCRYPT_ALLOW_PLAINTEXT_EXPORT_FLAG = 0x00000002
+	// Key Storage Flags
+	NCRYPT_MACHINE_KEY_FLAG = 0x00000001
+	NCRYPT_SILENT_FLAG      = 0x40
+
+	// Errors
+	NTE_NOT_SUPPORTED         = uint32(0x80090029)
+	NTE_NO_MEMORY             = uint32(0x8009000E)
+	NTE_INVALID_PARAMETER     = uint32(0x80090027)
+	NTE_INVALID_HANDLE        = uint32(0x80090026)
+	NTE_BAD_FLAGS             = uint32(0x80090009)
+	NTE_NO_MORE_ITEMS         = uint32(0x8009002A)
+	NTE_BAD_KEYSET            = uint32(0x80090016)
+	NTE_EXISTS                = uint32(0x8009000F)
+	NTE_BAD_KEY_STATE         = uint32(0x8009000B)
+	NTE_SILENT_CONTEXT        = uint32(0x80090022)
+	NTE_PERM                  = uint32(0x80090010)
+	SCARD_W_CANCELLED_BY_USER = uint32(0x8010006E)
+	SCARD_W_WRONG_CHV         = uint32(0x8010006B)
+	SCARD_W_REMOVED_CARD      = uint32(0x80100069)
+
+	// wincrypt.h constants
+	acquireCached           = 0x1                                             // CRYPT_ACQUIRE_CACHE_FLAG
+	acquireSilent           = 0x40                                            // CRYPT_ACQUIRE_SILENT_FLAG
+	encodingX509ASN         = 1                                               // X509_ASN_ENCODING
+	encodingPKCS7           = 65536                                           // PKCS_7_ASN_ENCODING
+	certStoreProvSystem     = 10                                              // CERT_STORE_PROV_SYSTEM
+	certStoreOpenExisting   = 0x00004000                                      // CERT_STORE_OPEN_EXISTING_FLAG
+	certStoreCurrentUser    = uint32(certStoreCurrentUserID << compareShift)  // CERT_SYSTEM_STORE_CURRENT_USER
+	certStoreLocalMachine   = uint32(certStoreLocalMachineID << compareShift) // CERT_SYSTEM_STORE_LOCAL_MACHINE
+	certStoreCurrentUserID  = 1                                               // CERT_SYSTEM_STORE_CURRENT_USER_ID
+	certStoreLocalMachineID = 2                                               // CERT_SYSTEM_STORE_LOCAL_MACHINE_ID
+	infoIssuerFlag          = 4                                               // CERT_INFO_ISSUER_FLAG
+	compareNameStrW         = 8                                               // CERT_COMPARE_NAME_STR_A
+	compareShift            = 16                                              // CERT_COMPARE_SHIFT
+	compareSHA1Hash         = 1                                               // CERT_COMPARE_SHA1_HASH
+	compareCertID           = 16                                              // CERT_COMPARE_CERT_ID
+	findIssuerStr           = compareNameStrW<<compareShift | infoIssuerFlag  // CERT_FIND_ISSUER_STR_W
+	findHash                = compareSHA1Hash << compareShift                 // CERT_FIND_HASH
+	findCertID              = compareCertID << compareShift                   // CERT_FIND_CERT_ID
+
+	signatureKeyUsage = 0x80       // CERT_DIGITAL_SIGNATURE_KEY_USAGE
+	ncryptKeySpec     = 0xFFFFFFFF // CERT_NCRYPT_KEY_SPEC
+
+	BCRYPT_RSAPUBLIC_BLOB      = "RSAPUBLICBLOB"
+	BCRYPT_ECCPUBLIC_BLOB      = "ECCPUBLICBLOB"
+	BCRYPT_RSAFULLPRIVATE_BLOB = "RSAFULLPRIVATEBLOB"
+	BCRYPT_ECCPRIVATE_BLOB     = "ECCPRIVATEBLOB"
+
+	// winerror.h constants
+	CRYPT_E_NOT_FOUND                    = uint32(0x80092004)
+	CRYPT_ACQUIRE_ALLOW_NCRYPT_KEY_FLAG  = uint32(0x00010000)
+	CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG = uint32(0x00020000)
+	CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG   = uint32(0x00040000)
+
+	CERT_ID_ISSUER_SERIAL_NUMBER = uint32(1)
+	CERT_ID_KEY_IDENTIFIER       = uint32(2)
+	CERT_ID_SHA1_HASH            = uint32(3)
+
+	CERT_NAME_STR_COMMA_FLAG = uint32(0x04000000)
+	CERT_SIMPLE_NAME_STR     = uint32(1)
+	CERT_X500_NAME_STR       = uint32(3)
+
+	AT_KEYEXCHANGE = uint32(1)
+	AT_SIGNATURE   = uint32(2)
+
+	// Legacy CryptoAPI flags
+	bCryptPadPKCS1 = uint32(2)
+
+	// Magic numbers for public key blobs.
+	RSA1Magic = 0x31415352 // "RSA1" BCRYPT_RSAPUBLIC_MAGIC
+	ECS1Magic = 0x31534345 // "ECS1" BCRYPT_ECDSA_PUBLIC_P256_MAGIC
+	ECS3Magic = 0x33534345 // "ECS3" BCRYPT_ECDSA_PUBLIC_P384_MAGIC
+	ECS5Magic = 0x35534345 // "ECS5" BCRYPT_ECDSA_PUBLIC_P521_MAGIC
+
+	// Magic numbers for private key blobs.
+	RSA3Magic = 0x33415352 // "RSA3" BCRYPT_RSAFULLPRIVATE_MAGIC
+	ECS2Magic = 0x32534345 // "ECS2" BCRYPT_ECDSA_PRIVATE_P256_MAGIC
+	ECS4Magic = 0x34534345 // "ECS4" BCRYPT_ECDSA_PRIVATE_P384_MAGIC
+	ECS6Magic = 0x36534345 // "ECS6" BCRYPT_ECDSA_PRIVATE_P521_MAGIC
+
+	ProviderMSSC       = "Microsoft Smart Card Key Storage Provider"
+	ProviderMSPlatform = "Microsoft Platform Crypto Provider"
+	ProviderMSSoftware = "Microsoft Software Key Storage Provider"
+	ProviderMSPassport = "Microsoft Passport Key Storage Provider"
+
+	ALG_RSA        = "RSA"
+	ALG_ECDSA_P256 = "ECDSA_P256"
+	ALG_ECDSA_P384 = "ECDSA_P384"
+	ALG_ECDSA_P521 = "ECDSA_P521"
+)
+
+var (
+	CurveNames = map[string]elliptic.Curve{
+		ALG_ECDSA_P256: elliptic.P256(),
+		ALG_ECDSA_P384: elliptic.P384(),
+		ALG_ECDSA_P521: elliptic.P521(),
+		"nistP256":     elliptic.P256(), // BCRYPT_ECC_CURVE_NISTP256
+		"nistP384":     elliptic.P384(), // BCRYPT_ECC_CURVE_NISTP384
+		"nistP521":     elliptic.P521(), // BCRYPT_ECC_CURVE_NISTP521
+	}
+
+	CurveMagicMap = map[string]uint32{
+		"P-256": ECS1Magic,
+		"P-384": ECS3Magic,
+		"P-521": ECS5Magic,
+	}
+
+	CurvePrivateMagicMap = map[string]uint32{
+		"P-256": ECS2Magic,
+		"P-384": ECS4Magic,
+		"P-521": ECS6Magic,
+	}
+
+	// algIDs maps crypto.Hash values to bcrypt.h constants.
+	HashAlgorithms = map[crypto.Hash]string{
+		crypto.SHA1:   "SHA1",   // BCRYPT_SHA1_ALGORITHM
+		crypto.SHA256: "SHA256", // BCRYPT_SHA256_ALGORITHM
+		crypto.SHA384: "SHA384", // BCRYPT_SHA384_ALGORITHM
+		crypto.SHA512: "SHA512", // BCRYPT_SHA512_ALGORITHM
+	}
+
+	AVAILABLE_ALGORITHMS = []string{ALG_ECDSA_P256, ALG_ECDSA_P384, ALG_ECDSA_P521, ALG_RSA}
+)
@@ -0,0 +1,934 @@
+package ncrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"ncryptagent/attest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Emulator is an in-memory API for running the NCrypt key lifecycle without Windows. Keys are real Go keys, exported
+// public keys use the CNG blob encoding and signatures the CNG layout. PIN protected keys ask PINPrompt the way a key
+// storage provider shows its PIN dialog and keep the PIN on the key handle until NCRYPT_PIN_PROPERTY is cleared.
+type Emulator struct {
+	// PINPrompt stands in for the provider's PIN dialog, returning false cancels it. Without a PINPrompt PIN
+	// protected keys can only sign while their handle holds the PIN.
+	PINPrompt func(provider string, container string) (string, bool)
+	// EKCertificate is the DER endorsement key certificate of the platform provider's TPM, none when nil. Keys of the
+	// platform provider are certified by TPM2_Certify with attest.CertifyKey.
+	EKCertificate []byte
+	// Unprivileged stands in for an account that isn't an administrator, it can use machine keys but not create them
+	Unprivileged bool
+	// Missing names the functions an older version of Windows lacks, like NCryptCreateClaim before Windows 10. They
+	// return ErrNotSupported like the native calls do.
+	Missing []string
+
+	mu        sync.Mutex
+	next      uintptr
+	providers map[string]*emulatedProvider
+	handles   map[uintptr]interface{}
+}
+
+type emulatedProvider struct {
+	name string
+	keys map[string]*emulatedKey
+	// algorithms are the algorithms of the provider, nil for all of them, and rsaLengths the minimum, maximum,
+	// increment and default of its RSA key lengths. Keys can't be created when noCreate is set.
+	algorithms []string
+	rsaLengths [4]uint32
+	noCreate   bool
+}
+
+// supports reports whether the provider has an algorithm
+func (p *emulatedProvider) supports(algorithm string) bool {
+	if _, ok := CurveNames[algorithm]; !ok && algorithm != ALG_RSA {
+		return false
+	}
+	if p.algorithms == nil {
+		return true
+	}
+	for _, a := range p.algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+type emulatedKey struct {
+	provider  *emulatedProvider
+	container string
+	algorithm string
+	length    int
+	signer    crypto.Signer
+	finalized bool
+	removed   bool
+	// card is the GUID of the smart card holding the key and reader the reader it is in, empty when the card was
+	// taken out. Keys of other providers have no card.
+	card   []byte
+	reader string
+	// pinDigest is the UsageAuthDigest of the key's PIN, nil when the key has none
+	pinDigest []byte
+	prompts   int
+	// imported keys were brought in with ImportKey instead of generated by the provider, exportPolicy is their
+	// NCRYPT_EXPORT_POLICY_PROPERTY
+	imported     bool
+	exportPolicy uint32
+	// machine keys were created with NCRYPT_MACHINE_KEY_FLAG, they are apart from the user's keys of the same name
+	machine bool
+}
+
+// id is the key's index in its provider, the same container can be on several cards and in both scopes
+func (k *emulatedKey) id() string {
+	id := strings.ToLower(k.container)
+	if k.card != nil {
+		id = fmt.Sprintf("%s@%x", id, k.card)
+	}
+	if k.machine {
+		id = "machine:" + id
+	}
+	return id
+}
+
+// present reports whether the key can be opened
+func (k *emulatedKey) present() bool {
+	return !k.removed && (k.card == nil || k.reader != "")
+}
+
+type emulatedKeyHandle struct {
+	key    *emulatedKey
+	silent bool
+	pin    []byte
+	hwnd   uintptr
+}
+
+type emulatedProviderHandle struct {
+	provider *emulatedProvider
+}
+
+// NewEmulator returns an emulator with the providers of a Windows installation with a TPM: the software, smart card,
+// platform and passport providers. Other providers are created when they are first opened, with every algorithm.
+func NewEmulator() *Emulator {
+	e := &Emulator{
+		next:      0x1000,
+		providers: make(map[string]*emulatedProvider),
+		handles:   make(map[uintptr]interface{}),
+	}
+	e.provider(ProviderMSSoftware)
+	e.provider(ProviderMSSC)
+	platform := e.provider(ProviderMSPlatform)
+	platform.algorithms = []string{ALG_RSA, ALG_ECDSA_P256, ALG_ECDSA_P384}
+	platform.rsaLengths = [4]uint32{1024, 2048, 1024, 2048}
+	passport := e.provider(ProviderMSPassport)
+	passport.algorithms = []string{ALG_RSA}
+	passport.rsaLengths = [4]uint32{2048, 2048, 0, 2048}
+	return e
+}
+
+// InstallProvider adds a provider with the given algorithms, like a vendor's key storage provider. Without create
+// the provider only has the keys stored with AddKey.
+func (e *Emulator) InstallProvider(name string, algorithms []string, create bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p := e.provider(name)
+	p.algorithms = append([]string(nil), algorithms...)
+	p.noCreate = !create
+}
+
+// missing returns ErrNotSupported for a function listed in Missing
+func (e *Emulator) missing(function string) error {
+	for _, m := range e.Missing {
+		if m == function {
+			return fmt.Errorf("%s: %w", function, ErrNotSupported)
+		}
+	}
+	return nil
+}
+
+func emulatorError(function string, code uint32) error {
+	return fmt.Errorf("%s returned %v", function, errNoToStr(code))
+}
+
+// emulatedReader is the reader the smart card of AddKey is in
+const emulatedReader = "Emulated Reader 0"
+
+// emulatedCard is the GUID of the smart card of AddKey
+var emulatedCard = []byte{0x4e, 0x43, 0x52, 0x59, 0x50, 0x54, 0x41, 0x47, 0x45, 0x4e, 0x54, 0x00, 0x00, 0x00, 0x00, 0x01}
+
+// find returns the key a container name opens. A name qualified as \\.\<reader>\<container> opens the key on the card
+// in that reader, a plain name the key on the card in the first reader when several cards hold the container, like
+// the smart card provider does. Keys that aren't present are only found with all set, machine keys only with machine
+// set. The caller holds e.mu.
+func (p *emulatedProvider) find(name string, machine bool, all bool) (*emulatedKey, bool) {
+	reader, container := "", name
+	if qualified := strings.TrimPrefix(name, `\\.\`); qualified != name {
+		var ok bool
+		if reader, container, ok = strings.Cut(qualified, `\`); !ok {
+			return nil, false
+		}
+	}
+
+	var found *emulatedKey
+	for _, k := range p.keys {
+		if !strings.EqualFold(k.container, container) || k.machine != machine || (!all && !k.present()) {
+			continue
+		}
+		if reader != "" && !strings.EqualFold(k.reader, reader) {
+			continue
+		}
+		if found == nil || k.reader < found.reader {
+			found = k
+		}
+	}
+	return found, found != nil
+}
+
+// provider returns the provider of the given name, creating it on first use. The caller holds e.mu.
+func (e *Emulator) provider(name string) *emulatedProvider {
+	p, ok := e.providers[strings.ToLower(name)]
+	if !ok {
+		p = &emulatedProvider{name: name, keys: make(map[string]*emulatedKey), rsaLengths: [4]uint32{512, 16384, 64, 2048}}
+		e.providers[strings.ToLower(name)] = p
+	}
+	return p
+}
+
+func (e *Emulator) newHandle(obj interface{}) uintptr {
+	h := e.next
+	e.next += 4
+	e.handles[h] = obj
+	return h
+}
+
+func (e *Emulator) keyHandle(function string, h uintptr) (*emulatedKeyHandle, error) {
+	kh, ok := e.handles[h].(*emulatedKeyHandle)
+	if !ok {
+		return nil, emulatorError(function, NTE_INVALID_HANDLE)
+	}
+	return kh, nil
+}
+
+func (e *Emulator) providerHandle(function string, h uintptr) (*emulatedProvider, error) {
+	ph, ok := e.handles[h].(*emulatedProviderHandle)
+	if !ok {
+		return nil, emulatorError(function, NTE_INVALID_HANDLE)
+	}
+	return ph.provider, nil
+}
+
+// AddKey stores an existing key in a provider, e.g. the contents of a smart card. An empty pin stores a key without a
+// PIN. Keys of the smart card provider are on one card in "Emulated Reader 0".
+func (e *Emulator) AddKey(provider string, container string, signer crypto.Signer, pin string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	k := &emulatedKey{container: container, signer: signer, finalized: true}
+	if strings.EqualFold(provider, ProviderMSSC) {
+		k.card, k.reader = emulatedCard, emulatedReader
+	}
+	return e.addKey(provider, k, pin)
+}
+
+// AddCardKey stores an existing key on the smart card with the given GUID in a reader, cards provisioned from the same
+// template have the same containers
+func (e *Emulator) AddCardKey(reader string, card []byte, container string, signer crypto.Signer, pin string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	k := &emulatedKey{container: container, signer: signer, finalized: true, card: append([]byte(nil), card...), reader: reader}
+	return e.addKey(ProviderMSSC, k, pin)
+}
+
+// MoveCard puts the smart card with the given GUID in a reader, taking out the card that was in it, or takes it out
+// with an empty reader. Open handles of keys on a card that was taken out fail to sign.
+func (e *Emulator) MoveCard(card []byte, reader string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, k := range e.provider(ProviderMSSC).keys {
+		if bytes.Equal(k.card, card) {
+			k.reader = reader
+		} else if reader != "" && strings.EqualFold(k.reader, reader) {
+			k.reader = ""
+		}
+	}
+}
+
+// addKey stores a finalized key, the caller holds e.mu
+func (e *Emulator) addKey(provider string, k *emulatedKey, pin string) error {
+	signer := k.signer
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		k.algorithm = ALG_RSA
+		k.length = pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		for name, curve := range CurveNames {
+			if curve == pub.Curve && strings.HasPrefix(name, "ECDSA_") {
+				k.algorithm = name
+			}
+		}
+		if k.algorithm == "" {
+			return fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+		}
+		k.length = pub.Curve.Params().BitSize
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	if pin != "" {
+		k.pinDigest = UsageAuthDigest(pin)
+	}
+
+	p := e.provider(provider)
+	if _, exists := p.keys[k.id()]; exists {
+		return emulatorError("AddKey", NTE_EXISTS)
+	}
+	k.provider = p
+	p.keys[k.id()] = k
+	return nil
+}
+
+// SetRemoved simulates removing the card holding a key, or inserting it again. A removed key can't be opened and
+// open handles fail to sign.
+func (e *Emulator) SetRemoved(provider string, container string, removed bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	k, ok := e.provider(provider).find(container, false, true)
+	if !ok {
+		return emulatorError("SetRemoved", NTE_BAD_KEYSET)
+	}
+	k.removed = removed
+	return nil
+}
+
+// Prompts returns how often PINPrompt was shown for a key
+func (e *Emulator) Prompts(provider string, container string) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if k, ok := e.provider(provider).find(container, false, true); ok {
+		return k.prompts
+	}
+	return 0
+}
+
+// OpenHandles returns the number of provider and key handles that haven't been freed
+func (e *Emulator) OpenHandles() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.handles)
+}
+
+func (e *Emulator) EnumStorageProviders() ([]string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.missing("NCryptEnumStorageProviders"); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, p := range e.providers {
+		names = append(names, p.name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (e *Emulator) IsAlgSupported(provider uintptr, algorithm string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.missing("NCryptIsAlgSupported"); err != nil {
+		return false, err
+	}
+
+	p, err := e.providerHandle("NCryptIsAlgSupported", provider)
+	if err != nil {
+		return false, err
+	}
+	return p.supports(algorithm), nil
+}
+
+func (e *Emulator) OpenStorageProvider(provider string) (uintptr, error) {
+	if provider == "" {
+		return 0, emulatorError("NCryptOpenStorageProvider", NTE_INVALID_PARAMETER)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.newHandle(&emulatedProviderHandle{provider: e.provider(provider)}), nil
+}
+
+func (e *Emulator) FreeObject(h uintptr) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, ok := e.handles[h]; !ok {
+		return emulatorError("NCryptFreeObject", NTE_INVALID_HANDLE)
+	}
+	delete(e.handles, h)
+	return nil
+}
+
+func (e *Emulator) CreatePersistedKey(provider uintptr, containerName string, algorithmName string, legacyKeySpec uint32, flags uint32) (uintptr, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, err := e.providerHandle("NCryptCreatePersistedKey", provider)
+	if err != nil {
+		return 0, err
+	}
+	k := &emulatedKey{provider: p, container: containerName, algorithm: algorithmName, machine: flags&NCRYPT_MACHINE_KEY_FLAG != 0}
+	if err = e.checkMachineKey("NCryptCreatePersistedKey", k); err != nil {
+		return 0, err
+	}
+	if _, exists := p.keys[k.id()]; exists {
+		return 0, emulatorError("NCryptCreatePersistedKey", NTE_EXISTS)
+	}
+	if p.noCreate || !p.supports(algorithmName) {
+		return 0, emulatorError("NCryptCreatePersistedKey", NTE_NOT_SUPPORTED)
+	}
+
+	switch algorithmName {
+	case ALG_RSA:
+		k.length = 2048
+	case ALG_ECDSA_P256, ALG_ECDSA_P384, ALG_ECDSA_P521:
+		k.length = CurveNames[algorithmName].Params().BitSize
+	default:
+		return 0, emulatorError("NCryptCreatePersistedKey", NTE_NOT_SUPPORTED)
+	}
+
+	return e.newHandle(&emulatedKeyHandle{key: k}), nil
+}
+
+// checkMachineKey refuses machine keys to an unprivileged account and on smart cards, the caller holds e.mu
+func (e *Emulator) checkMachineKey(function string, k *emulatedKey) error {
+	if !k.machine {
+		return nil
+	}
+	if strings.EqualFold(k.provider.name, ProviderMSSC) {
+		return emulatorError(function, NTE_BAD_FLAGS)
+	}
+	if e.Unprivileged {
+		return emulatorError(function, NTE_PERM)
+	}
+	return nil
+}
+
+func (e *Emulator) FinalizeKey(keyHandle uintptr, flags uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kh, err := e.keyHandle("NCryptFinalizeKey", keyHandle)
+	if err != nil {
+		return err
+	}
+	k := kh.key
+	if k.finalized {
+		return emulatorError("NCryptFinalizeKey", NTE_BAD_KEY_STATE)
+	}
+	if _, exists := k.provider.keys[k.id()]; exists {
+		return emulatorError("NCryptFinalizeKey", NTE_EXISTS)
+	}
+
+	switch {
+	case k.imported:
+		// the key material came with ImportKey
+	case k.algorithm == ALG_RSA:
+		k.signer, err = rsa.GenerateKey(rand.Reader, k.length)
+	default:
+		k.signer, err = ecdsa.GenerateKey(CurveNames[k.algorithm], rand.Reader)
+	}
+	if err != nil {
+		return fmt.Errorf("NCryptFinalizeKey failed: %w", err)
+	}
+
+	k.finalized = true
+	k.provider.keys[k.id()] = k
+	// the creator set the PIN, like the real providers it is cached on the handle
+	kh.pin = k.pinDigest
+	return nil
+}
+
+func (e *Emulator) OpenKey(provider uintptr, containerName string, legacyKeySpec uint32, flags uint32) (uintptr, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, err := e.providerHandle("NCryptOpenKey", provider)
+	if err != nil {
+		return 0, err
+	}
+	if flags&NCRYPT_MACHINE_KEY_FLAG != 0 && strings.EqualFold(p.name, ProviderMSSC) {
+		return 0, emulatorError("NCryptOpenKey", NTE_BAD_FLAGS)
+	}
+	k, ok := p.find(containerName, flags&NCRYPT_MACHINE_KEY_FLAG != 0, false)
+	if !ok {
+		return 0, emulatorError("NCryptOpenKey", NTE_BAD_KEYSET)
+	}
+
+	return e.newHandle(&emulatedKeyHandle{key: k, silent: flags&NCRYPT_SILENT_FLAG != 0}), nil
+}
+
+func (e *Emulator) DeleteKey(keyHandle uintptr, flags uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kh, err := e.keyHandle("NCryptDeleteKey", keyHandle)
+	if err != nil {
+		return err
+	}
+	k := kh.key
+	if !k.finalized {
+		return emulatorError("NCryptDeleteKey", NTE_BAD_KEY_STATE)
+	}
+	if !k.present() {
+		return emulatorError("NCryptDeleteKey", SCARD_W_REMOVED_CARD)
+	}
+
+	delete(k.provider.keys, k.id())
+	delete(e.handles, keyHandle)
+	return nil
+}
+
+func (e *Emulator) GetPropertyStr(h uintptr, property string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kh, err := e.keyHandle("NCryptGetProperty", h)
+	if err != nil {
+		return "", err
+	}
+	k := kh.key
+
+	switch property {
+	case NCRYPT_ALGORITHM_PROPERTY:
+		return k.algorithm, nil
+	case NCRYPT_ALGORITHM_GROUP_PROPERTY:
+		if k.algorithm == ALG_RSA {
+			return "RSA", nil
+		}
+		return "ECDSA", nil
+	case NCRYPT_UNIQUE_NAME_PROPERTY:
+		return k.container, nil
+	case NCRYPT_ECC_CURVE_NAME_PROPERTY:
+		// the smart card provider doesn't have the curve name, see getPublicKey
+		if k.algorithm == ALG_RSA || strings.EqualFold(k.provider.name, ProviderMSSC) {
+			break
+		}
+		return "nist" + strings.TrimPrefix(k.algorithm, "ECDSA_"), nil
+	case NCRYPT_READER_PROPERTY:
+		if k.card == nil {
+			break
+		}
+		if k.reader == "" {
+			return "", emulatorError(fmt.Sprintf("NCryptGetProperty(%s)", property), SCARD_W_REMOVED_CARD)
+		}
+		return k.reader, nil
+	}
+
+	return "", emulatorError(fmt.Sprintf("NCryptGetProperty(%s)", property), NTE_NOT_SUPPORTED)
+}
+
+func (e *Emulator) GetPropertyBytes(h uintptr, property string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if p, err := e.providerHandle("NCryptGetProperty", h); err == nil {
+		switch property {
+		case NCRYPT_PCP_RSA_EKNVCERT_PROPERTY, NCRYPT_PCP_EKNVCERT_PROPERTY:
+			if p.name == ProviderMSPlatform && e.EKCertificate != nil {
+				return append([]byte(nil), e.EKCertificate...), nil
+			}
+		}
+		return nil, emulatorError(fmt.Sprintf("NCryptGetProperty(%s)", property), NTE_NOT_SUPPORTED)
+	}
+
+	kh, err := e.keyHandle("NCryptGetProperty", h)
+	if err != nil {
+		return nil, err
+	}
+
+	k := kh.key
+	switch {
+	case property == NCRYPT_SMARTCARD_GUID_PROPERTY && k.card != nil:
+		return append([]byte(nil), k.card...), nil
+	case property == NCRYPT_LENGTHS_PROPERTY:
+		// NCRYPT_SUPPORTED_LENGTHS, the single length of a curve
+		lengths := k.provider.rsaLengths
+		if k.algorithm != ALG_RSA {
+			lengths = [4]uint32{uint32(k.length), uint32(k.length), 0, uint32(k.length)}
+		}
+		buf := make([]byte, 16)
+		for i, l := range lengths {
+			binary.LittleEndian.PutUint32(buf[4*i:], l)
+		}
+		return buf, nil
+	}
+	return nil, emulatorError(fmt.Sprintf("NCryptGetProperty(%s)", property), NTE_NOT_SUPPORTED)
+}
+
+func (e *Emulator) GetPropertyInt(h uintptr, property string) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kh, err := e.keyHandle("NCryptGetProperty", h)
+	if err != nil {
+		return 0, err
+	}
+
+	if property == NCRYPT_LENGTH_PROPERTY {
+		return kh.key.length, nil
+	}
+	return 0, emulatorError(fmt.Sprintf("NCryptGetProperty(%s)", property), NTE_NOT_SUPPORTED)
+}
+
+func (e *Emulator) SetProperty(h uintptr, property string, value interface{}, flags uint32) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	function := fmt.Sprintf("NCryptSetProperty \"%v\"", property)
+	kh, err := e.keyHandle(function, h)
+	if err != nil {
+		return err
+	}
+	k := kh.key
+
+	switch property {
+	case NCRYPT_LENGTH_PROPERTY:
+		length, ok := value.(uint32)
+		if !ok {
+			return emulatorError(function, NTE_INVALID_PARAMETER)
+		}
+		if k.finalized || k.algorithm != ALG_RSA {
+			return emulatorError(function, NTE_BAD_KEY_STATE)
+		}
+		if lengths := k.provider.rsaLengths; length < lengths[0] || length > lengths[1] {
+			return emulatorError(function, NTE_NOT_SUPPORTED)
+		}
+		k.length = int(length)
+	case NCRYPT_PCP_USAGE_AUTH_PROPERTY:
+		digest, ok := value.([]byte)
+		if !ok {
+			return emulatorError(function, NTE_INVALID_PARAMETER)
+		}
+		if k.finalized {
+			return emulatorError(function, NTE_BAD_KEY_STATE)
+		}
+		k.pinDigest = append([]byte(nil), digest...)
+	case NCRYPT_PCP_CHANGEPASSWORD_PROPERTY:
+		digest, ok := value.([]byte)
+		if !ok {
+			return emulatorError(function, NTE_INVALID_PARAMETER)
+		}
+		if k.provider.name != ProviderMSPlatform || !k.finalized {
+			return emulatorError(function, NTE_NOT_SUPPORTED)
+		}
+		if k.pinDigest != nil && !bytes.Equal(kh.pin, k.pinDigest) {
+			kh.pin = nil
+			return emulatorError(function, SCARD_W_WRONG_CHV)
+		}
+		k.pinDigest = append([]byte(nil), digest...)
+		kh.pin = k.pinDigest
+	case NCRYPT_PIN_PROPERTY:
+		pin, ok := value.(string)
+		if !ok {
+			return emulatorError(function, NTE_INVALID_PARAMETER)
+		}
+		if pin == "" {
+			kh.pin = nil
+		} else {
+			kh.pin = UsageAuthDigest(pin)
+		}
+	case NCRYPT_WINDOW_HANDLE_PROPERTY:
+		hwnd, ok := value.(uintptr)
+		if !ok {
+			return emulatorError(function, NTE_INVALID_PARAMETER)
+		}
+		kh.hwnd = hwnd
+	case NCRYPT_EXPORT_POLICY_PROPERTY:
+		policy, ok := value.(uint32)
+		if !ok {
+			return emulatorError(function, NTE_INVALID_PARAMETER)
+		}
+		if k.finalized {
+			return emulatorError(function, NTE_BAD_KEY_STATE)
+		}
+		k.exportPolicy = policy
+	default:
+		return emulatorError(function, NTE_NOT_SUPPORTED)
+	}
+	return nil
+}
+
+func (e *Emulator) ExportKey(keyHandle uintptr, blobType string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	kh, err := e.keyHandle("NCryptExportKey", keyHandle)
+	if err != nil {
+		return nil, err
+	}
+	if !kh.key.finalized {
+		return nil, emulatorError("NCryptExportKey", NTE_BAD_KEY_STATE)
+	}
+
+	switch blobType {
+	case BCRYPT_RSAFULLPRIVATE_BLOB, BCRYPT_ECCPRIVATE_BLOB:
+		// keys of a TPM or smart card never leave it
+		k := kh.key
+		if k.exportPolicy&NCRYPT_ALLOW_PLAINTEXT_EXPORT_FLAG == 0 || k.provider.name == ProviderMSPlatform || k.card != nil {
+			return nil, emulatorError("NCryptExportKey", NTE_PERM)
+		}
+	}
+
+	switch priv := kh.key.signer.(type) {
+	case *rsa.PrivateKey:
+		switch blobType {
+		case BCRYPT_RSAPUBLIC_BLOB:
+			return MarshalRSAPublicBlob(&priv.PublicKey), nil
+		case BCRYPT_RSAFULLPRIVATE_BLOB:
+			return MarshalRSAFullPrivateBlob(priv)
+		}
+	case *ecdsa.PrivateKey:
+		switch blobType {
+		case BCRYPT_ECCPUBLIC_BLOB:
+			return MarshalECCPublicBlob(&priv.PublicKey)
+		case BCRYPT_ECCPRIVATE_BLOB:
+			return MarshalECCPrivateBlob(priv)
+		}
+	}
+	return nil, emulatorError("NCryptExportKey", NTE_NOT_SUPPORTED)
+}
+
+// ImportKey stores the key of a private blob in a provider. Keys for the smart card provider go on the card in the
+// reader of a \\.\<reader>\<container> name, or the card of AddKey, and take the PIN of the card's other keys.
+// Imported keys are exportable until their NCRYPT_EXPORT_POLICY_PROPERTY is set before FinalizeKey.
+func (e *Emulator) ImportKey(provider uintptr, containerName string, blobType string, blob []byte, flags uint32) (uintptr, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.missing("NCryptImportKey"); err != nil {
+		return 0, err
+	}
+
+	p, err := e.providerHandle("NCryptImportKey", provider)
+	if err != nil {
+		return 0, err
+	}
+	if containerName == "" {
+		return 0, emulatorError("NCryptImportKey", NTE_INVALID_PARAMETER)
+	}
+
+	k := &emulatedKey{
+		provider:     p,
+		container:    containerName,
+		imported:     true,
+		exportPolicy: NCRYPT_ALLOW_EXPORT_FLAG | NCRYPT_ALLOW_PLAINTEXT_EXPORT_FLAG,
+		machine:      flags&NCRYPT_MACHINE_KEY_FLAG != 0,
+	}
+	if err = e.checkMachineKey("NCryptImportKey", k); err != nil {
+		return 0, err
+	}
+	switch blobType {
+	case BCRYPT_RSAFULLPRIVATE_BLOB:
+		priv, err := UnmarshalRSAFullPrivateBlob(blob)
+		if err != nil {
+			return 0, fmt.Errorf("NCryptImportKey: %w", err)
+		}
+		k.signer, k.algorithm, k.length = priv, ALG_RSA, priv.N.BitLen()
+		if lengths := p.rsaLengths; k.length < int(lengths[0]) || k.length > int(lengths[1]) {
+			return 0, emulatorError("NCryptImportKey", NTE_NOT_SUPPORTED)
+		}
+	case BCRYPT_ECCPRIVATE_BLOB:
+		priv, err := UnmarshalECCPrivateBlob(blob)
+		if err != nil {
+			return 0, fmt.Errorf("NCryptImportKey: %w", err)
+		}
+		k.signer, k.length = priv, priv.Curve.Params().BitSize
+		for name, curve := range CurveNames {
+			if curve == priv.Curve && strings.HasPrefix(name, "ECDSA_") {
+				k.algorithm = name
+			}
+		}
+	default:
+		return 0, emulatorError("NCryptImportKey", NTE_NOT_SUPPORTED)
+	}
+	if p.noCreate || !p.supports(k.algorithm) {
+		return 0, emulatorError("NCryptImportKey", NTE_NOT_SUPPORTED)
+	}
+
+	if strings.EqualFold(p.name, ProviderMSSC) {
+		reader, container := emulatedReader, containerName
+		if qualified := strings.TrimPrefix(containerName, `\\.\`); qualified != containerName {
+			var ok bool
+			if reader, container, ok = strings.Cut(qualified, `\`); !ok {
+				return 0, emulatorError("NCryptImportKey", NTE_INVALID_PARAMETER)
+			}
+		}
+		k.container, k.reader, k.card = container, reader, nil
+		for _, other := range p.keys {
+			if strings.EqualFold(other.reader, reader) {
+				k.card, k.pinDigest = other.card, other.pinDigest
+				break
+			}
+		}
+		if k.card == nil {
+			if !strings.EqualFold(reader, emulatedReader) {
+				return 0, emulatorError("NCryptImportKey", SCARD_W_REMOVED_CARD)
+			}
+			k.card = emulatedCard
+		}
+	}
+	if _, exists := p.keys[k.id()]; exists {
+		return 0, emulatorError("NCryptImportKey", NTE_EXISTS)
+	}
+
+	if flags&NCRYPT_DO_NOT_FINALIZE_FLAG == 0 {
+		k.finalized = true
+		p.keys[k.id()] = k
+	}
+	return e.newHandle(&emulatedKeyHandle{key: k, silent: flags&NCRYPT_SILENT_FLAG != 0}), nil
+}
+
+func (e *Emulator) CreateClaim(subjectKey uintptr, authorityKey uintptr, claimType uint32, nonce []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.missing("NCryptCreateClaim"); err != nil {
+		return nil, err
+	}
+
+	subject, err := e.keyHandle("NCryptCreateClaim", subjectKey)
+	if err != nil {
+		return nil, err
+	}
+	authority, err := e.keyHandle("NCryptCreateClaim", authorityKey)
+	if err != nil {
+		return nil, err
+	}
+	if claimType != NCRYPT_CLAIM_AUTHORITY_AND_SUBJECT || subject.key.provider.name != ProviderMSPlatform ||
+		authority.key.provider.name != ProviderMSPlatform {
+		return nil, emulatorError("NCryptCreateClaim", NTE_NOT_SUPPORTED)
+	}
+	if !subject.key.finalized || !authority.key.finalized {
+		return nil, emulatorError("NCryptCreateClaim", NTE_BAD_KEY_STATE)
+	}
+
+	// a key imported with TPM2_Import was not generated in the TPM and can be duplicated
+	attributes := attest.TPMA_NON_EXPORTABLE | attest.TPMA_USER_WITH_AUTH | attest.TPMA_SIGN_ENCRYPT
+	if subject.key.imported {
+		attributes = attest.TPMA_USER_WITH_AUTH | attest.TPMA_SIGN_ENCRYPT
+	}
+	blob, err := attest.CertifyKey(authority.key.signer, subject.key.signer.Public(), attributes, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("NCryptCreateClaim: %w", err)
+	}
+	return blob, nil
+}
+
+func (e *Emulator) SignHash(keyHandle uintptr, digest []byte, hashID string) ([]byte, error) {
+	e.mu.Lock()
+	kh, err := e.keyHandle("NCryptSignHash", keyHandle)
+	if err != nil {
+		e.mu.Unlock()
+		return nil, err
+	}
+	k := kh.key
+	if !k.finalized {
+		e.mu.Unlock()
+		return nil, emulatorError("NCryptSignHash", NTE_BAD_KEY_STATE)
+	}
+	if !k.present() {
+		e.mu.Unlock()
+		return nil, emulatorError("NCryptSignHash", SCARD_W_REMOVED_CARD)
+	}
+
+	if k.pinDigest != nil && !bytes.Equal(kh.pin, k.pinDigest) {
+		if kh.pin != nil {
+			kh.pin = nil
+			e.mu.Unlock()
+			return nil, emulatorError("NCryptSignHash", SCARD_W_WRONG_CHV)
+		}
+		if kh.silent || e.PINPrompt == nil {
+			e.mu.Unlock()
+			return nil, emulatorError("NCryptSignHash", NTE_SILENT_CONTEXT)
+		}
+		k.prompts++
+		prompt := e.PINPrompt
+		e.mu.Unlock()
+
+		// the dialog is shown without holding the lock, like the real one it may take a while
+		pin, ok := prompt(k.provider.name, k.container)
+
+		e.mu.Lock()
+		if !ok {
+			e.mu.Unlock()
+			return nil, emulatorError("NCryptSignHash", SCARD_W_CANCELLED_BY_USER)
+		}
+		if !bytes.Equal(UsageAuthDigest(pin), k.pinDigest) {
+			e.mu.Unlock()
+			return nil, emulatorError("NCryptSignHash", SCARD_W_WRONG_CHV)
+		}
+		kh.pin = k.pinDigest
+	}
+	signer := k.signer
+	e.mu.Unlock()
+
+	switch priv := signer.(type) {
+	case *rsa.PrivateKey:
+		if hashID == "" {
+			return nil, emulatorError("NCryptSignHash", NTE_INVALID_PARAMETER)
+		}
+		for hash, id := range HashAlgorithms {
+			if id == hashID {
+				return rsa.SignPKCS1v15(rand.Reader, priv, hash, digest)
+			}
+		}
+		return nil, emulatorError("NCryptSignHash", NTE_NOT_SUPPORTED)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return nil, fmt.Errorf("NCryptSignHash failed: %w", err)
+		}
+		// CNG returns r and s each padded to the size of the curve
+		size := (priv.Curve.Params().BitSize + 7) / 8
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+	}
+	return nil, emulatorError("NCryptSignHash", NTE_NOT_SUPPORTED)
+}
+
+func (e *Emulator) EnumKeys(provider uintptr, scope string, flags uint32) ([]NCryptKeyDescriptor, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	p, err := e.providerHandle("NCryptEnumKeys", provider)
+	if err != nil {
+		return nil, err
+	}
+
+	// a scope lists the card in one reader
+	reader := strings.TrimSuffix(strings.TrimPrefix(scope, `\\.\`), `\`)
+
+	var ret []NCryptKeyDescriptor
+	for _, k := range p.keys {
+		if (scope != "" && !strings.EqualFold(k.reader, reader)) || k.machine != (flags&NCRYPT_MACHINE_KEY_FLAG != 0) {
+			continue
+		}
+		if k.finalized && k.present() {
+			ret = append(ret, NCryptKeyDescriptor{Container: k.container, Algorithm: k.algorithm})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Container < ret[j].Container
+	})
+	return ret, nil
+}
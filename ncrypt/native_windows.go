@@ -0,0 +1,74 @@
+package ncrypt
+
+// Native is the API of ncrypt.dll
+var Native API = nativeAPI{}
+
+type nativeAPI struct{}
+
+func (nativeAPI) OpenStorageProvider(provider string) (uintptr, error) {
+	return NCryptOpenStorageProvider(provider)
+}
+
+func (nativeAPI) EnumStorageProviders() ([]string, error) {
+	return NCryptEnumStorageProviders()
+}
+
+func (nativeAPI) IsAlgSupported(provider uintptr, algorithm string) (bool, error) {
+	return NCryptIsAlgSupported(provider, algorithm)
+}
+
+func (nativeAPI) FreeObject(h uintptr) error {
+	return NCryptFreeObject(h)
+}
+
+func (nativeAPI) CreatePersistedKey(provider uintptr, containerName string, algorithmName string, legacyKeySpec uint32, flags uint32) (uintptr, error) {
+	return NCryptCreatePersistedKey(provider, containerName, algorithmName, legacyKeySpec, flags)
+}
+
+func (nativeAPI) FinalizeKey(keyHandle uintptr, flags uint32) error {
+	return NCryptFinalizeKey(keyHandle, flags)
+}
+
+func (nativeAPI) OpenKey(provider uintptr, containerName string, legacyKeySpec uint32, flags uint32) (uintptr, error) {
+	return NCryptOpenKey(provider, containerName, legacyKeySpec, flags)
+}
+
+func (nativeAPI) DeleteKey(keyHandle uintptr, flags uint32) error {
+	return NCryptDeleteKey(keyHandle, flags)
+}
+
+func (nativeAPI) GetPropertyStr(h uintptr, property string) (string, error) {
+	return NCryptGetPropertyStr(h, property)
+}
+
+func (nativeAPI) GetPropertyInt(h uintptr, property string) (int, error) {
+	return NCryptGetPropertyInt(h, property)
+}
+
+func (nativeAPI) GetPropertyBytes(h uintptr, property string) ([]byte, error) {
+	return NCryptGetPropertyBytes(h, property)
+}
+
+func (nativeAPI) SetProperty(h uintptr, property string, value interface{}, flags uint32) error {
+	return NCryptSetProperty(h, property, value, flags)
+}
+
+func (nativeAPI) ExportKey(keyHandle uintptr, blobType string) ([]byte, error) {
+	return NCryptExportKey(keyHandle, blobType)
+}
+
+func (nativeAPI) ImportKey(provider uintptr, containerName string, blobType string, blob []byte, flags uint32) (uintptr, error) {
+	return NCryptImportKey(provider, containerName, blobType, blob, flags)
+}
+
+func (nativeAPI) SignHash(keyHandle uintptr, digest []byte, hashID string) ([]byte, error) {
+	return NCryptSignHash(keyHandle, digest, hashID)
+}
+
+func (nativeAPI) CreateClaim(subjectKey uintptr, authorityKey uintptr, claimType uint32, nonce []byte) ([]byte, error) {
+	return NCryptCreateClaim(subjectKey, authorityKey, claimType, nonce)
+}
+
+func (nativeAPI) EnumKeys(provider uintptr, scope string, flags uint32) ([]NCryptKeyDescriptor, error) {
+	return enumKeys(provider, scope, flags)
+}
@@ -2,8 +2,6 @@ package ncrypt
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/elliptic"
 	"encoding/binary"
 	"fmt"
 	"golang.org/x/sys/windows"
@@ -11,123 +9,7 @@ import (
 	"unsafe"
 )
 
-const (
-
-	// Key storage properties
-	NCRYPT_ALGORITHM_GROUP_PROPERTY = "Algorithm Group"
-	NCRYPT_LENGTH_PROPERTY          = "Length"
-	NCRYPT_KEY_TYPE_PROPERTY        = "Key Type"
-	NCRYPT_UNIQUE_NAME_PROPERTY     = "Unique Name"
-	NCRYPT_ECC_CURVE_NAME_PROPERTY  = "ECCCurveName"
-	NCRYPT_IMPL_TYPE_PROPERTY       = "Impl Type"
-	NCRYPT_PROV_HANDLE              = "Provider Handle"
-	NCRYPT_PIN_PROPERTY             = "SmartCardPin"
-	NCRYPT_SECURE_PIN_PROPERTY      = "SmartCardSecurePin"
-	NCRYPT_READER_PROPERTY          = "SmartCardReader"
-	NCRYPT_ALGORITHM_PROPERTY       = "Algorithm Name"
-	NCRYPT_WINDOW_HANDLE_PROPERTY   = "HWND Handle"
-	NCRYPT_PCP_USAGE_AUTH_PROPERTY  = "PCP_USAGEAUTH"
-	// Key Storage Flags
-	NCRYPT_MACHINE_KEY_FLAG = 0x00000001
-	NCRYPT_SILENT_FLAG      = 0x40
-
-	// Errors
-	NTE_NOT_SUPPORTED         = uint32(0x80090029)
-	NTE_NO_MEMORY             = uint32(0x8009000E)
-	NTE_INVALID_PARAMETER     = uint32(0x80090027)
-	NTE_INVALID_HANDLE        = uint32(0x80090026)
-	NTE_BAD_FLAGS             = uint32(0x80090009)
-	NTE_NO_MORE_ITEMS         = uint32(0x8009002A)
-	NTE_BAD_KEYSET            = uint32(0x80090016)
-	SCARD_W_CANCELLED_BY_USER = uint32(0x8010006E)
-
-	// wincrypt.h constants
-	acquireCached           = 0x1                                             // CRYPT_ACQUIRE_CACHE_FLAG
-	acquireSilent           = 0x40                                            // CRYPT_ACQUIRE_SILENT_FLAG
-	encodingX509ASN         = 1                                               // X509_ASN_ENCODING
-	encodingPKCS7           = 65536                                           // PKCS_7_ASN_ENCODING
-	certStoreProvSystem     = 10                                              // CERT_STORE_PROV_SYSTEM
-	certStoreOpenExisting   = 0x00004000                                      // CERT_STORE_OPEN_EXISTING_FLAG
-	certStoreCurrentUser    = uint32(certStoreCurrentUserID << compareShift)  // CERT_SYSTEM_STORE_CURRENT_USER
-	certStoreLocalMachine   = uint32(certStoreLocalMachineID << compareShift) // CERT_SYSTEM_STORE_LOCAL_MACHINE
-	certStoreCurrentUserID  = 1                                               // CERT_SYSTEM_STORE_CURRENT_USER_ID
-	certStoreLocalMachineID = 2                                               // CERT_SYSTEM_STORE_LOCAL_MACHINE_ID
-	infoIssuerFlag          = 4                                               // CERT_INFO_ISSUER_FLAG
-	compareNameStrW         = 8                                               // CERT_COMPARE_NAME_STR_A
-	compareShift            = 16                                              // CERT_COMPARE_SHIFT
-	compareSHA1Hash         = 1                                               // CERT_COMPARE_SHA1_HASH
-	compareCertID           = 16                                              // CERT_COMPARE_CERT_ID
-	findIssuerStr           = compareNameStrW<<compareShift | infoIssuerFlag  // CERT_FIND_ISSUER_STR_W
-	findHash                = compareSHA1Hash << compareShift                 // CERT_FIND_HASH
-	findCertID              = compareCertID << compareShift                   // CERT_FIND_CERT_ID
-
-	signatureKeyUsage = 0x80       // CERT_DIGITAL_SIGNATURE_KEY_USAGE
-	ncryptKeySpec     = 0xFFFFFFFF // CERT_NCRYPT_KEY_SPEC
-
-	BCRYPT_RSAPUBLIC_BLOB = "RSAPUBLICBLOB"
-	BCRYPT_ECCPUBLIC_BLOB = "ECCPUBLICBLOB"
-
-	// winerror.h constants
-	CRYPT_E_NOT_FOUND                    = uint32(0x80092004)
-	CRYPT_ACQUIRE_ALLOW_NCRYPT_KEY_FLAG  = uint32(0x00010000)
-	CRYPT_ACQUIRE_PREFER_NCRYPT_KEY_FLAG = uint32(0x00020000)
-	CRYPT_ACQUIRE_ONLY_NCRYPT_KEY_FLAG   = uint32(0x00040000)
-
-	CERT_ID_ISSUER_SERIAL_NUMBER = uint32(1)
-	CERT_ID_KEY_IDENTIFIER       = uint32(2)
-	CERT_ID_SHA1_HASH            = uint32(3)
-
-	CERT_NAME_STR_COMMA_FLAG = uint32(0x04000000)
-	CERT_SIMPLE_NAME_STR     = uint32(1)
-	CERT_X500_NAME_STR       = uint32(3)
-
-	AT_KEYEXCHANGE = uint32(1)
-	AT_SIGNATURE   = uint32(2)
-
-	// Legacy CryptoAPI flags
-	bCryptPadPKCS1 = uint32(2)
-
-	// Magic numbers for public key blobs.
-	RSA1Magic = 0x31415352 // "RSA1" BCRYPT_RSAPUBLIC_MAGIC
-	ECS1Magic = 0x31534345 // "ECS1" BCRYPT_ECDSA_PUBLIC_P256_MAGIC
-	ECS3Magic = 0x33534345 // "ECS3" BCRYPT_ECDSA_PUBLIC_P384_MAGIC
-	ECS5Magic = 0x35534345 // "ECS5" BCRYPT_ECDSA_PUBLIC_P521_MAGIC
-
-	ProviderMSSC       = "Microsoft Smart Card Key Storage Provider"
-	ProviderMSPlatform = "Microsoft Platform Crypto Provider"
-
-	ALG_RSA        = "RSA"
-	ALG_ECDSA_P256 = "ECDSA_P256"
-	ALG_ECDSA_P384 = "ECDSA_P384"
-	ALG_ECDSA_P521 = "ECDSA_P521"
-)
-
 var (
-	CurveNames = map[string]elliptic.Curve{
-		ALG_ECDSA_P256: elliptic.P256(),
-		ALG_ECDSA_P384: elliptic.P384(),
-		ALG_ECDSA_P521: elliptic.P521(),
-		"nistP256":     elliptic.P256(), // BCRYPT_ECC_CURVE_NISTP256
-		"nistP384":     elliptic.P384(), // BCRYPT_ECC_CURVE_NISTP384
-		"nistP521":     elliptic.P521(), // BCRYPT_ECC_CURVE_NISTP521
-	}
-
-	CurveMagicMap = map[string]uint32{
-		"P-256": ECS1Magic,
-		"P-384": ECS3Magic,
-		"P-521": ECS5Magic,
-	}
-
-	// algIDs maps crypto.Hash values to bcrypt.h constants.
-	HashAlgorithms = map[crypto.Hash]string{
-		crypto.SHA1:   "SHA1",   // BCRYPT_SHA1_ALGORITHM
-		crypto.SHA256: "SHA256", // BCRYPT_SHA256_ALGORITHM
-		crypto.SHA384: "SHA384", // BCRYPT_SHA384_ALGORITHM
-		crypto.SHA512: "SHA512", // BCRYPT_SHA512_ALGORITHM
-	}
-
-	AVAILABLE_ALGORITHMS = []string{ALG_ECDSA_P256, ALG_ECDSA_P384, ALG_ECDSA_P521, ALG_RSA}
-
 	crypt32 = windows.MustLoadDLL("crypt32.dll")
 	nCrypt  = windows.MustLoadDLL("ncrypt.dll")
 
@@ -146,8 +28,24 @@ var (
 	procNCryptGetProperty               = nCrypt.MustFindProc("NCryptGetProperty")
 	procNCryptSetProperty               = nCrypt.MustFindProc("NCryptSetProperty")
 	procNCryptSignHash                  = nCrypt.MustFindProc("NCryptSignHash")
+
+	// procs that older versions of Windows lack are found on first use, see findProc. NCryptCreateClaim needs
+	// Windows 10.
+	nCryptLazy                     = windows.NewLazySystemDLL("ncrypt.dll")
+	procNCryptCreateClaim          = nCryptLazy.NewProc("NCryptCreateClaim")
+	procNCryptEnumStorageProviders = nCryptLazy.NewProc("NCryptEnumStorageProviders")
+	procNCryptImportKey            = nCryptLazy.NewProc("NCryptImportKey")
+	procNCryptIsAlgSupported       = nCryptLazy.NewProc("NCryptIsAlgSupported")
 )
 
+// findProc returns ErrNotSupported when ncrypt.dll of this version of Windows lacks proc
+func findProc(proc *windows.LazyProc) error {
+	if err := proc.Find(); err != nil {
+		return fmt.Errorf("%s: %w", proc.Name, ErrNotSupported)
+	}
+	return nil
+}
+
 type BCRYPT_PKCS1_PADDING_INFO struct {
 	pszAlgID *uint16
 }
@@ -183,23 +81,22 @@ type NCryptKeyName struct {
 	Flags         uint32
 }
 
-func errNoToStr(e uint32) string {
-	switch e {
-	case NTE_INVALID_PARAMETER:
-		return "NTE_INVALID_PARAMETER"
-	case NTE_BAD_FLAGS:
-		return "NTE_BAD_FLAGS"
-	case NTE_BAD_KEYSET:
-		return "NTE_BAD_KEYSET"
-	case NTE_NO_MORE_ITEMS:
-		return "NTE_NO_MORE_ITEMS"
-	case NTE_NOT_SUPPORTED:
-		return "NTE_NOT_SUPPORTED"
-	case SCARD_W_CANCELLED_BY_USER:
-		return "User cancelled smartcard action"
-	default:
-		return fmt.Sprintf("0x%X", e)
-	}
+type NCryptProviderName struct {
+	Name    *uint16
+	Comment *uint16
+}
+
+// NCryptBuffer and NCryptBufferDesc -- https://learn.microsoft.com/en-us/windows/win32/api/bcrypt/ns-bcrypt-bcryptbufferdesc
+type NCryptBuffer struct {
+	cbBuffer   uint32
+	BufferType uint32
+	pvBuffer   uintptr
+}
+
+type NCryptBufferDesc struct {
+	ulVersion uint32
+	cBuffers  uint32
+	pBuffers  uintptr
 }
 
 // wide returns a pointer to a uint16 representing the equivalent
@@ -222,6 +119,47 @@ func NCryptOpenStorageProvider(provider string) (uintptr, error) {
 	return hProv, fmt.Errorf("NCryptOpenStorageProvider returned %v: %v", errNoToStr(uint32(r)), err)
 }
 
+// NCryptEnumStorageProviders returns the names of the installed key storage providers
+func NCryptEnumStorageProviders() ([]string, error) {
+	if err := findProc(procNCryptEnumStorageProviders); err != nil {
+		return nil, err
+	}
+	var count uint32
+	var list uintptr
+	r, _, err := procNCryptEnumStorageProviders.Call(
+		uintptr(unsafe.Pointer(&count)),
+		uintptr(unsafe.Pointer(&list)),
+		0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptEnumStorageProviders returned %v: %v", errNoToStr(uint32(r)), err)
+	}
+	defer NCryptFreeBuffer(list)
+
+	var names []string
+	for _, p := range unsafe.Slice((*NCryptProviderName)(unsafe.Pointer(list)), count) {
+		names = append(names, windows.UTF16PtrToString(p.Name))
+	}
+	return names, nil
+}
+
+// NCryptIsAlgSupported reports whether a provider supports an algorithm
+func NCryptIsAlgSupported(provider uintptr, algorithm string) (bool, error) {
+	if err := findProc(procNCryptIsAlgSupported); err != nil {
+		return false, err
+	}
+	r, _, err := procNCryptIsAlgSupported.Call(
+		provider,
+		uintptr(unsafe.Pointer(wide(algorithm))),
+		0)
+	switch uint32(r) {
+	case 0:
+		return true, nil
+	case NTE_NOT_SUPPORTED:
+		return false, nil
+	}
+	return false, fmt.Errorf("NCryptIsAlgSupported returned %v: %v", errNoToStr(uint32(r)), err)
+}
+
 func NCryptFreeObject(h uintptr) error {
 	r, _, err := procNCryptFreeObject.Call(h)
 	if r == 0 {
@@ -412,6 +350,54 @@ func NCryptSignHash(kh uintptr, digest []byte, hashID string) ([]byte, error) {
 	return buf[:size], nil
 }
 
+// NCryptCreateClaim returns a claim about the subject key made by the authority key, the nonce is passed as
+// NCRYPTBUFFER_CLAIM_KEYATTESTATION_NONCE when given
+func NCryptCreateClaim(subjectKey uintptr, authorityKey uintptr, claimType uint32, nonce []byte) ([]byte, error) {
+	if err := findProc(procNCryptCreateClaim); err != nil {
+		return nil, err
+	}
+	var params uintptr
+	if len(nonce) > 0 {
+		buffer := NCryptBuffer{
+			cbBuffer:   uint32(len(nonce)),
+			BufferType: NCRYPTBUFFER_CLAIM_KEYATTESTATION_NONCE,
+			pvBuffer:   uintptr(unsafe.Pointer(&nonce[0])),
+		}
+		desc := NCryptBufferDesc{ulVersion: 0, cBuffers: 1, pBuffers: uintptr(unsafe.Pointer(&buffer))}
+		params = uintptr(unsafe.Pointer(&desc))
+	}
+
+	var size uint32
+	r, _, err := procNCryptCreateClaim.Call(
+		subjectKey,
+		authorityKey,
+		uintptr(claimType),
+		params,
+		0,
+		0,
+		uintptr(unsafe.Pointer(&size)),
+		0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptCreateClaim returned %v during size check: %v", errNoToStr(uint32(r)), err)
+	}
+
+	buf := make([]byte, size)
+	r, _, err = procNCryptCreateClaim.Call(
+		subjectKey,
+		authorityKey,
+		uintptr(claimType),
+		params,
+		uintptr(unsafe.Pointer(&buf[0])),
+		uintptr(size),
+		uintptr(unsafe.Pointer(&size)),
+		0)
+	if r != 0 {
+		return nil, fmt.Errorf("NCryptCreateClaim returned %v: %v", errNoToStr(uint32(r)), err)
+	}
+
+	return buf[:size], nil
+}
+
 func getProperty(kh uintptr, property *uint16) ([]byte, error) {
 	var strSize uint32
 	r, _, err := procNCryptGetProperty.Call(
@@ -476,6 +462,10 @@ func NCryptGetPropertyStr(kh uintptr, property string) (string, error) {
 	return string(uc), nil
 }
 
+func NCryptGetPropertyBytes(kh uintptr, property string) ([]byte, error) {
+	return getProperty(kh, wide(property))
+}
+
 func NCryptEnumKeys(provider uintptr, scope string, enumState uintptr, flags uint32) (*NCryptKeyName, uintptr, error) {
 	scopePtr := uintptr(0)
 	keyName := uintptr(0)
@@ -547,6 +537,42 @@ func NCryptExportKey(kh uintptr, blobType string) ([]byte, error) {
 	return buf, nil
 }
 
+// NCryptImportKey imports a private key blob as the persisted key containerName, which is passed as
+// NCRYPTBUFFER_PKCS_KEY_NAME
+func NCryptImportKey(provider uintptr, containerName string, blobType string, blob []byte, flags uint32) (uintptr, error) {
+	if err := findProc(procNCryptImportKey); err != nil {
+		return 0, err
+	}
+	if len(blob) == 0 {
+		return 0, fmt.Errorf("NCryptImportKey: empty key blob")
+	}
+	name, err := windows.UTF16FromString(containerName)
+	if err != nil {
+		return 0, err
+	}
+	buffer := NCryptBuffer{
+		cbBuffer:   uint32(len(name) * 2),
+		BufferType: NCRYPTBUFFER_PKCS_KEY_NAME,
+		pvBuffer:   uintptr(unsafe.Pointer(&name[0])),
+	}
+	desc := NCryptBufferDesc{ulVersion: 0, cBuffers: 1, pBuffers: uintptr(unsafe.Pointer(&buffer))}
+
+	var kh uintptr
+	r, _, err := procNCryptImportKey.Call(
+		provider,
+		0,
+		uintptr(unsafe.Pointer(wide(blobType))),
+		uintptr(unsafe.Pointer(&desc)),
+		uintptr(unsafe.Pointer(&kh)),
+		uintptr(unsafe.Pointer(&blob[0])),
+		uintptr(len(blob)),
+		uintptr(flags))
+	if r != 0 {
+		return 0, fmt.Errorf("NCryptImportKey returned %v: %v", errNoToStr(uint32(r)), err)
+	}
+	return kh, nil
+}
+
 func FindCertificateInStore(store windows.Handle, enc, findFlags, findType uint32, para uintptr, prev *windows.CertContext) (*windows.CertContext, error) {
 	h, _, err := procCertFindCertificateInStore.Call(
 		uintptr(store),
@@ -618,12 +644,9 @@ func CertStrToName(x500Str string) ([]byte, error) {
 	return buf, nil
 }
 
-type NCryptKeyDescriptor struct {
-	Container string
-	Algorithm string
-}
-
-func ListKeysOnProvider(providerName string, cardReader string) ([]NCryptKeyDescriptor, error) {
+// ListKeysOnProvider lists the keys of a provider, on the card in cardReader for the smart card provider. flags
+// NCRYPT_MACHINE_KEY_FLAG lists the machine keys.
+func ListKeysOnProvider(providerName string, cardReader string, flags uint32) ([]NCryptKeyDescriptor, error) {
 	var err error
 
 	var scope string
@@ -638,12 +661,18 @@ func ListKeysOnProvider(providerName string, cardReader string) ([]NCryptKeyDesc
 
 	defer NCryptFreeObject(prov)
 
+	return enumKeys(prov, scope, flags)
+}
+
+func enumKeys(prov uintptr, scope string, flags uint32) ([]NCryptKeyDescriptor, error) {
+	var err error
+
 	var ret []NCryptKeyDescriptor
 	enumState := uintptr(0)
 	iterating := true
 	for iterating {
 		var key *NCryptKeyName
-		key, enumState, err = NCryptEnumKeys(prov, scope, enumState, 0)
+		key, enumState, err = NCryptEnumKeys(prov, scope, enumState, flags)
 
 		if errno, ok := err.(windows.Errno); ok && uint32(errno) == 0 {
 			return nil, nil
@@ -0,0 +1,383 @@
+package openpgp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"ncryptagent/scard"
+	"sync"
+)
+
+// Emulator is an OpenPGP applet in memory that answers APDUs like the OpenPGP applet of a YubiKey: a wrong PW1 is
+// rejected with 6982 and PW1 is good for one signature with the signature key. Responses longer than a short APDU are
+// returned in parts for GET RESPONSE and long commands are accepted with command chaining, so the emulator covers
+// the same encoding paths as a card.
+type Emulator struct {
+	mu         sync.Mutex
+	aid        []byte
+	pin        []byte
+	retries    int
+	maxRetries int
+	// resetCode unblocks PW1, it is not set until SetResetCode
+	resetCode        []byte
+	resetCodeRetries int
+	// verified are the PW1 references verified since the applet was selected
+	verified map[byte]bool
+	selected bool
+	keys     map[Key]*emulatedKey
+	pending  []byte
+	chained  []byte
+
+	// Signatures counts the PSO: COMPUTE DIGITAL SIGNATURE and INTERNAL AUTHENTICATE commands that signed
+	Signatures int
+}
+
+type emulatedKey struct {
+	attrs       Attributes
+	signer      crypto.Signer
+	fingerprint []byte
+}
+
+// NewEmulator returns an emulated card with a serial number and PW1 and no keys
+func NewEmulator(serial uint32, pin string) *Emulator {
+	aid := append(append([]byte{}, AID...), 0x03, 0x04, 0xFF, 0xFF, 0, 0, 0, 0, 0x00, 0x00)
+	binary.BigEndian.PutUint32(aid[10:14], serial)
+	return &Emulator{
+		aid:        aid,
+		pin:        []byte(pin),
+		retries:    3,
+		maxRetries: 3,
+		verified:   make(map[byte]bool),
+		keys:       make(map[Key]*emulatedKey),
+	}
+}
+
+// GenerateKey puts a new key on the card
+func (e *Emulator) GenerateKey(k Key, attrs Attributes) (crypto.PublicKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch {
+	case attrs.Algorithm == AlgRSA:
+		signer, err = rsa.GenerateKey(rand.Reader, attrs.RSABits)
+	case attrs.Algorithm == AlgECDSA && attrs.Curve == CurveP256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case attrs.Algorithm == AlgECDSA && attrs.Curve == CurveP384:
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case attrs.Algorithm == AlgEdDSA && attrs.Curve == CurveEd25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", attrs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the fingerprint of an OpenPGP key covers its creation time, which the emulator leaves out
+	der, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha1.Sum(der)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keys[k] = &emulatedKey{attrs: attrs, signer: signer, fingerprint: fingerprint[:]}
+	return signer.Public(), nil
+}
+
+// SetResetCode sets the reset code like gpg --card-edit passwd does with the admin PIN
+func (e *Emulator) SetResetCode(code string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.resetCode = []byte(code)
+	e.resetCodeRetries = e.maxRetries
+}
+
+// Reset has the card lose its state like after a reset by another application, PW1 has to be verified again
+func (e *Emulator) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.selected = false
+	e.verified = make(map[byte]bool)
+	e.pending = nil
+	e.chained = nil
+}
+
+// PINRetries returns the tries left for PW1
+func (e *Emulator) PINRetries() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.retries
+}
+
+func (e *Emulator) Transmit(apdu []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(apdu) < 4 {
+		return sw(nil, scard.SW_WRONG_LENGTH), nil
+	}
+	cla, ins, p1, p2 := apdu[0], apdu[1], apdu[2], apdu[3]
+	var data []byte
+	if len(apdu) > 5 {
+		n := int(apdu[4])
+		if len(apdu) < 5+n {
+			return sw(nil, scard.SW_WRONG_LENGTH), nil
+		}
+		data = apdu[5 : 5+n]
+	}
+
+	if ins == 0xC0 {
+		return e.respond(nil), nil
+	}
+	e.pending = nil
+
+	if cla&0x10 != 0 {
+		e.chained = append(e.chained, data...)
+		return sw(nil, scard.SW_OK), nil
+	}
+	if e.chained != nil {
+		data = append(e.chained, data...)
+		e.chained = nil
+	}
+
+	if ins == insSelect {
+		if p1 != 0x04 || !bytes.HasPrefix(data, AID) {
+			e.selected = false
+			return sw(nil, scard.SW_FILE_NOT_FOUND), nil
+		}
+		e.selected = true
+		e.verified = make(map[byte]bool)
+		return sw(nil, scard.SW_OK), nil
+	}
+	if !e.selected {
+		return sw(nil, scard.SW_INS_NOT_SUPPORTED), nil
+	}
+
+	switch ins {
+	case insGetData:
+		return e.getData(uint16(p1)<<8 | uint16(p2)), nil
+	case insGenerate:
+		if p1 != 0x81 {
+			return sw(nil, scard.SW_SECURITY_STATUS), nil
+		}
+		return e.readPublicKey(data), nil
+	case insVerify:
+		return e.verify(p1, p2, data), nil
+	case insChangePIN:
+		return e.changePIN(p2, data), nil
+	case insResetPIN:
+		if p1 != 0x00 {
+			return sw(nil, scard.SW_INCORRECT_P1P2), nil
+		}
+		return e.resetPIN(p2, data), nil
+	case insPSO:
+		if p1 != 0x9E || p2 != 0x9A {
+			return sw(nil, scard.SW_INCORRECT_P1P2), nil
+		}
+		return e.sign(KeySignature, data), nil
+	case insInternalAuth:
+		return e.sign(KeyAuthentication, data), nil
+	}
+	return sw(nil, scard.SW_INS_NOT_SUPPORTED), nil
+}
+
+// respond returns up to 256 bytes of data, leaving the rest for GET RESPONSE
+func (e *Emulator) respond(data []byte) []byte {
+	if data == nil {
+		data = e.pending
+	}
+	if len(data) <= 256 {
+		e.pending = nil
+		return sw(data, scard.SW_OK)
+	}
+	e.pending = data[256:]
+	remaining := len(e.pending)
+	if remaining > 255 {
+		remaining = 0
+	}
+	return sw(data[:256], 0x6100|uint16(remaining))
+}
+
+func sw(data []byte, sw uint16) []byte {
+	return append(append([]byte{}, data...), byte(sw>>8), byte(sw))
+}
+
+func (e *Emulator) pwStatus() []byte {
+	return []byte{0x00, 0x7F, 0x7F, 0x7F, byte(e.retries), byte(e.resetCodeRetries), 0x03}
+}
+
+func (e *Emulator) getData(tag uint16) []byte {
+	switch tag {
+	case doAID:
+		return e.respond(e.aid)
+	case doPWStatus:
+		return e.respond(e.pwStatus())
+	case doApplicationData:
+		var discretionary []byte
+		discretionary = scard.AppendTLV(discretionary, 0xC0, []byte{0x7D, 0x00, 0x0B, 0xFE, 0x08, 0x00, 0x00, 0xFF, 0x00, 0x00})
+		fingerprints := make([]byte, 60)
+		for _, k := range []Key{KeySignature, KeyDecryption, KeyAuthentication} {
+			attrs := Attributes{Algorithm: AlgRSA, RSABits: 2048}
+			if key, ok := e.keys[k]; ok {
+				attrs = key.attrs
+				copy(fingerprints[k.index()*20:], key.fingerprint)
+			}
+			discretionary = scard.AppendTLV(discretionary, k.attributesObject(), attrs.Bytes())
+		}
+		discretionary = scard.AppendTLV(discretionary, doPWStatus, e.pwStatus())
+		discretionary = scard.AppendTLV(discretionary, doFingerprints, fingerprints)
+		discretionary = scard.AppendTLV(discretionary, 0xC6, make([]byte, 60))
+		discretionary = scard.AppendTLV(discretionary, 0xCD, make([]byte, 12))
+
+		var data []byte
+		data = scard.AppendTLV(data, doAID, e.aid)
+		data = scard.AppendTLV(data, 0x5F52, []byte{0x00, 0x73, 0x00, 0x00, 0xE0, 0x05, 0x90, 0x00})
+		data = scard.AppendTLV(data, doDiscretionary, discretionary)
+		return e.respond(scard.AppendTLV(nil, doApplicationData, data))
+	case KeySignature.uifObject(), KeyDecryption.uifObject(), KeyAuthentication.uifObject():
+		return e.respond([]byte{0x00, 0x20})
+	}
+	return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+}
+
+func (e *Emulator) readPublicKey(crt []byte) []byte {
+	if len(crt) != 2 {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	key, ok := e.keys[Key(crt[0])]
+	if !ok {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+
+	var out []byte
+	switch p := key.signer.Public().(type) {
+	case *rsa.PublicKey:
+		out = scard.AppendTLV(out, 0x81, p.N.Bytes())
+		out = scard.AppendTLV(out, 0x82, big.NewInt(int64(p.E)).Bytes())
+	case *ecdsa.PublicKey:
+		out = scard.AppendTLV(out, 0x86, elliptic.Marshal(p.Curve, p.X, p.Y))
+	case ed25519.PublicKey:
+		out = scard.AppendTLV(out, 0x86, p)
+	}
+	return e.respond(scard.AppendTLV(nil, tagPublicKey, out))
+}
+
+func (e *Emulator) verify(p1 byte, reference byte, data []byte) []byte {
+	if reference != 0x81 && reference != 0x82 {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if p1 == 0xFF {
+		e.verified[reference] = false
+		return sw(nil, scard.SW_OK)
+	}
+	if len(data) == 0 {
+		if e.verified[reference] {
+			return sw(nil, scard.SW_OK)
+		}
+		return sw(nil, 0x63C0|uint16(e.retries))
+	}
+	if e.retries == 0 {
+		return sw(nil, scard.SW_AUTH_BLOCKED)
+	}
+
+	if !bytes.Equal(data, e.pin) {
+		e.retries--
+		e.verified[reference] = false
+		if e.retries == 0 {
+			return sw(nil, scard.SW_AUTH_BLOCKED)
+		}
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+	e.retries = e.maxRetries
+	e.verified[reference] = true
+	return sw(nil, scard.SW_OK)
+}
+
+// changePIN is CHANGE REFERENCE DATA for PW1, the data is the old PIN followed by the new one
+func (e *Emulator) changePIN(reference byte, data []byte) []byte {
+	if reference != 0x81 {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if e.retries == 0 {
+		return sw(nil, scard.SW_AUTH_BLOCKED)
+	}
+	if !bytes.HasPrefix(data, e.pin) || len(data)-len(e.pin) < minPINLength {
+		e.retries--
+		e.verified = make(map[byte]bool)
+		if e.retries == 0 {
+			return sw(nil, scard.SW_AUTH_BLOCKED)
+		}
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+	e.pin = append([]byte{}, data[len(e.pin):]...)
+	e.retries = e.maxRetries
+	return sw(nil, scard.SW_OK)
+}
+
+// resetPIN is RESET RETRY COUNTER with the reset code, the data is the reset code followed by the new PIN
+func (e *Emulator) resetPIN(reference byte, data []byte) []byte {
+	if reference != 0x81 {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if e.resetCodeRetries == 0 {
+		return sw(nil, scard.SW_AUTH_BLOCKED)
+	}
+	if !bytes.HasPrefix(data, e.resetCode) || len(data)-len(e.resetCode) < minPINLength {
+		e.resetCodeRetries--
+		if e.resetCodeRetries == 0 {
+			return sw(nil, scard.SW_AUTH_BLOCKED)
+		}
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+	e.pin = append([]byte{}, data[len(e.resetCode):]...)
+	e.retries = e.maxRetries
+	e.resetCodeRetries = e.maxRetries
+	e.verified = make(map[byte]bool)
+	return sw(nil, scard.SW_OK)
+}
+
+func (e *Emulator) sign(k Key, data []byte) []byte {
+	key, ok := e.keys[k]
+	if !ok {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if !e.verified[k.pinReference()] {
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+
+	var signature []byte
+	var err error
+	switch s := key.signer.(type) {
+	case *rsa.PrivateKey:
+		// data is a DigestInfo, which the card pads
+		signature, err = rsa.SignPKCS1v15(nil, s, 0, data)
+	case *ecdsa.PrivateKey:
+		var r, ss *big.Int
+		if r, ss, err = ecdsa.Sign(rand.Reader, s, data); err == nil {
+			size := (s.Curve.Params().BitSize + 7) / 8
+			signature = append(r.FillBytes(make([]byte, size)), ss.FillBytes(make([]byte, size))...)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(s, data)
+	}
+	if err != nil {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+
+	// PW1 is good for one signature with the signature key
+	if k == KeySignature {
+		e.verified[k.pinReference()] = false
+	}
+	e.Signatures++
+	return e.respond(signature)
+}
@@ -0,0 +1,591 @@
+// Package openpgp talks to the OpenPGP applet of smart cards, YubiKeys and Nitrokeys over APDUs, covering the
+// application data, public keys, PW1 verification and signing with the signature and authentication keys.
+package openpgp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"ncryptagent/scard"
+	"strings"
+)
+
+// AID is the application identifier of the OpenPGP applet, the card matches it as a prefix of its full AID which
+// adds the version, manufacturer and serial number
+var AID = []byte{0xD2, 0x76, 0x00, 0x01, 0x24, 0x01}
+
+const (
+	insVerify         = 0x20
+	insChangePIN      = 0x24
+	insResetPIN       = 0x2C
+	insPSO            = 0x2A
+	insGenerate       = 0x47
+	insInternalAuth   = 0x88
+	insSelect         = 0xA4
+	insGetData        = 0xCA
+	doAID             = 0x4F
+	doApplicationData = 0x6E
+	doDiscretionary   = 0x73
+	doPWStatus        = 0xC4
+	doFingerprints    = 0xC5
+	tagPublicKey      = 0x7F49
+	minPINLength      = 6
+)
+
+// Key is a key of the OpenPGP applet, by its control reference template
+type Key byte
+
+const (
+	KeySignature      Key = 0xB6
+	KeyDecryption     Key = 0xB8
+	KeyAuthentication Key = 0xA4
+)
+
+// SigningKeys are the keys that can sign, the signature key with PSO: COMPUTE DIGITAL SIGNATURE and the
+// authentication key with INTERNAL AUTHENTICATE
+var SigningKeys = []Key{KeyAuthentication, KeySignature}
+
+// ParseKey parses a key in the notation of String, like "aut"
+func ParseKey(s string) (Key, error) {
+	switch strings.ToLower(s) {
+	case "sig":
+		return KeySignature, nil
+	case "dec":
+		return KeyDecryption, nil
+	case "aut":
+		return KeyAuthentication, nil
+	}
+	return 0, fmt.Errorf("invalid OpenPGP key %q, expected sig, dec or aut", s)
+}
+
+func (k Key) String() string {
+	switch k {
+	case KeySignature:
+		return "sig"
+	case KeyDecryption:
+		return "dec"
+	case KeyAuthentication:
+		return "aut"
+	}
+	return fmt.Sprintf("key %02X", byte(k))
+}
+
+// Name is the key's name in the OpenPGP card specification
+func (k Key) Name() string {
+	switch k {
+	case KeySignature:
+		return "Signature key"
+	case KeyDecryption:
+		return "Decryption key"
+	case KeyAuthentication:
+		return "Authentication key"
+	}
+	return k.String()
+}
+
+// index is the position of the key in the lists of the application data, like the fingerprints
+func (k Key) index() int {
+	switch k {
+	case KeySignature:
+		return 0
+	case KeyDecryption:
+		return 1
+	case KeyAuthentication:
+		return 2
+	}
+	return -1
+}
+
+// attributesObject is the data object with the key's algorithm attributes
+func (k Key) attributesObject() uint32 {
+	return 0xC1 + uint32(k.index())
+}
+
+// uifObject is the data object with the key's user interaction flag of YubiKeys
+func (k Key) uifObject() uint16 {
+	return 0xD6 + uint16(k.index())
+}
+
+// pinReference is the PW1 reference verified for the key, the signature key has its own as its PW1 verification may
+// be good for only one signature
+func (k Key) pinReference() byte {
+	if k == KeySignature {
+		return 0x81
+	}
+	return 0x82
+}
+
+// Algorithm IDs of the algorithm attributes
+const (
+	AlgRSA   = 0x01
+	AlgECDH  = 0x12
+	AlgECDSA = 0x13
+	AlgEdDSA = 0x16
+)
+
+// Curves of ECDSA and EdDSA keys, by the OID in their algorithm attributes
+const (
+	CurveP256    = "P-256"
+	CurveP384    = "P-384"
+	CurveEd25519 = "Ed25519"
+)
+
+var curveOIDs = map[string][]byte{
+	CurveP256:    {0x2A, 0x86, 0x48, 0xCE, 0x3D, 0x03, 0x01, 0x07},
+	CurveP384:    {0x2B, 0x81, 0x04, 0x00, 0x22},
+	CurveEd25519: {0x2B, 0x06, 0x01, 0x04, 0x01, 0xDA, 0x47, 0x0F, 0x01},
+}
+
+// Attributes are the algorithm attributes of a key
+type Attributes struct {
+	Algorithm byte
+	// RSABits is the modulus size of RSA keys
+	RSABits int
+	// Curve is the curve of ECC keys, or the OID in hex for curves not supported here
+	Curve string
+}
+
+func (a Attributes) String() string {
+	switch a.Algorithm {
+	case AlgRSA:
+		return fmt.Sprintf("RSA-%d", a.RSABits)
+	case AlgECDH:
+		return "ECDH " + a.Curve
+	case AlgECDSA:
+		return "ECDSA " + a.Curve
+	case AlgEdDSA:
+		return "EdDSA " + a.Curve
+	}
+	return fmt.Sprintf("algorithm 0x%02X", a.Algorithm)
+}
+
+// ParseAttributes decodes the content of an algorithm attributes data object
+func ParseAttributes(b []byte) (Attributes, error) {
+	if len(b) == 0 {
+		return Attributes{}, fmt.Errorf("empty algorithm attributes")
+	}
+	a := Attributes{Algorithm: b[0]}
+	switch a.Algorithm {
+	case AlgRSA:
+		if len(b) < 5 {
+			return a, fmt.Errorf("RSA algorithm attributes of %d bytes", len(b))
+		}
+		a.RSABits = int(binary.BigEndian.Uint16(b[1:3]))
+	case AlgECDH, AlgECDSA, AlgEdDSA:
+		// the OID may be followed by FF when the public key is imported along with the private key
+		oid := b[1:]
+		if len(oid) > 0 && oid[len(oid)-1] == 0xFF {
+			oid = oid[:len(oid)-1]
+		}
+		a.Curve = fmt.Sprintf("%X", oid)
+		for curve, o := range curveOIDs {
+			if bytes.Equal(o, oid) {
+				a.Curve = curve
+			}
+		}
+	}
+	return a, nil
+}
+
+// Bytes encodes the attributes like the algorithm attributes data objects hold them
+func (a Attributes) Bytes() []byte {
+	if a.Algorithm == AlgRSA {
+		// 32 bit public exponent, the standard format without CRT
+		return []byte{AlgRSA, byte(a.RSABits >> 8), byte(a.RSABits), 0x00, 0x20, 0x00}
+	}
+	return append([]byte{a.Algorithm}, curveOIDs[a.Curve]...)
+}
+
+// ApplicationData is what the application related data object tells of the card
+type ApplicationData struct {
+	// AID is the full application identifier with version, manufacturer and serial number
+	AID        []byte
+	Attributes map[Key]Attributes
+	// Fingerprints are the OpenPGP fingerprints of the keys, missing for empty keys
+	Fingerprints map[Key][]byte
+	// PW1Once is set when a PW1 verification is good for only one signature with the signature key
+	PW1Once bool
+	// PW1Retries are the tries left for PW1
+	PW1Retries int
+}
+
+// Version returns the version of the OpenPGP card specification the card implements
+func (a *ApplicationData) Version() string {
+	return fmt.Sprintf("%d.%d", a.AID[6], a.AID[7])
+}
+
+// Manufacturer returns the manufacturer ID, e.g. 0006 for Yubico and 000F for Nitrokey
+func (a *ApplicationData) Manufacturer() uint16 {
+	return binary.BigEndian.Uint16(a.AID[8:10])
+}
+
+// Serial returns the card's serial number, unique for the manufacturer
+func (a *ApplicationData) Serial() uint32 {
+	return binary.BigEndian.Uint32(a.AID[10:14])
+}
+
+// ID identifies the card by its manufacturer and serial number in hex like GnuPG does, e.g. 000612345678
+func (a *ApplicationData) ID() string {
+	return fmt.Sprintf("%04X%08X", a.Manufacturer(), a.Serial())
+}
+
+// ErrNotFound is returned for keys that aren't on the card
+var ErrNotFound = errors.New("not found on the card")
+
+// ErrPINBlocked is returned when PW1 can't be verified any more until it is reset with the reset code or the admin PIN
+var ErrPINBlocked = errors.New("the PIN is blocked")
+
+// ErrResetCodeBlocked is returned when the reset code is blocked or was never set
+var ErrResetCodeBlocked = errors.New("the reset code is blocked or not set")
+
+// PINError is a wrong PIN or reset code, with the tries left before it is blocked
+type PINError struct {
+	Retries   int
+	ResetCode bool
+}
+
+func (e *PINError) Error() string {
+	name := "PIN"
+	if e.ResetCode {
+		name = "reset code"
+	}
+	if e.Retries == 1 {
+		return fmt.Sprintf("wrong %s, 1 try left before the %s is blocked", name, name)
+	}
+	return fmt.Sprintf("wrong %s, %d tries left", name, e.Retries)
+}
+
+// Card is the OpenPGP applet of a card. The applet has to be selected before the other commands, again whenever
+// another application might have selected another applet in between.
+type Card struct {
+	t scard.Transmitter
+}
+
+func New(t scard.Transmitter) *Card {
+	return &Card{t: t}
+}
+
+func (c *Card) exchange(cmd scard.Command) ([]byte, error) {
+	resp, err := scard.Exchange(c.t, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err = resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Select selects the OpenPGP applet
+func (c *Card) Select() error {
+	_, err := c.exchange(scard.Command{Ins: insSelect, P1: 0x04, Data: AID})
+	if errors.Is(err, scard.StatusError(scard.SW_FILE_NOT_FOUND)) {
+		return fmt.Errorf("the card has no OpenPGP applet")
+	}
+	return err
+}
+
+// GetData reads a data object by its tag
+func (c *Card) GetData(tag uint16) ([]byte, error) {
+	data, err := c.exchange(scard.Command{Ins: insGetData, P1: byte(tag >> 8), P2: byte(tag), Le: 256})
+	if errors.Is(err, scard.StatusError(scard.SW_REFERENCED_DATA_NOT_FOUND)) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// ID identifies the card by the manufacturer and serial number of its AID
+func (c *Card) ID() (string, error) {
+	aid, err := c.GetData(doAID)
+	if err != nil {
+		return "", err
+	}
+	if len(aid) != 16 || !bytes.HasPrefix(aid, AID) {
+		return "", fmt.Errorf("invalid OpenPGP AID %X", aid)
+	}
+	return (&ApplicationData{AID: aid}).ID(), nil
+}
+
+// ApplicationData reads the application related data
+func (c *Card) ApplicationData() (*ApplicationData, error) {
+	data, err := c.GetData(doApplicationData)
+	if err != nil {
+		return nil, err
+	}
+	return ParseApplicationData(data)
+}
+
+// ParseApplicationData decodes the application related data object, with or without its 6E tag
+func ParseApplicationData(data []byte) (*ApplicationData, error) {
+	if inner, ok := scard.FindTLV(data, doApplicationData); ok {
+		data = inner
+	}
+	aid, ok := scard.FindTLV(data, doAID)
+	if !ok || len(aid) != 16 || !bytes.HasPrefix(aid, AID) {
+		return nil, fmt.Errorf("application data without a valid OpenPGP AID")
+	}
+	// the discretionary data objects are in 73, but some cards put them in 6E directly
+	discretionary, ok := scard.FindTLV(data, doDiscretionary)
+	if !ok {
+		discretionary = data
+	}
+	objects, err := scard.ParseTLV(discretionary)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &ApplicationData{
+		AID:          aid,
+		Attributes:   make(map[Key]Attributes),
+		Fingerprints: make(map[Key][]byte),
+	}
+	for _, o := range objects {
+		switch o.Tag {
+		case doPWStatus:
+			if len(o.Value) < 7 {
+				return nil, fmt.Errorf("PW status of %d bytes", len(o.Value))
+			}
+			a.PW1Once = o.Value[0] == 0x00
+			a.PW1Retries = int(o.Value[4])
+		case doFingerprints:
+			if len(o.Value) != 60 {
+				return nil, fmt.Errorf("fingerprints of %d bytes", len(o.Value))
+			}
+			for _, k := range []Key{KeySignature, KeyDecryption, KeyAuthentication} {
+				fp := o.Value[k.index()*20 : k.index()*20+20]
+				if !bytes.Equal(fp, make([]byte, 20)) {
+					a.Fingerprints[k] = fp
+				}
+			}
+		default:
+			for _, k := range []Key{KeySignature, KeyDecryption, KeyAuthentication} {
+				if o.Tag == k.attributesObject() {
+					attrs, err := ParseAttributes(o.Value)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", k.Name(), err)
+					}
+					a.Attributes[k] = attrs
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// Touch reports whether a YubiKey wants a touch for the key, cards without user interaction flags return false
+func (c *Card) Touch(k Key) (bool, error) {
+	uif, err := c.GetData(k.uifObject())
+	if errors.Is(err, ErrNotFound) || errors.Is(err, scard.StatusError(scard.SW_INS_NOT_SUPPORTED)) ||
+		errors.Is(err, scard.StatusError(scard.SW_WRONG_P1P2)) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(uif) > 0 && uif[0] != 0x00, nil
+}
+
+// PublicKey reads the public key of a key with GENERATE ASYMMETRIC KEY PAIR, which returns it without generating a
+// new one with P1 81
+func (c *Card) PublicKey(k Key, attrs Attributes) (crypto.PublicKey, error) {
+	data, err := c.exchange(scard.Command{Ins: insGenerate, P1: 0x81, Data: []byte{byte(k), 0x00}, Le: 256})
+	if errors.Is(err, scard.StatusError(scard.SW_REFERENCED_DATA_NOT_FOUND)) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodePublicKey(attrs, data)
+}
+
+// decodePublicKey decodes the public key of GENERATE ASYMMETRIC KEY PAIR, a 7F49 object
+func decodePublicKey(attrs Attributes, data []byte) (crypto.PublicKey, error) {
+	template, ok := scard.FindTLV(data, tagPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("response without a public key")
+	}
+	objects, err := scard.ParseTLV(template)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[uint32][]byte)
+	for _, o := range objects {
+		values[o.Tag] = o.Value
+	}
+
+	switch attrs.Algorithm {
+	case AlgRSA:
+		n, e := values[0x81], values[0x82]
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA public key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case AlgECDSA:
+		var curve elliptic.Curve
+		switch attrs.Curve {
+		case CurveP256:
+			curve = elliptic.P256()
+		case CurveP384:
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", attrs.Curve)
+		}
+		x, y := elliptic.Unmarshal(curve, values[0x86])
+		if x == nil {
+			return nil, fmt.Errorf("invalid %s public key", attrs)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case AlgEdDSA:
+		if attrs.Curve != CurveEd25519 {
+			return nil, fmt.Errorf("unsupported curve %s", attrs.Curve)
+		}
+		point := values[0x86]
+		// some cards prefix the point with 40 like OpenPGP does
+		if len(point) == ed25519.PublicKeySize+1 && point[0] == 0x40 {
+			point = point[1:]
+		}
+		if len(point) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(append([]byte{}, point...)), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", attrs)
+}
+
+// PINRetries returns the tries left for the PW1 of a key without using one. verified is set when it was verified
+// since the applet was selected.
+func (c *Card) PINRetries(k Key) (retries int, verified bool, err error) {
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insVerify, P2: k.pinReference()})
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.SW == scard.SW_OK {
+		return 0, true, nil
+	}
+	if n, ok := scard.StatusError(resp.SW).Retries(); ok {
+		return n, false, nil
+	}
+	if resp.SW == scard.SW_AUTH_BLOCKED {
+		return 0, false, nil
+	}
+
+	// cards that don't answer an empty VERIFY have the tries in the PW status
+	status, err := c.PINStatus()
+	if err != nil {
+		return 0, false, err
+	}
+	return status.Retries, false, nil
+}
+
+// VerifyPIN verifies PW1 for a key, a wrong PIN returns a *PINError
+func (c *Card) VerifyPIN(k Key, pin string) error {
+	if len(pin) < minPINLength {
+		return fmt.Errorf("the PIN has to have at least %d characters", minPINLength)
+	}
+	data := []byte(pin)
+	defer zero(data)
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insVerify, P2: k.pinReference(), Data: data})
+	return c.pinResult(resp, err, false)
+}
+
+// pinResult turns the response to a PIN or reset code command into a *PINError, ErrPINBlocked or
+// ErrResetCodeBlocked
+func (c *Card) pinResult(resp *scard.Response, err error, resetCode bool) error {
+	if err != nil {
+		return err
+	}
+	blocked := ErrPINBlocked
+	if resetCode {
+		blocked = ErrResetCodeBlocked
+	}
+	if n, ok := scard.StatusError(resp.SW).Retries(); ok {
+		if n == 0 {
+			return blocked
+		}
+		return &PINError{Retries: n, ResetCode: resetCode}
+	}
+	switch resp.SW {
+	case scard.SW_AUTH_BLOCKED:
+		return blocked
+	case scard.SW_SECURITY_STATUS:
+		// YubiKeys don't tell the tries left with a wrong PIN
+		if status, err := c.PINStatus(); err == nil {
+			retries := status.Retries
+			if resetCode {
+				retries = status.ResetCodeRetries
+			}
+			if retries == 0 {
+				return blocked
+			}
+			return &PINError{Retries: retries, ResetCode: resetCode}
+		}
+	}
+	return resp.Err()
+}
+
+// ClearPIN has the card forget that PW1 was verified, for both keys
+func (c *Card) ClearPIN() error {
+	for _, k := range SigningKeys {
+		if _, err := c.exchange(scard.Command{Ins: insVerify, P1: 0xFF, P2: k.pinReference()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Sign signs with a key, the signature key with PSO: COMPUTE DIGITAL SIGNATURE and the authentication key with
+// INTERNAL AUTHENTICATE. For RSA data is the DigestInfo of the digest, which the card pads, for ECDSA the digest and
+// for EdDSA the message. ECDSA signatures are returned ASN.1 encoded like crypto.Signer returns them, the card returns
+// r and s concatenated.
+func (c *Card) Sign(k Key, pub crypto.PublicKey, data []byte) ([]byte, error) {
+	if p, ok := pub.(*ecdsa.PublicKey); ok {
+		// the digest is truncated to the size of the curve
+		if size := (p.Curve.Params().BitSize + 7) / 8; len(data) > size {
+			data = data[:size]
+		}
+	}
+
+	cmd := scard.Command{Ins: insInternalAuth, Data: data, Le: 256}
+	switch k {
+	case KeySignature:
+		cmd.Ins, cmd.P1, cmd.P2 = insPSO, 0x9E, 0x9A
+	case KeyAuthentication:
+	default:
+		return nil, fmt.Errorf("the %s can't sign", k.Name())
+	}
+	signature, err := c.exchange(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	switch p := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := (p.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return nil, fmt.Errorf("ECDSA signature of %d bytes", len(signature))
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(signature[:size]),
+			new(big.Int).SetBytes(signature[size:]),
+		})
+	case ed25519.PublicKey:
+		if len(signature) != ed25519.SignatureSize {
+			return nil, fmt.Errorf("Ed25519 signature of %d bytes", len(signature))
+		}
+	}
+	return signature, nil
+}
@@ -0,0 +1,55 @@
+package openpgp
+
+import (
+	"fmt"
+	"ncryptagent/scard"
+)
+
+// minResetCodeLength is the shortest reset code the specification allows
+const minResetCodeLength = 8
+
+// PINStatus are the tries left for PW1, the reset code and the admin PIN PW3 from the PW status bytes. A reset code
+// that was never set has no tries.
+type PINStatus struct {
+	Retries          int
+	ResetCodeRetries int
+	AdminRetries     int
+}
+
+// PINStatus reads the tries left for the PINs without using any
+func (c *Card) PINStatus() (*PINStatus, error) {
+	status, err := c.GetData(doPWStatus)
+	if err != nil {
+		return nil, err
+	}
+	if len(status) < 7 {
+		return nil, fmt.Errorf("PW status of %d bytes", len(status))
+	}
+	return &PINStatus{Retries: int(status[4]), ResetCodeRetries: int(status[5]), AdminRetries: int(status[6])}, nil
+}
+
+// ChangePIN changes PW1 with CHANGE REFERENCE DATA, for both keys. A wrong old PIN returns a *PINError.
+func (c *Card) ChangePIN(oldPIN, newPIN string) error {
+	if len(oldPIN) < minPINLength || len(newPIN) < minPINLength {
+		return fmt.Errorf("a PIN has to have at least %d characters", minPINLength)
+	}
+	data := append([]byte(oldPIN), newPIN...)
+	defer zero(data)
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insChangePIN, P2: KeySignature.pinReference(), Data: data})
+	return c.pinResult(resp, err, false)
+}
+
+// UnblockPIN sets a new PW1 with the reset code with RESET RETRY COUNTER, which also unblocks a blocked PW1. A wrong
+// reset code returns a *PINError for the reset code.
+func (c *Card) UnblockPIN(resetCode, newPIN string) error {
+	if len(resetCode) < minResetCodeLength {
+		return fmt.Errorf("the reset code has to have at least %d characters", minResetCodeLength)
+	}
+	if len(newPIN) < minPINLength {
+		return fmt.Errorf("a PIN has to have at least %d characters", minPINLength)
+	}
+	data := append([]byte(resetCode), newPIN...)
+	defer zero(data)
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insResetPIN, P2: KeySignature.pinReference(), Data: data})
+	return c.pinResult(resp, err, true)
+}
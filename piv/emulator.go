@@ -0,0 +1,594 @@
+package piv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"ncryptagent/scard"
+	"sync"
+	"time"
+)
+
+// Emulator is a PIV applet in memory that answers APDUs like the PIV applet of a YubiKey, including its serial number
+// and slot metadata extensions. Keys are generated and certificates written after authenticating with the management
+// key, the default one unless SetManagementKey changed it. Responses longer than a short APDU are returned in parts for
+// GET RESPONSE and long commands are accepted with command chaining, so the emulator covers the same encoding paths as
+// a card.
+type Emulator struct {
+	mu         sync.Mutex
+	serial     uint32
+	guid       []byte
+	pin        []byte
+	retries    int
+	maxRetries int
+	puk        []byte
+	pukRetries int
+	verified   bool
+	selected   bool
+	// managementKey authorizes GENERATE ASYMMETRIC and PUT DATA, witness is the plain witness of a mutual
+	// authentication in progress
+	managementKey ManagementKey
+	authenticated bool
+	witness       []byte
+	slots         map[Slot]*emulatedSlot
+	pending       []byte
+	chained       []byte
+
+	// Authentications counts the GENERAL AUTHENTICATE commands that signed
+	Authentications int
+}
+
+type emulatedSlot struct {
+	alg         Algorithm
+	signer      crypto.Signer
+	cert        []byte
+	pinPolicy   byte
+	touchPolicy byte
+	generated   bool
+}
+
+// NewEmulator returns an emulated card with a serial number and PIN and no keys
+func NewEmulator(serial uint32, pin string) *Emulator {
+	guid := make([]byte, 16)
+	binary.BigEndian.PutUint32(guid[12:], serial)
+	return &Emulator{
+		serial:        serial,
+		guid:          guid,
+		pin:           []byte(pin),
+		retries:       3,
+		maxRetries:    3,
+		puk:           []byte("12345678"),
+		pukRetries:    3,
+		managementKey: DefaultManagementKey,
+		slots:         make(map[Slot]*emulatedSlot),
+	}
+}
+
+// SetManagementKey changes the management key
+func (e *Emulator) SetManagementKey(mk ManagementKey) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.managementKey = mk
+	e.authenticated = false
+}
+
+// defaultPINPolicy is the policy of keys generated without one, the signature slot wants the PIN for every signature
+// and the card authentication slot none at all
+func defaultPINPolicy(slot Slot) byte {
+	switch slot {
+	case SlotSignature:
+		return PINPolicyAlways
+	case SlotCardAuthentication:
+		return PINPolicyNever
+	}
+	return PINPolicyOnce
+}
+
+// GenerateKey puts a new key in a slot, with a self-signed certificate when withCertificate is set. A pinPolicy of
+// PINPolicyDefault takes the slot's default.
+func (e *Emulator) GenerateKey(slot Slot, alg Algorithm, pinPolicy byte, withCertificate bool) (crypto.PublicKey, error) {
+	s, err := newEmulatedSlot(slot, alg, pinPolicy, TouchPolicyNever)
+	if err != nil {
+		return nil, err
+	}
+	if withCertificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(slot)),
+			Subject:      pkix.Name{CommonName: fmt.Sprintf("emulated %s", slot.Name())},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(1, 0, 0),
+		}
+		if s.cert, err = x509.CreateCertificate(rand.Reader, template, template, s.signer.Public(), s.signer); err != nil {
+			return nil, err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.slots[slot] = s
+	return s.signer.Public(), nil
+}
+
+func newEmulatedSlot(slot Slot, alg Algorithm, pinPolicy, touchPolicy byte) (*emulatedSlot, error) {
+	var signer crypto.Signer
+	var err error
+	switch alg {
+	case AlgRSA1024, AlgRSA2048, AlgRSA3072, AlgRSA4096:
+		bits := map[Algorithm]int{AlgRSA1024: 1024, AlgRSA2048: 2048, AlgRSA3072: 3072, AlgRSA4096: 4096}[alg]
+		signer, err = rsa.GenerateKey(rand.Reader, bits)
+	case AlgECCP256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case AlgECCP384:
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case AlgEd25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pinPolicy == PINPolicyDefault {
+		pinPolicy = defaultPINPolicy(slot)
+	}
+	if touchPolicy == TouchPolicyDefault {
+		touchPolicy = TouchPolicyNever
+	}
+	return &emulatedSlot{alg: alg, signer: signer, pinPolicy: pinPolicy, touchPolicy: touchPolicy, generated: true}, nil
+}
+
+// Reset has the card lose its state like after a reset by another application, the PIN has to be verified again
+func (e *Emulator) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.selected = false
+	e.verified = false
+	e.authenticated = false
+	e.witness = nil
+	e.pending = nil
+	e.chained = nil
+}
+
+// PINRetries returns the tries left for the PIN
+func (e *Emulator) PINRetries() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.retries
+}
+
+// PUKRetries returns the tries left for the PUK, which is 12345678 like on a new YubiKey
+func (e *Emulator) PUKRetries() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.pukRetries
+}
+
+func (e *Emulator) Transmit(apdu []byte) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(apdu) < 4 {
+		return sw(nil, scard.SW_WRONG_LENGTH), nil
+	}
+	cla, ins, p1, p2 := apdu[0], apdu[1], apdu[2], apdu[3]
+	var data []byte
+	if len(apdu) > 5 {
+		n := int(apdu[4])
+		if len(apdu) < 5+n {
+			return sw(nil, scard.SW_WRONG_LENGTH), nil
+		}
+		data = apdu[5 : 5+n]
+	}
+
+	if ins == 0xC0 {
+		return e.respond(nil), nil
+	}
+	e.pending = nil
+
+	if cla&0x10 != 0 {
+		e.chained = append(e.chained, data...)
+		return sw(nil, scard.SW_OK), nil
+	}
+	if e.chained != nil {
+		data = append(e.chained, data...)
+		e.chained = nil
+	}
+
+	if ins == insSelect {
+		if p1 != 0x04 || !bytes.HasPrefix(data, AID) {
+			e.selected = false
+			return sw(nil, scard.SW_FILE_NOT_FOUND), nil
+		}
+		e.selected = true
+		e.verified = false
+		e.authenticated = false
+		e.witness = nil
+		var template []byte
+		template = scard.AppendTLV(template, 0x4F, []byte{0x00, 0x00, 0x10, 0x00, 0x01, 0x00})
+		template = scard.AppendTLV(template, 0x79, scard.AppendTLV(nil, 0x4F, AID))
+		return e.respond(scard.AppendTLV(nil, 0x61, template)), nil
+	}
+	if !e.selected {
+		return sw(nil, scard.SW_INS_NOT_SUPPORTED), nil
+	}
+
+	switch ins {
+	case insGetSerial:
+		out := make([]byte, 4)
+		binary.BigEndian.PutUint32(out, e.serial)
+		return e.respond(out), nil
+	case insGetVersion:
+		return e.respond([]byte{5, 4, 3}), nil
+	case insGetData:
+		return e.getData(data), nil
+	case insGetMetadata:
+		return e.metadata(Slot(p2)), nil
+	case insVerify:
+		return e.verify(p1, p2, data), nil
+	case insChangePIN:
+		return e.changePIN(p2, data), nil
+	case insUnblockPIN:
+		return e.unblockPIN(p2, data), nil
+	case insAuthenticate:
+		if Slot(p2) == SlotManagement {
+			return e.authenticateManagement(Algorithm(p1), data), nil
+		}
+		return e.authenticate(Algorithm(p1), Slot(p2), data), nil
+	case insGenerate:
+		return e.generate(Slot(p2), data), nil
+	case insPutData:
+		return e.putData(data), nil
+	}
+	return sw(nil, scard.SW_INS_NOT_SUPPORTED), nil
+}
+
+// respond returns up to 256 bytes of data, leaving the rest for GET RESPONSE
+func (e *Emulator) respond(data []byte) []byte {
+	if data == nil {
+		data = e.pending
+	}
+	if len(data) <= 256 {
+		e.pending = nil
+		return sw(data, scard.SW_OK)
+	}
+	e.pending = data[256:]
+	remaining := len(e.pending)
+	if remaining > 255 {
+		remaining = 0
+	}
+	return sw(data[:256], 0x6100|uint16(remaining))
+}
+
+func sw(data []byte, sw uint16) []byte {
+	return append(append([]byte{}, data...), byte(sw>>8), byte(sw))
+}
+
+func (e *Emulator) getData(data []byte) []byte {
+	id, ok := scard.FindTLV(data, tagObjectID)
+	if !ok || len(id) != 3 {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	object := uint32(id[0])<<16 | uint32(id[1])<<8 | uint32(id[2])
+
+	if object == objectCHUID {
+		var chuid []byte
+		chuid = scard.AppendTLV(chuid, 0x30, bytes.Repeat([]byte{0xD4}, 25))
+		chuid = scard.AppendTLV(chuid, 0x34, e.guid)
+		chuid = scard.AppendTLV(chuid, 0x35, []byte("20991231"))
+		chuid = scard.AppendTLV(chuid, 0x3E, nil)
+		chuid = scard.AppendTLV(chuid, 0xFE, nil)
+		return e.respond(scard.AppendTLV(nil, tagObject, chuid))
+	}
+
+	for slot, s := range e.slots {
+		if slot.object() == object && s.cert != nil {
+			var content []byte
+			content = scard.AppendTLV(content, tagCertificate, s.cert)
+			content = scard.AppendTLV(content, tagCertInfo, []byte{0x00})
+			content = scard.AppendTLV(content, 0xFE, nil)
+			return e.respond(scard.AppendTLV(nil, tagObject, content))
+		}
+	}
+	return sw(nil, scard.SW_FILE_NOT_FOUND)
+}
+
+func (e *Emulator) metadata(slot Slot) []byte {
+	if slot == pinReference || slot == pukReference {
+		value, isDefault, retries := e.pin, []byte("123456"), e.retries
+		if slot == pukReference {
+			value, isDefault, retries = e.puk, []byte("12345678"), e.pukRetries
+		}
+		var out []byte
+		out = scard.AppendTLV(out, 0x01, []byte{0xFF})
+		if bytes.Equal(value, isDefault) {
+			out = scard.AppendTLV(out, 0x05, []byte{0x01})
+		} else {
+			out = scard.AppendTLV(out, 0x05, []byte{0x00})
+		}
+		out = scard.AppendTLV(out, 0x06, []byte{byte(e.maxRetries), byte(retries)})
+		return e.respond(out)
+	}
+	if slot == SlotManagement {
+		isDefault := byte(0x00)
+		if e.managementKey.Algorithm == DefaultManagementKey.Algorithm && bytes.Equal(e.managementKey.Key, DefaultManagementKey.Key) {
+			isDefault = 0x01
+		}
+		var out []byte
+		out = scard.AppendTLV(out, 0x01, []byte{byte(e.managementKey.Algorithm)})
+		out = scard.AppendTLV(out, 0x02, []byte{PINPolicyNever, TouchPolicyNever})
+		out = scard.AppendTLV(out, 0x05, []byte{isDefault})
+		return e.respond(out)
+	}
+
+	s, ok := e.slots[slot]
+	if !ok {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	origin := byte(0x02)
+	if s.generated {
+		origin = 0x01
+	}
+	var out []byte
+	out = scard.AppendTLV(out, 0x01, []byte{byte(s.alg)})
+	out = scard.AppendTLV(out, 0x02, []byte{s.pinPolicy, s.touchPolicy})
+	out = scard.AppendTLV(out, 0x03, []byte{origin})
+	out = scard.AppendTLV(out, 0x04, encodePublicKey(s.signer.Public()))
+	return e.respond(out)
+}
+
+// encodePublicKey encodes a public key like GET METADATA and GENERATE ASYMMETRIC return it
+func encodePublicKey(pub crypto.PublicKey) []byte {
+	var out []byte
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		out = scard.AppendTLV(out, 0x81, p.N.Bytes())
+		out = scard.AppendTLV(out, 0x82, big.NewInt(int64(p.E)).Bytes())
+	case *ecdsa.PublicKey:
+		out = scard.AppendTLV(out, 0x86, elliptic.Marshal(p.Curve, p.X, p.Y))
+	case ed25519.PublicKey:
+		out = scard.AppendTLV(out, 0x86, p)
+	}
+	return out
+}
+
+func (e *Emulator) verify(p1 byte, reference byte, data []byte) []byte {
+	if reference != pinReference {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if p1 == 0xFF {
+		e.verified = false
+		return sw(nil, scard.SW_OK)
+	}
+	if len(data) == 0 {
+		if e.verified {
+			return sw(nil, scard.SW_OK)
+		}
+		return sw(nil, 0x63C0|uint16(e.retries))
+	}
+	if e.retries == 0 {
+		return sw(nil, scard.SW_AUTH_BLOCKED)
+	}
+
+	pin := bytes.TrimRight(data, "\xFF")
+	if len(data) != maxPINLength || !bytes.Equal(pin, e.pin) {
+		e.retries--
+		e.verified = false
+		return sw(nil, 0x63C0|uint16(e.retries))
+	}
+	e.retries = e.maxRetries
+	e.verified = true
+	return sw(nil, scard.SW_OK)
+}
+
+func (e *Emulator) authenticate(alg Algorithm, slot Slot, data []byte) []byte {
+	s, ok := e.slots[slot]
+	if !ok {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if alg != s.alg {
+		return sw(nil, scard.SW_INCORRECT_P1P2)
+	}
+	if s.pinPolicy != PINPolicyNever && !e.verified {
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+
+	template, ok := scard.FindTLV(data, tagDynamicAuth)
+	if !ok {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	challenge, ok := scard.FindTLV(template, tagAuthChallenge)
+	if !ok {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+
+	var signature []byte
+	var err error
+	switch k := s.signer.(type) {
+	case *rsa.PrivateKey:
+		// raw RSA, the caller has padded the challenge
+		if len(challenge) != k.Size() {
+			return sw(nil, scard.SW_WRONG_LENGTH)
+		}
+		c := new(big.Int).SetBytes(challenge)
+		signature = new(big.Int).Exp(c, k.D, k.N).FillBytes(make([]byte, k.Size()))
+	case *ecdsa.PrivateKey:
+		if len(challenge) != (k.Curve.Params().BitSize+7)/8 {
+			return sw(nil, scard.SW_WRONG_LENGTH)
+		}
+		signature, err = ecdsa.SignASN1(rand.Reader, k, challenge)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, challenge)
+	}
+	if err != nil {
+		return sw(nil, scard.SW_UNKNOWN)
+	}
+
+	// a key with the always policy wants the PIN again for the next signature
+	if s.pinPolicy == PINPolicyAlways {
+		e.verified = false
+	}
+	e.Authentications++
+	return e.respond(scard.AppendTLV(nil, tagDynamicAuth, scard.AppendTLV(nil, tagAuthResponse, signature)))
+}
+
+// authenticateManagement is the mutual authentication with the management key: the first command asks for a witness
+// and the second returns it decrypted with a challenge to encrypt
+func (e *Emulator) authenticateManagement(alg Algorithm, data []byte) []byte {
+	if alg != e.managementKey.Algorithm {
+		return sw(nil, scard.SW_INCORRECT_P1P2)
+	}
+	block, err := e.managementKey.cipher()
+	if err != nil {
+		return sw(nil, scard.SW_UNKNOWN)
+	}
+	template, ok := scard.FindTLV(data, tagDynamicAuth)
+	if !ok {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	witness, _ := scard.FindTLV(template, tagAuthWitness)
+	e.authenticated = false
+
+	if len(witness) == 0 {
+		e.witness = make([]byte, block.BlockSize())
+		if _, err := rand.Read(e.witness); err != nil {
+			return sw(nil, scard.SW_UNKNOWN)
+		}
+		encrypted := make([]byte, block.BlockSize())
+		block.Encrypt(encrypted, e.witness)
+		return e.respond(scard.AppendTLV(nil, tagDynamicAuth, scard.AppendTLV(nil, tagAuthWitness, encrypted)))
+	}
+
+	expected := e.witness
+	e.witness = nil
+	challenge, ok := scard.FindTLV(template, tagAuthChallenge)
+	if expected == nil || !ok || len(challenge) != block.BlockSize() {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	if !bytes.Equal(witness, expected) {
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+	e.authenticated = true
+	response := make([]byte, block.BlockSize())
+	block.Encrypt(response, challenge)
+	return e.respond(scard.AppendTLV(nil, tagDynamicAuth, scard.AppendTLV(nil, tagAuthResponse, response)))
+}
+
+// generate is GENERATE ASYMMETRIC, replacing the key and certificate of a slot
+func (e *Emulator) generate(slot Slot, data []byte) []byte {
+	if !e.authenticated {
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+	if slot.object() == 0 {
+		return sw(nil, scard.SW_INCORRECT_P1P2)
+	}
+	template, ok := scard.FindTLV(data, 0xAC)
+	if !ok {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	alg, ok := scard.FindTLV(template, 0x80)
+	if !ok || len(alg) != 1 {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	pinPolicy, touchPolicy := byte(PINPolicyDefault), byte(TouchPolicyDefault)
+	if v, ok := scard.FindTLV(template, 0xAA); ok && len(v) == 1 {
+		pinPolicy = v[0]
+	}
+	if v, ok := scard.FindTLV(template, 0xAB); ok && len(v) == 1 {
+		touchPolicy = v[0]
+	}
+	if pinPolicy > PINPolicyAlways || touchPolicy > TouchPolicyCached {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+
+	s, err := newEmulatedSlot(slot, Algorithm(alg[0]), pinPolicy, touchPolicy)
+	if err != nil {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	e.slots[slot] = s
+	return e.respond(scard.AppendTLV(nil, 0x7F49, encodePublicKey(s.signer.Public())))
+}
+
+// putData is PUT DATA, the emulator only stores slot certificates
+func (e *Emulator) putData(data []byte) []byte {
+	if !e.authenticated {
+		return sw(nil, scard.SW_SECURITY_STATUS)
+	}
+	id, ok := scard.FindTLV(data, tagObjectID)
+	if !ok || len(id) != 3 {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	object := uint32(id[0])<<16 | uint32(id[1])<<8 | uint32(id[2])
+	content, ok := scard.FindTLV(data, tagObject)
+	if !ok {
+		return sw(nil, scard.SW_WRONG_DATA)
+	}
+	for _, slot := range Slots {
+		if slot.object() != object {
+			continue
+		}
+		s, ok := e.slots[slot]
+		if !ok {
+			return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+		}
+		cert, ok := scard.FindTLV(content, tagCertificate)
+		if !ok || len(cert) == 0 {
+			s.cert = nil
+		} else {
+			s.cert = append([]byte{}, cert...)
+		}
+		return sw(nil, scard.SW_OK)
+	}
+	return sw(nil, scard.SW_FILE_NOT_FOUND)
+}
+
+// changePIN is CHANGE REFERENCE DATA for the PIN, the emulator doesn't change the PUK
+func (e *Emulator) changePIN(reference byte, data []byte) []byte {
+	if reference != pinReference {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if len(data) != 2*maxPINLength {
+		return sw(nil, scard.SW_WRONG_LENGTH)
+	}
+	if e.retries == 0 {
+		return sw(nil, scard.SW_AUTH_BLOCKED)
+	}
+	if !bytes.Equal(bytes.TrimRight(data[:maxPINLength], "\xFF"), e.pin) {
+		e.retries--
+		e.verified = false
+		return sw(nil, 0x63C0|uint16(e.retries))
+	}
+	e.pin = append([]byte{}, bytes.TrimRight(data[maxPINLength:], "\xFF")...)
+	e.retries = e.maxRetries
+	return sw(nil, scard.SW_OK)
+}
+
+// unblockPIN is RESET RETRY COUNTER, setting a new PIN with the PUK
+func (e *Emulator) unblockPIN(reference byte, data []byte) []byte {
+	if reference != pinReference {
+		return sw(nil, scard.SW_REFERENCED_DATA_NOT_FOUND)
+	}
+	if len(data) != 2*maxPINLength {
+		return sw(nil, scard.SW_WRONG_LENGTH)
+	}
+	if e.pukRetries == 0 {
+		return sw(nil, scard.SW_AUTH_BLOCKED)
+	}
+	if !bytes.Equal(bytes.TrimRight(data[:maxPINLength], "\xFF"), e.puk) {
+		e.pukRetries--
+		return sw(nil, 0x63C0|uint16(e.pukRetries))
+	}
+	e.pin = append([]byte{}, bytes.TrimRight(data[maxPINLength:], "\xFF")...)
+	e.pukRetries = e.maxRetries
+	e.retries = e.maxRetries
+	e.verified = false
+	return sw(nil, scard.SW_OK)
+}
@@ -0,0 +1,219 @@
+package piv
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ncryptagent/scard"
+	"strings"
+)
+
+// ManagementKey is the card management key that authorizes generating keys and writing data objects
+type ManagementKey struct {
+	Algorithm Algorithm
+	Key       []byte
+}
+
+// DefaultManagementKey is the management key cards ship with, YubiKeys from firmware 5.7 use it as an AES-192 key
+var DefaultManagementKey = ManagementKey{
+	Algorithm: AlgTDES,
+	Key: []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	},
+}
+
+// ErrManagementKey is returned when the card rejects the management key
+var ErrManagementKey = errors.New("the card rejected the management key")
+
+// ParseManagementKey parses a management key in hex, its algorithm is taken from the key length when alg is 0, which
+// is ambiguous for 24 byte keys and taken as 3DES
+func ParseManagementKey(s string, alg Algorithm) (ManagementKey, error) {
+	key, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		return ManagementKey{}, fmt.Errorf("invalid management key: %w", err)
+	}
+	if alg == 0 {
+		switch len(key) {
+		case 16:
+			alg = AlgAES128
+		case 24:
+			alg = AlgTDES
+		case 32:
+			alg = AlgAES256
+		}
+	}
+	mk := ManagementKey{Algorithm: alg, Key: key}
+	if _, err := mk.cipher(); err != nil {
+		return ManagementKey{}, err
+	}
+	return mk, nil
+}
+
+func (mk ManagementKey) cipher() (cipher.Block, error) {
+	want := map[Algorithm]int{AlgTDES: 24, AlgAES128: 16, AlgAES192: 24, AlgAES256: 32}[mk.Algorithm]
+	if want == 0 {
+		return nil, fmt.Errorf("unsupported management key algorithm %s", mk.Algorithm)
+	}
+	if len(mk.Key) != want {
+		return nil, fmt.Errorf("%s management keys have %d bytes, not %d", mk.Algorithm, want, len(mk.Key))
+	}
+	if mk.Algorithm == AlgTDES {
+		return des.NewTripleDESCipher(mk.Key)
+	}
+	return aes.NewCipher(mk.Key)
+}
+
+// ManagementKeyAlgorithm returns the algorithm of a YubiKey's management key, other cards use 3DES
+func (c *Card) ManagementKeyAlgorithm() (Algorithm, error) {
+	m, err := c.Metadata(SlotManagement)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, scard.StatusError(scard.SW_INS_NOT_SUPPORTED)) {
+		return AlgTDES, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return m.Algorithm, nil
+}
+
+// Authenticate authenticates with the management key by mutual authentication: the card sends an encrypted witness
+// the host decrypts, and the host sends a challenge the card encrypts
+func (c *Card) Authenticate(mk ManagementKey) error {
+	block, err := mk.cipher()
+	if err != nil {
+		return err
+	}
+	size := block.BlockSize()
+
+	resp, err := c.exchange(scard.Command{
+		Ins:  insAuthenticate,
+		P1:   byte(mk.Algorithm),
+		P2:   byte(SlotManagement),
+		Data: scard.AppendTLV(nil, tagDynamicAuth, scard.AppendTLV(nil, tagAuthWitness, nil)),
+		Le:   256,
+	})
+	if err != nil {
+		return err
+	}
+	template, _ := scard.FindTLV(resp, tagDynamicAuth)
+	witness, ok := scard.FindTLV(template, tagAuthWitness)
+	if !ok || len(witness) != size {
+		return fmt.Errorf("management key authentication without a witness")
+	}
+	decrypted := make([]byte, size)
+	block.Decrypt(decrypted, witness)
+
+	challenge := make([]byte, size)
+	if _, err = rand.Read(challenge); err != nil {
+		return err
+	}
+	var request []byte
+	request = scard.AppendTLV(request, tagAuthWitness, decrypted)
+	request = scard.AppendTLV(request, tagAuthChallenge, challenge)
+	resp, err = c.exchange(scard.Command{
+		Ins:  insAuthenticate,
+		P1:   byte(mk.Algorithm),
+		P2:   byte(SlotManagement),
+		Data: scard.AppendTLV(nil, tagDynamicAuth, request),
+		Le:   256,
+	})
+	if errors.Is(err, scard.StatusError(scard.SW_SECURITY_STATUS)) {
+		return ErrManagementKey
+	}
+	if err != nil {
+		return err
+	}
+
+	template, _ = scard.FindTLV(resp, tagDynamicAuth)
+	response, ok := scard.FindTLV(template, tagAuthResponse)
+	expected := make([]byte, size)
+	block.Encrypt(expected, challenge)
+	if !ok || subtle.ConstantTimeCompare(response, expected) != 1 {
+		return fmt.Errorf("the card failed the management key authentication")
+	}
+	return nil
+}
+
+// ParsePINPolicy parses a PIN policy by its name, "default", "never", "once" or "always"
+func ParsePINPolicy(s string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "", "default":
+		return PINPolicyDefault, nil
+	case "never":
+		return PINPolicyNever, nil
+	case "once":
+		return PINPolicyOnce, nil
+	case "always":
+		return PINPolicyAlways, nil
+	}
+	return 0, fmt.Errorf("invalid PIN policy %q", s)
+}
+
+// ParseTouchPolicy parses a touch policy by its name, "default", "never", "always" or "cached"
+func ParseTouchPolicy(s string) (byte, error) {
+	switch strings.ToLower(s) {
+	case "", "default":
+		return TouchPolicyDefault, nil
+	case "never":
+		return TouchPolicyNever, nil
+	case "always":
+		return TouchPolicyAlways, nil
+	case "cached":
+		return TouchPolicyCached, nil
+	}
+	return 0, fmt.Errorf("invalid touch policy %q", s)
+}
+
+// GenerateKey generates a key in a slot with GENERATE ASYMMETRIC, replacing the key that is in it. The card has to be
+// authenticated with the management key. The policies are YubiKey extensions, other cards only take the defaults.
+func (c *Card) GenerateKey(slot Slot, alg Algorithm, pinPolicy, touchPolicy byte) (crypto.PublicKey, error) {
+	var template []byte
+	template = scard.AppendTLV(template, 0x80, []byte{byte(alg)})
+	if pinPolicy != PINPolicyDefault {
+		template = scard.AppendTLV(template, 0xAA, []byte{pinPolicy})
+	}
+	if touchPolicy != TouchPolicyDefault {
+		template = scard.AppendTLV(template, 0xAB, []byte{touchPolicy})
+	}
+	resp, err := c.exchange(scard.Command{Ins: insGenerate, P2: byte(slot), Data: scard.AppendTLV(nil, 0xAC, template), Le: 256})
+	if errors.Is(err, scard.StatusError(scard.SW_SECURITY_STATUS)) {
+		return nil, fmt.Errorf("generating a key needs the management key: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	public, ok := scard.FindTLV(resp, 0x7F49)
+	if !ok {
+		return nil, fmt.Errorf("GENERATE ASYMMETRIC response without a public key")
+	}
+	return decodePublicKey(alg, public)
+}
+
+// PutCertificate writes the certificate of a slot, uncompressed. The card has to be authenticated with the management
+// key.
+func (c *Card) PutCertificate(slot Slot, der []byte) error {
+	object := slot.object()
+	if object == 0 {
+		return fmt.Errorf("%s has no certificate", slot.Name())
+	}
+	var content []byte
+	content = scard.AppendTLV(content, tagCertificate, der)
+	content = scard.AppendTLV(content, tagCertInfo, []byte{0x00})
+	content = scard.AppendTLV(content, 0xFE, nil)
+
+	var data []byte
+	data = scard.AppendTLV(data, tagObjectID, []byte{byte(object >> 16), byte(object >> 8), byte(object)})
+	data = append(data, scard.AppendTLV(nil, tagObject, content)...)
+	_, err := c.exchange(scard.Command{Ins: insPutData, P1: 0x3F, P2: 0xFF, Data: data})
+	if errors.Is(err, scard.StatusError(scard.SW_SECURITY_STATUS)) {
+		return fmt.Errorf("writing a certificate needs the management key: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package piv
+
+import (
+	"errors"
+	"ncryptagent/scard"
+)
+
+// PINStatus are the tries left for the PIN and the PUK, -1 when the card doesn't tell. Only YubiKeys tell the tries
+// of the PUK, and the tries of the PIN while it is verified.
+type PINStatus struct {
+	Retries       int
+	MaxRetries    int
+	PUKRetries    int
+	PUKMaxRetries int
+	// DefaultPIN is set when a YubiKey still has the factory PIN
+	DefaultPIN bool
+}
+
+// PINStatus reads the tries left for the PIN and the PUK without using either
+func (c *Card) PINStatus() (*PINStatus, error) {
+	status := &PINStatus{Retries: -1, MaxRetries: -1, PUKRetries: -1, PUKMaxRetries: -1}
+
+	m, err := c.Metadata(pinReference)
+	switch {
+	case err == nil:
+		status.Retries, status.MaxRetries, status.DefaultPIN = m.Retries, m.MaxRetries, m.Default
+		if m, err := c.Metadata(pukReference); err == nil {
+			status.PUKRetries, status.PUKMaxRetries = m.Retries, m.MaxRetries
+		}
+		return status, nil
+	case errors.Is(err, scard.StatusError(scard.SW_INS_NOT_SUPPORTED)), errors.Is(err, ErrNotFound):
+		retries, verified, err := c.PINRetries()
+		if err != nil {
+			return nil, err
+		}
+		if !verified {
+			status.Retries = retries
+		}
+		return status, nil
+	}
+	return nil, err
+}
+
+// ChangePIN changes the PIN with CHANGE REFERENCE DATA, a wrong old PIN returns a *PINError
+func (c *Card) ChangePIN(oldPIN, newPIN string) error {
+	data, err := encodePINs(oldPIN, newPIN)
+	if err != nil {
+		return err
+	}
+	defer zero(data)
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insChangePIN, P2: pinReference, Data: data})
+	return pinResult(resp, err, false)
+}
+
+// UnblockPIN sets a new PIN with the PUK with RESET RETRY COUNTER, which also unblocks a blocked PIN. A wrong PUK
+// returns a *PINError for the PUK.
+func (c *Card) UnblockPIN(puk, newPIN string) error {
+	data, err := encodePINs(puk, newPIN)
+	if err != nil {
+		return err
+	}
+	defer zero(data)
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insUnblockPIN, P2: pinReference, Data: data})
+	return pinResult(resp, err, true)
+}
+
+// encodePINs encodes the two PINs of CHANGE REFERENCE DATA and RESET RETRY COUNTER, each padded to 8 bytes
+func encodePINs(first, second string) ([]byte, error) {
+	a, err := encodePIN(first)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(a)
+	b, err := encodePIN(second)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(b)
+	return append(append(make([]byte, 0, 2*maxPINLength), a...), b...), nil
+}
@@ -0,0 +1,618 @@
+// Package piv talks to the PIV applet of smart cards and security keys over APDUs, covering slot certificates and
+// public keys, PIN verification and signing. The YubiKey extensions for the serial number and slot metadata are used
+// when the card has them.
+package piv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"ncryptagent/scard"
+	"strings"
+)
+
+// AID is the application identifier of the PIV applet, the card matches it as a prefix
+var AID = []byte{0xA0, 0x00, 0x00, 0x03, 0x08}
+
+const (
+	insVerify        = 0x20
+	insChangePIN     = 0x24
+	insUnblockPIN    = 0x2C
+	insGenerate      = 0x47
+	insAuthenticate  = 0x87
+	insSelect        = 0xA4
+	insGetData       = 0xCB
+	insPutData       = 0xDB
+	insGetMetadata   = 0xF7
+	insGetSerial     = 0xF8
+	insGetVersion    = 0xFD
+	pinReference     = 0x80
+	pukReference     = 0x81
+	objectCHUID      = 0x5FC102
+	tagDynamicAuth   = 0x7C
+	tagAuthWitness   = 0x80
+	tagAuthResponse  = 0x82
+	tagAuthChallenge = 0x81
+	tagObject        = 0x53
+	tagCertificate   = 0x70
+	tagCertInfo      = 0x71
+	tagObjectID      = 0x5C
+	certInfoGzip     = 0x01
+	maxPINLength     = 8
+	pinPadding       = 0xFF
+)
+
+// Slot is a key reference of the PIV applet
+type Slot byte
+
+const (
+	SlotAuthentication     Slot = 0x9A
+	SlotSignature          Slot = 0x9C
+	SlotKeyManagement      Slot = 0x9D
+	SlotCardAuthentication Slot = 0x9E
+	// SlotManagement is the card management key, it holds no key pair
+	SlotManagement Slot = 0x9B
+)
+
+// Slots are the slots that hold keys, the four standard slots and the twenty retired key management slots
+var Slots = func() []Slot {
+	slots := []Slot{SlotAuthentication, SlotSignature, SlotKeyManagement, SlotCardAuthentication}
+	for s := Slot(0x82); s <= 0x95; s++ {
+		slots = append(slots, s)
+	}
+	return slots
+}()
+
+// ParseSlot parses a slot in the hex notation of String, like "9a"
+func ParseSlot(s string) (Slot, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(s), "0x"))
+	if err != nil || len(b) != 1 {
+		return 0, fmt.Errorf("invalid PIV slot %q", s)
+	}
+	slot := Slot(b[0])
+	if slot.object() == 0 {
+		return 0, fmt.Errorf("%s is not a PIV key slot", s)
+	}
+	return slot, nil
+}
+
+func (s Slot) String() string {
+	return fmt.Sprintf("%02x", byte(s))
+}
+
+// Name is the slot's name in the PIV standard
+func (s Slot) Name() string {
+	switch s {
+	case SlotAuthentication:
+		return "PIV Authentication"
+	case SlotSignature:
+		return "Digital Signature"
+	case SlotKeyManagement:
+		return "Key Management"
+	case SlotCardAuthentication:
+		return "Card Authentication"
+	case SlotManagement:
+		return "Card Management"
+	}
+	if s >= 0x82 && s <= 0x95 {
+		return fmt.Sprintf("Retired Key Management %d", s-0x81)
+	}
+	return fmt.Sprintf("slot %s", s)
+}
+
+// object is the data object holding the slot's certificate
+func (s Slot) object() uint32 {
+	switch s {
+	case SlotAuthentication:
+		return 0x5FC105
+	case SlotSignature:
+		return 0x5FC10A
+	case SlotKeyManagement:
+		return 0x5FC10B
+	case SlotCardAuthentication:
+		return 0x5FC101
+	}
+	if s >= 0x82 && s <= 0x95 {
+		return 0x5FC10D + uint32(s-0x82)
+	}
+	return 0
+}
+
+// Algorithm is a PIV cryptographic algorithm identifier
+type Algorithm byte
+
+const (
+	AlgRSA1024 Algorithm = 0x06
+	AlgRSA2048 Algorithm = 0x07
+	AlgRSA3072 Algorithm = 0x05
+	AlgRSA4096 Algorithm = 0x16
+	AlgECCP256 Algorithm = 0x11
+	AlgECCP384 Algorithm = 0x14
+	// AlgEd25519 is a YubiKey extension
+	AlgEd25519 Algorithm = 0xE0
+
+	// algorithms of the card management key, the AES ones are YubiKey extensions
+	AlgTDES   Algorithm = 0x03
+	AlgAES128 Algorithm = 0x08
+	AlgAES192 Algorithm = 0x0A
+	AlgAES256 Algorithm = 0x0C
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case AlgRSA1024:
+		return "RSA-1024"
+	case AlgRSA2048:
+		return "RSA-2048"
+	case AlgRSA3072:
+		return "RSA-3072"
+	case AlgRSA4096:
+		return "RSA-4096"
+	case AlgECCP256:
+		return "ECCP256"
+	case AlgECCP384:
+		return "ECCP384"
+	case AlgEd25519:
+		return "Ed25519"
+	case AlgTDES:
+		return "3DES"
+	case AlgAES128:
+		return "AES-128"
+	case AlgAES192:
+		return "AES-192"
+	case AlgAES256:
+		return "AES-256"
+	}
+	return fmt.Sprintf("algorithm 0x%02X", byte(a))
+}
+
+// AlgorithmOf returns the algorithm of a public key
+func AlgorithmOf(pub crypto.PublicKey) (Algorithm, error) {
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		switch p.N.BitLen() {
+		case 1024:
+			return AlgRSA1024, nil
+		case 2048:
+			return AlgRSA2048, nil
+		case 3072:
+			return AlgRSA3072, nil
+		case 4096:
+			return AlgRSA4096, nil
+		}
+		return 0, fmt.Errorf("unsupported RSA key size %d", p.N.BitLen())
+	case *ecdsa.PublicKey:
+		switch p.Curve {
+		case elliptic.P256():
+			return AlgECCP256, nil
+		case elliptic.P384():
+			return AlgECCP384, nil
+		}
+		return 0, fmt.Errorf("unsupported curve %s", p.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return AlgEd25519, nil
+	}
+	return 0, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+const (
+	PINPolicyDefault = 0
+	PINPolicyNever   = 1
+	PINPolicyOnce    = 2
+	PINPolicyAlways  = 3
+
+	TouchPolicyDefault = 0
+	TouchPolicyNever   = 1
+	TouchPolicyAlways  = 2
+	TouchPolicyCached  = 3
+)
+
+// Metadata is what the YubiKey GET METADATA command tells about a slot
+type Metadata struct {
+	Algorithm   Algorithm
+	PINPolicy   byte
+	TouchPolicy byte
+	// Generated is set for keys generated on the card, imported keys have it cleared
+	Generated bool
+	Public    crypto.PublicKey
+	// Default is set for a PIN, PUK or management key that still has its factory value, MaxRetries and Retries are
+	// the tries of a PIN or PUK
+	Default    bool
+	MaxRetries int
+	Retries    int
+}
+
+// ErrNotFound is returned for slots without a certificate or key
+var ErrNotFound = errors.New("not found on the card")
+
+// ErrPINBlocked is returned when the PIN can't be verified any more until it is unblocked with the PUK
+var ErrPINBlocked = errors.New("the PIN is blocked")
+
+// ErrPUKBlocked is returned when the PUK is blocked, the PIN can't be unblocked any more
+var ErrPUKBlocked = errors.New("the PUK is blocked")
+
+// PINError is a wrong PIN or PUK, with the tries left before it is blocked
+type PINError struct {
+	Retries int
+	PUK     bool
+}
+
+func (e *PINError) Error() string {
+	name := "PIN"
+	if e.PUK {
+		name = "PUK"
+	}
+	if e.Retries == 1 {
+		return fmt.Sprintf("wrong %s, 1 try left before the %s is blocked", name, name)
+	}
+	return fmt.Sprintf("wrong %s, %d tries left", name, e.Retries)
+}
+
+// Card is the PIV applet of a card. The applet has to be selected before the other commands, again whenever another
+// application might have selected another applet in between.
+type Card struct {
+	t scard.Transmitter
+}
+
+func New(t scard.Transmitter) *Card {
+	return &Card{t: t}
+}
+
+func (c *Card) exchange(cmd scard.Command) ([]byte, error) {
+	resp, err := scard.Exchange(c.t, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err = resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Select selects the PIV applet
+func (c *Card) Select() error {
+	_, err := c.exchange(scard.Command{Ins: insSelect, P1: 0x04, Data: AID, Le: 256})
+	if errors.Is(err, scard.StatusError(scard.SW_FILE_NOT_FOUND)) {
+		return fmt.Errorf("the card has no PIV applet")
+	}
+	return err
+}
+
+// Serial returns the serial number of a YubiKey
+func (c *Card) Serial() (uint32, error) {
+	data, err := c.exchange(scard.Command{Ins: insGetSerial, Le: 256})
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 4 {
+		return 0, fmt.Errorf("serial number has %d bytes", len(data))
+	}
+	return binary.BigEndian.Uint32(data), nil
+}
+
+// GUID returns the card's GUID from its CHUID
+func (c *Card) GUID() ([]byte, error) {
+	chuid, err := c.GetData(objectCHUID)
+	if err != nil {
+		return nil, err
+	}
+	guid, ok := scard.FindTLV(chuid, 0x34)
+	if !ok || len(guid) != 16 {
+		return nil, fmt.Errorf("CHUID without a GUID")
+	}
+	return guid, nil
+}
+
+// ID identifies the card, by its serial number on YubiKeys and by the GUID of its CHUID otherwise
+func (c *Card) ID() (string, error) {
+	if serial, err := c.Serial(); err == nil {
+		return fmt.Sprintf("%d", serial), nil
+	}
+	guid, err := c.GUID()
+	if err != nil {
+		return "", fmt.Errorf("the card has neither a serial number nor a GUID: %w", err)
+	}
+	return hex.EncodeToString(guid), nil
+}
+
+// Version returns the firmware version of a YubiKey
+func (c *Card) Version() (string, error) {
+	data, err := c.exchange(scard.Command{Ins: insGetVersion, Le: 256})
+	if err != nil {
+		return "", err
+	}
+	if len(data) != 3 {
+		return "", fmt.Errorf("version has %d bytes", len(data))
+	}
+	return fmt.Sprintf("%d.%d.%d", data[0], data[1], data[2]), nil
+}
+
+// GetData reads a data object, returning its content without the 53 tag
+func (c *Card) GetData(object uint32) ([]byte, error) {
+	id := []byte{byte(object >> 16), byte(object >> 8), byte(object)}
+	data, err := c.exchange(scard.Command{Ins: insGetData, P1: 0x3F, P2: 0xFF, Data: scard.AppendTLV(nil, tagObjectID, id), Le: 256})
+	if errors.Is(err, scard.StatusError(scard.SW_FILE_NOT_FOUND)) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, ok := scard.FindTLV(data, tagObject)
+	if !ok {
+		return nil, fmt.Errorf("data object %06X is not encoded as an object", object)
+	}
+	return value, nil
+}
+
+// Certificate reads the certificate of a slot
+func (c *Card) Certificate(slot Slot) (*x509.Certificate, error) {
+	data, err := c.GetData(slot.object())
+	if err != nil {
+		return nil, err
+	}
+	der, ok := scard.FindTLV(data, tagCertificate)
+	if !ok || len(der) == 0 {
+		return nil, ErrNotFound
+	}
+	if info, ok := scard.FindTLV(data, tagCertInfo); ok && len(info) == 1 && info[0] == certInfoGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(der))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress certificate: %w", err)
+		}
+		if der, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("unable to decompress certificate: %w", err)
+		}
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Metadata reads the metadata of a slot from a YubiKey
+func (c *Card) Metadata(slot Slot) (*Metadata, error) {
+	data, err := c.exchange(scard.Command{Ins: insGetMetadata, P2: byte(slot), Le: 256})
+	if errors.Is(err, scard.StatusError(scard.SW_REFERENCED_DATA_NOT_FOUND)) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	objects, err := scard.ParseTLV(data)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{}
+	var public []byte
+	for _, o := range objects {
+		switch o.Tag {
+		case 0x01:
+			if len(o.Value) == 1 {
+				m.Algorithm = Algorithm(o.Value[0])
+			}
+		case 0x02:
+			if len(o.Value) == 2 {
+				m.PINPolicy, m.TouchPolicy = o.Value[0], o.Value[1]
+			}
+		case 0x03:
+			m.Generated = len(o.Value) == 1 && o.Value[0] == 0x01
+		case 0x04:
+			public = o.Value
+		case 0x05:
+			m.Default = len(o.Value) == 1 && o.Value[0] == 0x01
+		case 0x06:
+			if len(o.Value) == 2 {
+				m.MaxRetries, m.Retries = int(o.Value[0]), int(o.Value[1])
+			}
+		}
+	}
+	if public != nil {
+		if m.Public, err = decodePublicKey(m.Algorithm, public); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// PublicKey returns the public key of a slot, from its certificate or else from the YubiKey slot metadata
+func (c *Card) PublicKey(slot Slot) (crypto.PublicKey, error) {
+	cert, err := c.Certificate(slot)
+	if err == nil {
+		return cert.PublicKey, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	m, err := c.Metadata(slot)
+	if err != nil {
+		if errors.Is(err, scard.StatusError(scard.SW_INS_NOT_SUPPORTED)) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if m.Public == nil {
+		return nil, ErrNotFound
+	}
+	return m.Public, nil
+}
+
+// decodePublicKey decodes the public key of GET METADATA and GENERATE ASYMMETRIC, the content of a 7F49 object
+func decodePublicKey(alg Algorithm, data []byte) (crypto.PublicKey, error) {
+	objects, err := scard.ParseTLV(data)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[uint32][]byte)
+	for _, o := range objects {
+		values[o.Tag] = o.Value
+	}
+
+	switch alg {
+	case AlgRSA1024, AlgRSA2048, AlgRSA3072, AlgRSA4096:
+		n, e := values[0x81], values[0x82]
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA public key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case AlgECCP256, AlgECCP384:
+		curve := elliptic.P256()
+		if alg == AlgECCP384 {
+			curve = elliptic.P384()
+		}
+		x, y := elliptic.Unmarshal(curve, values[0x86])
+		if x == nil {
+			return nil, fmt.Errorf("invalid %s public key", alg)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case AlgEd25519:
+		point := values[0x86]
+		if len(point) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(append([]byte{}, point...)), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", alg)
+}
+
+// PINRetries returns the tries left for the PIN without using one. verified is set when the PIN was verified since
+// the applet was selected, the card doesn't tell the tries left then.
+func (c *Card) PINRetries() (retries int, verified bool, err error) {
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insVerify, P2: pinReference})
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.SW == scard.SW_OK {
+		return 0, true, nil
+	}
+	if n, ok := scard.StatusError(resp.SW).Retries(); ok {
+		return n, false, nil
+	}
+	if resp.SW == scard.SW_AUTH_BLOCKED {
+		return 0, false, nil
+	}
+	return 0, false, resp.Err()
+}
+
+// VerifyPIN verifies the PIN, a wrong one returns a *PINError
+func (c *Card) VerifyPIN(pin string) error {
+	data, err := encodePIN(pin)
+	if err != nil {
+		return err
+	}
+	defer zero(data)
+	resp, err := scard.Exchange(c.t, scard.Command{Ins: insVerify, P2: pinReference, Data: data})
+	return pinResult(resp, err, false)
+}
+
+// ClearPIN has the card forget that the PIN was verified
+func (c *Card) ClearPIN() error {
+	_, err := c.exchange(scard.Command{Ins: insVerify, P1: 0xFF, P2: pinReference})
+	return err
+}
+
+func encodePIN(pin string) ([]byte, error) {
+	if len(pin) < 6 || len(pin) > maxPINLength {
+		return nil, fmt.Errorf("a PIN has to have 6 to 8 characters")
+	}
+	data := bytes.Repeat([]byte{pinPadding}, maxPINLength)
+	copy(data, pin)
+	return data, nil
+}
+
+// pinResult turns the response to a PIN or PUK command into a *PINError, ErrPINBlocked or ErrPUKBlocked
+func pinResult(resp *scard.Response, err error, puk bool) error {
+	if err != nil {
+		return err
+	}
+	blocked := ErrPINBlocked
+	if puk {
+		blocked = ErrPUKBlocked
+	}
+	if n, ok := scard.StatusError(resp.SW).Retries(); ok {
+		if n == 0 {
+			return blocked
+		}
+		return &PINError{Retries: n, PUK: puk}
+	}
+	if resp.SW == scard.SW_AUTH_BLOCKED {
+		return blocked
+	}
+	return resp.Err()
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Sign signs with the key in a slot with GENERAL AUTHENTICATE. For RSA data is the DigestInfo of the digest, which
+// is padded for PKCS #1 v1.5 here, for ECDSA the digest and for Ed25519 the message. ECDSA signatures are returned
+// ASN.1 encoded like the card returns them.
+func (c *Card) Sign(slot Slot, pub crypto.PublicKey, data []byte) ([]byte, error) {
+	alg, err := AlgorithmOf(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var challenge []byte
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		size := (p.N.BitLen() + 7) / 8
+		if len(data) > size-11 {
+			return nil, fmt.Errorf("%d bytes are too long to sign with %s", len(data), alg)
+		}
+		// EMSA-PKCS1-v1_5: 00 01 FF..FF 00 DigestInfo
+		challenge = make([]byte, size)
+		challenge[1] = 0x01
+		for i := 2; i < size-len(data)-1; i++ {
+			challenge[i] = 0xFF
+		}
+		copy(challenge[size-len(data):], data)
+	case *ecdsa.PublicKey:
+		// the digest is truncated to the size of the curve, or padded when it is shorter
+		size := (p.Curve.Params().BitSize + 7) / 8
+		challenge = make([]byte, size)
+		if len(data) >= size {
+			copy(challenge, data[:size])
+		} else {
+			copy(challenge[size-len(data):], data)
+		}
+	default:
+		challenge = data
+	}
+
+	var request []byte
+	request = scard.AppendTLV(request, tagAuthResponse, nil)
+	request = scard.AppendTLV(request, tagAuthChallenge, challenge)
+	resp, err := c.exchange(scard.Command{
+		Ins:  insAuthenticate,
+		P1:   byte(alg),
+		P2:   byte(slot),
+		Data: scard.AppendTLV(nil, tagDynamicAuth, request),
+		Le:   256,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	template, ok := scard.FindTLV(resp, tagDynamicAuth)
+	if !ok {
+		return nil, fmt.Errorf("GENERAL AUTHENTICATE response without a dynamic authentication template")
+	}
+	signature, ok := scard.FindTLV(template, tagAuthResponse)
+	if !ok {
+		return nil, fmt.Errorf("GENERAL AUTHENTICATE response without a signature")
+	}
+	return signature, nil
+}
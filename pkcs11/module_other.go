@@ -0,0 +1,11 @@
+//go:build !cgo && !windows
+
+package pkcs11
+
+import "fmt"
+
+const ulongSize = 8
+
+func open(path string) (Module, error) {
+	return nil, fmt.Errorf("unable to load PKCS#11 module %s: this build has no cgo support", path)
+}
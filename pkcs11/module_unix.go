@@ -0,0 +1,461 @@
+//go:build cgo && !windows
+
+package pkcs11
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// the subset of pkcs11.h the agent uses, CK_ULONG is an unsigned long and structures have their natural alignment
+// outside Windows
+
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+
+typedef struct { unsigned char major, minor; } ck_version;
+
+typedef struct {
+	CK_ULONG type;
+	void *value;
+	CK_ULONG value_len;
+} ck_attribute;
+
+typedef struct {
+	CK_ULONG mechanism;
+	void *parameter;
+	CK_ULONG parameter_len;
+} ck_mechanism;
+
+typedef struct {
+	unsigned char description[64];
+	unsigned char manufacturer[32];
+	CK_ULONG flags;
+	ck_version hardware_version, firmware_version;
+} ck_slot_info;
+
+typedef struct {
+	unsigned char label[32];
+	unsigned char manufacturer[32];
+	unsigned char model[16];
+	unsigned char serial_number[16];
+	CK_ULONG flags;
+	CK_ULONG max_session_count, session_count, max_rw_session_count, rw_session_count;
+	CK_ULONG max_pin_len, min_pin_len;
+	CK_ULONG total_public_memory, free_public_memory, total_private_memory, free_private_memory;
+	ck_version hardware_version, firmware_version;
+	unsigned char utc_time[16];
+} ck_token_info;
+
+typedef struct {
+	void *create_mutex, *destroy_mutex, *lock_mutex, *unlock_mutex;
+	CK_ULONG flags;
+	void *reserved;
+} ck_c_initialize_args;
+
+// CK_FUNCTION_LIST up to C_Sign, the functions the agent doesn't call are left untyped
+typedef struct {
+	ck_version version;
+	CK_RV (*C_Initialize)(void *);
+	CK_RV (*C_Finalize)(void *);
+	void *C_GetInfo;
+	void *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(unsigned char, CK_ULONG *, CK_ULONG *);
+	CK_RV (*C_GetSlotInfo)(CK_ULONG, ck_slot_info *);
+	CK_RV (*C_GetTokenInfo)(CK_ULONG, ck_token_info *);
+	CK_RV (*C_GetMechanismList)(CK_ULONG, CK_ULONG *, CK_ULONG *);
+	void *C_GetMechanismInfo, *C_InitToken, *C_InitPIN, *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_ULONG, CK_ULONG, void *, void *, CK_ULONG *);
+	CK_RV (*C_CloseSession)(CK_ULONG);
+	void *C_CloseAllSessions, *C_GetSessionInfo, *C_GetOperationState, *C_SetOperationState;
+	CK_RV (*C_Login)(CK_ULONG, CK_ULONG, unsigned char *, CK_ULONG);
+	CK_RV (*C_Logout)(CK_ULONG);
+	void *C_CreateObject, *C_CopyObject, *C_DestroyObject, *C_GetObjectSize;
+	CK_RV (*C_GetAttributeValue)(CK_ULONG, CK_ULONG, ck_attribute *, CK_ULONG);
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_ULONG, ck_attribute *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_ULONG, CK_ULONG *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_ULONG);
+	void *C_EncryptInit, *C_Encrypt, *C_EncryptUpdate, *C_EncryptFinal;
+	void *C_DecryptInit, *C_Decrypt, *C_DecryptUpdate, *C_DecryptFinal;
+	void *C_DigestInit, *C_Digest, *C_DigestUpdate, *C_DigestKey, *C_DigestFinal;
+	CK_RV (*C_SignInit)(CK_ULONG, ck_mechanism *, CK_ULONG);
+	CK_RV (*C_Sign)(CK_ULONG, unsigned char *, CK_ULONG, unsigned char *, CK_ULONG *);
+} ck_function_list;
+
+static CK_RV p11_get_function_list(void *lib, ck_function_list **fl) {
+	CK_RV (*get)(ck_function_list **) = (CK_RV (*)(ck_function_list **))dlsym(lib, "C_GetFunctionList");
+	if (get == NULL) {
+		return 0x006; // CKR_FUNCTION_FAILED
+	}
+	return get(fl);
+}
+
+static CK_RV p11_initialize(ck_function_list *f) {
+	ck_c_initialize_args args;
+	memset(&args, 0, sizeof(args));
+	args.flags = 0x002; // CKF_OS_LOCKING_OK
+	return f->C_Initialize(&args);
+}
+
+static CK_RV p11_finalize(ck_function_list *f) {
+	return f->C_Finalize(NULL);
+}
+
+static CK_RV p11_get_slot_list(ck_function_list *f, unsigned char present, CK_ULONG *slots, CK_ULONG *count) {
+	return f->C_GetSlotList(present, slots, count);
+}
+
+static CK_RV p11_get_slot_info(ck_function_list *f, CK_ULONG slot, ck_slot_info *info) {
+	return f->C_GetSlotInfo(slot, info);
+}
+
+static CK_RV p11_get_token_info(ck_function_list *f, CK_ULONG slot, ck_token_info *info) {
+	return f->C_GetTokenInfo(slot, info);
+}
+
+static CK_RV p11_get_mechanism_list(ck_function_list *f, CK_ULONG slot, CK_ULONG *mechanisms, CK_ULONG *count) {
+	return f->C_GetMechanismList(slot, mechanisms, count);
+}
+
+static CK_RV p11_open_session(ck_function_list *f, CK_ULONG slot, CK_ULONG flags, CK_ULONG *session) {
+	return f->C_OpenSession(slot, flags, NULL, NULL, session);
+}
+
+static CK_RV p11_close_session(ck_function_list *f, CK_ULONG session) {
+	return f->C_CloseSession(session);
+}
+
+static CK_RV p11_login(ck_function_list *f, CK_ULONG session, CK_ULONG user, unsigned char *pin, CK_ULONG pin_len) {
+	return f->C_Login(session, user, pin, pin_len);
+}
+
+static CK_RV p11_logout(ck_function_list *f, CK_ULONG session) {
+	return f->C_Logout(session);
+}
+
+static CK_RV p11_get_attribute_value(ck_function_list *f, CK_ULONG session, CK_ULONG object, ck_attribute *attrs, CK_ULONG count) {
+	return f->C_GetAttributeValue(session, object, attrs, count);
+}
+
+static CK_RV p11_find_objects_init(ck_function_list *f, CK_ULONG session, ck_attribute *attrs, CK_ULONG count) {
+	return f->C_FindObjectsInit(session, attrs, count);
+}
+
+static CK_RV p11_find_objects(ck_function_list *f, CK_ULONG session, CK_ULONG *objects, CK_ULONG max, CK_ULONG *count) {
+	return f->C_FindObjects(session, objects, max, count);
+}
+
+static CK_RV p11_find_objects_final(ck_function_list *f, CK_ULONG session) {
+	return f->C_FindObjectsFinal(session);
+}
+
+static CK_RV p11_sign_init(ck_function_list *f, CK_ULONG session, CK_ULONG mechanism, void *param, CK_ULONG param_len, CK_ULONG key) {
+	ck_mechanism m = { mechanism, param, param_len };
+	return f->C_SignInit(session, &m, key);
+}
+
+static CK_RV p11_sign(ck_function_list *f, CK_ULONG session, unsigned char *data, CK_ULONG data_len, unsigned char *sig, CK_ULONG *sig_len) {
+	return f->C_Sign(session, data, data_len, sig, sig_len);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+const ulongSize = C.sizeof_CK_ULONG
+
+// unavailableInformation is CK_UNAVAILABLE_INFORMATION, the length of an attribute the object doesn't have
+const unavailableInformation = ^C.CK_ULONG(0)
+
+type module struct {
+	lib         unsafe.Pointer
+	fl          *C.ck_function_list
+	initialized bool
+}
+
+func open(path string) (Module, error) {
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	lib := C.dlopen(cpath, C.RTLD_NOW|C.RTLD_LOCAL)
+	if lib == nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 module %s: %s", path, C.GoString(C.dlerror()))
+	}
+
+	m := &module{lib: lib}
+	if rv := C.p11_get_function_list(lib, &m.fl); rv != CKR_OK {
+		C.dlclose(lib)
+		return nil, fmt.Errorf("C_GetFunctionList failed for %s: %w", path, Error(rv))
+	}
+
+	// another user of the module in this process has initialized it already, it stays initialized for them
+	switch rv := C.p11_initialize(m.fl); rv {
+	case CKR_OK:
+		m.initialized = true
+	case CKR_CRYPTOKI_ALREADY_INITIALIZED:
+	default:
+		C.dlclose(lib)
+		return nil, fmt.Errorf("C_Initialize failed for %s: %w", path, Error(rv))
+	}
+
+	return m, nil
+}
+
+func (m *module) Finalize() error {
+	var err error
+	if m.initialized {
+		if rv := C.p11_finalize(m.fl); rv != CKR_OK {
+			err = Error(rv)
+		}
+		m.initialized = false
+	}
+	C.dlclose(m.lib)
+	return err
+}
+
+func (m *module) SlotList(tokenPresent bool) ([]uint, error) {
+	var present C.uchar
+	if tokenPresent {
+		present = 1
+	}
+
+	for {
+		var count C.CK_ULONG
+		if rv := C.p11_get_slot_list(m.fl, present, nil, &count); rv != CKR_OK {
+			return nil, Error(rv)
+		}
+		if count == 0 {
+			return nil, nil
+		}
+
+		slots := make([]C.CK_ULONG, count)
+		rv := C.p11_get_slot_list(m.fl, present, &slots[0], &count)
+		if rv == CKR_BUFFER_TOO_SMALL {
+			// a token was inserted between the calls
+			continue
+		}
+		if rv != CKR_OK {
+			return nil, Error(rv)
+		}
+		return fromULongs(slots[:count]), nil
+	}
+}
+
+func (m *module) SlotInfo(slot uint) (SlotInfo, error) {
+	var info C.ck_slot_info
+	if rv := C.p11_get_slot_info(m.fl, C.CK_ULONG(slot), &info); rv != CKR_OK {
+		return SlotInfo{}, Error(rv)
+	}
+	return SlotInfo{
+		Description:  blankPadded(C.GoBytes(unsafe.Pointer(&info.description[0]), 64)),
+		Manufacturer: blankPadded(C.GoBytes(unsafe.Pointer(&info.manufacturer[0]), 32)),
+		Flags:        uint(info.flags),
+	}, nil
+}
+
+func (m *module) TokenInfo(slot uint) (TokenInfo, error) {
+	var info C.ck_token_info
+	if rv := C.p11_get_token_info(m.fl, C.CK_ULONG(slot), &info); rv != CKR_OK {
+		return TokenInfo{}, Error(rv)
+	}
+	return TokenInfo{
+		Label:        blankPadded(C.GoBytes(unsafe.Pointer(&info.label[0]), 32)),
+		Manufacturer: blankPadded(C.GoBytes(unsafe.Pointer(&info.manufacturer[0]), 32)),
+		Model:        blankPadded(C.GoBytes(unsafe.Pointer(&info.model[0]), 16)),
+		SerialNumber: blankPadded(C.GoBytes(unsafe.Pointer(&info.serial_number[0]), 16)),
+		Flags:        uint(info.flags),
+		MinPinLen:    uint(info.min_pin_len),
+		MaxPinLen:    uint(info.max_pin_len),
+	}, nil
+}
+
+func (m *module) MechanismList(slot uint) ([]uint, error) {
+	var count C.CK_ULONG
+	if rv := C.p11_get_mechanism_list(m.fl, C.CK_ULONG(slot), nil, &count); rv != CKR_OK {
+		return nil, Error(rv)
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	mechanisms := make([]C.CK_ULONG, count)
+	if rv := C.p11_get_mechanism_list(m.fl, C.CK_ULONG(slot), &mechanisms[0], &count); rv != CKR_OK {
+		return nil, Error(rv)
+	}
+	return fromULongs(mechanisms[:count]), nil
+}
+
+func (m *module) OpenSession(slot uint, flags uint) (uint, error) {
+	var session C.CK_ULONG
+	if rv := C.p11_open_session(m.fl, C.CK_ULONG(slot), C.CK_ULONG(flags), &session); rv != CKR_OK {
+		return 0, Error(rv)
+	}
+	return uint(session), nil
+}
+
+func (m *module) CloseSession(session uint) error {
+	if rv := C.p11_close_session(m.fl, C.CK_ULONG(session)); rv != CKR_OK {
+		return Error(rv)
+	}
+	return nil
+}
+
+func (m *module) Login(session uint, userType uint, pin []byte) error {
+	var rv C.CK_RV
+	if pin == nil {
+		rv = C.p11_login(m.fl, C.CK_ULONG(session), C.CK_ULONG(userType), nil, 0)
+	} else {
+		cpin := C.CBytes(pin)
+		rv = C.p11_login(m.fl, C.CK_ULONG(session), C.CK_ULONG(userType), (*C.uchar)(cpin), C.CK_ULONG(len(pin)))
+		C.memset(cpin, 0, C.size_t(len(pin)))
+		C.free(cpin)
+	}
+	if rv != CKR_OK {
+		return Error(rv)
+	}
+	return nil
+}
+
+func (m *module) Logout(session uint) error {
+	if rv := C.p11_logout(m.fl, C.CK_ULONG(session)); rv != CKR_OK {
+		return Error(rv)
+	}
+	return nil
+}
+
+func (m *module) FindObjects(session uint, template []*Attribute) ([]uint, error) {
+	attrs, free := cTemplate(template)
+	defer free()
+
+	if rv := C.p11_find_objects_init(m.fl, C.CK_ULONG(session), attrs, C.CK_ULONG(len(template))); rv != CKR_OK {
+		return nil, Error(rv)
+	}
+	defer C.p11_find_objects_final(m.fl, C.CK_ULONG(session))
+
+	var objects []uint
+	handles := make([]C.CK_ULONG, maxObjects)
+	for {
+		var count C.CK_ULONG
+		if rv := C.p11_find_objects(m.fl, C.CK_ULONG(session), &handles[0], maxObjects, &count); rv != CKR_OK {
+			return nil, Error(rv)
+		}
+		if count == 0 {
+			return objects, nil
+		}
+		objects = append(objects, fromULongs(handles[:count])...)
+	}
+}
+
+func (m *module) GetAttributeValue(session uint, object uint, types []uint) ([]*Attribute, error) {
+	template := make([]*Attribute, len(types))
+	for i, t := range types {
+		template[i] = &Attribute{Type: t}
+	}
+	attrs, free := cTemplate(template)
+	defer free()
+	cattrs := unsafe.Slice(attrs, len(types))
+
+	// the first call returns the lengths, attributes the object doesn't have or keeps secret are skipped after it
+	rv := C.p11_get_attribute_value(m.fl, C.CK_ULONG(session), C.CK_ULONG(object), attrs, C.CK_ULONG(len(types)))
+	if rv != CKR_OK && rv != CKR_ATTRIBUTE_SENSITIVE && rv != CKR_ATTRIBUTE_TYPE_INVALID {
+		return nil, Error(rv)
+	}
+	for i := range cattrs {
+		if cattrs[i].value_len == unavailableInformation {
+			cattrs[i].value_len = 0
+			continue
+		}
+		if cattrs[i].value_len > 0 {
+			cattrs[i].value = C.malloc(C.size_t(cattrs[i].value_len))
+		}
+	}
+
+	rv = C.p11_get_attribute_value(m.fl, C.CK_ULONG(session), C.CK_ULONG(object), attrs, C.CK_ULONG(len(types)))
+	if rv != CKR_OK && rv != CKR_ATTRIBUTE_SENSITIVE && rv != CKR_ATTRIBUTE_TYPE_INVALID {
+		return nil, Error(rv)
+	}
+	for i := range cattrs {
+		if cattrs[i].value_len == unavailableInformation {
+			continue
+		}
+		if cattrs[i].value == nil {
+			template[i].Value = []byte{}
+			continue
+		}
+		template[i].Value = C.GoBytes(cattrs[i].value, C.int(cattrs[i].value_len))
+	}
+	return template, nil
+}
+
+func (m *module) SignInit(session uint, mechanism *Mechanism, key uint) error {
+	var param unsafe.Pointer
+	if len(mechanism.Parameter) > 0 {
+		param = C.CBytes(mechanism.Parameter)
+		defer C.free(param)
+	}
+	rv := C.p11_sign_init(m.fl, C.CK_ULONG(session), C.CK_ULONG(mechanism.Mechanism), param,
+		C.CK_ULONG(len(mechanism.Parameter)), C.CK_ULONG(key))
+	if rv != CKR_OK {
+		return Error(rv)
+	}
+	return nil
+}
+
+func (m *module) Sign(session uint, data []byte) ([]byte, error) {
+	cdata := C.CBytes(data)
+	defer C.free(cdata)
+
+	// sign into a buffer that fits any signature the agent makes, some tokens would ask for the PIN twice if the
+	// length was queried first
+	sigLen := C.CK_ULONG(1024)
+	for {
+		sig := make([]byte, sigLen)
+		rv := C.p11_sign(m.fl, C.CK_ULONG(session), (*C.uchar)(cdata), C.CK_ULONG(len(data)), (*C.uchar)(&sig[0]), &sigLen)
+		if rv == CKR_BUFFER_TOO_SMALL {
+			continue
+		}
+		if rv != CKR_OK {
+			return nil, Error(rv)
+		}
+		return sig[:sigLen], nil
+	}
+}
+
+// cTemplate copies a template to C memory, the module keeps pointers to it until the call returns
+func cTemplate(template []*Attribute) (*C.ck_attribute, func()) {
+	if len(template) == 0 {
+		return nil, func() {}
+	}
+
+	attrs := (*C.ck_attribute)(C.calloc(C.size_t(len(template)), C.sizeof_ck_attribute))
+	cattrs := unsafe.Slice(attrs, len(template))
+	for i, a := range template {
+		cattrs[i]._type = C.CK_ULONG(a.Type)
+		if len(a.Value) > 0 {
+			cattrs[i].value = C.CBytes(a.Value)
+			cattrs[i].value_len = C.CK_ULONG(len(a.Value))
+		}
+	}
+
+	return attrs, func() {
+		for i := range cattrs {
+			if cattrs[i].value != nil {
+				C.free(cattrs[i].value)
+			}
+		}
+		C.free(unsafe.Pointer(attrs))
+	}
+}
+
+func fromULongs(values []C.CK_ULONG) []uint {
+	out := make([]uint, len(values))
+	for i, v := range values {
+		out[i] = uint(v)
+	}
+	return out
+}
@@ -0,0 +1,360 @@
+//go:build windows
+
+package pkcs11
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// CK_ULONG is 32 bits on Windows and the Cryptoki structures are packed to 1 byte, they are built in byte buffers
+const ulongSize = 4
+
+const ptrSize = int(unsafe.Sizeof(uintptr(0)))
+
+// unavailableInformation is CK_UNAVAILABLE_INFORMATION, the length of an attribute the object doesn't have
+const unavailableInformation = 0xFFFFFFFF
+
+// indexes into CK_FUNCTION_LIST, after the 2 byte version
+const (
+	fnInitialize         = 0
+	fnFinalize           = 1
+	fnGetSlotList        = 4
+	fnGetSlotInfo        = 5
+	fnGetTokenInfo       = 6
+	fnGetMechanismList   = 7
+	fnOpenSession        = 12
+	fnCloseSession       = 13
+	fnLogin              = 18
+	fnLogout             = 19
+	fnGetAttributeValue  = 24
+	fnFindObjectsInit    = 26
+	fnFindObjects        = 27
+	fnFindObjectsFinal   = 28
+	fnSignInit           = 42
+	fnSign               = 43
+	attributeSize        = 4 + ptrSize + 4
+	slotInfoSize         = 64 + 32 + 4 + 2 + 2
+	tokenInfoSize        = 32 + 32 + 16 + 16 + 4 + 10*4 + 2 + 2 + 16
+	tokenInfoFlagsOffset = 96
+)
+
+type module struct {
+	dll         *windows.DLL
+	fl          unsafe.Pointer
+	initialized bool
+}
+
+func open(path string) (Module, error) {
+	dll, err := windows.LoadDLL(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load PKCS#11 module %s: %w", path, err)
+	}
+
+	getFunctionList, err := dll.FindProc("C_GetFunctionList")
+	if err != nil {
+		dll.Release()
+		return nil, fmt.Errorf("unable to load PKCS#11 module %s: %w", path, err)
+	}
+
+	m := &module{dll: dll}
+	r, _, _ := getFunctionList.Call(uintptr(unsafe.Pointer(&m.fl)))
+	if rv := Error(uint32(r)); rv != CKR_OK {
+		dll.Release()
+		return nil, fmt.Errorf("C_GetFunctionList failed for %s: %w", path, rv)
+	}
+
+	args := make([]byte, 5*ptrSize+4)
+	binary.LittleEndian.PutUint32(args[4*ptrSize:], CKF_OS_LOCKING_OK)
+
+	// another user of the module in this process has initialized it already, it stays initialized for them
+	switch rv := m.call(fnInitialize, uintptr(unsafe.Pointer(&args[0]))); rv {
+	case CKR_OK:
+		m.initialized = true
+	case CKR_CRYPTOKI_ALREADY_INITIALIZED:
+	default:
+		dll.Release()
+		return nil, fmt.Errorf("C_Initialize failed for %s: %w", path, rv)
+	}
+
+	return m, nil
+}
+
+// call calls a function of the module's CK_FUNCTION_LIST
+func (m *module) call(fn int, args ...uintptr) Error {
+	proc := *(*uintptr)(unsafe.Add(m.fl, 2+fn*ptrSize))
+	r, _, _ := syscall.SyscallN(proc, args...)
+	return Error(uint32(r))
+}
+
+func (m *module) Finalize() error {
+	var err error
+	if m.initialized {
+		if rv := m.call(fnFinalize, 0); rv != CKR_OK {
+			err = rv
+		}
+		m.initialized = false
+	}
+	m.dll.Release()
+	return err
+}
+
+func (m *module) SlotList(tokenPresent bool) ([]uint, error) {
+	var present uintptr
+	if tokenPresent {
+		present = 1
+	}
+
+	for {
+		var count uint32
+		if rv := m.call(fnGetSlotList, present, 0, uintptr(unsafe.Pointer(&count))); rv != CKR_OK {
+			return nil, rv
+		}
+		if count == 0 {
+			return nil, nil
+		}
+
+		slots := make([]uint32, count)
+		rv := m.call(fnGetSlotList, present, uintptr(unsafe.Pointer(&slots[0])), uintptr(unsafe.Pointer(&count)))
+		if rv == CKR_BUFFER_TOO_SMALL {
+			// a token was inserted between the calls
+			continue
+		}
+		if rv != CKR_OK {
+			return nil, rv
+		}
+		return fromULongs(slots[:count]), nil
+	}
+}
+
+func (m *module) SlotInfo(slot uint) (SlotInfo, error) {
+	info := make([]byte, slotInfoSize)
+	if rv := m.call(fnGetSlotInfo, uintptr(slot), uintptr(unsafe.Pointer(&info[0]))); rv != CKR_OK {
+		return SlotInfo{}, rv
+	}
+	return SlotInfo{
+		Description:  blankPadded(info[0:64]),
+		Manufacturer: blankPadded(info[64:96]),
+		Flags:        uint(binary.LittleEndian.Uint32(info[96:])),
+	}, nil
+}
+
+func (m *module) TokenInfo(slot uint) (TokenInfo, error) {
+	info := make([]byte, tokenInfoSize)
+	if rv := m.call(fnGetTokenInfo, uintptr(slot), uintptr(unsafe.Pointer(&info[0]))); rv != CKR_OK {
+		return TokenInfo{}, rv
+	}
+	ulong := func(i int) uint {
+		return uint(binary.LittleEndian.Uint32(info[tokenInfoFlagsOffset+i*4:]))
+	}
+	return TokenInfo{
+		Label:        blankPadded(info[0:32]),
+		Manufacturer: blankPadded(info[32:64]),
+		Model:        blankPadded(info[64:80]),
+		SerialNumber: blankPadded(info[80:96]),
+		Flags:        ulong(0),
+		MaxPinLen:    ulong(5),
+		MinPinLen:    ulong(6),
+	}, nil
+}
+
+func (m *module) MechanismList(slot uint) ([]uint, error) {
+	var count uint32
+	if rv := m.call(fnGetMechanismList, uintptr(slot), 0, uintptr(unsafe.Pointer(&count))); rv != CKR_OK {
+		return nil, rv
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	mechanisms := make([]uint32, count)
+	if rv := m.call(fnGetMechanismList, uintptr(slot), uintptr(unsafe.Pointer(&mechanisms[0])), uintptr(unsafe.Pointer(&count))); rv != CKR_OK {
+		return nil, rv
+	}
+	return fromULongs(mechanisms[:count]), nil
+}
+
+func (m *module) OpenSession(slot uint, flags uint) (uint, error) {
+	var session uint32
+	if rv := m.call(fnOpenSession, uintptr(slot), uintptr(flags), 0, 0, uintptr(unsafe.Pointer(&session))); rv != CKR_OK {
+		return 0, rv
+	}
+	return uint(session), nil
+}
+
+func (m *module) CloseSession(session uint) error {
+	if rv := m.call(fnCloseSession, uintptr(session)); rv != CKR_OK {
+		return rv
+	}
+	return nil
+}
+
+func (m *module) Login(session uint, userType uint, pin []byte) error {
+	var rv Error
+	if pin == nil {
+		rv = m.call(fnLogin, uintptr(session), uintptr(userType), 0, 0)
+	} else {
+		buf := make([]byte, len(pin)+1)
+		copy(buf, pin)
+		rv = m.call(fnLogin, uintptr(session), uintptr(userType), uintptr(unsafe.Pointer(&buf[0])), uintptr(len(pin)))
+		for i := range buf {
+			buf[i] = 0
+		}
+	}
+	if rv != CKR_OK {
+		return rv
+	}
+	return nil
+}
+
+func (m *module) Logout(session uint) error {
+	if rv := m.call(fnLogout, uintptr(session)); rv != CKR_OK {
+		return rv
+	}
+	return nil
+}
+
+func (m *module) FindObjects(session uint, template []*Attribute) ([]uint, error) {
+	attrs := newTemplate(template)
+	if rv := m.call(fnFindObjectsInit, uintptr(session), attrs.pointer(), uintptr(len(template))); rv != CKR_OK {
+		return nil, rv
+	}
+	runtime.KeepAlive(attrs)
+	defer m.call(fnFindObjectsFinal, uintptr(session))
+
+	var objects []uint
+	handles := make([]uint32, maxObjects)
+	for {
+		var count uint32
+		if rv := m.call(fnFindObjects, uintptr(session), uintptr(unsafe.Pointer(&handles[0])), maxObjects, uintptr(unsafe.Pointer(&count))); rv != CKR_OK {
+			return nil, rv
+		}
+		if count == 0 {
+			return objects, nil
+		}
+		objects = append(objects, fromULongs(handles[:count])...)
+	}
+}
+
+func (m *module) GetAttributeValue(session uint, object uint, types []uint) ([]*Attribute, error) {
+	template := make([]*Attribute, len(types))
+	for i, t := range types {
+		template[i] = &Attribute{Type: t}
+	}
+	attrs := newTemplate(template)
+
+	// the first call returns the lengths, attributes the object doesn't have or keeps secret are skipped after it
+	rv := m.call(fnGetAttributeValue, uintptr(session), uintptr(object), attrs.pointer(), uintptr(len(types)))
+	if rv != CKR_OK && rv != CKR_ATTRIBUTE_SENSITIVE && rv != CKR_ATTRIBUTE_TYPE_INVALID {
+		return nil, rv
+	}
+	for i := range template {
+		length := attrs.length(i)
+		if length == unavailableInformation {
+			attrs.setValue(i, nil, 0)
+			continue
+		}
+		attrs.setValue(i, make([]byte, length), length)
+	}
+
+	rv = m.call(fnGetAttributeValue, uintptr(session), uintptr(object), attrs.pointer(), uintptr(len(types)))
+	if rv != CKR_OK && rv != CKR_ATTRIBUTE_SENSITIVE && rv != CKR_ATTRIBUTE_TYPE_INVALID {
+		return nil, rv
+	}
+	for i := range template {
+		length := attrs.length(i)
+		if length == unavailableInformation {
+			continue
+		}
+		template[i].Value = attrs.values[i][:length]
+	}
+	runtime.KeepAlive(attrs)
+	return template, nil
+}
+
+func (m *module) SignInit(session uint, mechanism *Mechanism, key uint) error {
+	mech := make([]byte, 4+ptrSize+4)
+	binary.LittleEndian.PutUint32(mech, uint32(mechanism.Mechanism))
+	if len(mechanism.Parameter) > 0 {
+		putPointer(mech[4:], uintptr(unsafe.Pointer(&mechanism.Parameter[0])))
+		binary.LittleEndian.PutUint32(mech[4+ptrSize:], uint32(len(mechanism.Parameter)))
+	}
+
+	rv := m.call(fnSignInit, uintptr(session), uintptr(unsafe.Pointer(&mech[0])), uintptr(key))
+	runtime.KeepAlive(mechanism)
+	if rv != CKR_OK {
+		return rv
+	}
+	return nil
+}
+
+func (m *module) Sign(session uint, data []byte) ([]byte, error) {
+	// sign into a buffer that fits any signature the agent makes, some tokens would ask for the PIN twice if the
+	// length was queried first
+	sigLen := uint32(1024)
+	for {
+		sig := make([]byte, sigLen)
+		rv := m.call(fnSign, uintptr(session), uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)),
+			uintptr(unsafe.Pointer(&sig[0])), uintptr(unsafe.Pointer(&sigLen)))
+		if rv == CKR_BUFFER_TOO_SMALL {
+			continue
+		}
+		if rv != CKR_OK {
+			return nil, rv
+		}
+		return sig[:sigLen], nil
+	}
+}
+
+// packedTemplate is a packed CK_ATTRIBUTE array, values keeps the buffers it points to reachable
+type packedTemplate struct {
+	buf    []byte
+	values [][]byte
+}
+
+func newTemplate(template []*Attribute) *packedTemplate {
+	t := &packedTemplate{buf: make([]byte, attributeSize*(len(template)+1)), values: make([][]byte, len(template))}
+	for i, a := range template {
+		binary.LittleEndian.PutUint32(t.buf[i*attributeSize:], uint32(a.Type))
+		t.setValue(i, a.Value, uint32(len(a.Value)))
+	}
+	return t
+}
+
+func (t *packedTemplate) pointer() uintptr {
+	return uintptr(unsafe.Pointer(&t.buf[0]))
+}
+
+func (t *packedTemplate) length(i int) uint32 {
+	return binary.LittleEndian.Uint32(t.buf[i*attributeSize+4+ptrSize:])
+}
+
+func (t *packedTemplate) setValue(i int, value []byte, length uint32) {
+	t.values[i] = value
+	var p uintptr
+	if len(value) > 0 {
+		p = uintptr(unsafe.Pointer(&value[0]))
+	}
+	putPointer(t.buf[i*attributeSize+4:], p)
+	binary.LittleEndian.PutUint32(t.buf[i*attributeSize+4+ptrSize:], length)
+}
+
+func putPointer(b []byte, p uintptr) {
+	if ptrSize == 4 {
+		binary.LittleEndian.PutUint32(b, uint32(p))
+	} else {
+		binary.LittleEndian.PutUint64(b, uint64(p))
+	}
+}
+
+func fromULongs(values []uint32) []uint {
+	out := make([]uint, len(values))
+	for i, v := range values {
+		out[i] = uint(v)
+	}
+	return out
+}
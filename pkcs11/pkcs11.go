@@ -0,0 +1,270 @@
+// Package pkcs11 is a minimal binding of the PKCS#11 (Cryptoki) API, covering what the agent needs to find keys on
+// tokens and sign with them
+package pkcs11
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	CKR_OK                           = 0x000
+	CKR_CANCEL                       = 0x001
+	CKR_HOST_MEMORY                  = 0x002
+	CKR_SLOT_ID_INVALID              = 0x003
+	CKR_GENERAL_ERROR                = 0x005
+	CKR_FUNCTION_FAILED              = 0x006
+	CKR_ARGUMENTS_BAD                = 0x007
+	CKR_ATTRIBUTE_SENSITIVE          = 0x011
+	CKR_ATTRIBUTE_TYPE_INVALID       = 0x012
+	CKR_DATA_LEN_RANGE               = 0x021
+	CKR_DEVICE_ERROR                 = 0x030
+	CKR_DEVICE_MEMORY                = 0x031
+	CKR_DEVICE_REMOVED               = 0x032
+	CKR_FUNCTION_CANCELED            = 0x050
+	CKR_FUNCTION_NOT_SUPPORTED       = 0x054
+	CKR_KEY_HANDLE_INVALID           = 0x060
+	CKR_KEY_TYPE_INCONSISTENT        = 0x063
+	CKR_KEY_FUNCTION_NOT_PERMITTED   = 0x068
+	CKR_MECHANISM_INVALID            = 0x070
+	CKR_OBJECT_HANDLE_INVALID        = 0x082
+	CKR_OPERATION_ACTIVE             = 0x090
+	CKR_OPERATION_NOT_INITIALIZED    = 0x091
+	CKR_PIN_INCORRECT                = 0x0A0
+	CKR_PIN_INVALID                  = 0x0A1
+	CKR_PIN_LEN_RANGE                = 0x0A2
+	CKR_PIN_EXPIRED                  = 0x0A3
+	CKR_PIN_LOCKED                   = 0x0A4
+	CKR_SESSION_CLOSED               = 0x0B0
+	CKR_SESSION_HANDLE_INVALID       = 0x0B3
+	CKR_TOKEN_NOT_PRESENT            = 0x0E0
+	CKR_TOKEN_NOT_RECOGNIZED         = 0x0E1
+	CKR_USER_ALREADY_LOGGED_IN       = 0x100
+	CKR_USER_NOT_LOGGED_IN           = 0x101
+	CKR_USER_PIN_NOT_INITIALIZED     = 0x102
+	CKR_USER_TYPE_INVALID            = 0x103
+	CKR_BUFFER_TOO_SMALL             = 0x150
+	CKR_CRYPTOKI_NOT_INITIALIZED     = 0x190
+	CKR_CRYPTOKI_ALREADY_INITIALIZED = 0x191
+)
+
+const (
+	CKA_CLASS               = 0x000
+	CKA_TOKEN               = 0x001
+	CKA_PRIVATE             = 0x002
+	CKA_LABEL               = 0x003
+	CKA_VALUE               = 0x011
+	CKA_KEY_TYPE            = 0x100
+	CKA_ID                  = 0x102
+	CKA_SIGN                = 0x108
+	CKA_MODULUS             = 0x120
+	CKA_MODULUS_BITS        = 0x121
+	CKA_PUBLIC_EXPONENT     = 0x122
+	CKA_EC_PARAMS           = 0x180
+	CKA_EC_POINT            = 0x181
+	CKA_ALWAYS_AUTHENTICATE = 0x202
+)
+
+const (
+	CKO_CERTIFICATE = 1
+	CKO_PUBLIC_KEY  = 2
+	CKO_PRIVATE_KEY = 3
+)
+
+const (
+	CKK_RSA = 0x00
+	CKK_EC  = 0x03
+)
+
+const (
+	CKM_RSA_PKCS = 0x0001
+	CKM_ECDSA    = 0x1041
+)
+
+const (
+	// slot flags
+	CKF_TOKEN_PRESENT    = 0x0001
+	CKF_REMOVABLE_DEVICE = 0x0002
+	CKF_HW_SLOT          = 0x0004
+
+	// token flags
+	CKF_LOGIN_REQUIRED                = 0x00000004
+	CKF_USER_PIN_INITIALIZED          = 0x00000008
+	CKF_PROTECTED_AUTHENTICATION_PATH = 0x00000100
+	CKF_TOKEN_INITIALIZED             = 0x00000400
+	CKF_USER_PIN_COUNT_LOW            = 0x00010000
+	CKF_USER_PIN_FINAL_TRY            = 0x00020000
+	CKF_USER_PIN_LOCKED               = 0x00040000
+
+	// session flags
+	CKF_RW_SESSION     = 0x0002
+	CKF_SERIAL_SESSION = 0x0004
+
+	// C_Initialize flags
+	CKF_OS_LOCKING_OK = 0x0002
+)
+
+const (
+	CKU_SO               = 0
+	CKU_USER             = 1
+	CKU_CONTEXT_SPECIFIC = 2
+)
+
+// Error is a CK_RV returned by a module
+type Error uint
+
+var errNames = map[Error]string{
+	CKR_CANCEL:                       "CKR_CANCEL",
+	CKR_HOST_MEMORY:                  "CKR_HOST_MEMORY",
+	CKR_SLOT_ID_INVALID:              "CKR_SLOT_ID_INVALID",
+	CKR_GENERAL_ERROR:                "CKR_GENERAL_ERROR",
+	CKR_FUNCTION_FAILED:              "CKR_FUNCTION_FAILED",
+	CKR_ARGUMENTS_BAD:                "CKR_ARGUMENTS_BAD",
+	CKR_ATTRIBUTE_SENSITIVE:          "CKR_ATTRIBUTE_SENSITIVE",
+	CKR_ATTRIBUTE_TYPE_INVALID:       "CKR_ATTRIBUTE_TYPE_INVALID",
+	CKR_DATA_LEN_RANGE:               "CKR_DATA_LEN_RANGE",
+	CKR_DEVICE_ERROR:                 "CKR_DEVICE_ERROR",
+	CKR_DEVICE_MEMORY:                "CKR_DEVICE_MEMORY",
+	CKR_DEVICE_REMOVED:               "CKR_DEVICE_REMOVED",
+	CKR_FUNCTION_CANCELED:            "CKR_FUNCTION_CANCELED",
+	CKR_FUNCTION_NOT_SUPPORTED:       "CKR_FUNCTION_NOT_SUPPORTED",
+	CKR_KEY_HANDLE_INVALID:           "CKR_KEY_HANDLE_INVALID",
+	CKR_KEY_TYPE_INCONSISTENT:        "CKR_KEY_TYPE_INCONSISTENT",
+	CKR_KEY_FUNCTION_NOT_PERMITTED:   "CKR_KEY_FUNCTION_NOT_PERMITTED",
+	CKR_MECHANISM_INVALID:            "CKR_MECHANISM_INVALID",
+	CKR_OBJECT_HANDLE_INVALID:        "CKR_OBJECT_HANDLE_INVALID",
+	CKR_OPERATION_ACTIVE:             "CKR_OPERATION_ACTIVE",
+	CKR_OPERATION_NOT_INITIALIZED:    "CKR_OPERATION_NOT_INITIALIZED",
+	CKR_PIN_INCORRECT:                "CKR_PIN_INCORRECT",
+	CKR_PIN_INVALID:                  "CKR_PIN_INVALID",
+	CKR_PIN_LEN_RANGE:                "CKR_PIN_LEN_RANGE",
+	CKR_PIN_EXPIRED:                  "CKR_PIN_EXPIRED",
+	CKR_PIN_LOCKED:                   "CKR_PIN_LOCKED",
+	CKR_SESSION_CLOSED:               "CKR_SESSION_CLOSED",
+	CKR_SESSION_HANDLE_INVALID:       "CKR_SESSION_HANDLE_INVALID",
+	CKR_TOKEN_NOT_PRESENT:            "CKR_TOKEN_NOT_PRESENT",
+	CKR_TOKEN_NOT_RECOGNIZED:         "CKR_TOKEN_NOT_RECOGNIZED",
+	CKR_USER_ALREADY_LOGGED_IN:       "CKR_USER_ALREADY_LOGGED_IN",
+	CKR_USER_NOT_LOGGED_IN:           "CKR_USER_NOT_LOGGED_IN",
+	CKR_USER_PIN_NOT_INITIALIZED:     "CKR_USER_PIN_NOT_INITIALIZED",
+	CKR_USER_TYPE_INVALID:            "CKR_USER_TYPE_INVALID",
+	CKR_BUFFER_TOO_SMALL:             "CKR_BUFFER_TOO_SMALL",
+	CKR_CRYPTOKI_NOT_INITIALIZED:     "CKR_CRYPTOKI_NOT_INITIALIZED",
+	CKR_CRYPTOKI_ALREADY_INITIALIZED: "CKR_CRYPTOKI_ALREADY_INITIALIZED",
+}
+
+func (e Error) Error() string {
+	if name, ok := errNames[e]; ok {
+		return fmt.Sprintf("pkcs11: 0x%X: %s", uint(e), name)
+	}
+	return fmt.Sprintf("pkcs11: 0x%X", uint(e))
+}
+
+// Attribute is a CK_ATTRIBUTE, Value is nil for attributes the token doesn't have or won't reveal
+type Attribute struct {
+	Type  uint
+	Value []byte
+}
+
+// NewAttribute encodes a bool, uint, string or []byte value the way the module expects it
+func NewAttribute(typ uint, value interface{}) *Attribute {
+	a := &Attribute{Type: typ}
+	switch v := value.(type) {
+	case bool:
+		if v {
+			a.Value = []byte{1}
+		} else {
+			a.Value = []byte{0}
+		}
+	case int:
+		a.Value = encodeULong(uint(v))
+	case uint:
+		a.Value = encodeULong(v)
+	case string:
+		a.Value = []byte(v)
+	case []byte:
+		a.Value = v
+	default:
+		panic(fmt.Sprintf("pkcs11: unsupported attribute value %T", value))
+	}
+	return a
+}
+
+// ULong decodes a CK_ULONG attribute value
+func (a *Attribute) ULong() (uint, error) {
+	if len(a.Value) != ulongSize {
+		return 0, fmt.Errorf("pkcs11: attribute 0x%X has %d bytes, not a CK_ULONG", a.Type, len(a.Value))
+	}
+	if ulongSize == 4 {
+		return uint(binary.LittleEndian.Uint32(a.Value)), nil
+	}
+	return uint(binary.LittleEndian.Uint64(a.Value)), nil
+}
+
+func encodeULong(v uint) []byte {
+	b := make([]byte, ulongSize)
+	if ulongSize == 4 {
+		binary.LittleEndian.PutUint32(b, uint32(v))
+	} else {
+		binary.LittleEndian.PutUint64(b, uint64(v))
+	}
+	return b
+}
+
+// Mechanism is a CK_MECHANISM
+type Mechanism struct {
+	Mechanism uint
+	Parameter []byte
+}
+
+type SlotInfo struct {
+	Description  string
+	Manufacturer string
+	Flags        uint
+}
+
+type TokenInfo struct {
+	Label        string
+	Manufacturer string
+	Model        string
+	SerialNumber string
+	Flags        uint
+	MinPinLen    uint
+	MaxPinLen    uint
+}
+
+// Module is a loaded PKCS#11 module. Slots, sessions and objects are the module's CK_ULONG handles. The module is
+// initialized for use from several goroutines.
+type Module interface {
+	SlotList(tokenPresent bool) ([]uint, error)
+	SlotInfo(slot uint) (SlotInfo, error)
+	TokenInfo(slot uint) (TokenInfo, error)
+	MechanismList(slot uint) ([]uint, error)
+	OpenSession(slot uint, flags uint) (uint, error)
+	CloseSession(session uint) error
+	// Login logs the user type in with pin, a nil pin leaves the PIN entry to the token's protected authentication
+	// path, e.g. a PIN pad on the reader
+	Login(session uint, userType uint, pin []byte) error
+	Logout(session uint) error
+	FindObjects(session uint, template []*Attribute) ([]uint, error)
+	// GetAttributeValue returns the requested attributes, leaving the value nil for those the object doesn't have
+	GetAttributeValue(session uint, object uint, types []uint) ([]*Attribute, error)
+	SignInit(session uint, mechanism *Mechanism, key uint) error
+	Sign(session uint, data []byte) ([]byte, error)
+	// Finalize finishes the use of the module and unloads it
+	Finalize() error
+}
+
+// Open loads the module at path and initializes it
+func Open(path string) (Module, error) {
+	return open(path)
+}
+
+// blankPadded trims the blank padding of the fixed length strings in the info structures
+func blankPadded(b []byte) string {
+	return strings.TrimRight(string(b), " \x00")
+}
+
+// maxObjects is the number of handles requested from C_FindObjects at a time
+const maxObjects = 32
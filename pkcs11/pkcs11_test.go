@@ -0,0 +1,230 @@
+//go:build cgo || windows
+
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testTokenLabel = "ncryptagent-test"
+	testUserPIN    = "123456"
+	testSOPIN      = "12345678"
+)
+
+// sha256DigestInfo is the DigestInfo prefix for a SHA-256 digest
+var sha256DigestInfo = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+// softHSMModule returns the SoftHSM module from PKCS11_TEST_MODULE or the usual install locations
+func softHSMModule() string {
+	if path := os.Getenv("PKCS11_TEST_MODULE"); path != "" {
+		return path
+	}
+	for _, path := range []string{
+		"/usr/lib/softhsm/libsofthsm2.so",
+		"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+		"/usr/lib64/pkcs11/libsofthsm2.so",
+		"/usr/local/lib/softhsm/libsofthsm2.so",
+		"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+		`C:\SoftHSM2\lib\softhsm2-x64.dll`,
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// softHSMToken initializes a token in a temporary SoftHSM store and imports the keys, skipping the test without
+// SoftHSM
+func softHSMToken(t *testing.T, keys map[string]crypto.Signer) string {
+	t.Helper()
+	module := softHSMModule()
+	if module == "" {
+		t.Skip("SoftHSM not found, set PKCS11_TEST_MODULE to the module")
+	}
+	util, err := exec.LookPath("softhsm2-util")
+	if err != nil {
+		t.Skip("softhsm2-util not found")
+	}
+
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err = os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err = os.WriteFile(conf, []byte("directories.tokendir = "+tokens+"\nobjectstore.backend = file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	run := func(args ...string) {
+		t.Helper()
+		if out, err := exec.Command(util, args...).CombinedOutput(); err != nil {
+			t.Fatalf("softhsm2-util %v: %s\n%s", args, err, out)
+		}
+	}
+	run("--init-token", "--free", "--label", testTokenLabel, "--pin", testUserPIN, "--so-pin", testSOPIN)
+
+	id := 1
+	for label, key := range keys {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, label+".pem")
+		if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		run("--import", path, "--token", testTokenLabel, "--label", label, "--id", fmt.Sprintf("%02x", id), "--pin", testUserPIN)
+		id++
+	}
+	return module
+}
+
+func TestSoftHSM(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := softHSMToken(t, map[string]crypto.Signer{"ec": ecKey, "rsa": rsaKey})
+
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Finalize()
+
+	slots, err := m.SlotList(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot, found := uint(0), false
+	for _, s := range slots {
+		info, err := m.TokenInfo(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Label == testTokenLabel {
+			if info.Flags&CKF_TOKEN_INITIALIZED == 0 || info.Flags&CKF_LOGIN_REQUIRED == 0 {
+				t.Errorf("token flags 0x%x", info.Flags)
+			}
+			slot, found = s, true
+		}
+	}
+	if !found {
+		t.Fatalf("token %s not in slots %v", testTokenLabel, slots)
+	}
+
+	mechanisms, err := m.MechanismList(slot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mechanism := range []uint{CKM_RSA_PKCS, CKM_ECDSA} {
+		supported := false
+		for _, mech := range mechanisms {
+			supported = supported || mech == mechanism
+		}
+		if !supported {
+			t.Errorf("mechanism 0x%x not listed", mechanism)
+		}
+	}
+
+	session, err := m.OpenSession(slot, CKF_SERIAL_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.CloseSession(session)
+
+	if err = m.Login(session, CKU_USER, []byte("000000")); err != Error(CKR_PIN_INCORRECT) {
+		t.Fatalf("login with the wrong PIN returned %v", err)
+	}
+	if err = m.Login(session, CKU_USER, []byte(testUserPIN)); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Logout(session)
+
+	// findKey returns the private key with label and checks its key type
+	findKey := func(t *testing.T, label string, keyType uint) uint {
+		t.Helper()
+		objects, err := m.FindObjects(session, []*Attribute{NewAttribute(CKA_CLASS, CKO_PRIVATE_KEY), NewAttribute(CKA_LABEL, label)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(objects) != 1 {
+			t.Fatalf("found %d private keys labeled %s", len(objects), label)
+		}
+		attrs, err := m.GetAttributeValue(session, objects[0], []uint{CKA_KEY_TYPE, CKA_SIGN, CKA_EC_POINT})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ, err := attrs[0].ULong(); err != nil || typ != keyType {
+			t.Fatalf("key type %d, %v", typ, err)
+		}
+		if !bytes.Equal(attrs[1].Value, []byte{1}) {
+			t.Fatalf("CKA_SIGN %v", attrs[1].Value)
+		}
+		return objects[0]
+	}
+
+	digest := sha256.Sum256([]byte("signed by the token"))
+
+	t.Run("ecdsa", func(t *testing.T) {
+		key := findKey(t, "ec", CKK_EC)
+		if err := m.SignInit(session, &Mechanism{Mechanism: CKM_ECDSA}, key); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := m.Sign(session, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sig) != 64 {
+			t.Fatalf("signature is %d bytes", len(sig))
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(&ecKey.PublicKey, digest[:], r, s) {
+			t.Fatal("signature doesn't verify")
+		}
+	})
+
+	t.Run("rsa", func(t *testing.T) {
+		key := findKey(t, "rsa", CKK_RSA)
+		attrs, err := m.GetAttributeValue(session, key, []uint{CKA_MODULUS})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if new(big.Int).SetBytes(attrs[0].Value).Cmp(rsaKey.N) != 0 {
+			t.Fatal("modulus doesn't match the imported key")
+		}
+		if err = m.SignInit(session, &Mechanism{Mechanism: CKM_RSA_PKCS}, key); err != nil {
+			t.Fatal(err)
+		}
+		sig, err := m.Sign(session, append(append([]byte{}, sha256DigestInfo...), digest[:]...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
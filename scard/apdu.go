@@ -0,0 +1,175 @@
+package scard
+
+import (
+	"fmt"
+)
+
+// Transmitter sends a command APDU to a card and returns the response APDU, status word included. Card and Conn
+// talk to real cards, Script and the applet emulators stand in for them.
+type Transmitter interface {
+	Transmit(apdu []byte) ([]byte, error)
+}
+
+const (
+	SW_OK                        = 0x9000
+	SW_VERIFY_FAILED             = 0x6300
+	SW_WRONG_LENGTH              = 0x6700
+	SW_SECURITY_STATUS           = 0x6982
+	SW_AUTH_BLOCKED              = 0x6983
+	SW_DATA_INVALID              = 0x6984
+	SW_CONDITIONS_NOT_SATISFIED  = 0x6985
+	SW_COMMAND_NOT_ALLOWED       = 0x6986
+	SW_WRONG_DATA                = 0x6A80
+	SW_FUNCTION_NOT_SUPPORTED    = 0x6A81
+	SW_FILE_NOT_FOUND            = 0x6A82
+	SW_NOT_ENOUGH_MEMORY         = 0x6A84
+	SW_INCORRECT_P1P2            = 0x6A86
+	SW_REFERENCED_DATA_NOT_FOUND = 0x6A88
+	SW_WRONG_P1P2                = 0x6B00
+	SW_INS_NOT_SUPPORTED         = 0x6D00
+	SW_CLA_NOT_SUPPORTED         = 0x6E00
+	SW_UNKNOWN                   = 0x6F00
+)
+
+var swNames = map[uint16]string{
+	SW_VERIFY_FAILED:             "verification failed",
+	SW_WRONG_LENGTH:              "wrong length",
+	SW_SECURITY_STATUS:           "security status not satisfied",
+	SW_AUTH_BLOCKED:              "authentication method blocked",
+	SW_DATA_INVALID:              "reference data not usable",
+	SW_CONDITIONS_NOT_SATISFIED:  "conditions of use not satisfied",
+	SW_COMMAND_NOT_ALLOWED:       "command not allowed",
+	SW_WRONG_DATA:                "incorrect data",
+	SW_FUNCTION_NOT_SUPPORTED:    "function not supported",
+	SW_FILE_NOT_FOUND:            "file or application not found",
+	SW_NOT_ENOUGH_MEMORY:         "not enough memory",
+	SW_INCORRECT_P1P2:            "incorrect P1 or P2",
+	SW_REFERENCED_DATA_NOT_FOUND: "referenced data not found",
+	SW_WRONG_P1P2:                "wrong P1 or P2",
+	SW_INS_NOT_SUPPORTED:         "instruction not supported",
+	SW_CLA_NOT_SUPPORTED:         "class not supported",
+	SW_UNKNOWN:                   "unknown error",
+}
+
+// StatusError is a status word other than 9000
+type StatusError uint16
+
+func (e StatusError) Error() string {
+	if retries, ok := e.Retries(); ok {
+		return fmt.Sprintf("card status %04X: verification failed, %d tries left", uint16(e), retries)
+	}
+	if name, ok := swNames[uint16(e)]; ok {
+		return fmt.Sprintf("card status %04X: %s", uint16(e), name)
+	}
+	return fmt.Sprintf("card status %04X", uint16(e))
+}
+
+// Retries returns the tries left of a 63Cx status word
+func (e StatusError) Retries() (int, bool) {
+	if e&0xFFF0 == 0x63C0 {
+		return int(e & 0x000F), true
+	}
+	return 0, false
+}
+
+// Command is a command APDU. Data longer than 255 bytes is sent with command chaining.
+type Command struct {
+	Cla, Ins, P1, P2 byte
+	Data             []byte
+	// Le is the length of the expected response, 0 for none and 256 to take whatever the card returns
+	Le int
+}
+
+// Bytes encodes the command as a short APDU
+func (c Command) Bytes() []byte {
+	apdu := []byte{c.Cla, c.Ins, c.P1, c.P2}
+	if len(c.Data) > 0 {
+		apdu = append(apdu, byte(len(c.Data)))
+		apdu = append(apdu, c.Data...)
+	}
+	if c.Le > 0 {
+		apdu = append(apdu, byte(c.Le))
+	}
+	return apdu
+}
+
+// Response is a response APDU
+type Response struct {
+	Data []byte
+	SW   uint16
+}
+
+// Err returns the status word as a StatusError unless it is 9000
+func (r *Response) Err() error {
+	if r.SW == SW_OK {
+		return nil
+	}
+	return StatusError(r.SW)
+}
+
+// ParseResponse splits a response APDU into its data and status word
+func ParseResponse(apdu []byte) (*Response, error) {
+	if len(apdu) < 2 {
+		return nil, fmt.Errorf("response APDU of %d bytes has no status word", len(apdu))
+	}
+	n := len(apdu) - 2
+	return &Response{Data: apdu[:n], SW: uint16(apdu[n])<<8 | uint16(apdu[n+1])}, nil
+}
+
+// Exchange sends a command, chaining data that doesn't fit a short APDU, and collects a response the card returns in
+// parts with GET RESPONSE. An error is only returned when the transmission fails, a card that rejects the command
+// returns a Response with the status word.
+func Exchange(t Transmitter, cmd Command) (*Response, error) {
+	data := cmd.Data
+	for len(data) > 255 {
+		part := Command{Cla: cmd.Cla | 0x10, Ins: cmd.Ins, P1: cmd.P1, P2: cmd.P2, Data: data[:255]}
+		resp, err := transmitCommand(t, part)
+		if err != nil {
+			return nil, err
+		}
+		if resp.SW != SW_OK {
+			return resp, nil
+		}
+		data = data[255:]
+	}
+
+	last := cmd
+	last.Data = data
+	resp, err := transmitCommand(t, last)
+	if err != nil {
+		return nil, err
+	}
+
+	// the card asks for the command again with the right Le
+	if resp.SW&0xFF00 == 0x6C00 {
+		last.Le = int(resp.SW & 0xFF)
+		if last.Le == 0 {
+			last.Le = 256
+		}
+		if resp, err = transmitCommand(t, last); err != nil {
+			return nil, err
+		}
+	}
+
+	collected := resp.Data
+	for resp.SW&0xFF00 == 0x6100 {
+		le := int(resp.SW & 0xFF)
+		if le == 0 {
+			le = 256
+		}
+		if resp, err = transmitCommand(t, Command{Cla: cmd.Cla &^ 0x10, Ins: 0xC0, Le: le}); err != nil {
+			return nil, err
+		}
+		collected = append(collected, resp.Data...)
+	}
+	resp.Data = collected
+	return resp, nil
+}
+
+func transmitCommand(t Transmitter, cmd Command) (*Response, error) {
+	apdu, err := t.Transmit(cmd.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return ParseResponse(apdu)
+}
@@ -0,0 +1,344 @@
+// Package scard is a binding of the PC/SC smart card API, winscard on Windows and pcsclite elsewhere, with the APDU
+// helpers the card applets build on
+package scard
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	SCARD_SCOPE_USER   = 0
+	SCARD_SCOPE_SYSTEM = 2
+
+	SCARD_SHARE_EXCLUSIVE = 1
+	SCARD_SHARE_SHARED    = 2
+	SCARD_SHARE_DIRECT    = 3
+
+	SCARD_PROTOCOL_T0 = 0x0001
+	SCARD_PROTOCOL_T1 = 0x0002
+
+	SCARD_LEAVE_CARD   = 0
+	SCARD_RESET_CARD   = 1
+	SCARD_UNPOWER_CARD = 2
+
+	SCARD_STATE_UNAWARE     = 0x0000
+	SCARD_STATE_IGNORE      = 0x0001
+	SCARD_STATE_CHANGED     = 0x0002
+	SCARD_STATE_UNKNOWN     = 0x0004
+	SCARD_STATE_UNAVAILABLE = 0x0008
+	SCARD_STATE_EMPTY       = 0x0010
+	SCARD_STATE_PRESENT     = 0x0020
+	SCARD_STATE_ATRMATCH    = 0x0040
+	SCARD_STATE_EXCLUSIVE   = 0x0080
+	SCARD_STATE_INUSE       = 0x0100
+	SCARD_STATE_MUTE        = 0x0200
+
+	// INFINITE is the timeout of a GetStatusChange that waits until a reader changes
+	INFINITE = 0xFFFFFFFF
+)
+
+const (
+	SCARD_F_INTERNAL_ERROR       = 0x80100001
+	SCARD_E_CANCELLED            = 0x80100002
+	SCARD_E_INVALID_HANDLE       = 0x80100003
+	SCARD_E_INVALID_PARAMETER    = 0x80100004
+	SCARD_E_NO_MEMORY            = 0x80100006
+	SCARD_E_INSUFFICIENT_BUFFER  = 0x80100008
+	SCARD_E_UNKNOWN_READER       = 0x80100009
+	SCARD_E_TIMEOUT              = 0x8010000A
+	SCARD_E_SHARING_VIOLATION    = 0x8010000B
+	SCARD_E_NO_SMARTCARD         = 0x8010000C
+	SCARD_E_PROTO_MISMATCH       = 0x8010000F
+	SCARD_E_NOT_READY            = 0x80100010
+	SCARD_E_NOT_TRANSACTED       = 0x80100016
+	SCARD_E_READER_UNAVAILABLE   = 0x80100017
+	SCARD_E_NO_SERVICE           = 0x8010001D
+	SCARD_E_SERVICE_STOPPED      = 0x8010001E
+	SCARD_E_NO_READERS_AVAILABLE = 0x8010002E
+	SCARD_W_UNRESPONSIVE_CARD    = 0x80100066
+	SCARD_W_UNPOWERED_CARD       = 0x80100067
+	SCARD_W_RESET_CARD           = 0x80100068
+	SCARD_W_REMOVED_CARD         = 0x80100069
+)
+
+// Error is an SCARD_E_ or SCARD_W_ code returned by the PC/SC service
+type Error uint32
+
+var errNames = map[Error]string{
+	SCARD_F_INTERNAL_ERROR:       "SCARD_F_INTERNAL_ERROR",
+	SCARD_E_CANCELLED:            "SCARD_E_CANCELLED",
+	SCARD_E_INVALID_HANDLE:       "SCARD_E_INVALID_HANDLE",
+	SCARD_E_INVALID_PARAMETER:    "SCARD_E_INVALID_PARAMETER",
+	SCARD_E_NO_MEMORY:            "SCARD_E_NO_MEMORY",
+	SCARD_E_INSUFFICIENT_BUFFER:  "SCARD_E_INSUFFICIENT_BUFFER",
+	SCARD_E_UNKNOWN_READER:       "SCARD_E_UNKNOWN_READER",
+	SCARD_E_TIMEOUT:              "SCARD_E_TIMEOUT",
+	SCARD_E_SHARING_VIOLATION:    "SCARD_E_SHARING_VIOLATION",
+	SCARD_E_NO_SMARTCARD:         "SCARD_E_NO_SMARTCARD",
+	SCARD_E_PROTO_MISMATCH:       "SCARD_E_PROTO_MISMATCH",
+	SCARD_E_NOT_READY:            "SCARD_E_NOT_READY",
+	SCARD_E_NOT_TRANSACTED:       "SCARD_E_NOT_TRANSACTED",
+	SCARD_E_READER_UNAVAILABLE:   "SCARD_E_READER_UNAVAILABLE",
+	SCARD_E_NO_SERVICE:           "SCARD_E_NO_SERVICE",
+	SCARD_E_SERVICE_STOPPED:      "SCARD_E_SERVICE_STOPPED",
+	SCARD_E_NO_READERS_AVAILABLE: "SCARD_E_NO_READERS_AVAILABLE",
+	SCARD_W_UNRESPONSIVE_CARD:    "SCARD_W_UNRESPONSIVE_CARD",
+	SCARD_W_UNPOWERED_CARD:       "SCARD_W_UNPOWERED_CARD",
+	SCARD_W_RESET_CARD:           "SCARD_W_RESET_CARD",
+	SCARD_W_REMOVED_CARD:         "SCARD_W_REMOVED_CARD",
+}
+
+func (e Error) Error() string {
+	if name, ok := errNames[e]; ok {
+		return fmt.Sprintf("scard: 0x%08X: %s", uint32(e), name)
+	}
+	return fmt.Sprintf("scard: 0x%08X", uint32(e))
+}
+
+// CardGone reports whether err means the card was removed or reset, or its reader went away, so the connection to it
+// is of no further use
+func CardGone(err error) bool {
+	var e Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	switch e {
+	case SCARD_W_REMOVED_CARD, SCARD_W_RESET_CARD, SCARD_W_UNPOWERED_CARD, SCARD_W_UNRESPONSIVE_CARD,
+		SCARD_E_NO_SMARTCARD, SCARD_E_READER_UNAVAILABLE, SCARD_E_UNKNOWN_READER, SCARD_E_INVALID_HANDLE,
+		SCARD_E_NO_SERVICE, SCARD_E_SERVICE_STOPPED:
+		return true
+	}
+	return false
+}
+
+// ReaderState is an SCARD_READERSTATE for GetStatusChange. CurrentState is the state the caller knows of,
+// EventState and ATR are filled in with the reader's state.
+type ReaderState struct {
+	Reader       string
+	CurrentState uint32
+	EventState   uint32
+	ATR          []byte
+}
+
+// CardStatus is the result of SCardStatus
+type CardStatus struct {
+	Reader   string
+	State    uint32
+	Protocol uint32
+	ATR      []byte
+}
+
+// Context is an SCARDCONTEXT, a connection to the PC/SC service
+type Context struct {
+	handle uintptr
+}
+
+// EstablishContext connects to the PC/SC service
+func EstablishContext() (*Context, error) {
+	h, err := establishContext(SCARD_SCOPE_USER)
+	if err != nil {
+		return nil, err
+	}
+	return &Context{handle: h}, nil
+}
+
+func (c *Context) Release() error {
+	return releaseContext(c.handle)
+}
+
+// ListReaders returns the names of the readers, no readers is not an error
+func (c *Context) ListReaders() ([]string, error) {
+	readers, err := listReaders(c.handle)
+	if errors.Is(err, Error(SCARD_E_NO_READERS_AVAILABLE)) {
+		return nil, nil
+	}
+	return readers, err
+}
+
+// GetStatusChange waits until the state of one of the readers differs from its CurrentState, or the timeout passes
+// with SCARD_E_TIMEOUT. A timeout of INFINITE*time.Millisecond or more waits forever.
+func (c *Context) GetStatusChange(states []ReaderState, timeout time.Duration) error {
+	ms := uint32(INFINITE)
+	if timeout < INFINITE*time.Millisecond {
+		ms = uint32(timeout / time.Millisecond)
+	}
+	return getStatusChange(c.handle, ms, states)
+}
+
+// Cancel makes a GetStatusChange that is waiting on the context return SCARD_E_CANCELLED
+func (c *Context) Cancel() error {
+	return cancel(c.handle)
+}
+
+// Connect connects to the card in a reader
+func (c *Context) Connect(reader string, shareMode uint32, protocols uint32) (*Card, error) {
+	h, protocol, err := connect(c.handle, reader, shareMode, protocols)
+	if err != nil {
+		return nil, err
+	}
+	return &Card{handle: h, protocol: protocol}, nil
+}
+
+// Card is an SCARDHANDLE, a connection to a card
+type Card struct {
+	handle   uintptr
+	protocol uint32
+}
+
+// Protocol is the SCARD_PROTOCOL_ the card was connected with
+func (c *Card) Protocol() uint32 {
+	return c.protocol
+}
+
+// Transmit sends a command APDU and returns the response APDU, status word included
+func (c *Card) Transmit(apdu []byte) ([]byte, error) {
+	return transmit(c.handle, c.protocol, apdu)
+}
+
+func (c *Card) Status() (*CardStatus, error) {
+	return status(c.handle)
+}
+
+// Reconnect connects again after the card was reset, initialization is the disposition applied to the card first
+func (c *Card) Reconnect(shareMode uint32, protocols uint32, initialization uint32) error {
+	protocol, err := reconnect(c.handle, shareMode, protocols, initialization)
+	if err != nil {
+		return err
+	}
+	c.protocol = protocol
+	return nil
+}
+
+// BeginTransaction keeps other applications from using the card until EndTransaction
+func (c *Card) BeginTransaction() error {
+	return beginTransaction(c.handle)
+}
+
+func (c *Card) EndTransaction(disposition uint32) error {
+	return endTransaction(c.handle, disposition)
+}
+
+func (c *Card) Disconnect(disposition uint32) error {
+	return disconnect(c.handle, disposition)
+}
+
+// Connector finds cards, in the PC/SC readers for System() or in emulated readers
+type Connector interface {
+	// ListReaders returns the readers, with or without a card
+	ListReaders() ([]string, error)
+	// Open connects to the card in a reader, sharing it with other applications
+	Open(reader string) (Conn, error)
+}
+
+// Conn is a shared connection to a card. Other applications can select another applet between transactions.
+type Conn interface {
+	Transmitter
+	BeginTransaction() error
+	EndTransaction() error
+	Close() error
+}
+
+// System returns the Connector of the PC/SC readers. The context with the PC/SC service is established on first use
+// and again after the service was restarted.
+func System() Connector {
+	return &systemConnector{}
+}
+
+type systemConnector struct {
+	mu  sync.Mutex
+	ctx *Context
+}
+
+func (s *systemConnector) context() (*Context, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil {
+		ctx, err := EstablishContext()
+		if err != nil {
+			return nil, fmt.Errorf("unable to connect to the smart card service: %w", err)
+		}
+		s.ctx = ctx
+	}
+	return s.ctx, nil
+}
+
+// retry runs f with the context, establishing a new one when the service went away since the last use
+func (s *systemConnector) retry(f func(ctx *Context) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var ctx *Context
+		if ctx, err = s.context(); err != nil {
+			return err
+		}
+		err = f(ctx)
+		if !errors.Is(err, Error(SCARD_E_INVALID_HANDLE)) && !errors.Is(err, Error(SCARD_E_NO_SERVICE)) &&
+			!errors.Is(err, Error(SCARD_E_SERVICE_STOPPED)) {
+			return err
+		}
+
+		s.mu.Lock()
+		if s.ctx == ctx {
+			ctx.Release()
+			s.ctx = nil
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *systemConnector) ListReaders() ([]string, error) {
+	var readers []string
+	err := s.retry(func(ctx *Context) error {
+		var err error
+		readers, err = ctx.ListReaders()
+		return err
+	})
+	return readers, err
+}
+
+func (s *systemConnector) Open(reader string) (Conn, error) {
+	var card *Card
+	err := s.retry(func(ctx *Context) error {
+		var err error
+		card, err = ctx.Connect(reader, SCARD_SHARE_SHARED, SCARD_PROTOCOL_T0|SCARD_PROTOCOL_T1)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sharedCard{card}, nil
+}
+
+// sharedCard leaves the card as it is at the end of transactions and on Close
+type sharedCard struct {
+	*Card
+}
+
+func (c *sharedCard) EndTransaction() error {
+	return c.Card.EndTransaction(SCARD_LEAVE_CARD)
+}
+
+func (c *sharedCard) Close() error {
+	return c.Card.Disconnect(SCARD_LEAVE_CARD)
+}
+
+// multiString splits a list of NUL terminated strings that ends with an empty one
+func multiString(b []byte) []string {
+	var list []string
+	start := 0
+	for i, c := range b {
+		if c != 0 {
+			continue
+		}
+		if i == start {
+			break
+		}
+		list = append(list, string(b[start:i]))
+		start = i + 1
+	}
+	return list
+}
@@ -0,0 +1,55 @@
+//go:build !cgo && !windows
+
+package scard
+
+import "fmt"
+
+var errNoCgo = fmt.Errorf("smart cards need a build with cgo support")
+
+func establishContext(scope uint32) (uintptr, error) {
+	return 0, errNoCgo
+}
+
+func releaseContext(ctx uintptr) error {
+	return errNoCgo
+}
+
+func listReaders(ctx uintptr) ([]string, error) {
+	return nil, errNoCgo
+}
+
+func getStatusChange(ctx uintptr, timeout uint32, states []ReaderState) error {
+	return errNoCgo
+}
+
+func cancel(ctx uintptr) error {
+	return errNoCgo
+}
+
+func connect(ctx uintptr, reader string, shareMode uint32, protocols uint32) (uintptr, uint32, error) {
+	return 0, 0, errNoCgo
+}
+
+func reconnect(card uintptr, shareMode uint32, protocols uint32, initialization uint32) (uint32, error) {
+	return 0, errNoCgo
+}
+
+func disconnect(card uintptr, disposition uint32) error {
+	return errNoCgo
+}
+
+func beginTransaction(card uintptr) error {
+	return errNoCgo
+}
+
+func endTransaction(card uintptr, disposition uint32) error {
+	return errNoCgo
+}
+
+func status(card uintptr) (*CardStatus, error) {
+	return nil, errNoCgo
+}
+
+func transmit(card uintptr, protocol uint32, apdu []byte) ([]byte, error) {
+	return nil, errNoCgo
+}
@@ -0,0 +1,306 @@
+//go:build cgo && !windows
+
+package scard
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+// the subset of winscard.h the agent uses. pcsclite's DWORD and LONG are unsigned long and long, the PC/SC framework
+// of macOS uses 32 bit types and packs its structures.
+
+#ifdef __APPLE__
+typedef uint32_t DWORD;
+typedef int32_t LONG;
+#pragma pack(push, 1)
+#else
+typedef unsigned long DWORD;
+typedef long LONG;
+#endif
+
+typedef LONG SCARDCONTEXT;
+typedef LONG SCARDHANDLE;
+
+typedef struct {
+	DWORD protocol;
+	DWORD pci_length;
+} io_request;
+
+typedef struct {
+	const char *reader;
+	void *user_data;
+	DWORD current_state;
+	DWORD event_state;
+	DWORD atr_len;
+	unsigned char atr[33];
+} reader_state;
+
+#ifdef __APPLE__
+#pragma pack(pop)
+#endif
+
+static struct {
+	LONG (*establish_context)(DWORD, const void *, const void *, SCARDCONTEXT *);
+	LONG (*release_context)(SCARDCONTEXT);
+	LONG (*list_readers)(SCARDCONTEXT, const char *, char *, DWORD *);
+	LONG (*get_status_change)(SCARDCONTEXT, DWORD, reader_state *, DWORD);
+	LONG (*cancel)(SCARDCONTEXT);
+	LONG (*connect)(SCARDCONTEXT, const char *, DWORD, DWORD, SCARDHANDLE *, DWORD *);
+	LONG (*reconnect)(SCARDHANDLE, DWORD, DWORD, DWORD, DWORD *);
+	LONG (*disconnect)(SCARDHANDLE, DWORD);
+	LONG (*begin_transaction)(SCARDHANDLE);
+	LONG (*end_transaction)(SCARDHANDLE, DWORD);
+	LONG (*status)(SCARDHANDLE, char *, DWORD *, DWORD *, DWORD *, unsigned char *, DWORD *);
+	LONG (*transmit)(SCARDHANDLE, const io_request *, const unsigned char *, DWORD, io_request *, unsigned char *, DWORD *);
+} pcsc;
+
+#define PCSC_SYMBOL(field, name) \
+	if ((*(void **)&pcsc.field = dlsym(lib, name)) == NULL) { \
+		return "missing symbol " name; \
+	}
+
+static const char *pcsc_load(const char *path) {
+	void *lib = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (lib == NULL) {
+		return dlerror();
+	}
+	PCSC_SYMBOL(establish_context, "SCardEstablishContext");
+	PCSC_SYMBOL(release_context, "SCardReleaseContext");
+	PCSC_SYMBOL(list_readers, "SCardListReaders");
+	PCSC_SYMBOL(get_status_change, "SCardGetStatusChange");
+	PCSC_SYMBOL(cancel, "SCardCancel");
+	PCSC_SYMBOL(connect, "SCardConnect");
+	PCSC_SYMBOL(reconnect, "SCardReconnect");
+	PCSC_SYMBOL(disconnect, "SCardDisconnect");
+	PCSC_SYMBOL(begin_transaction, "SCardBeginTransaction");
+	PCSC_SYMBOL(end_transaction, "SCardEndTransaction");
+	PCSC_SYMBOL(status, "SCardStatus");
+	PCSC_SYMBOL(transmit, "SCardTransmit");
+	return NULL;
+}
+
+static LONG pcsc_establish_context(DWORD scope, SCARDCONTEXT *ctx) {
+	return pcsc.establish_context(scope, NULL, NULL, ctx);
+}
+
+static LONG pcsc_release_context(SCARDCONTEXT ctx) {
+	return pcsc.release_context(ctx);
+}
+
+static LONG pcsc_list_readers(SCARDCONTEXT ctx, char *readers, DWORD *len) {
+	return pcsc.list_readers(ctx, NULL, readers, len);
+}
+
+static LONG pcsc_get_status_change(SCARDCONTEXT ctx, DWORD timeout, reader_state *states, DWORD count) {
+	return pcsc.get_status_change(ctx, timeout, states, count);
+}
+
+static LONG pcsc_cancel(SCARDCONTEXT ctx) {
+	return pcsc.cancel(ctx);
+}
+
+static LONG pcsc_connect(SCARDCONTEXT ctx, const char *reader, DWORD share, DWORD protocols, SCARDHANDLE *card, DWORD *protocol) {
+	return pcsc.connect(ctx, reader, share, protocols, card, protocol);
+}
+
+static LONG pcsc_reconnect(SCARDHANDLE card, DWORD share, DWORD protocols, DWORD init, DWORD *protocol) {
+	return pcsc.reconnect(card, share, protocols, init, protocol);
+}
+
+static LONG pcsc_disconnect(SCARDHANDLE card, DWORD disposition) {
+	return pcsc.disconnect(card, disposition);
+}
+
+static LONG pcsc_begin_transaction(SCARDHANDLE card) {
+	return pcsc.begin_transaction(card);
+}
+
+static LONG pcsc_end_transaction(SCARDHANDLE card, DWORD disposition) {
+	return pcsc.end_transaction(card, disposition);
+}
+
+static LONG pcsc_status(SCARDHANDLE card, char *reader, DWORD *reader_len, DWORD *state, DWORD *protocol, unsigned char *atr, DWORD *atr_len) {
+	return pcsc.status(card, reader, reader_len, state, protocol, atr, atr_len);
+}
+
+static LONG pcsc_transmit(SCARDHANDLE card, DWORD protocol, const unsigned char *send, DWORD send_len, unsigned char *recv, DWORD *recv_len) {
+	io_request pci = { protocol, sizeof(io_request) };
+	return pcsc.transmit(card, &pci, send, send_len, NULL, recv, recv_len);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// maxResponse is the largest response APDU, an extended length response and its status word
+const maxResponse = 65536 + 2
+
+var (
+	loadOnce sync.Once
+	loadErr  error
+)
+
+func load() error {
+	loadOnce.Do(func() {
+		path := "libpcsclite.so.1"
+		if runtime.GOOS == "darwin" {
+			path = "/System/Library/Frameworks/PCSC.framework/PCSC"
+		}
+		cpath := C.CString(path)
+		defer C.free(unsafe.Pointer(cpath))
+		if msg := C.pcsc_load(cpath); msg != nil {
+			loadErr = fmt.Errorf("unable to load the PC/SC library %s: %s", path, C.GoString(msg))
+		}
+	})
+	return loadErr
+}
+
+func rvError(rv C.LONG) error {
+	if rv == 0 {
+		return nil
+	}
+	return Error(uint32(rv))
+}
+
+func establishContext(scope uint32) (uintptr, error) {
+	if err := load(); err != nil {
+		return 0, err
+	}
+	var ctx C.SCARDCONTEXT
+	if err := rvError(C.pcsc_establish_context(C.DWORD(scope), &ctx)); err != nil {
+		return 0, err
+	}
+	return uintptr(ctx), nil
+}
+
+func releaseContext(ctx uintptr) error {
+	return rvError(C.pcsc_release_context(C.SCARDCONTEXT(ctx)))
+}
+
+func listReaders(ctx uintptr) ([]string, error) {
+	for {
+		var size C.DWORD
+		if err := rvError(C.pcsc_list_readers(C.SCARDCONTEXT(ctx), nil, &size)); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		err := rvError(C.pcsc_list_readers(C.SCARDCONTEXT(ctx), (*C.char)(unsafe.Pointer(&buf[0])), &size))
+		if err == Error(SCARD_E_INSUFFICIENT_BUFFER) {
+			// a reader was plugged in between the calls
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return multiString(buf[:size]), nil
+	}
+}
+
+func getStatusChange(ctx uintptr, timeout uint32, states []ReaderState) error {
+	if len(states) == 0 {
+		return nil
+	}
+
+	cstates := (*C.reader_state)(C.calloc(C.size_t(len(states)), C.sizeof_reader_state))
+	defer C.free(unsafe.Pointer(cstates))
+	s := unsafe.Slice(cstates, len(states))
+	for i := range states {
+		s[i].reader = C.CString(states[i].Reader)
+		defer C.free(unsafe.Pointer(s[i].reader))
+		s[i].current_state = C.DWORD(states[i].CurrentState)
+	}
+
+	if err := rvError(C.pcsc_get_status_change(C.SCARDCONTEXT(ctx), C.DWORD(timeout), cstates, C.DWORD(len(states)))); err != nil {
+		return err
+	}
+	for i := range states {
+		states[i].EventState = uint32(s[i].event_state)
+		n := int(s[i].atr_len)
+		if n > len(s[i].atr) {
+			n = len(s[i].atr)
+		}
+		states[i].ATR = C.GoBytes(unsafe.Pointer(&s[i].atr[0]), C.int(n))
+	}
+	return nil
+}
+
+func cancel(ctx uintptr) error {
+	return rvError(C.pcsc_cancel(C.SCARDCONTEXT(ctx)))
+}
+
+func connect(ctx uintptr, reader string, shareMode uint32, protocols uint32) (uintptr, uint32, error) {
+	creader := C.CString(reader)
+	defer C.free(unsafe.Pointer(creader))
+
+	var card C.SCARDHANDLE
+	var protocol C.DWORD
+	if err := rvError(C.pcsc_connect(C.SCARDCONTEXT(ctx), creader, C.DWORD(shareMode), C.DWORD(protocols), &card, &protocol)); err != nil {
+		return 0, 0, err
+	}
+	return uintptr(card), uint32(protocol), nil
+}
+
+func reconnect(card uintptr, shareMode uint32, protocols uint32, initialization uint32) (uint32, error) {
+	var protocol C.DWORD
+	if err := rvError(C.pcsc_reconnect(C.SCARDHANDLE(card), C.DWORD(shareMode), C.DWORD(protocols), C.DWORD(initialization), &protocol)); err != nil {
+		return 0, err
+	}
+	return uint32(protocol), nil
+}
+
+func disconnect(card uintptr, disposition uint32) error {
+	return rvError(C.pcsc_disconnect(C.SCARDHANDLE(card), C.DWORD(disposition)))
+}
+
+func beginTransaction(card uintptr) error {
+	return rvError(C.pcsc_begin_transaction(C.SCARDHANDLE(card)))
+}
+
+func endTransaction(card uintptr, disposition uint32) error {
+	return rvError(C.pcsc_end_transaction(C.SCARDHANDLE(card), C.DWORD(disposition)))
+}
+
+func status(card uintptr) (*CardStatus, error) {
+	reader := make([]byte, 512)
+	atr := make([]byte, 36)
+	readerLen, atrLen := C.DWORD(len(reader)), C.DWORD(len(atr))
+	var state, protocol C.DWORD
+
+	err := rvError(C.pcsc_status(C.SCARDHANDLE(card), (*C.char)(unsafe.Pointer(&reader[0])), &readerLen, &state, &protocol,
+		(*C.uchar)(unsafe.Pointer(&atr[0])), &atrLen))
+	if err != nil {
+		return nil, err
+	}
+	names := multiString(reader[:readerLen])
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	return &CardStatus{Reader: names[0], State: uint32(state), Protocol: uint32(protocol), ATR: atr[:atrLen]}, nil
+}
+
+func transmit(card uintptr, protocol uint32, apdu []byte) ([]byte, error) {
+	if len(apdu) == 0 {
+		return nil, fmt.Errorf("empty APDU")
+	}
+	recv := make([]byte, maxResponse)
+	recvLen := C.DWORD(len(recv))
+
+	err := rvError(C.pcsc_transmit(C.SCARDHANDLE(card), C.DWORD(protocol), (*C.uchar)(unsafe.Pointer(&apdu[0])), C.DWORD(len(apdu)),
+		(*C.uchar)(unsafe.Pointer(&recv[0])), &recvLen))
+	if err != nil {
+		return nil, err
+	}
+	return recv[:recvLen], nil
+}
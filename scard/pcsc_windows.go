@@ -0,0 +1,197 @@
+//go:build windows
+
+package scard
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+var (
+	procSCardEstablishContext = winscard.MustFindProc("SCardEstablishContext")
+	procSCardReleaseContext   = winscard.MustFindProc("SCardReleaseContext")
+	procSCardGetStatusChange  = winscard.MustFindProc("SCardGetStatusChangeA")
+	procSCardCancel           = winscard.MustFindProc("SCardCancel")
+	procSCardConnect          = winscard.MustFindProc("SCardConnectA")
+	procSCardReconnect        = winscard.MustFindProc("SCardReconnect")
+	procSCardDisconnect       = winscard.MustFindProc("SCardDisconnect")
+	procSCardBeginTransaction = winscard.MustFindProc("SCardBeginTransaction")
+	procSCardEndTransaction   = winscard.MustFindProc("SCardEndTransaction")
+	procSCardStatus           = winscard.MustFindProc("SCardStatusA")
+	procSCardTransmit         = winscard.MustFindProc("SCardTransmit")
+)
+
+// maxResponse is the largest response APDU, an extended length response and its status word
+const maxResponse = 65536 + 2
+
+// scardIORequest is SCARD_IO_REQUEST
+type scardIORequest struct {
+	protocol  uint32
+	pciLength uint32
+}
+
+// scardReaderState is SCARD_READERSTATEA
+type scardReaderState struct {
+	reader       *byte
+	userData     uintptr
+	currentState uint32
+	eventState   uint32
+	atrLen       uint32
+	atr          [36]byte
+}
+
+func rvError(r uintptr) error {
+	if r == 0 {
+		return nil
+	}
+	return Error(uint32(r))
+}
+
+func cString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func establishContext(scope uint32) (uintptr, error) {
+	var ctx uintptr
+	r, _, _ := procSCardEstablishContext.Call(uintptr(scope), 0, 0, uintptr(unsafe.Pointer(&ctx)))
+	if err := rvError(r); err != nil {
+		return 0, err
+	}
+	return ctx, nil
+}
+
+func releaseContext(ctx uintptr) error {
+	r, _, _ := procSCardReleaseContext.Call(ctx)
+	return rvError(r)
+}
+
+func listReaders(ctx uintptr) ([]string, error) {
+	for {
+		var size uint32
+		r, _, _ := procSCardListReaders.Call(ctx, 0, 0, uintptr(unsafe.Pointer(&size)))
+		if err := rvError(r); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+		r, _, _ = procSCardListReaders.Call(ctx, 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+		err := rvError(r)
+		if err == Error(SCARD_E_INSUFFICIENT_BUFFER) {
+			// a reader was plugged in between the calls
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return multiString(buf[:size]), nil
+	}
+}
+
+func getStatusChange(ctx uintptr, timeout uint32, states []ReaderState) error {
+	if len(states) == 0 {
+		return nil
+	}
+
+	names := make([][]byte, len(states))
+	s := make([]scardReaderState, len(states))
+	for i := range states {
+		names[i] = cString(states[i].Reader)
+		s[i].reader = &names[i][0]
+		s[i].currentState = states[i].CurrentState
+	}
+
+	r, _, _ := procSCardGetStatusChange.Call(ctx, uintptr(timeout), uintptr(unsafe.Pointer(&s[0])), uintptr(len(s)))
+	if err := rvError(r); err != nil {
+		return err
+	}
+	for i := range states {
+		states[i].EventState = s[i].eventState
+		n := int(s[i].atrLen)
+		if n > len(s[i].atr) {
+			n = len(s[i].atr)
+		}
+		states[i].ATR = append([]byte{}, s[i].atr[:n]...)
+	}
+	return nil
+}
+
+func cancel(ctx uintptr) error {
+	r, _, _ := procSCardCancel.Call(ctx)
+	return rvError(r)
+}
+
+func connect(ctx uintptr, reader string, shareMode uint32, protocols uint32) (uintptr, uint32, error) {
+	name := cString(reader)
+	var card uintptr
+	var protocol uint32
+	r, _, _ := procSCardConnect.Call(ctx, uintptr(unsafe.Pointer(&name[0])), uintptr(shareMode), uintptr(protocols),
+		uintptr(unsafe.Pointer(&card)), uintptr(unsafe.Pointer(&protocol)))
+	if err := rvError(r); err != nil {
+		return 0, 0, err
+	}
+	return card, protocol, nil
+}
+
+func reconnect(card uintptr, shareMode uint32, protocols uint32, initialization uint32) (uint32, error) {
+	var protocol uint32
+	r, _, _ := procSCardReconnect.Call(card, uintptr(shareMode), uintptr(protocols), uintptr(initialization),
+		uintptr(unsafe.Pointer(&protocol)))
+	if err := rvError(r); err != nil {
+		return 0, err
+	}
+	return protocol, nil
+}
+
+func disconnect(card uintptr, disposition uint32) error {
+	r, _, _ := procSCardDisconnect.Call(card, uintptr(disposition))
+	return rvError(r)
+}
+
+func beginTransaction(card uintptr) error {
+	r, _, _ := procSCardBeginTransaction.Call(card)
+	return rvError(r)
+}
+
+func endTransaction(card uintptr, disposition uint32) error {
+	r, _, _ := procSCardEndTransaction.Call(card, uintptr(disposition))
+	return rvError(r)
+}
+
+func status(card uintptr) (*CardStatus, error) {
+	reader := make([]byte, 512)
+	atr := make([]byte, 36)
+	readerLen, atrLen := uint32(len(reader)), uint32(len(atr))
+	var state, protocol uint32
+
+	r, _, _ := procSCardStatus.Call(card, uintptr(unsafe.Pointer(&reader[0])), uintptr(unsafe.Pointer(&readerLen)),
+		uintptr(unsafe.Pointer(&state)), uintptr(unsafe.Pointer(&protocol)),
+		uintptr(unsafe.Pointer(&atr[0])), uintptr(unsafe.Pointer(&atrLen)))
+	if err := rvError(r); err != nil {
+		return nil, err
+	}
+	names := multiString(reader[:readerLen])
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	return &CardStatus{Reader: names[0], State: state, Protocol: protocol, ATR: atr[:atrLen]}, nil
+}
+
+func transmit(card uintptr, protocol uint32, apdu []byte) ([]byte, error) {
+	if len(apdu) == 0 {
+		return nil, fmt.Errorf("empty APDU")
+	}
+	pci := scardIORequest{protocol: protocol, pciLength: uint32(unsafe.Sizeof(scardIORequest{}))}
+	recv := make([]byte, maxResponse)
+	recvLen := uint32(len(recv))
+
+	r, _, _ := procSCardTransmit.Call(card, uintptr(unsafe.Pointer(&pci)),
+		uintptr(unsafe.Pointer(&apdu[0])), uintptr(len(apdu)), 0,
+		uintptr(unsafe.Pointer(&recv[0])), uintptr(unsafe.Pointer(&recvLen)))
+	if err := rvError(r); err != nil {
+		return nil, err
+	}
+	return recv[:recvLen], nil
+}
@@ -0,0 +1,119 @@
+package scard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Script is a Transmitter replaying a recorded card session. Each command has to match the next command of the
+// script, which is answered with its recorded response. Scripts are text, commands start with ">" and responses with
+// "<", followed by hex bytes that may be separated by spaces. A command ending in "*" matches any remaining bytes, for
+// data like the digests to sign. Lines starting with "#" are comments.
+//
+//	# SELECT PIV
+//	> 00 A4 04 00 09 A0 00 00 03 08 00 00 10 00 00
+//	< 61 11 4F 06 00 00 10 00 01 00 79 07 4F 05 A0 00 00 03 08 90 00
+type Script struct {
+	mu    sync.Mutex
+	steps []scriptStep
+	next  int
+}
+
+type scriptStep struct {
+	line     int
+	command  []byte
+	prefix   bool
+	response []byte
+}
+
+// ParseScript reads a script
+func ParseScript(r io.Reader) (*Script, error) {
+	s := &Script{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	var pending *scriptStep
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		direction, text := line[0], strings.TrimSpace(line[1:])
+		prefix := strings.HasSuffix(text, "*")
+		data, err := hex.DecodeString(strings.ReplaceAll(strings.TrimSuffix(text, "*"), " ", ""))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		switch {
+		case direction == '>' && pending == nil:
+			pending = &scriptStep{line: lineNo, command: data, prefix: prefix}
+		case direction == '<' && pending != nil && !prefix:
+			if len(data) < 2 {
+				return nil, fmt.Errorf("line %d: response without status word", lineNo)
+			}
+			pending.response = data
+			s.steps = append(s.steps, *pending)
+			pending = nil
+		case pending != nil:
+			return nil, fmt.Errorf("line %d: expected a response", lineNo)
+		default:
+			return nil, fmt.Errorf("line %d: expected a command", lineNo)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("line %d: command without response", pending.line)
+	}
+	return s, nil
+}
+
+func (s *Script) Transmit(apdu []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next >= len(s.steps) {
+		return nil, fmt.Errorf("script ended, unexpected command %X", apdu)
+	}
+	step := s.steps[s.next]
+	if step.prefix && !bytes.HasPrefix(apdu, step.command) || !step.prefix && !bytes.Equal(apdu, step.command) {
+		return nil, fmt.Errorf("line %d: command %X, the script expects %X", step.line, apdu, step.command)
+	}
+	s.next++
+	return append([]byte{}, step.response...), nil
+}
+
+// Done returns an error when commands of the script were not sent
+func (s *Script) Done() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next < len(s.steps) {
+		return fmt.Errorf("%d of %d script commands were not sent, next is line %d", len(s.steps)-s.next, len(s.steps),
+			s.steps[s.next].line)
+	}
+	return nil
+}
+
+// Recorder records the session of a Transmitter as a script
+type Recorder struct {
+	Transmitter Transmitter
+	W           io.Writer
+}
+
+func (r *Recorder) Transmit(apdu []byte) ([]byte, error) {
+	resp, err := r.Transmitter.Transmit(apdu)
+	if err != nil {
+		fmt.Fprintf(r.W, "# > %X failed: %s\n", apdu, err)
+		return nil, err
+	}
+	fmt.Fprintf(r.W, "> %X\n< %X\n", apdu, resp)
+	return resp, nil
+}
@@ -0,0 +1,103 @@
+package scard
+
+import (
+	"fmt"
+)
+
+// TLV is a BER-TLV data object as applets encode their data, Tag holds all tag bytes, e.g. 0x7F49
+type TLV struct {
+	Tag   uint32
+	Value []byte
+}
+
+// ParseTLV splits b into the data objects at its top level
+func ParseTLV(b []byte) ([]TLV, error) {
+	var objects []TLV
+	for len(b) > 0 {
+		// padding between objects
+		if b[0] == 0x00 || b[0] == 0xFF {
+			b = b[1:]
+			continue
+		}
+
+		tag := uint32(b[0])
+		i := 1
+		if b[0]&0x1F == 0x1F {
+			for {
+				if i >= len(b) || i > 3 {
+					return nil, fmt.Errorf("truncated TLV tag")
+				}
+				tag = tag<<8 | uint32(b[i])
+				i++
+				if b[i-1]&0x80 == 0 {
+					break
+				}
+			}
+		}
+
+		if i >= len(b) {
+			return nil, fmt.Errorf("TLV %X has no length", tag)
+		}
+		length := int(b[i])
+		i++
+		if length > 0x80 {
+			n := length & 0x7F
+			if n > 3 || i+n > len(b) {
+				return nil, fmt.Errorf("TLV %X has an invalid length", tag)
+			}
+			length = 0
+			for _, c := range b[i : i+n] {
+				length = length<<8 | int(c)
+			}
+			i += n
+		} else if length == 0x80 {
+			return nil, fmt.Errorf("TLV %X has an indefinite length", tag)
+		}
+
+		if i+length > len(b) {
+			return nil, fmt.Errorf("TLV %X is truncated, %d of %d bytes", tag, len(b)-i, length)
+		}
+		objects = append(objects, TLV{Tag: tag, Value: b[i : i+length]})
+		b = b[i+length:]
+	}
+	return objects, nil
+}
+
+// FindTLV returns the value of the first data object with the tag at the top level of b
+func FindTLV(b []byte, tag uint32) ([]byte, bool) {
+	objects, err := ParseTLV(b)
+	if err != nil {
+		return nil, false
+	}
+	for _, o := range objects {
+		if o.Tag == tag {
+			return o.Value, true
+		}
+	}
+	return nil, false
+}
+
+// AppendTLV appends a data object to b
+func AppendTLV(b []byte, tag uint32, value []byte) []byte {
+	switch {
+	case tag > 0xFFFF:
+		b = append(b, byte(tag>>16), byte(tag>>8), byte(tag))
+	case tag > 0xFF:
+		b = append(b, byte(tag>>8), byte(tag))
+	default:
+		b = append(b, byte(tag))
+	}
+
+	n := len(value)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xFF:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
@@ -0,0 +1,123 @@
+package scard
+
+import (
+	"sort"
+	"sync"
+)
+
+// Virtual is a Connector with readers holding emulated or scripted cards. Cards can be inserted and removed while
+// they are connected, a removed card fails like a real one with SCARD_W_REMOVED_CARD.
+type Virtual struct {
+	mu      sync.Mutex
+	readers map[string]*virtualSlot
+}
+
+type virtualSlot struct {
+	card Transmitter
+	// insertion counts the cards put into the reader, a connection is to the card that was present when it was made
+	insertion int
+}
+
+func NewVirtual() *Virtual {
+	return &Virtual{readers: make(map[string]*virtualSlot)}
+}
+
+// AddReader adds an empty reader
+func (v *Virtual) AddReader(reader string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.readers[reader]; !ok {
+		v.readers[reader] = &virtualSlot{}
+	}
+}
+
+// Insert puts a card into a reader, adding the reader if needed and replacing a card that is in it
+func (v *Virtual) Insert(reader string, card Transmitter) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	slot, ok := v.readers[reader]
+	if !ok {
+		slot = &virtualSlot{}
+		v.readers[reader] = slot
+	}
+	slot.card = card
+	slot.insertion++
+}
+
+// Remove takes the card out of a reader
+func (v *Virtual) Remove(reader string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if slot, ok := v.readers[reader]; ok {
+		slot.card = nil
+	}
+}
+
+func (v *Virtual) ListReaders() ([]string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var readers []string
+	for reader := range v.readers {
+		readers = append(readers, reader)
+	}
+	sort.Strings(readers)
+	return readers, nil
+}
+
+func (v *Virtual) Open(reader string) (Conn, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	slot, ok := v.readers[reader]
+	if !ok {
+		return nil, Error(SCARD_E_UNKNOWN_READER)
+	}
+	if slot.card == nil {
+		return nil, Error(SCARD_E_NO_SMARTCARD)
+	}
+	return &virtualConn{v: v, reader: reader, insertion: slot.insertion}, nil
+}
+
+type virtualConn struct {
+	v         *Virtual
+	reader    string
+	insertion int
+	closed    bool
+}
+
+// card returns the card of the connection while it is still inserted
+func (c *virtualConn) card() (Transmitter, error) {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	if c.closed {
+		return nil, Error(SCARD_E_INVALID_HANDLE)
+	}
+	slot := c.v.readers[c.reader]
+	if slot == nil || slot.card == nil || slot.insertion != c.insertion {
+		return nil, Error(SCARD_W_REMOVED_CARD)
+	}
+	return slot.card, nil
+}
+
+func (c *virtualConn) Transmit(apdu []byte) ([]byte, error) {
+	card, err := c.card()
+	if err != nil {
+		return nil, err
+	}
+	return card.Transmit(apdu)
+}
+
+func (c *virtualConn) BeginTransaction() error {
+	_, err := c.card()
+	return err
+}
+
+func (c *virtualConn) EndTransaction() error {
+	return nil
+}
+
+func (c *virtualConn) Close() error {
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	c.closed = true
+	return nil
+}
@@ -0,0 +1,146 @@
+//go:build windows
+
+package ui
+
+import (
+	"fmt"
+	"github.com/lxn/walk"
+)
+
+type ChangePIN struct {
+	*walk.Dialog
+	currentEdit *walk.LineEdit
+	newEdit     *walk.LineEdit
+	confirmEdit *walk.LineEdit
+
+	currentPIN string
+	newPIN     string
+}
+
+// runChangePINDialog asks for the current PIN, or the PUK or reset code named by unblock, and a new PIN twice
+func runChangePINDialog(owner walk.Form, keyName string, status string, unblock string) (string, string, bool) {
+	dlg, err := newChangePINDialog(owner, keyName, status, unblock)
+	if showError(err, owner) {
+		return "", "", false
+	}
+
+	if dlg.Run() == walk.DlgCmdOK {
+		return dlg.currentPIN, dlg.newPIN, true
+	}
+
+	return "", "", false
+}
+
+func newChangePINDialog(owner walk.Form, keyName string, status string, unblock string) (*ChangePIN, error) {
+	var err error
+	var disposables walk.Disposables
+	defer disposables.Treat()
+
+	dlg := new(ChangePIN)
+
+	layout := walk.NewGridLayout()
+	layout.SetSpacing(6)
+	layout.SetMargins(walk.Margins{10, 10, 10, 10})
+	layout.SetColumnStretchFactor(1, 3)
+
+	if dlg.Dialog, err = walk.NewDialog(owner); err != nil {
+		return nil, err
+	}
+	disposables.Add(dlg)
+	dlg.SetIcon(owner.Icon())
+	dlg.SetLayout(layout)
+	dlg.SetMinMaxSize(walk.Size{400, 160}, walk.Size{0, 0})
+	if icon, err := loadSystemIcon("imageres", 54, 32); err == nil {
+		dlg.SetIcon(icon)
+	}
+
+	currentName := "&Current PIN:"
+	info := fmt.Sprintf("Change the PIN of key \"%s\"", keyName)
+	dlg.SetTitle("Change PIN")
+	if unblock != "" {
+		currentName = fmt.Sprintf("&%s:", unblock)
+		info = fmt.Sprintf("Set a new PIN for key \"%s\" with the %s", keyName, unblock)
+		dlg.SetTitle("Unblock PIN")
+	}
+	if status != "" {
+		info += fmt.Sprintf(", %s", status)
+	}
+	info += ". The PIN of a smart card is shared by all keys on the card."
+
+	infoLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(infoLabel, walk.Rectangle{0, 0, 2, 1})
+	infoLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	infoLabel.SetText(info)
+
+	addPassword := func(row int, text string) (*walk.LineEdit, error) {
+		label, err := walk.NewTextLabel(dlg)
+		if err != nil {
+			return nil, err
+		}
+		layout.SetRange(label, walk.Rectangle{0, row, 1, 1})
+		label.SetTextAlignment(walk.AlignHFarVCenter)
+		label.SetText(text)
+
+		edit, err := walk.NewLineEdit(dlg)
+		if err != nil {
+			return nil, err
+		}
+		layout.SetRange(edit, walk.Rectangle{1, row, 1, 1})
+		edit.SetPasswordMode(true)
+		return edit, nil
+	}
+
+	if dlg.currentEdit, err = addPassword(1, currentName); err != nil {
+		return nil, err
+	}
+	if dlg.newEdit, err = addPassword(2, "&New PIN:"); err != nil {
+		return nil, err
+	}
+	if dlg.confirmEdit, err = addPassword(3, "C&onfirm new PIN:"); err != nil {
+		return nil, err
+	}
+
+	buttonsContainer, err := walk.NewComposite(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(buttonsContainer, walk.Rectangle{0, 4, 2, 1})
+	buttonsContainer.SetLayout(walk.NewHBoxLayout())
+	buttonsContainer.Layout().SetMargins(walk.Margins{})
+
+	walk.NewHSpacer(buttonsContainer)
+	changeButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	changeButton.SetText(fmt.Sprintf("&Change"))
+	changeButton.Clicked().Attach(dlg.onChange)
+
+	cancelButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	cancelButton.SetText(fmt.Sprintf("Cancel"))
+	cancelButton.Clicked().Attach(dlg.Cancel)
+
+	dlg.SetCancelButton(cancelButton)
+	dlg.SetDefaultButton(changeButton)
+
+	disposables.Spare()
+
+	return dlg, nil
+}
+
+func (dlg *ChangePIN) onChange() {
+	if dlg.newEdit.Text() != dlg.confirmEdit.Text() {
+		showErrorCustom(dlg, "PINs differ", "The new PIN and its confirmation differ.")
+		return
+	}
+
+	dlg.currentPIN = dlg.currentEdit.Text()
+	dlg.newPIN = dlg.newEdit.Text()
+	dlg.Accept()
+}
@@ -1,3 +1,5 @@
+//go:build windows
+
 package ui
 
 import (
@@ -10,6 +12,7 @@ type GlobalConfView struct {
 
 	PinTimeoutEdit    *walk.LineEdit
 	NotificationsEdit *walk.CheckBox
+	VerifyEdit        *walk.CheckBox
 }
 
 func NewGlobalConfView(parent walk.Container) (*GlobalConfView, error) {
@@ -65,6 +68,23 @@ func NewGlobalConfView(parent walk.Container) (*GlobalConfView, error) {
 	gcv.NotificationsEdit.SetChecked(true)
 	gcv.NotificationsEdit.SetAlignment(walk.AlignHFarVFar)
 
+	//Setup the signature verification checkbox
+	verifyLabel, err := walk.NewTextLabel(gcv)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(verifyLabel, walk.Rectangle{0, 2, 1, 1})
+	verifyLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	verifyLabel.SetText(fmt.Sprintf("&Verify Signatures:"))
+	verifyLabel.SetToolTipText("Check every signature against the key's public key before it is sent, so a faulty card, TPM or driver shows an error instead of a failed login.")
+
+	if gcv.VerifyEdit, err = walk.NewCheckBox(gcv); err != nil {
+		return nil, err
+	}
+	layout.SetRange(gcv.VerifyEdit, walk.Rectangle{1, 2, 1, 1})
+	gcv.VerifyEdit.SetChecked(false)
+	gcv.VerifyEdit.SetAlignment(walk.AlignHFarVFar)
+
 	if err := walk.InitWrapperWindow(gcv); err != nil {
 		return nil, err
 	}
@@ -181,6 +201,9 @@ type VSockConfView struct {
 	*walk.GroupBox
 
 	ListenerEnabled *walk.CheckBox
+	ServicePortEdit *walk.LineEdit
+	VMIDsEdit       *walk.LineEdit
+	AnyPartition    *walk.CheckBox
 	ShellScript     *walk.TextEdit
 }
 
@@ -196,7 +219,7 @@ func NewVSockConfView(parent walk.Container) (*VSockConfView, error) {
 	}
 	disposables.Add(cv)
 
-	cv.SetTitle("WSL2 (Hyper-V Socket):")
+	cv.SetTitle("WSL2/Hyper-V VMs (Hyper-V Socket):")
 
 	layout := cv.Layout().(*walk.GridLayout)
 	layout.SetSpacing(6)
@@ -219,19 +242,70 @@ func NewVSockConfView(parent walk.Container) (*VSockConfView, error) {
 	cv.ListenerEnabled.SetChecked(true)
 	cv.ListenerEnabled.SetAlignment(walk.AlignHFarVFar)
 
+	// Service port
+	servicePortLabel, err := walk.NewTextLabel(cv)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(servicePortLabel, walk.Rectangle{0, 1, 1, 1})
+	servicePortLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	servicePortLabel.SetText(fmt.Sprintf("Service &Port:"))
+	servicePortLabel.SetToolTipText("The AF_VSOCK port guests connect to. The Hyper-V service GUID is derived from this port.")
+
+	if cv.ServicePortEdit, err = walk.NewLineEdit(cv); err != nil {
+		return nil, err
+	}
+	layout.SetRange(cv.ServicePortEdit, walk.Rectangle{1, 1, 1, 1})
+	cv.ServicePortEdit.SetText("")
+	cv.ServicePortEdit.SetAlignment(walk.AlignHFarVFar)
+
+	// Explicit VM IDs
+	vmidsLabel, err := walk.NewTextLabel(cv)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(vmidsLabel, walk.Rectangle{0, 2, 1, 1})
+	vmidsLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	vmidsLabel.SetText(fmt.Sprintf("Additional &VM IDs:"))
+	vmidsLabel.SetToolTipText("Comma separated list of Hyper-V VM GUIDs to accept connections from, in addition to WSL2. Use Get-VM | Select Name, Id to list them.")
+
+	if cv.VMIDsEdit, err = walk.NewLineEdit(cv); err != nil {
+		return nil, err
+	}
+	layout.SetRange(cv.VMIDsEdit, walk.Rectangle{1, 2, 1, 1})
+	cv.VMIDsEdit.SetText("")
+	cv.VMIDsEdit.SetAlignment(walk.AlignHFarVFar)
+
+	// Any partition
+	anyPartitionLabel, err := walk.NewTextLabel(cv)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(anyPartitionLabel, walk.Rectangle{0, 3, 1, 1})
+	anyPartitionLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	anyPartitionLabel.SetText(fmt.Sprintf("&Accept Any VM:"))
+	anyPartitionLabel.SetToolTipText("Accept connections from any Hyper-V partition, not just WSL2 and the listed VM IDs.")
+
+	if cv.AnyPartition, err = walk.NewCheckBox(cv); err != nil {
+		return nil, err
+	}
+	layout.SetRange(cv.AnyPartition, walk.Rectangle{1, 3, 1, 1})
+	cv.AnyPartition.SetChecked(true)
+	cv.AnyPartition.SetAlignment(walk.AlignHFarVFar)
+
 	// Shell script
 	shellScriptLabel, err := walk.NewTextLabel(cv)
 	if err != nil {
 		return nil, err
 	}
-	layout.SetRange(shellScriptLabel, walk.Rectangle{0, 1, 1, 1})
+	layout.SetRange(shellScriptLabel, walk.Rectangle{0, 4, 1, 1})
 	shellScriptLabel.SetTextAlignment(walk.AlignHNearVNear)
 	shellScriptLabel.SetText(fmt.Sprintf("&Shell Script:"))
 
 	if cv.ShellScript, err = walk.NewTextEdit(cv); err != nil {
 		return nil, err
 	}
-	layout.SetRange(cv.ShellScript, walk.Rectangle{1, 1, 1, 1})
+	layout.SetRange(cv.ShellScript, walk.Rectangle{1, 4, 1, 1})
 	cv.ShellScript.SetAlignment(walk.AlignHNearVNear)
 	cv.ShellScript.SetText("")
 	cv.ShellScript.SetReadOnly(true)
@@ -252,6 +326,7 @@ type CygwinConfView struct {
 	*walk.GroupBox
 
 	ListenerEnabled *walk.CheckBox
+	SocketPaths     *walk.LineEdit
 	ShellScript     *walk.TextEdit
 }
 
@@ -291,19 +366,36 @@ func NewCygwinConfView(parent walk.Container) (*CygwinConfView, error) {
 	cv.ListenerEnabled.SetChecked(true)
 	cv.ListenerEnabled.SetAlignment(walk.AlignHFarVFar)
 
+	// Socket files
+	socketPathsLabel, err := walk.NewTextLabel(cv)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(socketPathsLabel, walk.Rectangle{0, 1, 1, 1})
+	socketPathsLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	socketPathsLabel.SetText(fmt.Sprintf("Socket &Files:"))
+	socketPathsLabel.SetToolTipText("Semicolon separated list of socket file paths to create, e.g. a fixed path for SSH_AUTH_SOCK in Git Bash. Leave empty for the default location.")
+
+	if cv.SocketPaths, err = walk.NewLineEdit(cv); err != nil {
+		return nil, err
+	}
+	layout.SetRange(cv.SocketPaths, walk.Rectangle{1, 1, 1, 1})
+	cv.SocketPaths.SetText("")
+	cv.SocketPaths.SetAlignment(walk.AlignHFarVFar)
+
 	// Shell script
 	shellScriptLabel, err := walk.NewTextLabel(cv)
 	if err != nil {
 		return nil, err
 	}
-	layout.SetRange(shellScriptLabel, walk.Rectangle{0, 1, 1, 1})
+	layout.SetRange(shellScriptLabel, walk.Rectangle{0, 2, 1, 1})
 	shellScriptLabel.SetTextAlignment(walk.AlignHNearVNear)
 	shellScriptLabel.SetText(fmt.Sprintf("&Shell Script:"))
 
 	if cv.ShellScript, err = walk.NewTextEdit(cv); err != nil {
 		return nil, err
 	}
-	layout.SetRange(cv.ShellScript, walk.Rectangle{1, 1, 1, 1})
+	layout.SetRange(cv.ShellScript, walk.Rectangle{1, 2, 1, 1})
 	cv.ShellScript.SetAlignment(walk.AlignHNearVNear)
 	cv.ShellScript.SetText("")
 	cv.ShellScript.SetReadOnly(true)
@@ -1,3 +1,5 @@
+//go:build windows
+
 package ui
 
 import (
@@ -6,6 +8,7 @@ import (
 	"ncryptagent/keyman"
 	"ncryptagent/keyman/listeners"
 	"strconv"
+	"strings"
 )
 
 type ConfPageView struct {
@@ -117,9 +120,19 @@ func (cp *ConfPage) onSaveConfigClicked() {
 	}
 
 	cp.keyManager.SetNotificationsEnabled(cp.confPageView.globalConfView.NotificationsEdit.Checked())
+	cp.keyManager.SetVerifySignatures(cp.confPageView.globalConfView.VerifyEdit.Checked())
 	cp.keyManager.EnableListener(listeners.TYPE_PAGEANT, cp.confPageView.pageantConfView.ListenerEnabled.Checked())
 	cp.keyManager.EnableListener(listeners.TYPE_NAMED_PIPE, cp.confPageView.namedPipeConfView.ListenerEnabled.Checked())
+	vsockOptions, err := cp.confPageView.vsockConfView.options()
+	if err != nil {
+		showError(err, cp.Form())
+	} else if err = cp.keyManager.SetVSockOptions(vsockOptions); err != nil {
+		showError(err, cp.Form())
+	}
 	cp.keyManager.EnableListener(listeners.TYPE_VSOCK, cp.confPageView.vsockConfView.ListenerEnabled.Checked())
+	if err = cp.keyManager.SetCygwinSocketPaths(strings.Split(cp.confPageView.cygwinConfView.SocketPaths.Text(), ";")); err != nil {
+		showError(err, cp.Form())
+	}
 	cp.keyManager.EnableListener(listeners.TYPE_CYGWIN, cp.confPageView.cygwinConfView.ListenerEnabled.Checked())
 
 	cp.keyManager.SaveConfig()
@@ -129,6 +142,7 @@ func (cp *ConfPage) onSaveConfigClicked() {
 
 func (cp *ConfPage) onTabSelected() {
 	if cp.confPageView.Visible() {
+		vsockOptions := cp.keyManager.GetVSockOptions()
 		cp.confPageView.vsockConfView.ShellScript.SetText(
 			fmt.Sprintf(
 				"# Ensure you have socat version >= 1.7.4 installed in your WSL2 environment\r\n"+
@@ -136,13 +150,45 @@ func (cp *ConfPage) onTabSelected() {
 					"ss -lnx | grep -q $SSH_AUTH_SOCK\r\nif [ $? -ne 0 ]; then\r\n"+
 					"  rm -f $SSH_AUTH_SOCK\r\n"+
 					"  (setsid -f nohup socat UNIX-LISTEN:$SSH_AUTH_SOCK,fork VSOCK-CONNECT:2:0x%x >/dev/null 2>&1)\r\n"+
-					"fi\r\n", listeners.VSockServicePort))
-		cp.confPageView.cygwinConfView.ShellScript.SetText(fmt.Sprintf("export SSH_AUTH_SOCK=\"%s\"", cp.keyManager.CygwinSocketLocation()))
+					"fi\r\n"+
+					"\r\n"+
+					"# Or, with ncrypt-wsl-relay copied into your WSL2 environment:\r\n"+
+					"# eval $(ncrypt-wsl-relay -daemon -print-env)\r\n", vsockOptions.ServicePort))
+		cp.confPageView.vsockConfView.ServicePortEdit.SetText(fmt.Sprintf("0x%x", vsockOptions.ServicePort))
+		cp.confPageView.vsockConfView.VMIDsEdit.SetText(strings.Join(vsockOptions.VMIDs, ", "))
+		cp.confPageView.vsockConfView.AnyPartition.SetChecked(vsockOptions.AnyPartition)
+		cygwinSocketPaths := cp.keyManager.GetCygwinSocketPaths()
+		cp.confPageView.cygwinConfView.SocketPaths.SetText(strings.Join(cygwinSocketPaths, "; "))
+		cp.confPageView.cygwinConfView.ShellScript.SetText(fmt.Sprintf("export SSH_AUTH_SOCK=\"%s\"", cygwinSocketPaths[0]))
 
 		cp.confPageView.pageantConfView.ListenerEnabled.SetChecked(cp.keyManager.GetListenerEnabled(listeners.TYPE_PAGEANT))
 		cp.confPageView.namedPipeConfView.ListenerEnabled.SetChecked(cp.keyManager.GetListenerEnabled(listeners.TYPE_NAMED_PIPE))
 		cp.confPageView.vsockConfView.ListenerEnabled.SetChecked(cp.keyManager.GetListenerEnabled(listeners.TYPE_VSOCK))
 		cp.confPageView.cygwinConfView.ListenerEnabled.SetChecked(cp.keyManager.GetListenerEnabled(listeners.TYPE_CYGWIN))
 		cp.confPageView.globalConfView.PinTimeoutEdit.SetText(strconv.Itoa(cp.keyManager.GetPinTimeout()))
+		cp.confPageView.globalConfView.VerifyEdit.SetChecked(cp.keyManager.GetVerifySignatures())
+	}
+}
+
+func (cv *VSockConfView) options() (listeners.VSockOptions, error) {
+	options := listeners.VSockOptions{
+		ServicePort:  listeners.VSockServicePort,
+		AnyPartition: cv.AnyPartition.Checked(),
+	}
+
+	if portText := strings.TrimSpace(cv.ServicePortEdit.Text()); portText != "" {
+		port, err := strconv.ParseUint(portText, 0, 32)
+		if err != nil {
+			return options, fmt.Errorf("invalid Hyper-V socket service port %s", portText)
+		}
+		options.ServicePort = uint32(port)
 	}
+
+	for _, v := range strings.Split(cv.VMIDsEdit.Text(), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			options.VMIDs = append(options.VMIDs, v)
+		}
+	}
+
+	return options, nil
 }
@@ -1,12 +1,17 @@
+//go:build windows
+
 package ui
 
 import (
 	"fmt"
 	"github.com/lxn/walk"
+	"log"
 	"ncryptagent/keyman"
 	"ncryptagent/ncrypt"
+	"strings"
 )
 
+// algorithmChoices are offered when the key storage providers can't be probed
 var algorithmChoices = []string{
 	"RSA-2048",
 	"RSA-4096",
@@ -15,6 +20,21 @@ var algorithmChoices = []string{
 	"ECDSA-P521",
 }
 
+// providerAlgorithmChoices lists the algorithms a provider can create, with an entry for every RSA key length
+func providerAlgorithmChoices(p *keyman.ProviderInfo) []string {
+	var choices []string
+	for _, a := range p.Algorithms {
+		if a.Algorithm == ncrypt.ALG_RSA {
+			for _, l := range a.Lengths {
+				choices = append(choices, fmt.Sprintf("RSA-%d", l))
+			}
+		} else {
+			choices = append(choices, strings.ReplaceAll(a.Algorithm, "_", "-"))
+		}
+	}
+	return choices
+}
+
 type NewKeyConfig struct {
 	Name          string
 	Type          string
@@ -22,20 +42,25 @@ type NewKeyConfig struct {
 	ProviderName  string
 	Password      string
 	Algorithm     string
+	// Scope is keyman.SCOPE_MACHINE for a key in the machine's key store
+	Scope string
 }
 
 type CreateNewKey struct {
 	*walk.Dialog
 	nameEdit          *walk.LineEdit
 	containerNameEdit *walk.LineEdit
+	providerDropdown  *walk.ComboBox
 	algorithmDropdown *walk.ComboBox
 	keyLengthEdit     *walk.LineEdit
+	machineCheck      *walk.CheckBox
 
 	saveButton   *walk.PushButton
 	cancelButton *walk.PushButton
 
 	config       NewKeyConfig
 	passwordEdit *walk.LineEdit
+	providers    []*keyman.ProviderInfo
 }
 
 func runCreateKeyDialog(owner walk.Form, km *keyman.KeyManager) *NewKeyConfig {
@@ -58,6 +83,23 @@ func newCreateKeyDialog(owner walk.Form, km *keyman.KeyManager) (*CreateNewKey,
 
 	dlg := new(CreateNewKey)
 
+	// only providers that create keys are offered, the platform provider with the fixed choices when probing fails
+	providers, err := km.NCryptProviders()
+	if err != nil {
+		log.Printf("Unable to probe the key storage providers: %v", err)
+	}
+	var providerNames []string
+	for _, p := range providers {
+		if p.Create && len(providerAlgorithmChoices(p)) > 0 {
+			dlg.providers = append(dlg.providers, p)
+			providerNames = append(providerNames, p.Name)
+		}
+	}
+	if len(dlg.providers) == 0 {
+		dlg.providers = []*keyman.ProviderInfo{{Name: ncrypt.ProviderMSPlatform, Create: true}}
+		providerNames = []string{ncrypt.ProviderMSPlatform}
+	}
+
 	layout := walk.NewGridLayout()
 	layout.SetSpacing(6)
 	layout.SetMargins(walk.Margins{10, 10, 10, 10})
@@ -107,19 +149,34 @@ func newCreateKeyDialog(owner walk.Form, km *keyman.KeyManager) (*CreateNewKey,
 	err = dlg.containerNameEdit.SetText(dlg.config.ContainerName)
 	dlg.containerNameEdit.SetAlignment(walk.AlignHFarVCenter)
 
+	//Setup the provider list dropdown
+	providerLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(providerLabel, walk.Rectangle{0, 2, 1, 1})
+	providerLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	providerLabel.SetText(fmt.Sprintf("P&rovider:"))
+
+	if dlg.providerDropdown, err = walk.NewDropDownBox(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.providerDropdown, walk.Rectangle{1, 2, 1, 1})
+	dlg.providerDropdown.SetModel(providerNames)
+
 	//Setup the password field
 	passwordLabel, err := walk.NewTextLabel(dlg)
 	if err != nil {
 		return nil, err
 	}
-	layout.SetRange(passwordLabel, walk.Rectangle{0, 2, 1, 1})
+	layout.SetRange(passwordLabel, walk.Rectangle{0, 3, 1, 1})
 	passwordLabel.SetTextAlignment(walk.AlignHFarVCenter)
 	passwordLabel.SetText(fmt.Sprintf("&Password/PIN:"))
 
 	if dlg.passwordEdit, err = walk.NewLineEdit(dlg); err != nil {
 		return nil, err
 	}
-	layout.SetRange(dlg.passwordEdit, walk.Rectangle{1, 2, 1, 1})
+	layout.SetRange(dlg.passwordEdit, walk.Rectangle{1, 3, 1, 1})
 	err = dlg.passwordEdit.SetText(dlg.config.Password)
 	dlg.passwordEdit.SetPasswordMode(true)
 	dlg.passwordEdit.SetAlignment(walk.AlignHFarVCenter)
@@ -129,22 +186,46 @@ func newCreateKeyDialog(owner walk.Form, km *keyman.KeyManager) (*CreateNewKey,
 	if err != nil {
 		return nil, err
 	}
-	layout.SetRange(algorithmLabel, walk.Rectangle{0, 3, 1, 1})
+	layout.SetRange(algorithmLabel, walk.Rectangle{0, 4, 1, 1})
 	algorithmLabel.SetTextAlignment(walk.AlignHFarVCenter)
 	algorithmLabel.SetText(fmt.Sprintf("&Key Algorithm:"))
 	if dlg.algorithmDropdown, err = walk.NewDropDownBox(dlg); err != nil {
 		return nil, err
 	}
 
-	dlg.algorithmDropdown.SetModel(algorithmChoices)
-	dlg.algorithmDropdown.SetCurrentIndex(0)
-	layout.SetRange(dlg.algorithmDropdown, walk.Rectangle{1, 3, 1, 1})
+	layout.SetRange(dlg.algorithmDropdown, walk.Rectangle{1, 4, 1, 1})
+
+	//Setup the machine scope
+	machineLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(machineLabel, walk.Rectangle{0, 5, 1, 1})
+	machineLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	machineLabel.SetText(fmt.Sprintf("&Machine key:"))
+
+	if dlg.machineCheck, err = walk.NewCheckBox(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.machineCheck, walk.Rectangle{1, 5, 1, 1})
+	dlg.machineCheck.SetChecked(false)
+	dlg.machineCheck.SetAlignment(walk.AlignHNearVCenter)
+
+	// prefer the TPM, the provider sets the algorithms and whether there is a password
+	dlg.providerDropdown.CurrentIndexChanged().Attach(dlg.onProviderChange)
+	dlg.providerDropdown.SetCurrentIndex(0)
+	for i, name := range providerNames {
+		if name == ncrypt.ProviderMSPlatform {
+			dlg.providerDropdown.SetCurrentIndex(i)
+		}
+	}
+	dlg.onProviderChange()
 
 	buttonsContainer, err := walk.NewComposite(dlg)
 	if err != nil {
 		return nil, err
 	}
-	layout.SetRange(buttonsContainer, walk.Rectangle{0, 4, 2, 1})
+	layout.SetRange(buttonsContainer, walk.Rectangle{0, 6, 2, 1})
 	buttonsContainer.SetLayout(walk.NewHBoxLayout())
 	buttonsContainer.Layout().SetMargins(walk.Margins{})
 
@@ -171,6 +252,28 @@ func newCreateKeyDialog(owner walk.Form, km *keyman.KeyManager) (*CreateNewKey,
 
 }
 
+func (dlg *CreateNewKey) onProviderChange() {
+	i := dlg.providerDropdown.CurrentIndex()
+	if i < 0 || i >= len(dlg.providers) {
+		return
+	}
+	p := dlg.providers[i]
+
+	choices := providerAlgorithmChoices(p)
+	if len(choices) == 0 {
+		choices = algorithmChoices
+	}
+	dlg.algorithmDropdown.SetModel(choices)
+	dlg.algorithmDropdown.SetCurrentIndex(0)
+
+	// only keys of the platform provider have a password the agent sets
+	platform := p.Name == ncrypt.ProviderMSPlatform
+	if !platform {
+		dlg.passwordEdit.SetText("")
+	}
+	dlg.passwordEdit.SetEnabled(platform)
+}
+
 func (dlg *CreateNewKey) onSaveButtonClicked() {
 
 	dlg.config = NewKeyConfig{
@@ -179,7 +282,10 @@ func (dlg *CreateNewKey) onSaveButtonClicked() {
 		Algorithm:     dlg.algorithmDropdown.Text(),
 		ContainerName: dlg.containerNameEdit.Text(),
 		Password:      dlg.passwordEdit.Text(),
-		ProviderName:  ncrypt.ProviderMSPlatform,
+		ProviderName:  dlg.providerDropdown.Text(),
+	}
+	if dlg.machineCheck.Checked() {
+		dlg.config.Scope = keyman.SCOPE_MACHINE
 	}
 
 	dlg.Accept()
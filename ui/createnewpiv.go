@@ -0,0 +1,242 @@
+//go:build windows
+
+package ui
+
+import (
+	"fmt"
+	"github.com/lxn/walk"
+	"ncryptagent/keyman"
+)
+
+var algorithmChoicesPIV = []string{
+	"ECDSA-P256",
+	"ECDSA-P384",
+	"RSA-2048",
+	"RSA-4096",
+	"Ed25519",
+}
+
+var pinPolicyChoices = []string{"default", "once", "always", "never"}
+
+var touchPolicyChoices = []string{"default", "never", "always", "cached"}
+
+type NewPIVKeyConfig struct {
+	Name          string
+	Token         string
+	Reader        string
+	Slot          string
+	Algorithm     string
+	PINPolicy     string
+	TouchPolicy   string
+	ManagementKey string
+	Certificate   bool
+}
+
+type CreateNewPIVKey struct {
+	*walk.Dialog
+	nameEdit            *walk.LineEdit
+	cardDropdown        *walk.ComboBox
+	slotDropdown        *walk.ComboBox
+	algorithmDropdown   *walk.ComboBox
+	pinPolicyDropdown   *walk.ComboBox
+	touchPolicyDropdown *walk.ComboBox
+	managementKeyEdit   *walk.LineEdit
+	certificate         *walk.CheckBox
+
+	saveButton   *walk.PushButton
+	cancelButton *walk.PushButton
+
+	cards  []keyman.PIVCard
+	config NewPIVKeyConfig
+}
+
+func runCreateNewPIVKeyDialog(owner walk.Form, km *keyman.KeyManager) *NewPIVKeyConfig {
+	dlg, err := newCreateNewPIVKeyDialog(owner, km)
+	if showError(err, owner) {
+		return nil
+	}
+
+	if dlg.Run() == walk.DlgCmdOK {
+		return &dlg.config
+	}
+
+	return nil
+}
+
+func newCreateNewPIVKeyDialog(owner walk.Form, km *keyman.KeyManager) (*CreateNewPIVKey, error) {
+	var err error
+	var disposables walk.Disposables
+	defer disposables.Treat()
+
+	dlg := new(CreateNewPIVKey)
+
+	if dlg.cards, err = km.PIVCards(); err != nil {
+		return nil, err
+	}
+	if len(dlg.cards) == 0 {
+		return nil, fmt.Errorf("no PIV card present")
+	}
+
+	layout := walk.NewGridLayout()
+	layout.SetSpacing(6)
+	layout.SetMargins(walk.Margins{10, 10, 10, 10})
+	layout.SetColumnStretchFactor(1, 3)
+
+	if dlg.Dialog, err = walk.NewDialog(owner); err != nil {
+		return nil, err
+	}
+	disposables.Add(dlg)
+	dlg.SetIcon(owner.Icon())
+	dlg.SetTitle("Create new PIV key")
+	dlg.SetLayout(layout)
+	dlg.SetMinMaxSize(walk.Size{500, 200}, walk.Size{0, 0})
+	if icon, err := loadSystemIcon("imageres", 109, 32); err == nil {
+		dlg.SetIcon(icon)
+	}
+
+	addLabel := func(row int, text string) error {
+		label, err := walk.NewTextLabel(dlg)
+		if err != nil {
+			return err
+		}
+		layout.SetRange(label, walk.Rectangle{0, row, 1, 1})
+		label.SetTextAlignment(walk.AlignHFarVCenter)
+		label.SetText(text)
+		return nil
+	}
+	addDropdown := func(row int, text string, model []string) (*walk.ComboBox, error) {
+		if err := addLabel(row, text); err != nil {
+			return nil, err
+		}
+		dropdown, err := walk.NewDropDownBox(dlg)
+		if err != nil {
+			return nil, err
+		}
+		dropdown.SetModel(model)
+		dropdown.SetCurrentIndex(0)
+		layout.SetRange(dropdown, walk.Rectangle{1, row, 1, 1})
+		dropdown.SetAlignment(walk.AlignHFarVCenter)
+		return dropdown, nil
+	}
+
+	//Setup the name
+	if err = addLabel(0, "&Name:"); err != nil {
+		return nil, err
+	}
+	if dlg.nameEdit, err = walk.NewLineEdit(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.nameEdit, walk.Rectangle{1, 0, 1, 1})
+	dlg.nameEdit.SetAlignment(walk.AlignHFarVCenter)
+
+	//Setup the card and the free slots of the chosen card
+	var cardNames []string
+	for _, c := range dlg.cards {
+		cardNames = append(cardNames, fmt.Sprintf("%s (%s)", c.ID, c.Reader))
+	}
+	if dlg.cardDropdown, err = addDropdown(1, "&Card:", cardNames); err != nil {
+		return nil, err
+	}
+	if dlg.slotDropdown, err = addDropdown(2, "&Slot:", nil); err != nil {
+		return nil, err
+	}
+	dlg.cardDropdown.CurrentIndexChanged().Attach(dlg.updateSlots)
+	dlg.updateSlots()
+
+	if dlg.algorithmDropdown, err = addDropdown(3, "&Key Algorithm:", algorithmChoicesPIV); err != nil {
+		return nil, err
+	}
+	if dlg.pinPolicyDropdown, err = addDropdown(4, "&PIN policy:", pinPolicyChoices); err != nil {
+		return nil, err
+	}
+	if dlg.touchPolicyDropdown, err = addDropdown(5, "&Touch policy:", touchPolicyChoices); err != nil {
+		return nil, err
+	}
+
+	//Setup the management key, empty for the default one
+	if err = addLabel(6, "&Management key:"); err != nil {
+		return nil, err
+	}
+	if dlg.managementKeyEdit, err = walk.NewLineEdit(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.managementKeyEdit, walk.Rectangle{1, 6, 1, 1})
+	dlg.managementKeyEdit.SetPasswordMode(true)
+	dlg.managementKeyEdit.SetToolTipText("The management key in hex, leave it empty for the default key")
+
+	//Setup the certificate, the smart card minidriver only sees slots with one
+	if err = addLabel(7, "&Write a self-signed certificate:"); err != nil {
+		return nil, err
+	}
+	if dlg.certificate, err = walk.NewCheckBox(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.certificate, walk.Rectangle{1, 7, 1, 1})
+	dlg.certificate.SetChecked(true)
+	dlg.certificate.SetAlignment(walk.AlignHNearVCenter)
+
+	buttonsContainer, err := walk.NewComposite(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(buttonsContainer, walk.Rectangle{0, 8, 2, 1})
+	buttonsContainer.SetLayout(walk.NewHBoxLayout())
+	buttonsContainer.Layout().SetMargins(walk.Margins{})
+
+	walk.NewHSpacer(buttonsContainer)
+	if dlg.saveButton, err = walk.NewPushButton(buttonsContainer); err != nil {
+		return nil, err
+	}
+	dlg.saveButton.SetText(fmt.Sprintf("&Create"))
+	dlg.saveButton.Clicked().Attach(dlg.onSaveButtonClicked)
+
+	cancelButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	cancelButton.SetText(fmt.Sprintf("Cancel"))
+	cancelButton.Clicked().Attach(dlg.Cancel)
+
+	dlg.SetCancelButton(cancelButton)
+	dlg.SetDefaultButton(dlg.saveButton)
+
+	disposables.Spare()
+
+	return dlg, nil
+}
+
+func (dlg *CreateNewPIVKey) updateSlots() {
+	i := dlg.cardDropdown.CurrentIndex()
+	if i < 0 || i >= len(dlg.cards) {
+		return
+	}
+	var slots []string
+	for _, s := range dlg.cards[i].Free {
+		slots = append(slots, fmt.Sprintf("%s %s", s, s.Name()))
+	}
+	dlg.slotDropdown.SetModel(slots)
+	dlg.slotDropdown.SetCurrentIndex(0)
+}
+
+func (dlg *CreateNewPIVKey) onSaveButtonClicked() {
+	card := dlg.cards[dlg.cardDropdown.CurrentIndex()]
+	slot := dlg.slotDropdown.CurrentIndex()
+	if slot < 0 || slot >= len(card.Free) {
+		showErrorCustom(dlg, "No free slot", fmt.Sprintf("Card %s has no free slot for a new key.", card.ID))
+		return
+	}
+
+	dlg.config = NewPIVKeyConfig{
+		Name:          dlg.nameEdit.Text(),
+		Token:         card.ID,
+		Reader:        card.Reader,
+		Slot:          card.Free[slot].String(),
+		Algorithm:     dlg.algorithmDropdown.Text(),
+		PINPolicy:     dlg.pinPolicyDropdown.Text(),
+		TouchPolicy:   dlg.touchPolicyDropdown.Text(),
+		ManagementKey: dlg.managementKeyEdit.Text(),
+		Certificate:   dlg.certificate.Checked(),
+	}
+
+	dlg.Accept()
+}
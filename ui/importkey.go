@@ -0,0 +1,277 @@
+//go:build windows
+
+package ui
+
+import (
+	"fmt"
+	"github.com/lxn/walk"
+	"log"
+	"ncryptagent/keyman"
+	"ncryptagent/ncrypt"
+	"path/filepath"
+	"strings"
+)
+
+type ImportKeyConfig struct {
+	Name         string
+	Path         string
+	Passphrase   string
+	ProviderName string
+	Password     string
+	Scope        string
+}
+
+type ImportKey struct {
+	*walk.Dialog
+	nameEdit         *walk.LineEdit
+	pathEdit         *walk.LineEdit
+	passphraseEdit   *walk.LineEdit
+	providerDropdown *walk.ComboBox
+	passwordEdit     *walk.LineEdit
+	machineCheck     *walk.CheckBox
+
+	config ImportKeyConfig
+}
+
+func runImportKeyDialog(owner walk.Form, km *keyman.KeyManager) *ImportKeyConfig {
+	dlg, err := newImportKeyDialog(owner, km)
+	if showError(err, owner) {
+		return nil
+	}
+
+	if dlg.Run() == walk.DlgCmdOK {
+		return &dlg.config
+	}
+
+	return nil
+}
+
+func newImportKeyDialog(owner walk.Form, km *keyman.KeyManager) (*ImportKey, error) {
+	var err error
+	var disposables walk.Disposables
+	defer disposables.Treat()
+
+	dlg := new(ImportKey)
+
+	// keys go into the providers that create keys and onto smart cards, the TPM when probing fails
+	providers, err := km.NCryptProviders()
+	if err != nil {
+		log.Printf("Unable to probe the key storage providers: %v", err)
+	}
+	var providerNames []string
+	for _, p := range providers {
+		if (p.Create || p.Name == ncrypt.ProviderMSSC) && len(p.Algorithms) > 0 {
+			providerNames = append(providerNames, p.Name)
+		}
+	}
+	if len(providerNames) == 0 {
+		providerNames = []string{ncrypt.ProviderMSPlatform}
+	}
+
+	layout := walk.NewGridLayout()
+	layout.SetSpacing(6)
+	layout.SetMargins(walk.Margins{10, 10, 10, 10})
+	layout.SetColumnStretchFactor(1, 3)
+
+	if dlg.Dialog, err = walk.NewDialog(owner); err != nil {
+		return nil, err
+	}
+	disposables.Add(dlg)
+	dlg.SetIcon(owner.Icon())
+	dlg.SetTitle("Import private key")
+	dlg.SetLayout(layout)
+	dlg.SetMinMaxSize(walk.Size{500, 200}, walk.Size{0, 0})
+	if icon, err := loadSystemIcon("imageres", 109, 32); err == nil {
+		dlg.SetIcon(icon)
+	}
+
+	//Setup the key file with a browse button
+	pathLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(pathLabel, walk.Rectangle{0, 0, 1, 1})
+	pathLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	pathLabel.SetText(fmt.Sprintf("Key &File:"))
+
+	if dlg.pathEdit, err = walk.NewLineEdit(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.pathEdit, walk.Rectangle{1, 0, 1, 1})
+	dlg.pathEdit.SetAlignment(walk.AlignHFarVCenter)
+
+	browseButton, err := walk.NewPushButton(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(browseButton, walk.Rectangle{2, 0, 1, 1})
+	browseButton.SetText(fmt.Sprintf("&Browse…"))
+	browseButton.Clicked().Attach(dlg.onBrowse)
+
+	//Setup the name
+	nameLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(nameLabel, walk.Rectangle{0, 1, 1, 1})
+	nameLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	nameLabel.SetText(fmt.Sprintf("&Name:"))
+
+	if dlg.nameEdit, err = walk.NewLineEdit(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.nameEdit, walk.Rectangle{1, 1, 2, 1})
+	dlg.nameEdit.SetAlignment(walk.AlignHFarVCenter)
+
+	//Setup the passphrase of the file
+	passphraseLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(passphraseLabel, walk.Rectangle{0, 2, 1, 1})
+	passphraseLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	passphraseLabel.SetText(fmt.Sprintf("File P&assphrase:"))
+
+	if dlg.passphraseEdit, err = walk.NewLineEdit(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.passphraseEdit, walk.Rectangle{1, 2, 2, 1})
+	dlg.passphraseEdit.SetPasswordMode(true)
+	dlg.passphraseEdit.SetAlignment(walk.AlignHFarVCenter)
+
+	//Setup the provider list dropdown
+	providerLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(providerLabel, walk.Rectangle{0, 3, 1, 1})
+	providerLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	providerLabel.SetText(fmt.Sprintf("P&rovider:"))
+
+	if dlg.providerDropdown, err = walk.NewDropDownBox(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.providerDropdown, walk.Rectangle{1, 3, 2, 1})
+	dlg.providerDropdown.SetModel(providerNames)
+
+	//Setup the password field
+	passwordLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(passwordLabel, walk.Rectangle{0, 4, 1, 1})
+	passwordLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	passwordLabel.SetText(fmt.Sprintf("&Password/PIN:"))
+
+	if dlg.passwordEdit, err = walk.NewLineEdit(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.passwordEdit, walk.Rectangle{1, 4, 2, 1})
+	dlg.passwordEdit.SetPasswordMode(true)
+	dlg.passwordEdit.SetAlignment(walk.AlignHFarVCenter)
+
+	//Setup the machine scope
+	machineLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(machineLabel, walk.Rectangle{0, 5, 1, 1})
+	machineLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	machineLabel.SetText(fmt.Sprintf("&Machine key:"))
+
+	if dlg.machineCheck, err = walk.NewCheckBox(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.machineCheck, walk.Rectangle{1, 5, 2, 1})
+	dlg.machineCheck.SetChecked(false)
+	dlg.machineCheck.SetAlignment(walk.AlignHNearVCenter)
+
+	// prefer the TPM, only its keys have a password the agent sets
+	dlg.providerDropdown.CurrentIndexChanged().Attach(dlg.onProviderChange)
+	dlg.providerDropdown.SetCurrentIndex(0)
+	for i, name := range providerNames {
+		if name == ncrypt.ProviderMSPlatform {
+			dlg.providerDropdown.SetCurrentIndex(i)
+		}
+	}
+	dlg.onProviderChange()
+
+	buttonsContainer, err := walk.NewComposite(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(buttonsContainer, walk.Rectangle{0, 6, 3, 1})
+	buttonsContainer.SetLayout(walk.NewHBoxLayout())
+	buttonsContainer.Layout().SetMargins(walk.Margins{})
+
+	walk.NewHSpacer(buttonsContainer)
+	importButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	importButton.SetText(fmt.Sprintf("&Import"))
+	importButton.Clicked().Attach(dlg.onImportButtonClicked)
+
+	cancelButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	cancelButton.SetText(fmt.Sprintf("Cancel"))
+	cancelButton.Clicked().Attach(dlg.Cancel)
+
+	dlg.SetCancelButton(cancelButton)
+	dlg.SetDefaultButton(importButton)
+
+	disposables.Spare()
+
+	return dlg, nil
+}
+
+func (dlg *ImportKey) onBrowse() {
+	fd := walk.FileDialog{
+		Filter: fmt.Sprintf("All Files (*.*)|*.*|PEM Key Files (*.pem;*.key)|*.pem;*.key"),
+		Title:  fmt.Sprintf("Import private key file"),
+	}
+	if ok, _ := fd.ShowOpen(dlg); !ok {
+		return
+	}
+
+	dlg.pathEdit.SetText(fd.FilePath)
+	if dlg.nameEdit.Text() == "" {
+		dlg.nameEdit.SetText(strings.TrimSuffix(filepath.Base(fd.FilePath), filepath.Ext(fd.FilePath)))
+	}
+}
+
+func (dlg *ImportKey) onProviderChange() {
+	platform := dlg.providerDropdown.Text() == ncrypt.ProviderMSPlatform
+	if !platform {
+		dlg.passwordEdit.SetText("")
+	}
+	dlg.passwordEdit.SetEnabled(platform)
+
+	// smart cards have no machine key store
+	smartCard := dlg.providerDropdown.Text() == ncrypt.ProviderMSSC
+	if smartCard {
+		dlg.machineCheck.SetChecked(false)
+	}
+	dlg.machineCheck.SetEnabled(!smartCard)
+}
+
+func (dlg *ImportKey) onImportButtonClicked() {
+	dlg.config = ImportKeyConfig{
+		Name:         dlg.nameEdit.Text(),
+		Path:         dlg.pathEdit.Text(),
+		Passphrase:   dlg.passphraseEdit.Text(),
+		ProviderName: dlg.providerDropdown.Text(),
+		Password:     dlg.passwordEdit.Text(),
+	}
+	if dlg.machineCheck.Checked() {
+		dlg.config.Scope = keyman.SCOPE_MACHINE
+	}
+	if dlg.config.Name == "" || dlg.config.Path == "" {
+		showError(fmt.Errorf("choose a key file and a name for the key"), dlg)
+		return
+	}
+
+	dlg.Accept()
+}
@@ -0,0 +1,113 @@
+//go:build windows
+
+package ui
+
+import (
+	"fmt"
+	"github.com/lxn/walk"
+)
+
+type KeyProfile struct {
+	*walk.Dialog
+	profileSelect *walk.ComboBox
+	profile       string
+}
+
+// runKeyProfileDialog asks which profile a key should be served by, returning the chosen profile name
+func runKeyProfileDialog(owner walk.Form, keyName string, profiles []string, current string) (string, bool) {
+	dlg, err := newKeyProfileDialog(owner, keyName, profiles, current)
+	if showError(err, owner) {
+		return "", false
+	}
+
+	if dlg.Run() == walk.DlgCmdOK {
+		return dlg.profile, true
+	}
+
+	return "", false
+}
+
+func newKeyProfileDialog(owner walk.Form, keyName string, profiles []string, current string) (*KeyProfile, error) {
+	var err error
+	var disposables walk.Disposables
+	defer disposables.Treat()
+
+	dlg := new(KeyProfile)
+
+	layout := walk.NewGridLayout()
+	layout.SetSpacing(6)
+	layout.SetMargins(walk.Margins{10, 10, 10, 10})
+	layout.SetColumnStretchFactor(1, 3)
+
+	if dlg.Dialog, err = walk.NewDialog(owner); err != nil {
+		return nil, err
+	}
+	disposables.Add(dlg)
+	dlg.SetIcon(owner.Icon())
+	dlg.SetTitle("Assign key to profile")
+	dlg.SetLayout(layout)
+	dlg.SetMinMaxSize(walk.Size{400, 120}, walk.Size{0, 0})
+
+	infoLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(infoLabel, walk.Rectangle{0, 0, 2, 1})
+	infoLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	infoLabel.SetText(fmt.Sprintf("Choose the agent profile that serves key \"%s\".", keyName))
+
+	profileLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(profileLabel, walk.Rectangle{0, 1, 1, 1})
+	profileLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	profileLabel.SetText(fmt.Sprintf("&Profile:"))
+
+	if dlg.profileSelect, err = walk.NewDropDownBox(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.profileSelect, walk.Rectangle{1, 1, 1, 1})
+	dlg.profileSelect.SetModel(profiles)
+	dlg.profileSelect.SetCurrentIndex(0)
+	for i, p := range profiles {
+		if p == current {
+			dlg.profileSelect.SetCurrentIndex(i)
+		}
+	}
+
+	buttonsContainer, err := walk.NewComposite(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(buttonsContainer, walk.Rectangle{0, 2, 2, 1})
+	buttonsContainer.SetLayout(walk.NewHBoxLayout())
+	buttonsContainer.Layout().SetMargins(walk.Margins{})
+
+	walk.NewHSpacer(buttonsContainer)
+	assignButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	assignButton.SetText(fmt.Sprintf("&Assign"))
+	assignButton.Clicked().Attach(dlg.onAssign)
+
+	cancelButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	cancelButton.SetText(fmt.Sprintf("Cancel"))
+	cancelButton.Clicked().Attach(dlg.Cancel)
+
+	dlg.SetCancelButton(cancelButton)
+	dlg.SetDefaultButton(assignButton)
+
+	disposables.Spare()
+
+	return dlg, nil
+}
+
+func (dlg *KeyProfile) onAssign() {
+	dlg.profile = dlg.profileSelect.Text()
+	dlg.Accept()
+}
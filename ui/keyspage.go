@@ -1,3 +1,5 @@
+//go:build windows
+
 package ui
 
 import (
@@ -5,6 +7,7 @@ import (
 	"github.com/lxn/walk"
 	"ncryptagent/keyman"
 	"ncryptagent/webauthn"
+	"path/filepath"
 )
 
 type KeysPage struct {
@@ -147,6 +150,14 @@ func (kp *KeysPage) CreateToolbar() error {
 	createWebAuthN.Triggered().Attach(kp.onCreateWebAuthNKey)
 	addMenu.Actions().Add(createWebAuthN)
 
+	createPIV := walk.NewAction()
+	createPIV.SetText(fmt.Sprintf("Create &PIV Card Key…"))
+	createPIVIcon, _ := loadSystemIcon("imageres", 77, 16)
+	createPIV.SetImage(createPIVIcon)
+	createPIV.Triggered().Attach(kp.onCreatePIVKey)
+	createPIV.SetVisible(kp.keyManager.Backend(keyman.TYPE_PIV) != nil)
+	addMenu.Actions().Add(createPIV)
+
 	createExistingAction := walk.NewAction()
 	createExistingAction.SetText(fmt.Sprintf("Add &Existing nCrypt key…"))
 	createExistingActionIcon, _ := loadSystemIcon("imageres", 172, 16)
@@ -154,6 +165,20 @@ func (kp *KeysPage) CreateToolbar() error {
 	createExistingAction.Triggered().Attach(kp.onCreateExistingKey)
 	addMenu.Actions().Add(createExistingAction)
 
+	addFileAction := walk.NewAction()
+	addFileAction.SetText(fmt.Sprintf("Add Private Key &File…"))
+	addFileActionIcon, _ := loadSystemIcon("imageres", 172, 16)
+	addFileAction.SetImage(addFileActionIcon)
+	addFileAction.Triggered().Attach(kp.onAddKeyFile)
+	addMenu.Actions().Add(addFileAction)
+
+	importAction := walk.NewAction()
+	importAction.SetText(fmt.Sprintf("&Import Private Key into nCrypt…"))
+	importActionIcon, _ := loadSystemIcon("imageres", 77, 16)
+	importAction.SetImage(importActionIcon)
+	importAction.Triggered().Attach(kp.onImportKey)
+	addMenu.Actions().Add(importAction)
+
 	addMenuAction := walk.NewMenuAction(addMenu)
 	addMenuActionIcon, _ := loadSystemIcon("shell32", 104, 16)
 	addMenuAction.SetImage(addMenuActionIcon)
@@ -196,17 +221,63 @@ func (kp *KeysPage) CreateToolbar() error {
 	contextMenu.Actions().Add(addWebAuthN2)
 	kp.ShortcutActions().Add(addWebAuthN2)
 
+	addPIV2 := walk.NewAction()
+	addPIV2.SetText(fmt.Sprintf("Create new &PIV Card Key…"))
+	addPIV2.Triggered().Attach(kp.onCreatePIVKey)
+	addPIV2.SetVisible(kp.keyManager.Backend(keyman.TYPE_PIV) != nil)
+	contextMenu.Actions().Add(addPIV2)
+	kp.ShortcutActions().Add(addPIV2)
+
 	createExistingAction2 := walk.NewAction()
 	createExistingAction2.SetText(fmt.Sprintf("&Add existing key…"))
 	createExistingAction2.Triggered().Attach(kp.onCreateExistingKey)
 	contextMenu.Actions().Add(createExistingAction2)
 	kp.ShortcutActions().Add(createExistingAction2)
 
+	addFileAction2 := walk.NewAction()
+	addFileAction2.SetText(fmt.Sprintf("Add private key &file…"))
+	addFileAction2.Triggered().Attach(kp.onAddKeyFile)
+	contextMenu.Actions().Add(addFileAction2)
+	kp.ShortcutActions().Add(addFileAction2)
+
+	importAction2 := walk.NewAction()
+	importAction2.SetText(fmt.Sprintf("&Import private key into nCrypt…"))
+	importAction2.Triggered().Attach(kp.onImportKey)
+	contextMenu.Actions().Add(importAction2)
+	kp.ShortcutActions().Add(importAction2)
+
+	contextMenu.Actions().Add(walk.NewSeparatorAction())
+
+	profileAction := walk.NewAction()
+	profileAction.SetText(fmt.Sprintf("Assign to &Profile…"))
+	profileAction.Triggered().Attach(kp.onAssignProfile)
+	contextMenu.Actions().Add(profileAction)
+
+	changePINAction := walk.NewAction()
+	changePINAction.SetText(fmt.Sprintf("C&hange PIN…"))
+	changePINAction.Triggered().Attach(kp.onChangePIN)
+	contextMenu.Actions().Add(changePINAction)
+
+	unblockPINAction := walk.NewAction()
+	unblockPINAction.SetText(fmt.Sprintf("&Unblock PIN…"))
+	unblockPINAction.Triggered().Attach(kp.onUnblockPIN)
+	contextMenu.Actions().Add(unblockPINAction)
+
+	attestationAction := walk.NewAction()
+	attestationAction.SetText(fmt.Sprintf("Export TPM &Attestation…"))
+	attestationAction.Triggered().Attach(kp.onExportAttestation)
+	contextMenu.Actions().Add(attestationAction)
+
 	kp.listView.SetContextMenu(contextMenu)
 
 	setSelectionOrientedOptions := func() {
 		selected := len(kp.listView.SelectedIndexes())
 		deleteAction.SetEnabled(selected > 0)
+		profileAction.SetEnabled(selected > 0)
+		manageable := selected == 1 && kp.listView.CurrentKey() != nil && kp.listView.CurrentKey().PINManageable()
+		changePINAction.SetEnabled(manageable)
+		unblockPINAction.SetEnabled(manageable)
+		attestationAction.SetEnabled(selected == 1 && kp.listView.CurrentKey() != nil && kp.listView.CurrentKey().Attestable())
 	}
 	kp.listView.SelectedIndexesChanged().Attach(setSelectionOrientedOptions)
 	setSelectionOrientedOptions()
@@ -229,6 +300,9 @@ func (kp *KeysPage) onCreateKey() {
 			case "RSA-2048":
 				algorithm = "RSA"
 				length = 2048
+			case "RSA-3072":
+				algorithm = "RSA"
+				length = 3072
 			case "RSA-4096":
 				algorithm = "RSA"
 				length = 4096
@@ -252,6 +326,7 @@ func (kp *KeysPage) onCreateKey() {
 				algorithm,
 				length,
 				config.Password,
+				config.Scope,
 			)
 
 			if err != nil {
@@ -295,6 +370,51 @@ func (kp *KeysPage) onCreateWebAuthNKey() {
 	}
 }
 
+func (kp *KeysPage) onCreatePIVKey() {
+	if config := runCreateNewPIVKeyDialog(kp.Form(), kp.keyManager); config != nil {
+		go func() {
+
+			var algorithm string
+			var length int
+
+			switch config.Algorithm {
+			case "RSA-2048":
+				algorithm = "RSA"
+				length = 2048
+			case "RSA-4096":
+				algorithm = "RSA"
+				length = 4096
+			case "ECDSA-P384":
+				algorithm = "ECDSA_P384"
+			case "Ed25519":
+				algorithm = keyman.ALG_ED25519
+			default:
+				algorithm = "ECDSA_P256"
+			}
+
+			_, err := kp.keyManager.CreateNewPIVKey(config.Name,
+				config.Token,
+				config.Reader,
+				config.Slot,
+				algorithm,
+				length,
+				keyman.CreateOptions{
+					PINPolicy:     config.PINPolicy,
+					TouchPolicy:   config.TouchPolicy,
+					ManagementKey: config.ManagementKey,
+					Certificate:   config.Certificate,
+				},
+			)
+
+			if err != nil {
+				showError(err, kp.Form())
+			}
+
+			kp.listView.Load(false)
+		}()
+	}
+}
+
 func (kp *KeysPage) onCreateExistingKey() {
 	if config := runLoadExistingDialog(kp.Form(), kp.keyManager); config != nil {
 		go func() {
@@ -310,6 +430,50 @@ func (kp *KeysPage) onCreateExistingKey() {
 	}
 }
 
+func (kp *KeysPage) onAddKeyFile() {
+	dlg := walk.FileDialog{
+		Filter: fmt.Sprintf("All Files (*.*)|*.*|PEM Key Files (*.pem;*.key)|*.pem;*.key"),
+		Title:  fmt.Sprintf("Add private key file"),
+	}
+
+	if ok, _ := dlg.ShowOpen(kp.Form()); !ok {
+		return
+	}
+
+	config := &keyman.KeyConfig{
+		Name:          filepath.Base(dlg.FilePath),
+		ContainerName: dlg.FilePath,
+	}
+	if _, err := kp.keyManager.LoadFileKey(config); err != nil {
+		showError(err, kp.Form())
+		return
+	}
+
+	kp.listView.Load(false)
+	kp.keyManager.SaveConfig()
+}
+
+func (kp *KeysPage) onImportKey() {
+	if config := runImportKeyDialog(kp.Form(), kp.keyManager); config != nil {
+		go func() {
+			_, err := kp.keyManager.ImportNCryptKeyFile(config.Name,
+				"",
+				config.ProviderName,
+				config.Path,
+				config.Passphrase,
+				config.Password,
+				config.Scope,
+			)
+
+			if err != nil {
+				showError(err, kp.Form())
+			}
+
+			kp.listView.Load(false)
+		}()
+	}
+}
+
 func (kp *KeysPage) onDelete() {
 	confirmDelete, andFromKeystore := runDeleteKeyDialog(kp.Form(), kp.listView.CurrentKey().Name)
 
@@ -328,6 +492,98 @@ func (kp *KeysPage) onDelete() {
 	}
 }
 
+func (kp *KeysPage) onAssignProfile() {
+	k := kp.listView.CurrentKey()
+	if k == nil {
+		return
+	}
+
+	current := k.Profile()
+	if current == "" {
+		current = keyman.DEFAULT_PROFILE
+	}
+	profile, ok := runKeyProfileDialog(kp.Form(), k.Name, kp.keyManager.ProfileNames(), current)
+	if !ok {
+		return
+	}
+
+	if err := kp.keyManager.SetKeyProfile(k, profile); err != nil {
+		showError(err, kp.Form())
+	}
+	kp.keyView.SetKey(k)
+}
+
+func (kp *KeysPage) onChangePIN() {
+	k := kp.listView.CurrentKey()
+	if k == nil {
+		return
+	}
+
+	var status string
+	if s, err := k.PINStatus(); err == nil && s.Retries >= 0 {
+		status = s.String()
+	}
+	oldPIN, newPIN, ok := runChangePINDialog(kp.Form(), k.Name, status, "")
+	if !ok {
+		return
+	}
+
+	if err := kp.keyManager.ChangeKeyPIN(k.Name, oldPIN, newPIN); err != nil {
+		showError(err, kp.Form())
+	}
+	kp.keyView.SetKey(k)
+}
+
+func (kp *KeysPage) onUnblockPIN() {
+	k := kp.listView.CurrentKey()
+	if k == nil {
+		return
+	}
+
+	s, err := k.PINStatus()
+	if err != nil {
+		showError(err, kp.Form())
+		return
+	}
+	if s.Unblock == "" {
+		showError(keyman.ErrUnblockNotSupported, kp.Form())
+		return
+	}
+	puk, newPIN, ok := runChangePINDialog(kp.Form(), k.Name, s.String(), s.Unblock)
+	if !ok {
+		return
+	}
+
+	if err := kp.keyManager.UnblockKeyPIN(k.Name, puk, newPIN); err != nil {
+		showError(err, kp.Form())
+	}
+	kp.keyView.SetKey(k)
+}
+
+func (kp *KeysPage) onExportAttestation() {
+	k := kp.listView.CurrentKey()
+	if k == nil {
+		return
+	}
+
+	dlg := walk.FileDialog{
+		Filter:   fmt.Sprintf("Attestation Bundles (*.json)|*.json|All Files (*.*)|*.*"),
+		Title:    fmt.Sprintf("Export TPM attestation of %s", k.Name),
+		FilePath: fmt.Sprintf("%s-attestation.json", k.Name),
+	}
+	if ok, _ := dlg.ShowSave(kp.Form()); !ok {
+		return
+	}
+
+	bundle, err := kp.keyManager.ExportAttestation(k.Name, nil)
+	if err == nil {
+		err = bundle.WriteFile(dlg.FilePath)
+	}
+	if err != nil {
+		showError(err, kp.Form())
+	}
+}
+
 func (kp *KeysPage) onAddCertificate() {
 	dlg := walk.FileDialog{
 		Filter: fmt.Sprintf("OpenSSH Key Files (*.pub)|*.pub|All Files (*.*)|*.*"),
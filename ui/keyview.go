@@ -1,3 +1,5 @@
+//go:build windows
+
 package ui
 
 import (
@@ -54,9 +56,13 @@ type keyInfoView struct {
 	keyType              *labelTextLine
 	keyAlgorithm         *labelTextLine
 	keyContainer         *labelTextLine
+	smartCard            *labelTextLine
+	keyProfile           *labelTextLine
+	keyScope             *labelTextLine
 	keyFingerprint       *labelTextLine
 	sshCertificateSerial *labelTextLine
 	sshPublicKeyLocation *labelTextLine
+	pinStatus            *labelTextLine
 	loadError            *labelTextLine
 
 	copyPublicKeyLocation *keyActionsButtonLine
@@ -70,7 +76,7 @@ func (kiv *keyInfoView) widgetsLines() []widgetsLine {
 
 func (kiv *keyInfoView) apply(ki *keyman.Key) {
 	kiv.currentKey = ki
-	kiv.keyType.show(ki.Type)
+	kiv.keyType.show(ki.TypeReadable())
 	kiv.keyAlgorithm.show(ki.SSHPublicKeyType())
 	if ki.SSHPublicKey != nil {
 		kiv.keyFingerprint.show(ki.SSHPublicKeyFingerprint())
@@ -89,8 +95,30 @@ func (kiv *keyInfoView) apply(ki *keyman.Key) {
 	} else {
 		kiv.keyContainer.hide()
 	}
+	if ki.SmartCard() != "" {
+		kiv.smartCard.show(ki.SmartCard())
+	} else {
+		kiv.smartCard.hide()
+	}
+	if ki.Profile() != "" {
+		kiv.keyProfile.show(ki.Profile())
+	} else {
+		kiv.keyProfile.show(keyman.DEFAULT_PROFILE)
+	}
+	if ki.Scope() == keyman.SCOPE_MACHINE {
+		kiv.keyScope.show("Machine")
+	} else {
+		kiv.keyScope.hide()
+	}
 	kiv.sshPublicKeyLocation.show(ki.SSHPublicKeyLocation)
 
+	// the tries left are read from the card without using the PIN
+	if status, err := ki.PINStatus(); err == nil && (status.Retries >= 0 || status.UnblockRetries >= 0) {
+		kiv.pinStatus.show(status.String())
+	} else {
+		kiv.pinStatus.hide()
+	}
+
 	if ki.LoadError != nil {
 		kiv.loadError.show(fmt.Sprintf("%s", ki.LoadError))
 	} else {
@@ -131,9 +159,13 @@ func newKeyInfoView(parent walk.Container) (*keyInfoView, error) {
 		{fmt.Sprintf("Key Type:"), &iv.keyType},
 		{fmt.Sprintf("Algorithm:"), &iv.keyAlgorithm},
 		{fmt.Sprintf("Container Name:"), &iv.keyContainer},
+		{fmt.Sprintf("Smart Card:"), &iv.smartCard},
+		{fmt.Sprintf("Profile:"), &iv.keyProfile},
+		{fmt.Sprintf("Scope:"), &iv.keyScope},
 		{fmt.Sprintf("Fingerprint:"), &iv.keyFingerprint},
 		{fmt.Sprintf("Certificate Serial:"), &iv.sshCertificateSerial},
 		{fmt.Sprintf("Public Key Location:"), &iv.sshPublicKeyLocation},
+		{fmt.Sprintf("PIN:"), &iv.pinStatus},
 		{fmt.Sprintf("Errors:"), &iv.loadError},
 	}
 	if iv.lines, err = createLabelTextLines(items, parent, &disposables); err != nil {
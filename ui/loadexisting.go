@@ -1,3 +1,5 @@
+//go:build windows
+
 package ui
 
 import (
@@ -15,6 +17,7 @@ type LoadExistingKey struct {
 	providerSelect   *walk.ComboBox
 	cardReaderSelect *walk.ComboBox
 	containerSelect  *walk.ComboBox
+	machineCheck     *walk.CheckBox
 
 	saveButton   *walk.PushButton
 	cancelButton *walk.PushButton
@@ -98,7 +101,15 @@ func newLoadExistingDialog(owner walk.Form, km *keyman.KeyManager) (*LoadExistin
 	if dlg.providerSelect, err = walk.NewDropDownBox(dlg); err != nil {
 		return nil, err
 	}
-	dlg.providerSelect.SetModel([]string{ncrypt.ProviderMSPlatform, ncrypt.ProviderMSSC})
+	// keys can be loaded from every installed provider, like Windows Hello keys from the passport provider
+	providerNames := []string{ncrypt.ProviderMSPlatform, ncrypt.ProviderMSSC}
+	if providers, err := km.NCryptProviders(); err == nil && len(providers) > 0 {
+		providerNames = nil
+		for _, p := range providers {
+			providerNames = append(providerNames, p.Name)
+		}
+	}
+	dlg.providerSelect.SetModel(providerNames)
 	dlg.providerSelect.SetCurrentIndex(0)
 	dlg.providerSelect.CurrentIndexChanged().Attach(dlg.onProviderChange)
 	dlg.providerSelect.SetAlignment(walk.AlignHFarVCenter)
@@ -142,11 +153,29 @@ func newLoadExistingDialog(owner walk.Form, km *keyman.KeyManager) (*LoadExistin
 	dlg.containerSelect.SetAlignment(walk.AlignHFarVCenter)
 	layout.SetRange(dlg.containerSelect, walk.Rectangle{1, 3, 1, 1})
 
+	//Setup the machine scope
+	machineLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(machineLabel, walk.Rectangle{0, 4, 1, 1})
+	machineLabel.SetTextAlignment(walk.AlignHFarVCenter)
+	machineLabel.SetText(fmt.Sprintf("&Machine key:"))
+
+	if dlg.machineCheck, err = walk.NewCheckBox(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.machineCheck, walk.Rectangle{1, 4, 1, 1})
+	dlg.machineCheck.SetChecked(false)
+	dlg.machineCheck.SetAlignment(walk.AlignHNearVCenter)
+
+	dlg.machineCheck.CheckedChanged().Attach(dlg.updateKeyList)
+
 	buttonsContainer, err := walk.NewComposite(dlg)
 	if err != nil {
 		return nil, err
 	}
-	layout.SetRange(buttonsContainer, walk.Rectangle{0, 4, 2, 1})
+	layout.SetRange(buttonsContainer, walk.Rectangle{0, 5, 2, 1})
 	buttonsContainer.SetLayout(walk.NewHBoxLayout())
 	buttonsContainer.Layout().SetMargins(walk.Margins{})
 
@@ -190,6 +219,13 @@ func (dlg *LoadExistingKey) onSaveButtonClicked() {
 		Algorithm:     algorithm,
 		ProviderName:  dlg.providerSelect.Text(),
 	}
+	if dlg.machineCheck.Checked() {
+		dlg.config.Scope = keyman.SCOPE_MACHINE
+	}
+	// a smart card key is bound to the card in the chosen reader when it is loaded
+	if dlg.config.ProviderName == ncrypt.ProviderMSSC {
+		dlg.config.Reader = dlg.cardReaderSelect.Text()
+	}
 
 	dlg.Accept()
 }
@@ -199,13 +235,14 @@ func (dlg *LoadExistingKey) onCardChange() {
 }
 
 func (dlg *LoadExistingKey) onProviderChange() {
-	if dlg.providerSelect.Text() == ncrypt.ProviderMSPlatform {
-		dlg.cardReaderLabel.SetVisible(false)
-		dlg.cardReaderSelect.SetVisible(false)
-	} else {
-		dlg.cardReaderLabel.SetVisible(true)
-		dlg.cardReaderSelect.SetVisible(true)
+	smartCard := dlg.providerSelect.Text() == ncrypt.ProviderMSSC
+	dlg.cardReaderLabel.SetVisible(smartCard)
+	dlg.cardReaderSelect.SetVisible(smartCard)
+	// smart cards have no machine key store
+	if smartCard {
+		dlg.machineCheck.SetChecked(false)
 	}
+	dlg.machineCheck.SetEnabled(!smartCard)
 
 	dlg.updateKeyList()
 }
@@ -221,7 +258,11 @@ func (dlg *LoadExistingKey) updateKeyList() {
 	if dlg.providerSelect.Text() == ncrypt.ProviderMSSC {
 		cardReader = dlg.cardReaderSelect.Text()
 	}
-	dlg.containerList, err = ncrypt.ListKeysOnProvider(dlg.providerSelect.Text(), cardReader)
+	var flags uint32
+	if dlg.machineCheck.Checked() {
+		flags = ncrypt.NCRYPT_MACHINE_KEY_FLAG
+	}
+	dlg.containerList, err = ncrypt.ListKeysOnProvider(dlg.providerSelect.Text(), cardReader, flags)
 
 	if err != nil {
 		showError(err, dlg)
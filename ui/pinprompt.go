@@ -0,0 +1,108 @@
+//go:build windows
+
+package ui
+
+import (
+	"fmt"
+	"github.com/lxn/walk"
+)
+
+type PINPrompt struct {
+	*walk.Dialog
+	pinEdit *walk.LineEdit
+	pin     string
+}
+
+// runPINPromptDialog asks for the PIN of a token the agent logs in to itself
+func runPINPromptDialog(owner walk.Form, title string, message string) (string, bool) {
+	dlg, err := newPINPromptDialog(owner, title, message)
+	if showError(err, owner) {
+		return "", false
+	}
+
+	if dlg.Run() == walk.DlgCmdOK {
+		return dlg.pin, true
+	}
+
+	return "", false
+}
+
+func newPINPromptDialog(owner walk.Form, title string, message string) (*PINPrompt, error) {
+	var err error
+	var disposables walk.Disposables
+	defer disposables.Treat()
+
+	dlg := new(PINPrompt)
+
+	layout := walk.NewGridLayout()
+	layout.SetSpacing(6)
+	layout.SetMargins(walk.Margins{10, 10, 10, 10})
+	layout.SetColumnStretchFactor(1, 3)
+
+	if dlg.Dialog, err = walk.NewDialog(owner); err != nil {
+		return nil, err
+	}
+	disposables.Add(dlg)
+	dlg.SetIcon(owner.Icon())
+	dlg.SetTitle(title)
+	dlg.SetLayout(layout)
+	dlg.SetMinMaxSize(walk.Size{400, 120}, walk.Size{0, 0})
+
+	infoLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(infoLabel, walk.Rectangle{0, 0, 2, 1})
+	infoLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	infoLabel.SetText(message)
+
+	pinLabel, err := walk.NewTextLabel(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(pinLabel, walk.Rectangle{0, 1, 1, 1})
+	pinLabel.SetTextAlignment(walk.AlignHNearVCenter)
+	pinLabel.SetText(fmt.Sprintf("&PIN:"))
+
+	if dlg.pinEdit, err = walk.NewLineEdit(dlg); err != nil {
+		return nil, err
+	}
+	layout.SetRange(dlg.pinEdit, walk.Rectangle{1, 1, 1, 1})
+	dlg.pinEdit.SetPasswordMode(true)
+
+	buttonsContainer, err := walk.NewComposite(dlg)
+	if err != nil {
+		return nil, err
+	}
+	layout.SetRange(buttonsContainer, walk.Rectangle{0, 2, 2, 1})
+	buttonsContainer.SetLayout(walk.NewHBoxLayout())
+	buttonsContainer.Layout().SetMargins(walk.Margins{})
+
+	walk.NewHSpacer(buttonsContainer)
+	okButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	okButton.SetText(fmt.Sprintf("&OK"))
+	okButton.Clicked().Attach(dlg.onOK)
+
+	cancelButton, err := walk.NewPushButton(buttonsContainer)
+	if err != nil {
+		return nil, err
+	}
+	cancelButton.SetText(fmt.Sprintf("Cancel"))
+	cancelButton.Clicked().Attach(dlg.Cancel)
+
+	dlg.SetCancelButton(cancelButton)
+	dlg.SetDefaultButton(okButton)
+
+	disposables.Spare()
+
+	return dlg, nil
+}
+
+func (dlg *PINPrompt) onOK() {
+	dlg.pin = dlg.pinEdit.Text()
+	dlg.pinEdit.SetText("")
+	dlg.Accept()
+}
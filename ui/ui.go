@@ -1,3 +1,5 @@
+//go:build windows
+
 /* SPDX-License-Identifier: MIT
  *
  * Copyright (C) 2019 WireGuard LLC. All Rights Reserved.
@@ -106,6 +108,26 @@ func RunUI() {
 	}()
 
 	km.SetNotifyChan(notifyChan)
+	km.SetConfirmHandler(func(title, message string) bool {
+		return walk.MsgBox(nil, title, message, walk.MsgBoxYesNo|walk.MsgBoxIconQuestion|walk.MsgBoxDefButton2|walk.MsgBoxTopMost|walk.MsgBoxSetForeground) == walk.DlgCmdYes
+	})
+	km.SetPINHandler(func(title, message string) ([]byte, bool) {
+		// signatures are requested from the listener goroutines, the dialog has to run on the UI thread
+		type pinResult struct {
+			pin string
+			ok  bool
+		}
+		result := make(chan pinResult, 1)
+		mkw.Synchronize(func() {
+			pin, ok := runPINPromptDialog(mkw, title, message)
+			result <- pinResult{pin, ok}
+		})
+		r := <-result
+		if !r.ok {
+			return nil, false
+		}
+		return []byte(r.pin), true
+	})
 
 	if km.GetUSBEventsEnabled() {
 		// register for usb insert/remove events